@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"go-phers-parser/internal/annotation"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/header"
+	"go-phers-parser/internal/intervals"
+	"go-phers-parser/internal/resources"
+	"go-phers-parser/vcf"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// adaptiveMAF picks the MAF threshold from the frequencies of the records in the region instead of
+// using a fixed --maf-threshold. The vcf stream can only be read once so the first pass copies the
+// records to a temporary file while it collects the frequencies and the second pass (the usual
+// parser) reads the copy
+//
+//	rarest:X   keep the rarest X of the records. X is a fraction (0.05) or a percentage (5%)
+//	ac:K       keep the records where the frequency is at most that of K copies of the allele in the
+//	           cohort (K divided by the largest AN of the region, or by twice the samples without AN)
+type adaptiveMAF struct {
+	Spec          string
+	Fraction      float64
+	AlleleCount   int
+	UseFraction   bool
+	Frequencies   []float64 // the frequency that the MAF filter uses for each record with a frequency
+	MaxAN         int
+	Unknown       int // records without a frequency. The --af-columns filter keeps these as rare but the INFO AF filter drops them
+	HeaderAlleles int
+}
+
+// parse_adaptive_maf parses the --adaptive-maf value. An empty value returns nil
+func parse_adaptive_maf(spec string) (*adaptiveMAF, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	mode, value, found := strings.Cut(spec, ":")
+	if !found {
+		return nil, fmt.Errorf("unable to parse the --adaptive-maf value %s. Use rarest:X (such as rarest:5%% or rarest:0.05) or ac:K (such as ac:3)", spec)
+	}
+	adaptive := &adaptiveMAF{Spec: spec}
+	switch mode {
+	case "rarest":
+		percent := strings.HasSuffix(value, "%")
+		fraction, parse_err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if percent {
+			fraction /= 100
+		}
+		if parse_err != nil || fraction <= 0 || fraction > 1 {
+			return nil, fmt.Errorf("the fraction of --adaptive-maf %s has to be above 0 and at most 1 (or 100%%)", spec)
+		}
+		adaptive.Fraction, adaptive.UseFraction = fraction, true
+	case "ac":
+		allele_count, parse_err := strconv.Atoi(value)
+		if parse_err != nil || allele_count < 1 {
+			return nil, fmt.Errorf("the allele count of --adaptive-maf %s has to be a whole number of at least 1", spec)
+		}
+		adaptive.AlleleCount = allele_count
+	default:
+		return nil, fmt.Errorf("the --adaptive-maf mode %s is not recognized. Allowed modes are rarest or ac", mode)
+	}
+	return adaptive, nil
+}
+
+// Threshold returns the MAF threshold that the frequencies of the first pass pick. The second value
+// is false when there were no frequencies to pick it from
+func (adaptive *adaptiveMAF) Threshold() (float64, bool) {
+	if !adaptive.UseFraction {
+		alleles := adaptive.MaxAN
+		if alleles == 0 {
+			alleles = adaptive.HeaderAlleles
+		}
+		if alleles == 0 {
+			return 0, false
+		}
+		return float64(adaptive.AlleleCount) / float64(alleles), true
+	}
+	if len(adaptive.Frequencies) == 0 {
+		return 0, false
+	}
+	sorted := slices.Clone(adaptive.Frequencies)
+	slices.Sort(sorted)
+	indx := max(int(math.Ceil(adaptive.Fraction*float64(len(sorted))))-1, 0)
+	return sorted[indx], true
+}
+
+// kept counts the records with a frequency that passes the threshold
+func (adaptive *adaptiveMAF) kept(threshold mafThreshold) int {
+	count := 0
+	for _, freq := range adaptive.Frequencies {
+		if threshold.passes(freq) {
+			count++
+		}
+	}
+	return count
+}
+
+// spool_spectrum is the first pass of --adaptive-maf. The records are copied to a temporary file
+// and the frequency that the MAF filter would use is collected for each record in the regions. The
+// returned scanner reads the copy and the file has to be closed once the parser is done with it
+func spool_spectrum(adaptive *adaptiveMAF, vcf_scanner *bufio.Scanner, buffersize int, metadata *header.Metadata, regions *intervals.Set, fold_af bool, anno_freq *AnnotationFrequency, annotations annotation.AnnotationSource, logger *slog.Logger) (*bufio.Scanner, *os.File, error) {
+	defer resources.StartStage("adaptive maf")()
+	spool, create_err := os.CreateTemp("", "go-vcf-parser-records-*.vcf")
+	if create_err != nil {
+		return nil, nil, fmt.Errorf("unable to create the temporary file that --adaptive-maf copies the records into: %w", create_err)
+	}
+	// Like the annotation database the file is removed right away so it is cleaned up even if the
+	// program exits early
+	os.Remove(spool.Name())
+	logger.Info(fmt.Sprintf("Copying the records of the vcf stream to a temporary file in %s to pick the --adaptive-maf threshold. Set TMPDIR to use a different directory", os.TempDir()))
+
+	info_decoder := vcf.NewInfoDecoder(metadata)
+	writer := bufio.NewWriterSize(spool, files.WriteBufferSize())
+	for vcf_scanner.Scan() {
+		line := vcf_scanner.Text()
+		writer.WriteString(line)
+		writer.WriteByte('\n')
+
+		// Malformed records are skipped here and reported by the parser in the second pass
+		fields := strings.SplitN(line, "\t", 9)
+		if len(fields) < 9 {
+			continue
+		}
+		pos, pos_err := strconv.Atoi(fields[1])
+		if pos_err != nil || (regions != nil && !regions.Overlaps(fields[0], pos, pos+len(fields[3])-1)) {
+			continue
+		}
+		info, info_err := info_decoder.Decode(fields[7], strings.Count(fields[4], ",")+1)
+		if info_err != nil {
+			continue
+		}
+		if an, found := info.Get("AN"); found {
+			if values, an_err := an.Ints(); an_err == nil && len(values) > 0 {
+				adaptive.MaxAN = max(adaptive.MaxAN, values[0])
+			}
+		}
+		freq := math.NaN()
+		if anno_freq != nil {
+			anno_values, _ := annotations.Lookup(fields[0], pos, fields[3], fields[4])
+			if anno_value, found := anno_freq.Frequency(anno_values); found {
+				freq = anno_value
+			}
+		} else if freqs, _, freq_err := allele_freqs(info); freq_err == nil {
+			freq = smallest_frequency(freqs, fold_af)
+		}
+		if math.IsNaN(freq) {
+			adaptive.Unknown++
+			continue
+		}
+		adaptive.Frequencies = append(adaptive.Frequencies, freq)
+	}
+	// A read error is left on the scanner of the stream so that the run is still reported as
+	// incomplete once the records that did arrive were parsed
+	if flush_err := writer.Flush(); flush_err != nil {
+		spool.Close()
+		return nil, nil, fmt.Errorf("unable to copy the records to the temporary file for --adaptive-maf: %w", flush_err)
+	}
+	if _, seek_err := spool.Seek(0, 0); seek_err != nil {
+		spool.Close()
+		return nil, nil, seek_err
+	}
+	records, _ := files.NewLineScanner(spool, buffersize)
+	return records, spool, nil
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import "testing"
+
+func TestAdaptiveMAF(t *testing.T) {
+	for _, spec := range []string{"rarest", "rarest:0", "rarest:150%", "ac:0", "ac:1.5", "quantile:0.1"} {
+		if _, parse_err := parse_adaptive_maf(spec); parse_err == nil {
+			t.Errorf("expected the --adaptive-maf value %s to be rejected", spec)
+		}
+	}
+
+	frequencies := []float64{0.3, 0.001, 0.02, 0.005, 0.1, 0.0001, 0.04, 0.2, 0.008, 0.05}
+	cases := []struct {
+		spec     string
+		max_an   int
+		expected float64
+	}{
+		// 10% of 10 records is the single rarest record
+		{"rarest:10%", 0, 0.0001},
+		{"rarest:0.3", 0, 0.005},
+		{"rarest:100%", 0, 0.3},
+		{"ac:2", 400, 0.005},
+		// Without AN the samples in the header are assumed to be diploid
+		{"ac:2", 0, 0.01},
+	}
+	for _, test_case := range cases {
+		adaptive, parse_err := parse_adaptive_maf(test_case.spec)
+		if parse_err != nil {
+			t.Fatalf("unable to parse %s: %s", test_case.spec, parse_err)
+		}
+		adaptive.Frequencies, adaptive.MaxAN, adaptive.HeaderAlleles = frequencies, test_case.max_an, 200
+		if threshold, picked := adaptive.Threshold(); !picked || threshold != test_case.expected {
+			t.Errorf("expected %s to pick %g but got %g", test_case.spec, test_case.expected, threshold)
+		}
+	}
+
+	if _, picked := (&adaptiveMAF{UseFraction: true, Fraction: 0.1}).Threshold(); picked {
+		t.Errorf("expected no threshold without any frequencies")
+	}
+}
@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/annotation"
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/intervals"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// vepAnnotations lets the annotations that were read from the VEP file be used as an
+// AnnotationSource. The VEP file is keyed by the Uploaded_variation column which uses ids
+// of the form chrom_pos_ref/alt
+type vepAnnotations map[string]VariantAnnotations
+
+func (annotations vepAnnotations) Lookup(chrom string, pos int, ref string, alt string) (map[string]string, error) {
+	anno, found := annotations[contig.VariantKey(fmt.Sprintf("%s_%d_%s/%s", chrom, pos, ref, alt))]
+	if !found {
+		return nil, nil
+	}
+	values := make(map[string]string, len(anno))
+	for col, value := range anno {
+		values[col] = value.String()
+	}
+	return values, nil
+}
+
+// new_variant_annotations keeps the requested columns from the values returned by the sources.
+// Columns that none of the sources had are written as - so that the columns of the output still line up
+func new_variant_annotations(values map[string]string, anno_cols []string) VariantAnnotations {
+	if len(values) == 0 {
+		return nil
+	}
+	annotations := make(VariantAnnotations, len(anno_cols))
+	found := false
+	for _, col := range anno_cols {
+		value_builder := &strings.Builder{}
+		if value, ok := values[col]; ok {
+			value_builder.WriteString(value)
+			found = true
+		} else {
+			value_builder.WriteString("-")
+		}
+		annotations[col] = value_builder
+	}
+	if !found {
+		return nil
+	}
+	return annotations
+}
+
+// open_annotation_sources reads the VEP file and opens the extra sources from --anno-source. The
+// VEP file comes first in the chain so its columns take precedence over the extra sources
+func open_annotation_sources(args internal.UserArgs, anno_cols []string, anno_regions *intervals.Set, anno_lift *annotationLiftover, logger *slog.Logger) (annotation.Chain, error) {
+	var sources annotation.Chain
+
+	// The VEP file is still required when there are no other sources
+	if args.AnnoFile != "" || len(args.AnnoSources) == 0 {
+		// With --max-memory the annotations are moved to the disk once they would use more than the budget
+		var max_bytes int64
+		if args.MaxMemory != "" {
+			parsed_size, size_err := parse_memory_size(args.MaxMemory)
+			if size_err != nil {
+				return nil, size_err
+			}
+			max_bytes = parsed_size
+		}
+		pos_cols, pos_err := parse_pos_cols(args.AnnoPosCols)
+		if pos_err != nil {
+			return nil, pos_err
+		}
+		// The columns that aren't in the VEP file may come from one of the other sources
+		lenient := args.Lenient || len(args.AnnoSources) > 0
+		// The --write-unannotated report uses the ids at each position to tell id mismatches apart from missing annotations
+		anno_store, anno_err := load_annotations(args.AnnoFile, anno_cols, pos_cols, anno_regions, anno_lift, max_bytes, lenient, args.WriteUnannotated, logger)
+		if anno_err != nil {
+			return nil, anno_err
+		}
+		sources = append(sources, anno_store)
+	}
+
+	for _, spec := range args.AnnoSources {
+		source, source_err := annotation.Open(spec)
+		if source_err != nil {
+			return nil, source_err
+		}
+		logger.Info(fmt.Sprintf("Looking up annotations in the source %s", spec))
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// vep_allele_matches checks if the Allele column of a VEP row is the alt allele. VEP removes the
+// first base of indels when it is shared with the reference and writes an empty allele as -
+func vep_allele_matches(ref string, alt string, allele string) bool {
+	if allele == alt {
+		return true
+	}
+	if ref == "" || alt == "" || ref[0] != alt[0] {
+		return false
+	}
+	trimmed := alt[1:]
+	return trimmed == allele || (trimmed == "" && allele == "-")
+}
+
+// allele_variant_id rewrites an id of the form chrom_pos_ref/alt1/alt2 to the id of the alt allele
+// in the Allele column. VEP uses the same Uploaded_variation for every allele of a multi-allelic
+// site so the rows of each allele would otherwise be merged together. The second value is false
+// when the id has alleles but none of them match the Allele column
+func allele_variant_id(variant_id string, allele string) (string, bool) {
+	parts := strings.SplitN(variant_id, "_", 3)
+	if len(parts) != 3 {
+		return variant_id, false
+	}
+	alleles := strings.FieldsFunc(parts[2], func(r rune) bool {
+		return r == '/' || r == ','
+	})
+	if len(alleles) < 2 {
+		return variant_id, false
+	}
+	for _, alt := range alleles[1:] {
+		if vep_allele_matches(alleles[0], alt, allele) {
+			return fmt.Sprintf("%s_%s_%s/%s", parts[0], parts[1], alleles[0], alt), true
+		}
+	}
+	return variant_id, false
+}
+
+// parse_keep_cols splits the --keep-cols value into the columns to read from the annotations and the
+// names that they are written under. A column can be renamed with NAME=ALIAS (such as CLIN_SIG=ClinVar)
+// so that reports don't need a separate rename step
+func parse_keep_cols(value string) ([]string, []string, map[string]string, error) {
+	var read_cols, output_cols []string
+	aliases := make(map[string]string)
+	for _, col := range strings.Split(value, ",") {
+		name, alias, renamed := strings.Cut(col, "=")
+		if !renamed {
+			read_cols = append(read_cols, col)
+			output_cols = append(output_cols, col)
+			continue
+		}
+		if name == "" || alias == "" {
+			return nil, nil, nil, fmt.Errorf("unable to parse the column %s of --keep-cols. Renamed columns have to be of the form NAME=ALIAS", col)
+		}
+		if existing, found := aliases[name]; found && existing != alias {
+			return nil, nil, nil, fmt.Errorf("the column %s was renamed to both %s and %s in --keep-cols", name, existing, alias)
+		}
+		aliases[name] = alias
+		read_cols = append(read_cols, name)
+		output_cols = append(output_cols, alias)
+	}
+	for indx, col := range output_cols {
+		if slices.Contains(output_cols[:indx], col) {
+			return nil, nil, nil, fmt.Errorf("the output column %s appears more than once in --keep-cols", col)
+		}
+	}
+	return read_cols, output_cols, aliases, nil
+}
+
+// aliasedAnnotations adds the --keep-cols aliases to the annotations of the sources. The original
+// names are kept as well so that options like --af-columns can still use the names in the file
+type aliasedAnnotations struct {
+	annotation.Chain
+	aliases map[string]string
+}
+
+func (sources aliasedAnnotations) Lookup(chrom string, pos int, ref string, alt string) (map[string]string, error) {
+	values, lookup_err := sources.Chain.Lookup(chrom, pos, ref, alt)
+	if len(sources.aliases) == 0 || values == nil {
+		return values, lookup_err
+	}
+	for name, alias := range sources.aliases {
+		if value, found := values[name]; found {
+			values[alias] = value
+		}
+	}
+	return values, lookup_err
+}
@@ -0,0 +1,329 @@
+package cmd
+
+import (
+	"fmt"
+	"go-phers-parser/internal/contig"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// entryOverhead is our estimate of what the map spends on each variant besides the key and the
+	// values (the map bucket, the inner map, and its header)
+	entryOverhead = 96
+	// columnOverhead is our estimate for each column of a variant (the string.Builder, the pointer
+	// to it, and the map slot)
+	columnOverhead = 64
+	// spillBatchSize is how many rows are written to the on-disk store in one transaction. bbolt
+	// keeps the pages of a transaction in memory until it is committed
+	spillBatchSize = 50000
+	// alleleSeparator separates the annotations of the alleles of a multi-allelic record. VEP already
+	// uses commas within the Consequence column so they can't be used here
+	alleleSeparator = "|"
+)
+
+var annotationBucket = []byte("annotations")
+
+// parse_memory_size parses sizes like 8G, 500M, 1.5GB, or a plain number of bytes. The units are
+// powers of 1024 to match what schedulers like SLURM mean by --mem=8G
+func parse_memory_size(value string) (int64, error) {
+	trimmed := strings.ToUpper(strings.TrimSpace(value))
+	trimmed = strings.TrimSuffix(trimmed, "B")
+
+	multiplier := int64(1)
+	for indx, unit := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(trimmed, unit) {
+			multiplier = int64(1) << (10 * (indx + 1))
+			trimmed = strings.TrimSuffix(trimmed, unit)
+			break
+		}
+	}
+
+	size, parse_err := strconv.ParseFloat(trimmed, 64)
+	if parse_err != nil || size <= 0 {
+		return 0, fmt.Errorf("unable to parse the memory size %s. Use a number of bytes or a number followed by K, M, G, or T (for example 8G)", value)
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+// annotationStore holds the annotations that were read from the VEP file. The annotations are kept
+// in a map until their estimated size passes the memory budget. At that point the map is moved
+// into a bbolt database in the temporary directory and the rest of the file is added to the
+// database instead. Lookups work the same way in both cases so the rest of the program doesn't
+// have to know where the annotations are
+type annotationStore struct {
+	memory    map[string]VariantAnnotations
+	cols      []string // the requested columns that are in the header of the annotation file
+	max_bytes int64    // the memory budget. A budget of 0 keeps everything in memory
+	bytes     int64    // the estimated size of the map
+	count     int      // the number of variants in the store
+	db        *bolt.DB
+	tx        *bolt.Tx
+	pending   int // rows written in the open transaction
+	// positions has the ids of the rows at each position (chrom:start) when they are tracked for
+	// the --write-unannotated report. It stays in memory even after the annotations are spilled
+	positions map[string][]string
+	logger    *slog.Logger
+}
+
+// maxPositionIDs is how many ids are kept for each position. A few are enough to show how the ids
+// of the annotation file differ from the ids of the vcf
+const maxPositionIDs = 3
+
+func newAnnotationStore(cols []string, max_bytes int64, logger *slog.Logger) *annotationStore {
+	return &annotationStore{memory: make(map[string]VariantAnnotations), cols: cols, max_bytes: max_bytes, logger: logger}
+}
+
+// add appends the values of one annotation row to the variant. Variants with several transcripts
+// show up on several rows so the values of each column are separated by a semicolon. The values
+// are in the same order as the columns of the store
+func (store *annotationStore) add(variant_key string, values []string) error {
+	if store.db != nil {
+		return store.add_to_disk(variant_key, values)
+	}
+
+	if variant_annotations := store.memory[variant_key]; variant_annotations != nil {
+		for indx, col := range store.cols {
+			variant_annotations[col].WriteString(fmt.Sprintf(";%s", values[indx]))
+			store.bytes += int64(len(values[indx]) + 1)
+		}
+	} else {
+		variant_annos := make(VariantAnnotations, len(store.cols))
+		store.bytes += int64(entryOverhead + len(variant_key))
+		for indx, col := range store.cols {
+			col_values := strings.Builder{}
+			col_values.WriteString(values[indx])
+			variant_annos[col] = &col_values
+			store.bytes += int64(columnOverhead + len(values[indx]))
+		}
+		store.memory[variant_key] = variant_annos
+		store.count++
+	}
+
+	if store.max_bytes > 0 && store.bytes > store.max_bytes {
+		return store.spill()
+	}
+	return nil
+}
+
+// add_position remembers the id of an annotation row at its position. pos_str is the position of
+// the row in the form chrom:start or chrom:start-end
+func (store *annotationStore) add_position(pos_str string, variant_id string) {
+	chrom, span, has_chrom := strings.Cut(pos_str, ":")
+	if store.positions == nil || !has_chrom {
+		return
+	}
+	start, _, _ := strings.Cut(span, "-")
+	key := fmt.Sprintf("%s:%s", contig.Canonical(chrom), start)
+	if ids := store.positions[key]; len(ids) < maxPositionIDs && !slices.Contains(ids, variant_id) {
+		store.positions[key] = append(ids, variant_id)
+	}
+}
+
+// spill moves the annotations in the map into a new on-disk database
+func (store *annotationStore) spill() error {
+	db_fh, create_err := os.CreateTemp("", "go-vcf-parser-annotations-*.db")
+	if create_err != nil {
+		return fmt.Errorf("the annotations passed the memory budget of %d bytes but we were unable to create a temporary file for them: %w", store.max_bytes, create_err)
+	}
+	db_path := db_fh.Name()
+	db_fh.Close()
+
+	store.logger.Warn(fmt.Sprintf("The annotations passed the memory budget of %d bytes after %d variants. Moving them to the temporary file %s. Lookups will be slower but memory use will stay under the budget. Set TMPDIR to use a different directory", store.max_bytes, store.count, db_path))
+
+	// Nothing else needs the database after the run so we don't pay for syncing it to the disk
+	db, open_err := bolt.Open(db_path, 0600, &bolt.Options{NoSync: true, NoGrowSync: true, NoFreelistSync: true})
+	if open_err != nil {
+		os.Remove(db_path)
+		return fmt.Errorf("unable to open the temporary annotation database %s: %w", db_path, open_err)
+	}
+	// We remove the file right away so that it is cleaned up even if the program exits early. The
+	// database keeps the file open so it can still read and write it
+	os.Remove(db_path)
+	store.db = db
+
+	for variant_key, variant_annotations := range store.memory {
+		values := make([]string, len(store.cols))
+		for indx, col := range store.cols {
+			values[indx] = variant_annotations[col].String()
+		}
+		if put_err := store.put(variant_key, values); put_err != nil {
+			return put_err
+		}
+	}
+	store.memory = nil
+	store.bytes = 0
+	return nil
+}
+
+// put writes the values of the variant to the open transaction. A new transaction is started every
+// spillBatchSize rows so that the pending pages don't use up the memory budget
+func (store *annotationStore) put(variant_key string, values []string) error {
+	if store.tx == nil {
+		tx, begin_err := store.db.Begin(true)
+		if begin_err != nil {
+			return fmt.Errorf("unable to write to the temporary annotation database: %w", begin_err)
+		}
+		if _, bucket_err := tx.CreateBucketIfNotExists(annotationBucket); bucket_err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to write to the temporary annotation database: %w", bucket_err)
+		}
+		store.tx = tx
+	}
+
+	// The values come from splitting a tab separated row so they can't have a tab in them
+	if put_err := store.tx.Bucket(annotationBucket).Put([]byte(variant_key), []byte(strings.Join(values, "\t"))); put_err != nil {
+		return fmt.Errorf("unable to write the annotations of %s to the temporary annotation database: %w", variant_key, put_err)
+	}
+
+	store.pending++
+	if store.pending >= spillBatchSize {
+		return store.commit()
+	}
+	return nil
+}
+
+// commit writes the open transaction to the database
+func (store *annotationStore) commit() error {
+	if store.tx == nil {
+		return nil
+	}
+	commit_err := store.tx.Commit()
+	store.tx = nil
+	store.pending = 0
+	if commit_err != nil {
+		return fmt.Errorf("unable to write to the temporary annotation database: %w", commit_err)
+	}
+	return nil
+}
+
+func (store *annotationStore) add_to_disk(variant_key string, values []string) error {
+	var existing []byte
+	if store.tx != nil {
+		existing = store.tx.Bucket(annotationBucket).Get([]byte(variant_key))
+	} else {
+		view_err := store.db.View(func(tx *bolt.Tx) error {
+			if value := tx.Bucket(annotationBucket).Get([]byte(variant_key)); value != nil {
+				existing = append([]byte{}, value...)
+			}
+			return nil
+		})
+		if view_err != nil {
+			return view_err
+		}
+	}
+
+	if existing == nil {
+		store.count++
+		return store.put(variant_key, values)
+	}
+
+	merged := strings.Split(string(existing), "\t")
+	for indx := range merged {
+		merged[indx] = fmt.Sprintf("%s;%s", merged[indx], values[indx])
+	}
+	return store.put(variant_key, merged)
+}
+
+// finish commits the rows that are still pending. It has to be called after the last add
+func (store *annotationStore) finish() error {
+	if store.db == nil {
+		return nil
+	}
+	return store.commit()
+}
+
+// Lookup returns the annotations of the alt allele. Records that weren't split have every alt allele
+// in the ALT column. The annotations of each allele are looked up on their own so that one allele
+// never gets the consequences of another. They are written in the same order as the alleles and
+// separated by alleleSeparator with - for the alleles that weren't annotated
+func (store *annotationStore) Lookup(chrom string, pos int, ref string, alt string) (map[string]string, error) {
+	alts := strings.Split(alt, ",")
+	if len(alts) == 1 {
+		return store.lookup_allele(chrom, pos, ref, alt)
+	}
+
+	allele_values := make([]map[string]string, len(alts))
+	found := false
+	for indx, allele := range alts {
+		values, lookup_err := store.lookup_allele(chrom, pos, ref, allele)
+		if lookup_err != nil {
+			return nil, lookup_err
+		}
+		allele_values[indx] = values
+		found = found || values != nil
+	}
+	if !found {
+		return nil, nil
+	}
+
+	values := make(map[string]string, len(store.cols))
+	col_values := make([]string, len(alts))
+	for _, col := range store.cols {
+		for indx := range alts {
+			col_values[indx] = missing_dash(allele_values[indx][col])
+		}
+		values[col] = strings.Join(col_values, alleleSeparator)
+	}
+	return values, nil
+}
+
+// lookup_allele returns the annotations of a single alt allele
+func (store *annotationStore) lookup_allele(chrom string, pos int, ref string, alt string) (map[string]string, error) {
+	if store.db == nil {
+		return vepAnnotations(store.memory).Lookup(chrom, pos, ref, alt)
+	}
+
+	var values map[string]string
+	view_err := store.db.View(func(tx *bolt.Tx) error {
+		stored := tx.Bucket(annotationBucket).Get([]byte(contig.VariantKey(fmt.Sprintf("%s_%d_%s/%s", chrom, pos, ref, alt))))
+		if stored == nil {
+			return nil
+		}
+		values = make(map[string]string, len(store.cols))
+		for indx, value := range strings.Split(string(stored), "\t") {
+			values[store.cols[indx]] = value
+		}
+		return nil
+	})
+	return values, view_err
+}
+
+// each calls visit with the key and the values (in the order of the columns of the store) of every
+// variant. The variants are not visited in the order of the file. finish has to be called first
+func (store *annotationStore) each(visit func(variant_key string, values []string) error) error {
+	if store.db == nil {
+		values := make([]string, len(store.cols))
+		for variant_key, variant_annotations := range store.memory {
+			for indx, col := range store.cols {
+				values[indx] = variant_annotations[col].String()
+			}
+			if visit_err := visit(variant_key, values); visit_err != nil {
+				return visit_err
+			}
+		}
+		return nil
+	}
+	return store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(annotationBucket).ForEach(func(key []byte, stored []byte) error {
+			return visit(string(key), strings.Split(string(stored), "\t"))
+		})
+	})
+}
+
+// Close closes the on-disk database if the annotations were moved to one
+func (store *annotationStore) Close() error {
+	if store.db == nil {
+		return nil
+	}
+	if store.tx != nil {
+		store.tx.Rollback()
+		store.tx = nil
+	}
+	return store.db.Close()
+}
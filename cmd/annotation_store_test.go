@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"testing"
+
+	"go-phers-parser/internal/contig"
+)
+
+func TestAnnotationStoreSpill(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cols := []string{"Consequence", "SYMBOL"}
+
+	in_memory := newAnnotationStore(cols, 0, logger)
+	// The tiny budget moves the annotations to the disk after the first few variants
+	spilled := newAnnotationStore(cols, 512, logger)
+
+	add := func(id string, values ...string) {
+		t.Helper()
+		for _, store := range []*annotationStore{in_memory, spilled} {
+			if add_err := store.add(contig.VariantKey(id), values); add_err != nil {
+				t.Fatalf("unable to add the annotations of %s: %s", id, add_err)
+			}
+		}
+	}
+	for pos := 100; pos < 300; pos++ {
+		add(fmt.Sprintf("chr22_%d_A/G", pos), "missense_variant", fmt.Sprintf("GENE%d", pos))
+	}
+	// A second transcript of a variant that was moved to the disk in the same transaction
+	add("chr22_100_A/G", "intron_variant", "GENE100B")
+	// and one after the transaction was committed like at the end of a batch
+	if commit_err := spilled.commit(); commit_err != nil {
+		t.Fatalf("unable to commit the pending rows: %s", commit_err)
+	}
+	add("chr22_101_A/G", "splice_region_variant", "GENE101B")
+	add("chr22_150_A/T", "stop_gained", "GENE150")
+
+	for _, store := range []*annotationStore{in_memory, spilled} {
+		if finish_err := store.finish(); finish_err != nil {
+			t.Fatalf("unable to finish the store: %s", finish_err)
+		}
+	}
+	defer spilled.Close()
+	if spilled.db == nil || in_memory.db != nil {
+		t.Fatalf("expected only the store with the tiny budget to spill to the disk")
+	}
+	if spilled.count != in_memory.count {
+		t.Errorf("expected both stores to count %d variants but the spilled store counted %d", in_memory.count, spilled.count)
+	}
+
+	lookups := []struct {
+		chrom string
+		pos   int
+		ref   string
+		alt   string
+	}{
+		{"chr22", 100, "A", "G"},
+		{"22", 101, "A", "G"},
+		{"chr22", 299, "A", "G"},
+		{"chr22", 150, "A", "T,G"}, // a record with both alleles
+		{"chr22", 150, "A", "C"},   // not annotated
+		{"chr22", 99, "A", "G"},
+	}
+	for _, lookup := range lookups {
+		expected, expected_err := in_memory.Lookup(lookup.chrom, lookup.pos, lookup.ref, lookup.alt)
+		found, found_err := spilled.Lookup(lookup.chrom, lookup.pos, lookup.ref, lookup.alt)
+		if expected_err != nil || found_err != nil {
+			t.Fatalf("unable to look up %+v: %v %v", lookup, expected_err, found_err)
+		}
+		if !maps.Equal(expected, found) {
+			t.Errorf("expected the spilled lookup of %+v to match the map %v but got %v", lookup, expected, found)
+		}
+	}
+	if values, _ := spilled.Lookup("chr22", 100, "A", "G"); values["SYMBOL"] != "GENE100;GENE100B" {
+		t.Errorf("expected the transcripts of the variant to be merged but found %v", values)
+	}
+
+	visited := make(map[string]string)
+	spilled.each(func(variant_key string, values []string) error {
+		visited[variant_key] = fmt.Sprint(values)
+		return nil
+	})
+	in_memory.each(func(variant_key string, values []string) error {
+		if visited[variant_key] != fmt.Sprint(values) {
+			t.Errorf("expected the spilled store to have %v for %s but found %s", values, variant_key, visited[variant_key])
+		}
+		delete(visited, variant_key)
+		return nil
+	})
+	if len(visited) != 0 {
+		t.Errorf("the spilled store has variants that aren't in the map: %v", visited)
+	}
+}
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+)
+
+// bcftoolsStderrLines is how many of the last stderr lines of bcftools are added to the error if it fails
+const bcftoolsStderrLines = 5
+
+// bcftoolsLog writes every line that bcftools prints to stderr into the log. The last lines are
+// kept so that they can be added to the error if bcftools fails
+type bcftoolsLog struct {
+	logger  *slog.Logger
+	partial []byte
+	last    []string
+}
+
+func (stderr_log *bcftoolsLog) Write(p []byte) (int, error) {
+	stderr_log.partial = append(stderr_log.partial, p...)
+	for {
+		indx := bytes.IndexByte(stderr_log.partial, '\n')
+		if indx == -1 {
+			break
+		}
+		stderr_log.add_line(string(stderr_log.partial[:indx]))
+		stderr_log.partial = stderr_log.partial[indx+1:]
+	}
+	return len(p), nil
+}
+
+func (stderr_log *bcftoolsLog) add_line(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	stderr_log.logger.Warn(fmt.Sprintf("bcftools: %s", line))
+	stderr_log.last = append(stderr_log.last, line)
+	if len(stderr_log.last) > bcftoolsStderrLines {
+		stderr_log.last = stderr_log.last[1:]
+	}
+}
+
+// bcftoolsInput is the bcftools view process that pull-variants starts for the --vcf-file. Its
+// stdout is read in place of standard input
+type bcftoolsInput struct {
+	Stdout  io.ReadCloser
+	Command string // the command line that was run so it can be recorded in the manifest
+	command *exec.Cmd
+	stderr  *bcftoolsLog
+}
+
+// bcftools_view_args builds the arguments of bcftools view. The region uses the chromosome name
+// from the vcf header because bcftools doesn't match chr22 with 22. A --regions-file replaces the region
+func bcftools_view_args(args internal.UserArgs, region string) []string {
+	view_args := []string{"view", "-Ov"}
+	if args.RegionsFile != "" {
+		// bcftools uses the same index check for the regions file as for the region
+		region_args := bcftools_region_args(args.VcfFile, args.RegionsFile)
+		view_args = append(view_args, strings.ToUpper(region_args[0]), region_args[1])
+	} else {
+		view_args = append(view_args, bcftools_region_args(args.VcfFile, region)...)
+	}
+	// Samples that aren't in the vcf are only a warning (like when the samples are selected without bcftools)
+	if args.Samples != "" {
+		view_args = append(view_args, "-s", args.Samples, "--force-samples")
+	} else if args.SamplesFile != "" {
+		view_args = append(view_args, "-S", args.SamplesFile, "--force-samples")
+	}
+	return append(view_args, args.VcfFile)
+}
+
+// start_bcftools_input starts bcftools view on the --vcf-file for the region. The header of the
+// vcf is read first so that the region can use the chromosome name of the vcf
+func start_bcftools_input(args internal.UserArgs, region Region, logger *slog.Logger) (*bcftoolsInput, error) {
+	bcftools_path := cmp.Or(args.BcftoolsPath, "bcftools")
+	resolved_path, path_err := exec.LookPath(bcftools_path)
+	if path_err != nil {
+		return nil, fmt.Errorf("the --vcf-file is read with bcftools but %s could not be found. Use --bcftools-path to point to the bcftools executable. %w", bcftools_path, path_err)
+	}
+
+	vcf_reader := &files.VCFReader{FileReader: *files.Open(args.VcfFile, files.AutoBuffersize)}
+	defer vcf_reader.Close()
+	if vcf_reader.Err != nil {
+		return nil, fmt.Errorf("unable to open the vcf file %s: %w", args.VcfFile, vcf_reader.Err)
+	}
+	if header_err := vcf_reader.ParseHeader("#CHROM"); header_err != nil || !vcf_reader.Header_Found {
+		return nil, fmt.Errorf("unable to find the #CHROM header line in the vcf file %s. %v", args.VcfFile, header_err)
+	}
+
+	view_args := bcftools_view_args(args, bcftools_region(&vcf_reader.Metadata, region))
+	if view_args[2] == "-t" || view_args[2] == "-T" {
+		logger.Warn(fmt.Sprintf("The vcf file %s does not have a .tbi or .csi index next to it so bcftools has to read the whole file to find the records in the region", args.VcfFile))
+	}
+
+	command := exec.Command(resolved_path, view_args...)
+	stderr := &bcftoolsLog{logger: logger}
+	command.Stderr = stderr
+	stdout, pipe_err := command.StdoutPipe()
+	if pipe_err != nil {
+		return nil, pipe_err
+	}
+	logger.Info(fmt.Sprintf("Running: %s %s", resolved_path, strings.Join(view_args, " ")))
+	if start_err := command.Start(); start_err != nil {
+		return nil, fmt.Errorf("unable to start bcftools: %w", start_err)
+	}
+	return &bcftoolsInput{Stdout: stdout, Command: fmt.Sprintf("%s %s", resolved_path, strings.Join(view_args, " ")), command: command, stderr: stderr}, nil
+}
+
+// Wait waits for bcftools to exit once its output has been read. The output is closed first so
+// that a bcftools that is still writing (because the parser stopped early) doesn't block forever.
+// The error has the last lines that bcftools printed to stderr
+func (input *bcftoolsInput) Wait() error {
+	input.Stdout.Close()
+	if wait_err := input.command.Wait(); wait_err != nil {
+		return fmt.Errorf("bcftools view failed with %w: %s", wait_err, strings.Join(input.stderr.last, " | "))
+	}
+	return nil
+}
+
+// ExitStatus describes how bcftools exited (such as "exit status 1" or "signal: broken pipe").
+// It is only set after Wait
+func (input *bcftoolsInput) ExitStatus() string {
+	if input.command.ProcessState == nil {
+		return ""
+	}
+	return input.command.ProcessState.String()
+}
+
+// vcfInput is the stream that pull-variants reads the vcf from. It is standard input or the output
+// of the bcftools process that pull-variants started for the --vcf-file
+type vcfInput struct {
+	tail     *files.StreamTail
+	bcftools *bcftoolsInput
+}
+
+func new_vcf_input(reader io.Reader, bcftools *bcftoolsInput) *vcfInput {
+	return &vcfInput{tail: files.NewStreamTail(reader), bcftools: bcftools}
+}
+
+func (input *vcfInput) Read(p []byte) (int, error) {
+	return input.tail.Read(p)
+}
+
+// Finish is called once the parser has stopped reading the stream. It waits for bcftools (if it
+// was started) and decides if the whole stream arrived. When the vcf is piped in the exit status of
+// the upstream process can't be seen so a read error or a record that was cut off is the only sign
+func (input *vcfInput) Finish(scan_err error) manifest.Input {
+	status := manifest.Input{Source: "standard input", Bytes: input.tail.Bytes(), Complete: true}
+	var problems []string
+	if scan_err != nil {
+		problems = append(problems, fmt.Sprintf("The stream could not be read: %s", scan_err))
+	} else if input.tail.Truncated() {
+		problems = append(problems, "The last line does not end with a newline so the stream was cut off in the middle of a record")
+	}
+	if input.bcftools != nil {
+		status.Source = input.bcftools.Command
+		// bcftools is killed by SIGPIPE if the parser stopped early because of a read error. That
+		// error is already in the problems so the broken pipe is only added to it
+		if wait_err := input.bcftools.Wait(); wait_err != nil {
+			problems = append(problems, wait_err.Error())
+		}
+		status.ExitStatus = input.bcftools.ExitStatus()
+	}
+	if len(problems) > 0 {
+		status.Complete = false
+		status.Error = strings.Join(problems, ". ")
+	}
+	return status
+}
@@ -0,0 +1,371 @@
+package cmd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-phers-parser/vcf"
+
+	"github.com/klauspost/pgzip"
+)
+
+// benchDecompressors are the readers that --decompressors can time
+var benchDecompressors = []string{"gzip", "pgzip", "bgzf"}
+
+// BenchResult is the timing of one target with one buffer size and worker count
+type BenchResult struct {
+	Target     string
+	Buffersize int
+	Workers    int
+	Duration   time.Duration
+	Records    int
+	AllocBytes uint64
+	Err        error
+}
+
+// RecordsPerSecond is the throughput of the run. Failed runs have a throughput of 0
+func (result BenchResult) RecordsPerSecond() float64 {
+	if result.Err != nil || result.Duration <= 0 {
+		return 0
+	}
+	return float64(result.Records) / result.Duration.Seconds()
+}
+
+// parse_int_list parses a comma separated list of positive integers like "1,2,4"
+func parse_int_list(value string, flag_name string) ([]int, error) {
+	var values []int
+	for _, item := range strings.Split(value, ",") {
+		parsed, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || parsed < 1 {
+			return nil, fmt.Errorf("the value %s of the --%s flag has to be a comma separated list of positive integers", value, flag_name)
+		}
+		values = append(values, parsed)
+	}
+	return values, nil
+}
+
+// bench_vcf reads every record of the vcf and does the same work as the pull-variants parser for
+// each record: the columns and the INFO keys are parsed and the calls are checked for a carrier
+func bench_vcf(vcf_file string, buffersize int) (int, error) {
+	reader, open_err := vcf.Open(vcf_file, buffersize)
+	if open_err != nil {
+		return 0, open_err
+	}
+	defer reader.Close()
+
+	classifier := vcf.HardCall{}
+	records := 0
+	for {
+		variant, read_err := reader.Read()
+		if errors.Is(read_err, io.EOF) {
+			return records, nil
+		} else if errors.Is(read_err, vcf.ErrMalformedRecord) {
+			continue
+		} else if read_err != nil {
+			return records, read_err
+		}
+		records++
+
+		parse_genotype_calls(classifier, variant.FormatString(), variant.Calls)
+	}
+}
+
+// bench_annotations reads the annotations of the region with the same reader as pull-variants
+func bench_annotations(anno_file string, keep_cols []string, region Region, buffersize int) (int, error) {
+	annotationBuffersize = buffersize
+	// The reader logs every file that it reads which would drown out the results
+	annotations, anno_err := read_annotations(anno_file, keep_cols, region, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	return len(annotations), anno_err
+}
+
+// parse_decompressors parses the comma separated --decompressors value. "none" skips the decompression timings
+func parse_decompressors(value string) ([]string, error) {
+	if strings.EqualFold(strings.TrimSpace(value), "none") {
+		return nil, nil
+	}
+	var decompressors []string
+	for _, item := range strings.Split(value, ",") {
+		name := strings.ToLower(strings.TrimSpace(item))
+		if !slices.Contains(benchDecompressors, name) {
+			return nil, fmt.Errorf("the value %s of the --decompressors flag has to be a comma separated list of %s or none", value, strings.Join(benchDecompressors, ", "))
+		}
+		decompressors = append(decompressors, name)
+	}
+	return decompressors, nil
+}
+
+// open_decompressor opens the gzipped file with one of the benchDecompressors. The returned
+// function closes the decompressor and the file
+func open_decompressor(filename string, decompressor string) (io.Reader, func(), error) {
+	fh, open_err := files.OpenSource(filename)
+	if open_err != nil {
+		return nil, nil, fmt.Errorf("unable to open the file %s: %w", filename, open_err)
+	}
+	// The parallel readers use every thread that the run has (GOMAXPROCS) like --decomp-threads does by default
+	var gh io.ReadCloser
+	var gzip_err error
+	switch decompressor {
+	case "gzip":
+		gh, gzip_err = gzip.NewReader(fh)
+	case "pgzip":
+		gh, gzip_err = pgzip.NewReaderN(fh, files.Decompression.BlockSize, max(runtime.GOMAXPROCS(0), 2))
+	default:
+		gh = files.NewBGZFReader(fh, runtime.GOMAXPROCS(0))
+	}
+	if gzip_err != nil {
+		fh.Close()
+		return nil, nil, fmt.Errorf("unable to decompress the file %s with %s: %w", filename, decompressor, gzip_err)
+	}
+	return gh, func() {
+		gh.Close()
+		fh.Close()
+	}, nil
+}
+
+// bench_decompress reads every line of the gzipped file with the decompressor. Only the
+// decompression and the line splitting are timed so the readers can be compared without the parsers
+func bench_decompress(filename string, decompressor string, buffersize int) (int, error) {
+	reader, close_reader, open_err := open_decompressor(filename, decompressor)
+	if open_err != nil {
+		return 0, open_err
+	}
+	defer close_reader()
+
+	scanner, _ := files.NewLineScanner(reader, buffersize)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+	}
+	return lines, scanner.Err()
+}
+
+// decompress_inputs returns the inputs that the decompressors can be timed on. Plain text inputs
+// and standard input are skipped and bgzf is only timed on bgzipped inputs
+func decompress_inputs(args internal.UserArgs, decompressors []string, logger *slog.Logger) map[string][]string {
+	inputs := make(map[string][]string)
+	for _, input := range []struct{ target, filename string }{{"vcf", args.VcfFile}, {"annotations", args.AnnoFile}} {
+		if input.filename == "" || input.filename == "-" || len(decompressors) == 0 {
+			continue
+		}
+		fr := files.Open(input.filename, files.AutoBuffersize)
+		format := fr.Format
+		fr.Close()
+		if fr.Err != nil || format == files.PlainText {
+			logger.Info(fmt.Sprintf("The decompression of %s is not timed because it is not gzipped", input.filename))
+			continue
+		}
+		for _, decompressor := range decompressors {
+			if decompressor == "bgzf" && format != files.BGZF {
+				logger.Info(fmt.Sprintf("The bgzf reader is not timed on %s because it is gzipped but not bgzipped", input.filename))
+				continue
+			}
+			inputs[input.target] = append(inputs[input.target], decompressor)
+		}
+	}
+	return inputs
+}
+
+// run_bench times fn with the worker count. The worker count is the number of threads that the go
+// runtime can use (GOMAXPROCS) which limits the parallel decompression and the garbage collector
+func run_bench(target string, buffersize int, workers int, fn func() (int, error)) BenchResult {
+	previous_workers := runtime.GOMAXPROCS(workers)
+	defer runtime.GOMAXPROCS(previous_workers)
+
+	// Start each run with a clean heap so that the allocations of a run don't slow down the next one
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	start := time.Now()
+	records, err := fn()
+	duration := time.Since(start)
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+
+	return BenchResult{Target: target, Buffersize: buffersize, Workers: workers, Duration: duration, Records: records, AllocBytes: after.TotalAlloc - before.TotalAlloc, Err: err}
+}
+
+// recommend picks the settings for a target. Differences of a few percent are usually noise so we
+// take the smallest buffer and the fewest workers that are within 5% of the fastest run. Smaller
+// buffers use less memory and fewer workers leave room for the other jobs on the node
+func recommend(results []BenchResult, target string) (BenchResult, bool) {
+	best := 0.0
+	for _, result := range results {
+		if result.Target == target {
+			best = max(best, result.RecordsPerSecond())
+		}
+	}
+	if best == 0 {
+		return BenchResult{}, false
+	}
+
+	var picked BenchResult
+	found := false
+	for _, result := range results {
+		if result.Target != target || result.RecordsPerSecond() < best*0.95 {
+			continue
+		}
+		if !found || result.Buffersize < picked.Buffersize || (result.Buffersize == picked.Buffersize && result.Workers < picked.Workers) {
+			picked = result
+			found = true
+		}
+	}
+	return picked, found
+}
+
+// Bench times the vcf parser and the annotation reader on the user's files with every combination
+// of the buffer sizes and worker counts. The timings are written to the output as a table and the
+// CPU and heap profiles of the whole benchmark are written next to it so that they can be opened
+// with go tool pprof. The settings that we recommend are written to the log and standard output
+func Bench(args internal.UserArgs, logger *slog.Logger) {
+	if args.VcfFile == "" && args.AnnoFile == "" {
+		logger.Error("The bench command needs a --vcf-file, an --anno-file, or both to have something to time")
+		os.Exit(1)
+	}
+
+	buffersizes, buffer_err := parse_int_list(args.BenchBuffersizes, "buffer-sizes")
+	workers, workers_err := parse_int_list(args.BenchWorkers, "workers")
+	decompressors, decompressors_err := parse_decompressors(args.BenchDecompressors)
+	for _, err := range []error{buffer_err, workers_err, decompressors_err} {
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var region Region
+	if args.AnnoFile != "" {
+		parsed_region, region_err := parse_region(args.Region)
+		if region_err != nil {
+			logger.Error(fmt.Sprintf("The annotation reader is timed for a region so the --region flag has to be of the form chrX:start-end. %v", region_err))
+			os.Exit(1)
+		}
+		region = parsed_region
+	}
+	keep_cols := strings.Split(args.ColsToKeep, ",")
+	decompress_targets := decompress_inputs(args, decompressors, logger)
+	input_files := map[string]string{"vcf": args.VcfFile, "annotations": args.AnnoFile}
+
+	cpu_profile := fmt.Sprintf("%s.cpu.pprof", args.OutputFile)
+	cpu_fh, cpu_err := os.Create(cpu_profile)
+	if cpu_err != nil {
+		logger.Error(fmt.Sprintf("Unable to create the CPU profile %s. %s", cpu_profile, cpu_err))
+		os.Exit(1)
+	}
+	manifest.Track(cpu_profile)
+	if profile_err := pprof.StartCPUProfile(cpu_fh); profile_err != nil {
+		logger.Error(fmt.Sprintf("Unable to start the CPU profile. %s", profile_err))
+		os.Exit(1)
+	}
+
+	var results []BenchResult
+	for _, buffersize := range buffersizes {
+		for _, worker_count := range workers {
+			for repeat := 0; repeat < max(args.BenchRepeat, 1); repeat++ {
+				if args.VcfFile != "" {
+					result := run_bench("vcf", buffersize, worker_count, func() (int, error) { return bench_vcf(args.VcfFile, buffersize) })
+					logger.Info(fmt.Sprintf("vcf parser with a buffer of %d bytes and %d workers: %d records in %s (%v)", buffersize, worker_count, result.Records, result.Duration, result.Err))
+					results = append(results, result)
+				}
+				if args.AnnoFile != "" {
+					result := run_bench("annotations", buffersize, worker_count, func() (int, error) {
+						return bench_annotations(args.AnnoFile, keep_cols, region, buffersize)
+					})
+					logger.Info(fmt.Sprintf("annotation reader with a buffer of %d bytes and %d workers: %d annotations in %s (%v)", buffersize, worker_count, result.Records, result.Duration, result.Err))
+					results = append(results, result)
+				}
+				// The decompression timings use the target name of the input and the reader (vcf-pgzip)
+				for _, input := range []string{"vcf", "annotations"} {
+					for _, decompressor := range decompress_targets[input] {
+						result := run_bench(input+"-"+decompressor, buffersize, worker_count, func() (int, error) {
+							return bench_decompress(input_files[input], decompressor, buffersize)
+						})
+						logger.Info(fmt.Sprintf("%s reader for the %s file with a buffer of %d bytes and %d workers: %d lines in %s (%v)", decompressor, input, buffersize, worker_count, result.Records, result.Duration, result.Err))
+						results = append(results, result)
+					}
+				}
+			}
+		}
+	}
+
+	pprof.StopCPUProfile()
+	cpu_fh.Close()
+
+	heap_profile := fmt.Sprintf("%s.heap.pprof", args.OutputFile)
+	if heap_fh, heap_err := os.Create(heap_profile); heap_err != nil {
+		logger.Error(fmt.Sprintf("Unable to create the heap profile %s. %s", heap_profile, heap_err))
+	} else {
+		manifest.Track(heap_profile)
+		pprof.Lookup("allocs").WriteTo(heap_fh, 0)
+		heap_fh.Close()
+	}
+
+	output_fh, output_err := files.Create(args.OutputFile)
+	manifest.Track(args.OutputFile)
+	if output_err != nil {
+		logger.Error(fmt.Sprintf("There was an issue trying to create the output file: %s\n", args.OutputFile))
+		os.Exit(1)
+	}
+	defer output_fh.Close()
+
+	writer := bufio.NewWriter(output_fh)
+	defer writer.Flush()
+
+	writer.WriteString("TARGET\tBUFFERSIZE\tWORKERS\tSECONDS\tRECORDS\tRECORDS_PER_SECOND\tALLOCATED_MB\tERROR\n")
+	for _, result := range results {
+		error_str := "-"
+		if result.Err != nil {
+			error_str = strings.ReplaceAll(result.Err.Error(), "\t", " ")
+		}
+		writer.WriteString(fmt.Sprintf("%s\t%d\t%d\t%.3f\t%d\t%.1f\t%.1f\t%s\n", result.Target, result.Buffersize, result.Workers, result.Duration.Seconds(), result.Records, result.RecordsPerSecond(), float64(result.AllocBytes)/(1024*1024), error_str))
+	}
+
+	for _, target := range []string{"vcf", "annotations"} {
+		picked, found := recommend(results, target)
+		switch {
+		case !found && slices.ContainsFunc(results, func(result BenchResult) bool { return result.Target == target }):
+			logger.Warn(fmt.Sprintf("Every run of the %s benchmark failed so there is no recommendation. The errors are in %s", target, args.OutputFile))
+		case !found:
+			continue
+		case target == "vcf":
+			recommendation := fmt.Sprintf("Recommended settings for the vcf parser: --buffersize %d with GOMAXPROCS=%d (%.0f records per second)", picked.Buffersize, picked.Workers, picked.RecordsPerSecond())
+			logger.Info(recommendation)
+			fmt.Println(recommendation)
+		default:
+			recommendation := fmt.Sprintf("The annotation reader was fastest with a buffer of %d bytes and GOMAXPROCS=%d (%.0f annotations per second)", picked.Buffersize, picked.Workers, picked.RecordsPerSecond())
+			logger.Info(recommendation)
+			fmt.Println(recommendation)
+		}
+	}
+
+	for _, input := range []string{"vcf", "annotations"} {
+		var fastest BenchResult
+		for _, decompressor := range decompress_targets[input] {
+			if picked, found := recommend(results, input+"-"+decompressor); found && picked.RecordsPerSecond() > fastest.RecordsPerSecond() {
+				fastest = picked
+			}
+		}
+		if fastest.Target != "" {
+			recommendation := fmt.Sprintf("The %s reader decompressed the %s file the fastest with a buffer of %d bytes and GOMAXPROCS=%d (%.0f lines per second). Use --decomp-threads %d to decompress with this many threads", strings.TrimPrefix(fastest.Target, input+"-"), input, fastest.Buffersize, fastest.Workers, fastest.RecordsPerSecond(), fastest.Workers)
+			logger.Info(recommendation)
+			fmt.Println(recommendation)
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Wrote the timings to %s and the profiles to %s and %s. Open the profiles with 'go tool pprof'", args.OutputFile, cpu_profile, heap_profile))
+}
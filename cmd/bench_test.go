@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBenchDecompress(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "calls.vcf.gz")
+	// Every BGZF block is a gzip member with a BC subfield that holds the size of the block minus 1
+	var bgzipped bytes.Buffer
+	for _, chunk := range []string{strings.Repeat("chr22\t100\tvar1\tA\tG\n", 500), strings.Repeat("chr22\t100\tvar1\tA\tG\n", 500), ""} {
+		var block bytes.Buffer
+		gw := gzip.NewWriter(&block)
+		gw.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+		gw.Write([]byte(chunk))
+		gw.Close()
+		binary.LittleEndian.PutUint16(block.Bytes()[16:18], uint16(block.Len()-1))
+		bgzipped.Write(block.Bytes())
+	}
+	if write_err := os.WriteFile(filename, bgzipped.Bytes(), 0644); write_err != nil {
+		t.Fatalf("unable to write the fixture: %s", write_err)
+	}
+
+	// Every reader has to see the same lines
+	for _, decompressor := range benchDecompressors {
+		lines, read_err := bench_decompress(filename, decompressor, 1024)
+		if read_err != nil || lines != 1000 {
+			t.Errorf("the %s reader read %d lines (%v) but expected 1000", decompressor, lines, read_err)
+		}
+	}
+
+	if decompressors, _ := parse_decompressors("none"); decompressors != nil {
+		t.Errorf("none should skip the decompressors but got %q", decompressors)
+	}
+	if _, parse_err := parse_decompressors("gzip,zstd"); parse_err == nil {
+		t.Errorf("expected an error for a reader that doesn't exist")
+	}
+}
@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"flag"
+	"io"
+	"log/slog"
 	"os"
 	"strings"
 	"testing"
@@ -24,9 +26,11 @@ func BenchmarkAnnoParser(b *testing.B) {
 
 	parsed_region, _ := parse_region(*region)
 
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
 	b.Logf("Running benchmarks")
 
 	for b.Loop() {
-		read_annotations(*annofilePath, keep_col_list, parsed_region)
+		read_annotations(*annofilePath, keep_col_list, parsed_region, nil, logger)
 	}
 }
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/output"
+	"go-phers-parser/internal/pseudonym"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// The sources that a sample id can be found in. A sample has the bit of every source that it is in
+const (
+	inPhenoFile = 1 << iota
+	inSamplesFile
+	inVcfHeader
+)
+
+// consistencyExamples is how many of the ids are printed for each combination of sources
+const consistencyExamples = 5
+
+// read_bcftools_samples reads a samples file in the format of bcftools view -S. Each line has a
+// sample id and an optional new name. If the path starts with ^ then bcftools excludes the samples
+// instead of keeping them so exclude is true
+func read_bcftools_samples(samples_file string) ([]string, bool, error) {
+	exclude := strings.HasPrefix(samples_file, "^")
+	samples_fh, open_err := files.OpenSource(strings.TrimPrefix(samples_file, "^"))
+	if open_err != nil {
+		return nil, exclude, open_err
+	}
+	defer samples_fh.Close()
+
+	var samples []string
+	scanner := files.NewTableScanner(samples_fh)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			samples = append(samples, fields[0])
+		}
+	}
+	return samples, exclude, scanner.Err()
+}
+
+// sampleMembership keeps the sources of every sample id in the order that the ids were first seen
+type sampleMembership struct {
+	sources map[string]int
+	order   []string
+}
+
+func (membership *sampleMembership) add(id string, source int) {
+	if _, seen := membership.sources[id]; !seen {
+		membership.order = append(membership.order, id)
+	}
+	membership.sources[id] |= source
+}
+
+// select_ids returns the ids that pass the check in the order that they were first seen
+func (membership *sampleMembership) select_ids(check func(sources int) bool) []string {
+	var ids []string
+	for _, id := range membership.order {
+		if check(membership.sources[id]) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// example_ids joins the first few ids for the report
+func example_ids(ids []string) string {
+	examples := make([]string, 0, consistencyExamples)
+	for _, id := range ids[:min(len(ids), consistencyExamples)] {
+		examples = append(examples, pseudonym.ID(id))
+	}
+	if len(ids) > consistencyExamples {
+		examples = append(examples, "...")
+	}
+	return missing_dash(strings.Join(examples, ","))
+}
+
+func yes_no(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+// CheckConsistency compares the sample ids of the phenotype file, the bcftools samples file, and the
+// vcf header before a run. pull-variants stops as soon as it finds a sample in the header without
+// a phenotype, which can be hours into a queued job, so this check only reads the header. The number
+// of samples in each combination of the files is printed and the program exits with 1 if pull-variants would fail
+func CheckConsistency(args internal.UserArgs, logger *slog.Logger) {
+	membership := &sampleMembership{sources: make(map[string]int)}
+
+	pheno_rows, pheno_err := read_samples_rows(args.PhenoFilePath)
+	if pheno_err != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while trying to read the phenotype file %s.\n%s", args.PhenoFilePath, pheno_err))
+		os.Exit(1)
+	}
+	for _, row := range pheno_rows {
+		membership.add(row[0], inPhenoFile)
+	}
+	logger.Info(fmt.Sprintf("Read %d samples from the phenotype file %s", len(pheno_rows), args.PhenoFilePath))
+
+	vcf_reader := &files.VCFReader{FileReader: *files.Open(args.VcfFile, args.Buffersize)}
+	if vcf_reader.Err != nil {
+		vcf_reader.CheckErrors()
+	}
+	defer vcf_reader.Close()
+
+	if header_err := vcf_reader.ParseHeader("#CHROM"); header_err != nil || !vcf_reader.Header_Found {
+		logger.Error(fmt.Sprintf("Unable to find the #CHROM header line in the vcf file %s. %v", vcf_reader.Filename, header_err))
+		os.Exit(1)
+	}
+	for column := 9; column < vcf_reader.Col_count; column++ {
+		membership.add(vcf_reader.SampleMapping[column], inVcfHeader)
+	}
+	logger.Info(fmt.Sprintf("Read %d samples from the header of the vcf file %s", max(vcf_reader.Col_count-9, 0), vcf_reader.Filename))
+
+	// Without a samples file bcftools streams every sample in the header
+	streamed := func(sources int) bool { return sources&inVcfHeader != 0 }
+	exclude := false
+	if args.SamplesFile != "" {
+		samples, excluded, samples_err := read_bcftools_samples(args.SamplesFile)
+		if samples_err != nil {
+			logger.Error(fmt.Sprintf("Encountered the following error while trying to read the samples file %s.\n%s", args.SamplesFile, samples_err))
+			os.Exit(1)
+		}
+		for _, sample := range samples {
+			membership.add(sample, inSamplesFile)
+		}
+		exclude = excluded
+		if exclude {
+			streamed = func(sources int) bool { return sources&inVcfHeader != 0 && sources&inSamplesFile == 0 }
+		} else {
+			streamed = func(sources int) bool { return sources&inVcfHeader != 0 && sources&inSamplesFile != 0 }
+		}
+		logger.Info(fmt.Sprintf("Read %d samples from the samples file %s", len(samples), args.SamplesFile))
+	}
+
+	writer := bufio.NewWriter(os.Stdout)
+	header := output.Header("PHENO_FILE")
+	if args.SamplesFile != "" {
+		header.Add("SAMPLES_FILE")
+	}
+	header.Add("VCF_HEADER", "SAMPLES", "EXAMPLES")
+	header.WriteTo(writer)
+	for combination := 1; combination < inVcfHeader<<1; combination++ {
+		if args.SamplesFile == "" && combination&inSamplesFile != 0 {
+			continue
+		}
+		ids := membership.select_ids(func(sources int) bool { return sources == combination })
+		row := output.NewRow(yes_no(combination&inPhenoFile != 0))
+		if args.SamplesFile != "" {
+			row.Add(yes_no(combination&inSamplesFile != 0))
+		}
+		row.Add(yes_no(combination&inVcfHeader != 0)).Int(len(ids)).Add(example_ids(ids))
+		row.WriteTo(writer)
+	}
+	writer.Flush()
+
+	// The samples that bcftools streams need a phenotype or pull-variants stops at the header
+	failed := false
+	if no_pheno := membership.select_ids(func(sources int) bool { return streamed(sources) && sources&inPhenoFile == 0 }); len(no_pheno) > 0 {
+		logger.Error(fmt.Sprintf("%d samples would be streamed from the vcf file but are not in the phenotype file so pull-variants would stop at the header with \"id had no phenotype information\" unless it is given --restrict-to-pheno. The first ones are %s", len(no_pheno), example_ids(no_pheno)))
+		failed = true
+	}
+	// bcftools view -S fails when the samples file has ids that aren't in the header (unless --force-samples is used)
+	if !exclude {
+		if not_in_vcf := membership.select_ids(func(sources int) bool { return sources&inSamplesFile != 0 && sources&inVcfHeader == 0 }); len(not_in_vcf) > 0 {
+			logger.Error(fmt.Sprintf("%d samples in the samples file are not in the header of the vcf file so bcftools view -S will fail unless it is given --force-samples. The first ones are %s", len(not_in_vcf), example_ids(not_in_vcf)))
+			failed = true
+		}
+	}
+	if no_calls := membership.select_ids(func(sources int) bool { return sources&inPhenoFile != 0 && !streamed(sources) }); len(no_calls) > 0 {
+		logger.Warn(fmt.Sprintf("%d samples in the phenotype file will not be streamed from the vcf file so they will not have any calls in the output. The first ones are %s", len(no_calls), example_ids(no_calls)))
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+	logger.Info(fmt.Sprintf("Every one of the %d samples that would be streamed from the vcf file has a phenotype", len(membership.select_ids(streamed))))
+}
@@ -0,0 +1,355 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/genotype"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/output"
+	"go-phers-parser/vcf"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The replication status of a variant in the compare-cohorts output
+const (
+	replicatedStatus      = "replicated"       // the carriers lean the same way in both cohorts
+	oppositeStatus        = "opposite"         // the carriers lean one way in the discovery cohort and the other way in the replication cohort
+	noDifferenceStatus    = "no_difference"    // the carriers don't lean either way in one of the cohorts
+	discoveryOnlyStatus   = "discovery_only"   // only the discovery cohort has carriers
+	replicationOnlyStatus = "replication_only" // only the replication cohort has carriers
+	noCarriersStatus      = "no_carriers"      // neither cohort has carriers (such as a site where every call is reference)
+)
+
+// cohort is one vcf and phenotype pair of compare-cohorts. Only the samples with a phenotype are
+// read from the vcf
+type cohort struct {
+	Name       string // the prefix of the output columns such as DISCOVERY
+	VcfFile    string
+	PhenoFile  string
+	Phenotype  Phenotype
+	values     map[string]float64 // 1 or 0 for the cases and controls or the score of each sample
+	Cases      int                // the number of cases for a binary phenotype
+	Controls   int
+	ScoreTotal float64 // the sum of the scores of every sample for a continuous phenotype
+	Samples    int     // the samples of the vcf that have a phenotype
+	Variants   map[string]*cohortVariant
+	Order      []string // the variant keys in the order of the vcf
+}
+
+// cohortVariant is the carriers and the alleles of one variant in a cohort
+type cohortVariant struct {
+	Fixed           []string // CHROM, POS, ID, REF, and ALT
+	Carriers        int
+	CaseCarriers    int
+	ControlCarriers int
+	CarrierScore    float64 // the sum of the scores of the carriers for a continuous phenotype
+	AltAlleles      int
+	CalledAlleles   int
+}
+
+// read_cohort_phenotypes reads the phenotype of each sample. The phenotype has to be binary or
+// continuous so that the carriers can be compared with the other samples. Samples with a missing
+// phenotype are left out
+func read_cohort_phenotypes(current *cohort) error {
+	rows, read_err := read_samples_rows(current.PhenoFile)
+	if read_err != nil {
+		return fmt.Errorf("unable to read the phenotype file %s: %w", current.PhenoFile, read_err)
+	}
+	raw := make(map[string]string, len(rows))
+	for _, row := range rows {
+		if len(row) > 1 && !is_missing_phenotype(row[1]) {
+			raw[row[0]] = row[1]
+		}
+	}
+	current.Phenotype = detect_phenotype("PHENOTYPE", slices.Collect(maps.Values(raw)))
+	if len(raw) == 0 || current.Phenotype.Type == CategoricalPhenotype {
+		return fmt.Errorf("the phenotype file %s needs a case/control status or a score in its second column but it has %d samples with a phenotype of the type %s", current.PhenoFile, len(raw), current.Phenotype.Type)
+	}
+
+	current.values = make(map[string]float64, len(raw))
+	for sample_id, value := range raw {
+		if current.Phenotype.Type == BinaryPhenotype {
+			status, _ := binary_value(value)
+			current.values[sample_id] = 0
+			if status == "1" {
+				current.values[sample_id] = 1
+			}
+		} else {
+			current.values[sample_id], _ = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		}
+	}
+	return nil
+}
+
+// read_cohort_vcf counts the carriers and the alleles of every variant in the vcf of the cohort.
+// The counts only use the samples that have a phenotype and that were also counted in Cases,
+// Controls, and ScoreTotal so the samples of the vcf without a phenotype don't change the frequencies
+func read_cohort_vcf(current *cohort, buffersize int, expected_ploidy map[int]bool, classifier vcf.GenotypeClassifier, logger *slog.Logger) error {
+	vcf_reader := &files.VCFReader{FileReader: *files.Open(current.VcfFile, buffersize)}
+	defer vcf_reader.Close()
+	if vcf_reader.Err != nil {
+		return fmt.Errorf("unable to open the vcf file %s: %w", current.VcfFile, vcf_reader.Err)
+	}
+	vcf_reader.SampleFilter = func(sample_id string) bool {
+		_, found := current.values[sample_id]
+		return found
+	}
+	if header_err := vcf_reader.ParseHeader("#CHROM"); header_err != nil || !vcf_reader.Header_Found {
+		return fmt.Errorf("unable to find the #CHROM header line in the vcf file %s. %v", current.VcfFile, header_err)
+	}
+	if len(vcf_reader.SampleColumns) == 0 {
+		return fmt.Errorf("none of the %d samples in the header of the vcf file %s are in the phenotype file %s", max(vcf_reader.Col_count-9, 0), current.VcfFile, current.PhenoFile)
+	}
+	current.Samples = len(vcf_reader.SampleColumns)
+	for _, col_indx := range vcf_reader.SampleColumns {
+		value := current.values[vcf_reader.SampleMapping[col_indx]]
+		switch {
+		case current.Phenotype.Type == ContinuousPhenotype:
+			current.ScoreTotal += value
+		case value == 1:
+			current.Cases++
+		default:
+			current.Controls++
+		}
+	}
+	logger.Info(fmt.Sprintf("Reading %d of the %d samples in the vcf file %s that have a phenotype in %s", len(vcf_reader.SampleColumns), max(vcf_reader.Col_count-9, 0), current.VcfFile, current.PhenoFile))
+
+	var selector *vcf.ColumnSelector
+	if len(vcf_reader.SampleColumns) < vcf_reader.Col_count-9 {
+		selector = vcf.NewColumnSelector(vcf_reader.SampleColumns)
+	}
+	current.Variants = make(map[string]*cohortVariant)
+	symbols := genotype.NewSymbolTable()
+	line_number := vcf_reader.HeaderLines
+	skipped := 0
+	for vcf_reader.FileScanner.Scan() {
+		line_number++
+		calls, line_err := process_line(vcf_reader.FileScanner.Text(), line_number, vcf_reader, selector, expected_ploidy, classifier, symbols)
+		if line_err != nil {
+			logger.Warn(fmt.Sprintf("Skipping a record of the vcf file %s. %s", current.VcfFile, line_err))
+			skipped++
+			continue
+		}
+
+		fixed := append(slices.Clone(calls.VariantInfo), calls.Ref, calls.Alt)
+		key := pulled_variant_key(fixed)
+		variant, seen := current.Variants[key]
+		if !seen {
+			variant = &cohortVariant{Fixed: fixed}
+			current.Variants[key] = variant
+			current.Order = append(current.Order, key)
+		}
+		variant.AltAlleles += calls.AltAlleles
+		variant.CalledAlleles += calls.CalledAlleles
+		for sample_id := range calls.VariantCarriers {
+			value := current.values[sample_id]
+			variant.Carriers++
+			switch {
+			case current.Phenotype.Type == ContinuousPhenotype:
+				variant.CarrierScore += value
+			case value == 1:
+				variant.CaseCarriers++
+			default:
+				variant.ControlCarriers++
+			}
+		}
+	}
+	if scan_err := vcf_reader.FileScanner.Err(); scan_err != nil {
+		return fmt.Errorf("unable to read the vcf file %s: %w", current.VcfFile, scan_err)
+	}
+	logger.Info(fmt.Sprintf("Read %d variants from the vcf file %s. Skipped %d malformed records", len(current.Order), current.VcfFile, skipped))
+	return nil
+}
+
+// direction is 1 if the carriers of the variant lean towards the cases (or have a higher mean
+// score than the other samples), -1 if they lean towards the controls (or have a lower mean score),
+// and 0 if there is no difference or the variant has no carriers
+func (current *cohort) direction(variant *cohortVariant) int {
+	if variant == nil || variant.Carriers == 0 {
+		return 0
+	}
+	var carriers, others float64
+	if current.Phenotype.Type == ContinuousPhenotype {
+		noncarriers := current.Samples - variant.Carriers
+		if noncarriers == 0 {
+			return 0
+		}
+		carriers = variant.CarrierScore / float64(variant.Carriers)
+		others = (current.ScoreTotal - variant.CarrierScore) / float64(noncarriers)
+	} else {
+		if current.Cases == 0 || current.Controls == 0 {
+			return 0
+		}
+		carriers = float64(variant.CaseCarriers) / float64(current.Cases)
+		others = float64(variant.ControlCarriers) / float64(current.Controls)
+	}
+	switch {
+	case carriers > others:
+		return 1
+	case carriers < others:
+		return -1
+	}
+	return 0
+}
+
+// header_columns are the columns of the cohort in the output
+func (current *cohort) header_columns() []string {
+	columns := []string{"CARRIERS", "ALT_ALLELES", "ALLELE_NUMBER", "AF"}
+	if current.Phenotype.Type == ContinuousPhenotype {
+		columns = append(columns, "CARRIER_MEAN", "NONCARRIER_MEAN")
+	} else {
+		columns = append(columns, "CASE_CARRIERS", "CONTROL_CARRIERS", "CASE_CARRIER_FREQ", "CONTROL_CARRIER_FREQ")
+	}
+	for indx, column := range columns {
+		columns[indx] = current.Name + "_" + column
+	}
+	return columns
+}
+
+// add_columns adds the counts of the variant in the cohort to the row. A variant that isn't in
+// the vcf of the cohort gets a - in every column
+func (current *cohort) add_columns(row *output.Row, variant *cohortVariant) {
+	if variant == nil {
+		for range current.header_columns() {
+			row.Add("-")
+		}
+		return
+	}
+	row.Int(variant.Carriers, variant.AltAlleles, variant.CalledAlleles).Add(fraction(variant.AltAlleles, variant.CalledAlleles))
+	if current.Phenotype.Type == ContinuousPhenotype {
+		noncarriers := current.Samples - variant.Carriers
+		row.Add(mean_or_na(variant.CarrierScore, variant.Carriers), mean_or_na(current.ScoreTotal-variant.CarrierScore, noncarriers))
+		return
+	}
+	row.Int(variant.CaseCarriers, variant.ControlCarriers).Add(fraction(variant.CaseCarriers, current.Cases), fraction(variant.ControlCarriers, current.Controls))
+}
+
+// fraction writes the count over the total like the allele frequencies of find-all-carriers
+func fraction(count int, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(float64(count)/float64(total), 'f', 6, 64)
+}
+
+// replication_status compares the direction of the carriers in the two cohorts
+func replication_status(discovery *cohort, discovery_variant *cohortVariant, replication *cohort, replication_variant *cohortVariant) string {
+	in_discovery := discovery_variant != nil && discovery_variant.Carriers > 0
+	in_replication := replication_variant != nil && replication_variant.Carriers > 0
+	switch {
+	case !in_discovery && !in_replication:
+		return noCarriersStatus
+	case !in_replication:
+		return discoveryOnlyStatus
+	case !in_discovery:
+		return replicationOnlyStatus
+	}
+	discovery_direction, replication_direction := discovery.direction(discovery_variant), replication.direction(replication_variant)
+	switch {
+	case discovery_direction == 0 || replication_direction == 0:
+		return noDifferenceStatus
+	case discovery_direction == replication_direction:
+		return replicatedStatus
+	}
+	return oppositeStatus
+}
+
+// CompareCohorts reads the vcf and phenotype file of a discovery cohort and a replication cohort
+// and joins the variants of the two. Every variant gets the carriers and the allele frequency in
+// each cohort along with the carriers among the cases and controls (or the mean score of the
+// carriers) and a REPLICATION column that says if the carriers lean the same way in both cohorts.
+// Variants with carriers in only one cohort are kept so that the variants that didn't replicate can be found too
+func CompareCohorts(args internal.UserArgs, logger *slog.Logger) {
+	expected_ploidy, ploidy_err := genotype.ParsePloidyList(args.ExpectedPloidy)
+	if ploidy_err != nil {
+		logger.Error(fmt.Sprintf("Unable to parse the expected ploidy value, %s, into a list of integers: %s", args.ExpectedPloidy, ploidy_err))
+		os.Exit(1)
+	}
+	classifier, classifier_err := carrier_classifier(args.Classifier, args.GenotypeClass, args.MinVAF)
+	if classifier_err != nil {
+		logger.Error(classifier_err.Error())
+		os.Exit(1)
+	}
+
+	discovery := &cohort{Name: "DISCOVERY", VcfFile: args.DiscoveryVcf, PhenoFile: args.DiscoveryPheno}
+	replication := &cohort{Name: "REPLICATION", VcfFile: args.ReplicationVcf, PhenoFile: args.ReplicationPheno}
+	for _, current := range []*cohort{discovery, replication} {
+		if pheno_err := read_cohort_phenotypes(current); pheno_err != nil {
+			logger.Error(pheno_err.Error())
+			os.Exit(1)
+		}
+		logger.Info(fmt.Sprintf("The %s phenotype file %s has a %s phenotype for %d samples", strings.ToLower(current.Name), current.PhenoFile, current.Phenotype.Type, len(current.values)))
+	}
+	if discovery.Phenotype.Type != replication.Phenotype.Type {
+		logger.Error(fmt.Sprintf("The discovery phenotype is %s but the replication phenotype is %s. Both cohorts need the same kind of phenotype to compare the carriers", discovery.Phenotype.Type, replication.Phenotype.Type))
+		os.Exit(1)
+	}
+	// The replication cohort is meant to be independent so samples in both cohorts are only a warning
+	var overlap []string
+	for sample_id := range discovery.values {
+		if _, found := replication.values[sample_id]; found {
+			overlap = append(overlap, sample_id)
+		}
+	}
+	if len(overlap) > 0 {
+		slices.Sort(overlap)
+		logger.Warn(fmt.Sprintf("%d samples are in both phenotype files so the cohorts are not independent. The first ones are %s", len(overlap), example_ids(overlap)))
+	}
+
+	for _, current := range []*cohort{discovery, replication} {
+		if read_err := read_cohort_vcf(current, args.Buffersize, expected_ploidy, classifier, logger); read_err != nil {
+			logger.Error(read_err.Error())
+			os.Exit(1)
+		}
+	}
+
+	output_fh, output_err := files.Create(args.OutputFile)
+	manifest.Track(args.OutputFile)
+	if output_err != nil {
+		logger.Error(fmt.Sprintf("There was an issue trying to create the output file: %s\n", args.OutputFile))
+		os.Exit(1)
+	}
+	defer output_fh.Close()
+
+	writer := bufio.NewWriterSize(output_fh, files.WriteBufferSize())
+	defer writer.Flush()
+
+	header := output.Header("CHROM", "POS", "ID", "REF", "ALT")
+	header.Add(discovery.header_columns()...).Add(replication.header_columns()...).Add("REPLICATION")
+	header.WriteTo(writer)
+
+	// The variants of the discovery cohort come first in the order of its vcf followed by the
+	// variants that are only in the replication vcf
+	statuses := make(map[string]int)
+	written := 0
+	write_variant := func(discovery_variant *cohortVariant, replication_variant *cohortVariant) {
+		fixed := discovery_variant
+		if fixed == nil {
+			fixed = replication_variant
+		}
+		status := replication_status(discovery, discovery_variant, replication, replication_variant)
+		statuses[status]++
+		row := output.NewRow(fixed.Fixed...)
+		discovery.add_columns(row, discovery_variant)
+		replication.add_columns(row, replication_variant)
+		row.Add(status).WriteTo(writer)
+		written++
+	}
+	for _, key := range discovery.Order {
+		write_variant(discovery.Variants[key], replication.Variants[key])
+	}
+	for _, key := range replication.Order {
+		if _, found := discovery.Variants[key]; !found {
+			write_variant(nil, replication.Variants[key])
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Wrote %d variants to %s. %d replicated, %d had carriers leaning the opposite way, %d had no difference in one of the cohorts, %d only had carriers in the discovery cohort, %d only had carriers in the replication cohort, and %d didn't have carriers in either cohort", written, args.OutputFile, statuses[replicatedStatus], statuses[oppositeStatus], statuses[noDifferenceStatus], statuses[discoveryOnlyStatus], statuses[replicationOnlyStatus], statuses[noCarriersStatus]))
+}
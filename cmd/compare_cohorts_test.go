@@ -0,0 +1,37 @@
+package cmd
+
+import "testing"
+
+func TestReplicationStatus(t *testing.T) {
+	binary := &cohort{Phenotype: Phenotype{Type: BinaryPhenotype}, Cases: 10, Controls: 90}
+	scored := &cohort{Phenotype: Phenotype{Type: ContinuousPhenotype}, Samples: 100, ScoreTotal: 100}
+
+	// 2 of 10 cases carry the variant but only 1 of 90 controls
+	enriched := &cohortVariant{Carriers: 3, CaseCarriers: 2, ControlCarriers: 1}
+	depleted := &cohortVariant{Carriers: 9, CaseCarriers: 0, ControlCarriers: 9}
+	// the 2 carriers have a mean score of 3 while the other samples have a mean below 1
+	high_score := &cohortVariant{Carriers: 2, CarrierScore: 6}
+	no_carriers := &cohortVariant{}
+
+	cases := []struct {
+		discovery   *cohort
+		first       *cohortVariant
+		replication *cohort
+		second      *cohortVariant
+		expected    string
+	}{
+		{binary, enriched, binary, enriched, replicatedStatus},
+		{binary, enriched, scored, high_score, replicatedStatus},
+		{binary, enriched, binary, depleted, oppositeStatus},
+		{binary, enriched, binary, nil, discoveryOnlyStatus},
+		{binary, no_carriers, binary, enriched, replicationOnlyStatus},
+		{binary, no_carriers, binary, nil, noCarriersStatus},
+		// a cohort without controls can't say which way the carriers lean
+		{&cohort{Phenotype: Phenotype{Type: BinaryPhenotype}, Cases: 10}, enriched, binary, enriched, noDifferenceStatus},
+	}
+	for indx, test_case := range cases {
+		if status := replication_status(test_case.discovery, test_case.first, test_case.replication, test_case.second); status != test_case.expected {
+			t.Errorf("case %d: expected %s but got %s", indx, test_case.expected, status)
+		}
+	}
+}
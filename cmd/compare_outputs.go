@@ -0,0 +1,298 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/genotype"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/output"
+	"go-phers-parser/vcf"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// The GT field of a call is allele indices (or '.') separated by '/' or '|'. We use this pattern to
+// figure out where the sample columns end and the annotation columns begin in a pull-variants output.
+// A haploid call is a single allele so it also matches numeric annotations such as 0.25 or 3
+var genotypePattern = regexp.MustCompile(`^[0-9.]+([/|][0-9.]+)*$`)
+
+// PulledOutput is a pull-variants output file read into memory. The calls for each variant are
+// stored in the same order as the Samples
+type PulledOutput struct {
+	Filename string
+	Samples  []string
+	Calls    map[string][]string // keyed by chrom:pos:ref:alt using the canonical chromosome name
+	Order    []string            // variant keys in the order that they appear in the file
+}
+
+// strip_phenotype_suffix removes the "_phenotype" that older versions of pull-variants appended to the sample ids
+func strip_phenotype_suffix(column string) string {
+	sample_id, _, _ := split_sample_column(column)
+	return sample_id
+}
+
+// count_sample_columns counts the columns after FORMAT that hold genotype calls for the older
+// outputs that don't have ##SAMPLE lines. A column with a call that has a '/' or '|' in any row is
+// a sample and so is every column before it. The columns after the last of these are annotations
+// even if they look like haploid calls. If no row has a call with a separator then the samples
+// can't be told apart from numeric annotations so an error is returned instead of guessing.
+// Without any rows every column after FORMAT (up to max_samples) is a sample
+func count_sample_columns(rows [][]string, max_samples int) (int, error) {
+	if len(rows) == 0 {
+		return max_samples, nil
+	}
+	sample_count, haploid_count := 0, 0
+	for _, split_line := range rows {
+		// The columns that look like calls (haploid or not) and the last column with a separator
+		looks_like_calls, last_separated := 0, 0
+		for _, value := range split_line[min(9, len(split_line)):min(9+max_samples, len(split_line))] {
+			gt, _, _ := strings.Cut(value, ":")
+			if !genotypePattern.MatchString(gt) {
+				break
+			}
+			looks_like_calls++
+			if strings.ContainsAny(gt, "/|") {
+				last_separated = looks_like_calls
+			}
+		}
+		sample_count = max(sample_count, last_separated)
+		haploid_count = max(haploid_count, looks_like_calls)
+	}
+	if sample_count == 0 && haploid_count > 0 {
+		return 0, fmt.Errorf("the %d column(s) after FORMAT only have haploid calls so they could be samples or numeric annotations. Please use an output with ##SAMPLE lines (written by the current version of pull-variants)", haploid_count)
+	}
+	return sample_count, nil
+}
+
+func pulled_variant_key(split_line []string) string {
+	return fmt.Sprintf("%s:%s:%s:%s", contig.Canonical(split_line[0]), split_line[1], split_line[3], split_line[4])
+}
+
+// PulledTable holds every row of a pull-variants output. The first SampleCount columns after
+// FORMAT are the sample calls and the rest of the columns are annotations and INFO values
+type PulledTable struct {
+	Filename    string
+	Header      []string
+	SampleCount int
+	Rows        [][]string
+	SampleMeta  []string          // the ##SAMPLE lines of the output
+	Phenotypes  map[string]string // phenotype of each sample column from the ##SAMPLE lines. nil for older outputs
+}
+
+// Samples returns the sample ids without the phenotype suffix. Outputs with ##SAMPLE lines
+// already use the sample ids as the column names
+func (table *PulledTable) Samples() []string {
+	var samples []string
+	for _, column := range table.Header[9 : 9+table.SampleCount] {
+		if table.Phenotypes != nil {
+			samples = append(samples, column)
+		} else {
+			samples = append(samples, strip_phenotype_suffix(column))
+		}
+	}
+	return samples
+}
+
+// read_pulled_table reads in a pull-variants output. The file can be gzipped
+func read_pulled_table(filename string, buffersize int) (*PulledTable, error) {
+	output_fr := files.Open(filename, buffersize)
+	// The file is still open if it couldn't be decompressed so the handles are closed before the error is checked
+	defer output_fr.Close()
+
+	if output_fr.Err != nil {
+		return nil, fmt.Errorf("unable to open the file %s: %w", filename, output_fr.Err)
+	}
+
+	var header_cols []string
+	var sample_meta []string
+	for output_fr.FileScanner.Scan() {
+		line := output_fr.FileScanner.Text()
+		if strings.HasPrefix(line, sampleMetaPrefix) {
+			sample_meta = append(sample_meta, strings.TrimRight(line, "\r\n"))
+		} else if strings.HasPrefix(line, "#CHROM") {
+			header_cols = strings.Split(strings.TrimSpace(line), "\t")
+			break
+		}
+	}
+	if header_cols == nil {
+		return nil, fmt.Errorf("unable to find the #CHROM header line in the file %s. Please make sure that this file is an output of the pull-variants command", filename)
+	}
+	phenotypes, meta_err := parse_sample_meta(sample_meta)
+	if meta_err != nil {
+		return nil, fmt.Errorf("unable to read the sample metadata of the file %s: %w", filename, meta_err)
+	}
+
+	table := &PulledTable{Filename: filename, Header: header_cols, SampleCount: -1, SampleMeta: sample_meta, Phenotypes: phenotypes}
+	// The ##SAMPLE lines tell us exactly how many of the columns are samples
+	if phenotypes != nil {
+		table.SampleCount = min(len(sample_meta), max(len(header_cols)-9, 0))
+	}
+	for output_fr.FileScanner.Scan() {
+		table.Rows = append(table.Rows, strings.Split(strings.TrimRight(output_fr.FileScanner.Text(), "\r\n"), "\t"))
+	}
+	if output_fr.FileScanner.Err() != nil {
+		return nil, fmt.Errorf("encountered the following error while reading the file %s: %w", filename, output_fr.FileScanner.Err())
+	}
+
+	// Without ##SAMPLE lines the header doesn't tell us how many of the columns are samples so the
+	// calls of every row are used. An empty file still has the header and every column after FORMAT
+	// is assumed to be a sample in this case
+	if table.SampleCount == -1 {
+		sample_count, count_err := count_sample_columns(table.Rows, max(len(header_cols)-9, 0))
+		if count_err != nil {
+			return nil, fmt.Errorf("unable to find the sample columns of the file %s: %w", filename, count_err)
+		}
+		table.SampleCount = sample_count
+	}
+
+	for indx, split_line := range table.Rows {
+		if len(split_line) < 9+table.SampleCount {
+			return nil, fmt.Errorf("line %d of the file %s only has %d columns but %d were expected. This situation usually means that the file was truncated", len(sample_meta)+indx+2, filename, len(split_line), 9+table.SampleCount)
+		}
+	}
+	return table, nil
+}
+
+// read_pulled_output reads in a pull-variants output and keeps only the calls for each variant
+func read_pulled_output(filename string, buffersize int) (*PulledOutput, error) {
+	table, table_err := read_pulled_table(filename, buffersize)
+	if table_err != nil {
+		return nil, table_err
+	}
+
+	pulled := &PulledOutput{Filename: filename, Samples: table.Samples(), Calls: make(map[string][]string)}
+	for _, split_line := range table.Rows {
+		key := pulled_variant_key(split_line)
+		if _, duplicate := pulled.Calls[key]; !duplicate {
+			pulled.Order = append(pulled.Order, key)
+		}
+		pulled.Calls[key] = split_line[9 : 9+table.SampleCount]
+	}
+	return pulled, nil
+}
+
+// same_genotype compares two calls by their alleles. Unphased calls are compared without
+// considering the order of the alleles so 0/1 and 1/0 are the same genotype
+func same_genotype(first_call string, second_call string) bool {
+	first := vcf.ParseGenotype(first_call)
+	second := vcf.ParseGenotype(second_call)
+	first_alleles := slices.Clone(first.Alleles)
+	second_alleles := slices.Clone(second.Alleles)
+	if !first.Phased || !second.Phased {
+		slices.Sort(first_alleles)
+		slices.Sort(second_alleles)
+	}
+	return slices.Equal(first_alleles, second_alleles)
+}
+
+// SampleComparison holds the counts for one sample. Only the variants where the sample has a
+// non reference call in at least one of the files are counted
+type SampleComparison struct {
+	Shared       int // variant in both files with the same genotype
+	Discordant   int // variant in both files with different genotypes
+	UniqueFirst  int // variant only in the first file
+	UniqueSecond int // variant only in the second file
+}
+
+// CompareOutputs compares two pull-variants outputs (such as two versions of a callset or two
+// cohorts) and writes the number of shared, unique, and discordant variants for each sample that is in both files
+func CompareOutputs(args internal.UserArgs, logger *slog.Logger) {
+	first, first_err := read_pulled_output(args.FirstFile, args.Buffersize)
+	if first_err != nil {
+		logger.Error(first_err.Error())
+		os.Exit(1)
+	}
+	second, second_err := read_pulled_output(args.SecondFile, args.Buffersize)
+	if second_err != nil {
+		logger.Error(second_err.Error())
+		os.Exit(1)
+	}
+
+	second_indices := make(map[string]int)
+	for indx, sample_id := range second.Samples {
+		second_indices[sample_id] = indx
+	}
+
+	// Only the samples that are in both files can be compared
+	type sharedSample struct {
+		id          string
+		first_indx  int
+		second_indx int
+	}
+	var shared_samples []sharedSample
+	for indx, sample_id := range first.Samples {
+		if second_indx, found := second_indices[sample_id]; found {
+			shared_samples = append(shared_samples, sharedSample{id: sample_id, first_indx: indx, second_indx: second_indx})
+		}
+	}
+	if len(shared_samples) < len(first.Samples) || len(shared_samples) < len(second.Samples) {
+		logger.Warn(fmt.Sprintf("Only %d samples are in both files. The first file has %d samples and the second file has %d samples", len(shared_samples), len(first.Samples), len(second.Samples)))
+	}
+
+	comparisons := make([]SampleComparison, len(shared_samples))
+	shared_variants := 0
+	unique_first := 0
+	for _, key := range first.Order {
+		first_calls := first.Calls[key]
+		second_calls, in_second := second.Calls[key]
+		if in_second {
+			shared_variants++
+		} else {
+			unique_first++
+		}
+
+		for indx, sample := range shared_samples {
+			first_call := first_calls[sample.first_indx]
+			switch {
+			case !in_second:
+				if genotype.HasAlt(first_call) {
+					comparisons[indx].UniqueFirst++
+				}
+			case !genotype.HasAlt(first_call) && !genotype.HasAlt(second_calls[sample.second_indx]):
+				continue
+			case same_genotype(first_call, second_calls[sample.second_indx]):
+				comparisons[indx].Shared++
+			default:
+				comparisons[indx].Discordant++
+			}
+		}
+	}
+
+	unique_second := 0
+	for _, key := range second.Order {
+		if _, in_first := first.Calls[key]; in_first {
+			continue
+		}
+		unique_second++
+		for indx, sample := range shared_samples {
+			if genotype.HasAlt(second.Calls[key][sample.second_indx]) {
+				comparisons[indx].UniqueSecond++
+			}
+		}
+	}
+
+	logger.Info(fmt.Sprintf("%d variants are in both files, %d variants are only in %s, and %d variants are only in %s", shared_variants, unique_first, first.Filename, unique_second, second.Filename))
+
+	output_fh, output_err := files.Create(args.OutputFile)
+	manifest.Track(args.OutputFile)
+	if output_err != nil {
+		logger.Error(fmt.Sprintf("There was an issue trying to create the output file: %s\n", args.OutputFile))
+		os.Exit(1)
+	}
+	defer output_fh.Close()
+
+	writer := bufio.NewWriter(output_fh)
+	defer writer.Flush()
+
+	output.Header("SAMPLE", "SHARED", "DISCORDANT", "UNIQUE_FIRST", "UNIQUE_SECOND").WriteTo(writer)
+	for indx, sample := range shared_samples {
+		comparison := comparisons[indx]
+		output.NewRow(sample.id).Int(comparison.Shared, comparison.Discordant, comparison.UniqueFirst, comparison.UniqueSecond).WriteTo(writer)
+	}
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func write_pulled_fixture(t *testing.T, lines ...string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "pulled.txt")
+	if write_err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0o644); write_err != nil {
+		t.Fatalf("unable to write the fixture: %s", write_err)
+	}
+	return filename
+}
+
+func TestReadPulledTableSampleColumns(t *testing.T) {
+	header := "#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS1\tS2\tCADD_PHRED\tAF"
+
+	// The numeric annotation columns look like haploid calls but S2 has a diploid call in the second row
+	filename := write_pulled_fixture(t,
+		header,
+		"1\t100\t.\tA\tG\t.\tPASS\t.\tGT\t0/1\t1\t3\t0.25",
+		"1\t200\t.\tC\tT\t.\tPASS\t.\tGT\t1\t0|1\t12\t0.5",
+	)
+	table, read_err := read_pulled_table(filename, 1024)
+	if read_err != nil {
+		t.Fatalf("unable to read the table: %s", read_err)
+	}
+	if table.SampleCount != 2 {
+		t.Errorf("expected 2 sample columns before the numeric annotations but found %d", table.SampleCount)
+	}
+
+	// Every call is haploid so the samples can't be told apart from the annotations
+	filename = write_pulled_fixture(t,
+		header,
+		"Y\t100\t.\tA\tG\t.\tPASS\t.\tGT\t1\t0\t3\t0.25",
+	)
+	if _, read_err := read_pulled_table(filename, 1024); read_err == nil || !strings.Contains(read_err.Error(), "##SAMPLE") {
+		t.Errorf("expected the haploid calls before numeric annotations to be rejected but got %v", read_err)
+	}
+
+	// The ##SAMPLE lines give the number of samples so the haploid calls are read
+	filename = write_pulled_fixture(t,
+		"##SAMPLE=<ID=S1,Phenotype=1>",
+		"##SAMPLE=<ID=S2,Phenotype=0>",
+		header,
+		"Y\t100\t.\tA\tG\t.\tPASS\t.\tGT\t1\t0\t3\t0.25",
+	)
+	if table, read_err = read_pulled_table(filename, 1024); read_err != nil || table.SampleCount != 2 {
+		t.Errorf("expected the ##SAMPLE lines to give 2 sample columns but got %v", read_err)
+	}
+
+	// A text annotation ends the calls
+	filename = write_pulled_fixture(t,
+		header,
+		"1\t100\t.\tA\tG\t.\tPASS\t.\tGT:DP\t0/1:10\t./.\tmissense\t0.25",
+	)
+	if table, read_err = read_pulled_table(filename, 1024); read_err != nil || table.SampleCount != 2 {
+		t.Errorf("expected 2 sample columns before the text annotation but got %v", read_err)
+	}
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/genotype"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/pseudonym"
+	"go-phers-parser/vcf"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// hetCall is a heterozygous carrier call of a sample in a gene
+type hetCall struct {
+	VariantID string
+	Phase     genotype.Phase
+}
+
+// CompoundHets collects the heterozygous calls of each sample in each gene of the --gene-col column.
+// Samples with two heterozygous variants in a gene are the candidate compound heterozygotes. The
+// PS FORMAT field decides if the two variants are in cis or in trans when the calls are phased
+type CompoundHets struct {
+	GeneCol string
+	calls   map[string]map[string][]hetCall // sample -> gene -> calls
+}
+
+func new_compound_hets(gene_col string) *CompoundHets {
+	if gene_col == "" {
+		return nil
+	}
+	return &CompoundHets{GeneCol: gene_col, calls: make(map[string]map[string][]hetCall)}
+}
+
+// Add records the call if it is heterozygous. VEP can list several genes for a variant (separated
+// by & or ,) so the call is added to each gene
+func (comp_hets *CompoundHets) Add(sample_id string, genes string, variant_id string, format string, call string) {
+	if vcf.ParseGenotype(call).Class() != vcf.Het {
+		return
+	}
+	sample_genes, found := comp_hets.calls[sample_id]
+	if !found {
+		sample_genes = make(map[string][]hetCall)
+		comp_hets.calls[sample_id] = sample_genes
+	}
+	phase := genotype.CallPhase(format, call)
+	for _, gene := range strings.FieldsFunc(genes, func(r rune) bool { return r == '&' || r == ',' }) {
+		if gene == "" || gene == "-" {
+			continue
+		}
+		// Every transcript of the variant can list the same gene
+		if slices.ContainsFunc(sample_genes[gene], func(het hetCall) bool { return het.VariantID == variant_id }) {
+			continue
+		}
+		sample_genes[gene] = append(sample_genes[gene], hetCall{VariantID: variant_id, Phase: phase})
+	}
+}
+
+// write_compound_hets writes every pair of heterozygous variants of a sample in a gene with the
+// phase of the pair (cis, trans, or unknown). The number of pairs and the number of pairs in trans are returned
+func write_compound_hets(filename string, comp_hets *CompoundHets) (int, int, error) {
+	comp_het_fh, create_err := files.Create(filename)
+	manifest.Track(filename)
+	if create_err != nil {
+		return 0, 0, fmt.Errorf("encountered the following error while trying to create the compound heterozygote file %s: %w", filename, create_err)
+	}
+	defer comp_het_fh.Close()
+
+	writer := bufio.NewWriter(comp_het_fh)
+	writer.WriteString("SAMPLE\tGENE\tVARIANT_1\tVARIANT_2\tPHASE\tPHASE_SET\n")
+
+	pairs, trans_pairs := 0, 0
+	for _, sample_id := range slices.Sorted(maps.Keys(comp_hets.calls)) {
+		sample_genes := comp_hets.calls[sample_id]
+		for _, gene := range slices.Sorted(maps.Keys(sample_genes)) {
+			calls := sample_genes[gene]
+			for first_indx := 0; first_indx < len(calls); first_indx++ {
+				for second_indx := first_indx + 1; second_indx < len(calls); second_indx++ {
+					first, second := calls[first_indx], calls[second_indx]
+					relation := first.Phase.Relation(second.Phase)
+					phase_set := "-"
+					if relation != "unknown" && first.Phase.PhaseSet != "" {
+						phase_set = first.Phase.PhaseSet
+					}
+					if relation == "trans" {
+						trans_pairs++
+					}
+					pairs++
+					writer.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\n", pseudonym.ID(sample_id), gene, first.VariantID, second.VariantID, relation, phase_set))
+				}
+			}
+		}
+	}
+	return pairs, trans_pairs, writer.Flush()
+}
@@ -0,0 +1,33 @@
+//go:build !duckdb
+
+package cmd
+
+import (
+	"errors"
+	internal "go-phers-parser/internal"
+	"log/slog"
+	"os"
+)
+
+// go-duckdb needs cgo so the duckdb output and the query command are only built with the duckdb
+// build tag (go build -tags duckdb). Without it the binary stays pure Go so that it can be built
+// with CGO_ENABLED=0 and cross compiled for the other platforms
+var errNoDuckDB = errors.New("this build does not include duckdb. Rebuild the program with cgo enabled and `go build -tags duckdb` to use --output-format duckdb or the query command")
+
+// duckdb_unavailable returns the reason that this build can't write duckdb files
+func duckdb_unavailable() error {
+	return errNoDuckDB
+}
+
+// write_duckdb_variants stops the run because this build can't write a duckdb file
+func write_duckdb_variants(pulled *PulledVariants, variants <-chan []VariantInfo, output_file string, logger *slog.Logger) func() {
+	logger.Error(errNoDuckDB.Error())
+	os.Exit(1)
+	return nil
+}
+
+// Query stops because this build can't open a duckdb file
+func Query(args internal.UserArgs, logger *slog.Logger) {
+	logger.Error(errNoDuckDB.Error())
+	os.Exit(1)
+}
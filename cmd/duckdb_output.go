@@ -0,0 +1,235 @@
+//go:build duckdb
+
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/pipeline"
+	"go-phers-parser/internal/pseudonym"
+	"go-phers-parser/internal/resources"
+	"go-phers-parser/vcf"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// duckdb_unavailable returns the reason that this build can't write duckdb files. The builds
+// with the duckdb tag always can (see duckdb_disabled.go for the others)
+func duckdb_unavailable() error {
+	return nil
+}
+
+// quote_identifier quotes a column name for sql. The annotation and INFO columns come from the
+// user so they can have characters that aren't allowed in a bare identifier
+func quote_identifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// duckdb_schema returns the statements that create the tables of the duckdb output. Only the
+// calls of the carriers are written to the genotypes table because the full matrix for a
+// biobank would be larger than the vcf
+func duckdb_schema(anno_cols []string, info_cols []string) []string {
+	variant_cols := []string{"variant_id VARCHAR", "chrom VARCHAR", "pos BIGINT", "id VARCHAR", "ref VARCHAR", "alt VARCHAR", "qual VARCHAR", "filter VARCHAR", "info VARCHAR"}
+	for _, col := range info_cols {
+		variant_cols = append(variant_cols, quote_identifier(col)+" VARCHAR")
+	}
+
+	annotation_cols := []string{"variant_id VARCHAR"}
+	for _, col := range anno_cols {
+		annotation_cols = append(annotation_cols, quote_identifier(col)+" VARCHAR")
+	}
+
+	return []string{
+		"CREATE TABLE samples (sample VARCHAR, phenotype VARCHAR)",
+		fmt.Sprintf("CREATE TABLE variants (%s)", strings.Join(variant_cols, ", ")),
+		"CREATE TABLE genotypes (variant_id VARCHAR, sample VARCHAR, genotype VARCHAR, call VARCHAR)",
+		fmt.Sprintf("CREATE TABLE annotations (%s)", strings.Join(annotation_cols, ", ")),
+	}
+}
+
+// DuckDBOutput writes the pulled variants into the variants, genotypes, annotations, and samples
+// tables of a duckdb file. The rows are added with appenders which are much faster than inserts
+type DuckDBOutput struct {
+	db          *sql.DB
+	conn        driver.Conn
+	variants    *duckdb.Appender
+	genotypes   *duckdb.Appender
+	annotations *duckdb.Appender
+}
+
+// NewDuckDBOutput creates the database and its tables. An existing database at the path is
+// replaced so that the output behaves the same way as the tsv output
+func NewDuckDBOutput(output_file string, anno_cols []string, info_cols []string) (*DuckDBOutput, error) {
+	if files.IsRemote(output_file) {
+		return nil, fmt.Errorf("duckdb outputs have to be written to a local file. Upload %s after the run finishes", output_file)
+	}
+	for _, path := range []string{output_file, output_file + ".wal"} {
+		if remove_err := os.Remove(path); remove_err != nil && !os.IsNotExist(remove_err) {
+			return nil, fmt.Errorf("unable to replace the existing database %s: %w", path, remove_err)
+		}
+	}
+
+	connector, connector_err := duckdb.NewConnector(output_file, nil)
+	if connector_err != nil {
+		return nil, fmt.Errorf("unable to create the duckdb database %s: %w", output_file, connector_err)
+	}
+	output := &DuckDBOutput{db: sql.OpenDB(connector)}
+
+	for _, statement := range duckdb_schema(anno_cols, info_cols) {
+		if _, exec_err := output.db.Exec(statement); exec_err != nil {
+			output.db.Close()
+			return nil, fmt.Errorf("unable to create the tables in %s: %w", output_file, exec_err)
+		}
+	}
+
+	conn, conn_err := connector.Connect(context.Background())
+	if conn_err != nil {
+		output.db.Close()
+		return nil, conn_err
+	}
+	output.conn = conn
+
+	appenders := []**duckdb.Appender{&output.variants, &output.genotypes, &output.annotations}
+	for indx, table := range []string{"variants", "genotypes", "annotations"} {
+		appender, appender_err := duckdb.NewAppenderFromConn(conn, "", table)
+		if appender_err != nil {
+			output.Close()
+			return nil, fmt.Errorf("unable to open the %s table for writing: %w", table, appender_err)
+		}
+		*appenders[indx] = appender
+	}
+	return output, nil
+}
+
+// WriteSamples fills in the samples table with the (possibly hashed) sample ids and their phenotypes
+func (output *DuckDBOutput) WriteSamples(samples []string, phenotypes map[string]string) error {
+	appender, appender_err := duckdb.NewAppenderFromConn(output.conn, "", "samples")
+	if appender_err != nil {
+		return appender_err
+	}
+	for _, sample_id := range samples {
+		var phenotype driver.Value
+		if value, ok := phenotypes[sample_id]; ok {
+			phenotype = value
+		}
+		if append_err := appender.AppendRow(pseudonym.ID(sample_id), phenotype); append_err != nil {
+			appender.Close()
+			return append_err
+		}
+	}
+	return appender.Close()
+}
+
+// WriteVariant adds the variant, the calls of its carriers, and its annotations
+func (output *DuckDBOutput) WriteVariant(samples []string, anno_cols []string, classifier vcf.GenotypeClassifier, variant VariantInfo) error {
+	fields := variant.InfoFields
+	pos, _ := strconv.ParseInt(fields[1], 10, 64)
+
+	row := []driver.Value{variant.VariantID, fields[0], pos, fields[2], fields[3], fields[4], fields[5], fields[6], fields[7]}
+	for _, value := range variant.InfoColumns {
+		row = append(row, value)
+	}
+	if append_err := output.variants.AppendRow(row...); append_err != nil {
+		return append_err
+	}
+
+	// The calls string starts with a tab so the first value after splitting is empty
+	for indx, call := range strings.Split(variant.Calls, "\t")[1:] {
+		if indx >= len(samples) || !classifier.IsCarrier(fields[8], call) {
+			continue
+		}
+		genotype, _, _ := strings.Cut(call, ":")
+		if append_err := output.genotypes.AppendRow(variant.VariantID, pseudonym.ID(samples[indx]), genotype, call); append_err != nil {
+			return append_err
+		}
+	}
+
+	if variant.Annotations != nil {
+		anno_row := []driver.Value{variant.VariantID}
+		for _, col := range anno_cols {
+			if value, ok := variant.Annotations[col]; ok {
+				anno_row = append(anno_row, value.String())
+			} else {
+				anno_row = append(anno_row, nil)
+			}
+		}
+		if append_err := output.annotations.AppendRow(anno_row...); append_err != nil {
+			return append_err
+		}
+	}
+	return nil
+}
+
+// Close flushes the appenders and closes the database. The rows are only in the file once this returns
+func (output *DuckDBOutput) Close() error {
+	var close_errs []error
+	for _, appender := range []*duckdb.Appender{output.variants, output.genotypes, output.annotations} {
+		if appender != nil {
+			if close_err := appender.Close(); close_err != nil {
+				close_errs = append(close_errs, close_err)
+			}
+		}
+	}
+	if output.conn != nil {
+		output.conn.Close()
+	}
+	if close_err := output.db.Close(); close_err != nil {
+		close_errs = append(close_errs, close_err)
+	}
+	if len(close_errs) > 0 {
+		return close_errs[0]
+	}
+	return nil
+}
+
+// write_duckdb_variants starts a goroutine that writes the variants into a duckdb file. The
+// returned function closes the database and should be called after the waitgroup finishes
+func write_duckdb_variants(pulled *PulledVariants, variants <-chan []VariantInfo, output_file string, logger *slog.Logger) func() {
+	output, output_err := NewDuckDBOutput(output_file, pulled.AnnoCols, pulled.InfoCols)
+	manifest.Track(output_file)
+	if output_err != nil {
+		logger.Error(output_err.Error())
+		os.Exit(1)
+	}
+
+	if samples_err := output.WriteSamples(pulled.Samples, pulled.Phenotypes); samples_err != nil {
+		logger.Error(fmt.Sprintf("Unable to write the samples table to %s. %s", output_file, samples_err))
+		os.Exit(1)
+	}
+
+	pulled.wg.Add(1)
+
+	go func() {
+		defer pulled.wg.Done()
+		defer resources.StartStage("write output")()
+
+		variants_written := 0
+		write_err := pipeline.Each(variants, func(variant VariantInfo) error {
+			if err := output.WriteVariant(pulled.Samples, pulled.AnnoCols, pulled.Classifier, variant); err != nil {
+				return fmt.Errorf("encountered an error while writing the variant %s to the duckdb file %s. %w", variant.VariantID, output_file, err)
+			}
+			variants_written++
+			return nil
+		})
+		if write_err != nil {
+			logger.Error(write_err.Error())
+			os.Exit(1)
+		}
+		logger.Info(fmt.Sprintf("Recorded information for %d variant(s) in the duckdb file %s", variants_written, output_file))
+	}()
+
+	return func() {
+		if close_err := output.Close(); close_err != nil {
+			logger.Error(fmt.Sprintf("Unable to finish writing the duckdb file %s. %s", output_file, close_err))
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/output"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// extractedAnnotation is one variant of the extract-annotations table
+type extractedAnnotation struct {
+	Chrom  string
+	Pos    int // 0 when the id doesn't have a position (such as an rsID)
+	Ref    string
+	Alt    string
+	ID     string
+	Values []string
+}
+
+// split_annotation_key pulls the coordinates out of an annotation key of the form chrom_pos_ref/alt.
+// Ids of any other form are kept as the ID and their coordinates are written as -
+func split_annotation_key(variant_key string) extractedAnnotation {
+	variant := extractedAnnotation{Chrom: "-", Ref: "-", Alt: "-", ID: variant_key}
+	parts := strings.SplitN(variant_key, "_", 3)
+	if len(parts) != 3 {
+		return variant
+	}
+	pos, pos_err := strconv.Atoi(parts[1])
+	ref, alt, has_alt := strings.Cut(parts[2], "/")
+	if pos_err != nil || !has_alt {
+		return variant
+	}
+	variant.Chrom, variant.Pos, variant.Ref, variant.Alt = parts[0], pos, ref, alt
+	return variant
+}
+
+// dedupe_transcripts collapses the values of the transcripts of a variant (separated by a
+// semicolon in the store) into the distinct values in the order that they were first seen. Missing
+// values are only written when none of the transcripts had a value
+func dedupe_transcripts(value string) string {
+	var distinct []string
+	for _, item := range strings.Split(value, ";") {
+		if item == "" || item == "-" || slices.Contains(distinct, item) {
+			continue
+		}
+		distinct = append(distinct, item)
+	}
+	if len(distinct) == 0 {
+		return "-"
+	}
+	return strings.Join(distinct, ";")
+}
+
+// compare_extracted orders the variants by chromosome and position. Variants without coordinates come last in the order of their ids
+func compare_extracted(first extractedAnnotation, second extractedAnnotation) int {
+	if (first.Pos == 0) != (second.Pos == 0) {
+		if first.Pos == 0 {
+			return 1
+		}
+		return -1
+	}
+	if first.Pos != 0 {
+		if chrom_order := contig.Compare(first.Chrom, second.Chrom); chrom_order != 0 {
+			return chrom_order
+		}
+	}
+	return cmp.Or(cmp.Compare(first.Pos, second.Pos), cmp.Compare(first.ID, second.ID))
+}
+
+// ExtractAnnotations reads the annotations of the region (or the --regions-file) with the same
+// filters as pull-variants and writes one row per variant without reading a vcf. This table is meant
+// for building gene reports or for checking which columns a region has before pulling the variants
+func ExtractAnnotations(args internal.UserArgs, logger *slog.Logger) {
+	if args.Region == "" && args.RegionsFile == "" {
+		logger.Error("extract-annotations needs a --region or a --regions-file to know which annotations to read")
+		os.Exit(1)
+	}
+	// The region is only optional when the intervals of the regions file are used instead
+	var parsed_region Region
+	if args.Region != "" {
+		var region_err []error
+		parsed_region, region_err = parse_region(args.Region)
+		if region_err != nil {
+			logger.Error("Encountered the following errors while trying to parse the region value: ")
+			for _, msg := range region_err {
+				logger.Error(fmt.Sprintf("%s", msg))
+			}
+			os.Exit(1)
+		}
+	}
+	contig_style, style_err := contig.ParseStyle(args.ContigStyle)
+	if style_err != nil {
+		logger.Error(style_err.Error())
+		os.Exit(1)
+	}
+	anno_region, anno_lift, lift_err := setup_liftover(args, parsed_region, logger)
+	if lift_err != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while setting up the liftover.\n %s", lift_err))
+		os.Exit(1)
+	}
+	_, anno_regions, regions_err := region_sets(args, anno_region, logger)
+	if regions_err != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while reading the regions.\n %s", regions_err))
+		os.Exit(1)
+	}
+	// The keys of the store don't have the chr prefix so by default the names follow the region
+	if contig_style == contig.StyleAuto {
+		contig_style = contig.DetectStyle(anno_regions.Chroms()[0])
+	}
+
+	anno_cols_from_file, anno_cols_to_keep, _, keep_err := parse_keep_cols(args.ColsToKeep)
+	if keep_err != nil {
+		logger.Error(keep_err.Error())
+		os.Exit(1)
+	}
+	anno_freq, freq_err := new_annotation_frequency(args.AfColumns, args.AfMode, args.FoldAf)
+	if freq_err != nil {
+		logger.Error(freq_err.Error())
+		os.Exit(1)
+	}
+	maf_cap, threshold_err := new_maf_threshold(args.MafCap, args.MafCompare)
+	if threshold_err != nil {
+		logger.Error(threshold_err.Error())
+		os.Exit(1)
+	}
+	anno_cols_to_read := anno_cols_from_file
+	if anno_freq != nil {
+		logger.Info(fmt.Sprintf("Only keeping the annotations where the %s frequency of the columns %s is AF%s", anno_freq.Mode, strings.Join(anno_freq.Columns, ", "), maf_cap))
+		for _, col := range anno_freq.Columns {
+			if !slices.Contains(anno_cols_to_read, col) {
+				anno_cols_to_read = append(slices.Clone(anno_cols_to_read), col)
+			}
+		}
+	}
+
+	var max_bytes int64
+	if args.MaxMemory != "" {
+		parsed_size, size_err := parse_memory_size(args.MaxMemory)
+		if size_err != nil {
+			logger.Error(size_err.Error())
+			os.Exit(1)
+		}
+		max_bytes = parsed_size
+	}
+	pos_cols, pos_err := parse_pos_cols(args.AnnoPosCols)
+	if pos_err != nil {
+		logger.Error(pos_err.Error())
+		os.Exit(1)
+	}
+	store, anno_err := load_annotations(args.AnnoFile, anno_cols_to_read, pos_cols, anno_regions, anno_lift, max_bytes, args.Lenient, false, logger)
+	if anno_err != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while trying to read in the annotations.\n %s", anno_err))
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	var variants []extractedAnnotation
+	frequency_filtered := 0
+	each_err := store.each(func(variant_key string, values []string) error {
+		deduped := make(map[string]string, len(values))
+		for indx, col := range store.cols {
+			deduped[col] = dedupe_transcripts(values[indx])
+		}
+		if anno_freq != nil {
+			if passes, _ := anno_freq.Passes(deduped, maf_cap); !passes {
+				frequency_filtered++
+				return nil
+			}
+		}
+		variant := split_annotation_key(variant_key)
+		if variant.Pos != 0 {
+			variant.Chrom = contig.Apply(variant.Chrom, contig_style)
+		}
+		variant.ID = contig.RewriteVariantID(variant.ID, contig_style)
+		variant.Values = make([]string, len(anno_cols_from_file))
+		// The store only has the columns that were in the file. Under --lenient the others are written as -
+		for indx, col := range anno_cols_from_file {
+			variant.Values[indx] = cmp.Or(deduped[col], "-")
+		}
+		variants = append(variants, variant)
+		return nil
+	})
+	if each_err != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while reading the annotations back from the temporary database.\n %s", each_err))
+		os.Exit(1)
+	}
+	if frequency_filtered > 0 {
+		logger.Info(fmt.Sprintf("Skipped %d annotated variants with a frequency that failed AF%s in the columns %s", frequency_filtered, maf_cap, strings.Join(anno_freq.Columns, ", ")))
+	}
+	slices.SortFunc(variants, compare_extracted)
+
+	output_fh, output_err := files.Create(args.OutputFile)
+	manifest.Track(args.OutputFile)
+	if output_err != nil {
+		logger.Error(fmt.Sprintf("There was an issue trying to create the output file: %s\n", args.OutputFile))
+		os.Exit(1)
+	}
+	defer output_fh.Close()
+
+	writer := bufio.NewWriterSize(output_fh, files.WriteBufferSize())
+	defer writer.Flush()
+
+	output.Header("CHROM", "POS", "ID", "REF", "ALT").Add(anno_cols_to_keep...).WriteTo(writer)
+	for _, variant := range variants {
+		pos := "-"
+		if variant.Pos != 0 {
+			pos = strconv.Itoa(variant.Pos)
+		}
+		output.NewRow(variant.Chrom, pos, variant.ID, variant.Ref, variant.Alt).Add(variant.Values...).WriteTo(writer)
+	}
+	logger.Info(fmt.Sprintf("Wrote the annotations of %d variants to %s", len(variants), args.OutputFile))
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDedupeTranscripts(t *testing.T) {
+	cases := map[string]string{
+		"missense_variant": "missense_variant",
+		"missense_variant;synonymous_variant;missense_variant": "missense_variant;synonymous_variant",
+		"-;pathogenic;-": "pathogenic",
+		"-;-":            "-",
+		"":               "-",
+	}
+	for value, expected := range cases {
+		if deduped := dedupe_transcripts(value); deduped != expected {
+			t.Errorf("expected %s to be collapsed to %s but got %s", value, expected, deduped)
+		}
+	}
+}
+
+func TestExtractedAnnotationOrder(t *testing.T) {
+	var variants []extractedAnnotation
+	for _, key := range []string{"rs123", "X_5_C/T", "22_300_G/A", "2_100_A/G", "22_100_A/G"} {
+		variants = append(variants, split_annotation_key(key))
+	}
+	slices.SortFunc(variants, compare_extracted)
+
+	var ids []string
+	for _, variant := range variants {
+		ids = append(ids, variant.ID)
+	}
+	expected := []string{"2_100_A/G", "22_100_A/G", "22_300_G/A", "X_5_C/T", "rs123"}
+	if !slices.Equal(ids, expected) {
+		t.Errorf("expected the variants in the order %v but got %v", expected, ids)
+	}
+	if rsid := split_annotation_key("rs123"); rsid.Pos != 0 || rsid.Chrom != "-" {
+		t.Errorf("expected an rsID to have no coordinates but got %s:%d", rsid.Chrom, rsid.Pos)
+	}
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"log/slog"
+	"os"
+)
+
+// ExtractSamples writes the sample ids from the vcf header to a phenotype template. The file has
+// the GRID and Status header that the phenotype loaders expect and every sample starts with a
+// status of NA so that the user only has to fill in the phenotypes. The ids are never hashed because
+// this file is an input for the other commands which match the GRIDs in the vcf header
+func ExtractSamples(args internal.UserArgs, logger *slog.Logger) {
+	vcf_reader := &files.VCFReader{FileReader: *files.Open(args.VcfFile, args.Buffersize)}
+
+	if vcf_reader.Err != nil {
+		vcf_reader.CheckErrors()
+	}
+
+	defer vcf_reader.Close()
+
+	// The sample ids are lowercased before they are compared to the exclusion strings so we do the same for the exclusion strings
+	if args.SampleExclusion != "" {
+		vcf_reader.SampleExclusions = files.ParseSampleExclusions(args.SampleExclusion)
+	}
+
+	if header_err := vcf_reader.ParseHeader("#CHROM"); header_err != nil || !vcf_reader.Header_Found {
+		logger.Error(fmt.Sprintf("Unable to find the #CHROM header line in the vcf file %s. %v", vcf_reader.Filename, header_err))
+		os.Exit(1)
+	}
+
+	output_fh, output_err := files.Create(args.OutputFile)
+	manifest.Track(args.OutputFile)
+	if output_err != nil {
+		logger.Error(fmt.Sprintf("There was an issue trying to create the output file: %s\n", args.OutputFile))
+		os.Exit(1)
+	}
+	defer output_fh.Close()
+
+	writer := bufio.NewWriter(output_fh)
+	defer writer.Flush()
+
+	writer.WriteString("GRID\tStatus\n")
+
+	// The sample mapping is keyed by the column index so we walk the columns to keep the order of the vcf header
+	written := 0
+	for col_indx := 9; col_indx < vcf_reader.Col_count; col_indx++ {
+		if sample_id, included := vcf_reader.SampleMapping[col_indx]; included {
+			writer.WriteString(fmt.Sprintf("%s\tNA\n", sample_id))
+			written++
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Wrote %d of the %d samples in the vcf header to %s", written, vcf_reader.Col_count-9, args.OutputFile))
+}
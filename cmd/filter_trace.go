@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// filterTraceColumn is the extra column of --filter-trace. It lists the value that each of the
+// configured filters saw for the record so that the thresholds can be tuned from a single run
+const filterTraceColumn = "FILTER_TRACE"
+
+// filterStatusColumn is the extra column of --keep-filtered. It is PASS for the records that passed
+// every filter and FAIL: followed by the filters that the record failed otherwise
+const filterStatusColumn = "FILTER_STATUS"
+
+// The filters that --keep-filtered labels the records with
+const (
+	mafFailure       = "maf"        // the frequency doesn't pass the --maf-threshold
+	noCarrierFailure = "no_carrier" // none of the samples are a carrier
+	maxACFailure     = "max_ac"     // the minor allele count in the samples is above --max-ac
+)
+
+// filter_status formats the FILTER_STATUS value of a record from the filters that it failed
+func filter_status(failed []string) string {
+	if len(failed) == 0 {
+		return "PASS"
+	}
+	return "FAIL:" + strings.Join(failed, ",")
+}
+
+// filterTrace collects the steps of the FILTER_TRACE column of one record. The steps are written
+// as NAME=value (or NAME=value<=threshold for the filters with a threshold, with < for
+// --maf-compare strict and = for the novel variants of a --maf-threshold of 0) separated by
+// semicolons in the order that the filters are applied:
+//
+//	REGIONS   the record overlaps the intervals of --regions-file
+//	AF        the smallest INFO AF of the alternate alleles (MAF with --fold-af)
+//	ANNO_AF   the frequency of the --af-columns. Variants without a frequency are written as . and treated as rare
+//	CARRIERS  the number of samples that the carrier classifier counted as carriers
+//	AC        the minor allele count in the written samples with --max-ac
+//
+// A nil trace ignores the steps so the parser only has to build the values when --filter-trace is set
+type filterTrace struct {
+	steps []string
+}
+
+// add records a filter without a threshold
+func (trace *filterTrace) add(name string, value string) {
+	if trace == nil {
+		return
+	}
+	trace.steps = append(trace.steps, fmt.Sprintf("%s=%s", name, value))
+}
+
+// threshold records a filter that compares the value to a threshold
+func (trace *filterTrace) threshold(name string, value string, threshold string) {
+	trace.add(name, fmt.Sprintf("%s<=%s", value, threshold))
+}
+
+// frequency records a frequency filter with the comparison of the threshold. NaN is written as .
+// for a missing frequency
+func (trace *filterTrace) frequency(name string, freq float64, maf_cap mafThreshold) {
+	if trace == nil {
+		return
+	}
+	value := "."
+	if !math.IsNaN(freq) {
+		value = strconv.FormatFloat(freq, 'g', 6, 64)
+	}
+	trace.add(name, value+maf_cap.String())
+}
+
+func (trace *filterTrace) String() string {
+	return missing_dash(strings.Join(trace.steps, ";"))
+}
+
+// smallest_frequency returns the frequency that decides if a record passes the MAF filter. A record
+// passes when any of its alternate alleles is rare enough so this is the smallest frequency (folded
+// with fold). Missing frequencies are skipped and NaN is returned if every frequency is missing
+func smallest_frequency(freqs []float64, fold bool) float64 {
+	smallest := math.NaN()
+	for _, freq := range freqs {
+		if fold {
+			freq = fold_frequency(freq)
+		}
+		if !math.IsNaN(freq) && (math.IsNaN(smallest) || freq < smallest) {
+			smallest = freq
+		}
+	}
+	return smallest
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFilterTrace(t *testing.T) {
+	trace := &filterTrace{}
+	trace.add("REGIONS", "overlap")
+	trace.frequency("AF", smallest_frequency([]float64{0.3, 0.002, math.NaN()}, false), mafThreshold{Cap: 0.01})
+	trace.frequency("ANNO_AF", math.NaN(), mafThreshold{Cap: 0.01})
+	trace.threshold("AC", "3", "5")
+	if expected := "REGIONS=overlap;AF=0.002<=0.01;ANNO_AF=.<=0.01;AC=3<=5"; trace.String() != expected {
+		t.Errorf("expected the trace %s but got %s", expected, trace.String())
+	}
+	if empty := (&filterTrace{}).String(); empty != "-" {
+		t.Errorf("expected a trace without steps to be written as - but got %s", empty)
+	}
+	// A nil trace is what the parser has without --filter-trace
+	var disabled *filterTrace
+	disabled.add("CARRIERS", "1")
+
+	if folded := smallest_frequency([]float64{0.98, 0.2}, true); math.Abs(folded-0.02) > 1e-9 {
+		t.Errorf("expected the folded frequency of 0.98 to be the smallest but got %f", folded)
+	}
+	if missing := smallest_frequency([]float64{math.NaN()}, false); !math.IsNaN(missing) {
+		t.Errorf("expected a record without frequencies to have a missing frequency but got %f", missing)
+	}
+}
+
+func TestFilterStatus(t *testing.T) {
+	if status := filter_status(nil); status != "PASS" {
+		t.Errorf("expected a record without failed filters to be PASS but got %s", status)
+	}
+	if status := filter_status([]string{mafFailure, noCarrierFailure}); status != "FAIL:maf,no_carrier" {
+		t.Errorf("expected the failed filters to be listed in order but got %s", status)
+	}
+}
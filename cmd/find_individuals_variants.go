@@ -1,22 +1,60 @@
 package cmd
 
 import (
-	"bufio"
 	"fmt"
 	internal "go-phers-parser/internal"
 	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/model"
+	"go-phers-parser/internal/pipeline"
+	"go-phers-parser/internal/pseudonym"
+	"go-phers-parser/internal/records"
+	"go-phers-parser/internal/resources"
+	"go-phers-parser/vcf"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type SampleInfo struct {
 	Score                 string
+	Phenotypes            []string // values of the --pheno-cols columns. This value is nil if no columns were selected
+	Percentile            string   // percentile of the sample's score. This value is only set when --score-quantile is used
+	Covariates            []string // values from the covariate file in the same order as the selected covariate columns
 	PathogenicVariants    []string
 	NonsynonymousVariants []string
+	LofVariants           []string // predicted loss of function variants (stop gained, frameshift, and splice donor/acceptor)
 	OtherVariants         []string
+	TierVariants          map[VariantTier][]string       // the variants of each tier. This map is only filled with --variant-tiers
+	Zygosity              map[string]model.GenotypeClass // zygosity of the call for each variant string in the lists above
+}
+
+// ZygosityCounts returns the number of heterozygous and homozygous alternate variants of the sample.
+// When only is given the variants are limited to those variant strings
+func (info *SampleInfo) ZygosityCounts(only []string) (int, int) {
+	het, hom_alt := 0, 0
+	count := func(class model.GenotypeClass) {
+		switch class {
+		case model.Het:
+			het++
+		case model.HomAlt:
+			hom_alt++
+		}
+	}
+	if only == nil {
+		for _, class := range info.Zygosity {
+			count(class)
+		}
+		return het, hom_alt
+	}
+	for _, variant_str := range only {
+		count(info.Zygosity[variant_str])
+	}
+	return het, hom_alt
 }
 
 type SampleID struct {
@@ -25,29 +63,99 @@ type SampleID struct {
 	Score    string
 }
 
+// headerKeywords are the names of the sample id column that mark the first line of a samples or
+// phenotype file as a header. They are compared without case. --header-keywords replaces them
+var headerKeywords = []string{"grid", "iid", "fid", "id", "sample", "sample_id", "person_id"}
+
+// SetHeaderKeywords replaces the keywords that identify the header line of the samples and
+// phenotype files. The value is a comma separated list and an empty value keeps the defaults
+func SetHeaderKeywords(value string) {
+	if strings.TrimSpace(value) == "" {
+		return
+	}
+	headerKeywords = nil
+	for _, keyword := range strings.Split(value, ",") {
+		if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" {
+			headerKeywords = append(headerKeywords, keyword)
+		}
+	}
+}
+
+// is_samples_header decides if the first row of a samples or phenotype file is a header. It is a
+// header if the first column is one of the headerKeywords (or starts with #). It is also a header
+// if its second column is a word like Status while the rest of that column is numbers or a
+// case/control status. A categorical phenotype has words all the way down so its first row is a sample
+func is_samples_header(rows [][]string) bool {
+	if len(rows) == 0 || len(rows[0]) == 0 {
+		return false
+	}
+	first := rows[0]
+	if strings.HasPrefix(first[0], "#") || slices.Contains(headerKeywords, strings.ToLower(first[0])) {
+		return true
+	}
+	if len(first) < 2 || is_missing_phenotype(first[1]) {
+		return false
+	}
+	if _, conv_err := strconv.ParseFloat(first[1], 64); conv_err == nil {
+		return false
+	}
+	if _, is_binary := binary_value(first[1]); is_binary {
+		return false
+	}
+	values := make([]string, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		if len(row) > 1 {
+			values = append(values, row[1])
+		}
+	}
+	return detect_phenotype("", values).Type != CategoricalPhenotype
+}
+
+// read_samples_rows reads the rows of a samples or phenotype file without the header. The files
+// are small so they are read in full before we decide if the first row is a header
+func read_samples_rows(samples_filepath string) ([][]string, error) {
+	samples_fh, open_err := files.OpenSource(samples_filepath)
+	if open_err != nil {
+		return nil, open_err
+	}
+	defer samples_fh.Close()
+
+	// The delimiter is detected from the first line because these files are often made in Excel
+	scanner := files.NewTableScanner(samples_fh)
+	delimiter := ""
+	var rows [][]string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if delimiter == "" {
+			delimiter = files.DetectDelimiter(line)
+		}
+		if split_line := files.SplitFields(strings.TrimSpace(line), delimiter); len(split_line) > 0 && split_line[0] != "" {
+			rows = append(rows, split_line)
+		}
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+
+	// Only the first row can be the header. We used to skip every line with grid in it which also
+	// dropped any sample whose id happened to contain it
+	if is_samples_header(rows) {
+		rows = rows[1:]
+	}
+	return rows, nil
+}
+
 func read_samples_file(samples_filepath string, logger *slog.Logger) ([]string, []error) {
 	logger.Info(fmt.Sprintf("Reading in all of the desired samples from the file %s\n", samples_filepath))
 	var errors []error
 	var samples []string
 
-	samples_fh, samples_err := os.Open(samples_filepath)
-	if samples_err != nil {
-		errors = append(errors, fmt.Errorf("failed to open the file, %s. The following error was encountered, %s", samples_filepath, samples_err))
-	} else {
-		sample_scanner := bufio.NewScanner(samples_fh)
-		for sample_scanner.Scan() {
-			line := sample_scanner.Text()
-			if strings.Contains(strings.ToLower(line), "grid") {
-				// we can skip the header line if it exists
-				continue
-			}
-			split_line := strings.Split(strings.TrimSpace(line), "\t")
-
-			samples = append(samples, split_line[0])
-		}
-		if sample_scanner.Err() != nil {
-			errors = append(errors, fmt.Errorf("encountered the following error while scanning through the samples file. %s", sample_scanner.Err()))
-		}
+	rows, read_err := read_samples_rows(samples_filepath)
+	if read_err != nil {
+		errors = append(errors, fmt.Errorf("failed to read the file, %s. The following error was encountered, %s", samples_filepath, read_err))
+	}
+	for _, row := range rows {
+		samples = append(samples, row[0])
 	}
 
 	// If no samples were read in the we should give the user an error
@@ -59,36 +167,50 @@ func read_samples_file(samples_filepath string, logger *slog.Logger) ([]string,
 	return samples, errors
 }
 
-func get_sample_col_indices(header_map map[string]int, samples []string, logger *slog.Logger) []SampleID {
+// get_sample_col_indices finds the column of each sample in the calls file. The phenotypes come
+// from the ##SAMPLE lines of the file and the columns are matched on the full sample id. Older files
+// without these lines have the phenotype appended to the sample id (ID_score). For these files a
+// column that is already a full sample id is used as is and the others are split on the last separator
+func get_sample_col_indices(header_map map[string]int, sample_meta map[string]string, samples []string, logger *slog.Logger) []SampleID {
 	var sample_map []SampleID
+	// The header can have hundreds of thousands of columns so we look the samples up in a set
+	sample_set := vcf.NewSampleIndex(samples)
+
+	// If the calls file was written with hashed ids then we need to map the hashes back to the ids in the samples file
+	hashed_ids := make(map[string]string)
+	if pseudonym.Enabled() {
+		for _, sample_id := range samples {
+			hashed_ids[pseudonym.ID(sample_id)] = sample_id
+		}
+	}
 
-	for sample_id, indx := range header_map {
-		// Sometimes the id will have a score (either PheRS or case/control status) appended to the end. We can split the string to get this value
-		split_id := strings.Split(sample_id, "_")
+	for column, indx := range header_map {
+		sample_id, score := column, ""
+		if sample_meta != nil {
+			phenotype, is_sample := sample_meta[column]
+			if !is_sample {
+				continue
+			}
+			score = phenotype
+		} else if !sample_set.Contains(column) && hashed_ids[column] == "" {
+			// Sometimes the id will have a score (either PheRS or case/control status) appended to the end. We can split the string to get this value
+			sample_id, score, _ = split_sample_column(column)
+		}
 
-		// we can check if the sample id (split_id[0]) is in our samples array. If not then we skip that position
-		if !slices.Contains(samples, split_id[0]) {
-			continue
+		if original_id, hashed := hashed_ids[sample_id]; hashed {
+			sample_id = original_id
 		}
-		if len(split_id) == 2 {
-			sample_map = append(sample_map, SampleID{Index: indx, SampleID: split_id[0], Score: split_id[1]})
-		} else {
-			sample_map = append(sample_map, SampleID{Index: indx, SampleID: split_id[0], Score: ""})
+
+		// we can check if the sample id is in our samples array. If not then we skip that position
+		if !sample_set.Contains(sample_id) {
+			continue
 		}
+		sample_map = append(sample_map, SampleID{Index: indx, SampleID: sample_id, Score: score})
 	}
 	logger.Info(fmt.Sprintf("Successfully mapped the indices for %d columns from the header", len(sample_map)))
 	return sample_map
 }
 
-func check_for_alt_call(call string, reference_call_set map[string]bool) bool {
-	_, ok := reference_call_set[call]
-	// If the call is an alt call then the dictionary will return
-	// false because it only contains keys for reference calls.
-	// We can negate the false value so that it equals true
-	// indicating that we did find an alternate allele
-	return !ok
-}
-
 func find_col_indx(colname string, header_map map[string]int) (int, error) {
 	col_indx, key_present := header_map[colname]
 
@@ -114,32 +236,66 @@ func initialize_sample_info(samples []SampleID) map[string]*SampleInfo {
 	sampleInfo := make(map[string]*SampleInfo) // This will be our return value
 
 	for _, obj := range samples {
-		sampleInfo[obj.SampleID] = &SampleInfo{Score: obj.Score}
+		sampleInfo[obj.SampleID] = &SampleInfo{Score: obj.Score, TierVariants: make(map[VariantTier][]string), Zygosity: make(map[string]model.GenotypeClass)}
 	}
 
 	return sampleInfo
 }
 
-func parse_calls(calls_file string, samples []string, pathogenic_colname string, consequence_colname string, logger *slog.Logger) (map[string]*SampleInfo, []error) {
+// add_sample_variant records the variant for the individual if the classifier says that their call
+// makes them a carrier. The variant is put into the pathogenic, nonsynonymous, and/or LOF lists based on its annotations.
+// If the variant has a tier (--variant-tiers) then it is put in the list of the tier instead. The
+// return value reports whether the individual was a carrier
+func add_sample_variant(individualInfo *SampleInfo, classifier vcf.GenotypeClassifier, format string, variant_id string, call string, is_pathogenic bool, is_nonsense_variant bool, is_lof bool, tier VariantTier) bool {
+	if !classifier.IsCarrier(format, call) {
+		return false
+	}
+	// Now we can generate teh variant string that we are going to write to a file
+	variantStr := fmt.Sprintf("%s:%s", variant_id, call)
+	// We keep the zygosity so that the het and hom-alt carriers can be reported separately
+	individualInfo.Zygosity[variantStr] = vcf.ParseGenotype(call).Class()
+
+	if tier != "" {
+		individualInfo.TierVariants[tier] = append(individualInfo.TierVariants[tier], variantStr)
+		return true
+	}
+
+	if is_pathogenic {
+		individualInfo.PathogenicVariants = append(individualInfo.PathogenicVariants, variantStr)
+	}
+
+	if is_nonsense_variant {
+		individualInfo.NonsynonymousVariants = append(individualInfo.NonsynonymousVariants, variantStr)
+	}
+
+	if is_lof {
+		individualInfo.LofVariants = append(individualInfo.LofVariants, variantStr)
+	}
+
+	if !is_nonsense_variant && !is_pathogenic && !is_lof {
+		individualInfo.OtherVariants = append(individualInfo.OtherVariants, variantStr)
+	}
+	return true
+}
+
+func parse_calls(calls_file string, samples []string, pathogenic_colname string, consequence_colname string, classifier vcf.GenotypeClassifier, lof LofRule, strata *StrataSummary, tiers *VariantTiers, comp_hets *CompoundHets, logger *slog.Logger) (map[string]*SampleInfo, []error) {
+	defer resources.StartStage("collect sample variants")()
 	var errors []error
 
-	calls_fr := files.MakeFileReader(calls_file, 1024*1024)
+	// The calls file can be plain text, gzipped, or streamed in from standard input using "-"
+	calls_fr := files.Open(calls_file, 1024*1024)
+	// lets defer the file closing. A gzipped file that couldn't be decompressed is still open so this comes before the error check
+	defer calls_fr.Close()
 
 	if calls_fr.Err != nil {
-		fmt.Println(calls_fr.Err)
+		errors = append(errors, fmt.Errorf("unable to open the calls file %s: %w", calls_file, calls_fr.Err))
+		return nil, errors
 	}
-	// lets defer the file closing
 	// lets go ahead and parse through the calls_file to get the header
 	err := calls_fr.ParseHeader("#CHROM")
 
 	errors = append(errors, err)
 
-	defer func() {
-		for _, handle := range calls_fr.Handles {
-			handle.Close()
-		}
-	}()
-
 	// If we never found the header then we need to early exit. Other wise we will try to get an index that doesn't exist
 	if !calls_fr.Header_Found {
 		return nil, errors
@@ -156,59 +312,97 @@ func parse_calls(calls_file string, samples []string, pathogenic_colname string,
 		return nil, errors
 	}
 	// we also need to map the sample id columns
-	sample_indices := get_sample_col_indices(calls_fr.Header_col_indx, samples, logger)
+	sample_meta, meta_err := parse_sample_meta(calls_fr.MetaLines)
+	if meta_err != nil {
+		errors = append(errors, meta_err)
+		return nil, errors
+	}
+	sample_indices := get_sample_col_indices(calls_fr.Header_col_indx, sample_meta, samples, logger)
 
 	sampleInfo := initialize_sample_info(sample_indices)
 
-	// We also need to generate the set of reference calls so that we can compare our calls for that
-	reference_call_strs := generate_reference_set()
+	if comp_hets != nil {
+		if _, found := calls_fr.Header_col_indx[comp_hets.GeneCol]; !found {
+			errors = append(errors, fmt.Errorf("the calls file does not have the gene column %s that the compound heterozygotes are found with. Add the column with --keep-cols when running pull-variants", comp_hets.GeneCol))
+			return nil, errors
+		}
+	}
+
+	if _, found := calls_fr.Header_col_indx[lof.LofteeCol]; lof.HCOnly && !found {
+		logger.Warn(fmt.Sprintf("The calls file does not have the LOFTEE column %s so none of the variants will be in the LOF category with --lof-hc-only", lof.LofteeCol))
+	}
+
+	// The LOFTEE and frequency columns of the tiers are optional so we only let the user know if they are missing
+	if tiers != nil {
+		for _, col := range []string{tiers.LofteeCol, tiers.FrequencyCol} {
+			if _, found := calls_fr.Header_col_indx[col]; col != "" && !found {
+				logger.Warn(fmt.Sprintf("The calls file does not have the column %s so it will not be used for the variant tiers", col))
+			}
+		}
+	}
+
+	// We need the largest column index that we read from so that we can check for truncated rows
+	max_col_indx := max(clinVar_col_indx, consequence_col_indx)
+	for _, individual := range sample_indices {
+		max_col_indx = max(max_col_indx, individual.Index)
+	}
+	// We need the line number to report malformed rows
+	line_number := calls_fr.HeaderLines
 	// This file has a header line so we first need to read in the indices for each column
 	for calls_fr.FileScanner.Scan() {
+		line_number++
 		line := calls_fr.FileScanner.Text()
 		// We assume the header line contains the phrase #CHROM because this is the output of the other program
 		split_line := strings.Split(strings.TrimSpace(line), "\t")
 
+		// Truncated rows would cause an index out of range panic when we pull out the calls
+		if len(split_line) <= max(max_col_indx, 8) {
+			errors = append(errors, fmt.Errorf("line %d of the calls file only has %d columns but the header has %d columns. This situation usually means that the file was truncated", line_number, len(split_line), calls_fr.Col_count))
+			continue
+		}
+
+		// The first 9 columns are the vcf columns of the variant. The annotation columns come after the samples
+		record, record_err := model.ParseVariant(split_line[:9])
+		if record_err != nil {
+			errors = append(errors, fmt.Errorf("line %d of the calls file: %w", line_number, record_err))
+			continue
+		}
+
 		is_pathogenic := check_column_label(split_line[clinVar_col_indx], []string{"pathogenic", "likely_pathogenic"})
 		is_nonsense_variant := check_column_label(split_line[consequence_col_indx], []string{"missense", "nonsynonymous"})
-
-		for _, individual := range sample_indices {
-			call := split_line[individual.Index]
-			alternate_call := check_for_alt_call(call, reference_call_strs)
-			// Now we can generate teh variant string that we are going to write to a file
-			variantStr := fmt.Sprintf("%s:%s", split_line[2], call)
-			individualInfo := sampleInfo[individual.SampleID]
-
-			if is_pathogenic && alternate_call {
-				individualInfo.PathogenicVariants = append(individualInfo.PathogenicVariants, variantStr)
+		is_lof := lof.IsLoF(split_line[consequence_col_indx], func(col string) string {
+			if col_indx, found := calls_fr.Header_col_indx[col]; found && col_indx < len(split_line) {
+				return split_line[col_indx]
 			}
+			return ""
+		})
 
-			if is_nonsense_variant && alternate_call {
-				individualInfo.NonsynonymousVariants = append(individualInfo.NonsynonymousVariants, variantStr)
-			}
+		if strata != nil {
+			strata.AddVariant(record.ID, classifier, split_line[8], sample_indices, split_line)
+		}
 
-			if !is_nonsense_variant && !is_pathogenic && alternate_call {
-				individualInfo.OtherVariants = append(individualInfo.OtherVariants, variantStr)
-			}
+		var tier VariantTier
+		var evidence []string
+		if tiers != nil {
+			tier, evidence = tiers.Classify(func(col string) string {
+				if col_indx, found := calls_fr.Header_col_indx[col]; found && col_indx < len(split_line) {
+					return split_line[col_indx]
+				}
+				return ""
+			})
+		}
 
-			// if check_for_alt_call(call, reference_call_strs) {
-			// 	// We need to pull out the label for pathogenicity if that is present in the file
-			// 	var pathogenic_label string
-			// 	if pathogenic_label_present {
-			// 		pathogenic_label = split_line[clinical_col_indx]
-			// 	} else {
-			// 		pathogenic_label = ""
-			// 	}
-			// 	// We need to keep track of the variants that an individual has. The variant is the first value in the split_line array.
-			// 	if sampleStruct, ok := sampleInfo[individual.SampleID]; ok {
-			// 		update_variant_status(sampleStruct, variantStr, pathogenic_label)
-			// 	} else if check_pathogenic_label(pathogenic_label) {
-			// 		variantList := []string{variantStr}
-			// 		sampleInfo[individual.SampleID] = &SampleInfo{Score: individual.Score, PathogenicVariants: variantList, OtherVariants: []string{}}
-			// 	} else {
-			// 		nonPathogenicsList := []string{variantStr}
-			// 		sampleInfo[individual.SampleID] = &SampleInfo{Score: individual.Score, PathogenicVariants: []string{}, OtherVariants: nonPathogenicsList}
-			// 	}
-			// }
+		carriers := 0
+		for _, individual := range sample_indices {
+			if add_sample_variant(sampleInfo[individual.SampleID], classifier, split_line[8], record.ID, split_line[individual.Index], is_pathogenic, is_nonsense_variant, is_lof, tier) {
+				carriers++
+				if comp_hets != nil {
+					comp_hets.Add(individual.SampleID, split_line[calls_fr.Header_col_indx[comp_hets.GeneCol]], record.ID, split_line[8], split_line[individual.Index])
+				}
+			}
+		}
+		if tiers != nil {
+			tiers.Add(record.ID, tier, evidence, carriers)
 		}
 	}
 	if calls_fr.FileScanner.Err() != nil {
@@ -218,41 +412,281 @@ func parse_calls(calls_file string, samples []string, pathogenic_colname string,
 	return sampleInfo, errors
 }
 
-func write_variants(writer *bufio.Writer, sample_variants map[string]*SampleInfo) {
-	// lets build the header line
+func write_variants(record_writer records.RecordWriter, sample_variants map[string]*SampleInfo, pheno_cols []string, include_percentile bool, covariate_cols []string, tiered bool) error {
+	// lets build the header line. If the user selected phenotype columns then each one gets a
+	// column in place of the single SCORE column
+	columns := []string{"SAMPLE"}
+	if len(pheno_cols) > 0 {
+		columns = append(columns, pheno_cols...)
+	} else {
+		columns = append(columns, "SCORE")
+	}
 
-	header_str := "SAMPLE\tSCORE\tPATHOGENIC_VARIANTS\tNONSYNONYMOUS_VARIANTS\tOTHER_VARIANTS\n"
+	if include_percentile {
+		columns = append(columns, "SCORE_PERCENTILE")
+	}
 
-	writer.WriteString(header_str)
+	// The tiers replace the pathogenic, nonsynonymous, and other columns
+	if tiered {
+		for _, tier := range variantTierOrder {
+			columns = append(columns, tier.ColumnName())
+		}
+	} else {
+		columns = append(columns, "PATHOGENIC_VARIANTS", "NONSYNONYMOUS_VARIANTS", "LOF_VARIANTS", "OTHER_VARIANTS")
+	}
+	columns = append(columns, "HET_VARIANT_COUNT", "HOM_ALT_VARIANT_COUNT")
+
+	// The covariates are added to the end of each row so that the statisticians get one joined table
+	columns = append(columns, covariate_cols...)
+
+	if header_err := record_writer.WriteHeader(records.Header{Columns: columns}); header_err != nil {
+		return header_err
+	}
 
-	sample_str := strings.Builder{}
 	for sample_id, sampleInfoObj := range sample_variants {
+		values := make([]string, 0, len(columns))
+		values = append(values, pseudonym.ID(sample_id))
+
+		// We can build the rest of the row appending the Score if there is one and the variants
+		if len(pheno_cols) > 0 {
+			for indx := range pheno_cols {
+				if indx < len(sampleInfoObj.Phenotypes) && sampleInfoObj.Phenotypes[indx] != "" {
+					values = append(values, sampleInfoObj.Phenotypes[indx])
+				} else {
+					values = append(values, "-")
+				}
+			}
+		} else if sampleInfoObj.Score == "" {
+			values = append(values, "-")
+		} else {
+			values = append(values, sampleInfoObj.Score)
+		}
+
+		if include_percentile {
+			if sampleInfoObj.Percentile == "" {
+				values = append(values, "-")
+			} else {
+				values = append(values, sampleInfoObj.Percentile)
+			}
+		}
+
+		if tiered {
+			for _, tier := range variantTierOrder {
+				values = append(values, strings.Join(sampleInfoObj.TierVariants[tier], ","))
+			}
+		} else {
+			values = append(values, strings.Join(sampleInfoObj.PathogenicVariants, ","), strings.Join(sampleInfoObj.NonsynonymousVariants, ","), strings.Join(sampleInfoObj.LofVariants, ","), strings.Join(sampleInfoObj.OtherVariants, ","))
+		}
+		het_count, hom_alt_count := sampleInfoObj.ZygosityCounts(nil)
+		values = append(values, strconv.Itoa(het_count), strconv.Itoa(hom_alt_count))
+
+		for indx := range covariate_cols {
+			if indx < len(sampleInfoObj.Covariates) && sampleInfoObj.Covariates[indx] != "" {
+				values = append(values, sampleInfoObj.Covariates[indx])
+			} else {
+				values = append(values, "NA")
+			}
+		}
+
+		if record_err := record_writer.WriteRecord(values); record_err != nil {
+			return record_err
+		}
+	}
+	return nil
+}
+
+// load_phenotype_table reads in the --pheno-cols columns if the user selected any. A nil table is
+// returned when no columns were selected
+func load_phenotype_table(config internal.UserArgs, logger *slog.Logger) *PhenotypeTable {
+	pheno_cols := parse_pheno_cols(config.PhenoCols)
+	if len(pheno_cols) == 0 {
+		return nil
+	}
 
-		sample_str.WriteString(sample_id)
+	table, table_err := read_phenotype_table(config.PhenoFilePath, pheno_cols)
+	if table_err != nil {
+		logger.Error(table_err.Error())
+		os.Exit(1)
+	}
+	logger.Info(fmt.Sprintf("Read in the phenotype columns %s for %d samples", strings.Join(pheno_cols, ", "), len(table.Values)))
+	return table
+}
+
+func write_sample_output(output_filepath string, sample_variants map[string]*SampleInfo, phenotypes *PhenotypeTable, ranks *ScoreRanks, covariates *PhenotypeTable, tiers *VariantTiers, comp_hets *CompoundHets, logger *slog.Logger) {
+	defer resources.StartStage("write output")()
+	logger.Info(fmt.Sprintf("Identified variants for %d samples", len(sample_variants)))
 
-		pathogenicVarStr := strings.Join(sampleInfoObj.PathogenicVariants, ",")
-		nonsynonymousVarStr := strings.Join(sampleInfoObj.NonsynonymousVariants, ",")
-		otherVarStr := strings.Join(sampleInfoObj.OtherVariants, ",")
+	var pheno_cols []string
+	if phenotypes != nil {
+		pheno_cols = phenotypes.Columns
+		for sample_id, info := range sample_variants {
+			info.Phenotypes = phenotypes.Values[sample_id]
+		}
 
-		// We can build the rest of the string appending the Score if there is one and the variants
-		if sampleInfoObj.Score == "" {
-			sample_str.WriteString(fmt.Sprintf("\t-\t%s\t%s\t%s", pathogenicVarStr, nonsynonymousVarStr, otherVarStr))
+		summary_file := fmt.Sprintf("%s_pheno_summary.txt", strings.TrimSuffix(output_filepath, filepath.Ext(output_filepath)))
+		if summary_err := write_phenotype_summary(summary_file, phenotypes, sample_variants, tiers != nil); summary_err != nil {
+			logger.Error(summary_err.Error())
 		} else {
-			sample_str.WriteString(fmt.Sprintf("\t%s\t%s\t%s\t%s", sampleInfoObj.Score, pathogenicVarStr, nonsynonymousVarStr, otherVarStr))
+			logger.Info(fmt.Sprintf("Wrote the per-phenotype carrier summary to the file: %s", summary_file))
+		}
+	}
+
+	if tiers != nil {
+		tiers_file := fmt.Sprintf("%s_variant_tiers.txt", strings.TrimSuffix(output_filepath, filepath.Ext(output_filepath)))
+		if tiers_err := write_variant_tiers(tiers_file, tiers); tiers_err != nil {
+			logger.Error(tiers_err.Error())
+		} else {
+			logger.Info(fmt.Sprintf("Wrote the tier of %d variants to the file: %s", len(tiers.Variants), tiers_file))
+		}
+	}
+
+	if comp_hets != nil {
+		comp_het_file := fmt.Sprintf("%s_compound_het.txt", strings.TrimSuffix(output_filepath, filepath.Ext(output_filepath)))
+		if pairs, trans_pairs, comp_het_err := write_compound_hets(comp_het_file, comp_hets); comp_het_err != nil {
+			logger.Error(comp_het_err.Error())
+		} else {
+			logger.Info(fmt.Sprintf("Found %d pairs of heterozygous variants in the same gene (%d of them phased in trans). Wrote the pairs to the file: %s", pairs, trans_pairs, comp_het_file))
+		}
+	}
+
+	// The headline numbers of a case/control analysis are the carrier frequencies of each group.
+	// Categorical phenotypes get the same summary with a group for each label
+	group_file := fmt.Sprintf("%s_group_summary.txt", strings.TrimSuffix(output_filepath, filepath.Ext(output_filepath)))
+	if written, group_err := write_group_summary(group_file, sample_variants, tiers != nil); group_err != nil {
+		logger.Error(group_err.Error())
+	} else if written {
+		logger.Info(fmt.Sprintf("Wrote the carrier summary of each phenotype group to the file: %s", group_file))
+	} else {
+		logger.Info("The scores of the samples are continuous so the carrier summary of the case/control or categorical groups was not written")
+	}
+
+	record_writer, output_err := records.Open("tsv", output_filepath)
+	manifest.Track(output_filepath)
+
+	if output_err != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while trying to open the output file, %s.\n %s", output_filepath, output_err))
+		os.Exit(1)
+	}
+
+	logger.Info(fmt.Sprintf("Writing output to the file: %s", output_filepath))
+	if ranks != nil {
+		for sample_id, info := range sample_variants {
+			if percentile, ok := ranks.Percentiles[sample_id]; ok {
+				info.Percentile = strconv.FormatFloat(percentile, 'f', 2, 64)
+			}
 		}
-		sample_str.WriteString("\n")
 	}
 
-	writer.WriteString(sample_str.String())
-	writer.Flush()
+	var covariate_cols []string
+	if covariates != nil {
+		covariate_cols = covariates.Columns
+		missing_covariates := 0
+		for sample_id, info := range sample_variants {
+			values, found := covariates.Values[sample_id]
+			if !found {
+				missing_covariates++
+			}
+			info.Covariates = values
+		}
+		if missing_covariates > 0 {
+			logger.Warn(fmt.Sprintf("%d samples were not in the covariate file. Their covariates will be written as NA", missing_covariates))
+		}
+	}
+
+	write_err := write_variants(record_writer, sample_variants, pheno_cols, ranks != nil, covariate_cols, tiers != nil)
+	if close_err := record_writer.Close(); write_err == nil {
+		write_err = close_err
+	}
+	if write_err != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while trying to write the output file, %s.\n %s", output_filepath, write_err))
+		os.Exit(1)
+	}
 }
 
-func FindSampleVariants(config internal.UserArgs, logger *slog.Logger) {
-	start_time := time.Now()
+// lof_rule returns the LOF category rule of the --lof-hc-only and --loftee-col flags
+func lof_rule(config internal.UserArgs) LofRule {
+	return LofRule{LofteeCol: config.LofteeCol, HCOnly: config.LofHCOnly}
+}
 
-	logger.Info(fmt.Sprintf("began the analysis at: %s\n", start_time.Format("2006-01-02@15:04:05")))
-	// read in the appropriate CLI flags
+// variant_tiers returns the tier classifier of --variant-tiers or nil if the tiers weren't requested
+func variant_tiers(config internal.UserArgs) *VariantTiers {
+	if !config.VariantTiers {
+		return nil
+	}
+	return &VariantTiers{ClinvarCol: config.ClinvarColumnName, ConsequenceCol: config.ConsequenceCol, LofteeCol: config.LofteeCol, FrequencyCol: config.TierFreqCol}
+}
+
+// open_strata_summary creates the summary of the --strata-cols columns. Any errors terminate the program
+func open_strata_summary(config internal.UserArgs, logger *slog.Logger) *StrataSummary {
+	strata, strata_err := load_strata_summary(config, logger)
+	if strata_err != nil {
+		logger.Error(strata_err.Error())
+		os.Exit(1)
+	}
+	return strata
+}
+
+func close_strata_summary(strata *StrataSummary, logger *slog.Logger) {
+	if strata == nil {
+		return
+	}
+	if close_err := strata.Close(); close_err != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while writing the strata summary:\n %s", close_err))
+		os.Exit(1)
+	}
+}
+
+// load_covariate_table reads in the covariate file if one was provided. The covariate columns are
+// selected with --covariate-cols. If no columns are selected then every column is used
+func load_covariate_table(config internal.UserArgs, logger *slog.Logger) *PhenotypeTable {
+	if config.CovariateFile == "" {
+		return nil
+	}
+
+	table, table_err := read_phenotype_table(config.CovariateFile, parse_pheno_cols(config.CovariateCols))
+	if table_err != nil {
+		logger.Error(table_err.Error())
+		os.Exit(1)
+	}
+	logger.Info(fmt.Sprintf("Read in the covariates %s for %d samples from the file %s", strings.Join(table.Columns, ", "), len(table.Values), config.CovariateFile))
+	return table
+}
+
+// restrict_to_top_quantile keeps only the samples whose score is in the top quantile of the scores in
+// the phenotype file. The returned ranks are used to report the percentile of each sample. If the
+// user didn't request a quantile then the samples are returned unchanged with nil ranks
+func restrict_to_top_quantile(config internal.UserArgs, samples []string, logger *slog.Logger) ([]string, *ScoreRanks) {
+	if config.ScoreQuantile <= 0 {
+		return samples, nil
+	}
+
+	if config.ScoreQuantile >= 1 {
+		logger.Error(fmt.Sprintf("The score quantile has to be between 0 and 1 but the value %f was provided", config.ScoreQuantile))
+		os.Exit(1)
+	}
+
+	scores, score_err := read_sample_scores(config.PhenoFilePath, parse_pheno_cols(config.PhenoCols))
+	if score_err != nil {
+		logger.Error(score_err.Error())
+		os.Exit(1)
+	}
+
+	ranks := rank_scores(scores, config.ScoreQuantile)
 
+	var kept []string
+	for _, sample_id := range samples {
+		if score, ok := scores[sample_id]; ok && score >= ranks.Cutoff {
+			kept = append(kept, sample_id)
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Restricting the analysis to the %d samples with a score of at least %f (the %.4f quantile of %d scores)", len(kept), ranks.Cutoff, config.ScoreQuantile, len(scores)))
+
+	return kept, &ranks
+}
+
+// load_samples_of_interest reads in the samples that we want to find variants for. Any errors terminate the program
+func load_samples_of_interest(config internal.UserArgs, logger *slog.Logger) []string {
 	var samples []string
 	var sample_file_err []error
 	if config.PhenoFilePath == "" {
@@ -268,11 +702,122 @@ func FindSampleVariants(config internal.UserArgs, logger *slog.Logger) {
 			os.Exit(1)
 		}
 	}
+	return samples
+}
+
+// collect_sample_variants is the in-memory version of parse_calls. Instead of reading the output
+// of pull-variants from a file, the variants are read directly from the channel of the pull stage
+func collect_sample_variants(pulled *PulledVariants, variants <-chan []VariantInfo, samples []string, pathogenic_colname string, consequence_colname string, lof LofRule, strata *StrataSummary, tiers *VariantTiers, comp_hets *CompoundHets, logger *slog.Logger) map[string]*SampleInfo {
+	defer resources.StartStage("collect sample variants")()
+	samples_of_interest := make(map[string]bool, len(samples))
+	for _, sample_id := range samples {
+		samples_of_interest[sample_id] = true
+	}
+
+	// The index is the position of the sample in the VariantInfo.Calls string
+	var sample_indices []SampleID
+	for indx, sample_id := range pulled.Samples {
+		if samples_of_interest[sample_id] {
+			sample_indices = append(sample_indices, SampleID{Index: indx, SampleID: sample_id, Score: pulled.Phenotypes[sample_id]})
+		}
+	}
+	logger.Info(fmt.Sprintf("Successfully mapped the indices for %d samples from the vcf header", len(sample_indices)))
+
+	sampleInfo := initialize_sample_info(sample_indices)
+
+	pipeline.Each(variants, func(variant VariantInfo) error {
+		// The calls string starts with a tab so we need to remove it before we split it
+		calls := strings.Split(strings.TrimPrefix(variant.Calls, "\t"), "\t")
+
+		var pathogenic_label, consequence_label string
+		if value, ok := variant.Annotations[pathogenic_colname]; ok {
+			pathogenic_label = value.String()
+		}
+		if value, ok := variant.Annotations[consequence_colname]; ok {
+			consequence_label = value.String()
+		}
+
+		is_pathogenic := check_column_label(pathogenic_label, []string{"pathogenic", "likely_pathogenic"})
+		is_nonsense_variant := check_column_label(consequence_label, []string{"missense", "nonsynonymous"})
+		is_lof := lof.IsLoF(consequence_label, func(col string) string {
+			if value, ok := variant.Annotations[col]; ok {
+				return value.String()
+			}
+			return ""
+		})
+
+		if strata != nil {
+			strata.AddVariant(variant.VariantID, pulled.Classifier, variant.InfoFields[8], sample_indices, calls)
+		}
+
+		var tier VariantTier
+		var evidence []string
+		if tiers != nil {
+			tier, evidence = tiers.Classify(func(col string) string {
+				if value, ok := variant.Annotations[col]; ok {
+					return value.String()
+				}
+				return ""
+			})
+		}
+
+		carriers := 0
+		for _, individual := range sample_indices {
+			if add_sample_variant(sampleInfo[individual.SampleID], pulled.Classifier, variant.InfoFields[8], variant.VariantID, calls[individual.Index], is_pathogenic, is_nonsense_variant, is_lof, tier) {
+				carriers++
+				if comp_hets != nil {
+					var genes string
+					if value, ok := variant.Annotations[comp_hets.GeneCol]; ok {
+						genes = value.String()
+					}
+					comp_hets.Add(individual.SampleID, genes, variant.VariantID, variant.InfoFields[8], calls[individual.Index])
+				}
+			}
+		}
+		if tiers != nil {
+			tiers.Add(variant.VariantID, tier, evidence, carriers)
+		}
+		return nil
+	})
+	return sampleInfo
+}
+
+// FindSampleVariantsFromStream runs the view-sample-variants step on the variants from the pull
+// stage without writing them to an intermediate file
+func FindSampleVariantsFromStream(config internal.UserArgs, pulled *PulledVariants, variants <-chan []VariantInfo, logger *slog.Logger) {
+	samples, ranks := restrict_to_top_quantile(config, load_samples_of_interest(config, logger), logger)
+
+	strata := open_strata_summary(config, logger)
+	tiers := variant_tiers(config)
+	comp_hets := new_compound_hets(config.GeneCol)
+	sample_variants := collect_sample_variants(pulled, variants, samples, config.ClinvarColumnName, config.ConsequenceCol, lof_rule(config), strata, tiers, comp_hets, logger)
+	close_strata_summary(strata, logger)
+
+	write_sample_output(config.OutputFilepath, sample_variants, load_phenotype_table(config, logger), ranks, load_covariate_table(config, logger), tiers, comp_hets, logger)
+}
+
+func FindSampleVariants(config internal.UserArgs, logger *slog.Logger) {
+	start_time := time.Now()
+
+	logger.Info(fmt.Sprintf("began the analysis at: %s\n", start_time.Format("2006-01-02@15:04:05")))
+	// read in the appropriate CLI flags
+
+	samples, ranks := restrict_to_top_quantile(config, load_samples_of_interest(config, logger), logger)
 	// now we can parse through the output file for variants of interest
 
 	// Create the scanner to read the calls file with a custom buffer
 
-	sample_variants, errs := parse_calls(config.CallsFile, samples, config.ClinvarColumnName, config.ConsequenceCol, logger)
+	classifier, classifier_err := carrier_classifier(config.Classifier, config.GenotypeClass, config.MinVAF)
+	if classifier_err != nil {
+		logger.Error(classifier_err.Error())
+		os.Exit(1)
+	}
+
+	strata := open_strata_summary(config, logger)
+	tiers := variant_tiers(config)
+	comp_hets := new_compound_hets(config.GeneCol)
+	sample_variants, errs := parse_calls(config.CallsFile, samples, config.ClinvarColumnName, config.ConsequenceCol, classifier, lof_rule(config), strata, tiers, comp_hets, logger)
+	close_strata_summary(strata, logger)
 
 	var parsing_err_encountered bool
 	for _, err_msg := range errs {
@@ -286,20 +831,7 @@ func FindSampleVariants(config internal.UserArgs, logger *slog.Logger) {
 		os.Exit(1)
 	}
 
-	logger.Info(fmt.Sprintf("Identified variants for %d samples", len(sample_variants)))
-
-	output_fh, output_err := os.Create(config.OutputFilepath)
-
-	if output_err != nil {
-		logger.Error(fmt.Sprintf("Encountered the following error while trying to open the output file, %s.\n %s", config.OutputFilepath, output_err))
-		os.Exit(1)
-	}
-
-	defer output_fh.Close()
-
-	writer := bufio.NewWriter(output_fh)
-	logger.Info(fmt.Sprintf("Writing output to the file: %s", config.OutputFilepath))
-	write_variants(writer, sample_variants)
+	write_sample_output(config.OutputFilepath, sample_variants, load_phenotype_table(config, logger), ranks, load_covariate_table(config, logger), tiers, comp_hets, logger)
 
 	end_time := time.Now()
 
@@ -2,93 +2,257 @@ package cmd
 
 import (
 	"bufio"
+	"cmp"
 	"fmt"
 	"go-phers-parser/internal/files"
-	"maps"
+	"go-phers-parser/internal/genotype"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/model"
+	"go-phers-parser/internal/output"
+	"go-phers-parser/internal/pseudonym"
+	"go-phers-parser/internal/resources"
+	"go-phers-parser/vcf"
+	"hash/fnv"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
 )
 
-func check_alt_call(call string, reference_call_set map[string]bool) bool {
-	_, call_is_ref := reference_call_set[call] // line checks to see if our value is one of the reference calls
+// Result writes the rows of the find-all-carriers output as the variants are read so that only
+// one variant is held in memory at a time. The sample columns come from the vcf header (without the
+// excluded samples) so the header can be written before any variants are read. With CountsOnly
+// there are no sample columns and the carriers are dropped before the rows are written. A
+// MaxCarriers above 0 caps the number of carriers that are listed for each variant
+type Result struct {
+	Errors      []error
+	Samples     []string // sample columns of the output in the order of the vcf
+	CountsOnly  bool
+	MaxCarriers int
+	Written     int // number of variant rows that have been written
+	output      *bufio.Writer
+}
 
-	return !call_is_ref
+// NewResult creates a Result that writes to the output. The samples are the ids of the vcf
+// header that weren't excluded
+func NewResult(output *bufio.Writer, samples []string, counts_only bool, max_carriers int) *Result {
+	result := &Result{CountsOnly: counts_only, MaxCarriers: max_carriers, output: output}
+	if !counts_only {
+		result.Samples = samples
+	}
+	return result
 }
 
-type Result struct {
-	Variants []VariantCalls
-	Errors   []error
-	Samples  map[string]bool
+// header_samples returns the ids of the samples that weren't excluded in the order of the vcf columns
+func header_samples(streamReader *files.VCFReader) []string {
+	samples := make([]string, 0, len(streamReader.SampleColumns))
+	for _, col_indx := range streamReader.SampleColumns {
+		samples = append(samples, streamReader.SampleMapping[col_indx])
+	}
+	return samples
+}
+
+// WriteHeader writes the header line. It has to be called before any variants are added
+func (result *Result) WriteHeader() error {
+	header := output.Header("CHROM", "POS", "ID", "HOMO_REF_COUNT", "HET_COUNT", "HOMO_ALT_COUNT", "NO_CALL_COUNT", "OTHER_CALL_COUNT", "UNEXPECTED_PLOIDY_COUNT", "ALT_ALLELE_COUNT", "ALLELE_NUMBER", "ALT_ALLELE_FREQ")
+	// The capped carrier lists need the total number of carriers because the listed carriers are only a sample
+	if result.MaxCarriers > 0 {
+		header.Add("CARRIER_COUNT", "CARRIERS_LISTED")
+	}
+	for _, sample_id := range result.Samples {
+		header.Add(pseudonym.ID(sample_id))
+	}
+	_, write_err := header.WriteTo(result.output)
+	return write_err
+}
+
+// Add writes the row for the variant. The row has the genotype counts, the allele frequency, and a
+// column for each sample. Samples that don't carry the variant (or weren't picked by MaxCarriers) get a -
+func (result *Result) Add(variant VariantCalls) error {
+	variant.TotalCarriers = len(variant.carrier_order)
+	if result.CountsOnly {
+		variant.VariantCarriers = nil
+		variant.carrier_order = nil
+	} else if result.MaxCarriers > 0 && len(variant.carrier_order) > result.MaxCarriers {
+		variant.carrier_order = sample_carriers(variant.VariantInfo, variant.carrier_order, result.MaxCarriers)
+		listed := make(map[string]string, len(variant.carrier_order))
+		for _, sample_id := range variant.carrier_order {
+			listed[sample_id] = variant.VariantCarriers[sample_id]
+		}
+		variant.VariantCarriers = listed
+	}
+
+	row := output.NewRow(variant.VariantInfo...)
+	counts := variant.GenotypeCounts
+	row.Int(counts[model.HomRef], counts[model.Het], counts[model.HomAlt], counts[model.Missing], counts[model.Other], counts[unexpectedPloidy])
+	row.Int(variant.AltAlleles, variant.CalledAlleles).Add(variant.allele_freq())
+	if result.MaxCarriers > 0 {
+		row.Int(variant.TotalCarriers, len(variant.VariantCarriers))
+	}
+	for _, sample_id := range result.Samples {
+		if sample_call, ok := variant.VariantCarriers[sample_id]; ok {
+			row.Add(pseudonym.ID(sample_id) + ":" + sample_call)
+		} else {
+			row.Add("-")
+		}
+	}
+
+	if _, write_err := row.WriteTo(result.output); write_err != nil {
+		return write_err
+	}
+	result.Written++
+	return nil
 }
 
-func (result *Result) generate_sample_list() []string {
-	return slices.Collect(maps.Keys(result.Samples))
+// sample_carriers picks max_carriers of the carriers to list for a common variant. Each carrier is
+// ranked by a hash of the variant and its id so the same carriers are picked every time the stream
+// is read (even if the samples are in a different order) and different variants pick different carriers.
+// The picked carriers keep their order from the vcf
+func sample_carriers(variant_info []string, carriers []string, max_carriers int) []string {
+	variant_key := strings.Join(variant_info, ":")
+	ranks := make(map[string]uint64, len(carriers))
+	for _, sample_id := range carriers {
+		hasher := fnv.New64a()
+		hasher.Write([]byte(variant_key + "\x00" + sample_id))
+		ranks[sample_id] = hasher.Sum64()
+	}
+
+	ranked := slices.Clone(carriers)
+	slices.SortFunc(ranked, func(first string, second string) int {
+		return cmp.Or(cmp.Compare(ranks[first], ranks[second]), strings.Compare(first, second))
+	})
+	picked := make(map[string]bool, max_carriers)
+	for _, sample_id := range ranked[:max_carriers] {
+		picked[sample_id] = true
+	}
+
+	listed := make([]string, 0, max_carriers)
+	for _, sample_id := range carriers {
+		if picked[sample_id] {
+			listed = append(listed, sample_id)
+		}
+	}
+	return listed
 }
 
+// unexpectedPloidy is the slot of genotypeCounts for the calls with a ploidy that wasn't expected.
+// It comes after the genotype classes
+const unexpectedPloidy = model.Other + 1
+
+// genotypeCounts counts the calls of a variant by their genotype class (model.HomRef, model.Het, ...)
+// with the calls of an unexpected ploidy in the last slot. An array indexed by the class is much
+// smaller than a map keyed by the class names and it doesn't have to be allocated for every record
+type genotypeCounts [unexpectedPloidy + 1]int
+
 type VariantCalls struct {
 	VariantInfo     []string
 	VariantCarriers map[string]string
-	GenotypeCounts  map[string]int
+	GenotypeCounts  genotypeCounts
+	AltAlleles      int // alternate alleles in the calls of the samples. Calls with an unexpected ploidy aren't counted
+	CalledAlleles   int // called (non missing) alleles in the same calls
+	TotalCarriers   int // carriers of the variant before --max-carriers-listed picked the ones to list
+	Ref             string
+	Alt             string
+	carrier_order   []string
 }
 
-func update_genotype_count(call string, genotype_counts map[string]int) {
-	switch call {
-	case "0/0":
-		genotype_counts["homo_ref"]++
-	case "0/1", "1/0":
-		genotype_counts["het"]++
-	case "1/1":
-		genotype_counts["homo_alt"]++
-	case "./.", ".":
-		genotype_counts["no_calls"]++
-	default:
-		genotype_counts["other"]++
+// allele_freq returns the alternate allele frequency of the variant in the samples of the stream.
+// Variants where none of the samples have a called allele get a -
+func (variant *VariantCalls) allele_freq() string {
+	if variant.CalledAlleles == 0 {
+		return "-"
 	}
+	return strconv.FormatFloat(float64(variant.AltAlleles)/float64(variant.CalledAlleles), 'f', 6, 64)
 }
 
-func process_variant_stream(streamReader *files.VCFReader, resultsObj *Result) error {
-	for streamReader.FileScanner.Scan() {
+func update_genotype_count(summary genotype.Summary, expected_ploidy map[int]bool, genotype_counts *genotypeCounts) {
+	// Calls with a ploidy that we don't expect are counted separately instead of being classified
+	if !expected_ploidy[summary.Ploidy] {
+		genotype_counts[unexpectedPloidy]++
+		return
+	}
+	genotype_counts[summary.Class]++
+}
 
-		// We can initialize the variantCalls object with a dictionary for the genotype counts.
-		// This structure will help us while writing later
-		variantCallsObj := VariantCalls{
-			VariantCarriers: make(map[string]string),
-			GenotypeCounts: map[string]int{
-				"homo_alt": 0,
-				"homo_ref": 0,
-				"het":      0,
-				"no_calls": 0,
-				"other":    0,
-			},
-		}
+// process_line reads the calls of one record of the stream. The carriers and the genotype counts
+// only include the samples that weren't excluded. The GT of each call is looked up in the symbols
+// of the stream so that the calls aren't parsed again for every record
+func process_line(line string, line_number int, streamReader *files.VCFReader, selector *vcf.ColumnSelector, expected_ploidy map[int]bool, classifier vcf.GenotypeClassifier, symbols *genotype.SymbolTable) (VariantCalls, error) {
+	variantCallsObj := VariantCalls{VariantCarriers: make(map[string]string)}
+
+	// A truncated record would cause us to misread the calls so we return the error and the record is skipped
+	split_line, column_err := split_record(line, selector, streamReader.Col_count)
+	if column_err != nil {
+		return variantCallsObj, fmt.Errorf("line %d: %w", line_number, column_err)
+	}
+
+	// The typed record checks the fixed columns so that a bad position doesn't end up in the output
+	record, record_err := model.ParseVariant(split_line)
+	if record_err != nil {
+		return variantCallsObj, fmt.Errorf("line %d: %w", line_number, record_err)
+	}
+
+	// We can add the variant string here
+	variantCallsObj.VariantInfo = []string{record.Chrom, strconv.Itoa(record.Pos), record.ID}
+	// The alleles aren't written but they are needed to match the variant with other vcfs
+	variantCallsObj.Ref, variantCallsObj.Alt = record.Ref, strings.Join(record.Alt, ",")
 
-		line := streamReader.FileScanner.Text()
-		split_line := strings.Split(strings.TrimSpace(line), "\t")
-
-		// We can add the variant string here
-		variantCallsObj.VariantInfo = split_line[0:3]
-
-		// We will need to generate the reference calls for comparison
-		ref_call_set := generate_reference_set()
-		// We can iterate over each call
-		for indx, calls := range split_line[9:] {
-			indx = indx + 9
-			// There may be some indices that are missing if there are samples we want to skip.
-			// We will need to check and make sure the key exist and only proceed if it does
-			if id, ok := streamReader.SampleMapping[indx]; ok {
-				if check_alt_call(calls, ref_call_set) {
-					// We can add the id and the call to the carriers map
-					variantCallsObj.VariantCarriers[id] = calls
-					// Then we can also save the carrier ids we found. We will use
-					// this list to create the header for the output file later
-					resultsObj.Samples[id] = true // This is how you use a set in Go. Its the same as a map
-				}
-				update_genotype_count(calls, variantCallsObj.GenotypeCounts)
+	// We only read the calls of the samples that weren't excluded or left out by --samples. The
+	// columns are in the order of the header so the carriers keep the order of the vcf. With a
+	// selector the line only has the calls of these samples
+	for sample_pos, col_indx := range streamReader.SampleColumns {
+		call_indx := col_indx
+		if selector != nil {
+			call_indx = sample_pos + 9
+		}
+		id, calls := streamReader.SampleMapping[col_indx], split_line[call_indx]
+		summary := symbols.Lookup(calls)
+		if classifier.IsCarrier(split_line[8], calls) {
+			// Calls that are only a GT are stored as the interned GT instead of a piece of the line
+			if len(calls) == len(summary.GT) {
+				calls = summary.GT
 			}
+			// We can add the id and the call to the carriers map. The order is kept so that the
+			// result can add new carriers to the output columns in the order of the vcf
+			variantCallsObj.VariantCarriers[id] = calls
+			variantCallsObj.carrier_order = append(variantCallsObj.carrier_order, id)
+		}
+		update_genotype_count(summary, expected_ploidy, &variantCallsObj.GenotypeCounts)
+		// The allele frequency is computed from the calls instead of the AF in the INFO column
+		// because the stream is usually a subset of the samples in the callset
+		if expected_ploidy[summary.Ploidy] {
+			variantCallsObj.AltAlleles += summary.AltCount
+			variantCallsObj.CalledAlleles += summary.AltCount + summary.RefCount
+		}
+	}
+	return variantCallsObj, nil
+}
+
+// process_variant_stream reads the records of the stream and writes a row for each one. Malformed
+// records are skipped and their errors are collected in the result
+func process_variant_stream(streamReader *files.VCFReader, expected_ploidy map[int]bool, classifier vcf.GenotypeClassifier, resultsObj *Result) error {
+	defer resources.StartStage("parse vcf")()
+	// We need to keep track of the line number so that we can report it if a record is malformed
+	line_number := streamReader.HeaderLines
+	// When samples were excluded or left out by --samples only their columns are pulled out of the lines
+	var selector *vcf.ColumnSelector
+	if len(streamReader.SampleColumns) < streamReader.Col_count-9 {
+		selector = vcf.NewColumnSelector(streamReader.SampleColumns)
+	}
+	symbols := genotype.NewSymbolTable()
+	for streamReader.FileScanner.Scan() {
+		line_number++
+
+		variantCallsObj, line_err := process_line(streamReader.FileScanner.Text(), line_number, streamReader, selector, expected_ploidy, classifier, symbols)
+		if line_err != nil {
+			resultsObj.Errors = append(resultsObj.Errors, line_err)
+			continue
 		}
 		fmt.Printf("Identified %d individuals who were either heterozygous or homozygous alt for the variant %s\n", len(variantCallsObj.VariantCarriers), variantCallsObj.VariantInfo[2])
-		resultsObj.Variants = append(resultsObj.Variants, variantCallsObj)
+		// The row is written right away so that the memory doesn't grow with the size of the region
+		if write_err := resultsObj.Add(variantCallsObj); write_err != nil {
+			return fmt.Errorf("unable to write the row for the variant on line %d: %w", line_number, write_err)
+		}
 	}
 	if streamReader.FileScanner.Err() != nil {
 		return streamReader.FileScanner.Err()
@@ -96,45 +260,37 @@ func process_variant_stream(streamReader *files.VCFReader, resultsObj *Result) e
 	return nil
 }
 
-func writer(writer *bufio.Writer, results Result) {
-	// get a list of all the samples we need to put in the header
-	sample_list := results.generate_sample_list()
-	// Create the header string
-	header_str := strings.Builder{}
-	header_str.WriteString("CHROM\tPOS\tID\tHOMO_REF_COUNT\tHET_COUNT\tHOMO_ALT_COUNT\tNO_CALL_COUNT\tOTHER_CALL_COUNT\t")
-	header_str.WriteString(fmt.Sprintf("%s\n", strings.Join(sample_list, "\t")))
-
-	writer.WriteString(header_str.String())
-	// Now create the output string
-	for _, variant := range results.Variants {
-		row_str := strings.Builder{}
-		row_str.WriteString(fmt.Sprintf("%s\t%d\t%d\t%d\t%d\t%d", strings.Join(variant.VariantInfo, "\t"), variant.GenotypeCounts["homo_ref"], variant.GenotypeCounts["het"], variant.GenotypeCounts["homo_alt"], variant.GenotypeCounts["no_calls"], variant.GenotypeCounts["other"]))
-		for sampleID := range results.Samples {
-			sample_call, ok := variant.VariantCarriers[sampleID]
-
-			var output_str string
-			if ok {
-				output_str = fmt.Sprintf("\t%s:%s", sampleID, sample_call)
-			} else {
-				output_str = "\t-"
-			}
-			row_str.WriteString(output_str)
-		}
-		row_str.WriteString("\n")
-		writer.WriteString(row_str.String())
-	}
-	writer.Flush()
-}
-
 // This function is used to find all the individuals with variant calls for a site of interest.
 // It expects to have input streamed in from bcftools
-func FindAllCarrierCalls(output_filepath string, buffersize int, exclusion_substring string) {
+func FindAllCarrierCalls(output_filepath string, buffersize int, exclusion_substring string, expected_ploidy_str string, classifier_str string, genotype_class string, min_vaf float64, counts_only bool, max_carriers int, samples string, samples_file string) {
+	// Calls with a ploidy outside of this set get their own count in the output
+	expected_ploidy, ploidy_err := genotype.ParsePloidyList(expected_ploidy_str)
+	if ploidy_err != nil {
+		fmt.Printf("Unable to parse the expected ploidy value, %s, into a list of integers: %s\n", expected_ploidy_str, ploidy_err)
+		os.Exit(1)
+	}
+
+	classifier, classifier_err := carrier_classifier(classifier_str, genotype_class, min_vaf)
+	if classifier_err != nil {
+		fmt.Println(classifier_err)
+		os.Exit(1)
+	}
+
+	// --samples picks the sample columns that are read so the full cohort vcf can be streamed in
+	selection, selection_err := load_sample_selection(samples, samples_file)
+	if selection_err != nil {
+		fmt.Println(selection_err)
+		os.Exit(1)
+	}
 
 	// we need to create the reader
 	vcfStreamer := files.MakeStreamReader(buffersize)
+	defer vcfStreamer.Close()
 
-	// We need to add the sample-exclusion-string
-	vcfStreamer.SampleExclusions = strings.Split(exclusion_substring, ",")
+	// We need to add the sample-exclusion-string so that the reference panel samples are skipped
+	// while the header is mapped. The substrings are compared without case
+	vcfStreamer.SampleExclusions = files.ParseSampleExclusions(exclusion_substring)
+	vcfStreamer.SampleFilter = selection.Filter()
 
 	// We need to early terminate if there was an error while parsing the header line or if there was no header line found in the file
 	if err := vcfStreamer.ParseHeader("#CHROM"); err != nil {
@@ -144,13 +300,42 @@ func FindAllCarrierCalls(output_filepath string, buffersize int, exclusion_subst
 		fmt.Printf("Expected the input vcf file %s, to have a header line containing the string #CHROM. This line is essential to map the genotype calls to individuals. Please ensure that this line is in the file. Terminating program...\n", vcfStreamer.Filename)
 		os.Exit(1)
 	}
+	if len(vcfStreamer.SampleExclusions) > 0 {
+		fmt.Printf("Excluded %d of the %d samples in the vcf header because their ids contained one of the substrings: %s\n", vcfStreamer.ExcludedSamples(), max(vcfStreamer.Col_count-9, 0), strings.Join(vcfStreamer.SampleExclusions, ", "))
+	} else if selection != nil {
+		fmt.Printf("Reading %d of the %d samples in the vcf header that were selected with --samples\n", len(vcfStreamer.SampleColumns), max(vcfStreamer.Col_count-9, 0))
+	}
+	if missing := selection.Missing(); len(missing) > 0 {
+		fmt.Printf("Warning: %s\n", selection.missing_samples_message(missing))
+	}
 
-	// make a list of errors
-	var err []error
+	if max_carriers < 0 {
+		fmt.Printf("The --max-carriers-listed has to be 0 (no limit) or larger but it was %d\n", max_carriers)
+		os.Exit(1)
+	}
 
-	resultObj := Result{Errors: err, Samples: make(map[string]bool)}
+	// The output is opened before the stream is read because the rows are written as the variants are found
+	output_fh, open_err := files.Create(output_filepath)
+	manifest.Track(output_filepath)
+	if open_err != nil {
+		fmt.Printf("The following error was encountered while opening the file: %s", open_err)
+		os.Exit(1)
+	}
+	// The output has to be closed so that compressed outputs and uploads are finished
+	defer output_fh.Close()
 
-	process_variant_stream(vcfStreamer, &resultObj)
+	buffered_writer := bufio.NewWriterSize(output_fh, files.WriteBufferSize())
+	defer buffered_writer.Flush()
+
+	resultObj := NewResult(buffered_writer, header_samples(vcfStreamer), counts_only, max_carriers)
+	if header_err := resultObj.WriteHeader(); header_err != nil {
+		fmt.Printf("Unable to write the header of the output file %s: %s\n", output_filepath, header_err)
+		os.Exit(1)
+	}
+
+	if stream_err := process_variant_stream(vcfStreamer, expected_ploidy, classifier, resultObj); stream_err != nil {
+		resultObj.Errors = append(resultObj.Errors, stream_err)
+	}
 
 	var error_encountered bool
 	for _, msg := range resultObj.Errors {
@@ -160,16 +345,10 @@ func FindAllCarrierCalls(output_filepath string, buffersize int, exclusion_subst
 		}
 	}
 	if error_encountered {
-		fmt.Println("Encountered the above errors while parsing through the vcf file stream. Terminating program...")
+		// The rows of the records before the errors have already been written so the output is incomplete
+		buffered_writer.Flush()
+		output_fh.Close()
+		fmt.Printf("Encountered the above errors while parsing through the vcf file stream. The output %s only has %d variants and is incomplete. Terminating program...\n", output_filepath, resultObj.Written)
 		os.Exit(1)
 	}
-
-	output_fh, open_err := os.Create(output_filepath)
-	if open_err != nil {
-		fmt.Printf("The following error was encountered while opening the file: %s", open_err)
-	}
-
-	buffered_writer := bufio.NewWriter(output_fh)
-
-	writer(buffered_writer, resultObj)
 }
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+
+	"go-phers-parser/internal/files"
+)
+
+const carriersFixture = `##fileformat=VCFv4.2
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	S1	S2	REF_PANEL_1	S3
+chr22	100	var1	A	G	.	PASS	.	GT	0/1	0/0	1/1	./.
+chr22	200	var2	C	T	.	PASS	.	GT	0/0	1/1	0/1	0/1
+chr22	300	var3	G	A	.	PASS	.	GT	0/0	0/0	0/0	0/0
+chr22	400	var4	T	C	.	PASS	.	GT	1|1	0/1	0/0	0/1
+`
+
+// read_carriers runs the find-all-carriers stages over the fixture and returns the rows of the output
+func read_carriers(t *testing.T, fixture string, exclusions string, counts_only bool, max_carriers int) (*Result, [][]string) {
+	t.Helper()
+	reader := &files.VCFReader{
+		FileReader:       files.FileReader{Filename: "fixture", FileScanner: bufio.NewScanner(strings.NewReader(fixture))},
+		SampleExclusions: files.ParseSampleExclusions(exclusions),
+	}
+	if header_err := reader.ParseHeader("#CHROM"); header_err != nil || !reader.Header_Found {
+		t.Fatalf("unable to read the header of the fixture: %v", header_err)
+	}
+
+	var output bytes.Buffer
+	buffered := bufio.NewWriter(&output)
+	result := NewResult(buffered, header_samples(reader), counts_only, max_carriers)
+	if header_err := result.WriteHeader(); header_err != nil {
+		t.Fatalf("unable to write the header: %s", header_err)
+	}
+	classifier, _ := carrier_classifier("hard", "any", 0)
+	if stream_err := process_variant_stream(reader, map[int]bool{1: true, 2: true}, classifier, result); stream_err != nil {
+		t.Fatalf("unexpected error: %s", stream_err)
+	}
+	buffered.Flush()
+
+	var rows [][]string
+	for _, line := range strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n") {
+		rows = append(rows, strings.Split(line, "\t"))
+	}
+	return result, rows
+}
+
+func TestFindAllCarriersRows(t *testing.T) {
+	result, rows := read_carriers(t, carriersFixture, " REF_Panel ,", false, 0)
+	if len(result.Errors) > 0 {
+		t.Fatalf("unexpected errors: %v", result.Errors)
+	}
+
+	// One header plus one row per variant, including the variant without any carriers
+	if len(rows) != 5 {
+		t.Fatalf("expected 5 lines in the output but found %d: %q", len(rows), rows)
+	}
+	header := rows[0]
+	samples := header[12:]
+	if strings.Join(samples, ",") != "S1,S2,S3" {
+		t.Errorf("expected the carrier columns S1,S2,S3 but found %q", samples)
+	}
+
+	expected := map[string]struct {
+		counts   string // HOMO_REF, HET, HOMO_ALT, NO_CALL
+		alleles  string // ALT_ALLELE_COUNT, ALLELE_NUMBER, ALT_ALLELE_FREQ
+		carriers string
+	}{
+		"var1": {"1,1,0,1", "1,4,0.250000", "S1:0/1,-,-"},
+		"var2": {"1,1,1,0", "3,6,0.500000", "-,S2:1/1,S3:0/1"},
+		"var3": {"3,0,0,0", "0,6,0.000000", "-,-,-"},
+		"var4": {"0,2,1,0", "4,6,0.666667", "S1:1|1,S2:0/1,S3:0/1"},
+	}
+	for _, row := range rows[1:] {
+		if len(row) != len(header) {
+			t.Errorf("the row for %s has %d columns but the header has %d", row[2], len(row), len(header))
+			continue
+		}
+		want, found := expected[row[2]]
+		if !found {
+			t.Errorf("unexpected variant %s in the output", row[2])
+			continue
+		}
+		if counts := strings.Join(row[3:7], ","); counts != want.counts {
+			t.Errorf("%s: expected the genotype counts %s but found %s", row[2], want.counts, counts)
+		}
+		if alleles := strings.Join(row[9:12], ","); alleles != want.alleles {
+			t.Errorf("%s: expected the allele counts %s but found %s", row[2], want.alleles, alleles)
+		}
+		if carriers := strings.Join(row[12:], ","); carriers != want.carriers {
+			t.Errorf("%s: expected the carriers %s but found %s", row[2], want.carriers, carriers)
+		}
+	}
+}
+
+func TestFindAllCarriersMalformedRecord(t *testing.T) {
+	fixture := carriersFixture + "chr22\tnotapos\tvar5\tA\tG\t.\tPASS\t.\tGT\t0/1\t0/1\t0/1\t0/1\nchr22\t500\tvar6\tA\tG\n"
+	result, rows := read_carriers(t, fixture, "", false, 0)
+	if len(result.Errors) != 2 {
+		t.Errorf("expected an error for each of the 2 malformed records but found %v", result.Errors)
+	}
+	// The malformed records are skipped while the rows of the other variants are still written
+	if len(rows) != 5 {
+		t.Errorf("expected 5 lines in the output but found %d", len(rows))
+	}
+	// Without exclusions the reference panel sample has a column too
+	if strings.Join(rows[0][12:], ",") != "S1,S2,REF_PANEL_1,S3" {
+		t.Errorf("expected a column for every sample in the header but found %q", rows[0][12:])
+	}
+	if result.Written != 4 {
+		t.Errorf("expected 4 rows to be written but found %d", result.Written)
+	}
+}
+
+func TestFindAllCarriersCountsOnly(t *testing.T) {
+	result, rows := read_carriers(t, carriersFixture, "", true, 0)
+	if len(result.Samples) > 0 {
+		t.Errorf("no samples should be kept with CountsOnly but found %v", result.Samples)
+	}
+	for _, row := range rows {
+		if len(row) != 12 {
+			t.Errorf("expected only the 12 count columns but found %q", row)
+		}
+		for _, value := range row {
+			if strings.HasPrefix(value, "S1") || strings.HasPrefix(value, "REF_PANEL") {
+				t.Errorf("found the sample id %s in the counts only output", value)
+			}
+		}
+	}
+	if rows[4][2] != "var4" || strings.Join(rows[4][3:7], ",") != "1,2,1,0" {
+		t.Errorf("unexpected counts for var4: %q", rows[4])
+	}
+}
+
+func TestMaxCarriersListed(t *testing.T) {
+	carriers := []string{"S1", "S2", "S3", "S4", "S5"}
+	picked := sample_carriers([]string{"chr1", "100", "var1"}, carriers, 2)
+	// The same carriers are picked when the samples come in a different order
+	reversed := slices.Clone(carriers)
+	slices.Reverse(reversed)
+	picked_reversed := sample_carriers([]string{"chr1", "100", "var1"}, reversed, 2)
+	slices.Reverse(picked_reversed)
+	if len(picked) != 2 || !slices.Equal(picked, picked_reversed) {
+		t.Errorf("expected the same 2 carriers to be picked but found %q and %q", picked, picked_reversed)
+	}
+
+	// var4 has 3 carriers. Only 1 of them is listed but the total is still reported
+	_, rows := read_carriers(t, carriersFixture, "", false, 1)
+	if strings.Join(rows[0][12:14], ",") != "CARRIER_COUNT,CARRIERS_LISTED" {
+		t.Fatalf("expected the CARRIER_COUNT and CARRIERS_LISTED columns but found %q", rows[0])
+	}
+	if rows[4][2] != "var4" || rows[4][12] != "3" || rows[4][13] != "1" {
+		t.Errorf("expected 1 of the 3 carriers of var4 to be listed but found %q", rows[4][12:])
+	}
+	listed := 0
+	for _, value := range rows[4][14:] {
+		if value != "-" {
+			listed++
+		}
+	}
+	if listed != 1 {
+		t.Errorf("expected 1 listed carrier for var4 but found %d in %q", listed, rows[4][14:])
+	}
+}
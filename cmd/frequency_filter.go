@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// AnnotationFrequency filters the variants on population frequencies from the annotation columns
+// (such as the gnomAD columns that VEP adds) instead of the AF in the INFO column. The mode
+// decides how the populations are combined
+//
+//	max   the largest frequency of the populations. A variant is only rare if it is rare everywhere
+//	min   the smallest frequency of the populations. A variant is rare if it is rare in any population
+//	pop   the frequency of the first column that has a value so that a specific population can be
+//	      used with a fallback to a broader one (such as gnomADe_NFE_AF,gnomADe_AF)
+//
+// With Fold each frequency is folded to the minor allele frequency before the populations are combined
+type AnnotationFrequency struct {
+	Columns []string
+	Mode    string
+	Fold    bool
+}
+
+// new_annotation_frequency parses the --af-columns and --af-mode flags. No columns means that the
+// INFO AF is used and nil is returned
+func new_annotation_frequency(columns string, mode string, fold bool) (*AnnotationFrequency, error) {
+	if columns == "" {
+		return nil, nil
+	}
+	if mode == "" {
+		mode = "max"
+	}
+	if mode != "max" && mode != "min" && mode != "pop" {
+		return nil, fmt.Errorf("the --af-mode %s is not recognized. Allowed values are max, min, or pop", mode)
+	}
+	return &AnnotationFrequency{Columns: strings.Split(columns, ","), Mode: mode, Fold: fold}, nil
+}
+
+// column_frequency parses the frequency of one annotation column. Variants with several
+// transcripts have the values of each transcript separated by a semicolon (and VEP separates
+// the values of overlapping variants with &). These are usually the same value so we take the
+// largest to be safe. Missing values like - or an empty string are skipped
+func column_frequency(value string) (float64, bool) {
+	freq, found := 0.0, false
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '&' || r == ',' }) {
+		parsed, parse_err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if parse_err != nil || math.IsNaN(parsed) {
+			continue
+		}
+		freq = max(freq, parsed)
+		found = true
+	}
+	return freq, found
+}
+
+// Frequency combines the frequencies of the columns with the mode. The second value is false if
+// none of the columns had a frequency for the variant
+func (anno_freq *AnnotationFrequency) Frequency(values map[string]string) (float64, bool) {
+	return anno_freq.combine(values, anno_freq.Fold)
+}
+
+func (anno_freq *AnnotationFrequency) combine(values map[string]string, fold bool) (float64, bool) {
+	combined, found := 0.0, false
+	for _, col := range anno_freq.Columns {
+		freq, has_freq := column_frequency(values[col])
+		if !has_freq {
+			continue
+		}
+		if fold {
+			freq = fold_frequency(freq)
+		}
+		switch {
+		case anno_freq.Mode == "pop":
+			return freq, true
+		case !found:
+			combined = freq
+		case anno_freq.Mode == "max":
+			combined = max(combined, freq)
+		default:
+			combined = min(combined, freq)
+		}
+		found = true
+	}
+	return combined, found
+}
+
+// Passes reports whether the variant passes the frequency threshold. Variants that aren't in the
+// population databases have no frequency and are treated as rare. With Fold the second value
+// reports whether the reference is the minor allele (the unfolded frequency is above 0.5)
+func (anno_freq *AnnotationFrequency) Passes(values map[string]string, maf_cap mafThreshold) (bool, bool) {
+	freq, found := anno_freq.Frequency(values)
+	if found && !maf_cap.passes(freq) {
+		return false, false
+	}
+	if !anno_freq.Fold || !found {
+		return true, false
+	}
+	alt_freq, _ := anno_freq.combine(values, false)
+	return true, alt_freq > 0.5
+}
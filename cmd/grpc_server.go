@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"fmt"
+	"go-phers-parser/internal/pseudonym"
+	"go-phers-parser/internal/rpc"
+	"go-phers-parser/vcf"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// variantService streams the records of a region over gRPC so that the JVM based services can
+// consume the results without a file handoff. It shares the index and the annotation cache with the http server
+type variantService struct {
+	rpc.UnimplementedVariantServiceServer
+	server *VariantServer
+}
+
+// passes_frequency_filter reports whether any alternate allele is at or below the cap. Records
+// without a usable frequency (no values or only missing values like AF=.) are kept so that the
+// client can decide what to do with them
+func passes_frequency_filter(freqs []float64, max_freq float64) bool {
+	if max_freq <= 0 {
+		return true
+	}
+	usable := false
+	for _, freq := range freqs {
+		// A missing value decodes to NaN which is never at or below the cap
+		if math.IsNaN(freq) {
+			continue
+		}
+		if freq <= max_freq {
+			return true
+		}
+		usable = true
+	}
+	return !usable
+}
+
+func (service *variantService) StreamRegion(request *rpc.RegionRequest, stream grpc.ServerStreamingServer[rpc.VariantRecord]) error {
+	server := service.server
+
+	region, region_err := parse_request_region(request.GetRegion())
+	if region_err != nil {
+		return status.Error(codes.InvalidArgument, region_err.Error())
+	}
+
+	annotations, anno_err := server.annotations(region.chrom)
+	if anno_err != nil {
+		return status.Error(codes.Internal, anno_err.Error())
+	}
+
+	info_decoder := vcf.NewInfoDecoder(&server.Metadata)
+
+	scan_err := server.Index.ScanRegion(server.VcfFile, region.chrom, region.start, region.end, server.Buffersize, func(split_line []string) error {
+		// The client may have hung up part way through the region
+		if ctx_err := stream.Context().Err(); ctx_err != nil {
+			return ctx_err
+		}
+		if len(split_line) != len(server.Samples)+9 {
+			return fmt.Errorf("the record for the variant %s has %d columns but the header has %d columns", split_line[2], len(split_line), len(server.Samples)+9)
+		}
+
+		var freqs []float64
+		if info, info_err := info_decoder.Decode(split_line[7], strings.Count(split_line[4], ",")+1); info_err == nil {
+			freqs, _, _ = allele_freqs(info)
+		}
+		if !passes_frequency_filter(freqs, request.GetMaxAlleleFrequency()) {
+			return nil
+		}
+
+		carrier_set := &rpc.CarrierSet{GenotypeCounts: make(map[string]int32)}
+		for sample_indx, call := range split_line[9:] {
+			genotype := vcf.ParseGenotype(call)
+			carrier_set.GenotypeCounts[genotype.Class().String()]++
+			if genotype.HasAlt() {
+				carrier_set.Carriers = append(carrier_set.Carriers, &rpc.Carrier{Sample: pseudonym.ID(server.Samples[sample_indx]), Genotype: call})
+			}
+		}
+		if request.GetCarriersOnly() && len(carrier_set.Carriers) == 0 {
+			return nil
+		}
+
+		pos, _ := strconv.ParseInt(split_line[1], 10, 64)
+		return stream.Send(&rpc.VariantRecord{
+			Chrom:             split_line[0],
+			Pos:               pos,
+			Id:                split_line[2],
+			Ref:               split_line[3],
+			Alt:               split_line[4],
+			Filter:            split_line[6],
+			AlleleFrequencies: freqs,
+			Annotations:       server.format_annotations(annotations, split_line[2]),
+			CarrierSet:        carrier_set,
+		})
+	})
+	if scan_err != nil {
+		if status_err, is_status := status.FromError(scan_err); is_status {
+			return status_err.Err()
+		}
+		return status.Error(codes.Internal, scan_err.Error())
+	}
+	return nil
+}
+
+// ServeGRPC starts the gRPC server on the address. This function blocks until the server stops
+func (server *VariantServer) ServeGRPC(address string) error {
+	listener, listen_err := net.Listen("tcp", address)
+	if listen_err != nil {
+		return listen_err
+	}
+
+	grpc_server := grpc.NewServer()
+	rpc.RegisterVariantServiceServer(grpc_server, &variantService{server: server})
+
+	return grpc_server.Serve(listener)
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPassesFrequencyFilter(t *testing.T) {
+	nan := math.NaN()
+	cases := []struct {
+		name     string
+		freqs    []float64
+		max_freq float64
+		expected bool
+	}{
+		{"no cap", []float64{0.5}, 0, true},
+		{"below the cap", []float64{0.001}, 0.01, true},
+		{"at the cap", []float64{0.01}, 0.01, true},
+		{"above the cap", []float64{0.2}, 0.01, false},
+		{"one rare allele", []float64{0.2, 0.001}, 0.01, true},
+		{"no frequency", nil, 0.01, true},
+		{"missing frequency", []float64{nan}, 0.01, true}, // AF=.
+		{"missing and common", []float64{nan, 0.2}, 0.01, false},
+		{"missing and rare", []float64{nan, 0.001}, 0.01, true},
+	}
+	for _, test_case := range cases {
+		if passes := passes_frequency_filter(test_case.freqs, test_case.max_freq); passes != test_case.expected {
+			t.Errorf("%s: expected passes_frequency_filter(%v, %g) to be %t but got %t", test_case.name, test_case.freqs, test_case.max_freq, test_case.expected, passes)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/header"
+	"go-phers-parser/internal/pseudonym"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+)
+
+// write_field_definitions writes the INFO/FORMAT/FILTER definitions sorted by their ID
+func write_field_definitions(writer *bufio.Writer, section string, definitions map[string]header.FieldDefinition) {
+	writer.WriteString(fmt.Sprintf("\n#%s\t%d\n", section, len(definitions)))
+	for _, id := range slices.Sorted(maps.Keys(definitions)) {
+		definition := definitions[id]
+		if section == "FILTER" {
+			writer.WriteString(fmt.Sprintf("%s\t%s\n", definition.ID, definition.Description))
+		} else {
+			writer.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\n", definition.ID, definition.Number, definition.Type, definition.Description))
+		}
+	}
+}
+
+// InspectHeader prints the metadata from the header of the vcf file. Only the header is read so
+// this is quick even for whole genome files. It lets users check the inputs before starting a long run
+func InspectHeader(args internal.UserArgs, logger *slog.Logger) {
+	vcf_reader := &files.VCFReader{FileReader: *files.Open(args.VcfFile, args.Buffersize)}
+
+	if vcf_reader.Err != nil {
+		vcf_reader.CheckErrors()
+	}
+
+	defer vcf_reader.Close()
+
+	if header_err := vcf_reader.ParseHeader("#CHROM"); header_err != nil || !vcf_reader.Header_Found {
+		logger.Error(fmt.Sprintf("Unable to find the #CHROM header line in the vcf file %s. %v", vcf_reader.Filename, header_err))
+		os.Exit(1)
+	}
+	metadata := vcf_reader.Metadata
+
+	writer := bufio.NewWriter(os.Stdout)
+	defer writer.Flush()
+
+	writer.WriteString(fmt.Sprintf("FILEFORMAT\t%s\n", metadata.FileFormat))
+	writer.WriteString(fmt.Sprintf("REFERENCE\t%s\n", metadata.Reference))
+
+	build := metadata.BuildFromReference()
+	if build == "" {
+		build = metadata.BuildFromContigs()
+	}
+	if build == "" {
+		build = "unknown"
+	}
+	writer.WriteString(fmt.Sprintf("GENOME_BUILD\t%s\n", build))
+	writer.WriteString(fmt.Sprintf("HEADER_LINES\t%d\n", vcf_reader.HeaderLines))
+
+	sample_count := vcf_reader.Col_count - 9
+	writer.WriteString(fmt.Sprintf("SAMPLE_COUNT\t%d\n", max(sample_count, 0)))
+	if sample_count > 0 {
+		writer.WriteString(fmt.Sprintf("FIRST_SAMPLE\t%s\n", pseudonym.ID(vcf_reader.SampleMapping[9])))
+		writer.WriteString(fmt.Sprintf("LAST_SAMPLE\t%s\n", pseudonym.ID(vcf_reader.SampleMapping[vcf_reader.Col_count-1])))
+	}
+
+	writer.WriteString(fmt.Sprintf("\n#CONTIGS\t%d\n", len(metadata.Contigs)))
+	for _, header_contig := range metadata.Contigs {
+		contig_length := "NA"
+		if header_contig.Length > 0 {
+			contig_length = fmt.Sprintf("%d", header_contig.Length)
+		}
+		writer.WriteString(fmt.Sprintf("%s\t%s\n", header_contig.ID, contig_length))
+	}
+
+	write_field_definitions(writer, "FILTER", metadata.Filter)
+	write_field_definitions(writer, "INFO", metadata.Info)
+	write_field_definitions(writer, "FORMAT", metadata.Format)
+}
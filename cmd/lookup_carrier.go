@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/pseudonym"
+	"go-phers-parser/vcf"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// write_carrier_variants writes one row per variant carried by the sample. The annotation
+// columns are written in the same order as the --keep-cols flag
+func write_carrier_variants(writer *bufio.Writer, sample_id string, records []*vcf.SampleRecord, infos []vcf.Info, annotations map[string]VariantAnnotations, anno_cols []string, info_cols []string) int {
+	header_cols := []string{"SAMPLE", "CHROM", "POS", "ID", "REF", "ALT", "GENOTYPE", "GENOTYPE_CLASS"}
+	header_cols = append(header_cols, info_cols...)
+	if annotations != nil {
+		header_cols = append(header_cols, anno_cols...)
+	}
+	writer.WriteString(strings.Join(header_cols, "\t") + "\n")
+
+	unannotated := 0
+	for indx, record := range records {
+		writer.WriteString(fmt.Sprintf("%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s", pseudonym.ID(sample_id), record.Chrom, record.Pos, record.ID, record.Ref, record.Alt, record.Call, record.Genotype.Class()))
+		for _, value := range format_info_columns(infos[indx], info_cols) {
+			writer.WriteString(fmt.Sprintf("\t%s", value))
+		}
+		if annotations != nil {
+			anno, ok := annotations[contig.VariantKey(record.ID)]
+			if !ok {
+				unannotated++
+			}
+			// Variants without annotations still get empty columns so that the rows line up with the header
+			for _, col := range anno_cols {
+				if value, found := anno[col]; found {
+					writer.WriteString(fmt.Sprintf("\t%s", value.String()))
+				} else {
+					writer.WriteString("\t")
+				}
+			}
+		}
+		writer.WriteString("\n")
+	}
+	return unannotated
+}
+
+// LookupCarrier streams the vcf from stdin and writes every variant that a single sample carries.
+// Only the column for that sample is parsed so this is much faster than running pull-variants and
+// view-sample-variants when we only care about one individual
+func LookupCarrier(args internal.UserArgs, logger *slog.Logger) {
+	if args.SampleID == "" {
+		logger.Error("A sample id needs to be provided with the --sample flag")
+		os.Exit(1)
+	}
+	maf_cap, threshold_err := new_maf_threshold(args.MafCap, args.MafCompare)
+	if threshold_err != nil {
+		logger.Error(threshold_err.Error())
+		os.Exit(1)
+	}
+
+	var region Region
+	if args.Region != "" {
+		parsed_region, region_errs := parse_region(args.Region)
+		if region_errs != nil {
+			logger.Error("Encountered the following errors while trying to parse the region value: ")
+			for _, msg := range region_errs {
+				logger.Error(fmt.Sprintf("%s", msg))
+			}
+			os.Exit(1)
+		}
+		region = parsed_region
+	}
+
+	// Annotations are optional for this command. We need a region to keep the annotation map small
+	var annotations map[string]VariantAnnotations
+	anno_cols := strings.Split(args.ColsToKeep, ",")
+	if args.AnnoFile != "" {
+		if args.Region == "" {
+			logger.Error("The --region flag is required when an annotation file is provided so that only the annotations for that region are read in")
+			os.Exit(1)
+		}
+		anno_map, anno_err := read_annotations(args.AnnoFile, anno_cols, region, nil, logger)
+		if anno_err != nil {
+			logger.Error(fmt.Sprintf("Encountered the following error while trying to read in the annotations.\n %s", anno_err))
+			os.Exit(1)
+		}
+		annotations = anno_map
+	}
+
+	lookup, lookup_err := vcf.NewSampleLookup(files.Stdin(), args.SampleID, args.Buffersize)
+	if lookup_err != nil {
+		logger.Error(lookup_err.Error())
+		os.Exit(1)
+	}
+	logger.Info(fmt.Sprintf("Found the sample %s in column %d of the vcf header", args.SampleID, lookup.SampleIndex+1))
+
+	var info_cols []string
+	if args.InfoCols != "" {
+		info_cols = strings.Split(args.InfoCols, ",")
+	}
+
+	info_decoder := vcf.NewInfoDecoder(lookup.Metadata)
+
+	var records []*vcf.SampleRecord
+	var infos []vcf.Info
+	scanned := 0
+	for {
+		record, next_err := lookup.Next()
+		if errors.Is(next_err, vcf.ErrMalformedRecord) {
+			logger.Warn(fmt.Sprintf("Skipping a record: %s", next_err))
+			continue
+		} else if next_err != nil {
+			if next_err != io.EOF {
+				logger.Error(fmt.Sprintf("Encountered the following error while reading the vcf stream: %s", next_err))
+				os.Exit(1)
+			}
+			break
+		}
+		scanned++
+		// We can check the genotype first because it is much cheaper than decoding the INFO column
+		if !record.Genotype.HasAlt() {
+			continue
+		}
+		if args.Region != "" && (!contig.Same(record.Chrom, region.chrom) || record.Pos < region.start || record.Pos > region.end) {
+			continue
+		}
+		info, info_err := info_decoder.Decode(record.Info, strings.Count(record.Alt, ",")+1)
+		if info_err == nil {
+			info_err = info.Check(info_cols...)
+		}
+		if info_err != nil {
+			logger.Warn(fmt.Sprintf("Skipping the variant %s on line %d because the INFO column could not be decoded: %s", record.ID, record.Line, info_err))
+			continue
+		}
+		freqs, _, freq_err := allele_freqs(info)
+		if freq_err != nil {
+			logger.Warn(fmt.Sprintf("Skipping the variant %s on line %d because the allele frequency could not be checked: %s", record.ID, record.Line, freq_err))
+			continue
+		}
+		if check_allele_freq(freqs, maf_cap) {
+			records = append(records, record)
+			infos = append(infos, info)
+		}
+	}
+
+	logger.Info(fmt.Sprintf("The sample %s carries %d qualifying variants out of %d records scanned", args.SampleID, len(records), scanned))
+
+	output_fh, output_err := files.Create(args.OutputFile)
+	manifest.Track(args.OutputFile)
+	if output_err != nil {
+		logger.Error(fmt.Sprintf("There was an issue trying to create the output file: %s\n", args.OutputFile))
+		os.Exit(1)
+	}
+	defer output_fh.Close()
+
+	writer := bufio.NewWriter(output_fh)
+	unannotated := write_carrier_variants(writer, args.SampleID, records, infos, annotations, anno_cols, info_cols)
+	writer.Flush()
+
+	if annotations != nil && unannotated > 0 {
+		logger.Info(fmt.Sprintf("%d out of %d variants had no annotations in the annotation file", unannotated, len(records)))
+	}
+}
@@ -0,0 +1,237 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/pseudonym"
+	"go-phers-parser/internal/tabix"
+	"go-phers-parser/vcf"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// VariantSpec is the site that the user asked for in the form chrom:pos:ref:alt
+type VariantSpec struct {
+	Chrom string
+	Pos   int
+	Ref   string
+	Alt   string
+}
+
+func parse_variant_spec(spec string) (VariantSpec, error) {
+	split_spec := strings.Split(spec, ":")
+	if len(split_spec) != 4 {
+		return VariantSpec{}, fmt.Errorf("the variant %s needs to have the form chrom:pos:ref:alt (for example chr22:23456789:A:G)", spec)
+	}
+
+	pos, pos_err := strconv.Atoi(split_spec[1])
+	if pos_err != nil {
+		return VariantSpec{}, fmt.Errorf("unable to convert the position of the variant %s to an integer: %w", spec, pos_err)
+	}
+
+	return VariantSpec{Chrom: split_spec[0], Pos: pos, Ref: split_spec[2], Alt: split_spec[3]}, nil
+}
+
+// matches returns the allele index of the requested alt allele if the record is the requested
+// site. Multi-allelic records match when any of their alt alleles is the requested allele
+func (spec VariantSpec) matches(split_line []string) (int, bool) {
+	if !contig.Same(split_line[0], spec.Chrom) || split_line[1] != strconv.Itoa(spec.Pos) || split_line[3] != spec.Ref {
+		return 0, false
+	}
+	alt_indx := slices.Index(strings.Split(split_line[4], ","), spec.Alt)
+	return alt_indx + 1, alt_indx != -1
+}
+
+// find_variant_record scans forward from the current position of the scanner until the
+// requested site is found or the records have moved past it
+func find_variant_record(scanner *bufio.Scanner, spec VariantSpec, logger *slog.Logger) ([]string, int) {
+	for scanner.Scan() {
+		split_line := strings.Split(strings.TrimSpace(scanner.Text()), "\t")
+		if len(split_line) < 10 || strings.HasPrefix(split_line[0], "#") {
+			continue
+		}
+
+		if allele_indx, found := spec.matches(split_line); found {
+			return split_line, allele_indx
+		}
+
+		// The vcf is sorted so once we pass the position on the same contig the site can't be in the file
+		if pos, pos_err := strconv.Atoi(split_line[1]); pos_err == nil && contig.Same(split_line[0], spec.Chrom) && pos > spec.Pos {
+			break
+		}
+	}
+	if scanner.Err() != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while reading through the vcf file:\n %s", scanner.Err()))
+		os.Exit(1)
+	}
+	return nil, 0
+}
+
+// open_vcf_reader reads the header of the vcf. If the vcf is bgzipped and has a tabix index next to it
+// then the returned scanner starts at the first block that can contain the site. Otherwise the
+// scanner continues after the header and the file is read from the beginning
+func open_vcf_reader(vcf_file string, spec VariantSpec, buffersize int, logger *slog.Logger) (*files.VCFReader, *bufio.Scanner, func()) {
+	vcf_reader := &files.VCFReader{FileReader: *files.Open(vcf_file, buffersize)}
+
+	if vcf_reader.Err != nil {
+		vcf_reader.CheckErrors()
+	}
+
+	close_handles := func() {
+		vcf_reader.Close()
+	}
+
+	if header_err := vcf_reader.ParseHeader("#CHROM"); header_err != nil || !vcf_reader.Header_Found {
+		logger.Error(fmt.Sprintf("Unable to find the #CHROM header line in the vcf file %s. %v", vcf_file, header_err))
+		os.Exit(1)
+	}
+
+	// files.Open only finds the index of a bgzipped file so standard input is always scanned
+	if vcf_reader.Index == "" {
+		if vcf_file != "-" {
+			logger.Warn(fmt.Sprintf("The file %s is not bgzipped with a .tbi index next to it so the whole file will be scanned", vcf_file))
+		}
+		return vcf_reader, vcf_reader.FileScanner, close_handles
+	}
+	index, index_err := tabix.ReadIndex(vcf_reader.Index)
+	if index_err != nil {
+		logger.Warn(fmt.Sprintf("Unable to use a tabix index for the file %s so the whole file will be scanned. %s", vcf_file, index_err))
+		return vcf_reader, vcf_reader.FileScanner, close_handles
+	}
+
+	offset, found := index.Offset(spec.Chrom, spec.Pos, spec.Pos)
+	if !found {
+		logger.Warn(fmt.Sprintf("The tabix index for %s does not have any records near %s:%d", vcf_file, spec.Chrom, spec.Pos))
+		return vcf_reader, nil, close_handles
+	}
+
+	seeker, seek_err := tabix.OpenAt(vcf_file, offset)
+	if seek_err != nil {
+		logger.Error(seek_err.Error())
+		os.Exit(1)
+	}
+	logger.Info(fmt.Sprintf("Used the tabix index to seek to the virtual offset %d", offset))
+
+	scanner, lines := files.NewLineScanner(seeker, buffersize)
+	lines.SetSamples(max(vcf_reader.Col_count-9, 0))
+
+	return vcf_reader, scanner, func() {
+		seeker.Close()
+		close_handles()
+	}
+}
+
+// load_lookup_phenotypes returns the phenotype columns and the values for each sample. The
+// --pheno-cols columns are used if they were provided otherwise the second column of the file is used
+func load_lookup_phenotypes(args internal.UserArgs, logger *slog.Logger) ([]string, map[string][]string) {
+	if args.PhenoFilePath == "" {
+		return nil, nil
+	}
+	if table := load_phenotype_table(args, logger); table != nil {
+		return table.Columns, table.Values
+	}
+
+	values := make(map[string][]string)
+	for sample_id, pheno := range read_in_samples(args.PhenoFilePath, logger) {
+		values[sample_id] = []string{pheno}
+	}
+	return []string{"PHENOTYPE"}, values
+}
+
+// LookupVariant reports the genotype class counts, the carriers and their phenotypes, and the
+// annotations for a single site. This is the question that we most often answer by hand so the
+// report is written to standard output
+func LookupVariant(args internal.UserArgs, logger *slog.Logger) {
+	spec, spec_err := parse_variant_spec(args.Variant)
+	if spec_err != nil {
+		logger.Error(spec_err.Error())
+		os.Exit(1)
+	}
+
+	pheno_cols, phenotypes := load_lookup_phenotypes(args, logger)
+
+	var annotations map[string]VariantAnnotations
+	anno_cols := strings.Split(args.ColsToKeep, ",")
+	if args.AnnoFile != "" {
+		anno_map, anno_err := read_annotations(args.AnnoFile, anno_cols, Region{chrom: spec.Chrom, start: spec.Pos, end: spec.Pos}, nil, logger)
+		if anno_err != nil {
+			logger.Error(fmt.Sprintf("Encountered the following error while trying to read in the annotations.\n %s", anno_err))
+			os.Exit(1)
+		}
+		annotations = anno_map
+	}
+
+	vcf_reader, scanner, close_vcf := open_vcf_reader(args.VcfFile, spec, args.Buffersize, logger)
+	defer close_vcf()
+
+	var record []string
+	var allele_indx int
+	if scanner != nil {
+		record, allele_indx = find_variant_record(scanner, spec, logger)
+	}
+	if record == nil {
+		logger.Error(fmt.Sprintf("The variant %s was not found in the vcf file %s", args.Variant, args.VcfFile))
+		os.Exit(1)
+	}
+
+	// The counts use the same classes as the find-all-carriers command. Carriers are the samples
+	// that have at least one copy of the requested allele
+	genotype_counts := make(map[vcf.GenotypeClass]int)
+	var carriers []int
+	for col_indx := 9; col_indx < len(record); col_indx++ {
+		if _, included := vcf_reader.SampleMapping[col_indx]; !included {
+			continue
+		}
+		genotype := vcf.ParseGenotype(record[col_indx])
+		genotype_counts[genotype.Class()]++
+		if slices.Contains(genotype.Alleles, allele_indx) {
+			carriers = append(carriers, col_indx)
+		}
+	}
+
+	writer := bufio.NewWriter(os.Stdout)
+	defer writer.Flush()
+
+	writer.WriteString(fmt.Sprintf("VARIANT\t%s\n", record[2]))
+	writer.WriteString(fmt.Sprintf("SITE\t%s:%s:%s:%s\n", record[0], record[1], record[3], record[4]))
+	writer.WriteString(fmt.Sprintf("FILTER\t%s\n", record[6]))
+	writer.WriteString(fmt.Sprintf("INFO\t%s\n", record[7]))
+
+	writer.WriteString("\n#GENOTYPE_COUNTS\n")
+	for _, class := range []vcf.GenotypeClass{vcf.HomRef, vcf.Het, vcf.HomAlt, vcf.Missing, vcf.Other} {
+		writer.WriteString(fmt.Sprintf("%s\t%d\n", class, genotype_counts[class]))
+	}
+
+	if annotations != nil {
+		writer.WriteString("\n#ANNOTATIONS\n")
+		anno := annotations[contig.VariantKey(record[2])]
+		for _, col := range anno_cols {
+			if value, found := anno[col]; found {
+				writer.WriteString(fmt.Sprintf("%s\t%s\n", col, value.String()))
+			} else {
+				writer.WriteString(fmt.Sprintf("%s\tNA\n", col))
+			}
+		}
+	}
+
+	writer.WriteString(fmt.Sprintf("\n#CARRIERS\t%d\n", len(carriers)))
+	writer.WriteString(strings.Join(append([]string{"SAMPLE", "GENOTYPE"}, pheno_cols...), "\t") + "\n")
+	for _, col_indx := range carriers {
+		sample_id := vcf_reader.SampleMapping[col_indx]
+		writer.WriteString(fmt.Sprintf("%s\t%s", pseudonym.ID(sample_id), record[col_indx]))
+		for indx := range pheno_cols {
+			if values, found := phenotypes[sample_id]; found && indx < len(values) && values[indx] != "" {
+				writer.WriteString(fmt.Sprintf("\t%s", values[indx]))
+			} else {
+				writer.WriteString("\tNA")
+			}
+		}
+		writer.WriteString("\n")
+	}
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// The comparisons that --maf-compare allows between the frequency of a variant and the --maf-threshold
+const (
+	inclusiveCompare = "inclusive" // the frequency has to be at or below the threshold
+	strictCompare    = "strict"    // the frequency has to be below the threshold
+)
+
+// mafThreshold is the --maf-threshold together with the comparison of --maf-compare. A threshold
+// of 0 keeps only the novel variants (a frequency of 0) with either comparison because a strict
+// comparison with 0 couldn't keep anything
+type mafThreshold struct {
+	Cap    float64
+	Strict bool
+}
+
+// new_maf_threshold checks the --maf-threshold and the --maf-compare value. An empty compare value
+// is the inclusive comparison that pull-variants has always used
+func new_maf_threshold(maf_cap float64, compare string) (mafThreshold, error) {
+	if math.IsNaN(maf_cap) || maf_cap < 0 {
+		return mafThreshold{}, fmt.Errorf("the --maf-threshold %g has to be 0 or above. Use 0 to keep only the novel variants", maf_cap)
+	}
+	switch compare {
+	case "", inclusiveCompare:
+		return mafThreshold{Cap: maf_cap}, nil
+	case strictCompare:
+		return mafThreshold{Cap: maf_cap, Strict: true}, nil
+	default:
+		return mafThreshold{}, fmt.Errorf("the --maf-compare value %s is not recognized. Allowed values are %s or %s", compare, inclusiveCompare, strictCompare)
+	}
+}
+
+// passes reports whether the frequency is rare enough. A missing frequency (NaN) never passes
+func (threshold mafThreshold) passes(freq float64) bool {
+	switch {
+	case math.IsNaN(freq):
+		return false
+	case threshold.Cap == 0:
+		return freq == 0
+	case threshold.Strict:
+		return freq < threshold.Cap
+	default:
+		return freq <= threshold.Cap
+	}
+}
+
+// operator is the comparison as it is written in the logs, the FILTER_TRACE column, and the bcftools filter
+func (threshold mafThreshold) operator() string {
+	switch {
+	case threshold.Cap == 0:
+		return "="
+	case threshold.Strict:
+		return "<"
+	default:
+		return "<="
+	}
+}
+
+// String writes the threshold with its comparison, such as <=0.01 or <1e-05
+func (threshold mafThreshold) String() string {
+	return threshold.operator() + strconv.FormatFloat(threshold.Cap, 'g', -1, 64)
+}
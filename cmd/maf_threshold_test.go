@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMafThreshold(t *testing.T) {
+	for _, bad := range []struct {
+		maf_cap float64
+		compare string
+	}{{-0.1, "inclusive"}, {math.NaN(), ""}, {0.1, "lt"}} {
+		if _, threshold_err := new_maf_threshold(bad.maf_cap, bad.compare); threshold_err == nil {
+			t.Errorf("expected the --maf-threshold %g with --maf-compare %q to be rejected", bad.maf_cap, bad.compare)
+		}
+	}
+
+	cases := []struct {
+		maf_cap  float64
+		compare  string
+		freq     float64
+		expected bool
+	}{
+		{0.01, "", 0.01, true},
+		{0.01, "inclusive", 0.0100001, false},
+		{0.01, "strict", 0.01, false},
+		{0.01, "strict", 0.0099, true},
+		// Scientific notation parses to the same float64 so the boundary is exact
+		{1e-4, "strict", 0.0001, false},
+		{1e-4, "inclusive", 0.0001, true},
+		// 0 keeps only the novel variants with either comparison
+		{0, "strict", 0, true},
+		{0, "inclusive", 1e-9, false},
+		{0.5, "inclusive", math.NaN(), false},
+	}
+	for _, test_case := range cases {
+		threshold, threshold_err := new_maf_threshold(test_case.maf_cap, test_case.compare)
+		if threshold_err != nil {
+			t.Fatalf("unable to create the threshold %g %s: %s", test_case.maf_cap, test_case.compare, threshold_err)
+		}
+		if passed := threshold.passes(test_case.freq); passed != test_case.expected {
+			t.Errorf("expected the frequency %g to pass AF%s to be %t", test_case.freq, threshold, test_case.expected)
+		}
+	}
+
+	for threshold, expected := range map[mafThreshold]string{
+		{Cap: 0.01}:               `INFO/AF<=0.01 & GT="alt"`,
+		{Cap: 1e-5, Strict: true}: `INFO/AF<1e-05 & GT="alt"`,
+		{Cap: 0, Strict: true}:    `INFO/AF=0 & GT="alt"`,
+	} {
+		if filter := bcftools_filter(threshold); filter != expected {
+			t.Errorf("expected the bcftools filter %s but got %s", expected, filter)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/vcf"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// reconcile_sample_columns maps each sample column of the table onto the sample order of the
+// merged output. Every shard has to have the same samples but they don't need to be in the same order
+func reconcile_sample_columns(table *PulledTable, merged_samples []string) ([]int, error) {
+	table_samples := table.Samples()
+	if len(table_samples) != len(merged_samples) {
+		return nil, fmt.Errorf("the file %s has %d samples but the first file has %d samples. All of the files need to come from the same set of samples", table.Filename, len(table_samples), len(merged_samples))
+	}
+
+	table_index := vcf.NewSampleIndex(table_samples)
+	columns := make([]int, len(merged_samples))
+	for indx, sample_id := range merged_samples {
+		table_indx, found := table_index.Position(sample_id)
+		if !found {
+			return nil, fmt.Errorf("the sample %s from the first file is missing from the file %s", sample_id, table.Filename)
+		}
+		columns[indx] = 9 + table_indx
+	}
+	return columns, nil
+}
+
+// compare_pulled_rows orders the rows by chromosome and then by position
+func compare_pulled_rows(first []string, second []string) int {
+	if chrom_order := contig.Compare(first[0], second[0]); chrom_order != 0 {
+		return chrom_order
+	}
+	first_pos, _ := strconv.Atoi(first[1])
+	second_pos, _ := strconv.Atoi(second[1])
+	return cmp.Compare(first_pos, second_pos)
+}
+
+// MergeOutputs combines pull-variants outputs that were run on separate regions or chromosomes.
+// The annotation columns of all of the files are combined, variants that are in more than one
+// file (from overlapping region boundaries) are only written once, and the rows are sorted by
+// chromosome and position
+func MergeOutputs(args internal.UserArgs, logger *slog.Logger) {
+	if len(args.InputFiles) == 0 {
+		logger.Error("At least one pull-variants output needs to be provided to merge")
+		os.Exit(1)
+	}
+
+	var tables []*PulledTable
+	for _, filename := range args.InputFiles {
+		table, table_err := read_pulled_table(filename, args.Buffersize)
+		if table_err != nil {
+			logger.Error(table_err.Error())
+			os.Exit(1)
+		}
+		logger.Info(fmt.Sprintf("Read in %d variants and %d samples from the file %s", len(table.Rows), table.SampleCount, filename))
+		tables = append(tables, table)
+	}
+
+	// The sample columns of the first file are used in the output. The extra columns are every
+	// column that comes after the samples in any of the files in the order we first see them
+	merged_samples := tables[0].Samples()
+	var extra_cols []string
+	for _, table := range tables {
+		for _, column := range table.Header[9+table.SampleCount:] {
+			if !slices.Contains(extra_cols, column) {
+				extra_cols = append(extra_cols, column)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	duplicates := 0
+	var merged_rows [][]string
+	for _, table := range tables {
+		sample_columns, reconcile_err := reconcile_sample_columns(table, merged_samples)
+		if reconcile_err != nil {
+			logger.Error(reconcile_err.Error())
+			os.Exit(1)
+		}
+
+		extra_indices := make(map[string]int)
+		for indx, column := range table.Header[9+table.SampleCount:] {
+			extra_indices[column] = 9 + table.SampleCount + indx
+		}
+
+		for _, row := range table.Rows {
+			key := pulled_variant_key(row)
+			if seen[key] {
+				duplicates++
+				continue
+			}
+			seen[key] = true
+
+			merged_row := slices.Clone(row[:9])
+			for _, col_indx := range sample_columns {
+				merged_row = append(merged_row, row[col_indx])
+			}
+			// Columns that the shard doesn't have are filled in the same way as missing annotations
+			for _, column := range extra_cols {
+				if col_indx, found := extra_indices[column]; found && col_indx < len(row) {
+					merged_row = append(merged_row, row[col_indx])
+				} else {
+					merged_row = append(merged_row, "-")
+				}
+			}
+			merged_rows = append(merged_rows, merged_row)
+		}
+	}
+
+	slices.SortStableFunc(merged_rows, compare_pulled_rows)
+
+	output_fh, output_err := files.Create(args.OutputFile)
+	manifest.Track(args.OutputFile)
+	if output_err != nil {
+		logger.Error(fmt.Sprintf("There was an issue trying to create the output file: %s\n", args.OutputFile))
+		os.Exit(1)
+	}
+	defer output_fh.Close()
+
+	writer := bufio.NewWriterSize(output_fh, files.WriteBufferSize())
+	defer writer.Flush()
+
+	// The sample columns follow the first file so its ##SAMPLE lines describe the merged output
+	for _, line := range tables[0].SampleMeta {
+		writer.WriteString(line + "\n")
+	}
+	header_cols := slices.Concat(tables[0].Header[:9+tables[0].SampleCount], extra_cols)
+	writer.WriteString(strings.Join(header_cols, "\t") + "\n")
+	for _, row := range merged_rows {
+		writer.WriteString(strings.Join(row, "\t") + "\n")
+	}
+
+	logger.Info(fmt.Sprintf("Wrote %d variants from %d files to %s. Skipped %d variants that were in more than one file", len(merged_rows), len(tables), args.OutputFile, duplicates))
+}
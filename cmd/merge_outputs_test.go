@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	internal "go-phers-parser/internal"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMergeOutputs(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// The first shard ends at chr2:500 and the second shard starts there so the boundary variant
+	// is in both files. The second shard is an older output without ##SAMPLE lines, has the samples
+	// in a different order, and has a CADD_PHRED column instead of AF
+	first_shard := write_pulled_fixture(t,
+		"##SAMPLE=<ID=S1,Phenotype=1>",
+		"##SAMPLE=<ID=S2,Phenotype=0>",
+		"##SAMPLE=<ID=S3,Phenotype=1>",
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS1\tS2\tS3\tConsequence\tAF",
+		"chr10\t50\t.\tG\tA\t.\tPASS\t.\tGT\t0/0\t0/1\t1/1\tsynonymous\t0.5",
+		"chr2\t500\t.\tC\tT\t.\tPASS\t.\tGT\t0/1\t0/0\t0/0\tmissense\t0.1",
+		"chr2\t100\t.\tA\tG\t.\tPASS\t.\tGT\t1/1\t0/0\t0/1\tstop_gained\t0.2",
+	)
+	second_shard := write_pulled_fixture(t,
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS3_1\tS1_1\tS2_0\tCADD_PHRED\tConsequence",
+		"chr2\t500\t.\tC\tT\t.\tPASS\t.\tGT\t0/0\t0/1\t0/0\t25\tmissense",
+		"chr2\t600\t.\tT\tC\t.\tPASS\t.\tGT\t0|1\t0|0\t1|1\t12\tintron",
+		"chrX\t10\t.\tG\tT\t.\tPASS\t.\tGT\t1\t0\t0/1\t3\tsplice_region",
+		"chr1\t20\t.\tA\tC\t.\tPASS\t.\tGT\t0/1\t1/1\t0/0\t8\tmissense",
+	)
+	output_file := filepath.Join(t.TempDir(), "merged.txt")
+
+	MergeOutputs(internal.UserArgs{InputFiles: []string{first_shard, second_shard}, OutputFile: output_file, Buffersize: 1024}, logger)
+
+	contents, read_err := os.ReadFile(output_file)
+	if read_err != nil {
+		t.Fatalf("unable to read the merged output: %s", read_err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+
+	expected := []string{
+		"##SAMPLE=<ID=S1,Phenotype=1>",
+		"##SAMPLE=<ID=S2,Phenotype=0>",
+		"##SAMPLE=<ID=S3,Phenotype=1>",
+		// The annotation columns of the second shard that the first shard doesn't have are added at the end
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS1\tS2\tS3\tConsequence\tAF\tCADD_PHRED",
+		"chr1\t20\t.\tA\tC\t.\tPASS\t.\tGT\t1/1\t0/0\t0/1\tmissense\t-\t8",
+		"chr2\t100\t.\tA\tG\t.\tPASS\t.\tGT\t1/1\t0/0\t0/1\tstop_gained\t0.2\t-",
+		// The boundary variant comes from the first shard and is only written once
+		"chr2\t500\t.\tC\tT\t.\tPASS\t.\tGT\t0/1\t0/0\t0/0\tmissense\t0.1\t-",
+		"chr2\t600\t.\tT\tC\t.\tPASS\t.\tGT\t0|0\t1|1\t0|1\tintron\t-\t12",
+		"chr10\t50\t.\tG\tA\t.\tPASS\t.\tGT\t0/0\t0/1\t1/1\tsynonymous\t0.5\t-",
+		"chrX\t10\t.\tG\tT\t.\tPASS\t.\tGT\t0\t0/1\t1\tsplice_region\t-\t3",
+	}
+	if !slices.Equal(lines, expected) {
+		t.Errorf("expected the merged output to be\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestReconcileSampleColumns(t *testing.T) {
+	table := &PulledTable{
+		Filename:    "shard.txt",
+		Header:      strings.Split("#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS3_1\tS1_1\tS2_0\tAF", "\t"),
+		SampleCount: 3,
+	}
+	cases := []struct {
+		merged_samples []string
+		expected       []int
+		has_error      bool
+	}{
+		{[]string{"S1", "S2", "S3"}, []int{10, 11, 9}, false},
+		{[]string{"S3", "S1", "S2"}, []int{9, 10, 11}, false},
+		{[]string{"S1", "S2", "S4"}, nil, true},
+		{[]string{"S1", "S2"}, nil, true},
+	}
+	for _, test_case := range cases {
+		columns, reconcile_err := reconcile_sample_columns(table, test_case.merged_samples)
+		if (reconcile_err != nil) != test_case.has_error {
+			t.Errorf("expected an error for the samples %v to be %t but got %v", test_case.merged_samples, test_case.has_error, reconcile_err)
+			continue
+		}
+		if !slices.Equal(columns, test_case.expected) {
+			t.Errorf("expected the columns %v for the samples %v but got %v", test_case.expected, test_case.merged_samples, columns)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+
+	"go-phers-parser/internal/intervals"
+	"go-phers-parser/vcf"
+)
+
+// These fuzz targets make sure that malformed region strings, INFO columns, and headers produce
+// errors instead of panics. The seeds run with go test. To fuzz one of the targets run:
+//
+//	go test ./cmd -run '^$' -fuzz FuzzParseRegion -fuzztime 30s
+
+func FuzzParseRegion(f *testing.F) {
+	for _, seed := range []string{"chr22:1000-2000", "1:1-100000000", "", ":", "chr1", "chr1:100", "chr1:-5-10", "chr1:1-2-3", "chrX:9223372036854775807-1"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, region_str string) {
+		// The position column of the annotation file has the same chr:start-end form
+		check_region(region_str, intervals.New([]intervals.Interval{{Chrom: "chr1", Start: 1, End: 100}}))
+
+		region, errs := parse_region(region_str)
+		if len(errs) > 0 {
+			return
+		}
+		if region.chrom == "" || region.start >= region.end {
+			t.Errorf("parse_region accepted the region %q but returned %+v", region_str, region)
+		}
+
+		// A region that was accepted should be parsed the same way once it is written back out
+		reparsed, reparse_errs := parse_region(fmt.Sprintf("%s:%d-%d", region.chrom, region.start, region.end))
+		if len(reparse_errs) > 0 || reparsed != region {
+			t.Errorf("the region %q was parsed as %+v but writing it back out gave %+v (%v)", region_str, region, reparsed, reparse_errs)
+		}
+	})
+}
+
+func FuzzCheckAlleleFreq(f *testing.F) {
+	f.Add("AC=1;AN=2;AF=0.5", 1, 0.01)
+	f.Add("AF=0.001,0.2", 2, 0.01)
+	f.Add("AF=.", 1, 0.01)
+	f.Add("AC=3;AN=100;0.03", 1, 0.05)
+	f.Add("DB;AF", 1, 1.0)
+	f.Add(".", 1, 0.0)
+	f.Add("AF=0.1,,;;=", 3, 0.5)
+	f.Add("AF=NA,0.01%2C0.2,abc", 3, 0.05)
+
+	metadata := &vcf.Metadata{}
+	metadata.AddLine(`##INFO=<ID=AF,Number=A,Type=Float,Description="Allele Frequency">`)
+	metadata.AddLine(`##INFO=<ID=AC,Number=A,Type=Integer,Description="Allele Count">`)
+	metadata.AddLine(`##INFO=<ID=DB,Number=0,Type=Flag,Description="dbSNP membership">`)
+	decoder := vcf.NewInfoDecoder(metadata)
+
+	f.Fuzz(func(t *testing.T, info_col string, alt_count int, threshold float64) {
+		// The alt count comes from splitting the ALT column so it is never negative or huge
+		if alt_count < 0 || alt_count > 64 || math.IsNaN(threshold) {
+			return
+		}
+
+		info, decode_err := decoder.Decode(info_col, alt_count)
+		if decode_err != nil {
+			return
+		}
+
+		freqs, unparseable, freq_err := allele_freqs(info)
+		if freq_err != nil && (freqs != nil || unparseable > 0) {
+			t.Errorf("allele_freqs returned an error for %q but still returned frequencies", info_col)
+		}
+		if unparseable > len(freqs) {
+			t.Errorf("allele_freqs counted %d unparseable values for %q but only returned %d frequencies", unparseable, info_col, len(freqs))
+		}
+		if check_allele_freq(freqs, mafThreshold{Cap: threshold}) && !slices.ContainsFunc(freqs, func(freq float64) bool { return !math.IsNaN(freq) }) {
+			t.Errorf("check_allele_freq passed %q without any frequency", info_col)
+		}
+	})
+}
+
+func FuzzGenotypeParsing(f *testing.F) {
+	for _, seed := range []string{"0/1", "1|1", "./.", "0", "0/0/1", "1/2:35:0.9", ".|1", "", ":", "01/0", "+1/0", "0//1", "1a/0", "/", "||"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, call string) {
+		genotype := vcf.ParseGenotype(call)
+
+		// The find-all-carriers command uses the quick checks while the other commands parse the
+		// genotype so they have to agree or the commands would count different carriers
+		if genotype.HasAlt() != vcf.CallHasAlt(call) {
+			t.Errorf("the call %q has HasAlt %t but CallHasAlt %t", call, genotype.HasAlt(), vcf.CallHasAlt(call))
+		}
+		if genotype.Ploidy() != vcf.CallPloidy(call) {
+			t.Errorf("the call %q has a ploidy of %d but CallPloidy returned %d", call, genotype.Ploidy(), vcf.CallPloidy(call))
+		}
+		if genotype.AltCount() > genotype.Ploidy() {
+			t.Errorf("the call %q has more alternate alleles (%d) than alleles (%d)", call, genotype.AltCount(), genotype.Ploidy())
+		}
+
+		for _, classifier := range []vcf.GenotypeClassifier{vcf.HardCall{}, vcf.Dosage{Threshold: 0.5}, vcf.QualityAware{Base: vcf.HardCall{}, MinGQ: 20, MinDP: 10}} {
+			classifier.IsCarrier("GT:GQ:DP:DS", call)
+		}
+	})
+}
+
+func FuzzHeaderMapping(f *testing.F) {
+	f.Add("##fileformat=VCFv4.2\n##contig=<ID=chr22,length=50818468>\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS1\tS2\n")
+	f.Add("#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\n")
+	f.Add("#CHROM\tPOS\tID\n")
+	f.Add("#CHROM")
+	f.Add("##INFO=<ID=AF,Number=A,Description=\"unterminated>\n##=\n##contig=<length=abc>\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS1\n")
+	f.Add("chr22\t100\t.\tA\tG\t.\tPASS\t.\tGT\t0/1\n")
+	f.Add("")
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	pheno_map := map[string]string{"S1": "1", "S2": "0"}
+
+	f.Fuzz(func(t *testing.T, vcf_header string) {
+		scanner := bufio.NewScanner(strings.NewReader(vcf_header))
+		samples, _, metadata, err := process_header_ids(scanner, pheno_map, nil, false, logger)
+		if metadata == nil {
+			t.Fatalf("process_header_ids returned a nil metadata for the header %q", vcf_header)
+		}
+		if err != nil {
+			return
+		}
+
+		mapping := map_header_ids(samples)
+		for indx, id := range samples {
+			if _, found := pheno_map[id]; !found {
+				t.Errorf("the sample %q was accepted without a phenotype", id)
+			}
+			// repeated ids map to the last column that they were found in
+			if mapping[id] < indx {
+				t.Errorf("the sample %q in column %d was mapped to column %d", id, indx, mapping[id])
+			}
+		}
+	})
+}
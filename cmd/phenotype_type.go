@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PhenotypeType is the kind of values that a phenotype column has. The type decides how the
+// values are written in the outputs and which statistics the summaries report
+type PhenotypeType string
+
+const (
+	BinaryPhenotype      PhenotypeType = "binary"      // case/control status written as 1 or 0
+	ContinuousPhenotype  PhenotypeType = "continuous"  // a score such as a PheRS
+	CategoricalPhenotype PhenotypeType = "categorical" // a label such as a diagnosis or an ancestry group
+	unknownGroup                       = "UNKNOWN"
+)
+
+// Phenotype records the type of a phenotype column. Categorical columns also keep their sorted levels
+type Phenotype struct {
+	Name   string
+	Type   PhenotypeType
+	Levels []string
+}
+
+// is_missing_phenotype reports whether a phenotype value is missing
+func is_missing_phenotype(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "-", ".", "na", "nan":
+		return true
+	}
+	return false
+}
+
+// binary_value converts the case/control status to 1 or 0
+func binary_value(value string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "1.0", "case":
+		return "1", true
+	case "0", "0.0", "control":
+		return "0", true
+	}
+	return "", false
+}
+
+// detect_phenotype finds the type of a column from its values. A column is binary if every value
+// is a case/control status, continuous if every value is a number, and categorical otherwise.
+// Missing values are ignored and a column without any values is treated as binary so that every
+// sample ends up in the UNKNOWN group
+func detect_phenotype(name string, values []string) Phenotype {
+	binary, numeric := true, true
+	levels := make(map[string]bool)
+	for _, value := range values {
+		if is_missing_phenotype(value) {
+			continue
+		}
+		levels[strings.TrimSpace(value)] = true
+		if _, is_binary := binary_value(value); !is_binary {
+			binary = false
+		}
+		if number, conv_err := strconv.ParseFloat(strings.TrimSpace(value), 64); conv_err != nil || math.IsNaN(number) {
+			numeric = false
+		}
+	}
+
+	switch {
+	case binary:
+		return Phenotype{Name: name, Type: BinaryPhenotype}
+	case numeric:
+		return Phenotype{Name: name, Type: ContinuousPhenotype}
+	}
+	pheno := Phenotype{Name: name, Type: CategoricalPhenotype}
+	for level := range levels {
+		pheno.Levels = append(pheno.Levels, level)
+	}
+	slices.Sort(pheno.Levels)
+	return pheno
+}
+
+// Format writes the value the way that it is written in the outputs. The case/control status is
+// always 1 or 0, scores are cut to 2 decimal places, and the underscores and spaces of labels are
+// replaced so that the labels match the ones in outputs from older versions
+func (pheno Phenotype) Format(value string) string {
+	if is_missing_phenotype(value) {
+		return value
+	}
+	switch pheno.Type {
+	case BinaryPhenotype:
+		status, _ := binary_value(value)
+		return status
+	case ContinuousPhenotype:
+		if dot_indx := strings.Index(value, "."); dot_indx != -1 {
+			// scores with fewer than 2 decimal places can't be trimmed any further
+			return value[0:min(dot_indx+3, len(value))]
+		}
+		return value
+	default:
+		return strings.NewReplacer("_", "-", " ", "-").Replace(strings.TrimSpace(value))
+	}
+}
+
+// Numeric returns the value as a number for the means of the summaries. The case/control status is
+// 1 or 0 so its mean is the fraction of cases. Labels don't have a numeric value
+func (pheno Phenotype) Numeric(value string) (float64, bool) {
+	if is_missing_phenotype(value) {
+		return math.NaN(), false
+	}
+	switch pheno.Type {
+	case BinaryPhenotype:
+		if status, _ := binary_value(value); status == "1" {
+			return 1, true
+		}
+		return 0, true
+	case ContinuousPhenotype:
+		number, conv_err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return number, conv_err == nil && !math.IsNaN(number)
+	default:
+		return math.NaN(), false
+	}
+}
+
+// Group returns the group of the value for the group summary. Binary phenotypes have the CASE and
+// CONTROL groups and categorical phenotypes have a group for each level. Continuous phenotypes
+// don't have groups so the bool is false
+func (pheno Phenotype) Group(value string) (string, bool) {
+	if pheno.Type == ContinuousPhenotype {
+		return "", false
+	}
+	if is_missing_phenotype(value) {
+		return unknownGroup, true
+	}
+	if pheno.Type == BinaryPhenotype {
+		if status, _ := binary_value(value); status == "1" {
+			return "CASE", true
+		}
+		return "CONTROL", true
+	}
+	return strings.TrimSpace(value), true
+}
+
+// Groups returns the groups of the phenotype in the order that they are written
+func (pheno Phenotype) Groups() []string {
+	switch pheno.Type {
+	case BinaryPhenotype:
+		return []string{"CASE", "CONTROL", unknownGroup}
+	case CategoricalPhenotype:
+		return append(slices.Clone(pheno.Levels), unknownGroup)
+	}
+	return nil
+}
+
+// format_phenotypes detects the type of the phenotype of each sample and formats the values for the
+// outputs
+func format_phenotypes(name string, values map[string]string) (map[string]string, Phenotype) {
+	pheno := detect_phenotype(name, slices.Collect(maps.Values(values)))
+	formatted := make(map[string]string, len(values))
+	for sample_id, value := range values {
+		formatted[sample_id] = pheno.Format(value)
+	}
+	return formatted, pheno
+}
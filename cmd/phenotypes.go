@@ -0,0 +1,403 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PhenotypeTable holds the values of several phenotype/score columns for each sample. This
+// table is used when the user selects columns with --pheno-cols so that multiple score
+// definitions can be compared in the same run
+type PhenotypeTable struct {
+	Columns []string
+	Values  map[string][]string // values for each sample in the same order as Columns
+}
+
+// parse_pheno_cols splits the value of the --pheno-cols flag
+func parse_pheno_cols(pheno_cols string) []string {
+	if strings.TrimSpace(pheno_cols) == "" {
+		return nil
+	}
+	var cols []string
+	for _, col := range strings.Split(pheno_cols, ",") {
+		cols = append(cols, strings.TrimSpace(col))
+	}
+	return cols
+}
+
+// read_phenotype_table reads the selected columns from the phenotype file. The file needs to have
+// a header line because the columns are selected by name. The first column is the sample id. If
+// no columns are selected then every column after the sample id is used. This function is also used
+// to read the covariate file because it has the same layout
+func read_phenotype_table(filepath string, pheno_cols []string) (*PhenotypeTable, error) {
+	pheno_fh, open_err := files.OpenSource(filepath)
+	if open_err != nil {
+		return nil, fmt.Errorf("encountered the following error while trying to open the phenotype file %s: %w", filepath, open_err)
+	}
+	defer pheno_fh.Close()
+
+	scanner := files.NewTableScanner(pheno_fh)
+
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("the phenotype file %s was empty. A header line is required when using --pheno-cols", filepath)
+	}
+
+	// The table can be tab, comma, or whitespace separated. The header line decides which one
+	delimiter := files.DetectDelimiter(scanner.Text())
+	header_cols := files.SplitFields(strings.TrimSpace(scanner.Text()), delimiter)
+
+	if len(pheno_cols) == 0 {
+		pheno_cols = header_cols[1:]
+	}
+
+	// find the position of each requested column in the header
+	col_indices := make([]int, len(pheno_cols))
+	var missing_cols []string
+	for indx, col := range pheno_cols {
+		col_indices[indx] = -1
+		for header_indx, header_col := range header_cols {
+			if header_col == col {
+				col_indices[indx] = header_indx
+				break
+			}
+		}
+		if col_indices[indx] == -1 {
+			missing_cols = append(missing_cols, col)
+		}
+	}
+
+	if len(missing_cols) > 0 {
+		return nil, fmt.Errorf("the phenotype column(s) %s were not found in the header of the file %s. The header has the columns: %s", strings.Join(missing_cols, ", "), filepath, strings.Join(header_cols, ", "))
+	}
+
+	table := &PhenotypeTable{Columns: pheno_cols, Values: make(map[string][]string)}
+
+	for scanner.Scan() {
+		split_line := files.SplitFields(strings.TrimSpace(scanner.Text()), delimiter)
+		if len(split_line) == 0 || (len(split_line) == 1 && split_line[0] == "") {
+			continue
+		}
+
+		values := make([]string, len(col_indices))
+		for indx, col_indx := range col_indices {
+			if col_indx < len(split_line) {
+				values[indx] = split_line[col_indx]
+			}
+		}
+		table.Values[split_line[0]] = values
+	}
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("encountered the following error while reading the phenotype file %s: %w", filepath, scanner.Err())
+	}
+
+	return table, nil
+}
+
+// ColumnMap returns the values of one column for each sample. This map has the same format as
+// the output of read_in_samples so that the first phenotype can be used in the pull-variants header
+func (table *PhenotypeTable) ColumnMap(col_indx int) map[string]string {
+	values := make(map[string]string, len(table.Values))
+	for sample_id, sample_values := range table.Values {
+		values[sample_id] = sample_values[col_indx]
+	}
+	return values
+}
+
+// carrierCategory is a variant category of the summaries. A sample is a carrier of a category if
+// it has at least one variant in the category
+type carrierCategory struct {
+	name     string
+	variants func(*SampleInfo) []string
+}
+
+// carrier_categories returns the categories of the summaries. These are the pathogenic,
+// nonsynonymous, LOF, and other buckets or the tiers when --variant-tiers is used
+func carrier_categories(tiered bool) []carrierCategory {
+	if tiered {
+		var categories []carrierCategory
+		for _, tier := range variantTierOrder {
+			categories = append(categories, carrierCategory{strings.TrimSuffix(tier.ColumnName(), "_VARIANTS"), func(info *SampleInfo) []string { return info.TierVariants[tier] }})
+		}
+		return append(categories, carrierCategory{"ANY", func(info *SampleInfo) []string {
+			var variants []string
+			for _, tier := range variantTierOrder {
+				variants = append(variants, info.TierVariants[tier]...)
+			}
+			return variants
+		}})
+	}
+	return []carrierCategory{
+		{"PATHOGENIC", func(info *SampleInfo) []string { return info.PathogenicVariants }},
+		{"NONSYNONYMOUS", func(info *SampleInfo) []string { return info.NonsynonymousVariants }},
+		{"LOF", func(info *SampleInfo) []string { return info.LofVariants }},
+		{"OTHER", func(info *SampleInfo) []string { return info.OtherVariants }},
+		{"ANY", func(info *SampleInfo) []string {
+			return slices.Concat(info.PathogenicVariants, info.NonsynonymousVariants, info.LofVariants, info.OtherVariants)
+		}},
+	}
+}
+
+// mean_or_na returns the mean formatted for the output or NA if there were no values
+func mean_or_na(total float64, count int) string {
+	if count == 0 {
+		return "NA"
+	}
+	return strconv.FormatFloat(total/float64(count), 'f', 4, 64)
+}
+
+// phenotypeMeasure is a number that the phenotype summary averages over the carriers and the
+// non-carriers. Each binary or continuous column is one measure and each level of a categorical
+// column is a measure of whether the sample has the level
+type phenotypeMeasure struct {
+	name  string
+	value func(raw string) (float64, bool)
+}
+
+// phenotype_measures returns the measures of a phenotype column
+func phenotype_measures(pheno Phenotype) []phenotypeMeasure {
+	if pheno.Type != CategoricalPhenotype {
+		return []phenotypeMeasure{{pheno.Name, pheno.Numeric}}
+	}
+	var measures []phenotypeMeasure
+	for _, level := range pheno.Levels {
+		measures = append(measures, phenotypeMeasure{fmt.Sprintf("%s=%s", pheno.Name, level), func(raw string) (float64, bool) {
+			if is_missing_phenotype(raw) {
+				return math.NaN(), false
+			}
+			if strings.TrimSpace(raw) == level {
+				return 1, true
+			}
+			return 0, true
+		}})
+	}
+	return measures
+}
+
+// write_phenotype_summary writes the carrier counts and the mean phenotype value among carriers and
+// non-carriers for each phenotype column and each variant category. The mean of a binary column is
+// the fraction of cases. Categorical columns get a row for each level where the mean is the
+// fraction of samples with the level. Missing values are counted but are not used in the means
+func write_phenotype_summary(filename string, table *PhenotypeTable, sample_variants map[string]*SampleInfo, tiered bool) error {
+	summary_fh, create_err := files.Create(filename)
+	manifest.Track(filename)
+	if create_err != nil {
+		return fmt.Errorf("encountered the following error while trying to create the phenotype summary file %s: %w", filename, create_err)
+	}
+	defer summary_fh.Close()
+
+	writer := bufio.NewWriter(summary_fh)
+
+	writer.WriteString("PHENOTYPE\tPHENOTYPE_TYPE\tVARIANT_CATEGORY\tCARRIERS\tHET_CARRIERS\tHOM_ALT_CARRIERS\tNON_CARRIERS\tCARRIER_MEAN\tNON_CARRIER_MEAN\n")
+
+	// The carriers of a category are split into the samples with at least one heterozygous
+	// variant and the samples with at least one homozygous alternate variant in the category.
+	// A sample can be in both
+	for col_indx, col := range table.Columns {
+		col_values := make([]string, 0, len(sample_variants))
+		for sample_id := range sample_variants {
+			if values, found := table.Values[sample_id]; found {
+				col_values = append(col_values, values[col_indx])
+			}
+		}
+		pheno := detect_phenotype(col, col_values)
+
+		for _, measure := range phenotype_measures(pheno) {
+			for _, category := range carrier_categories(tiered) {
+				var carriers, het_carriers, hom_alt_carriers, non_carriers, carrier_n, non_carrier_n int
+				var carrier_total, non_carrier_total float64
+
+				for sample_id, info := range sample_variants {
+					value, numeric := math.NaN(), false
+					if values, found := table.Values[sample_id]; found {
+						value, numeric = measure.value(values[col_indx])
+					}
+
+					if category_variants := category.variants(info); len(category_variants) > 0 {
+						carriers++
+						het_count, hom_alt_count := info.ZygosityCounts(category_variants)
+						if het_count > 0 {
+							het_carriers++
+						}
+						if hom_alt_count > 0 {
+							hom_alt_carriers++
+						}
+						if numeric {
+							carrier_total += value
+							carrier_n++
+						}
+					} else {
+						non_carriers++
+						if numeric {
+							non_carrier_total += value
+							non_carrier_n++
+						}
+					}
+				}
+				writer.WriteString(fmt.Sprintf("%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\n", measure.name, pheno.Type, category.name, carriers, het_carriers, hom_alt_carriers, non_carriers, mean_or_na(carrier_total, carrier_n), mean_or_na(non_carrier_total, non_carrier_n)))
+			}
+		}
+	}
+
+	return writer.Flush()
+}
+
+// write_group_summary writes the number of carriers and the carrier frequency of each variant
+// category in each group of the scores. The groups are the cases and the controls of a binary
+// phenotype or the levels of a categorical phenotype. The bool is false if the scores were
+// continuous (like a PheRS) because they don't have groups
+func write_group_summary(filename string, sample_variants map[string]*SampleInfo, tiered bool) (bool, error) {
+	scores := make([]string, 0, len(sample_variants))
+	for _, info := range sample_variants {
+		scores = append(scores, info.Score)
+	}
+	pheno := detect_phenotype("SCORE", scores)
+	if pheno.Type == ContinuousPhenotype {
+		return false, nil
+	}
+
+	categories := carrier_categories(tiered)
+	type group_counts struct {
+		samples  int
+		carriers []int
+	}
+	groups := make(map[string]*group_counts)
+	for _, info := range sample_variants {
+		group, _ := pheno.Group(info.Score)
+		counts, found := groups[group]
+		if !found {
+			counts = &group_counts{carriers: make([]int, len(categories))}
+			groups[group] = counts
+		}
+		counts.samples++
+		for category_indx, category := range categories {
+			if len(category.variants(info)) > 0 {
+				counts.carriers[category_indx]++
+			}
+		}
+	}
+
+	summary_fh, create_err := files.Create(filename)
+	manifest.Track(filename)
+	if create_err != nil {
+		return true, fmt.Errorf("encountered the following error while trying to create the group summary file %s: %w", filename, create_err)
+	}
+	defer summary_fh.Close()
+
+	writer := bufio.NewWriter(summary_fh)
+
+	header := []string{"GROUP", "SAMPLES"}
+	for _, category := range categories {
+		header = append(header, category.name+"_CARRIERS", category.name+"_CARRIER_FREQ")
+	}
+	writer.WriteString(strings.Join(header, "\t") + "\n")
+
+	for _, group := range pheno.Groups() {
+		counts, found := groups[group]
+		if !found {
+			continue
+		}
+		row := []string{group, strconv.Itoa(counts.samples)}
+		for category_indx := range categories {
+			row = append(row, strconv.Itoa(counts.carriers[category_indx]), frequency_or_na(counts.carriers[category_indx], counts.samples))
+		}
+		writer.WriteString(strings.Join(row, "\t") + "\n")
+	}
+
+	return true, writer.Flush()
+}
+
+// read_sample_scores reads the numeric score for each sample from the phenotype file. If the user
+// selected phenotype columns then the first selected column is used. Otherwise the second column
+// of the file is used. Rows where the score isn't a number (such as the header) are skipped
+func read_sample_scores(pheno_filepath string, pheno_cols []string) (map[string]float64, error) {
+	scores := make(map[string]float64)
+
+	if len(pheno_cols) > 0 {
+		table, table_err := read_phenotype_table(pheno_filepath, pheno_cols)
+		if table_err != nil {
+			return nil, table_err
+		}
+		for sample_id, value := range table.ColumnMap(0) {
+			if score, conv_err := strconv.ParseFloat(value, 64); conv_err == nil && !math.IsNaN(score) {
+				scores[sample_id] = score
+			}
+		}
+		return scores, nil
+	}
+
+	pheno_fh, open_err := files.OpenSource(pheno_filepath)
+	if open_err != nil {
+		return nil, fmt.Errorf("encountered the following error while trying to open the phenotype file %s: %w", pheno_filepath, open_err)
+	}
+	defer pheno_fh.Close()
+
+	scanner := files.NewTableScanner(pheno_fh)
+	delimiter := ""
+	for scanner.Scan() {
+		if delimiter == "" {
+			delimiter = files.DetectDelimiter(scanner.Text())
+		}
+		split_line := files.SplitFields(strings.TrimSpace(scanner.Text()), delimiter)
+		if len(split_line) < 2 {
+			continue
+		}
+		if score, conv_err := strconv.ParseFloat(split_line[1], 64); conv_err == nil && !math.IsNaN(score) {
+			scores[split_line[0]] = score
+		}
+	}
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("encountered the following error while reading the phenotype file %s: %w", pheno_filepath, scanner.Err())
+	}
+
+	if len(scores) == 0 {
+		return nil, fmt.Errorf("none of the rows in the phenotype file %s had a numeric score in the second column", pheno_filepath)
+	}
+	return scores, nil
+}
+
+// ScoreRanks holds the percentile of each sample's score and the score cutoff for the requested quantile
+type ScoreRanks struct {
+	Percentiles map[string]float64
+	Cutoff      float64
+}
+
+// rank_scores calculates the percentile of each score (the percent of samples with a score at or
+// below it) and the smallest score that is in the top (1 - quantile) of the samples
+func rank_scores(scores map[string]float64, quantile float64) ScoreRanks {
+	sorted_scores := make([]float64, 0, len(scores))
+	for _, score := range scores {
+		sorted_scores = append(sorted_scores, score)
+	}
+	slices.Sort(sorted_scores)
+
+	ranks := ScoreRanks{Percentiles: make(map[string]float64, len(scores))}
+
+	for sample_id, score := range scores {
+		// the number of scores that are at or below this score
+		at_or_below, found := slices.BinarySearch(sorted_scores, score)
+		for found && at_or_below < len(sorted_scores) && sorted_scores[at_or_below] == score {
+			at_or_below++
+		}
+		ranks.Percentiles[sample_id] = 100 * float64(at_or_below) / float64(len(sorted_scores))
+	}
+
+	// Without any scores there is no sample in the top so nothing can reach the cutoff
+	if len(sorted_scores) == 0 {
+		ranks.Cutoff = math.Inf(1)
+		return ranks
+	}
+
+	// The top (1 - quantile) of the samples is at least one sample. The cutoff is the smallest
+	// score of the top so a quantile of 0.9 with 10 samples keeps the single highest score
+	top_count := max(1, int(math.Round((1-quantile)*float64(len(sorted_scores)))))
+	cutoff_indx := max(0, min(len(sorted_scores)-top_count, len(sorted_scores)-1))
+	ranks.Cutoff = sorted_scores[cutoff_indx]
+
+	return ranks
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import "testing"
+
+func TestRankScores(t *testing.T) {
+	ten := map[string]float64{}
+	for indx, sample_id := range []string{"s1", "s2", "s3", "s4", "s5", "s6", "s7", "s8", "s9", "s10"} {
+		ten[sample_id] = float64(indx + 1)
+	}
+
+	cases := []struct {
+		name     string
+		scores   map[string]float64
+		quantile float64
+		cutoff   float64
+	}{
+		// The top 10% of 10 samples is the single highest score
+		{"top tenth", ten, 0.9, 10},
+		{"top half", ten, 0.5, 6},
+		{"everyone", ten, 0, 1},
+		// The top is at least one sample even for a quantile of 1
+		{"quantile of one", ten, 1, 10},
+		// 0.95 of 10 rounds to the top sample instead of keeping none
+		{"rounded to one sample", ten, 0.95, 10},
+		{"rounded to the nearest sample", ten, 0.74, 8},
+		{"single sample", map[string]float64{"s1": 3.5}, 0.9, 3.5},
+		{"tied scores", map[string]float64{"s1": 1, "s2": 2, "s3": 2, "s4": 2}, 0.75, 2},
+	}
+	for _, test_case := range cases {
+		if ranks := rank_scores(test_case.scores, test_case.quantile); ranks.Cutoff != test_case.cutoff {
+			t.Errorf("%s: expected the cutoff %g for the quantile %g but got %g", test_case.name, test_case.cutoff, test_case.quantile, ranks.Cutoff)
+		}
+	}
+
+	ranks := rank_scores(map[string]float64{"s1": 1, "s2": 2, "s3": 2, "s4": 4}, 0.5)
+	for sample_id, expected := range map[string]float64{"s1": 25, "s2": 75, "s3": 75, "s4": 100} {
+		if ranks.Percentiles[sample_id] != expected {
+			t.Errorf("expected the percentile of %s to be %g but got %g", sample_id, expected, ranks.Percentiles[sample_id])
+		}
+	}
+
+	if ranks := rank_scores(map[string]float64{}, 0.9); len(ranks.Percentiles) != 0 || ranks.Cutoff <= 0 {
+		t.Errorf("expected no sample to reach the cutoff without any scores but got %+v", ranks)
+	}
+}
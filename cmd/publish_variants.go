@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/pipeline"
+	"go-phers-parser/internal/pseudonym"
+	"go-phers-parser/internal/publish"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// new_published_variant builds the message for a variant. The message uses the same json as the
+// serve command so that subscribers can share the code that reads the variants
+func new_published_variant(pulled *PulledVariants, variant VariantInfo) ServedVariant {
+	message := new_served_variant(variant.InfoFields)
+
+	// The calls string starts with a tab so the first value after splitting is empty
+	calls := strings.Split(variant.Calls, "\t")[1:]
+	for indx, call := range calls {
+		if indx < len(pulled.Samples) && pulled.Classifier.IsCarrier(variant.InfoFields[8], call) {
+			message.Carriers = append(message.Carriers, CarrierCall{Sample: pseudonym.ID(pulled.Samples[indx]), Genotype: strings.SplitN(call, ":", 2)[0]})
+		}
+	}
+
+	if variant.Annotations != nil {
+		message.Annotations = make(map[string]string)
+		for _, col := range pulled.AnnoCols {
+			if value, ok := variant.Annotations[col]; ok {
+				message.Annotations[col] = value.String()
+			}
+		}
+	}
+
+	if len(pulled.InfoCols) > 0 {
+		message.Info = make(map[string]string)
+		for indx, col := range pulled.InfoCols {
+			message.Info[col] = variant.InfoColumns[indx]
+		}
+	}
+	return message
+}
+
+// publish_counts counts the variants that were handed to the queue and the ones that were lost
+type publish_counts struct {
+	published int
+	failed    int
+}
+
+// add counts the variant that was just published. A batch that couldn't be sent loses the
+// variants of the batch that were already counted as published too
+func (counts *publish_counts) add(publish_err error) {
+	var batch_err *publish.BatchError
+	switch {
+	case publish_err == nil:
+		counts.published++
+	case errors.As(publish_err, &batch_err):
+		counts.published -= batch_err.Messages - 1
+		counts.failed += batch_err.Messages
+	default:
+		counts.failed++
+	}
+}
+
+// close moves the variants that were still waiting in the last batch from the published to the
+// failed variants if the batch couldn't be sent when the queue was closed
+func (counts *publish_counts) close(close_err error) {
+	var batch_err *publish.BatchError
+	if errors.As(close_err, &batch_err) {
+		counts.published -= batch_err.Messages
+		counts.failed += batch_err.Messages
+	}
+}
+
+// publish_variants publishes every variant that passes through the stage to the message queue
+// and then passes the variant on to the writer. The returned function closes the connection to
+// the queue and should be called after the waitgroup finishes so that every message is delivered.
+// It records the delivery in the run manifest and the command fails once the manifest is written
+// if any variant was lost
+func publish_variants(pulled *PulledVariants, variants <-chan []VariantInfo, target string, logger *slog.Logger) (<-chan []VariantInfo, func()) {
+	publisher, open_err := publish.Open(target)
+	if open_err != nil {
+		logger.Error(fmt.Sprintf("Unable to connect to the message queue. %s", open_err))
+		os.Exit(1)
+	}
+	logger.Info(fmt.Sprintf("Publishing the qualifying variants to %s", manifest.RedactURL(target)))
+
+	counts := &publish_counts{}
+
+	forwarded := pipeline.Stage(variants, pulled.Pipeline, func(variant VariantInfo) (VariantInfo, bool) {
+		message, json_err := json.Marshal(new_published_variant(pulled, variant))
+		if json_err == nil {
+			json_err = publisher.Publish(variant.VariantID, message)
+		}
+		// We keep writing the output file if the queue goes down. The log records how many messages were lost
+		if json_err != nil && counts.failed == 0 {
+			logger.Warn(fmt.Sprintf("Unable to publish the variant %s. %s", variant.VariantID, json_err))
+		}
+		counts.add(json_err)
+		return variant, true
+	})
+
+	return forwarded, func() {
+		redacted := manifest.RedactURL(target)
+		close_err := publisher.Close()
+		counts.close(close_err)
+		status := manifest.Publish{Target: redacted, Published: counts.published, Failed: counts.failed}
+		if close_err != nil {
+			logger.Error(fmt.Sprintf("Some messages may not have been delivered to %s. %s", redacted, close_err))
+			status.Error = close_err.Error()
+		}
+		if counts.failed > 0 {
+			logger.Error(fmt.Sprintf("%d variants could not be published to %s", counts.failed, redacted))
+		}
+		logger.Info(fmt.Sprintf("Published %d variant(s) to %s", counts.published, redacted))
+		manifest.SetPublish(status)
+	}
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"errors"
+	"go-phers-parser/internal/publish"
+	"testing"
+)
+
+func TestPublishCounts(t *testing.T) {
+	queue_err := errors.New("connection refused")
+	cases := []struct {
+		name      string
+		errs      []error
+		close_err error
+		published int
+		failed    int
+	}{
+		{"delivered", []error{nil, nil, nil}, nil, 3, 0},
+		{"single message", []error{nil, queue_err, nil}, nil, 2, 1},
+		// The third message sends the batch so the two messages before it are lost with it
+		{"lost batch", []error{nil, nil, nil, nil, &publish.BatchError{Messages: 3, Err: queue_err}}, nil, 2, 3},
+		{"lost last batch", []error{nil, nil, nil, nil}, &publish.BatchError{Messages: 2, Err: queue_err}, 2, 2},
+		{"close error", []error{nil, nil}, queue_err, 2, 0},
+	}
+	for _, test_case := range cases {
+		counts := &publish_counts{}
+		for _, publish_err := range test_case.errs {
+			counts.add(publish_err)
+		}
+		counts.close(test_case.close_err)
+		if counts.published != test_case.published || counts.failed != test_case.failed {
+			t.Errorf("%s: expected %d published and %d failed variants but got %d and %d", test_case.name, test_case.published, test_case.failed, counts.published, counts.failed)
+		}
+	}
+}
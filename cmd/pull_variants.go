@@ -5,9 +5,25 @@ import (
 	"errors"
 	"fmt"
 	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/annotation"
+	"go-phers-parser/internal/contig"
 	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/genotype"
+	"go-phers-parser/internal/header"
+	"go-phers-parser/internal/intervals"
+	"go-phers-parser/internal/liftover"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/model"
+	"go-phers-parser/internal/pipeline"
+	"go-phers-parser/internal/pseudonym"
+	"go-phers-parser/internal/records"
+	"go-phers-parser/internal/resources"
+	"go-phers-parser/vcf"
+	"io"
 	"log/slog"
+	"math"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,33 +35,64 @@ type VariantAnnotations map[string]*strings.Builder
 type VariantInfo struct {
 	VariantID   string
 	InfoFields  []string
+	InfoColumns []string // decoded values for the INFO keys that the user wanted as separate columns
 	Calls       string
 	Annotations VariantAnnotations
 }
 
-func generate_reference_set() map[string]bool {
-	ref_call := map[string]bool{
-		"0/0": true,
-		"./.": true,
-		"0/.": true,
-		"./0": true,
-		".":   true,
+// We can parse the genotype calls and determine if there was a carrier call for any of the samples.
+// The classifier decides what counts as a carrier (the GT by default or the dosage or the call quality)
+func parse_genotype_calls(classifier vcf.GenotypeClassifier, format string, calls []string) bool {
+	for _, call := range calls {
+		if classifier.IsCarrier(format, call) {
+			return true
+		}
 	}
-
-	return ref_call
+	return false
 }
 
-// We can parse the genotype calls and determine if there was a no reference call for any of the samples
-// The ref calls is a dictionary where the keys are the different reference genotype calls. If we try to use the sample calls as errors and we find one that is not a valid key then it indicates that we have found a non-reference call
-func parse_genotype_calls(calls []string, ref_calls map[string]bool) bool {
-	non_ref_calls := false
+// count_carriers counts the calls that the classifier counts as carriers
+func count_carriers(classifier vcf.GenotypeClassifier, format string, calls []string) int {
+	carriers := 0
 	for _, call := range calls {
-		if _, ok := ref_calls[call]; !ok {
-			non_ref_calls = true
-			break
+		if classifier.IsCarrier(format, call) {
+			carriers++
+		}
+	}
+	return carriers
+}
+
+// carrier_classifier creates the classifier of the --carrier-classifier flag and restricts it to the
+// zygosity of the --genotype-class flag and the variant allele fraction of the --min-vaf flag
+func carrier_classifier(spec string, genotype_class string, min_vaf float64) (vcf.GenotypeClassifier, error) {
+	classifier, classifier_err := vcf.ParseClassifier(spec)
+	if classifier_err != nil {
+		return nil, classifier_err
+	}
+	if min_vaf < 0 || min_vaf > 1 {
+		return nil, fmt.Errorf("the --min-vaf has to be between 0 and 1 but it was %f", min_vaf)
+	}
+	if min_vaf > 0 {
+		classifier = vcf.MinVAF{Base: classifier, Minimum: min_vaf}
+	}
+	return vcf.WithGenotypeClass(classifier, genotype_class)
+}
+
+// carrierVAFColumn is the extra column of --carrier-vaf. It lists the variant allele fraction of
+// each carrier as sample=vaf
+const carrierVAFColumn = "CARRIER_VAF"
+
+// written_samples keeps the samples that were selected with --samples (and that are in the phenotype
+// file for --restrict-to-pheno) in the order of the header
+func written_samples(samples []string, selection *sampleSelection, pheno_map map[string]string, restrict_to_pheno bool) []string {
+	kept := make([]string, 0, len(samples))
+	for _, sample := range samples {
+		if _, found := pheno_map[sample]; !selection.Keep(sample) || (restrict_to_pheno && !found) {
+			continue
 		}
+		kept = append(kept, sample)
 	}
-	return non_ref_calls
+	return kept
 }
 
 func map_header_ids(samples []string) map[string]int {
@@ -57,34 +104,104 @@ func map_header_ids(samples []string) map[string]int {
 	return id_mappings
 }
 
-func check_allele_freq(token string, max_freq_threshold float64) (bool, error) {
-	maf_field := strings.Split(token, ";")[2]
+// allele_freqs returns the frequency of each alternate allele. We use the AF key if it is present.
+// Otherwise we fall back to the third INFO field which is where bcftools puts the frequency after AC
+// and AN. Values that aren't numbers are returned as missing (NaN) and counted in the second value.
+// The error is only returned when the record doesn't have a frequency field at all
+func allele_freqs(info vcf.Info) ([]float64, int, error) {
+	maf_field, found := info.Get("AF")
+	if !found {
+		if len(info.Fields) < 3 {
+			return nil, 0, fmt.Errorf("the INFO field did not have an AF key and only had %d values so the allele frequency could not be found", len(info.Fields))
+		}
+		maf_field = info.Fields[2]
+	}
+	// Only the number of values of the frequency field is checked so that a bad count in a field
+	// that isn't used doesn't fail the record
+	if check_err := info.Check(maf_field.ID); check_err != nil {
+		return nil, 0, check_err
+	}
 
-	maf_values := strings.Split(maf_field, "=")
+	freqs, unparseable := maf_field.AlleleFrequencies()
+	return freqs, unparseable, nil
+}
 
-	for _, maf := range maf_values[1:] {
-		// I think the smallest value that a float32 can be is like 1.17e-38 so we should be
-		// safe using a 32 bit float because allele frequencies can't get that low in any modern
-		// BioBank cohort
-		float_val, err := strconv.ParseFloat(maf, 32)
-		if err != nil {
-			return false, err
+// check_allele_freq determines if any of the allele frequencies pass the threshold. Multi-allelic
+// records have one frequency per alternate allele so the record passes if any of the alleles are
+// rare enough
+func check_allele_freq(maf_values []float64, threshold mafThreshold) bool {
+	for _, maf := range maf_values {
+		// missing values are NaN which will always fail this comparison
+		if threshold.passes(maf) {
+			return true
 		}
+	}
 
-		if float_val <= max_freq_threshold {
-			return true, nil
+	return false
+}
+
+// fold_frequency returns the frequency of the minor allele. When the AF is above 0.5 the alternate
+// allele is the major allele and the reference is the minor allele
+func fold_frequency(freq float64) float64 {
+	return min(freq, 1-freq)
+}
+
+// check_folded_allele_freq is check_allele_freq for --fold-af. Each frequency is folded so that
+// common variants where the alternate allele is the major allele can't slip under the threshold
+// because of a frequency near 1. The second value reports whether the reference is the minor
+// allele of the passing alternate allele, in which case the reference carriers are the interesting samples
+func check_folded_allele_freq(maf_values []float64, threshold mafThreshold) (bool, bool) {
+	for _, maf := range maf_values {
+		if threshold.passes(fold_frequency(maf)) {
+			return true, maf > 0.5
 		}
 	}
 
-	return false, nil
+	return false, false
 }
 
-func process_header_ids(vcf_scanner *bufio.Scanner, pheno_map map[string]string, logger *slog.Logger) ([]string, string, error) {
+// minorAlleleColumn is the extra column that --fold-af adds after the INFO columns. It says which
+// allele of the record is the minor allele so that the carriers in the calls can be interpreted
+const minorAlleleColumn = "MINOR_ALLELE"
+
+func minor_allele_value(minor_is_ref bool) string {
+	if minor_is_ref {
+		return "REF"
+	}
+	return "ALT"
+}
+
+// format_info_columns pulls out the requested INFO keys so that they can be written as separate columns.
+// Keys that are missing from the record are written as '-'. Flags are written as 1 when they are present
+func format_info_columns(info vcf.Info, info_cols []string) []string {
+	values := make([]string, len(info_cols))
+
+	for indx, key := range info_cols {
+		field, found := info.Get(key)
+		switch {
+		case !found:
+			values[indx] = "-"
+		case field.Type == "Flag":
+			values[indx] = "1"
+		default:
+			values[indx] = field.String()
+		}
+	}
+	return values
+}
+
+// process_header_ids reads the header of the vcf stream. Every sample in the header is returned but
+// the sample string only has the selected samples with a phenotype. A selected sample without a
+// phenotype is an error unless restrict_to_pheno is true and then it is left out of the sample string
+func process_header_ids(vcf_scanner *bufio.Scanner, pheno_map map[string]string, selection *sampleSelection, restrict_to_pheno bool, logger *slog.Logger) ([]string, string, *header.Metadata, error) {
 	// We need to return a list of the samples. This value will be used while parsing the vcf file sequencing calls.
 	var samples []string
 	// create the sample string builder so that we can add ids as we process them. This string will be used when writting the output
 	sample_str := strings.Builder{}
 
+	// We also keep the information from the meta lines like ##contig and ##reference so that we can check the region against the callset
+	metadata := &header.Metadata{}
+
 	var err error
 	samples_count := 0 // We also are going to keep counts of the number of samples so that we can report that back to the user
 
@@ -96,18 +213,33 @@ Scanner: // we can create a label for the outer scanner loop so that we can sele
 
 		line_number++
 
-		if strings.Contains(line, "##") {
+		// We need to use the prefix of the line because INFO fields or IDs in the records could contain these substrings
+		if strings.HasPrefix(line, "##") {
+			metadata.AddLine(line)
 			continue
-		} else if strings.Contains(line, "#CHROM") {
+		} else if strings.HasPrefix(line, "#CHROM") {
 			split_header := strings.Split(strings.TrimSpace(line), "\t")
+			// A truncated header line doesn't have the 9 fixed columns so there is no place where the samples start
+			if len(split_header) < 9 {
+				err = fmt.Errorf("the #CHROM header line on line %d only had %d tab separated columns. A vcf header line needs the 9 columns #CHROM, POS, ID, REF, ALT, QUAL, FILTER, INFO, and FORMAT before the sample ids. Please make sure that the vcf file is tab separated", line_number, len(split_header))
+				break Scanner
+			}
 			// we can now set the samples
 			samples = split_header[9:]
 			for _, id := range split_header[9:] { // sample IDs start at the 9 index in the vcf file. This is standard format
-				if value, ok := pheno_map[id]; ok {
-					sample_str.WriteString(fmt.Sprintf("%s_%s\t", id, value))
+				// The phenotype is written in the ##SAMPLE lines so the column is just the id. Ids
+				// can have underscores in them so appending the phenotype made the columns ambiguous
+				// The samples that weren't selected with --samples don't need a phenotype
+				if !selection.Keep(id) {
+					continue
+				}
+				if _, ok := pheno_map[id]; ok {
+					sample_str.WriteString(pseudonym.ID(id) + "\t")
 					samples_count++
+				} else if restrict_to_pheno {
+					continue
 				} else {
-					err = fmt.Errorf("the id %s had no phenotype information meaning that it was not present in the phenotype file but it is present in the header of the VCF file that is being streamed in. This error may be the result of providing an incorrect version of either the phenotype file to the program or the samples file used to filter from bcftools. Please rectify this two files so that the samples file either has the same individuals as the phenotype file or it is a subset of the individuals in the phenotype file. Program will now terminate", id)
+					err = fmt.Errorf("the id %s had no phenotype information meaning that it was not present in the phenotype file but it is present in the header of the VCF file that is being streamed in. This error may be the result of providing an incorrect version of either the phenotype file to the program or the samples file used to filter from bcftools. Please rectify this two files so that the samples file either has the same individuals as the phenotype file or it is a subset of the individuals in the phenotype file, or use --restrict-to-pheno to leave the samples without a phenotype out of the output. Program will now terminate", id)
 					break Scanner // Break out of the whole scanner loop
 				}
 			}
@@ -121,20 +253,155 @@ Scanner: // we can create a label for the outer scanner loop so that we can sele
 	if vcf_scanner.Err() != nil {
 		err = fmt.Errorf("encountered the following error on line %d while trying to scan through the header of the vcf file for sample ids: %s", line_number, vcf_scanner.Err())
 	}
+	metadata.HeaderLines = line_number
 	// The final sample_str will end in a tab separator. This needs to be kept in mind when writing the string to a file
-	return samples, sample_str.String(), err
+	return samples, sample_str.String(), metadata, err
+}
+
+// check_region_against_header makes sure that the chromosome in the region is actually
+// in the callset and that the region doesn't extend past the end of the chromosome. We also
+// try to detect the build of the callset so that we can warn the user if it doesn't look like
+// the build they expected. These are only warnings because plenty of vcf files don't have these lines
+func check_region_against_header(metadata *header.Metadata, region Region, expected_build string, logger *slog.Logger) {
+	if len(metadata.Contigs) == 0 {
+		logger.Info("The vcf header did not have any ##contig lines so the region could not be checked against the callset")
+	} else if header_contig, found := metadata.FindContig(region.chrom); !found {
+		logger.Warn(fmt.Sprintf("The chromosome %s from the region was not found in the ##contig lines of the vcf header. This situation will likely produce an empty output. Please make sure that the region is on a chromosome in the callset", region.chrom))
+	} else if header_contig.Length > 0 && region.end > header_contig.Length {
+		logger.Warn(fmt.Sprintf("The end of the region, %d, is past the end of the chromosome %s which has a length of %d in the vcf header. This situation may indicate that the region is from a different genome build than the callset", region.end, header_contig.ID, header_contig.Length))
+	}
+
+	reference_build := metadata.BuildFromReference()
+	contig_build := metadata.BuildFromContigs()
+
+	if reference_build != "" && contig_build != "" && reference_build != contig_build {
+		logger.Warn(fmt.Sprintf("The ##reference line of the vcf header looks like %s but the ##contig lines look like %s. Please check what build the callset was generated with", reference_build, contig_build))
+	}
+
+	detected_build := reference_build
+	if detected_build == "" {
+		detected_build = contig_build
+	}
+
+	if detected_build != "" {
+		logger.Info(fmt.Sprintf("The vcf header indicates that the callset uses the build %s", detected_build))
+	}
+
+	if expected_build != "" && detected_build != "" && header.NormalizeBuild(expected_build) != detected_build {
+		logger.Warn(fmt.Sprintf("The expected genome build was %s but the vcf header indicates that the callset uses %s. The region and the annotations may not line up with the variants", expected_build, detected_build))
+	}
+}
+
+// check_column_count makes sure that a record has the same number of columns as the header. The
+// returned error identifies the variant (if we can find the ID column) so that the user can find the record
+func check_column_count(split_line []string, expected_columns int) error {
+	if len(split_line) == expected_columns {
+		return nil
+	}
+
+	variant_id := "unknown"
+	if len(split_line) > 2 {
+		variant_id = split_line[2]
+	}
+	return column_count_error(variant_id, len(split_line), expected_columns)
+}
+
+// split_record splits the record into its columns and checks them against the header. With a
+// selector only the fixed columns and the selected sample columns are returned
+func split_record(line string, selector *vcf.ColumnSelector, expected_columns int) ([]string, error) {
+	line = strings.TrimSpace(line)
+	if selector == nil {
+		split_line := strings.Split(line, "\t")
+		return split_line, check_column_count(split_line, expected_columns)
+	}
+
+	fields, column_count, selected := selector.Select(line)
+	if !selected || column_count != expected_columns {
+		// The line is only split to name the variant in the error
+		variant_id := "unknown"
+		if split_line := strings.SplitN(line, "\t", 4); len(split_line) > 2 {
+			variant_id = split_line[2]
+		}
+		return nil, column_count_error(variant_id, column_count, expected_columns)
+	}
+	return fields, nil
 }
 
-func parse_vcf_file(vcf_scanner *bufio.Scanner, maf_cap float64, annotations map[string]VariantAnnotations, samples []string, sample_indices map[string]int, ch chan<- VariantInfo, wg *sync.WaitGroup, logger *slog.Logger) {
+func column_count_error(variant_id string, column_count int, expected_columns int) error {
+	return fmt.Errorf("the record for the variant %s has %d columns but the header has %d columns (9 fixed columns + %d samples). This situation usually means that the vcf stream was truncated", variant_id, column_count, expected_columns, expected_columns-9)
+}
+
+// check_contig_names compares the chromosome name of the first record in the vcf stream against
+// the chromosome of the requested region. Mixed naming (chr22 vs 22) is reconciled
+// automatically but we still want to let the user know that it happened. If the
+// chromosomes are actually different then the output will most likely be empty so we warn the user
+func check_contig_names(vcf_chrom string, region Region, logger *slog.Logger) {
+	if !contig.Same(vcf_chrom, region.chrom) {
+		logger.Warn(fmt.Sprintf("The first variant in the vcf stream is on the chromosome %s but the requested region is on the chromosome %s. This mismatch will likely result in no annotations being matched to the variants. Please make sure that bcftools was given the same region as the --region flag", vcf_chrom, region.chrom))
+	} else if contig.DetectStyle(vcf_chrom) != contig.DetectStyle(region.chrom) {
+		logger.Warn(fmt.Sprintf("The vcf stream uses the chromosome name %s while the region uses the name %s. These names will be treated as the same chromosome", vcf_chrom, region.chrom))
+	}
+}
+
+func parse_vcf_file(vcf_scanner *bufio.Scanner, maf_cap mafThreshold, fold_af bool, max_ac int, carrier_vaf bool, filter_trace bool, keep_filtered bool, anno_freq *AnnotationFrequency, annotations annotation.AnnotationSource, anno_cols []string, classifier vcf.GenotypeClassifier, samples []string, sample_indices map[string]int, header_samples int, region Region, regions *intervals.Set, expected_ploidy map[int]bool, contig_style contig.Style, metadata *header.Metadata, info_cols []string, rejects *RejectTracker, unannotated *UnannotatedTracker, out *pipeline.Emitter[VariantInfo], wg *sync.WaitGroup, logger *slog.Logger) {
 	defer wg.Done()
+	defer resources.StartStage("parse vcf")()
 	logger.Info("Starting to parse VCF lines in parse_vcf_file...")
-	// Lets create the reference genotype map
-	reference_calls := generate_reference_set()
+	// We keep track of how many calls have a ploidy that we don't expect (such as triploid calls from a mosaic caller)
+	unexpected_ploidy_calls := 0
+	// The decoder uses the ##INFO lines to split multi-allelic values correctly. It also handles the
+	// percent encoded characters that VCFv4.3 and newer files can have in the INFO values
+	info_decoder := vcf.NewInfoDecoder(metadata)
+	// With --fold-af the records where the reference is the minor allele look for the reference allele
+	// in the calls. The --genotype-class, --min-vaf, and the quality or dosage of the classifier still apply
+	minor_classifier := vcf.ForMinorReference(classifier)
+	// The header has the 9 fixed columns plus a column for each sample
+	expected_columns := header_samples + 9
+	// We look up the column of each sample once here instead of once per record. In the id_mapping the
+	// indices start at 0 but in the file the indices for samples will start at 9 so we need to add 9 to the index
+	sample_columns := make([]int, len(samples))
+	for sample_pos, sample_id := range samples {
+		sample_columns[sample_pos] = sample_indices[sample_id] + 9
+	}
+	// With --samples or --restrict-to-pheno some of the samples in the header aren't written. The
+	// selector pulls the written columns out of each line without splitting the other calls, which is
+	// most of the work for a small panel of a wide callset. The selected calls are in the order of the
+	// samples so the records only have the written calls and they start at the column 9
+	var selector *vcf.ColumnSelector
+	if len(samples) != header_samples {
+		selector = vcf.NewColumnSelector(sample_columns)
+		for sample_pos := range sample_columns {
+			sample_columns[sample_pos] = sample_pos + 9
+		}
+	}
 	// now we can parse through the vcf file. We don't have to account for the header lines
 	// because we have a separator function handling this before the go routines
 	lines_scanned := 0
-	variants_skipped := 0 // For now we are going to use this variable to track variants we are skipping
-	for vcf_scanner.Scan() {
+	variants_skipped := 0     // For now we are going to use this variable to track variants we are skipping
+	variants_unannotated := 0 // We also keep track of how many variants we couldn't find annotations for
+	variants_found := 0
+	variants_outside := 0    // records that don't overlap the intervals of --regions-file
+	variants_folded := 0     // records where --fold-af found that the reference is the minor allele
+	variants_over_ac := 0    // records with more minor alleles in the samples than --max-ac
+	variants_no_carrier := 0 // records where none of the samples were a carrier
+	af_unparseable := 0      // INFO AF values that weren't numbers and were treated as missing
+	records_af_unparseable := 0
+	variants_failed := 0 // records that failed a filter but were written because of --keep-filtered
+	contig_checked := false
+	// With --timings the stopwatch splits the time of the loop between reading the records (the
+	// decompression and bcftools upstream), the filters, the annotation lookups, and waiting on the writer
+	watch := resources.NewStopwatch()
+	defer watch.Finish()
+	// In strict mode the first malformed record stops the loop. The variants that were already
+	// parsed are still passed on so that the other stages can finish before the program exits
+Records:
+	for {
+		watch.Lap("filter records")
+		scanned := vcf_scanner.Scan()
+		watch.Lap("scan vcf")
+		if !scanned {
+			break
+		}
 		lines_scanned++
 		line := vcf_scanner.Text()
 
@@ -144,136 +411,355 @@ func parse_vcf_file(vcf_scanner *bufio.Scanner, maf_cap float64, annotations map
 
 		// we can first skip all the unnessecary header lines that have runtime information that we don't need
 		// We need to make sure the variants are within our region of interest
-		split_line := strings.Split(strings.TrimSpace(line), "\t")
-		if len(split_line) < 10 {
-			variants_skipped++
+		// Every record needs to have a column for each sample in the header. Truncated streams from
+		// bcftools would otherwise cause an index out of range panic when we pull out the calls
+		split_line, column_err := split_record(line, selector, expected_columns)
+		if column_err != nil {
+			if reject_err := rejects.Reject(lines_scanned, line, column_err); reject_err != nil {
+				break Records
+			}
 			continue // Skip malformed lines or header lines that might have slipped through
 		}
+		// The typed record checks the fixed columns (the position is needed to look up the annotations of the variant)
+		record, record_err := model.ParseVariant(split_line)
+		if record_err != nil {
+			if reject_err := rejects.Reject(lines_scanned, line, record_err); reject_err != nil {
+				break Records
+			}
+			continue
+		}
+
+		// bcftools usually streams a whole chromosome (or the span of the intervals) when there is a
+		// --regions-file so we only keep the records that overlap one of the intervals
+		if regions != nil && !regions.Overlaps(record.Chrom, record.Pos, record.Pos+len(record.Ref)-1) {
+			variants_outside++
+			continue
+		}
+
+		// With --filter-trace we keep the value that each filter saw so it can be written with the record
+		var trace *filterTrace
+		if filter_trace {
+			trace = &filterTrace{}
+		}
+		if regions != nil {
+			trace.add("REGIONS", "overlap")
+		}
+
+		// The first record lets us check if the vcf stream uses the same naming as the region
+		if !contig_checked {
+			check_contig_names(record.Chrom, region, logger)
+			contig_checked = true
+		}
 
 		// we also need to get the minor allele freq
 		// If there is an error then we can continue in the loop
-		pass_af_threshold, freq_err := check_allele_freq(split_line[7], maf_cap)
-		if freq_err != nil {
-			logger.Error(fmt.Sprintf("Error checking allele frequency on line %d: %s\n", lines_scanned, freq_err))
-			variants_skipped++
+		info, info_err := info_decoder.Decode(split_line[7], len(record.Alt))
+		if info_err == nil {
+			// The AF is checked when it is read so only the fields of --info-cols are checked here
+			info_err = info.Check(info_cols...)
+		}
+		if info_err != nil {
+			if reject_err := rejects.Reject(lines_scanned, line, fmt.Errorf("failed to decode the INFO column for the variant %s: %w", record.ID, info_err)); reject_err != nil {
+				break Records
+			}
 			continue
 		}
 
-		if pass_af_threshold {
-			// we only need to determine if any of the calls are non variant and then we can return those sites
-			if non_ref_call_found := parse_genotype_calls(split_line[9:], reference_calls); non_ref_call_found {
-				// we can build the calls string we need to ensure that the calls are
-				// in the same order as the samples with whatever scores we provided
-				call_string := strings.Builder{}
+		// We also need to pull out the annotations for the variant. The sources match the
+		// chromosome regardless of the naming style. Variants without annotations get a
+		// nil value and are written with - in every annotation column
+		lookup_annotations := func() map[string]string {
+			watch.Lap("filter records")
+			defer watch.Lap("annotation lookups")
+			watch.Count("annotation lookups", 1)
+			anno_values, anno_err := annotations.Lookup(record.Chrom, record.Pos, record.Ref, split_line[4])
+			if anno_err != nil {
+				logger.Warn(fmt.Sprintf("Unable to look up the annotations for the variant %s. %s", record.ID, anno_err))
+			}
+			return anno_values
+		}
 
-				for _, sample_id := range samples {
-					// In the id_mapping the indices are start at 0 but in the file the
-					// indices for samples will start at 9 so we need to add 9 to the index
-					sample_indx := sample_indices[sample_id] + 9
-					call_string.WriteString(fmt.Sprintf("\t%s", split_line[sample_indx]))
+		// With --af-columns the frequency comes from the annotations so these are looked up before
+		// the calls. minor_is_ref is set when --fold-af found that the reference is the minor allele
+		var anno_values map[string]string
+		pass_af_threshold, minor_is_ref := false, false
+		switch {
+		case anno_freq != nil:
+			anno_values = lookup_annotations()
+			pass_af_threshold, minor_is_ref = anno_freq.Passes(anno_values, maf_cap)
+			if trace != nil {
+				freq, found := anno_freq.Frequency(anno_values)
+				if !found {
+					freq = math.NaN()
 				}
-
-				// We also need to pull out the annotations for the variant. If the annotation
-				// doesn't exist then we can just use an empty string. The ok returns true if
-				// the value is in the dictionary and false if it is not.
-				anno, ok := annotations[split_line[2]]
-				if !ok {
-					anno = nil
+				trace.frequency("ANNO_AF", freq, maf_cap)
+			}
+		default:
+			// Values that aren't numbers are treated as missing for their allele so that the
+			// other alleles of the record can still pass. They are counted for the summary
+			freqs, unparseable, freq_err := allele_freqs(info)
+			if freq_err != nil {
+				if reject_err := rejects.Reject(lines_scanned, line, fmt.Errorf("failed to check the allele frequency for the variant %s: %w", record.ID, freq_err)); reject_err != nil {
+					break Records
 				}
-				variant := VariantInfo{VariantID: split_line[2], InfoFields: split_line[0:9], Calls: call_string.String(), Annotations: anno}
-				ch <- variant
+				continue
 			}
-		} else {
+			if unparseable > 0 {
+				af_unparseable += unparseable
+				records_af_unparseable++
+			}
+			if fold_af {
+				pass_af_threshold, minor_is_ref = check_folded_allele_freq(freqs, maf_cap)
+				trace.frequency("MAF", smallest_frequency(freqs, true), maf_cap)
+			} else {
+				pass_af_threshold = check_allele_freq(freqs, maf_cap)
+				trace.frequency("AF", smallest_frequency(freqs, false), maf_cap)
+			}
+		}
+
+		// When the reference is the minor allele the samples that carry the reference are the carriers
+		carrier_classifier := classifier
+		if minor_is_ref {
+			carrier_classifier = minor_classifier
+			variants_folded++
+		}
+
+		// With --keep-filtered the records that fail a filter are written with the filters that they
+		// failed instead of being skipped
+		var failed []string
+		if !pass_af_threshold {
 			variants_skipped++
+			failed = append(failed, mafFailure)
+			if !keep_filtered {
+				continue
+			}
+		}
+		// we only need to determine if any of the calls are non variant and then we can return those sites
+		if non_ref_call_found := parse_genotype_calls(carrier_classifier, split_line[8], record.Calls); !non_ref_call_found {
+			variants_no_carrier++
+			failed = append(failed, noCarrierFailure)
+			if !keep_filtered {
+				continue
+			}
+		}
+		if trace != nil {
+			trace.add("CARRIERS", strconv.Itoa(count_carriers(carrier_classifier, split_line[8], record.Calls)))
+		}
+		if anno_freq == nil {
+			anno_values = lookup_annotations()
 		}
+
+		// we can build the calls string we need to ensure that the calls are
+		// in the same order as the samples with whatever scores we provided
+		call_string := strings.Builder{}
+
+		// We count the minor alleles in the samples while we build the string so that
+		// the --max-ac filter doesn't depend on the AC in the INFO column
+		allele_count := 0
+		var carrier_vafs []string
+		for sample_pos, sample_id := range samples {
+			sample_indx := sample_columns[sample_pos]
+			call_string.WriteString(fmt.Sprintf("\t%s", split_line[sample_indx]))
+			if ploidy := genotype.Ploidy(split_line[sample_indx]); !expected_ploidy[ploidy] {
+				unexpected_ploidy_calls++
+			}
+			if carrier_vaf && carrier_classifier.IsCarrier(split_line[8], split_line[sample_indx]) {
+				if vaf, found := vcf.CallVAF(split_line[8], split_line[sample_indx]); found {
+					carrier_vafs = append(carrier_vafs, fmt.Sprintf("%s=%s", pseudonym.ID(sample_id), strconv.FormatFloat(vaf, 'f', 3, 64)))
+				}
+			}
+			alt_count, ref_count := genotype.AlleleCounts(split_line[sample_indx])
+			if minor_is_ref {
+				allele_count += ref_count
+			} else {
+				allele_count += alt_count
+			}
+		}
+		if max_ac > 0 && allele_count > max_ac {
+			variants_over_ac++
+			failed = append(failed, maxACFailure)
+			if !keep_filtered {
+				continue
+			}
+		}
+		if max_ac > 0 {
+			trace.threshold("AC", strconv.Itoa(allele_count), strconv.Itoa(max_ac))
+		}
+
+		anno := new_variant_annotations(anno_values, anno_cols)
+		// The unannotated variants are only counted for the records that passed the filters
+		if anno == nil && len(failed) == 0 {
+			variants_unannotated++
+			unannotated.Add(split_line[0:5])
+		}
+		if len(failed) > 0 {
+			variants_failed++
+		}
+		variants_found++
+		// If the user requested a specific naming style then we need to rewrite the chromosome and the id
+		if contig_style != contig.StyleAuto {
+			split_line[0] = contig.Apply(split_line[0], contig_style)
+			split_line[2] = contig.RewriteVariantID(split_line[2], contig_style)
+		}
+		info_values := format_info_columns(info, info_cols)
+		if fold_af {
+			info_values = append(info_values, minor_allele_value(minor_is_ref))
+		}
+		if carrier_vaf {
+			info_values = append(info_values, missing_dash(strings.Join(carrier_vafs, ",")))
+		}
+		if trace != nil {
+			info_values = append(info_values, trace.String())
+		}
+		if keep_filtered {
+			info_values = append(info_values, filter_status(failed))
+		}
+		variant := VariantInfo{VariantID: split_line[2], InfoFields: split_line[0:9], InfoColumns: info_values, Calls: call_string.String(), Annotations: anno}
+		watch.Lap("filter records")
+		out.Emit(variant)
+		watch.Lap("send to writer")
 		if vcf_scanner.Err() != nil {
 			logger.Error(fmt.Sprintf("Encountered the following error while attempting to read through the vcf file:\n %s", vcf_scanner.Err()))
 		}
 	}
-	logger.Info(fmt.Sprintf("Skipped %d variants while parsing the vcf file\n", variants_skipped))
+	watch.Count("scan vcf", lines_scanned)
+	watch.Count("filter records", lines_scanned)
+	watch.Count("send to writer", variants_found)
+	resources.CountRecords("parse vcf", lines_scanned)
+	// With --keep-filtered the variants that failed a filter were labelled instead of skipped
+	skipped := "Skipped"
+	if keep_filtered {
+		skipped = "Labelled"
+	}
+	logger.Info(fmt.Sprintf("%s %d variants while parsing the vcf file\n", skipped, variants_skipped))
+	logger.Info(fmt.Sprintf("%s %d variants that had no carriers in the samples", skipped, variants_no_carrier))
+	if regions != nil {
+		logger.Info(fmt.Sprintf("Skipped %d records that did not overlap the intervals of the regions file", variants_outside))
+	}
+	if max_ac > 0 {
+		logger.Info(fmt.Sprintf("%s %d variants that had an allele count above %d in the samples", skipped, variants_over_ac, max_ac))
+	}
+	if af_unparseable > 0 {
+		logger.Warn(fmt.Sprintf("%d INFO AF values in %d records could not be parsed as a number and were treated as missing. A record still passes the --maf-threshold if one of its other alleles does", af_unparseable, records_af_unparseable))
+	}
+	if fold_af {
+		logger.Info(fmt.Sprintf("The reference was the minor allele of %d records so the reference carriers were used for these records", variants_folded))
+	}
+	if keep_filtered {
+		logger.Info(fmt.Sprintf("%d of the %d written variants failed a filter and were labelled in the %s column instead of being skipped", variants_failed, variants_found, filterStatusColumn))
+	}
+
+	rejects.Close()
+	unannotated.Close()
+
+	if unexpected_ploidy_calls > 0 {
+		logger.Warn(fmt.Sprintf("%d calls in the written variants had a ploidy that was not one of the expected ploidies. These calls may come from a polyploid or mosaic caller", unexpected_ploidy_calls))
+	}
+
+	if variants_found > 0 && variants_unannotated == variants_found {
+		logger.Warn(fmt.Sprintf("None of the %d variants found in the vcf stream were matched to an annotation. This situation is usually caused by the variant IDs in the vcf file not matching the Uploaded_variation column of the annotation file. Use --write-unannotated to list the reason for each variant", variants_found))
+	} else if variants_unannotated > 0 {
+		logger.Info(fmt.Sprintf("%d out of %d variants had no annotations in the annotation file", variants_unannotated, variants_found))
+	}
 
 	if vcf_scanner.Err() != nil {
 		logger.Info(fmt.Sprintf("Encountered the following error after the vcf scanner loop:\n %s", vcf_scanner.Err()))
 	} else if lines_scanned == 0 {
 		logger.Info("No variants were scanned. The VCF stream might be empty after the header.")
 	}
-	close(ch)
+	out.Close()
 }
 
-// parse the VariantAnnotations
-func generate_annotation_str(variant_annos VariantAnnotations, anno_cols []string) string {
-	annotation_str := strings.Builder{}
-	for _, col := range anno_cols {
-		if value, ok := variant_annos[col]; ok {
-			formatted_val := fmt.Sprintf("\t%s", value.String())
-			annotation_str.WriteString(formatted_val)
-		}
-	}
-	return annotation_str.String()
-}
+// pulled_output_columns returns the columns of the pull-variants output. This will have the first
+// 9 fields that are in every vcf file. Then we will add the columns for the sample ids. Then we will
+// add the columns for the annotation fields and finally the INFO keys that the user requested
+func pulled_output_columns(samples string, annotation_cols []string, info_cols []string) []string {
+	columns := []string{"#CHROM", "POS", "ID", "REF", "ALT", "QUAL", "FILTER", "INFO", "FORMAT"}
 
-func writeToFile(samples string, annotation_cols []string, writer *bufio.Writer, ch <-chan VariantInfo, wg *sync.WaitGroup, logger *slog.Logger) {
-	defer wg.Done()
-	// counter to record how many variants were written to a file
-	variants_written := 0
-	// we first ned to build the header string. This will have the first 9 fields that are in every
-	// vcf file. Then we will add the columns for the sample ids. Then we will add the columns for
-	// the annotation fields
-	header_str := strings.Builder{}
-
-	header_str.WriteString("#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\t")
-
-	header_str.WriteString(samples)
+	// The sample string ends with a tab separator so we trim it before splitting
+	if trimmed := strings.TrimSuffix(samples, "\t"); trimmed != "" {
+		columns = append(columns, strings.Split(trimmed, "\t")...)
+	}
 
-	header_str.WriteString(strings.Join(annotation_cols, "\t"))
+	columns = append(columns, annotation_cols...)
 
-	header_str.WriteString("\n")
+	return append(columns, info_cols...)
+}
 
-	_, header_err := writer.WriteString(header_str.String())
+// format_output_header builds the header line of the tsv pull-variants output
+func format_output_header(samples string, annotation_cols []string, info_cols []string) string {
+	return strings.Join(pulled_output_columns(samples, annotation_cols, info_cols), "\t") + "\n"
+}
 
-	if header_err != nil {
-		logger.Error(fmt.Sprintf("encountered an error while trying to write the header string, %s, to a file. The cause of this could be a bug in the code or unexpected separators in your data. Flushing all of the current data in the writer to the output file but this file is incomplete.", header_str.String()))
-		writer.Flush()
-		os.Exit(1)
+// pulled_output_header describes the pull-variants output for the record writers. The vcf
+// writer uses the meta lines of the input so that the output keeps the ##INFO and ##contig lines.
+// Every format that writes a header gets the ##SAMPLE lines with the phenotype of each column
+func pulled_output_header(pulled *PulledVariants) records.Header {
+	output_header := records.Header{
+		Columns:    pulled_output_columns(pulled.SampleStr, pulled.AnnoCols, pulled.InfoCols),
+		Samples:    len(pulled.Samples),
+		SampleMeta: sample_meta_lines(pulled.Samples, pulled.Phenotypes),
 	}
+	if pulled.Metadata != nil {
+		output_header.Meta = pulled.Metadata.Lines
+	}
+	return output_header
+}
 
-	// Now we can read through the information in the channel by pulling out 1 variant at a time
-	for variant := range ch {
-		// now we can build a string for each variant being returned in the analysis
-		output_str := strings.Builder{}
-		// WE first join initial 9 fields from the vcf file that we stored in the variant.InfoFields attribute
-		output_str.WriteString(strings.Join(variant.InfoFields, "\t"))
-		// next we can append the calls to this string. This calls string starts with a tab character
-		output_str.WriteString(variant.Calls)
-		// This code asumes that the variant.Calls ends with a tab separator so
-		// therefore we don't need to add any separator between that string and
-		// If the annotation string is empty then there were no annotations for the specific variant
-		// and we have to create the annotation string by just creating '-' for each column
-		if variant.Annotations == nil {
-			for range annotation_cols {
-				output_str.WriteString("\t-")
-			}
-			output_str.WriteString("\n")
+// pulled_variant_record returns the values of one row of the pull-variants output. Variants
+// without annotations get a - in every annotation column
+func pulled_variant_record(variant VariantInfo, annotation_cols []string) []string {
+	values := make([]string, 0, len(variant.InfoFields)+len(annotation_cols)+len(variant.InfoColumns)+strings.Count(variant.Calls, "\t"))
+	// WE first add the initial 9 fields from the vcf file that we stored in the variant.InfoFields attribute
+	values = append(values, variant.InfoFields...)
+	// The calls string starts with a tab character so the first value of the split is empty
+	if variant.Calls != "" {
+		values = append(values, strings.Split(variant.Calls, "\t")[1:]...)
+	}
+	for _, col := range annotation_cols {
+		if value, ok := variant.Annotations[col]; ok {
+			values = append(values, value.String())
 		} else {
-			anno_str := generate_annotation_str(variant.Annotations, annotation_cols)
-			output_str.WriteString(fmt.Sprintf("%s\n", anno_str))
+			values = append(values, "-")
 		}
+	}
+	return append(values, variant.InfoColumns...)
+}
 
-		_, variant_err := writer.WriteString(output_str.String())
+// writeToFile writes the variants from the channel with the record writer. The header is only
+// written to the output if the writer was created to write it (appending skips the header)
+func writeToFile(record_writer records.RecordWriter, output_header records.Header, annotation_cols []string, batches <-chan []VariantInfo, wg *sync.WaitGroup, logger *slog.Logger) {
+	defer wg.Done()
+	defer resources.StartStage("write output")()
+	// counter to record how many variants were written to a file
+	variants_written := 0
 
-		if variant_err != nil {
-			logger.Error(fmt.Sprintf("encountered an error while trying to write the output variant string, %s, for the variant object, %+v\n. This error could be the result of a bug in the code or an encoding issue within the data. Flushing all current data in the writer but the output file will be incomplete", output_str.String(), variant))
-			writer.Flush()
-			os.Exit(1)
+	if header_err := record_writer.WriteHeader(output_header); header_err != nil {
+		logger.Error(fmt.Sprintf("encountered an error while trying to write the header of the output. %s", header_err))
+		record_writer.Close()
+		os.Exit(1)
+	}
+
+	// Now we can read through the batches in the channel and write out 1 variant at a time
+	for batch := range batches {
+		for _, variant := range batch {
+			if variant_err := record_writer.WriteRecord(pulled_variant_record(variant, annotation_cols)); variant_err != nil {
+				logger.Error(fmt.Sprintf("encountered an error while trying to write the variant %s to the output. This error could be the result of a bug in the code or an encoding issue within the data. Closing the output but the output file will be incomplete. %s", variant.VariantID, variant_err))
+				record_writer.Close()
+				os.Exit(1)
+			}
+			// increment the variants_written counter to represent that we have written another variant to file
+			variants_written++
 		}
-		// increment the variants_written counter to represent that we have written another variant to file
-		variants_written++
 	}
-	writer.Flush()
+	resources.CountRecords("write output", variants_written)
 	logger.Info(fmt.Sprintf("Recorded information for %d variant(s)", variants_written))
 }
 
-func check_region(anno_pos string, start int, end int) (bool, []error) {
+// check_region checks if the position from the annotation file overlaps the intervals that we are
+// collecting annotations for. The chromosome has to match as well because annotation files often
+// cover several chromosomes and the same coordinates exist on each of them
+func check_region(anno_pos string, regions *intervals.Set) (bool, []error) {
 	split_pos := strings.FieldsFunc(anno_pos, func(r rune) bool {
 		return r == ':' || r == '-'
 	})
@@ -282,15 +768,20 @@ func check_region(anno_pos string, start int, end int) (bool, []error) {
 	// If the position is only "pos" then the split will produce an array of 1 value. If there is only
 	// a : then it will have 2 values. If it has both a : and - then the resulting array will have 3
 	// values. If the length of the resulting array is > 2 then we just need to pull the second value. If the length is 3 then we need to set the start and end
+	var chrom string
 	var start_pos_str string
 	var end_pos_str string
 	var conversion_err []error
 
-	if len(split_pos) == 1 {
+	if len(split_pos) == 0 {
+		return false, []error{fmt.Errorf("the position %q in the annotation file was empty", anno_pos)}
+	} else if len(split_pos) == 1 {
 		start_pos_str = split_pos[0]
 	} else if len(split_pos) == 2 {
+		chrom = split_pos[0]
 		start_pos_str = split_pos[1]
 	} else {
+		chrom = split_pos[0]
 		start_pos_str = split_pos[1]
 		end_pos_str = split_pos[2]
 	}
@@ -310,8 +801,9 @@ func check_region(anno_pos string, start int, end int) (bool, []error) {
 	if end_pos_str != "" && second_conv_err != nil {
 		conversion_err = append(conversion_err, fmt.Errorf("enocuntered the following error while converting the ending position of the string %s\n. %s", anno_pos, second_conv_err))
 	}
-	// Here we are going to check if the starting region falls within our desired region or if the end end position falls within our starting region
-	return start <= start_pos && start_pos <= end || (end_pos != 0 && start <= end_pos && end_pos <= end), conversion_err
+	// Positions without an end (or with an end that couldn't be read) are a single base. Positions
+	// without a chromosome are compared against the intervals of every chromosome
+	return regions.Overlaps(chrom, start_pos, end_pos), conversion_err
 }
 
 // To improve performance we are going to use cut in a for loop to get the column that we desire.
@@ -334,35 +826,188 @@ func retrieve_pos(line string, col_indx int) (string, error) {
 	return return_string, err
 }
 
-func read_annotations(filepath string, cols_to_grab []string, region Region, logger *slog.Logger) (map[string]VariantAnnotations, error) {
+// parse_pos_cols parses the value of --anno-pos-cols. The columns are either CHROM,POS for tables
+// with one position per row or CHROM,START,END for tables of intervals
+func parse_pos_cols(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	pos_cols := strings.Split(value, ",")
+	if len(pos_cols) != 2 && len(pos_cols) != 3 {
+		return nil, fmt.Errorf("the --anno-pos-cols value %s should list the chromosome and position columns (such as CHROM,POS) or the chromosome, start, and end columns (such as CHROM,START,END)", value)
+	}
+	return pos_cols, nil
+}
+
+// columns_pos builds the position of the row in the chr:start-end form of the VEP Location column
+// from the separate coordinate columns so that the rest of the reader can treat both layouts the same
+func columns_pos(split_line []string, pos_indices []int) (string, error) {
+	for _, indx := range pos_indices {
+		if indx >= len(split_line) || split_line[indx] == "" {
+			return "", fmt.Errorf("the annotation row only has %d columns and is missing a coordinate column", len(split_line))
+		}
+	}
+	if len(pos_indices) == 2 {
+		return fmt.Sprintf("%s:%s", split_line[pos_indices[0]], split_line[pos_indices[1]]), nil
+	}
+	return fmt.Sprintf("%s:%s-%s", split_line[pos_indices[0]], split_line[pos_indices[1]], split_line[pos_indices[2]]), nil
+}
+
+// lift_annotation_pos converts the position column of the annotation file (chr:pos or chr:start-end)
+// into the build of the callset. The returned bool is false if the position couldn't be lifted
+func lift_annotation_pos(pos_str string, chain *liftover.Chain) (string, bool) {
+	chrom, positions, found := strings.Cut(pos_str, ":")
+	if !found {
+		return pos_str, false
+	}
+
+	start_str, end_str, has_end := strings.Cut(positions, "-")
+
+	start, start_err := strconv.Atoi(start_str)
+	if start_err != nil {
+		return pos_str, false
+	}
+
+	if !has_end {
+		new_chrom, new_start, ok := chain.LiftPosition(chrom, start)
+		return fmt.Sprintf("%s:%d", new_chrom, new_start), ok
+	}
+
+	end, end_err := strconv.Atoi(end_str)
+	if end_err != nil {
+		return pos_str, false
+	}
+
+	new_chrom, new_start, new_end, lift_err := chain.LiftInterval(chrom, start, end)
+
+	return fmt.Sprintf("%s:%d-%d", new_chrom, new_start, new_end), lift_err == nil
+}
+
+// annotationBuffersize is the longest annotation row that read_annotations can read. VEP rows
+// are much shorter than vcf records but rows with many plugin columns can still be long. The
+// bench command changes this value to time the reader with different buffer sizes
+var annotationBuffersize = 7168 * 7168
+
+func read_annotations(filepath string, cols_to_grab []string, region Region, lift *annotationLiftover, logger *slog.Logger) (map[string]VariantAnnotations, error) {
+	store, err := load_annotations(filepath, cols_to_grab, nil, region_set(region), lift, 0, true, false, logger)
+	if store == nil {
+		return nil, err
+	}
+	return store.memory, err
+}
+
+// load_annotations reads the cols_to_grab columns of the annotation rows that overlap the intervals
+// into a store. The position of each row comes from the VEP Location column unless pos_cols names
+// the columns with the chromosome and the position (or the start and end), and lift converts it to
+// the build of the callset when a chain file was given. Every column has to be in the header of the
+// file unless lenient is set, in which case the missing columns are only logged and written as -.
+// If max_bytes is above 0 then the store moves the annotations to the disk once they would use more
+// memory than that. With track_positions the store also remembers the ids at each position so that
+// variants without annotations can be explained
+func load_annotations(filepath string, cols_to_grab []string, pos_cols []string, regions *intervals.Set, lift *annotationLiftover, max_bytes int64, lenient bool, track_positions bool, logger *slog.Logger) (*annotationStore, error) {
+	defer resources.StartStage("read annotations")()
 	logger.Info(fmt.Sprintf("Reading in the annotation file: %s", filepath))
-	logger.Info(fmt.Sprintf("Collecting annotations only for sites overlapping this region: %s:%d-%d", region.chrom, region.start, region.end))
-	annotations := make(map[string]VariantAnnotations)
+	logger.Info(fmt.Sprintf("Collecting annotations only for sites overlapping this region: %s", regions))
+	// The naming style of the annotations is compared to the first chromosome of the intervals
+	region_chrom := regions.Chroms()[0]
 
 	var err error
 
-	anno_fr := files.MakeCompressedFileReader(filepath, 7168*7168)
+	anno_fr := files.Open(filepath, annotationBuffersize)
 
 	if anno_fr.Err != nil {
 		anno_fr.CheckErrors()
 	}
 
-	defer func() {
-		for _, handle := range anno_fr.Handles {
-			handle.Close()
-		}
-	}()
+	defer anno_fr.Close()
 
-	header_err := anno_fr.ParseHeader("#Uploaded_variation")
+	// Curated annotation tables are often exported from Excel as CSV so the delimiter comes from the header line
+	anno_fr.AutoDelimiter = true
+	// Tables with their own coordinate columns don't have the VEP header so we look for the line
+	// with the coordinate columns instead
+	var header_err error
+	if pos_cols != nil {
+		header_err = anno_fr.ParseHeaderWithColumns(pos_cols)
+	} else {
+		header_err = anno_fr.ParseHeader("#Uploaded_variation")
+	}
 	// If there was an error while parsing the header line (or if the header line was not found) then we need to end the function early and return.
 	if header_err != nil {
 		return nil, header_err
+	} else if !anno_fr.Header_Found && pos_cols != nil {
+		return nil, fmt.Errorf("there was no header line with the columns %s in the annotation file %s. Please make sure that the --anno-pos-cols match the column names of the file", strings.Join(pos_cols, ", "), filepath)
 	} else if !anno_fr.Header_Found {
 		return nil, errors.New("there was no header line detected within the file %s, when we were looking for the phrase %s. Since this program is designed to work with VEP and this is default column header in VEP, this value is necessary for the rest of the analysis. Please make sure that this value is in the annotation file")
 	} else {
 		logger.Info(fmt.Sprintf("Mapped the indices of %d columns from the annotation file header", len(anno_fr.Header_col_indx)))
 	}
 
+	var pos_indices []int
+	for _, col := range pos_cols {
+		pos_indices = append(pos_indices, anno_fr.Header_col_indx[col])
+	}
+	// Tables with coordinate columns usually have REF and ALT columns instead of a VEP style id. In
+	// that case the id is built from the columns. Otherwise the first column has to be the id
+	var allele_indices []int
+	ref_indx, has_ref := anno_fr.Header_col_indx["REF"]
+	alt_indx, has_alt := anno_fr.Header_col_indx["ALT"]
+	if pos_cols != nil && has_ref && has_alt {
+		allele_indices = []int{ref_indx, alt_indx}
+		logger.Info("Building the variant ids of the annotations from the coordinate, REF, and ALT columns")
+	}
+	// VEP writes the same Uploaded_variation for every allele of a multi-allelic site and an id like
+	// an rsID can be shared by different variants. The Allele column tells the rows apart so that
+	// the annotations of one allele are not concatenated onto another. Ids built from the REF and
+	// ALT columns are already allele specific
+	allele_col_indx, has_allele_col := anno_fr.Header_col_indx["Allele"]
+	has_allele_col = has_allele_col && allele_indices == nil
+	// The rows of a site are next to each other so we only have to remember the alleles of the
+	// ids at the current position
+	site_pos := ""
+	site_alleles := make(map[string]string)
+	allele_collisions := 0
+
+	// These are the columns that the user wants that are actually in the file. We also keep track
+	// of their indices so that each row only has to look them up once
+	var store_cols []string
+	var col_indices []int
+	var missing_cols []string
+	for _, col := range cols_to_grab {
+		if value, ok := anno_fr.Header_col_indx[col]; ok {
+			store_cols = append(store_cols, col)
+			col_indices = append(col_indices, value)
+		} else {
+			missing_cols = append(missing_cols, col)
+		}
+	}
+	// A misspelled column used to only show up as an empty output column (or as an error about no
+	// annotations being loaded when every column was misspelled) so we name the missing columns here
+	if len(missing_cols) > 0 && !lenient {
+		return nil, fmt.Errorf("the columns %s are not in the header of the annotation file %s. Please check the spelling of the --keep-cols columns or use --lenient to write them as -", strings.Join(missing_cols, ", "), filepath)
+	}
+	for _, col := range missing_cols {
+		logger.Warn(fmt.Sprintf("The column %s is not in the header of the annotation file %s. It will be written as -", col, filepath))
+	}
+	annotations := newAnnotationStore(store_cols, max_bytes, logger)
+	if track_positions {
+		annotations.positions = make(map[string][]string)
+	}
+	row_values := make([]string, len(col_indices))
+
+	// We only need to check the naming style of the first annotation row
+	contig_checked := false
+	// If a chain file was provided then we also keep track of how many rows couldn't be lifted over
+	lift_failures := 0
+	other_chrom_rows := 0
+	var chain *liftover.Chain
+	filter_first := false
+	if lift != nil {
+		chain, filter_first = lift.chain, lift.filter_first
+	}
+	if chain != nil {
+		logger.Info(fmt.Sprintf("Lifting the annotation coordinates to the build of the callset using the chain file %s", chain.Filename))
+	}
+
 Main_Loop:
 	for anno_fr.FileScanner.Scan() {
 		cur_line := anno_fr.FileScanner.Text()
@@ -372,57 +1017,136 @@ Main_Loop:
 		// we can use a string builder to keep track of the annotation and separate the different values by a comma
 
 		// first lets see if this annotation is even in the right position. If it is not in the right position then we can just continue the loop
-		pos_str, err := retrieve_pos(cur_line, 1)
-		if err != nil {
+		// The coordinate columns can be anywhere in the row so we have to split it first
+		var split_line []string
+		var pos_str string
+		var pos_err error
+		switch {
+		case pos_indices != nil:
+			split_line = anno_fr.Split(cur_line)
+			pos_str, pos_err = columns_pos(split_line, pos_indices)
+		case anno_fr.Delimiter != files.Tab:
+			// The Location column is the second column of the VEP layout
+			split_line = anno_fr.Split(cur_line)
+			if len(split_line) > 1 {
+				pos_str = split_line[1]
+			} else {
+				pos_err = fmt.Errorf("the annotation row only has %d columns", len(split_line))
+			}
+		default:
+			pos_str, pos_err = retrieve_pos(cur_line, 1)
+		}
+		if pos_err != nil {
 			// We just skip the row if we fail to read it in
 			continue Main_Loop
 		}
-		if in_region, ok := check_region(pos_str, region.start, region.end); !in_region && ok == nil {
+		// The annotations may come from an older build so we need to convert the position before we compare it to the region
+		if chain != nil && !filter_first {
+			lifted_pos, lifted := lift_annotation_pos(pos_str, chain)
+			if !lifted {
+				lift_failures++
+				continue Main_Loop
+			}
+			pos_str = lifted_pos
+		}
+		anno_chrom, _, has_chrom := strings.Cut(pos_str, ":")
+		if has_chrom && !contig_checked {
+			if contig.DetectStyle(anno_chrom) != contig.DetectStyle(region_chrom) {
+				logger.Warn(fmt.Sprintf("The annotation file uses the chromosome name %s while the region uses the name %s. These names will be treated as the same chromosome", anno_chrom, region_chrom))
+			}
+			contig_checked = true
+		}
+		if in_region, ok := check_region(pos_str, regions); !in_region && ok == nil {
+			// We keep track of the rows on other chromosomes so that users can tell why a multi
+			// chromosome annotation file had fewer annotations than expected
+			if has_chrom && !regions.HasChrom(anno_chrom) {
+				other_chrom_rows++
+			}
 			// move on from the row if the position is incorrect
 			continue Main_Loop
 		} else if ok != nil {
-			logger.Error(fmt.Sprintf("Encountered an issue while checking if the variant %s was in the search region of %d-%d\n %s\n Skipping this variant and proceeding to the next one", pos_str, region.start, region.end, ok))
+			logger.Error(fmt.Sprintf("Encountered an issue while checking if the variant %s was in the search region of %s\n %s\n Skipping this variant and proceeding to the next one", pos_str, regions, ok))
+		}
+		// In the region mode the regions are in the build of the annotations so only the rows that
+		// matched a region are lifted back into the build of the callset
+		if chain != nil && filter_first {
+			lifted_pos, lifted := lift_annotation_pos(pos_str, chain)
+			if !lifted {
+				lift_failures++
+				continue Main_Loop
+			}
+			pos_str = lifted_pos
+		}
+		if split_line == nil {
+			split_line = anno_fr.Split(cur_line)
 		}
-		split_line := strings.Split(cur_line, "\t")
 		// we can check if there is already an annotation created for the variant and add things to it. Otherwise we can just
-		variant_annotations := annotations[split_line[0]]
-		// if the anotation is present then we can iterate over the columns and update the string.builder for each appropriate columns
-		if variant_annotations != nil {
-			for _, col := range cols_to_grab {
-				if value, ok := anno_fr.Header_col_indx[col]; ok {
-					value_str := fmt.Sprintf(";%s", split_line[value])
-					variant_annotations[col].WriteString(value_str)
-				}
+		// The key ignores the chr prefix so that IDs like chr22_123_A/G and 22_123_A/G are treated the same
+		variant_id := split_line[0]
+		if allele_indices != nil {
+			variant_id = fmt.Sprintf("%s_%s_%s/%s", split_line[pos_indices[0]], split_line[pos_indices[1]], split_line[allele_indices[0]], split_line[allele_indices[1]])
+		}
+		if has_allele_col && allele_col_indx < len(split_line) {
+			allele := split_line[allele_col_indx]
+			allele_id, resolved := allele_variant_id(variant_id, allele)
+			if pos_str != site_pos {
+				site_pos = pos_str
+				clear(site_alleles)
 			}
-			// otherwise we have to create a new map that will have a key for each column in the
-			// analysis. We can then iterate over each column and append information to the string.Builder for that key
-		} else {
-			variant_annos := make(VariantAnnotations)
-			for _, col := range cols_to_grab {
-				col_values := strings.Builder{}
-				if value, ok := anno_fr.Header_col_indx[col]; ok {
-					col_values.WriteString(split_line[value])
-					variant_annos[col] = &col_values
-				}
+			// If we can't tell which allele of the id the row is for then the first allele that we
+			// saw keeps the id and the rows of any other allele are skipped
+			if first_allele, seen := site_alleles[allele_id]; !seen {
+				site_alleles[allele_id] = allele
+			} else if first_allele != allele && !resolved {
+				allele_collisions++
+				logger.Debug(fmt.Sprintf("Skipping the annotation row of the allele %s because the id %s was already used by the allele %s", allele, variant_id, first_allele))
+				continue Main_Loop
+			}
+			variant_id = allele_id
+		}
+		if chain != nil {
+			// The position already lifted over but the alleles of an indel can't be turned around
+			// when the variant lands on the minus strand
+			lifted_id, lifted := chain.LiftVariantID(variant_id)
+			if !lifted {
+				lift_failures++
+				continue Main_Loop
 			}
-			annotations[split_line[0]] = variant_annos
+			variant_id = lifted_id
 		}
+		annotations.add_position(pos_str, variant_id)
+		variant_key := contig.VariantKey(variant_id)
+		for indx, col_indx := range col_indices {
+			row_values[indx] = split_line[col_indx]
+		}
+		if add_err := annotations.add(variant_key, row_values); add_err != nil {
+			return nil, add_err
+		}
+	}
+	if other_chrom_rows > 0 {
+		logger.Info(fmt.Sprintf("Skipped %d annotation rows that were on a different chromosome than the region", other_chrom_rows))
+	}
+	if allele_collisions > 0 {
+		logger.Warn(fmt.Sprintf("Skipped %d annotation rows whose id was already used by a different allele. Their annotations would otherwise have been combined with an unrelated variant. Use --verbose to list them", allele_collisions))
+	}
+	if lift_failures > 0 {
+		logger.Warn(fmt.Sprintf("%d annotation rows could not be lifted over with the chain file %s and were skipped", lift_failures, chain.Filename))
 	}
 	if anno_fr.FileScanner.Err() != nil {
 		err = fmt.Errorf("encountered the following error while scanner through the annotations file:\n%s", anno_fr.FileScanner.Err())
 	}
+	if finish_err := annotations.finish(); finish_err != nil {
+		return nil, finish_err
+	}
 	// If there were no annotations loaded into the map then we need to return an error and let the program terminate
-	if len(annotations) == 0 {
-		err = fmt.Errorf("there were no annotations loading into the internal annotation hashmap after processing the annotations file. This error may could be because the annotation file is empty. but is more likely that the annotation columns that the user desired to keep are not present in the file (Probably due to a spelling error). Please check your annotation file and make sure that the columns you wish to keep are present in the file and spelled the exact same way")
+	if annotations.count == 0 {
+		// The missing columns were already reported so this means that no rows were in the region
+		// or that none of the requested columns were in the file under --lenient
+		err = fmt.Errorf("there were no annotations loaded from the annotation file %s. Please make sure that the file has rows in the region %s and that at least one of the columns %s is in its header", filepath, regions, strings.Join(cols_to_grab, ", "))
 	}
 
-	func() {
-		for _, fh := range anno_fr.Handles {
-			defer fh.Close()
-		}
-	}()
-
-	logger.Info(fmt.Sprintf("Read in %d annotations from the file: %s", len(annotations), filepath))
+	resources.CountRecords("read annotations", annotations.count)
+	logger.Info(fmt.Sprintf("Read in %d annotations from the file: %s", annotations.count, filepath))
 	return annotations, err
 }
 
@@ -432,41 +1156,28 @@ func read_in_samples(samples_filepath string, logger *slog.Logger) map[string]st
 	// same order
 	sample_ids := make(map[string]string)
 
-	samples_fh, sample_err := os.Open(samples_filepath)
-
-	if sample_err != nil {
-		logger.Error(fmt.Sprintf("Encountered the following error while trying to open the file %s.\n%s\n", samples_filepath, sample_err))
+	// We are assuming that the first column is the sample id and the second column is the score
+	rows, read_err := read_samples_rows(samples_filepath)
+	if read_err != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while trying to read the file %s.\n%s\n", samples_filepath, read_err))
 		os.Exit(1)
 	}
-
-	defer samples_fh.Close()
-
-	scanner := bufio.NewScanner(samples_fh)
-
-	// this should only be a 2 column file so we should be okay with the standard buffer
-	// We are assuming that the first column is the sample id and the second column is the score
-	for scanner.Scan() {
-		line := scanner.Text()
-		split_line := strings.Split(strings.TrimSpace(line), "\t")
-
-		if len(split_line) == 1 {
-			sample_ids[split_line[0]] = ""
+	for _, row := range rows {
+		if len(row) == 1 {
+			sample_ids[row[0]] = ""
 		} else {
-			if dot_indx := strings.Index(split_line[1], "."); dot_indx != -1 {
-				trimmed_score := split_line[1][0 : dot_indx+3]
-				sample_ids[split_line[0]] = trimmed_score
-			} else {
-				sample_ids[split_line[0]] = split_line[1]
-			}
+			sample_ids[row[0]] = row[1]
 		}
 	}
-	if scanner.Err() != nil {
-		logger.Error(fmt.Sprintf("Encountered an error while scanning through the samples file:\n %s.", scanner.Err()))
-	}
 
 	logger.Info(fmt.Sprintf("Read in %d samples from the file: %s\n", len(sample_ids), samples_filepath))
 
-	return sample_ids
+	// The values are written after the sample ids so they are formatted for their type. Scores are
+	// cut to 2 decimal places and the case/control status is always 1 or 0
+	formatted, pheno := format_phenotypes("PHENOTYPE", sample_ids)
+	logger.Info(fmt.Sprintf("The second column of the file %s is a %s phenotype", samples_filepath, pheno.Type))
+
+	return formatted
 }
 
 type Region struct {
@@ -484,8 +1195,10 @@ func parse_region(region_str string) (Region, []error) {
 	var err []error
 	var region Region
 
-	if len(region_split) == 1 {
-		err = append(err, fmt.Errorf("failed to split the region string. Make sure that the region string is of the form chrX:start-end"))
+	// Anything other than the three parts (an empty string, chrX, chrX:start, or a region with
+	// extra separators like a negative start) can't be turned into a region
+	if len(region_split) != 3 {
+		err = append(err, fmt.Errorf("failed to split the region string, %s. Make sure that the region string is of the form chrX:start-end", region_str))
 	} else {
 
 		start_int, start_err := strconv.Atoi(region_split[1])
@@ -508,11 +1221,117 @@ func parse_region(region_str string) (Region, []error) {
 	return region, err
 }
 
-func PullVariants(args internal.UserArgs, logger *slog.Logger) {
-	start_time := time.Now()
+// annotationLiftover converts the annotation rows into the build of the callset. In the annotations
+// mode the position of every row is lifted before it is compared to the regions. In the region mode
+// the regions were lifted into the build of the annotations instead so the rows are compared first
+// and only the rows in the regions are lifted back with the inverted chain
+type annotationLiftover struct {
+	chain        *liftover.Chain
+	filter_first bool
+}
 
-	logger.Info(fmt.Sprintf("began the analysis at: %s\n", start_time.Format("2006-01-02@15:04:05")))
+// setup_liftover reads in the chain file if one was provided. There are two ways that we can use
+// the chain file. In the "annotations" mode the chain converts the annotation build into the callset
+// build and every annotation row is lifted. In the "region" mode the chain converts the callset build
+// into the annotation build so the region used to filter the annotations is lifted and the rows in
+// it are lifted back with the inverted chain. Either way the annotations end up in the build of the
+// callset. This function returns the region that should be used to filter the annotations and how
+// to lift the annotations
+func setup_liftover(args internal.UserArgs, region Region, logger *slog.Logger) (Region, *annotationLiftover, error) {
+	if args.ChainFile == "" {
+		return region, nil, nil
+	}
+
+	chain, chain_err := liftover.ReadChainFile(args.ChainFile, 1024*1024)
+	if chain_err != nil {
+		return region, nil, chain_err
+	}
+
+	switch args.LiftoverMode {
+	case "", "annotations":
+		return region, &annotationLiftover{chain: chain}, nil
+	case "region":
+		chrom, start, end, lift_err := chain.LiftInterval(region.chrom, region.start, region.end)
+		if lift_err != nil {
+			return region, nil, lift_err
+		}
+		lifted_region := Region{chrom: chrom, start: start, end: end}
+		logger.Info(fmt.Sprintf("Lifted the region %s:%d-%d to %s:%d-%d for filtering the annotations", region.chrom, region.start, region.end, lifted_region.chrom, lifted_region.start, lifted_region.end))
+		return lifted_region, &annotationLiftover{chain: chain.Invert(), filter_first: true}, nil
+	default:
+		return region, nil, fmt.Errorf("the liftover mode %s is not recognized. Allowed values are 'annotations' or 'region'", args.LiftoverMode)
+	}
+}
+
+// region_set turns the region into an interval set so that a single region and the intervals of a
+// regions file are checked the same way
+func region_set(region Region) *intervals.Set {
+	return intervals.New([]intervals.Interval{{Chrom: region.chrom, Start: region.start, End: region.end}})
+}
+
+// region_sets builds the intervals that the vcf records and the annotations are filtered with.
+// Without a --regions-file the annotations are filtered with the region (which setup_liftover may
+// have lifted) and the vcf records aren't filtered because bcftools already streamed the region.
+// With a --regions-file both use the intervals of the BED file
+func region_sets(args internal.UserArgs, anno_region Region, logger *slog.Logger) (*intervals.Set, *intervals.Set, error) {
+	if args.RegionsFile == "" {
+		return nil, region_set(anno_region), nil
+	}
+	// The intervals are only lifted in the annotations mode where the annotation rows are
+	// converted to the build of the callset
+	if args.ChainFile != "" && args.LiftoverMode == "region" {
+		return nil, nil, fmt.Errorf("the --regions-file can't be used with the region liftover mode. Use the annotations mode so that the annotations are lifted to the build of the regions file")
+	}
+
+	bed_intervals, bed_err := intervals.ReadBED(args.RegionsFile)
+	if bed_err != nil {
+		return nil, nil, bed_err
+	}
+	regions := intervals.New(bed_intervals)
+	logger.Info(fmt.Sprintf("Read %d intervals on %d chromosome(s) from the regions file %s", regions.Len(), len(regions.Chroms()), args.RegionsFile))
+	return regions, regions, nil
+}
+
+// pipeline_config builds the batching of the channels between the stages from --batch-size and
+// --queue-depth. Values that weren't set (like in workflow steps) use the defaults
+func pipeline_config(args internal.UserArgs) pipeline.Config {
+	config := pipeline.DefaultConfig
+	if args.BatchSize > 0 {
+		config.BatchSize = args.BatchSize
+	}
+	if args.QueueDepth > 0 {
+		config.QueueDepth = args.QueueDepth
+	}
+	return config
+}
+
+// PulledVariants holds everything that the later stages need from the pull-variants stage. The
+// Variants channel is closed once the whole vcf stream has been parsed. The pull-variants command
+// writes these variants to a file while the pipeline hands them directly to the sample variant stage
+type PulledVariants struct {
+	Samples    []string          // sample ids in the same order as the calls in VariantInfo.Calls
+	SampleStr  string            // tab separated sample ids. This value is used for the output header
+	Phenotypes map[string]string // phenotype/score for each sample id
+	AnnoCols   []string
+	InfoCols   []string
+	Metadata   *header.Metadata // the "##" lines of the vcf header
+	Classifier vcf.GenotypeClassifier
+	Variants   <-chan []VariantInfo // the variants are passed to the next stages in batches
+	Pipeline   pipeline.Config      // the batch size and queue depth for the stages that read the variants
+	wg         *sync.WaitGroup
+	rejects    *RejectTracker
+}
 
+// Wait blocks until the vcf parsing (and any writers that were added to the waitgroup) have finished.
+// The error is the malformed record that stopped the parser in strict mode
+func (pulled *PulledVariants) Wait() error {
+	pulled.wg.Wait()
+	return pulled.rejects.Err()
+}
+
+// StartPullVariants reads in the annotations, the phenotypes, and the vcf header and then starts
+// parsing the vcf stream in a goroutine. Errors during the setup terminate the program
+func StartPullVariants(args internal.UserArgs, logger *slog.Logger) *PulledVariants {
 	// parse all the arguments needs for this command
 
 	// log_filepath, _ := cmd.Flags().GetString("log-filepath")
@@ -527,11 +1346,80 @@ func PullVariants(args internal.UserArgs, logger *slog.Logger) {
 		// These issues are all worth terminating the program
 		os.Exit(1)
 	}
+	// We also need to know how the user wants the chromosome names to be written
+	contig_style, style_err := contig.ParseStyle(args.ContigStyle)
+
+	if style_err != nil {
+		logger.Error(style_err.Error())
+		os.Exit(1)
+	}
+	// If the annotations and the callset are on different builds then we need to use the chain file to lift one of them over
+	anno_region, anno_lift, lift_err := setup_liftover(args, parsed_region, logger)
+
+	if lift_err != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while setting up the liftover.\n %s", lift_err))
+		os.Exit(1)
+	}
+	// The intervals are shared by the vcf and the annotation filters
+	vcf_regions, anno_regions, regions_err := region_sets(args, anno_region, logger)
+
+	if regions_err != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while reading the regions.\n %s", regions_err))
+		os.Exit(1)
+	}
+	// Calls with a ploidy outside of this set are reported at the end of the run
+	expected_ploidy, ploidy_err := genotype.ParsePloidyList(args.ExpectedPloidy)
+
+	if ploidy_err != nil {
+		logger.Error(fmt.Sprintf("Unable to parse the expected ploidy value, %s, into a list of integers: %s", args.ExpectedPloidy, ploidy_err))
+		os.Exit(1)
+	}
+	maf_cap, threshold_err := new_maf_threshold(args.MafCap, args.MafCompare)
+	if threshold_err != nil {
+		logger.Error(threshold_err.Error())
+		os.Exit(1)
+	}
+	adaptive, adaptive_err := parse_adaptive_maf(args.AdaptiveMaf)
+
+	if adaptive_err != nil {
+		logger.Error(adaptive_err.Error())
+		os.Exit(1)
+	}
+	// The classifier decides which calls make a sample a carrier of the variant
+	classifier, classifier_err := carrier_classifier(args.Classifier, args.GenotypeClass, args.MinVAF)
+
+	if classifier_err != nil {
+		logger.Error(classifier_err.Error())
+		os.Exit(1)
+	}
 	// read in the annotations into a dictionary
 
-	anno_cols_to_keep := strings.Split(args.ColsToKeep, ",")
+	anno_cols_from_file, anno_cols_to_keep, anno_aliases, keep_err := parse_keep_cols(args.ColsToKeep)
+	if keep_err != nil {
+		logger.Error(keep_err.Error())
+		os.Exit(1)
+	}
+
+	// The MAF filter can use population frequencies from the annotations instead of the INFO AF.
+	// These columns have to be read from the annotation file even if they aren't written out
+	anno_freq, freq_err := new_annotation_frequency(args.AfColumns, args.AfMode, args.FoldAf)
 
-	anno_map, anno_err := read_annotations(args.AnnoFile, anno_cols_to_keep, parsed_region, logger)
+	if freq_err != nil {
+		logger.Error(freq_err.Error())
+		os.Exit(1)
+	}
+	anno_cols_to_read := anno_cols_from_file
+	if anno_freq != nil {
+		logger.Info(fmt.Sprintf("Filtering the variants on the %s frequency of the annotation columns %s instead of the INFO AF", anno_freq.Mode, strings.Join(anno_freq.Columns, ", ")))
+		for _, col := range anno_freq.Columns {
+			if !slices.Contains(anno_cols_to_read, col) {
+				anno_cols_to_read = append(slices.Clone(anno_cols_to_read), col)
+			}
+		}
+	}
+
+	anno_chain_sources, anno_err := open_annotation_sources(args, anno_cols_to_read, anno_regions, anno_lift, logger)
+	annotations := aliasedAnnotations{Chain: anno_chain_sources, aliases: anno_aliases}
 
 	if anno_err != nil {
 		logger.Error(fmt.Sprintf("Encountered the following error while trying to read in the annotations.\n %s", anno_err))
@@ -543,54 +1431,409 @@ func PullVariants(args internal.UserArgs, logger *slog.Logger) {
 	// ids with the phers score appended
 	sample_phenos := read_in_samples(args.PhenoFilePath, logger)
 
-	// lets read from stdin. We need to increase the buffer because the default buffer is too small for our files
-	buf := make([]byte, args.Buffersize)
-
-	buffered_vcf := bufio.NewScanner(os.Stdin)
+	// If the user selected phenotype columns then the first one is appended to the sample ids in the output header
+	if phenotypes := load_phenotype_table(args, logger); phenotypes != nil {
+		var pheno Phenotype
+		sample_phenos, pheno = format_phenotypes(phenotypes.Columns[0], phenotypes.ColumnMap(0))
+		logger.Info(fmt.Sprintf("The phenotype column %s is a %s phenotype", pheno.Name, pheno.Type))
+	}
 
-	buffered_vcf.Buffer(buf, args.Buffersize)
+	// lets read from stdin unless the user gave us the vcf file. Then we run bcftools ourselves and
+	// read its output instead
+	var vcf_stream io.Reader = files.Stdin()
+	// --samples picks the sample columns that are read so the full cohort vcf can be streamed in
+	selection, selection_err := load_sample_selection(args.Samples, args.SamplesFile)
+	if selection_err != nil {
+		logger.Error(selection_err.Error())
+		os.Exit(1)
+	}
+	var bcftools *bcftoolsInput
+	if args.VcfFile != "" {
+		started, bcftools_err := start_bcftools_input(args, parsed_region, logger)
+		if bcftools_err != nil {
+			logger.Error(bcftools_err.Error())
+			os.Exit(1)
+		}
+		bcftools = started
+		vcf_stream = started.Stdout
+	}
+	// We follow the end of the stream so that a pipe that was cut off isn't mistaken for a small result
+	vcf_input := new_vcf_input(vcf_stream, bcftools)
+	// The default buffer of a scanner is too small for the records of a large callset so unless
+	// the user set --buffersize we size it from the samples in the header
+	buffered_vcf, line_limit := files.NewLineScanner(vcf_input, args.Buffersize)
+	line_limit.Warn = func(message string) { logger.Warn(message) }
 
 	// We need to process the header row first. Ids in the sample string are in the same
 	// order as the samples but they have the phenotype information added to the string
 	// formatted as "_score"
-	samples, sample_str, header_err := process_header_ids(buffered_vcf, sample_phenos, logger)
+	stop_header := resources.StartStage("parse header")
+	samples, sample_str, metadata, header_err := process_header_ids(buffered_vcf, sample_phenos, selection, args.RestrictToPheno, logger)
+	stop_header()
 	logger.Info(fmt.Sprintf("length of samples after parsing the header: %d", len(samples)))
 	if header_err != nil {
 		logger.Error(fmt.Sprintf("%s\nTerminating programming...", header_err))
 		os.Exit(1)
 	}
+	resources.CountRecords("parse header", metadata.HeaderLines)
+
+	line_limit.SetSamples(len(samples))
+	logger.Info(fmt.Sprintf("Reading the records of the vcf with a line limit of %d bytes", line_limit.Limit))
+
+	if version, version_err := metadata.Version(); version_err != nil {
+		logger.Warn(fmt.Sprintf("Unable to determine the version of the vcf file. The file will be treated as VCFv4.2. %s", version_err))
+	} else {
+		logger.Info(fmt.Sprintf("Detected the vcf version %s from the header", version))
+	}
+
+	check_region_against_header(metadata, parsed_region, args.GenomeBuild, logger)
+
+	// Malformed records either terminate the program (--strict) or get counted and optionally written to a rejects file
+	rejects_file := ""
+	if args.WriteRejects {
+		rejects_file = fmt.Sprintf("%s.rejects", args.OutputFile)
+	}
+
+	rejects, rejects_err := NewRejectTracker(args.Strict, rejects_file, logger)
+
+	if rejects_err != nil {
+		logger.Error(rejects_err.Error())
+		os.Exit(1)
+	}
+	rejects.LineOffset = metadata.HeaderLines
+	// The variants that pass the filters without an annotation can be written with the reason that they weren't matched
+	var unannotated *UnannotatedTracker
+	if args.WriteUnannotated {
+		unannotated_regions, positions := anno_regions, map[string][]string(nil)
+		// The VEP file is the first source when there is one
+		if len(anno_chain_sources) > 0 {
+			if anno_store, is_store := anno_chain_sources[0].(*annotationStore); is_store {
+				positions = anno_store.positions
+			}
+		}
+		// With the region liftover mode the annotations were filtered in their own build but the
+		// rows were lifted back so the variants are compared to the region of the vcf
+		if args.ChainFile != "" && args.LiftoverMode == "region" {
+			unannotated_regions = region_set(parsed_region)
+		}
+		tracker, tracker_err := NewUnannotatedTracker(fmt.Sprintf("%s.unannotated", args.OutputFile), unannotated_regions, positions, logger)
+		if tracker_err != nil {
+			logger.Error(tracker_err.Error())
+			os.Exit(1)
+		}
+		unannotated = tracker
+	}
+	// These are the INFO keys that the user wants written as their own columns
+	var info_cols []string
+	if args.InfoCols != "" {
+		info_cols = strings.Split(args.InfoCols, ",")
+		for _, col := range info_cols {
+			if _, defined := metadata.Info[col]; !defined {
+				logger.Warn(fmt.Sprintf("The INFO key %s does not have a ##INFO line in the vcf header so its values will be written without being checked", col))
+			}
+		}
+	}
+
+	// --only-singletons is the same as --max-ac 1 since every written variant has at least one carrier
+	max_ac := args.MaxAC
+	if args.OnlySingletons {
+		if max_ac > 1 {
+			logger.Warn(fmt.Sprintf("--only-singletons overrides the --max-ac of %d", max_ac))
+		}
+		max_ac = 1
+	}
+	if max_ac < 0 {
+		logger.Error(fmt.Sprintf("The --max-ac has to be 0 (no limit) or larger but it was %d", max_ac))
+		os.Exit(1)
+	}
+
+	// --fold-af adds a column that says if the reference or the alternate allele is the minor allele
+	output_info_cols := info_cols
+	if args.FoldAf {
+		output_info_cols = append(slices.Clone(info_cols), minorAlleleColumn)
+	}
+	if args.CarrierVAF {
+		output_info_cols = append(slices.Clone(output_info_cols), carrierVAFColumn)
+	}
+	if args.FilterTrace {
+		output_info_cols = append(slices.Clone(output_info_cols), filterTraceColumn)
+	}
+	if args.KeepFiltered {
+		output_info_cols = append(slices.Clone(output_info_cols), filterStatusColumn)
+	}
+
 	// we then nedd to use the samples list and map this values to an index because
 	// this is the order they will be in the vcf stream
 	samples_indices := map_header_ids(samples)
+	header_samples := len(samples)
+	// The samples that weren't selected with --samples (or that have no phenotype with
+	// --restrict-to-pheno) are dropped after their columns were mapped
+	if selection != nil || args.RestrictToPheno {
+		samples = written_samples(samples, selection, sample_phenos, args.RestrictToPheno)
+		if missing := selection.Missing(); len(missing) > 0 {
+			logger.Warn(selection.missing_samples_message(missing))
+		}
+		if len(samples) == 0 {
+			logger.Error("None of the samples in the vcf header were selected with --samples or are in the phenotype file so there is nothing to write. Please check that the ids match the vcf")
+			os.Exit(1)
+		}
+		logger.Info(fmt.Sprintf("Left %d of the %d samples in the vcf header out of the output because they were not selected with --samples or do not have a phenotype", header_samples-len(samples), header_samples))
+	}
 
 	logger.Info(fmt.Sprintf("Mapped %d sample indices. Scanner error: %v", len(samples_indices), buffered_vcf.Err()))
-	logger.Info(fmt.Sprintf("Starting analysis with MafCap: %f and Region: %s", args.MafCap, args.Region))
 
-	// We also need to open the output file for writing
-	output_fh, output_err := os.Create(args.OutputFile)
+	// With --adaptive-maf the threshold comes from the frequencies of the records in the region. The
+	// records are read once to pick the threshold and the parser then reads a copy of them
+	records := buffered_vcf
+	var spool io.Closer
+	if adaptive != nil {
+		adaptive.HeaderAlleles = 2 * header_samples
+		spooled, spool_fh, spool_err := spool_spectrum(adaptive, buffered_vcf, line_limit.Limit, metadata, vcf_regions, args.FoldAf, anno_freq, annotations, logger)
+		if spool_err != nil {
+			logger.Error(spool_err.Error())
+			os.Exit(1)
+		}
+		records, spool = spooled, spool_fh
+		if threshold, picked := adaptive.Threshold(); !picked {
+			logger.Warn(fmt.Sprintf("None of the records in the region had a frequency for --adaptive-maf %s to pick a threshold from so the --maf-threshold of %g is used", adaptive.Spec, maf_cap.Cap))
+		} else {
+			if threshold > maf_cap.Cap {
+				logger.Info(fmt.Sprintf("The --adaptive-maf %s threshold of %g is above the --maf-threshold so the --maf-threshold of %g is used", adaptive.Spec, threshold, maf_cap.Cap))
+			}
+			maf_cap.Cap = min(threshold, maf_cap.Cap)
+			kept := adaptive.kept(maf_cap)
+			// The ac mode picks a threshold from the AN even if none of the records had a frequency
+			kept_percent := 0.0
+			if len(adaptive.Frequencies) > 0 {
+				kept_percent = 100 * float64(kept) / float64(len(adaptive.Frequencies))
+			}
+			// Only the annotation frequencies treat a missing frequency as rare. A record without an INFO AF fails the filter
+			unknown_fate := "are dropped because they have no INFO frequency"
+			if anno_freq != nil {
+				unknown_fate = "are kept as rare"
+			}
+			logger.Info(fmt.Sprintf("--adaptive-maf %s picked the MAF threshold %g from the frequencies of %d records. %d of them (%.1f%%) pass it (AF%s) and %d records without a frequency %s", adaptive.Spec, maf_cap.Cap, len(adaptive.Frequencies), kept, kept_percent, maf_cap, adaptive.Unknown, unknown_fate))
+		}
+	}
+	if maf_cap.Cap == 0 {
+		logger.Info("The --maf-threshold is 0 so only the novel variants (a frequency of 0) are kept")
+	}
+	logger.Info(fmt.Sprintf("Starting analysis with MafCap: AF%s and Region: %s", maf_cap, args.Region))
+
+	// lets create a batched channel and a waitgroup so we can have the parsing vcf in one goroutine and the writing in another goroutine
+	batches := pipeline_config(args)
+	logger.Debug(fmt.Sprintf("Passing the variants between the stages in batches of %d with room for %d batches in each queue", batches.BatchSize, batches.QueueDepth))
+	out := pipeline.NewEmitter[VariantInfo](batches)
+	var wg sync.WaitGroup
 
-	if output_err != nil {
-		logger.Error(fmt.Sprintf("There was an issue trying to create the output file: %s\n", args.OutputFile))
+	// The run isn't finished until we know if the whole stream arrived (and bcftools exited without
+	// an error) so there is a second count for the status of the input
+	wg.Add(2)
+	// now we can parse the vcf file. The annotations are only used by the parser so we can close
+	// them as soon as it is done
+	go func() {
+		defer wg.Done()
+		parse_vcf_file(records, maf_cap, args.FoldAf, max_ac, args.CarrierVAF, args.FilterTrace, args.KeepFiltered, anno_freq, annotations, anno_cols_to_keep, classifier, samples, samples_indices, header_samples, parsed_region, vcf_regions, expected_ploidy, contig_style, metadata, info_cols, rejects, unannotated, out, &wg, logger)
+		annotations.Close()
+		if spool != nil {
+			spool.Close()
+		}
+		// The variants that were parsed are still written but the run fails once the outputs are
+		// closed so the status ends up in the manifest
+		status := vcf_input.Finish(buffered_vcf.Err())
+		manifest.SetInput(status)
+		if !status.Complete {
+			logger.Error(fmt.Sprintf("The vcf stream from %s was incomplete so the output is incomplete too. %s", status.Source, status.Error))
+		}
+	}()
+
+	return &PulledVariants{
+		Samples:    samples,
+		Classifier: classifier,
+		SampleStr:  sample_str,
+		Phenotypes: sample_phenos,
+		AnnoCols:   anno_cols_to_keep,
+		InfoCols:   output_info_cols,
+		Metadata:   metadata,
+		Variants:   out.Stream(),
+		Pipeline:   batches,
+		wg:         &wg,
+		rejects:    rejects,
+	}
+}
+
+// skip_existing_variants drops the variants that are already in the output that we are appending to
+func skip_existing_variants(pulled *PulledVariants, variants <-chan []VariantInfo, existing map[string]bool, logger *slog.Logger) <-chan []VariantInfo {
+	filtered := pipeline.NewEmitter[VariantInfo](pulled.Pipeline)
+
+	go func() {
+		defer filtered.Close()
+		skipped := 0
+		for batch := range variants {
+			for _, variant := range batch {
+				if existing[pulled_variant_key(variant.InfoFields)] {
+					skipped++
+					continue
+				}
+				filtered.Emit(variant)
+			}
+		}
+		logger.Info(fmt.Sprintf("Skipped %d variants that were already in the output file", skipped))
+	}()
+
+	return filtered.Stream()
+}
+
+// open_append_output opens an existing output so that new variants can be added to the end of it.
+// The header of the existing file has to match the header for this run otherwise the columns of the
+// new rows wouldn't line up. The keys of the variants that are already in the file are returned so
+// that they can be skipped. A nil file is returned if there is no existing output to append to
+func open_append_output(pulled *PulledVariants, output_file string) (io.WriteCloser, map[string]bool, error) {
+	if files.IsRemoteOutput(output_file) {
+		return nil, nil, fmt.Errorf("objects in s3 or gcs can't be appended to. Write the new variants to a local file and merge them with the merge-outputs command")
+	}
+
+	if stat, stat_err := os.Stat(output_file); stat_err != nil || stat.Size() == 0 {
+		return nil, nil, nil
+	}
+
+	existing, read_err := read_pulled_table(output_file, 1024*1024)
+	if read_err != nil {
+		return nil, nil, read_err
+	}
+
+	expected_header := strings.TrimSpace(format_output_header(pulled.SampleStr, pulled.AnnoCols, pulled.InfoCols))
+	if strings.Join(existing.Header, "\t") != expected_header || !slices.Equal(existing.SampleMeta, sample_meta_lines(pulled.Samples, pulled.Phenotypes)) {
+		return nil, nil, fmt.Errorf("the header of the existing output %s does not match the header for this run. The samples, phenotypes, --keep-cols, and --info-cols need to be the same to append to an output", output_file)
+	}
+
+	keys := make(map[string]bool)
+	for _, row := range existing.Rows {
+		keys[pulled_variant_key(row)] = true
+	}
+
+	output_fh, open_err := files.Append(output_file)
+	manifest.Track(output_file)
+	if open_err != nil {
+		return nil, nil, open_err
+	}
+	return output_fh, keys, nil
+}
+
+// write_pulled_variants starts a goroutine that writes the variants to the output file. The
+// returned function closes the output file and should be called after the waitgroup finishes.
+// If append_output is true and the output file already exists then the new variants are
+// added to the end of the file and variants that are already in the file are skipped. The
+// duckdb output format writes the variants into a database with a table for the variants,
+// genotypes, and annotations. Every other format comes from the records registry
+func write_pulled_variants(pulled *PulledVariants, variants <-chan []VariantInfo, output_file string, output_format string, append_output bool, logger *slog.Logger) func() {
+	if output_format == "" {
+		output_format = "tsv"
+	}
+
+	if output_format == "duckdb" {
+		if append_output {
+			logger.Error("The --append flag can't be used with the duckdb output format")
+			os.Exit(1)
+		}
+		return write_duckdb_variants(pulled, variants, output_file, logger)
+	}
+
+	if !slices.Contains(records.Formats(), output_format) {
+		logger.Error(fmt.Sprintf("The output format %s is not recognized. Allowed values are %s, or duckdb", output_format, strings.Join(records.Formats(), ", ")))
 		os.Exit(1)
 	}
 
-	defer output_fh.Close()
+	var record_writer records.RecordWriter
 
-	writer := bufio.NewWriter(output_fh)
+	if append_output {
+		if output_format != "tsv" {
+			logger.Error(fmt.Sprintf("The --append flag can only be used with the tsv output format, not %s", output_format))
+			os.Exit(1)
+		}
+		append_fh, existing, append_err := open_append_output(pulled, output_file)
+		if append_err != nil {
+			logger.Error(fmt.Sprintf("Unable to append to the output file %s. %s", output_file, append_err))
+			os.Exit(1)
+		}
+		if append_fh != nil {
+			logger.Info(fmt.Sprintf("Appending to the output file %s which already has %d variants", output_file, len(existing)))
+			record_writer = records.NewTSV(append_fh, false)
+			variants = skip_existing_variants(pulled, variants, existing, logger)
+		}
+	}
 
-	// lets create a channel and a waitgroup so we can have the parsing vcf in one goroutine and the writing in another goroutine
-	ch := make(chan VariantInfo)
-	var wg sync.WaitGroup
+	if record_writer == nil {
+		// We also need to open the output file for writing
+		created_writer, output_err := records.Open(output_format, output_file)
+		manifest.Track(output_file)
 
-	wg.Add(1)
-	// now we can parse the vcf file
-	go parse_vcf_file(buffered_vcf, args.MafCap, anno_map, samples, samples_indices, ch, &wg, logger)
+		if output_err != nil {
+			logger.Error(fmt.Sprintf("There was an issue trying to create the output file: %s. %s\n", output_file, output_err))
+			os.Exit(1)
+		}
+		record_writer = created_writer
+	}
+
+	pulled.wg.Add(1)
 
-	wg.Add(1)
+	go writeToFile(record_writer, pulled_output_header(pulled), pulled.AnnoCols, variants, pulled.wg, logger)
 
-	go writeToFile(sample_str, anno_cols_to_keep, writer, ch, &wg, logger)
+	return func() {
+		if close_err := record_writer.Close(); close_err != nil {
+			logger.Error(fmt.Sprintf("Unable to finish writing the output file %s. %s", output_file, close_err))
+		}
+	}
+}
 
-	wg.Wait()
+// PullVariants runs the pull-variants command. The error of a --strict run is returned instead of
+// exiting so that the outputs are closed and the run manifest is still written
+func PullVariants(args internal.UserArgs, logger *slog.Logger) error {
+	start_time := time.Now()
+
+	logger.Info(fmt.Sprintf("began the analysis at: %s\n", start_time.Format("2006-01-02@15:04:05")))
+
+	// The filtered variants would be counted as differences by the validation and sent to the subscribers as qualifying variants
+	if args.KeepFiltered && (args.ValidateAgainstBcftools != "" || args.PublishTarget != "") {
+		logger.Error("--keep-filtered writes the variants that failed the filters so it can't be used with --validate-against-bcftools or --publish")
+		os.Exit(1)
+	}
+
+	// The output format is checked before the stream is read so that a build without duckdb
+	// doesn't fail after the annotations were loaded
+	if args.OutputFormat == "duckdb" {
+		if unavailable_err := duckdb_unavailable(); unavailable_err != nil {
+			logger.Error(unavailable_err.Error())
+			os.Exit(1)
+		}
+	}
+
+	pulled := StartPullVariants(args, logger)
+
+	variants := pulled.Variants
+	if args.ValidateAgainstBcftools != "" {
+		// This defer is registered first so it runs after the output has been closed
+		counted, validate := start_bcftools_validation(args, pulled, variants, logger)
+		defer validate()
+		variants = counted
+	}
+	if args.PublishTarget != "" {
+		published, close_publisher := publish_variants(pulled, variants, args.PublishTarget, logger)
+		defer close_publisher()
+		variants = published
+	}
+
+	close_output := write_pulled_variants(pulled, variants, args.OutputFile, args.OutputFormat, args.Append, logger)
+
+	defer close_output()
+
+	// The parser stops at the first malformed record with --strict. The error is only returned once
+	// the other stages have finished with the batches that were already parsed so that the deferred
+	// closes flush them to the output and the subscribers
+	if strict_err := pulled.Wait(); strict_err != nil {
+		logger.Error(fmt.Sprintf("%s. Terminating program...", strict_err))
+		return strict_err
+	}
 
 	end_time := time.Now()
 
@@ -599,4 +1842,5 @@ func PullVariants(args internal.UserArgs, logger *slog.Logger) {
 	duration := end_time.Sub(start_time)
 
 	logger.Info(fmt.Sprintf("total analysis time: %s", duration.String()))
+	return nil
 }
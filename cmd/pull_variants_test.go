@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	internal "go-phers-parser/internal"
+	"go-phers-parser/vcf"
+)
+
+func TestFoldedGenotypeClass(t *testing.T) {
+	classifier, classifier_err := carrier_classifier("quality:gq=20", "hom-alt", 0)
+	if classifier_err != nil {
+		t.Fatalf("unable to create the classifier: %s", classifier_err)
+	}
+	minor_classifier := vcf.ForMinorReference(classifier)
+
+	// With an AF above 0.5 the homozygous carriers of the minor allele are the 0/0 calls
+	calls := []string{"1/1:99", "0/1:99", "0/0:10", "0/0:40"}
+	if count := count_carriers(minor_classifier, "GT:GQ", calls); count != 1 {
+		t.Errorf("expected only the 0/0 call with a GQ of 40 to be a hom-alt carrier of the folded record but found %d carriers", count)
+	}
+	if !parse_genotype_calls(minor_classifier, "GT:GQ", calls) {
+		t.Errorf("expected the folded record to have a carrier")
+	}
+	// The same calls without folding only have the 1/1 carrier
+	if count := count_carriers(classifier, "GT:GQ", calls); count != 1 {
+		t.Errorf("expected only the 1/1 call to be a hom-alt carrier but found %d carriers", count)
+	}
+}
+
+func TestRegionLiftoverMode(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+
+	// The chain maps the callset build to the annotation build. chr22 is shifted by 100 bases and
+	// chr2 lands on the minus strand
+	chain_file := filepath.Join(dir, "callset_to_anno.over.chain")
+	os.WriteFile(chain_file, []byte("chain 1000 chr22 1000 + 100 200 chr22 1000 + 0 100 1\n100\n\nchain 1000 chr2 1000 + 0 100 chr2 1000 - 100 200 2\n100\n"), 0o644)
+	anno_file := filepath.Join(dir, "anno.txt")
+	os.WriteFile(anno_file, []byte("#Uploaded_variation\tLocation\tAllele\tConsequence\n"+
+		"22_50_A/G\t22:50\tG\tmissense_variant\n"+
+		"22_150_C/T\t22:150\tT\tintron_variant\n"+
+		"2_891_T/C\t2:891\tC\tstop_gained\n"), 0o644)
+
+	args := internal.UserArgs{ChainFile: chain_file, LiftoverMode: "region"}
+	cases := []struct {
+		region   Region
+		chrom    string
+		pos      int
+		ref      string
+		alt      string
+		expected string
+	}{
+		{Region{chrom: "chr22", start: 101, end: 200}, "chr22", 150, "A", "G", "missense_variant"},
+		// The row at 22:150 of the annotation build is outside of the lifted region
+		{Region{chrom: "chr22", start: 101, end: 200}, "chr22", 250, "C", "T", ""},
+		// The alleles of the minus strand are reverse complemented when they are lifted back
+		{Region{chrom: "chr2", start: 1, end: 100}, "chr2", 10, "A", "G", "stop_gained"},
+	}
+	for _, test_case := range cases {
+		anno_region, lift, lift_err := setup_liftover(args, test_case.region, logger)
+		if lift_err != nil {
+			t.Fatalf("unable to set up the liftover: %s", lift_err)
+		}
+		store, load_err := load_annotations(anno_file, []string{"Consequence"}, nil, region_set(anno_region), lift, 0, false, false, logger)
+		if load_err != nil {
+			t.Fatalf("unable to read the annotations: %s", load_err)
+		}
+		values, lookup_err := store.Lookup(test_case.chrom, test_case.pos, test_case.ref, test_case.alt)
+		if lookup_err != nil {
+			t.Fatalf("unable to look up the variant: %s", lookup_err)
+		}
+		if values["Consequence"] != test_case.expected {
+			t.Errorf("expected %s:%d:%s:%s of the callset build to have the annotation %q but found %v", test_case.chrom, test_case.pos, test_case.ref, test_case.alt, test_case.expected, values)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+//go:build duckdb
+
+package cmd
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"log/slog"
+	"os"
+	"strings"
+
+	_ "github.com/marcboeker/go-duckdb"
+)
+
+// format_query_value converts a value from the database into the text written in the results.
+// NULL values are written as "-" like the missing annotations in the other outputs
+func format_query_value(value any) string {
+	switch typed := value.(type) {
+	case nil:
+		return "-"
+	case []byte:
+		return string(typed)
+	default:
+		return fmt.Sprint(typed)
+	}
+}
+
+// Query runs a sql statement against a duckdb file that was written with --output-format duckdb
+// and prints the results as tab separated text so that they can be piped into other tools
+func Query(args internal.UserArgs, logger *slog.Logger) {
+	if _, stat_err := os.Stat(args.Database); stat_err != nil {
+		logger.Error(fmt.Sprintf("Unable to open the database %s. %s", args.Database, stat_err))
+		os.Exit(1)
+	}
+
+	// The database is opened read only so an ad-hoc query can't change the results of the run
+	db, open_err := sql.Open("duckdb", args.Database+"?access_mode=READ_ONLY")
+	if open_err != nil {
+		logger.Error(fmt.Sprintf("Unable to open the database %s. %s", args.Database, open_err))
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	rows, query_err := db.Query(args.Query)
+	if query_err != nil {
+		logger.Error(fmt.Sprintf("The query failed. %s", query_err))
+		os.Exit(1)
+	}
+	defer rows.Close()
+
+	columns, columns_err := rows.Columns()
+	if columns_err != nil {
+		logger.Error(columns_err.Error())
+		os.Exit(1)
+	}
+
+	writer := bufio.NewWriter(os.Stdout)
+	defer writer.Flush()
+
+	writer.WriteString(strings.Join(columns, "\t") + "\n")
+
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for indx := range values {
+		pointers[indx] = &values[indx]
+	}
+
+	row_count := 0
+	formatted := make([]string, len(columns))
+	for rows.Next() {
+		if scan_err := rows.Scan(pointers...); scan_err != nil {
+			logger.Error(fmt.Sprintf("Unable to read row %d of the results. %s", row_count+1, scan_err))
+			os.Exit(1)
+		}
+		for indx, value := range values {
+			formatted[indx] = format_query_value(value)
+		}
+		writer.WriteString(strings.Join(formatted, "\t") + "\n")
+		row_count++
+	}
+	if rows_err := rows.Err(); rows_err != nil {
+		logger.Error(fmt.Sprintf("The query failed after %d rows. %s", row_count, rows_err))
+		os.Exit(1)
+	}
+	logger.Debug(fmt.Sprintf("The query returned %d rows", row_count))
+}
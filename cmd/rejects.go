@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"io"
+	"log/slog"
+)
+
+// RejectTracker keeps track of the malformed records that we encounter while parsing the vcf
+// stream. In strict mode the first malformed record is returned as an error so that the parser
+// stops and the program terminates once the other stages have finished. In the default
+// lenient mode we count the records, log their line numbers, and (if requested) write the
+// offending lines to a rejects file so that the user can inspect them later
+type RejectTracker struct {
+	Strict     bool
+	Count      int
+	LineOffset int // number of header lines before the first record so that we can report the line number in the file
+	Filename   string
+	err        error // the malformed record that stopped the parser in strict mode
+	fh         io.WriteCloser
+	writer     *bufio.Writer
+	logger     *slog.Logger
+}
+
+// NewRejectTracker creates the tracker. If rejects_file is an empty string then the offending lines are not written anywhere
+func NewRejectTracker(strict bool, rejects_file string, logger *slog.Logger) (*RejectTracker, error) {
+	tracker := &RejectTracker{Strict: strict, Filename: rejects_file, logger: logger}
+
+	if rejects_file != "" {
+		fh, err := files.Create(rejects_file)
+		manifest.Track(rejects_file)
+		if err != nil {
+			return nil, fmt.Errorf("encountered the following error while trying to create the rejects file %s: %w", rejects_file, err)
+		}
+		tracker.fh = fh
+		tracker.writer = bufio.NewWriter(fh)
+		tracker.writer.WriteString("LINE_NUMBER\tREASON\tRECORD\n")
+	}
+	return tracker, nil
+}
+
+// Reject records a malformed line. The line_number should be the number of the record in the
+// stream after the header (the LineOffset is added to get the line number in the file). In strict
+// mode the error is returned and the parser should stop reading the stream
+func (tracker *RejectTracker) Reject(line_number int, line string, reason error) error {
+	file_line := line_number + tracker.LineOffset
+
+	if tracker.Strict {
+		tracker.err = fmt.Errorf("encountered a malformed record on line %d of the vcf stream while running in strict mode: %w", file_line, reason)
+		return tracker.err
+	}
+
+	tracker.Count++
+	tracker.logger.Warn(fmt.Sprintf("Skipping the malformed record on line %d of the vcf stream: %s", file_line, reason))
+
+	if tracker.writer != nil {
+		tracker.writer.WriteString(fmt.Sprintf("%d\t%s\t%s\n", file_line, reason, line))
+	}
+	return nil
+}
+
+// Err returns the malformed record that stopped the parser in strict mode. It should only be
+// called after the parser has finished
+func (tracker *RejectTracker) Err() error {
+	return tracker.err
+}
+
+// Close flushes the rejects file and reports how many records were rejected
+func (tracker *RejectTracker) Close() {
+	if tracker.writer != nil {
+		tracker.writer.Flush()
+		tracker.fh.Close()
+		tracker.writer = nil
+		if tracker.Count > 0 {
+			tracker.logger.Info(fmt.Sprintf("Wrote %d malformed record(s) to the file %s", tracker.Count, tracker.Filename))
+		}
+	}
+	if tracker.Count > 0 {
+		tracker.logger.Warn(fmt.Sprintf("Skipped %d malformed record(s) while parsing the vcf stream", tracker.Count))
+	}
+}
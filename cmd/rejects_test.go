@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestRejectTracker(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	reason := errors.New("the record has 10 columns")
+
+	lenient, _ := NewRejectTracker(false, "", logger)
+	if reject_err := lenient.Reject(3, "22\t100", reason); reject_err != nil || lenient.Count != 1 || lenient.Err() != nil {
+		t.Errorf("expected the lenient tracker to count the record without an error but got %v with %d rejects", reject_err, lenient.Count)
+	}
+
+	// The strict tracker returns the error to the parser instead of exiting from its goroutine
+	strict, _ := NewRejectTracker(true, "", logger)
+	strict.LineOffset = 10
+	reject_err := strict.Reject(3, "22\t100", reason)
+	if !errors.Is(reject_err, reason) || !errors.Is(strict.Err(), reason) {
+		t.Fatalf("expected the strict tracker to return the reason but got %v", reject_err)
+	}
+	if want := "encountered a malformed record on line 13 of the vcf stream while running in strict mode: the record has 10 columns"; reject_err.Error() != want {
+		t.Errorf("expected the error %q but got %q", want, reject_err)
+	}
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/pipeline"
+	"log/slog"
+	"time"
+)
+
+// RunPipeline connects the pull-variants stage to the view-sample-variants stage. The variants are
+// passed between the stages through a channel so the output of the first stage doesn't have to be
+// written to a file and read back in. If args.KeepIntermediate is true then the variants from the
+// first stage are also written to args.OutputFile. The error of a --strict run is returned so that
+// the outputs are closed before the program exits
+func RunPipeline(args internal.UserArgs, logger *slog.Logger) error {
+	logger.Info(fmt.Sprintf("Reading in annotations for the region %s and pulling variants for the samples in the samples file, %s\n", args.Region, args.PhenoFilePath))
+
+	pull_start := time.Now()
+
+	pulled := StartPullVariants(args, logger)
+
+	sample_stage_variants := pulled.Variants
+
+	if args.ValidateAgainstBcftools != "" {
+		// This defer is registered first so it runs after the outputs have been closed
+		counted, validate := start_bcftools_validation(args, pulled, sample_stage_variants, logger)
+		defer validate()
+		sample_stage_variants = counted
+	}
+
+	if args.PublishTarget != "" {
+		published, close_publisher := publish_variants(pulled, sample_stage_variants, args.PublishTarget, logger)
+		defer close_publisher()
+		sample_stage_variants = published
+	}
+
+	if args.KeepIntermediate {
+		logger.Info(fmt.Sprintf("Writing the output of step 1 to %s", args.OutputFile))
+
+		// Both stages read the same batches so that the variants only have to be parsed once
+		streams := pipeline.Tee(sample_stage_variants, pulled.Pipeline, 2)
+
+		close_output := write_pulled_variants(pulled, streams[0], args.OutputFile, args.OutputFormat, args.Append, logger)
+		defer close_output()
+
+		sample_stage_variants = streams[1]
+	}
+
+	logger.Info(fmt.Sprintf("Writing the output of step 2 to %s", args.OutputFilepath))
+
+	FindSampleVariantsFromStream(args, pulled, sample_stage_variants, logger)
+
+	if strict_err := pulled.Wait(); strict_err != nil {
+		logger.Error(fmt.Sprintf("%s. Terminating program...", strict_err))
+		return strict_err
+	}
+
+	logger.Info(fmt.Sprintf("both stages of the pipeline finished in %s", time.Since(pull_start).String()))
+	return nil
+}
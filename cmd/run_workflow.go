@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/workflow"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// These are the subcommands that can be used as steps in a workflow file
+var workflowCommands = []string{"pull-variants", "view-sample-variants", "find-all-carriers"}
+
+// apply_step_params copies the parameters of a workflow step onto the UserArgs. The parameter
+// names are the same as the command line flags. Unknown parameters are an error so that typos
+// in the workflow file don't get silently ignored
+func apply_step_params(args *internal.UserArgs, params map[string]string) error {
+	for key, value := range params {
+		var conv_err error
+		switch key {
+		case "anno-file":
+			args.AnnoFile = value
+		case "keep-cols":
+			args.ColsToKeep = value
+		case "anno-source":
+			args.AnnoSources = strings.Split(value, ",")
+		case "pheno-file":
+			args.PhenoFilePath = value
+		case "pheno-cols":
+			args.PhenoCols = value
+		case "covariate-file":
+			args.CovariateFile = value
+		case "covariate-cols":
+			args.CovariateCols = value
+		case "strata-cols":
+			args.StrataCols = value
+		case "variant-tiers":
+			args.VariantTiers, conv_err = strconv.ParseBool(value)
+		case "loftee-col":
+			args.LofteeCol = value
+		case "lof-hc-only":
+			args.LofHCOnly, conv_err = strconv.ParseBool(value)
+		case "gene-col":
+			args.GeneCol = value
+		case "tier-freq-col":
+			args.TierFreqCol = value
+		case "score-quantile":
+			args.ScoreQuantile, conv_err = strconv.ParseFloat(value, 64)
+		case "region":
+			args.Region = value
+		case "maf-threshold":
+			args.MafCap, conv_err = strconv.ParseFloat(value, 64)
+		case "maf-compare":
+			args.MafCompare = value
+		case "adaptive-maf":
+			args.AdaptiveMaf = value
+		case "buffersize":
+			args.Buffersize, conv_err = strconv.Atoi(value)
+		case "contig-style":
+			args.ContigStyle = value
+		case "chain-file":
+			args.ChainFile = value
+		case "liftover-mode":
+			args.LiftoverMode = value
+		case "genome-build":
+			args.GenomeBuild = value
+		case "strict":
+			args.Strict, conv_err = strconv.ParseBool(value)
+		case "write-rejects":
+			args.WriteRejects, conv_err = strconv.ParseBool(value)
+		case "write-unannotated":
+			args.WriteUnannotated, conv_err = strconv.ParseBool(value)
+		case "info-cols":
+			args.InfoCols = value
+		case "expected-ploidy":
+			args.ExpectedPloidy = value
+		case "carrier-classifier":
+			args.Classifier = value
+		case "genotype-class":
+			args.GenotypeClass = value
+		case "min-vaf":
+			args.MinVAF, conv_err = strconv.ParseFloat(value, 64)
+		case "carrier-vaf":
+			args.CarrierVAF, conv_err = strconv.ParseBool(value)
+		case "filter-trace":
+			args.FilterTrace, conv_err = strconv.ParseBool(value)
+		case "calls-file":
+			args.CallsFile = value
+		case "clinvar-col":
+			args.ClinvarColumnName = value
+		case "consequence-col":
+			args.ConsequenceCol = value
+		case "append":
+			args.Append, conv_err = strconv.ParseBool(value)
+		case "publish":
+			args.PublishTarget = value
+		case "output-format":
+			args.OutputFormat = value
+		case "batch-size":
+			args.BatchSize, conv_err = strconv.Atoi(value)
+		case "queue-depth":
+			args.QueueDepth, conv_err = strconv.Atoi(value)
+		case "validate-against-bcftools":
+			args.ValidateAgainstBcftools = value
+		case "vcf-file":
+			args.VcfFile = value
+		case "bcftools-path":
+			args.BcftoolsPath = value
+		case "samples":
+			args.Samples = value
+		case "samples-file":
+			args.SamplesFile = value
+		case "max-memory":
+			args.MaxMemory = value
+		case "lenient":
+			args.Lenient, conv_err = strconv.ParseBool(value)
+		case "regions-file":
+			args.RegionsFile = value
+		case "anno-pos-cols":
+			args.AnnoPosCols = value
+		case "af-columns":
+			args.AfColumns = value
+		case "af-mode":
+			args.AfMode = value
+		case "fold-af":
+			args.FoldAf, conv_err = strconv.ParseBool(value)
+		case "max-ac":
+			args.MaxAC, conv_err = strconv.Atoi(value)
+		case "only-singletons":
+			args.OnlySingletons, conv_err = strconv.ParseBool(value)
+		case "restrict-to-pheno":
+			args.RestrictToPheno, conv_err = strconv.ParseBool(value)
+		case "sample-exclusion-string":
+			args.SampleExclusion = value
+		case "counts-only":
+			args.CountsOnly, conv_err = strconv.ParseBool(value)
+		case "max-carriers-listed":
+			args.MaxCarriersListed, conv_err = strconv.Atoi(value)
+		default:
+			return fmt.Errorf("the parameter %s is not recognized", key)
+		}
+		if conv_err != nil {
+			return fmt.Errorf("unable to convert the value %s of the parameter %s: %w", value, key, conv_err)
+		}
+	}
+	return nil
+}
+
+// RunWorkflow runs the steps from the workflow file in order. The base args have the values of
+// the global flags (such as the buffersize) which each step can override. Only one step can read
+// the vcf from standard input because the stream can't be rewound
+func RunWorkflow(workflow_file string, base internal.UserArgs, logger *slog.Logger) {
+	wf, read_err := workflow.ReadWorkflow(workflow_file)
+	if read_err != nil {
+		logger.Error(read_err.Error())
+		os.Exit(1)
+	}
+
+	default_prefix := strings.TrimSuffix(base.OutputFile, filepath.Ext(base.OutputFile))
+
+	steps, resolve_err := wf.Resolve(default_prefix)
+	if resolve_err != nil {
+		logger.Error(resolve_err.Error())
+		os.Exit(1)
+	}
+
+	// We validate every step before running anything so that a typo in the last step doesn't waste a long run
+	stdin_steps := 0
+	step_args := make([]internal.UserArgs, len(steps))
+	for indx, step := range steps {
+		if !slices.Contains(workflowCommands, step.Command) {
+			logger.Error(fmt.Sprintf("The step %s uses the command %s which can't be used in a workflow. Allowed commands are: %s", step.Name, step.Command, strings.Join(workflowCommands, ", ")))
+			os.Exit(1)
+		}
+
+		step_args[indx] = base
+		if param_err := apply_step_params(&step_args[indx], step.Params); param_err != nil {
+			logger.Error(fmt.Sprintf("Encountered the following error in the parameters of the step %s: %s", step.Name, param_err))
+			os.Exit(1)
+		}
+		step_args[indx].OutputFile = step.Output
+		step_args[indx].OutputFilepath = step.Output
+
+		if step.Command != "view-sample-variants" || step_args[indx].CallsFile == "-" {
+			stdin_steps++
+		}
+	}
+
+	if stdin_steps > 1 {
+		logger.Error(fmt.Sprintf("%d steps of the workflow read from standard input but only one step can read the vcf stream", stdin_steps))
+		os.Exit(1)
+	}
+
+	for indx, step := range steps {
+		logger.Info(fmt.Sprintf("Running step %d of %d: %s (%s). Writing the output to %s", indx+1, len(steps), step.Name, step.Command, step.Output))
+
+		switch step.Command {
+		case "pull-variants":
+			if pull_err := PullVariants(step_args[indx], logger); pull_err != nil {
+				logger.Error(fmt.Sprintf("Step %d of the workflow (%s) failed", indx+1, step.Name))
+				os.Exit(1)
+			}
+		case "view-sample-variants":
+			FindSampleVariants(step_args[indx], logger)
+		case "find-all-carriers":
+			FindAllCarrierCalls(step.Output, step_args[indx].Buffersize, step_args[indx].SampleExclusion, step_args[indx].ExpectedPloidy, step_args[indx].Classifier, step_args[indx].GenotypeClass, step_args[indx].MinVAF, step_args[indx].CountsOnly, step_args[indx].MaxCarriersListed, step_args[indx].Samples, step_args[indx].SamplesFile)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"testing"
+
+	"go-phers-parser/internal"
+)
+
+func TestApplyStepParams(t *testing.T) {
+	// The base is the values from the command line of run-pipeline
+	base := internal.UserArgs{
+		MafCap:       0.05,
+		MafCompare:   "strict",
+		AdaptiveMaf:  "gnomAD_AF",
+		ContigStyle:  "ucsc",
+		LiftoverMode: "variants",
+	}
+
+	step_args := base
+	if apply_err := apply_step_params(&step_args, map[string]string{"maf-threshold": "0.001", "contig-style": "ensembl"}); apply_err != nil {
+		t.Fatalf("unable to apply the step params: %s", apply_err)
+	}
+
+	if step_args.MafCap != 0.001 || step_args.ContigStyle != "ensembl" {
+		t.Errorf("expected the step params to override the command line but found maf-threshold=%g and contig-style=%s", step_args.MafCap, step_args.ContigStyle)
+	}
+	if step_args.MafCompare != "strict" || step_args.AdaptiveMaf != "gnomAD_AF" || step_args.LiftoverMode != "variants" {
+		t.Errorf("expected the values that the step doesn't set to come from the command line but found %+v", step_args)
+	}
+	if base.MafCap != 0.05 {
+		t.Errorf("expected the base args to be left alone but found maf-threshold=%g", base.MafCap)
+	}
+
+	if apply_err := apply_step_params(&step_args, map[string]string{"maf-threshold": "rare"}); apply_err == nil {
+		t.Errorf("expected an unparseable maf-threshold to be rejected")
+	}
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go-phers-parser/internal/pseudonym"
+)
+
+// sampleMetaPrefix starts the lines of the pull-variants output that map each sample column to
+// its phenotype. The lines look like ##SAMPLE=<ID=column,Phenotype=value> and come before the
+// #CHROM line. Older outputs appended the phenotype to the column name instead (ID_score)
+const sampleMetaPrefix = "##SAMPLE=<"
+
+// sampleSeparator separates the sample id from the phenotype in the columns of outputs that were
+// written before the ##SAMPLE lines. --sample-separator changes it for outputs that used something else
+var sampleSeparator = "_"
+
+// SetSampleSeparator sets the separator between the sample id and the phenotype of the sample
+// columns in older outputs. An empty value keeps the current separator
+func SetSampleSeparator(value string) {
+	if value != "" {
+		sampleSeparator = value
+	}
+}
+
+// split_sample_column splits a sample column of an older output into the sample id and the
+// phenotype. The phenotype comes after the last separator because the ids can have the separator
+// in them (GRIDs like R123_456) while the phenotypes can't. The bool is false if there is no separator
+func split_sample_column(column string) (string, string, bool) {
+	indx := strings.LastIndex(column, sampleSeparator)
+	if indx == -1 {
+		return column, "", false
+	}
+	return column[:indx], column[indx+len(sampleSeparator):], true
+}
+
+// sampleMetaEscaper percent encodes the characters that would break up the fields of a ##SAMPLE line
+var sampleMetaEscaper = strings.NewReplacer("%", "%25", ",", "%2C", "=", "%3D", ">", "%3E", "\t", "%09", "\n", "%0A", "\r", "%0D")
+
+// sample_meta_lines builds the ##SAMPLE lines for the samples of the output. The columns use the
+// hashed ids if --hash-ids was given. Samples without a phenotype don't get a Phenotype field
+func sample_meta_lines(samples []string, phenotypes map[string]string) []string {
+	lines := make([]string, 0, len(samples))
+	for _, sample_id := range samples {
+		line := sampleMetaPrefix + "ID=" + sampleMetaEscaper.Replace(pseudonym.ID(sample_id))
+		if value := phenotypes[sample_id]; value != "" {
+			line += ",Phenotype=" + sampleMetaEscaper.Replace(value)
+		}
+		lines = append(lines, line+">")
+	}
+	return lines
+}
+
+// parse_sample_meta reads the ##SAMPLE lines from the meta lines of an output and returns the
+// phenotype of each sample column. A nil map means that the output doesn't have the lines and the
+// phenotypes are still appended to the column names
+func parse_sample_meta(lines []string) (map[string]string, error) {
+	var phenotypes map[string]string
+	for _, line := range lines {
+		fields, found := strings.CutPrefix(strings.TrimSpace(line), sampleMetaPrefix)
+		if !found {
+			continue
+		}
+		fields, closed := strings.CutSuffix(fields, ">")
+		if !closed {
+			return nil, fmt.Errorf("the sample metadata line %s is missing the closing >", line)
+		}
+
+		var column, phenotype string
+		for _, field := range strings.Split(fields, ",") {
+			key, value, _ := strings.Cut(field, "=")
+			decoded, decode_err := url.PathUnescape(value)
+			if decode_err != nil {
+				return nil, fmt.Errorf("unable to decode the value %s in the sample metadata line %s: %w", value, line, decode_err)
+			}
+			switch key {
+			case "ID":
+				column = decoded
+			case "Phenotype":
+				phenotype = decoded
+			}
+		}
+		if column == "" {
+			return nil, fmt.Errorf("the sample metadata line %s doesn't have an ID", line)
+		}
+		if phenotypes == nil {
+			phenotypes = make(map[string]string)
+		}
+		phenotypes[column] = phenotype
+	}
+	return phenotypes, nil
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"io"
+	"log/slog"
+	"maps"
+	"testing"
+)
+
+func TestSampleMetaRoundTrip(t *testing.T) {
+	samples := []string{"S_1", "S2", "S3"}
+	phenotypes := map[string]string{"S_1": "1", "S2": "EUR,non=fin>", "S3": ""}
+
+	lines := sample_meta_lines(samples, phenotypes)
+	if lines[0] != "##SAMPLE=<ID=S_1,Phenotype=1>" || lines[2] != "##SAMPLE=<ID=S3>" {
+		t.Errorf("unexpected sample lines: %q", lines)
+	}
+
+	parsed, parse_err := parse_sample_meta(append([]string{"##fileformat=VCFv4.2"}, lines...))
+	if parse_err != nil {
+		t.Fatalf("unexpected error: %s", parse_err)
+	}
+	if !maps.Equal(parsed, phenotypes) {
+		t.Errorf("read back the phenotypes %v but expected %v", parsed, phenotypes)
+	}
+
+	if parsed, _ := parse_sample_meta([]string{"##fileformat=VCFv4.2"}); parsed != nil {
+		t.Errorf("an output without ##SAMPLE lines should give a nil map but got %v", parsed)
+	}
+	if _, parse_err := parse_sample_meta([]string{"##SAMPLE=<ID=S1"}); parse_err == nil {
+		t.Errorf("expected an error for a line without the closing >")
+	}
+}
+
+func TestGetSampleColIndices(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	samples := []string{"R123_456", "R789", "R1_2_3"}
+	scores := func(mapped []SampleID) map[string]string {
+		found := make(map[string]string)
+		for _, sample := range mapped {
+			found[sample.SampleID] = sample.Score
+		}
+		return found
+	}
+
+	// Older outputs have the phenotype after the last underscore. A column that is already a full id has no phenotype
+	legacy := map[string]int{"#CHROM": 0, "R123_456_1": 9, "R789_0.25": 10, "R1_2_3": 11, "CLIN_SIG": 12}
+	expected := map[string]string{"R123_456": "1", "R789": "0.25", "R1_2_3": ""}
+	if found := scores(get_sample_col_indices(legacy, nil, samples, logger)); !maps.Equal(found, expected) {
+		t.Errorf("mapped the legacy columns to %v but expected %v", found, expected)
+	}
+
+	// With the ##SAMPLE lines the columns are the full ids
+	header := map[string]int{"#CHROM": 0, "R123_456": 9, "R789": 10, "R1_2_3": 11, "CLIN_SIG": 12}
+	meta := map[string]string{"R123_456": "1", "R789": "0", "R1_2_3": "EUR"}
+	if found := scores(get_sample_col_indices(header, meta, samples, logger)); !maps.Equal(found, meta) {
+		t.Errorf("mapped the columns to %v but expected %v", found, meta)
+	}
+}
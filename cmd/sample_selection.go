@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// sampleSelection is the samples that were picked with --samples or --samples-file. Only the
+// columns of these samples are read from the records so the tool can run on the full cohort vcf.
+// Like bcftools, a list that starts with ^ picks every sample except the ones in the list
+type sampleSelection struct {
+	ids     map[string]bool
+	exclude bool
+	found   map[string]bool // the ids that were seen in the vcf header
+}
+
+// load_sample_selection reads the comma separated --samples or the --samples-file (one sample per
+// line in the format of bcftools view -S). A nil selection keeps every sample
+func load_sample_selection(samples string, samples_file string) (*sampleSelection, error) {
+	if samples != "" && samples_file != "" {
+		return nil, fmt.Errorf("only one of --samples and --samples-file can be used")
+	}
+	var ids []string
+	exclude := false
+	switch {
+	case samples != "":
+		exclude = strings.HasPrefix(samples, "^")
+		for _, id := range strings.Split(strings.TrimPrefix(samples, "^"), ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	case samples_file != "":
+		read_ids, excluded, read_err := read_bcftools_samples(samples_file)
+		if read_err != nil {
+			return nil, fmt.Errorf("unable to read the samples file %s: %w", samples_file, read_err)
+		}
+		ids, exclude = read_ids, excluded
+	default:
+		return nil, nil
+	}
+	if len(ids) == 0 && !exclude {
+		return nil, fmt.Errorf("no sample ids were given to --samples or found in the --samples-file")
+	}
+
+	selection := &sampleSelection{ids: make(map[string]bool, len(ids)), exclude: exclude, found: make(map[string]bool)}
+	for _, id := range ids {
+		selection.ids[id] = true
+	}
+	return selection, nil
+}
+
+// Keep reports if the column of the sample should be read. It is safe to call on a nil selection
+func (selection *sampleSelection) Keep(sample_id string) bool {
+	if selection == nil {
+		return true
+	}
+	if selection.ids[sample_id] {
+		selection.found[sample_id] = true
+	}
+	return selection.ids[sample_id] != selection.exclude
+}
+
+// Filter returns the function for VCFReader.SampleFilter. A nil selection doesn't filter
+func (selection *sampleSelection) Filter() func(string) bool {
+	if selection == nil {
+		return nil
+	}
+	return selection.Keep
+}
+
+// Missing returns the selected samples that weren't in the vcf header. It is called once the header was read
+func (selection *sampleSelection) Missing() []string {
+	if selection == nil {
+		return nil
+	}
+	var missing []string
+	for id := range selection.ids {
+		if !selection.found[id] {
+			missing = append(missing, id)
+		}
+	}
+	slices.Sort(missing)
+	return missing
+}
+
+// missing_samples_message describes the selected samples that weren't in the vcf header
+func (selection *sampleSelection) missing_samples_message(missing []string) string {
+	return fmt.Sprintf("%d of the %d samples given to --samples or --samples-file are not in the vcf header. The first ones are %s", len(missing), len(selection.ids), example_ids(missing))
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func write_samples_file(t *testing.T, contents string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "samples.txt")
+	if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatalf("unable to write the samples file: %s", err)
+	}
+	return filename
+}
+
+func TestIsSamplesHeader(t *testing.T) {
+	cases := []struct {
+		rows   [][]string
+		header bool
+	}{
+		{[][]string{{"GRID", "Status"}, {"S1", "1"}}, true},
+		{[][]string{{"IID", "score"}, {"S1", "0.5"}}, true},
+		{[][]string{{"iid"}, {"S1"}}, true},
+		{[][]string{{"#sample_id", "pheno"}}, true},
+		{[][]string{{"S1", "Status"}, {"S2", "case"}, {"S3", "control"}}, true},
+		{[][]string{{"S1", "1"}, {"S2", "0"}}, false},
+		{[][]string{{"S1", "0.25"}}, false},
+		{[][]string{{"S1", "NA"}, {"S2", "1"}}, false},
+		{[][]string{{"S1", "case"}, {"S2", "control"}}, false},
+		{[][]string{{"S1"}}, false},
+		{[][]string{{"GRID123", "1"}}, false},
+		// A categorical phenotype has labels in every row so the first row is a sample
+		{[][]string{{"S1", "EUR"}, {"S2", "AFR"}}, false},
+		{nil, false},
+	}
+	for _, test_case := range cases {
+		if header := is_samples_header(test_case.rows); header != test_case.header {
+			t.Errorf("is_samples_header(%q) = %t but expected %t", test_case.rows, header, test_case.header)
+		}
+	}
+}
+
+func TestReadSamplesFile(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cases := []struct {
+		name     string
+		contents string
+		samples  []string
+	}{
+		{"no header", "S1\t1\nS2\t0\n", []string{"S1", "S2"}},
+		{"grid header", "GRID\tStatus\nS1\t1\nS2\t0\n", []string{"S1", "S2"}},
+		{"iid header", "IID\tscore\nS1\t0.5\n", []string{"S1"}},
+		{"lowercase keyword", "iid\nS1\nS2\n", []string{"S1", "S2"}},
+		{"non-numeric second column", "person\tphenotype\nS1\t1\n", []string{"S1"}},
+		// Ids with a keyword in them are samples. Only the first line can be a header
+		{"keyword inside an id", "S1\t1\nGRID42\t0\nsample_7\t1\n", []string{"S1", "GRID42", "sample_7"}},
+		{"categorical phenotype", "S1\tEUR\nS2\tAFR\n", []string{"S1", "S2"}},
+		{"windows line endings", "\xef\xbb\xbfIID,status\r\nS1,1\r\nS2,0\r\n", []string{"S1", "S2"}},
+	}
+	for _, test_case := range cases {
+		t.Run(test_case.name, func(t *testing.T) {
+			samples, errs := read_samples_file(write_samples_file(t, test_case.contents), logger)
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			if !slices.Equal(samples, test_case.samples) {
+				t.Errorf("read the samples %q but expected %q", samples, test_case.samples)
+			}
+		})
+	}
+}
+
+func TestReadInSamplesSkipsHeader(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	samples := read_in_samples(write_samples_file(t, "ID\tscore\nS1\t0.123\nS2\t1\n"), logger)
+	if _, found := samples["ID"]; found {
+		t.Errorf("the header line was read in as a sample: %v", samples)
+	}
+	if samples["S1"] != "0.12" || samples["S2"] != "1" {
+		t.Errorf("unexpected scores: %v", samples)
+	}
+}
+
+func TestSetHeaderKeywords(t *testing.T) {
+	defaults := slices.Clone(headerKeywords)
+	t.Cleanup(func() { headerKeywords = defaults })
+
+	SetHeaderKeywords(" Subject , ")
+	if !is_samples_header([][]string{{"SUBJECT", "1"}}) {
+		t.Errorf("the keyword Subject was not used to find the header")
+	}
+	if is_samples_header([][]string{{"GRID", "1"}}) {
+		t.Errorf("the default keywords should be replaced by --header-keywords")
+	}
+
+	SetHeaderKeywords("")
+	if !slices.Equal(headerKeywords, []string{"subject"}) {
+		t.Errorf("an empty value should keep the current keywords but got %q", headerKeywords)
+	}
+}
+
+func TestReadBcftoolsSamples(t *testing.T) {
+	// bcftools samples files have no header and can rename the samples in a second column
+	filename := write_samples_file(t, "S1\nS2 renamed\n\nS3\n")
+
+	samples, exclude, read_err := read_bcftools_samples(filename)
+	if read_err != nil || exclude || !slices.Equal(samples, []string{"S1", "S2", "S3"}) {
+		t.Errorf("read %q with exclude=%t and the error %v", samples, exclude, read_err)
+	}
+	if _, exclude, read_err := read_bcftools_samples("^" + filename); read_err != nil || !exclude {
+		t.Errorf("expected ^ to exclude the samples but got exclude=%t and the error %v", exclude, read_err)
+	}
+}
+
+func TestSampleMembership(t *testing.T) {
+	membership := &sampleMembership{sources: make(map[string]int)}
+	for _, id := range []string{"S1", "S2"} {
+		membership.add(id, inPhenoFile)
+	}
+	for _, id := range []string{"S3", "S1", "S2"} {
+		membership.add(id, inVcfHeader)
+	}
+
+	// The ids keep the order that they were first seen in
+	no_pheno := membership.select_ids(func(sources int) bool { return sources&inPhenoFile == 0 })
+	both := membership.select_ids(func(sources int) bool { return sources == inPhenoFile|inVcfHeader })
+	if !slices.Equal(no_pheno, []string{"S3"}) || !slices.Equal(both, []string{"S1", "S2"}) {
+		t.Errorf("found %q without a phenotype and %q in both files", no_pheno, both)
+	}
+}
+
+func TestSampleSelection(t *testing.T) {
+	// Without --samples every sample is kept
+	if selection, load_err := load_sample_selection("", ""); selection != nil || load_err != nil || !selection.Keep("S1") {
+		t.Errorf("expected a nil selection that keeps every sample but got %v and the error %v", selection, load_err)
+	}
+	if _, load_err := load_sample_selection("S1", write_samples_file(t, "S1\n")); load_err == nil {
+		t.Error("expected an error when both --samples and --samples-file are given")
+	}
+
+	selection, load_err := load_sample_selection("S1, S3,S9", "")
+	if load_err != nil {
+		t.Fatalf("unexpected error: %s", load_err)
+	}
+	var kept []string
+	for _, id := range []string{"S1", "S2", "S3"} {
+		if selection.Keep(id) {
+			kept = append(kept, id)
+		}
+	}
+	if !slices.Equal(kept, []string{"S1", "S3"}) || !slices.Equal(selection.Missing(), []string{"S9"}) {
+		t.Errorf("kept %q and found %q missing from the header", kept, selection.Missing())
+	}
+
+	// A list that starts with ^ keeps every sample except the ones in the list
+	excluded, _ := load_sample_selection("", "^"+write_samples_file(t, "S2\n"))
+	if !excluded.Keep("S1") || excluded.Keep("S2") {
+		t.Error("expected ^ to keep every sample except S2")
+	}
+}
@@ -0,0 +1,284 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/genotype"
+	"go-phers-parser/internal/header"
+	"go-phers-parser/internal/pseudonym"
+	"go-phers-parser/internal/tabix"
+	"go-phers-parser/vcf"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CarrierCall is a sample with a non reference call for a variant
+type CarrierCall struct {
+	Sample   string `json:"sample"`
+	Genotype string `json:"genotype"`
+}
+
+// ServedVariant is the json representation of a variant returned by the server
+type ServedVariant struct {
+	Chrom          string            `json:"chrom"`
+	Pos            int               `json:"pos"`
+	ID             string            `json:"id"`
+	Ref            string            `json:"ref"`
+	Alt            string            `json:"alt"`
+	Filter         string            `json:"filter"`
+	GenotypeCounts map[string]int    `json:"genotype_counts,omitempty"`
+	Carriers       []CarrierCall     `json:"carriers,omitempty"`
+	Genotype       string            `json:"genotype,omitempty"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+	Info           map[string]string `json:"info,omitempty"`
+}
+
+// VariantServer answers carrier queries from a tabix indexed vcf. The annotations are read in
+// one chromosome at a time the first time that the chromosome is queried and then kept in memory
+type VariantServer struct {
+	VcfFile     string
+	Index       *tabix.Index
+	Metadata    header.Metadata
+	Samples     []string         // sample ids in the order of the vcf columns
+	SampleIndex *vcf.SampleIndex // position of each sample in Samples
+	AnnoFile    string
+	AnnoCols    []string
+	Buffersize  int
+	logger      *slog.Logger
+
+	anno_mu    sync.Mutex
+	anno_cache map[string]map[string]VariantAnnotations // keyed by the canonical chromosome name
+}
+
+// NewVariantServer reads the header and the tabix index of the vcf
+func NewVariantServer(args internal.UserArgs, logger *slog.Logger) (*VariantServer, error) {
+	vcf_reader := &files.VCFReader{FileReader: *files.Open(args.VcfFile, args.Buffersize)}
+	defer vcf_reader.Close()
+	if vcf_reader.Err != nil {
+		return nil, vcf_reader.Err
+	}
+	if vcf_reader.Format != files.BGZF || vcf_reader.Index == "" {
+		return nil, fmt.Errorf("the serve command needs a bgzipped vcf with a tabix index but %s is %s and the index was not found at %s.tbi", args.VcfFile, vcf_reader.Format, args.VcfFile)
+	}
+	index, index_err := tabix.ReadIndex(vcf_reader.Index)
+	if index_err != nil {
+		return nil, fmt.Errorf("the serve command needs a bgzipped vcf with a tabix index. %w", index_err)
+	}
+	if header_err := vcf_reader.ParseHeader("#CHROM"); header_err != nil || !vcf_reader.Header_Found {
+		return nil, fmt.Errorf("unable to find the #CHROM header line in the vcf file %s. %v", args.VcfFile, header_err)
+	}
+
+	server := &VariantServer{
+		VcfFile:    args.VcfFile,
+		Index:      index,
+		Metadata:   vcf_reader.Metadata,
+		AnnoFile:   args.AnnoFile,
+		Buffersize: vcf_reader.Lines.Limit, // every query starts a new scanner with the limit from the header
+		logger:     logger,
+		anno_cache: make(map[string]map[string]VariantAnnotations),
+	}
+	for col_indx := 9; col_indx < vcf_reader.Col_count; col_indx++ {
+		server.Samples = append(server.Samples, vcf_reader.SampleMapping[col_indx])
+	}
+	server.SampleIndex = vcf.NewSampleIndex(server.Samples)
+	if args.ColsToKeep != "" {
+		server.AnnoCols = strings.Split(args.ColsToKeep, ",")
+	}
+	return server, nil
+}
+
+// annotations returns the annotations for the chromosome. The whole chromosome is read in so
+// that later queries on the same chromosome don't have to read the annotation file again
+func (server *VariantServer) annotations(chrom string) (map[string]VariantAnnotations, error) {
+	if server.AnnoFile == "" {
+		return nil, nil
+	}
+
+	server.anno_mu.Lock()
+	defer server.anno_mu.Unlock()
+
+	if cached, found := server.anno_cache[contig.Canonical(chrom)]; found {
+		return cached, nil
+	}
+
+	anno_map, anno_err := read_annotations(server.AnnoFile, server.AnnoCols, Region{chrom: chrom, start: 1, end: math.MaxInt}, nil, server.logger)
+	if anno_err != nil {
+		return nil, anno_err
+	}
+	server.anno_cache[contig.Canonical(chrom)] = anno_map
+	return anno_map, nil
+}
+
+func (server *VariantServer) format_annotations(annotations map[string]VariantAnnotations, variant_id string) map[string]string {
+	anno, found := annotations[contig.VariantKey(variant_id)]
+	if !found {
+		return nil
+	}
+	values := make(map[string]string)
+	for _, col := range server.AnnoCols {
+		if value, ok := anno[col]; ok {
+			values[col] = value.String()
+		}
+	}
+	return values
+}
+
+func new_served_variant(split_line []string) ServedVariant {
+	pos, _ := strconv.Atoi(split_line[1])
+	return ServedVariant{Chrom: split_line[0], Pos: pos, ID: split_line[2], Ref: split_line[3], Alt: split_line[4], Filter: split_line[6]}
+}
+
+func write_json(writer http.ResponseWriter, status int, value any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(value)
+}
+
+func write_json_error(writer http.ResponseWriter, status int, err error) {
+	write_json(writer, status, map[string]string{"error": err.Error()})
+}
+
+func parse_request_region(region_str string) (Region, error) {
+	region, region_errs := parse_region(region_str)
+	if region_errs != nil {
+		return region, fmt.Errorf("unable to parse the region %s. The region should have the form chrX:start-end", region_str)
+	}
+	return region, nil
+}
+
+// handle_region_carriers answers GET /region/{region}/carriers
+func (server *VariantServer) handle_region_carriers(writer http.ResponseWriter, request *http.Request) {
+	region, region_err := parse_request_region(request.PathValue("region"))
+	if region_err != nil {
+		write_json_error(writer, http.StatusBadRequest, region_err)
+		return
+	}
+
+	annotations, anno_err := server.annotations(region.chrom)
+	if anno_err != nil {
+		write_json_error(writer, http.StatusInternalServerError, anno_err)
+		return
+	}
+
+	variants := []ServedVariant{}
+	scan_err := server.Index.ScanRegion(server.VcfFile, region.chrom, region.start, region.end, server.Buffersize, func(split_line []string) error {
+		if len(split_line) != len(server.Samples)+9 {
+			return fmt.Errorf("the record for the variant %s has %d columns but the header has %d columns", split_line[2], len(split_line), len(server.Samples)+9)
+		}
+		variant := new_served_variant(split_line)
+		variant.GenotypeCounts = make(map[string]int)
+		for sample_indx, call := range split_line[9:] {
+			genotype := vcf.ParseGenotype(call)
+			variant.GenotypeCounts[genotype.Class().String()]++
+			if genotype.HasAlt() {
+				variant.Carriers = append(variant.Carriers, CarrierCall{Sample: pseudonym.ID(server.Samples[sample_indx]), Genotype: call})
+			}
+		}
+		variant.Annotations = server.format_annotations(annotations, variant.ID)
+		variants = append(variants, variant)
+		return nil
+	})
+	if scan_err != nil {
+		write_json_error(writer, http.StatusInternalServerError, scan_err)
+		return
+	}
+
+	write_json(writer, http.StatusOK, map[string]any{"region": request.PathValue("region"), "variants": variants})
+}
+
+// handle_sample_variants answers GET /sample/{id}/variants?region=chrX:start-end
+func (server *VariantServer) handle_sample_variants(writer http.ResponseWriter, request *http.Request) {
+	sample_id := request.PathValue("id")
+	sample_indx, found := server.SampleIndex.Position(sample_id)
+	if !found {
+		write_json_error(writer, http.StatusNotFound, fmt.Errorf("the sample %s is not in the vcf file", sample_id))
+		return
+	}
+
+	// Scanning the whole callset for one sample would take far too long for a web request so a region is required
+	region_str := request.URL.Query().Get("region")
+	if region_str == "" {
+		write_json_error(writer, http.StatusBadRequest, fmt.Errorf("the region query parameter is required (for example ?region=chr22:1-100000)"))
+		return
+	}
+	region, region_err := parse_request_region(region_str)
+	if region_err != nil {
+		write_json_error(writer, http.StatusBadRequest, region_err)
+		return
+	}
+
+	annotations, anno_err := server.annotations(region.chrom)
+	if anno_err != nil {
+		write_json_error(writer, http.StatusInternalServerError, anno_err)
+		return
+	}
+
+	variants := []ServedVariant{}
+	scan_err := server.Index.ScanRegion(server.VcfFile, region.chrom, region.start, region.end, server.Buffersize, func(split_line []string) error {
+		if len(split_line) <= 9+sample_indx {
+			return fmt.Errorf("the record for the variant %s does not have a column for the sample %s", split_line[2], sample_id)
+		}
+		call := split_line[9+sample_indx]
+		if !genotype.HasAlt(call) {
+			return nil
+		}
+		variant := new_served_variant(split_line)
+		variant.Genotype = call
+		variant.Annotations = server.format_annotations(annotations, variant.ID)
+		variants = append(variants, variant)
+		return nil
+	})
+	if scan_err != nil {
+		write_json_error(writer, http.StatusInternalServerError, scan_err)
+		return
+	}
+
+	write_json(writer, http.StatusOK, map[string]any{"sample": pseudonym.ID(sample_id), "region": region_str, "variants": variants})
+}
+
+// Handler returns the routes of the server
+func (server *VariantServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /region/{region}/carriers", server.handle_region_carriers)
+	mux.HandleFunc("GET /sample/{id}/variants", server.handle_sample_variants)
+	return mux
+}
+
+// Serve starts the http server. Internal web tools can use this to query carriers without
+// starting the command line tool for every request
+func Serve(args internal.UserArgs, logger *slog.Logger) {
+	server, server_err := NewVariantServer(args, logger)
+	if server_err != nil {
+		logger.Error(server_err.Error())
+		os.Exit(1)
+	}
+
+	if args.ListenAddress == "" && args.GRPCAddress == "" {
+		logger.Error("At least one of --listen or --grpc-listen needs to be provided")
+		os.Exit(1)
+	}
+
+	// The http and grpc servers share the index and the annotation cache. We stop if either of them fails
+	server_errs := make(chan error, 2)
+	if args.ListenAddress != "" {
+		logger.Info(fmt.Sprintf("Serving http carrier queries for %d samples from %s on %s", len(server.Samples), args.VcfFile, args.ListenAddress))
+		go func() { server_errs <- http.ListenAndServe(args.ListenAddress, server.Handler()) }()
+	}
+	if args.GRPCAddress != "" {
+		logger.Info(fmt.Sprintf("Serving grpc variant streams for %d samples from %s on %s", len(server.Samples), args.VcfFile, args.GRPCAddress))
+		go func() { server_errs <- server.ServeGRPC(args.GRPCAddress) }()
+	}
+
+	if serve_err := <-server_errs; serve_err != nil {
+		logger.Error(serve_err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/genotype"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/output"
+	"go-phers-parser/vcf"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// stratumCounts are the counts of one stratum (such as the female samples) for the current variant
+type stratumCounts struct {
+	samples  int
+	carriers int
+	het      int
+	hom_alt  int
+	alt      int // alternate alleles in the calls of the stratum
+	called   int // alleles that were not missing
+}
+
+// StrataSummary writes the carrier counts and frequencies of each variant within the strata of the
+// --strata-cols columns (such as sex or genetic ancestry). Reviewers usually ask for these and they
+// would otherwise need a join of the per-sample output with the covariate file
+type StrataSummary struct {
+	Columns []string
+	table   *PhenotypeTable
+	strata  map[string][]int // the index of the stratum of each sample for each column
+	levels  [][]string       // the sorted strata of each column. Samples without a value are in NA
+	counts  [][]stratumCounts
+	fh      io.WriteCloser
+	writer  *bufio.Writer
+}
+
+// new_strata_summary creates the summary file for the columns of the table
+func new_strata_summary(filename string, table *PhenotypeTable) (*StrataSummary, error) {
+	summary := &StrataSummary{Columns: table.Columns, table: table}
+
+	summary_fh, create_err := files.Create(filename)
+	manifest.Track(filename)
+	if create_err != nil {
+		return nil, fmt.Errorf("encountered the following error while trying to create the strata summary file %s: %w", filename, create_err)
+	}
+	summary.fh = summary_fh
+	summary.writer = bufio.NewWriterSize(summary_fh, files.WriteBufferSize())
+	output.Header("VARIANT", "STRATUM_COLUMN", "STRATUM", "SAMPLES", "CARRIERS", "HET_CARRIERS", "HOM_ALT_CARRIERS", "CARRIER_FREQ", "ALT_ALLELE_FREQ").WriteTo(summary.writer)
+	return summary, nil
+}
+
+// assign_strata finds the stratum of each sample. This is done for the samples in the calls instead
+// of every sample in the table so that strata without any samples aren't written
+func (summary *StrataSummary) assign_strata(sample_ids []SampleID) {
+	values := make(map[string][]string, len(sample_ids))
+	level_sets := make([]map[string]bool, len(summary.Columns))
+	for col_indx := range summary.Columns {
+		level_sets[col_indx] = make(map[string]bool)
+	}
+	for _, sample := range sample_ids {
+		sample_values := make([]string, len(summary.Columns))
+		for col_indx := range summary.Columns {
+			sample_values[col_indx] = "NA"
+			if table_values, found := summary.table.Values[sample.SampleID]; found && table_values[col_indx] != "" {
+				sample_values[col_indx] = table_values[col_indx]
+			}
+			level_sets[col_indx][sample_values[col_indx]] = true
+		}
+		values[sample.SampleID] = sample_values
+	}
+
+	for col_indx := range summary.Columns {
+		levels := make([]string, 0, len(level_sets[col_indx]))
+		for level := range level_sets[col_indx] {
+			levels = append(levels, level)
+		}
+		slices.Sort(levels)
+		summary.levels = append(summary.levels, levels)
+		summary.counts = append(summary.counts, make([]stratumCounts, len(levels)))
+	}
+
+	summary.strata = make(map[string][]int, len(values))
+	for sample_id, sample_values := range values {
+		indices := make([]int, len(sample_values))
+		for col_indx, value := range sample_values {
+			indices[col_indx] = slices.Index(summary.levels[col_indx], value)
+		}
+		summary.strata[sample_id] = indices
+	}
+}
+
+// AddVariant counts the calls of the samples in each stratum and writes a row for every stratum.
+// The calls are indexed by the Index of each sample. The samples have to be the same for every variant
+func (summary *StrataSummary) AddVariant(variant_id string, classifier vcf.GenotypeClassifier, format string, sample_ids []SampleID, calls []string) {
+	if summary.strata == nil {
+		summary.assign_strata(sample_ids)
+	}
+	for col_indx := range summary.counts {
+		clear(summary.counts[col_indx])
+	}
+
+	for _, sample := range sample_ids {
+		call := calls[sample.Index]
+		is_carrier := classifier.IsCarrier(format, call)
+		class := vcf.ParseGenotype(call).Class()
+		alt_count, ref_count := genotype.AlleleCounts(call)
+
+		for col_indx, level_indx := range summary.strata[sample.SampleID] {
+			counts := &summary.counts[col_indx][level_indx]
+			counts.samples++
+			counts.alt += alt_count
+			counts.called += alt_count + ref_count
+			if !is_carrier {
+				continue
+			}
+			counts.carriers++
+			switch class {
+			case vcf.Het:
+				counts.het++
+			case vcf.HomAlt:
+				counts.hom_alt++
+			}
+		}
+	}
+
+	for col_indx, col := range summary.Columns {
+		for level_indx, level := range summary.levels[col_indx] {
+			counts := summary.counts[col_indx][level_indx]
+			output.NewRow(variant_id, col, level).Int(counts.samples, counts.carriers, counts.het, counts.hom_alt).Add(frequency_or_na(counts.carriers, counts.samples), frequency_or_na(counts.alt, counts.called)).WriteTo(summary.writer)
+		}
+	}
+}
+
+// Close flushes the summary and closes the file
+func (summary *StrataSummary) Close() error {
+	flush_err := summary.writer.Flush()
+	if close_err := summary.fh.Close(); flush_err == nil {
+		flush_err = close_err
+	}
+	return flush_err
+}
+
+// frequency_or_na formats the fraction for the output or NA if the stratum had nothing to count
+func frequency_or_na(count int, total int) string {
+	if total == 0 {
+		return "NA"
+	}
+	return strconv.FormatFloat(float64(count)/float64(total), 'f', 6, 64)
+}
+
+// load_strata_summary reads the --strata-cols columns and creates <output>_strata_summary.txt. The
+// columns are read from the covariate file if there is one and it has every column. Otherwise they
+// are read from the phenotype file. A nil summary is returned when no columns were selected
+func load_strata_summary(config internal.UserArgs, logger *slog.Logger) (*StrataSummary, error) {
+	strata_cols := parse_pheno_cols(config.StrataCols)
+	if len(strata_cols) == 0 {
+		return nil, nil
+	}
+
+	var table *PhenotypeTable
+	var table_err error
+	if config.CovariateFile != "" {
+		table, table_err = read_phenotype_table(config.CovariateFile, strata_cols)
+		if table_err != nil {
+			logger.Debug(fmt.Sprintf("Reading the strata columns from the phenotype file because the covariate file could not be used: %s", table_err))
+		}
+	}
+	if table == nil {
+		table, table_err = read_phenotype_table(config.PhenoFilePath, strata_cols)
+		if table_err != nil {
+			return nil, fmt.Errorf("unable to read the --strata-cols columns from the covariate or the phenotype file: %w", table_err)
+		}
+	}
+
+	summary_file := fmt.Sprintf("%s_strata_summary.txt", strings.TrimSuffix(config.OutputFilepath, filepath.Ext(config.OutputFilepath)))
+	summary, summary_err := new_strata_summary(summary_file, table)
+	if summary_err != nil {
+		return nil, summary_err
+	}
+	logger.Info(fmt.Sprintf("Writing the carrier counts of each variant stratified by %s to the file: %s", strings.Join(strata_cols, ", "), summary_file))
+	return summary, nil
+}
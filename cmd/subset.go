@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// subsetRecord is a record that was picked for the subset. The line number is kept so that the
+// records can be written in the same order as the input
+type subsetRecord struct {
+	line_number int
+	columns     []string
+}
+
+// identifying_meta_line reports whether a "##" line can identify the samples or the environment
+// that the vcf was made in. ##SAMPLE and ##PEDIGREE lines describe the samples and the command
+// lines that bcftools and GATK add have the file paths of the run
+func identifying_meta_line(line string) bool {
+	key, _, _ := strings.Cut(strings.TrimPrefix(line, "##"), "=")
+	lowered := strings.ToLower(key)
+	return lowered == "sample" || lowered == "pedigree" || strings.HasSuffix(lowered, "command") || strings.HasSuffix(lowered, "commandline")
+}
+
+// subset_columns keeps the fixed columns of the record and the calls of the selected samples in
+// the order of the selection. If gt_only is true then every FORMAT field except the GT is dropped
+func subset_columns(split_line []string, sample_cols []int, gt_only bool) []string {
+	columns := make([]string, 0, 9+len(sample_cols))
+	columns = append(columns, split_line[:9]...)
+
+	gt_indx := 0
+	if gt_only {
+		gt_indx = slices.Index(strings.Split(split_line[8], ":"), "GT")
+		columns[8] = "GT"
+	}
+
+	for _, col := range sample_cols {
+		call := split_line[col]
+		if gt_only {
+			// A record without a GT has nothing left to share once the other fields are dropped
+			if fields := strings.Split(call, ":"); gt_indx != -1 && gt_indx < len(fields) {
+				call = fields[gt_indx]
+			} else {
+				call = "."
+			}
+		}
+		columns = append(columns, call)
+	}
+	return columns
+}
+
+// SubsetVcf writes a small vcf with a random selection of the variants and the samples of the
+// input so that a bug report can include an input that reproduces the problem. The samples are
+// shuffled and renamed to SAMPLE_1, SAMPLE_2, ... and the header lines that could identify the
+// samples are dropped. The same seed picks the same variants and samples from the same input
+func SubsetVcf(args internal.UserArgs, logger *slog.Logger) {
+	if args.SubsetVariants < 1 || args.SubsetSamples < 0 {
+		logger.Error(fmt.Sprintf("The number of variants has to be at least 1 and the number of samples can't be negative but the values were %d and %d", args.SubsetVariants, args.SubsetSamples))
+		os.Exit(1)
+	}
+
+	seed := uint64(args.Seed)
+	if args.Seed == 0 {
+		seed = uint64(time.Now().UnixNano())
+	}
+	// The seed is logged so that the same subset can be made again with --seed
+	logger.Info(fmt.Sprintf("Selecting the variants and samples with the seed %d", seed))
+	random := rand.New(rand.NewPCG(seed, seed))
+
+	vcf_reader := &files.VCFReader{FileReader: *files.Open(args.VcfFile, args.Buffersize)}
+
+	if vcf_reader.Err != nil {
+		vcf_reader.CheckErrors()
+	}
+
+	defer vcf_reader.Close()
+
+	if args.SampleExclusion != "" {
+		vcf_reader.SampleExclusions = files.ParseSampleExclusions(args.SampleExclusion)
+	}
+
+	if header_err := vcf_reader.ParseHeader("#CHROM"); header_err != nil || !vcf_reader.Header_Found {
+		logger.Error(fmt.Sprintf("Unable to find the #CHROM header line in the vcf file %s. %v", vcf_reader.Filename, header_err))
+		os.Exit(1)
+	} else if vcf_reader.Col_count < 9 {
+		logger.Error(fmt.Sprintf("The #CHROM header line of the vcf file %s only has %d columns. A vcf needs the 9 fixed columns before the samples", vcf_reader.Filename, vcf_reader.Col_count))
+		os.Exit(1)
+	}
+
+	// We pick the sample columns up front so that only the calls of these samples are kept for the
+	// records in the reservoir. The order of the selection is also the order of the output
+	sample_cols := slices.Sorted(maps.Keys(vcf_reader.SampleMapping))
+	random.Shuffle(len(sample_cols), func(i, j int) { sample_cols[i], sample_cols[j] = sample_cols[j], sample_cols[i] })
+	if len(sample_cols) > args.SubsetSamples {
+		sample_cols = sample_cols[:args.SubsetSamples]
+	} else if len(sample_cols) < args.SubsetSamples {
+		logger.Warn(fmt.Sprintf("The vcf only has %d samples that can be selected so all of them are written instead of %d", len(sample_cols), args.SubsetSamples))
+	}
+
+	// Reservoir sampling lets us pick the variants uniformly without knowing how many records are
+	// in the stream ahead of time and only SubsetVariants records are held in memory
+	reservoir := make([]subsetRecord, 0, args.SubsetVariants)
+	records_seen := 0
+	for vcf_reader.FileScanner.Scan() {
+		line := vcf_reader.FileScanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		records_seen++
+
+		slot := len(reservoir)
+		if len(reservoir) == args.SubsetVariants {
+			slot = random.IntN(records_seen)
+			if slot >= args.SubsetVariants {
+				continue
+			}
+		}
+
+		split_line := strings.Split(strings.TrimSpace(line), "\t")
+		if len(split_line) != vcf_reader.Col_count {
+			logger.Warn(fmt.Sprintf("Skipping the record on line %d because it has %d columns but the header has %d", vcf_reader.HeaderLines+records_seen, len(split_line), vcf_reader.Col_count))
+			continue
+		}
+
+		record := subsetRecord{line_number: records_seen, columns: subset_columns(split_line, sample_cols, args.GTOnly)}
+		if slot == len(reservoir) {
+			reservoir = append(reservoir, record)
+		} else {
+			reservoir[slot] = record
+		}
+	}
+
+	if vcf_reader.FileScanner.Err() != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while reading the vcf file %s: %s", vcf_reader.Filename, vcf_reader.FileScanner.Err()))
+		os.Exit(1)
+	}
+
+	slices.SortFunc(reservoir, func(first, second subsetRecord) int { return first.line_number - second.line_number })
+
+	output_fh, output_err := files.Create(args.OutputFile)
+	manifest.Track(args.OutputFile)
+	if output_err != nil {
+		logger.Error(fmt.Sprintf("There was an issue trying to create the output file: %s\n", args.OutputFile))
+		os.Exit(1)
+	}
+
+	writer := bufio.NewWriterSize(output_fh, files.WriteBufferSize())
+
+	dropped_lines := 0
+	for _, line := range vcf_reader.Metadata.Lines {
+		if identifying_meta_line(line) || (args.GTOnly && strings.HasPrefix(line, "##FORMAT=") && !strings.HasPrefix(line, "##FORMAT=<ID=GT,")) {
+			dropped_lines++
+			continue
+		}
+		writer.WriteString(line + "\n")
+	}
+
+	header_cols := []string{"#CHROM", "POS", "ID", "REF", "ALT", "QUAL", "FILTER", "INFO", "FORMAT"}
+	for indx := range sample_cols {
+		header_cols = append(header_cols, fmt.Sprintf("SAMPLE_%d", indx+1))
+	}
+	writer.WriteString(strings.Join(header_cols, "\t") + "\n")
+
+	for _, record := range reservoir {
+		writer.WriteString(strings.Join(record.columns, "\t") + "\n")
+	}
+
+	flush_err := writer.Flush()
+	if close_err := output_fh.Close(); flush_err == nil {
+		flush_err = close_err
+	}
+	if flush_err != nil {
+		logger.Error(fmt.Sprintf("Unable to finish writing the subset to %s. %s", args.OutputFile, flush_err))
+		os.Exit(1)
+	}
+
+	logger.Info(fmt.Sprintf("Wrote %d of the %d records and %d of the %d samples to %s. %d header lines were dropped", len(reservoir), records_seen, len(sample_cols), len(vcf_reader.SampleMapping), args.OutputFile, dropped_lines))
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/intervals"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/output"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// The reasons that a written variant didn't have any annotations
+const (
+	idMismatchReason     = "id_mismatch"     // the annotation file has rows at the position but under other ids (or other alleles)
+	regionMismatchReason = "region_mismatch" // the variant is outside of the region that the annotations were read for
+	absentReason         = "absent"          // the annotation file doesn't have a row at the position
+)
+
+// UnannotatedTracker writes the variants that passed every filter but didn't match an annotation
+// to the file <output>.unannotated with the reason that they weren't matched. The reasons compare
+// the variant to the region of the annotations and to the ids of the annotation rows at the same
+// position. A nil tracker doesn't write anything so the parser can always call it
+type UnannotatedTracker struct {
+	Count     int
+	Reasons   map[string]int
+	Filename  string
+	regions   *intervals.Set      // the intervals that the annotations were read for
+	positions map[string][]string // the ids of the annotation rows at each position
+	fh        io.WriteCloser
+	writer    *bufio.Writer
+	logger    *slog.Logger
+}
+
+// NewUnannotatedTracker creates the report. The regions and the positions can be nil when they
+// aren't known in which case every variant is reported as absent
+func NewUnannotatedTracker(filename string, regions *intervals.Set, positions map[string][]string, logger *slog.Logger) (*UnannotatedTracker, error) {
+	fh, create_err := files.Create(filename)
+	manifest.Track(filename)
+	if create_err != nil {
+		return nil, fmt.Errorf("encountered the following error while trying to create the unannotated variants file %s: %w", filename, create_err)
+	}
+	tracker := &UnannotatedTracker{Reasons: make(map[string]int), Filename: filename, regions: regions, positions: positions, fh: fh, writer: bufio.NewWriter(fh), logger: logger}
+	output.Header("CHROM", "POS", "ID", "REF", "ALT", "REASON", "ANNOTATION_IDS").WriteTo(tracker.writer)
+	return tracker, nil
+}
+
+// reason explains why the variant didn't match an annotation. VEP moves the start of indels past
+// the shared first base so every position that the reference allele covers (and the one after it
+// for insertions) is checked for annotation rows
+func (tracker *UnannotatedTracker) reason(chrom string, pos int, ref string) (string, []string) {
+	if tracker.regions != nil && !tracker.regions.Overlaps(chrom, pos, pos+len(ref)-1) {
+		return regionMismatchReason, nil
+	}
+	canonical := contig.Canonical(chrom)
+	for offset := range max(len(ref), 1) + 1 {
+		if ids := tracker.positions[fmt.Sprintf("%s:%d", canonical, pos+offset)]; len(ids) > 0 {
+			return idMismatchReason, ids
+		}
+	}
+	return absentReason, nil
+}
+
+// Add writes the variant with the reason that it wasn't annotated. The fields are the fixed columns of the record
+func (tracker *UnannotatedTracker) Add(fields []string) {
+	if tracker == nil {
+		return
+	}
+	pos, _ := strconv.Atoi(fields[1])
+	reason, ids := tracker.reason(fields[0], pos, fields[3])
+	tracker.Count++
+	tracker.Reasons[reason]++
+	output.NewRow(fields[0:5]...).Add(reason, missing_dash(strings.Join(ids, ","))).WriteTo(tracker.writer)
+}
+
+// Close flushes the file and summarizes the reasons
+func (tracker *UnannotatedTracker) Close() {
+	if tracker == nil || tracker.writer == nil {
+		return
+	}
+	tracker.writer.Flush()
+	tracker.fh.Close()
+	tracker.writer = nil
+	tracker.logger.Info(fmt.Sprintf("Wrote %d variant(s) without annotations to the file %s. %d had annotation rows at the same position under a different id, %d were outside of the annotation region, and %d had no annotation rows at their position", tracker.Count, tracker.Filename, tracker.Reasons[idMismatchReason], tracker.Reasons[regionMismatchReason], tracker.Reasons[absentReason]))
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"go-phers-parser/internal/intervals"
+	"testing"
+)
+
+func TestUnannotatedReason(t *testing.T) {
+	tracker := &UnannotatedTracker{
+		regions:   intervals.New([]intervals.Interval{{Chrom: "22", Start: 1, End: 1000}}),
+		positions: map[string][]string{"22:100": {"22_100_A/T"}, "22:201": {"22_200_AT/A"}},
+	}
+	cases := []struct {
+		chrom    string
+		pos      int
+		ref      string
+		expected string
+	}{
+		{"chr22", 100, "A", idMismatchReason},
+		// VEP writes the deletion at the base after the one that is shared with the alt allele
+		{"chr22", 200, "AT", idMismatchReason},
+		{"chr22", 300, "A", absentReason},
+		{"chr22", 5000, "A", regionMismatchReason},
+		{"chr21", 100, "A", regionMismatchReason},
+	}
+	for _, test_case := range cases {
+		if reason, _ := tracker.reason(test_case.chrom, test_case.pos, test_case.ref); reason != test_case.expected {
+			t.Errorf("expected the variant at %s:%d to be %s but got %s", test_case.chrom, test_case.pos, test_case.expected, reason)
+		}
+	}
+}
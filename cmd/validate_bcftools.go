@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/header"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/pipeline"
+	"go-phers-parser/internal/resources"
+	"log/slog"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// BcftoolsValidation keeps the carrier count of every variant that pull-variants found so that
+// the variants can be compared with the variants that bcftools finds for the same filters
+type BcftoolsValidation struct {
+	VcfFile  string
+	Region   string
+	MafCap   mafThreshold
+	Carriers map[string]int // keyed by chrom:pos:ref:alt using the canonical chromosome name
+}
+
+// bcftools_filter is the bcftools expression that matches the filters of pull-variants. The
+// AF check is true if any of the alternate alleles pass the threshold with the same comparison as
+// check_allele_freq and the GT check keeps only the samples that carry an alternate allele
+func bcftools_filter(maf_cap mafThreshold) string {
+	return fmt.Sprintf(`INFO/AF%s & GT="alt"`, maf_cap)
+}
+
+// bcftools_region writes the region with the chromosome name that the vcf uses. bcftools doesn't
+// match chr22 with 22 like we do so we look the contig up in the header
+func bcftools_region(metadata *header.Metadata, region Region) string {
+	chrom := region.chrom
+	if header_contig, found := metadata.FindContig(region.chrom); found {
+		chrom = header_contig.ID
+	}
+	return fmt.Sprintf("%s:%d-%d", chrom, region.start, region.end)
+}
+
+// start_bcftools_validation adds a stage to the variant stream that counts the carriers of every
+// variant. The variants are passed through unchanged so that the stage can go in front of the
+// writers. The returned function runs bcftools once the stream is finished and exits the program
+// if the variants or the carrier counts are different
+func start_bcftools_validation(args internal.UserArgs, pulled *PulledVariants, variants <-chan []VariantInfo, logger *slog.Logger) (<-chan []VariantInfo, func()) {
+	if _, path_err := exec.LookPath("bcftools"); path_err != nil {
+		logger.Error(fmt.Sprintf("The --validate-against-bcftools flag needs bcftools to be installed and on the PATH. %s", path_err))
+		os.Exit(1)
+	}
+	if _, defined := pulled.Metadata.Info["AF"]; !defined {
+		logger.Warn("The vcf header does not have an ##INFO line for AF. pull-variants falls back to the third INFO value for the allele frequency but bcftools can only filter on the AF key so the variant sets may differ")
+	}
+	if args.FoldAf {
+		logger.Warn("bcftools filters on the unfolded INFO AF and counts the alternate allele carriers but this run uses --fold-af so the variants where the reference is the minor allele will differ")
+	}
+	if args.AdaptiveMaf != "" {
+		logger.Warn("bcftools filters with the --maf-threshold but this run picks the threshold with --adaptive-maf so the variant sets may differ")
+	}
+	if args.AfColumns != "" {
+		logger.Warn("bcftools filters on the INFO AF but this run uses the population frequencies from the --af-columns so the variant sets may differ")
+	}
+	if args.Classifier != "" && args.Classifier != "hard" {
+		logger.Warn(fmt.Sprintf("The carriers are compared using the GT of the calls in bcftools but this run uses the %s classifier. The carrier counts will only match the bcftools counts for the hard classifier", args.Classifier))
+	}
+
+	// The region and the threshold were already checked when the run started
+	region, _ := parse_region(args.Region)
+	maf_cap, _ := new_maf_threshold(args.MafCap, args.MafCompare)
+
+	validation := &BcftoolsValidation{
+		VcfFile:  args.ValidateAgainstBcftools,
+		Region:   bcftools_region(pulled.Metadata, region),
+		MafCap:   maf_cap,
+		Carriers: make(map[string]int),
+	}
+
+	// Stage runs fn in a single goroutine so the map doesn't need a lock
+	counted := pipeline.Stage(variants, pulled.Pipeline, func(variant VariantInfo) (VariantInfo, bool) {
+		carriers := 0
+		for _, call := range strings.Split(strings.TrimPrefix(variant.Calls, "\t"), "\t") {
+			if pulled.Classifier.IsCarrier(variant.InfoFields[8], call) {
+				carriers++
+			}
+		}
+		validation.Carriers[pulled_variant_key(variant.InfoFields)] = carriers
+		return variant, true
+	})
+
+	return counted, func() {
+		report_file := fmt.Sprintf("%s.bcftools_validation.txt", args.OutputFile)
+		matched, validation_err := validation.Run(report_file, logger)
+		if validation_err != nil {
+			logger.Error(fmt.Sprintf("Unable to validate the variants against bcftools. %s", validation_err))
+			os.Exit(1)
+		} else if !matched {
+			logger.Error(fmt.Sprintf("The variants from pull-variants did not match the variants from bcftools. The differences were written to %s", report_file))
+			os.Exit(1)
+		}
+	}
+}
+
+// run_bcftools runs bcftools with the arguments and calls fn for every line that it writes. The
+// stderr of bcftools is added to the error if the command fails
+func run_bcftools(bcftools_args []string, fn func(line string), logger *slog.Logger) error {
+	logger.Info(fmt.Sprintf("Running: bcftools %s", strings.Join(bcftools_args, " ")))
+
+	command := exec.Command("bcftools", bcftools_args...)
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+
+	stdout, pipe_err := command.StdoutPipe()
+	if pipe_err != nil {
+		return pipe_err
+	}
+	if start_err := command.Start(); start_err != nil {
+		return fmt.Errorf("unable to start bcftools: %w", start_err)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024*1024)
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+	scan_err := scanner.Err()
+
+	if wait_err := command.Wait(); wait_err != nil {
+		return fmt.Errorf("bcftools %s failed with %w: %s", bcftools_args[0], wait_err, strings.TrimSpace(stderr.String()))
+	}
+	return scan_err
+}
+
+// bcftools_region_args uses the index to jump to the region if there is one. Otherwise bcftools
+// has to stream through the whole file and keep the records in the region (-t)
+func bcftools_region_args(vcf_file string, region string) []string {
+	for _, suffix := range []string{".tbi", ".csi"} {
+		if _, stat_err := os.Stat(vcf_file + suffix); stat_err == nil {
+			return []string{"-r", region}
+		}
+	}
+	return []string{"-t", region}
+}
+
+func (validation *BcftoolsValidation) region_args() []string {
+	return bcftools_region_args(validation.VcfFile, validation.Region)
+}
+
+// Run collects the variants with bcftools view and the carriers with bcftools query and compares
+// them to the variants from pull-variants. Every difference is written to the report file. The
+// return value is true if the variants and the carrier counts were the same
+func (validation *BcftoolsValidation) Run(report_file string, logger *slog.Logger) (bool, error) {
+	defer resources.StartStage("bcftools validation")()
+	filter := bcftools_filter(validation.MafCap)
+
+	// bcftools view gives us the variant set
+	view_variants := make(map[string]bool)
+	view_args := append(append([]string{"view", "-H"}, validation.region_args()...), "-i", filter, validation.VcfFile)
+	view_err := run_bcftools(view_args, func(line string) {
+		if split_line := strings.SplitN(line, "\t", 6); len(split_line) >= 5 {
+			view_variants[pulled_variant_key(split_line)] = true
+		}
+	}, logger)
+
+	// bcftools query only prints the samples that pass the GT filter inside of the brackets so we
+	// can count the carriers without parsing the genotypes ourselves
+	query_carriers := make(map[string]int)
+	query_args := append(append([]string{"query"}, validation.region_args()...), "-i", filter, "-f", `%CHROM\t%POS\t%ID\t%REF\t%ALT\t[%SAMPLE,]\n`, validation.VcfFile)
+	query_err := run_bcftools(query_args, func(line string) {
+		if split_line := strings.Split(line, "\t"); len(split_line) >= 6 {
+			query_carriers[pulled_variant_key(split_line)] = strings.Count(split_line[5], ",")
+		}
+	}, logger)
+
+	if view_err != nil {
+		return false, view_err
+	} else if query_err != nil {
+		return false, query_err
+	}
+
+	var differences []string
+	shared, only_go, discordant, only_bcftools := 0, 0, 0, 0
+
+	for _, key := range slices.Sorted(maps.Keys(validation.Carriers)) {
+		carriers := validation.Carriers[key]
+		switch {
+		case !view_variants[key]:
+			only_go++
+			differences = append(differences, fmt.Sprintf("%s\tonly_go_vcf_parser\t%d\t-", key, carriers))
+		case query_carriers[key] != carriers:
+			discordant++
+			differences = append(differences, fmt.Sprintf("%s\tcarrier_count\t%d\t%d", key, carriers, query_carriers[key]))
+		default:
+			shared++
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(view_variants)) {
+		if _, found := validation.Carriers[key]; !found {
+			only_bcftools++
+			differences = append(differences, fmt.Sprintf("%s\tonly_bcftools\t-\t%d", key, query_carriers[key]))
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Compared the variants with bcftools for the region %s. %d variants matched, %d variants were only found by pull-variants, %d variants were only found by bcftools, and %d variants had different carrier counts", validation.Region, shared, only_go, only_bcftools, discordant))
+
+	if len(differences) == 0 {
+		return true, nil
+	}
+	return false, write_validation_report(report_file, differences)
+}
+
+// write_validation_report writes one line for every variant that was different between the tools
+func write_validation_report(report_file string, differences []string) error {
+	output_fh, create_err := files.Create(report_file)
+	if create_err != nil {
+		return create_err
+	}
+	manifest.Track(report_file)
+
+	writer := bufio.NewWriter(output_fh)
+	writer.WriteString("VARIANT\tSTATUS\tGO_VCF_PARSER_CARRIERS\tBCFTOOLS_CARRIERS\n")
+	for _, line := range differences {
+		writer.WriteString(line + "\n")
+	}
+	if flush_err := writer.Flush(); flush_err != nil {
+		output_fh.Close()
+		return flush_err
+	}
+	return output_fh.Close()
+}
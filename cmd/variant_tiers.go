@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"strconv"
+	"strings"
+)
+
+// VariantTier is an ACMG style classification of a variant. These tiers replace the pathogenic,
+// nonsynonymous, and other buckets when --variant-tiers is used
+type VariantTier string
+
+const (
+	TierPathogenic      VariantTier = "P/LP"
+	TierVUSFavorPath    VariantTier = "VUS-favor-path"
+	TierVUS             VariantTier = "VUS"
+	TierBenign          VariantTier = "LB/B"
+	commonTierFreq                  = 0.05  // the BA1 cutoff. More common variants are benign
+	rareTierFreq                    = 0.001 // variants at or below this frequency are rare enough for PM2
+	lowConfidenceLoFTEE             = "LC"
+)
+
+// variantTierOrder is the order that the tiers are written in the outputs
+var variantTierOrder = []VariantTier{TierPathogenic, TierVUSFavorPath, TierVUS, TierBenign}
+
+// ColumnName is the name of the per-sample output column of the tier (P_LP_VARIANTS for P/LP)
+func (tier VariantTier) ColumnName() string {
+	return strings.ToUpper(strings.NewReplacer("/", "_", "-", "_").Replace(string(tier))) + "_VARIANTS"
+}
+
+// The consequences are grouped by the VEP impact. Predicted loss of function consequences are the
+// null variants of PVS1 and the low impact consequences can't change the protein (BP7)
+var (
+	lofConsequences      = []string{"transcript_ablation", "splice_acceptor_variant", "splice_donor_variant", "stop_gained", "frameshift_variant", "start_lost"}
+	moderateConsequences = []string{"stop_lost", "missense_variant", "inframe_insertion", "inframe_deletion", "protein_altering_variant", "nonsynonymous"}
+	lowConsequences      = []string{"synonymous_variant", "stop_retained_variant", "start_retained_variant", "intron_variant", "upstream_gene_variant", "downstream_gene_variant", "intergenic_variant", "3_prime_UTR_variant", "5_prime_UTR_variant"}
+)
+
+// lofCategoryConsequences are the consequences of the LOF category. These are the consequences that
+// LOFTEE assesses so the category lines up with the HC/LC calls
+var lofCategoryConsequences = []string{"stop_gained", "frameshift_variant", "splice_donor_variant", "splice_acceptor_variant"}
+
+// LofRule decides if a variant is in the LOF category of the per-sample output. With HCOnly the
+// variant also has to be a high confidence LOF in the LOFTEE column
+type LofRule struct {
+	LofteeCol string
+	HCOnly    bool
+}
+
+// IsLoF reports whether the consequence is a loss of function consequence. The value function
+// returns the annotation of a column like in VariantTiers.Classify
+func (rule LofRule) IsLoF(consequence string, value func(col string) string) bool {
+	if !check_column_label(consequence, lofCategoryConsequences) {
+		return false
+	}
+	return !rule.HCOnly || value(rule.LofteeCol) == "HC"
+}
+
+// TieredVariant is one row of the per-variant tier report
+type TieredVariant struct {
+	ID       string
+	Tier     VariantTier
+	Carriers int
+	Evidence []string // the clinvar, consequence, LOFTEE, and frequency values that were used
+}
+
+// VariantTiers combines the ClinVar significance, the consequence, the LOFTEE confidence, and the
+// population frequency of a variant into a tier:
+//
+//	LB/B             benign or likely benign in ClinVar, more common than 5% (BA1), or a low impact consequence
+//	P/LP             pathogenic or likely pathogenic in ClinVar, or a high confidence loss of function
+//	                 consequence that is rare (PVS1 and PM2)
+//	VUS-favor-path   a low confidence or common loss of function consequence or a rare missense/inframe consequence
+//	VUS              everything else including conflicting ClinVar interpretations
+//
+// The LOFTEE and frequency columns are optional. Variants without a value are not held back by them
+type VariantTiers struct {
+	ClinvarCol     string
+	ConsequenceCol string
+	LofteeCol      string
+	FrequencyCol   string
+	Variants       []TieredVariant
+}
+
+// Classify finds the tier of a variant. The value function returns the annotation of a column or
+// an empty string if the variant or the file doesn't have the column
+func (tiers *VariantTiers) Classify(value func(col string) string) (VariantTier, []string) {
+	clinvar := strings.ToLower(value(tiers.ClinvarCol))
+	consequence := value(tiers.ConsequenceCol)
+	loftee := ""
+	if tiers.LofteeCol != "" {
+		loftee = value(tiers.LofteeCol)
+	}
+	freq, has_freq := 0.0, false
+	freq_str := ""
+	if tiers.FrequencyCol != "" {
+		freq_str = value(tiers.FrequencyCol)
+		freq, has_freq = column_frequency(freq_str)
+	}
+	evidence := []string{missing_dash(clinvar), missing_dash(consequence), missing_dash(loftee), missing_dash(freq_str)}
+
+	conflicting := strings.Contains(clinvar, "conflicting")
+	clinvar_benign := strings.Contains(clinvar, "benign") && !strings.Contains(clinvar, "pathogenic")
+	clinvar_pathogenic := strings.Contains(clinvar, "pathogenic") && !conflicting && !strings.Contains(clinvar, "benign")
+	rare := !has_freq || freq <= rareTierFreq
+
+	switch {
+	case clinvar_benign, has_freq && freq >= commonTierFreq:
+		return TierBenign, evidence
+	case clinvar_pathogenic:
+		return TierPathogenic, evidence
+	case conflicting:
+		return TierVUS, evidence
+	case check_column_label(consequence, lofConsequences) && loftee != lowConfidenceLoFTEE && rare:
+		return TierPathogenic, evidence
+	case check_column_label(consequence, lofConsequences), check_column_label(consequence, moderateConsequences) && rare:
+		return TierVUSFavorPath, evidence
+	case consequence != "" && check_column_label(consequence, lowConsequences) && !check_column_label(consequence, moderateConsequences):
+		return TierBenign, evidence
+	default:
+		return TierVUS, evidence
+	}
+}
+
+// Add records the tier of a variant for the per-variant report
+func (tiers *VariantTiers) Add(variant_id string, tier VariantTier, evidence []string, carriers int) {
+	tiers.Variants = append(tiers.Variants, TieredVariant{ID: variant_id, Tier: tier, Carriers: carriers, Evidence: evidence})
+}
+
+// missing_dash writes the missing values as - in the reports
+func missing_dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// write_variant_tiers writes the tier of each variant with the values that it was based on and the
+// number of samples of interest that carry the variant
+func write_variant_tiers(filename string, tiers *VariantTiers) error {
+	tiers_fh, create_err := files.Create(filename)
+	manifest.Track(filename)
+	if create_err != nil {
+		return fmt.Errorf("encountered the following error while trying to create the variant tier file %s: %w", filename, create_err)
+	}
+	defer tiers_fh.Close()
+
+	writer := bufio.NewWriter(tiers_fh)
+	writer.WriteString("VARIANT\tTIER\tCLINVAR\tCONSEQUENCE\tLOFTEE\tFREQUENCY\tCARRIERS\n")
+	for _, variant := range tiers.Variants {
+		writer.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\n", variant.ID, variant.Tier, strings.Join(variant.Evidence, "\t"), strconv.Itoa(variant.Carriers)))
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,440 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/output"
+	"go-phers-parser/internal/pseudonym"
+	"go-phers-parser/internal/resources"
+	"go-phers-parser/internal/tabix"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shardMaxEnd is the end of the region for contigs that don't have a length in the vcf header. It
+// is the largest position that a tabix index can hold
+const shardMaxEnd = 1<<29 - 1
+
+// shardDroppedFlags are the flags of the command line that the shards get their own values for.
+// The value says if the flag takes a value that is in the next argument
+var shardDroppedFlags = map[string]bool{
+	"whole-genome":  false,
+	"shard-workers": true,
+	"output":        true,
+	"o":             true,
+	"region":        true,
+	"r":             true,
+	"hash-ids-map":  true,
+}
+
+// shard is the run of pull-variants for one contig
+type shard struct {
+	Contig   string
+	Region   string
+	Dir      string // each shard has its own directory so the logs of the shards don't overwrite each other
+	Output   string
+	Mapping  string // the --hash-ids-map of the shard. Empty when the run doesn't write a mapping
+	Err      error
+	Elapsed  time.Duration
+	Variants int
+	Manifest *manifest.Manifest // the manifest that the shard wrote. nil if the shard failed before writing it
+}
+
+// whole_genome_contigs lists the contigs of the vcf. The contigs in the tabix index are the ones
+// that have records so they are used when the index can be read. Otherwise every ##contig line of
+// the header is used. The regions are written as contig:start-end so contigs whose names have a :
+// or a - (like the HLA alleles) can't be pulled on their own and are skipped
+func whole_genome_contigs(vcf_file string, logger *slog.Logger) ([]shard, error) {
+	vcf_reader := &files.VCFReader{FileReader: *files.Open(vcf_file, files.AutoBuffersize)}
+	defer vcf_reader.Close()
+	if vcf_reader.Err != nil {
+		return nil, fmt.Errorf("unable to open the vcf file %s: %w", vcf_file, vcf_reader.Err)
+	}
+	if header_err := vcf_reader.ParseHeader("#CHROM"); header_err != nil || !vcf_reader.Header_Found {
+		return nil, fmt.Errorf("unable to find the #CHROM header line in the vcf file %s. %v", vcf_file, header_err)
+	}
+
+	var names []string
+	if index, index_err := tabix.ReadIndex(vcf_file + ".tbi"); index_err == nil {
+		names = index.Names
+		logger.Info(fmt.Sprintf("Read %d contigs with records from the index %s.tbi", len(names), vcf_file))
+	} else {
+		for _, header_contig := range vcf_reader.Metadata.Contigs {
+			names = append(names, header_contig.ID)
+		}
+		logger.Info(fmt.Sprintf("Read %d contigs from the ##contig lines of the vcf header because the tabix index could not be read. %s", len(names), index_err))
+	}
+
+	var shards []shard
+	var skipped []string
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, ":-") {
+			skipped = append(skipped, name)
+			continue
+		}
+		end := shardMaxEnd
+		if header_contig, found := vcf_reader.Metadata.FindContig(name); found && header_contig.Length > 0 {
+			end = header_contig.Length
+		}
+		shards = append(shards, shard{Contig: name, Region: fmt.Sprintf("%s:1-%d", name, end)})
+	}
+	if len(skipped) > 0 {
+		logger.Warn(fmt.Sprintf("Skipping %d contigs whose names can't be written as a region (chrX:start-end). The first ones are %s", len(skipped), strings.Join(skipped[:min(len(skipped), consistencyExamples)], ",")))
+	}
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("no contigs were found in the index or the header of the vcf file %s", vcf_file)
+	}
+	return shards, nil
+}
+
+// shard_command_args removes the flags that the shards set themselves from the command line of
+// the run. Flags can be written as --name value, --name=value, or with a single dash
+func shard_command_args(cli_args []string) []string {
+	var kept []string
+	for indx := 0; indx < len(cli_args); indx++ {
+		argument := cli_args[indx]
+		if argument == "--" {
+			return append(kept, cli_args[indx:]...)
+		}
+		if !strings.HasPrefix(argument, "-") {
+			kept = append(kept, argument)
+			continue
+		}
+		name, _, has_value := strings.Cut(strings.TrimLeft(argument, "-"), "=")
+		takes_value, dropped := shardDroppedFlags[name]
+		if !dropped {
+			kept = append(kept, argument)
+			continue
+		}
+		if takes_value && !has_value {
+			indx++
+		}
+	}
+	return kept
+}
+
+// shard_environment splits the threads and the memory limit of the run between the shards that run
+// at the same time. Without this every shard would size itself for the whole machine or the whole job
+func shard_environment(workers int) []string {
+	environment := os.Environ()
+	if os.Getenv("GOMAXPROCS") == "" {
+		environment = append(environment, fmt.Sprintf("GOMAXPROCS=%d", max(runtime.GOMAXPROCS(0)/workers, 1)))
+	}
+	if limits, found := resources.AppliedLimits(); found && limits.MemoryBytes > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		environment = append(environment, fmt.Sprintf("GOMEMLIMIT=%d", limits.SoftMemoryLimit()/int64(workers)))
+	}
+	return environment
+}
+
+// run_shard runs pull-variants for the contig of the shard as a separate process. A separate
+// process keeps the failure of one contig (which stops pull-variants with os.Exit) from taking
+// down the others and gives each shard its own log and manifest
+func run_shard(ctx context.Context, executable string, command_args []string, environment []string, current *shard) {
+	started := time.Now()
+	defer func() { current.Elapsed = time.Since(started) }()
+
+	if mkdir_err := os.MkdirAll(current.Dir, 0755); mkdir_err != nil {
+		current.Err = mkdir_err
+		return
+	}
+	console, console_err := os.Create(filepath.Join(current.Dir, "console.log"))
+	if console_err != nil {
+		current.Err = console_err
+		return
+	}
+	defer console.Close()
+
+	shard_args := append(append([]string{}, command_args...), "--region", current.Region, "--output", current.Output)
+	if current.Mapping != "" {
+		shard_args = append(shard_args, "--hash-ids-map", current.Mapping)
+	}
+	command := exec.CommandContext(ctx, executable, shard_args...)
+	command.Env = environment
+	command.Stdout = console
+	command.Stderr = console
+	if run_err := command.Run(); run_err != nil {
+		current.Err = fmt.Errorf("pull-variants failed with %w. See the logs in %s", run_err, current.Dir)
+	}
+
+	manifest_json, read_err := os.ReadFile(strings.TrimSuffix(current.Output, filepath.Ext(current.Output)) + ".manifest.json")
+	if read_err == nil {
+		current.Manifest = &manifest.Manifest{}
+		if json_err := json.Unmarshal(manifest_json, current.Manifest); json_err != nil {
+			current.Manifest = nil
+		}
+	}
+}
+
+// merge_shards concatenates the shard outputs in the order of the contigs. Every shard was run
+// with the same arguments so they have to have the same header. The rows of a shard are already in
+// order and the contigs don't overlap so unlike merge-outputs the rows don't have to be held in memory
+func merge_shards(shards []shard, output_file string, buffersize int) error {
+	output_fh, output_err := files.Create(output_file)
+	manifest.Track(output_file)
+	if output_err != nil {
+		return fmt.Errorf("unable to create the output file %s: %w", output_file, output_err)
+	}
+	defer output_fh.Close()
+	writer := bufio.NewWriterSize(output_fh, files.WriteBufferSize())
+
+	var first_header []string
+	header_written := false
+	// check_header keeps the header of the first shard and compares the #CHROM line of the others to it
+	check_header := func(current *shard, header []string) error {
+		if first_header == nil {
+			first_header = header
+			return nil
+		}
+		if len(header) == 0 || header[len(header)-1] != first_header[len(first_header)-1] {
+			return fmt.Errorf("the output of the shard %s has a different header than the output of the shard %s", current.Contig, shards[0].Contig)
+		}
+		return nil
+	}
+	write_header := func() {
+		for _, header_line := range first_header {
+			writer.WriteString(header_line + "\n")
+		}
+		header_written = true
+	}
+
+	for indx := range shards {
+		current := &shards[indx]
+		shard_fr := files.Open(current.Output, buffersize)
+		if shard_fr.Err != nil {
+			shard_fr.Close()
+			return fmt.Errorf("unable to open the output of the shard %s: %w", current.Contig, shard_fr.Err)
+		}
+		var header []string
+		header_done := false
+		for shard_fr.FileScanner.Scan() {
+			line := shard_fr.FileScanner.Text()
+			if !header_done && strings.HasPrefix(line, "#") {
+				header = append(header, line)
+				continue
+			}
+			if !header_done {
+				// The samples and the annotation columns come from the arguments and the vcf header
+				// which are the same for every shard
+				if header_err := check_header(current, header); header_err != nil {
+					shard_fr.Close()
+					return header_err
+				}
+				header_done = true
+				if !header_written {
+					write_header()
+				}
+			}
+			writer.WriteString(line + "\n")
+			current.Variants++
+		}
+		scan_err := shard_fr.FileScanner.Err()
+		shard_fr.Close()
+		if scan_err != nil {
+			return fmt.Errorf("unable to read the output of the shard %s: %w", current.Contig, scan_err)
+		}
+		if !header_done {
+			if header_err := check_header(current, header); header_err != nil {
+				return header_err
+			}
+		}
+	}
+	// The header is written even if none of the contigs had a variant
+	if !header_written {
+		write_header()
+	}
+	return writer.Flush()
+}
+
+// merge_shard_mappings adds the hashed ids that each shard wrote to its mapping file to the mapping
+// of the run. The shards without a mapping file are skipped
+func merge_shard_mappings(shards []shard) error {
+	for _, current := range shards {
+		if current.Mapping == "" {
+			continue
+		}
+		if read_err := pseudonym.ReadMapping(current.Mapping); read_err != nil {
+			return fmt.Errorf("unable to read the mapping of the shard %s: %w", current.Contig, read_err)
+		}
+	}
+	return nil
+}
+
+// write_shard_report writes the status, the variants, the time, and the memory of every shard and
+// the totals of the run. The shards run at the same time so the total time is the time of the whole run
+func write_shard_report(shards []shard, report_file string, elapsed time.Duration) error {
+	report_fh, create_err := files.Create(report_file)
+	manifest.Track(report_file)
+	if create_err != nil {
+		return create_err
+	}
+	defer report_fh.Close()
+
+	writer := bufio.NewWriter(report_fh)
+	output.Header("CONTIG", "REGION", "STATUS", "VARIANTS", "WALL_SECONDS", "PEAK_MEMORY", "VCF_BYTES").WriteTo(writer)
+	total_variants, total_bytes, failed := 0, int64(0), 0
+	var peak_memory int64
+	for _, current := range shards {
+		status := "ok"
+		if current.Err != nil {
+			status = "failed"
+			failed++
+		}
+		peak, vcf_bytes := "-", "-"
+		if current.Manifest != nil {
+			peak = resources.FormatBytes(current.Manifest.Resources.PeakRSSBytes)
+			peak_memory = max(peak_memory, current.Manifest.Resources.PeakRSSBytes)
+			if current.Manifest.Input != nil {
+				vcf_bytes = strconv.FormatInt(current.Manifest.Input.Bytes, 10)
+				total_bytes += current.Manifest.Input.Bytes
+			}
+		}
+		output.NewRow(current.Contig, current.Region, status).Int(current.Variants).Float(current.Elapsed.Seconds(), 3).Add(peak, vcf_bytes).WriteTo(writer)
+		total_variants += current.Variants
+	}
+	total_status := "ok"
+	if failed > 0 {
+		total_status = fmt.Sprintf("%d failed", failed)
+	}
+	output.NewRow("total", "-", total_status).Int(total_variants).Float(elapsed.Seconds(), 3).Add(resources.FormatBytes(peak_memory), strconv.FormatInt(total_bytes, 10)).WriteTo(writer)
+	return writer.Flush()
+}
+
+// PullWholeGenome runs pull-variants on every contig of the --vcf-file instead of a single region.
+// The contigs are pulled by a pool of --shard-workers processes that each write a shard output,
+// and the shards are merged into the --output in the order of the contigs. A report with the
+// variants, time, and memory of every shard is written next to the output. The cli_args are the
+// arguments of the run which the shards are started with
+func PullWholeGenome(args internal.UserArgs, cli_args []string, logger *slog.Logger) {
+	start_time := time.Now()
+
+	// The contigs are read from the --vcf-file with bcftools. Standard input can't be split by contig
+	var conflicts []string
+	for flag, used := range map[string]bool{"--region": args.Region != "", "--regions-file": args.RegionsFile != "", "--append": args.Append, "--publish": args.PublishTarget != ""} {
+		if used {
+			conflicts = append(conflicts, flag)
+		}
+	}
+	switch {
+	case args.VcfFile == "" || args.VcfFile == "-":
+		logger.Error("--whole-genome needs an indexed --vcf-file so that each contig can be read with bcftools. The vcf can't be split into contigs when it is streamed into standard input")
+		os.Exit(1)
+	case len(conflicts) > 0:
+		logger.Error(fmt.Sprintf("--whole-genome can't be used with %s because every contig gets its own region and the shards are merged into a new output", strings.Join(conflicts, " or ")))
+		os.Exit(1)
+	case args.OutputFormat != "" && args.OutputFormat != "tsv":
+		logger.Error(fmt.Sprintf("--whole-genome can only merge tsv outputs but the output format is %s", args.OutputFormat))
+		os.Exit(1)
+	case files.IsRemoteOutput(args.OutputFile):
+		logger.Error("--whole-genome writes the shards next to the --output so the output has to be a local file. Upload the merged output afterwards")
+		os.Exit(1)
+	}
+
+	shards, contigs_err := whole_genome_contigs(args.VcfFile, logger)
+	if contigs_err != nil {
+		logger.Error(contigs_err.Error())
+		os.Exit(1)
+	}
+	executable, executable_err := os.Executable()
+	if executable_err != nil {
+		logger.Error(fmt.Sprintf("Unable to find the path of the running program to start the shards. %s", executable_err))
+		os.Exit(1)
+	}
+
+	// Every shard reads its own copy of the annotations for the contig and runs its own bcftools
+	// so by default half of the threads are used for the shards
+	workers := args.ShardWorkers
+	if workers <= 0 {
+		workers = max(runtime.GOMAXPROCS(0)/2, 1)
+	}
+	workers = min(workers, len(shards))
+
+	output_stem := strings.TrimSuffix(args.OutputFile, filepath.Ext(args.OutputFile))
+	shard_dir := output_stem + ".shards"
+	for indx := range shards {
+		shards[indx].Dir = filepath.Join(shard_dir, strings.ReplaceAll(shards[indx].Contig, string(filepath.Separator), "_"))
+		shards[indx].Output = filepath.Join(shards[indx].Dir, "variants.tsv")
+		// Each shard writes the mapping of the ids that it hashed to its own directory. The shards
+		// would overwrite each other's mapping if they were all given the --hash-ids-map of the run
+		if args.HashIdsMap != "" {
+			shards[indx].Mapping = filepath.Join(shards[indx].Dir, "hash_ids_map.tsv")
+		}
+	}
+	logger.Info(fmt.Sprintf("Pulling the variants of %d contigs with %d workers. The shards are written to %s", len(shards), workers, shard_dir))
+
+	command_args := shard_command_args(cli_args)
+	environment := shard_environment(workers)
+	jobs := make(chan *shard)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for current := range jobs {
+				logger.Info(fmt.Sprintf("Started the shard for %s", current.Region))
+				run_shard(context.Background(), executable, command_args, environment, current)
+				if current.Err != nil {
+					logger.Error(fmt.Sprintf("The shard for %s failed. %s", current.Contig, current.Err))
+				} else {
+					logger.Info(fmt.Sprintf("Finished the shard for %s in %s", current.Contig, current.Elapsed.Round(time.Millisecond)))
+				}
+			}
+		}()
+	}
+	for indx := range shards {
+		jobs <- &shards[indx]
+	}
+	close(jobs)
+	wg.Wait()
+
+	var failed []string
+	var shard_errs []error
+	for _, current := range shards {
+		if current.Err != nil {
+			failed = append(failed, current.Contig)
+			shard_errs = append(shard_errs, current.Err)
+		}
+	}
+
+	report_file := output_stem + ".shards.tsv"
+	if len(failed) > 0 {
+		if report_err := write_shard_report(shards, report_file, time.Since(start_time)); report_err != nil {
+			logger.Error(fmt.Sprintf("Unable to write the shard report %s. %s", report_file, report_err))
+		}
+		logger.Error(fmt.Sprintf("%d of the %d shards failed (%s) so the outputs were not merged. The shard outputs and logs are in %s and the status of every shard is in %s. %s", len(failed), len(shards), strings.Join(failed, ","), shard_dir, report_file, errors.Join(shard_errs...)))
+		os.Exit(1)
+	}
+
+	if merge_err := merge_shards(shards, args.OutputFile, args.Buffersize); merge_err != nil {
+		logger.Error(fmt.Sprintf("Unable to merge the shards into %s. %s", args.OutputFile, merge_err))
+		os.Exit(1)
+	}
+	if report_err := write_shard_report(shards, report_file, time.Since(start_time)); report_err != nil {
+		logger.Error(fmt.Sprintf("Unable to write the shard report %s. %s", report_file, report_err))
+		os.Exit(1)
+	}
+	// The merged output only copies the rows of the shards so this process never hashes an id itself.
+	// The mappings of the shards are combined so that the --hash-ids-map of the run is written with them
+	if mapping_err := merge_shard_mappings(shards); mapping_err != nil {
+		logger.Error(fmt.Sprintf("Unable to combine the hashed id mappings of the shards. %s", mapping_err))
+		os.Exit(1)
+	}
+
+	total_variants := 0
+	for _, current := range shards {
+		total_variants += current.Variants
+	}
+	logger.Info(fmt.Sprintf("Merged %d variants from %d contigs into %s in %s. The variants, time, and memory of each contig are in %s", total_variants, len(shards), args.OutputFile, time.Since(start_time).Round(time.Millisecond), report_file))
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestShardCommandArgs(t *testing.T) {
+	cli_args := []string{"--decomp-threads", "2", "pull-variants", "--whole-genome", "--shard-workers=4", "-o", "all.tsv", "--region", "chr1:1-10", "--vcf-file", "calls.vcf.gz", "-r=chr2:1-5", "--output=x.tsv", "--maf-threshold", "0.01", "--hash-ids-map", "map.tsv", "--hash-ids=salt"}
+	// Each shard gets its own --hash-ids-map but keeps the salt so that the ids are hashed the same way
+	expected := []string{"--decomp-threads", "2", "pull-variants", "--vcf-file", "calls.vcf.gz", "--maf-threshold", "0.01", "--hash-ids=salt"}
+	if kept := shard_command_args(cli_args); !slices.Equal(kept, expected) {
+		t.Errorf("expected the shard arguments %q but got %q", expected, kept)
+	}
+}
+
+func TestMergeShards(t *testing.T) {
+	dir := t.TempDir()
+	header := "##SAMPLE=<ID=S1,Phenotype=1>\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS1\n"
+	contents := map[string]string{
+		"chr1": header + "chr1\t100\tv1\tA\tG\t.\tPASS\t.\tGT\t0/1\nchr1\t200\tv2\tC\tT\t.\tPASS\t.\tGT\t0/1\n",
+		"chr2": header,
+		"chr3": header + "chr3\t50\tv3\tG\tA\t.\tPASS\t.\tGT\t1/1\n",
+	}
+	var shards []shard
+	for _, contig := range []string{"chr1", "chr2", "chr3"} {
+		output := filepath.Join(dir, contig+".tsv")
+		os.WriteFile(output, []byte(contents[contig]), 0644)
+		shards = append(shards, shard{Contig: contig, Output: output})
+	}
+
+	merged := filepath.Join(dir, "merged.tsv")
+	if merge_err := merge_shards(shards, merged, 0); merge_err != nil {
+		t.Fatalf("unable to merge the shards: %s", merge_err)
+	}
+	merged_contents, _ := os.ReadFile(merged)
+	expected := header + "chr1\t100\tv1\tA\tG\t.\tPASS\t.\tGT\t0/1\nchr1\t200\tv2\tC\tT\t.\tPASS\t.\tGT\t0/1\nchr3\t50\tv3\tG\tA\t.\tPASS\t.\tGT\t1/1\n"
+	if string(merged_contents) != expected {
+		t.Errorf("unexpected merged output:\n%s", merged_contents)
+	}
+	if shards[0].Variants != 2 || shards[1].Variants != 0 || shards[2].Variants != 1 {
+		t.Errorf("expected 2, 0, and 1 variants in the shards but found %d, %d, and %d", shards[0].Variants, shards[1].Variants, shards[2].Variants)
+	}
+
+	// A shard with other samples can't be appended to the others
+	os.WriteFile(shards[2].Output, []byte(strings.Replace(contents["chr3"], "S1", "S2", -1)), 0644)
+	if merge_err := merge_shards(shards, merged, 0); merge_err == nil {
+		t.Errorf("expected an error for a shard with a different header")
+	}
+}
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	internal "go-phers-parser/internal"
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/genotype"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/output"
+	"go-phers-parser/vcf"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// WindowSummary holds the counts for one fixed size window of the region
+type WindowSummary struct {
+	Start        int
+	End          int
+	Variants     int
+	MafTotal     float64
+	MafCount     int    // variants with a usable frequency. The mean only uses these variants
+	CarrierCalls int    // number of non reference calls across all of the variants
+	carriers     []bool // samples with at least one non reference call in the window
+}
+
+func new_window_summary(window_indx int, region Region, window_size int, sample_count int) *WindowSummary {
+	start := region.start + window_indx*window_size
+	return &WindowSummary{Start: start, End: min(start+window_size-1, region.end), carriers: make([]bool, sample_count)}
+}
+
+// Carriers is the number of samples with a non reference call for at least one variant in the window
+func (window *WindowSummary) Carriers() int {
+	count := 0
+	for _, carrier := range window.carriers {
+		if carrier {
+			count++
+		}
+	}
+	return count
+}
+
+func (window *WindowSummary) write(writer *bufio.Writer, chrom string) {
+	row := output.NewRow(chrom).Int(window.Start, window.End, window.Variants)
+	if window.MafCount > 0 {
+		row.Float(window.MafTotal/float64(window.MafCount), 6)
+	} else {
+		row.Add("NA")
+	}
+	row.Int(window.Carriers(), window.CarrierCalls).WriteTo(writer)
+}
+
+// record_minor_allele_freq converts the alternate allele frequencies into a minor allele frequency.
+// The alternate alleles are summed so multi-allelic sites are treated as a single site
+func record_minor_allele_freq(info vcf.Info) (float64, bool) {
+	freqs, _, freq_err := allele_freqs(info)
+	if freq_err != nil {
+		return 0, false
+	}
+
+	total := 0.0
+	for _, freq := range freqs {
+		if math.IsNaN(freq) {
+			return 0, false
+		}
+		total += freq
+	}
+	return min(total, 1-total), true
+}
+
+// SummarizeWindows streams the vcf from stdin and reports the number of variants, the mean minor
+// allele frequency, and the number of carriers in fixed size windows across the region. Every
+// window in the region is written even if no variants were found in it so that gaps in the
+// coverage of the callset stand out
+func SummarizeWindows(args internal.UserArgs, logger *slog.Logger) {
+	region, region_errs := parse_region(args.Region)
+	if region_errs != nil {
+		logger.Error("Encountered the following errors while trying to parse the region value: ")
+		for _, msg := range region_errs {
+			logger.Error(fmt.Sprintf("%s", msg))
+		}
+		os.Exit(1)
+	}
+
+	if args.WindowSize <= 0 {
+		logger.Error(fmt.Sprintf("The window size needs to be a positive integer. Received the value %d", args.WindowSize))
+		os.Exit(1)
+	}
+
+	vcf_reader := files.MakeStreamReader(args.Buffersize)
+	defer vcf_reader.Close()
+
+	if header_err := vcf_reader.ParseHeader("#CHROM"); header_err != nil || !vcf_reader.Header_Found {
+		logger.Error(fmt.Sprintf("Unable to find the #CHROM header line in the vcf stream. %v", header_err))
+		os.Exit(1)
+	}
+	sample_count := vcf_reader.Col_count - 9
+	info_decoder := vcf.NewInfoDecoder(&vcf_reader.Metadata)
+
+	output_fh, output_err := files.Create(args.OutputFile)
+	manifest.Track(args.OutputFile)
+	if output_err != nil {
+		logger.Error(fmt.Sprintf("There was an issue trying to create the output file: %s\n", args.OutputFile))
+		os.Exit(1)
+	}
+	defer output_fh.Close()
+
+	writer := bufio.NewWriter(output_fh)
+	defer writer.Flush()
+
+	output.Header("CHROM", "START", "END", "VARIANT_COUNT", "MEAN_MAF", "CARRIERS", "CARRIER_CALLS").WriteTo(writer)
+
+	// The vcf is sorted so we only need to keep the current window in memory. Windows that were
+	// skipped over have no variants so they are written as empty rows
+	window_count := (region.end-region.start)/args.WindowSize + 1
+	current_indx := 0
+	current := new_window_summary(current_indx, region, args.WindowSize, sample_count)
+
+	line_number := vcf_reader.HeaderLines
+	for vcf_reader.FileScanner.Scan() {
+		line_number++
+		split_line := strings.Split(strings.TrimSpace(vcf_reader.FileScanner.Text()), "\t")
+
+		if column_err := check_column_count(split_line, vcf_reader.Col_count); column_err != nil {
+			logger.Warn(fmt.Sprintf("Skipping line %d: %s", line_number, column_err))
+			continue
+		}
+
+		pos, pos_err := strconv.Atoi(split_line[1])
+		if pos_err != nil {
+			logger.Warn(fmt.Sprintf("Skipping line %d because the position %s is not an integer", line_number, split_line[1]))
+			continue
+		}
+		if !contig.Same(split_line[0], region.chrom) || pos < region.start || pos > region.end {
+			continue
+		}
+
+		window_indx := (pos - region.start) / args.WindowSize
+		if window_indx < current_indx {
+			logger.Error(fmt.Sprintf("The record on line %d is before the previous record. The vcf stream needs to be sorted by position", line_number))
+			os.Exit(1)
+		}
+		for current_indx < window_indx {
+			current.write(writer, region.chrom)
+			current_indx++
+			current = new_window_summary(current_indx, region, args.WindowSize, sample_count)
+		}
+
+		current.Variants++
+
+		info, info_err := info_decoder.Decode(split_line[7], strings.Count(split_line[4], ",")+1)
+		if info_err == nil {
+			if maf, found := record_minor_allele_freq(info); found {
+				current.MafTotal += maf
+				current.MafCount++
+			}
+		}
+
+		for sample_indx, call := range split_line[9:] {
+			if genotype.HasAlt(call) {
+				current.CarrierCalls++
+				current.carriers[sample_indx] = true
+			}
+		}
+	}
+	if vcf_reader.FileScanner.Err() != nil {
+		logger.Error(fmt.Sprintf("Encountered the following error while attempting to read through the vcf file:\n %s", vcf_reader.FileScanner.Err()))
+	}
+
+	// We still need to write the last window with variants and any empty windows after it
+	for current_indx < window_count {
+		current.write(writer, region.chrom)
+		current_indx++
+		current = new_window_summary(current_indx, region, args.WindowSize, sample_count)
+	}
+
+	logger.Info(fmt.Sprintf("Wrote the summary of %d windows to %s", window_count, args.OutputFile))
+}
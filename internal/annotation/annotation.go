@@ -0,0 +1,80 @@
+package annotation
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// AnnotationSource returns the annotations for a single variant. The keys of the map are the
+// column names that the user can request with --keep-cols. A variant without any annotations
+// returns a nil map and no error
+type AnnotationSource interface {
+	Lookup(chrom string, pos int, ref string, alt string) (map[string]string, error)
+}
+
+// Chain queries several sources for each variant and merges their annotations. When more than
+// one source has the same column the value from the earlier source is kept so that a curated
+// source can be listed ahead of a more general one
+type Chain []AnnotationSource
+
+func (chain Chain) Lookup(chrom string, pos int, ref string, alt string) (map[string]string, error) {
+	var merged map[string]string
+	for _, source := range chain {
+		values, lookup_err := source.Lookup(chrom, pos, ref, alt)
+		if lookup_err != nil {
+			return nil, lookup_err
+		}
+		for key, value := range values {
+			if merged == nil {
+				merged = make(map[string]string)
+			}
+			if _, found := merged[key]; !found {
+				merged[key] = value
+			}
+		}
+	}
+	return merged, nil
+}
+
+// Close closes the sources that hold on to files (such as annotations that were moved to the disk)
+func (chain Chain) Close() error {
+	var errs []error
+	for _, source := range chain {
+		if closer, ok := source.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Open creates a built-in source from a spec of the form type:path. The types are
+//
+//	clinvar:clinvar.vcf.gz    INFO fields of the ClinVar vcf (CLNSIG, CLNREVSTAT, ...) plus CLINVAR_ID
+//	csq:annotated.vcf.gz      subfields of the CSQ INFO field written by VEP (use csq=ANN:file for snpEff)
+//	tabix:scores.tsv.gz       every column of a tabix indexed table such as CADD or dbNSFP
+//
+// Every file has to be bgzipped with a tabix index next to it and use the same build as the callset
+func Open(spec string) (AnnotationSource, error) {
+	source_type, filename, found := strings.Cut(spec, ":")
+	if !found || filename == "" {
+		return nil, fmt.Errorf("the annotation source %s should have the form type:path (for example clinvar:clinvar.vcf.gz)", spec)
+	}
+
+	info_key := "CSQ"
+	if csq_type, key, has_key := strings.Cut(source_type, "="); has_key {
+		source_type, info_key = csq_type, key
+	}
+
+	switch source_type {
+	case "clinvar":
+		return NewClinVar(filename)
+	case "csq":
+		return NewCSQ(filename, info_key)
+	case "tabix":
+		return NewTabixTable(filename)
+	default:
+		return nil, fmt.Errorf("the annotation source type %s is not recognized. Allowed types are clinvar, csq, and tabix", source_type)
+	}
+}
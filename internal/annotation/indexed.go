@@ -0,0 +1,94 @@
+package annotation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/tabix"
+)
+
+// The indexed sources read the records of one window at a time. The callset is sorted so most
+// lookups land in the window that is already in memory. The windows are kept small because
+// files like dbNSFP have several long rows for every base
+const (
+	windowSize       = 16 * 1024
+	recordBufferSize = 1024 * 1024
+)
+
+// indexedFile reads the records of a bgzipped and tabix indexed file around the positions that
+// are looked up. The chromosome has to be the first column and the position the second
+type indexedFile struct {
+	filename     string
+	index        *tabix.Index
+	window_chrom string
+	window_start int
+	window_end   int
+	records      map[int][]string // raw lines keyed by position
+}
+
+func open_indexed_file(filename string) (*indexedFile, error) {
+	index, index_err := tabix.ReadIndex(filename + ".tbi")
+	if index_err != nil {
+		return nil, fmt.Errorf("the annotation source %s needs a tabix index: %w", filename, index_err)
+	}
+	return &indexedFile{filename: filename, index: index}, nil
+}
+
+// records_at returns the lines of the records that start at the position
+func (file *indexedFile) records_at(chrom string, pos int) ([]string, error) {
+	canonical := contig.Canonical(chrom)
+	if canonical != file.window_chrom || pos < file.window_start || pos > file.window_end {
+		file.window_chrom = canonical
+		file.window_start = pos
+		file.window_end = pos + windowSize - 1
+		file.records = make(map[int][]string)
+
+		scan_err := file.index.ScanRegion(file.filename, chrom, file.window_start, file.window_end, recordBufferSize, func(split_line []string) error {
+			record_pos, _ := strconv.Atoi(split_line[1])
+			file.records[record_pos] = append(file.records[record_pos], strings.Join(split_line, "\t"))
+			return nil
+		})
+		if scan_err != nil {
+			// The window is cleared so that the next lookup tries to read it again
+			file.window_chrom = ""
+			return nil, fmt.Errorf("unable to read the annotations for %s:%d from %s: %w", chrom, pos, file.filename, scan_err)
+		}
+	}
+	return file.records[pos], nil
+}
+
+// read_header_lines returns the lines at the top of the file that start with #
+func read_header_lines(filename string) ([]string, error) {
+	reader := files.Open(filename, recordBufferSize)
+	defer reader.Close()
+	if reader.Err != nil {
+		return nil, reader.Err
+	}
+
+	var lines []string
+	for reader.FileScanner.Scan() {
+		line := reader.FileScanner.Text()
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		lines = append(lines, line)
+	}
+	return lines, reader.FileScanner.Err()
+}
+
+// vcf_allele_matches reports whether the vcf record has the ref allele and the alt allele. The
+// index of the alt allele in the ALT column is also returned for records with several alleles
+func vcf_allele_matches(split_line []string, ref string, alt string) (int, bool) {
+	if len(split_line) < 8 || !strings.EqualFold(split_line[3], ref) {
+		return 0, false
+	}
+	for indx, record_alt := range strings.Split(split_line[4], ",") {
+		if strings.EqualFold(record_alt, alt) {
+			return indx, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,77 @@
+package annotation
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TabixTable reads every column of a bgzipped and tabix indexed table like CADD or dbNSFP. The
+// column names come from the last header line that starts with #. If the table has REF and ALT
+// columns then only the rows for the same alleles are used, otherwise every row at the position is used
+type TabixTable struct {
+	file     *indexedFile
+	Columns  []string
+	ref_indx int
+	alt_indx int
+}
+
+func NewTabixTable(filename string) (*TabixTable, error) {
+	file, open_err := open_indexed_file(filename)
+	if open_err != nil {
+		return nil, open_err
+	}
+	header_lines, header_err := read_header_lines(filename)
+	if header_err != nil {
+		return nil, fmt.Errorf("unable to read the header of %s: %w", filename, header_err)
+	}
+	if len(header_lines) == 0 {
+		return nil, errors.New("the table " + filename + " needs a header line that starts with # so that the columns can be named")
+	}
+
+	columns := strings.Split(strings.TrimPrefix(header_lines[len(header_lines)-1], "#"), "\t")
+	table := &TabixTable{file: file, Columns: columns, ref_indx: -1, alt_indx: -1}
+	for indx, name := range columns {
+		switch strings.ToUpper(name) {
+		case "REF":
+			table.ref_indx = indx
+		case "ALT":
+			table.alt_indx = indx
+		}
+	}
+	return table, nil
+}
+
+func (table *TabixTable) Lookup(chrom string, pos int, ref string, alt string) (map[string]string, error) {
+	records, read_err := table.file.records_at(chrom, pos)
+	if read_err != nil {
+		return nil, read_err
+	}
+
+	var annotations map[string]string
+	for _, record := range records {
+		split_line := strings.Split(record, "\t")
+		if table.ref_indx >= 0 && (table.ref_indx >= len(split_line) || !strings.EqualFold(split_line[table.ref_indx], ref)) {
+			continue
+		}
+		if table.alt_indx >= 0 && (table.alt_indx >= len(split_line) || !strings.EqualFold(split_line[table.alt_indx], alt)) {
+			continue
+		}
+
+		// A position can have several matching rows (one for each transcript) so the values are joined like the VEP file
+		if annotations == nil {
+			annotations = make(map[string]string, len(table.Columns))
+		}
+		for indx, name := range table.Columns {
+			if indx >= len(split_line) {
+				break
+			}
+			if existing, found := annotations[name]; found {
+				annotations[name] = existing + ";" + split_line[indx]
+			} else {
+				annotations[name] = split_line[indx]
+			}
+		}
+	}
+	return annotations, nil
+}
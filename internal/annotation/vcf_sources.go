@@ -0,0 +1,179 @@
+package annotation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parse_info splits an INFO column into its keys and values. Flags are given the value "true"
+func parse_info(info string) map[string]string {
+	values := make(map[string]string)
+	for _, field := range strings.Split(info, ";") {
+		if field == "" || field == "." {
+			continue
+		}
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			value = "true"
+		}
+		values[key] = value
+	}
+	return values
+}
+
+// ClinVar reads the INFO fields of the ClinVar vcf (CLNSIG, CLNREVSTAT, CLNDN, GENEINFO, ...). The
+// ID column of the ClinVar vcf is the variation id so it is returned as CLINVAR_ID
+type ClinVar struct {
+	file *indexedFile
+}
+
+func NewClinVar(filename string) (*ClinVar, error) {
+	file, open_err := open_indexed_file(filename)
+	if open_err != nil {
+		return nil, open_err
+	}
+	return &ClinVar{file: file}, nil
+}
+
+func (source *ClinVar) Lookup(chrom string, pos int, ref string, alt string) (map[string]string, error) {
+	records, read_err := source.file.records_at(chrom, pos)
+	if read_err != nil {
+		return nil, read_err
+	}
+	for _, record := range records {
+		split_line := strings.Split(record, "\t")
+		if _, matched := vcf_allele_matches(split_line, ref, alt); !matched {
+			continue
+		}
+		values := parse_info(split_line[7])
+		values["CLINVAR_ID"] = split_line[2]
+		return values, nil
+	}
+	return nil, nil
+}
+
+// CSQ reads the consequence annotations that VEP (CSQ) or snpEff (ANN) writes into the INFO column
+// of an annotated vcf. The names of the subfields come from the Format in the header. Every
+// transcript is kept and the values of the transcripts are separated by ; like in the VEP file
+type CSQ struct {
+	file      *indexedFile
+	InfoKey   string
+	Subfields []string
+}
+
+// csq_subfields pulls the subfield names out of the description of the INFO field. VEP writes
+// "... Format: Allele|Consequence|..." and snpEff writes "Functional annotations: 'Allele | Annotation | ...'"
+func csq_subfields(header_lines []string, info_key string) ([]string, error) {
+	prefix := fmt.Sprintf("##INFO=<ID=%s,", info_key)
+	for _, line := range header_lines {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		_, description, found := strings.Cut(line, "Description=\"")
+		if !found {
+			break
+		}
+		description, _, _ = strings.Cut(description, "\"")
+		if _, format, has_format := strings.Cut(description, "Format: "); has_format {
+			description = format
+		} else if _, format, has_format := strings.Cut(description, ": "); has_format {
+			description = format
+		}
+
+		var subfields []string
+		for _, name := range strings.Split(strings.Trim(description, "' "), "|") {
+			subfields = append(subfields, strings.TrimSpace(name))
+		}
+		return subfields, nil
+	}
+	return nil, fmt.Errorf("the header does not define the INFO field %s", info_key)
+}
+
+func NewCSQ(filename string, info_key string) (*CSQ, error) {
+	file, open_err := open_indexed_file(filename)
+	if open_err != nil {
+		return nil, open_err
+	}
+	header_lines, header_err := read_header_lines(filename)
+	if header_err != nil {
+		return nil, fmt.Errorf("unable to read the header of %s: %w", filename, header_err)
+	}
+	subfields, subfield_err := csq_subfields(header_lines, info_key)
+	if subfield_err != nil {
+		return nil, fmt.Errorf("unable to find the consequence annotations in %s: %w", filename, subfield_err)
+	}
+	return &CSQ{file: file, InfoKey: info_key, Subfields: subfields}, nil
+}
+
+// vep_allele converts the alt allele to the way VEP writes it. VEP drops the base that the
+// ref and alt share at the start of an indel and writes deletions as -
+func vep_allele(ref string, alt string) string {
+	if (len(ref) > 1 || len(alt) > 1) && len(ref) > 0 && len(alt) > 0 && ref[0] == alt[0] {
+		if len(alt) == 1 {
+			return "-"
+		}
+		return alt[1:]
+	}
+	return alt
+}
+
+func (source *CSQ) Lookup(chrom string, pos int, ref string, alt string) (map[string]string, error) {
+	records, read_err := source.file.records_at(chrom, pos)
+	if read_err != nil {
+		return nil, read_err
+	}
+	for _, record := range records {
+		split_line := strings.Split(record, "\t")
+		alt_indx, matched := vcf_allele_matches(split_line, ref, alt)
+		if !matched {
+			continue
+		}
+		consequences, found := parse_info(split_line[7])[source.InfoKey]
+		if !found {
+			return nil, nil
+		}
+
+		columns := make(map[string][]string)
+		for _, entry := range strings.Split(consequences, ",") {
+			values := strings.Split(entry, "|")
+			if !source.entry_matches(values, alt_indx, vep_allele(ref, alt), alt) {
+				continue
+			}
+			for indx, name := range source.Subfields {
+				if indx < len(values) {
+					columns[name] = append(columns[name], values[indx])
+				}
+			}
+		}
+		if len(columns) == 0 {
+			return nil, nil
+		}
+
+		annotations := make(map[string]string, len(columns))
+		for name, values := range columns {
+			annotations[name] = strings.Join(values, ";")
+		}
+		return annotations, nil
+	}
+	return nil, nil
+}
+
+// entry_matches reports whether a transcript entry belongs to the alt allele. The ALLELE_NUM
+// subfield is used when VEP wrote it because the allele strings can be ambiguous for indels
+func (source *CSQ) entry_matches(values []string, alt_indx int, vep_alt string, alt string) bool {
+	for indx, name := range source.Subfields {
+		if indx >= len(values) {
+			break
+		}
+		switch name {
+		case "ALLELE_NUM":
+			if number, err := strconv.Atoi(values[indx]); err == nil {
+				return number == alt_indx+1
+			}
+		case "Allele":
+			return values[indx] == vep_alt || values[indx] == alt
+		}
+	}
+	return true
+}
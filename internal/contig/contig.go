@@ -0,0 +1,168 @@
+package contig
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Style describes how the chromosome names are written. Some of our callsets
+// use the UCSC style (chr22) while older VEP runs and GRCh37 references use
+// the Ensembl/NCBI style (22). If we don't reconcile the two then lookups
+// between the region, the VCF stream, and the annotation file silently fail
+type Style int
+
+const (
+	StyleAuto  Style = iota // leave names as they are and only reconcile them when comparing
+	StyleChr                // force names to have the chr prefix (chr22, chrX, chrM)
+	StyleNoChr              // force names to not have the chr prefix (22, X, MT)
+)
+
+func (style Style) String() string {
+	switch style {
+	case StyleChr:
+		return "chr"
+	case StyleNoChr:
+		return "no-chr"
+	default:
+		return "auto"
+	}
+}
+
+// ParseStyle converts the value of the --contig-style flag into a Style
+func ParseStyle(value string) (Style, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "auto":
+		return StyleAuto, nil
+	case "chr", "ucsc":
+		return StyleChr, nil
+	case "no-chr", "nochr", "numeric", "ensembl":
+		return StyleNoChr, nil
+	default:
+		return StyleAuto, fmt.Errorf("the contig style %s is not recognized. Allowed values are 'auto', 'chr', or 'no-chr'", value)
+	}
+}
+
+// Canonical returns the chromosome name without the chr prefix. The
+// mitochondrial contig is called chrM by UCSC and MT by Ensembl so we map both
+// of these to MT. This value should only be used for comparisons
+func Canonical(name string) string {
+	trimmed := strings.TrimSpace(name)
+
+	if len(trimmed) > 3 && strings.EqualFold(trimmed[:3], "chr") {
+		trimmed = trimmed[3:]
+	}
+
+	if strings.EqualFold(trimmed, "M") || strings.EqualFold(trimmed, "MT") {
+		return "MT"
+	}
+	return trimmed
+}
+
+// Same reports whether the two names refer to the same chromosome regardless of the naming style
+func Same(first string, second string) bool {
+	return Canonical(first) == Canonical(second)
+}
+
+// DetectStyle determines what naming style a chromosome name uses
+func DetectStyle(name string) Style {
+	trimmed := strings.TrimSpace(name)
+	if len(trimmed) > 3 && strings.EqualFold(trimmed[:3], "chr") {
+		return StyleChr
+	}
+	return StyleNoChr
+}
+
+// Apply rewrites the chromosome name so that it follows the requested style. If the
+// style is StyleAuto then the name is returned unchanged
+func Apply(name string, style Style) string {
+	switch style {
+	case StyleChr:
+		canonical := Canonical(name)
+		if canonical == "MT" {
+			return "chrM"
+		}
+		return "chr" + canonical
+	case StyleNoChr:
+		return Canonical(name)
+	default:
+		return name
+	}
+}
+
+// looksLikeContig checks if the value is one of the standard human chromosome
+// names. We need this check so that we don't mangle IDs like rs12345 or
+// custom IDs that happen to have an underscore in them
+func looksLikeContig(value string) bool {
+	canonical := Canonical(value)
+
+	switch strings.ToUpper(canonical) {
+	case "X", "Y", "MT":
+		return true
+	}
+
+	if canonical == "" || len(canonical) > 2 {
+		return false
+	}
+
+	for _, r := range canonical {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// RewriteVariantID rewrites the contig portion of variant IDs like
+// chr22_23456789_A/G or 22:23456789:A:G so that it follows the requested style.
+// IDs that don't start with a chromosome name (such as rsIDs) are returned unchanged
+func RewriteVariantID(id string, style Style) string {
+	sep_indx := strings.IndexAny(id, ":_-")
+	if sep_indx <= 0 || !looksLikeContig(id[:sep_indx]) {
+		return id
+	}
+
+	var contig_name string
+	if style == StyleAuto {
+		contig_name = Canonical(id[:sep_indx])
+	} else {
+		contig_name = Apply(id[:sep_indx], style)
+	}
+	return contig_name + id[sep_indx:]
+}
+
+// VariantKey generates the key that we use to match variant IDs between the VCF
+// stream and the annotation file. The contig portion of the ID is always
+// written without the chr prefix so that both naming styles generate the same key
+func VariantKey(id string) string {
+	return RewriteVariantID(id, StyleAuto)
+}
+
+// rank orders the chromosomes as 1-22, X, Y, MT. Other contigs (alt contigs, decoys) come afterwards
+func rank(name string) (int, string) {
+	canonical := Canonical(name)
+	if number, err := strconv.Atoi(canonical); err == nil {
+		return number, ""
+	}
+	switch strings.ToUpper(canonical) {
+	case "X":
+		return 1000, ""
+	case "Y":
+		return 1001, ""
+	case "MT":
+		return 1002, ""
+	default:
+		return 2000, canonical
+	}
+}
+
+// Compare orders two chromosome names in karyotype order regardless of the naming style. It
+// returns a negative number when first comes before second, 0 when they are the same chromosome, and a positive number otherwise
+func Compare(first string, second string) int {
+	first_rank, first_name := rank(first)
+	second_rank, second_name := rank(second)
+	if first_rank != second_rank {
+		return first_rank - second_rank
+	}
+	return strings.Compare(first_name, second_name)
+}
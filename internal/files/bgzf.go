@@ -0,0 +1,176 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// bgzfHeaderSize is the size of the gzip header of a BGZF block. The 12 fixed bytes are followed by
+// the 6 bytes of the BC subfield that has the size of the block
+const bgzfHeaderSize = 18
+
+// bgzfMaxBlock is the largest a BGZF block (compressed or not) can be
+const bgzfMaxBlock = 64 * 1024
+
+// bgzfBlock is one block that is waiting to be decompressed (or to be read once it is)
+type bgzfBlock struct {
+	compressed []byte
+	data       []byte
+	err        error
+	done       chan struct{}
+}
+
+// BGZFReader decompresses the blocks of a bgzipped stream in parallel. Every BGZF block is a
+// complete gzip member of at most 64KB so, unlike the blocks of a plain gzip stream, the blocks
+// don't depend on each other. The blocks are decompressed by Threads goroutines and read back in
+// the order of the file
+type BGZFReader struct {
+	order   chan *bgzfBlock // the blocks in the order of the file
+	current *bgzfBlock
+	offset  int
+	stop    chan struct{}
+	stopped sync.Once
+	err     error
+}
+
+// NewBGZFReader starts decompressing the blocks of the reader with the number of threads. A few
+// blocks for each thread are read ahead of the caller
+func NewBGZFReader(reader io.Reader, threads int) *BGZFReader {
+	threads = max(threads, 1)
+	bgzf := &BGZFReader{order: make(chan *bgzfBlock, threads*4), stop: make(chan struct{})}
+	jobs := make(chan *bgzfBlock, threads*4)
+	for range threads {
+		go inflate_blocks(jobs)
+	}
+	go bgzf.read_blocks(bufio.NewReaderSize(reader, bgzfMaxBlock), jobs)
+	return bgzf
+}
+
+// read_blocks cuts the stream into blocks and hands them to the workers and the reader
+func (bgzf *BGZFReader) read_blocks(reader *bufio.Reader, jobs chan<- *bgzfBlock) {
+	defer close(jobs)
+	defer close(bgzf.order)
+	for {
+		compressed, read_err := read_bgzf_block(reader)
+		if read_err == io.EOF {
+			return
+		}
+		block := &bgzfBlock{compressed: compressed, err: read_err, done: make(chan struct{})}
+		if read_err != nil {
+			close(block.done)
+		}
+		select {
+		case bgzf.order <- block:
+		case <-bgzf.stop:
+			return
+		}
+		if read_err != nil {
+			return
+		}
+		select {
+		case jobs <- block:
+		case <-bgzf.stop:
+			return
+		}
+	}
+}
+
+// read_bgzf_block reads the next block with its header and footer. io.EOF is only returned at the end of a block
+func read_bgzf_block(reader *bufio.Reader) ([]byte, error) {
+	header, peek_err := reader.Peek(bgzfHeaderSize)
+	if len(header) == 0 && peek_err == io.EOF {
+		return nil, io.EOF
+	}
+	if peek_err != nil {
+		return nil, fmt.Errorf("the bgzipped stream ended in the middle of a block header: %w", io.ErrUnexpectedEOF)
+	}
+	if detect_format(header) != BGZF {
+		return nil, errors.New("found a gzip block without the BGZF size field. The file is gzipped but not bgzipped")
+	}
+	// The first subfield of bgzip output is BC. The block size is stored minus 1
+	block_size := int(binary.LittleEndian.Uint16(header[16:18])) + 1
+	if block_size < bgzfHeaderSize+8 {
+		return nil, fmt.Errorf("found a BGZF block with a size of %d bytes which is too small to hold its header and footer", block_size)
+	}
+	block := make([]byte, block_size)
+	if _, read_err := io.ReadFull(reader, block); read_err != nil {
+		return nil, fmt.Errorf("the bgzipped stream ended in the middle of a block: %w", io.ErrUnexpectedEOF)
+	}
+	return block, nil
+}
+
+// inflate_blocks decompresses the blocks until there are no more jobs. The flate reader is reused
+func inflate_blocks(jobs <-chan *bgzfBlock) {
+	var inflater io.ReadCloser
+	for block := range jobs {
+		block.data, block.err = inflate_block(block.compressed, &inflater)
+		block.compressed = nil
+		close(block.done)
+	}
+}
+
+// inflate_block decompresses one block and checks it against the CRC and the size in its footer
+func inflate_block(block []byte, inflater *io.ReadCloser) ([]byte, error) {
+	extra_size := int(binary.LittleEndian.Uint16(block[10:12]))
+	data_start := 12 + extra_size
+	if len(block) < data_start+8 {
+		return nil, errors.New("found a BGZF block that is too short to hold its data")
+	}
+	footer := block[len(block)-8:]
+	expected_crc := binary.LittleEndian.Uint32(footer[:4])
+	expected_size := int(binary.LittleEndian.Uint32(footer[4:]))
+	if expected_size > bgzfMaxBlock {
+		return nil, fmt.Errorf("found a BGZF block that claims to hold %d bytes", expected_size)
+	}
+
+	compressed := bytes.NewReader(block[data_start : len(block)-8])
+	if *inflater == nil {
+		*inflater = flate.NewReader(compressed)
+	} else if reset_err := (*inflater).(flate.Resetter).Reset(compressed, nil); reset_err != nil {
+		return nil, reset_err
+	}
+	data := make([]byte, expected_size)
+	if _, read_err := io.ReadFull(*inflater, data); read_err != nil {
+		return nil, fmt.Errorf("unable to decompress a BGZF block: %w", read_err)
+	}
+	if crc32.ChecksumIEEE(data) != expected_crc {
+		return nil, errors.New("a BGZF block failed its CRC check. The file is corrupt")
+	}
+	return data, nil
+}
+
+func (bgzf *BGZFReader) Read(p []byte) (int, error) {
+	for bgzf.current == nil || bgzf.offset == len(bgzf.current.data) {
+		if bgzf.err != nil {
+			return 0, bgzf.err
+		}
+		block, more := <-bgzf.order
+		if !more {
+			bgzf.err = io.EOF
+			return 0, io.EOF
+		}
+		<-block.done
+		if block.err != nil {
+			bgzf.err = block.err
+			return 0, block.err
+		}
+		bgzf.current, bgzf.offset = block, 0
+	}
+	read := copy(p, bgzf.current.data[bgzf.offset:])
+	bgzf.offset += read
+	return read, nil
+}
+
+// Close stops reading ahead. The reader that the blocks come from is not closed
+func (bgzf *BGZFReader) Close() error {
+	bgzf.stopped.Do(func() { close(bgzf.stop) })
+	return nil
+}
@@ -0,0 +1,63 @@
+package files
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// bgzip writes the data as BGZF blocks of block_size bytes followed by the empty block that bgzip ends a file with
+func bgzip(data []byte, block_size int) []byte {
+	var output bytes.Buffer
+	for start := 0; ; start += block_size {
+		chunk := data[min(start, len(data)):min(start+block_size, len(data))]
+		var block bytes.Buffer
+		gw := gzip.NewWriter(&block)
+		gw.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+		gw.Write(chunk)
+		gw.Close()
+		// The BC subfield holds the size of the whole block minus 1
+		binary.LittleEndian.PutUint16(block.Bytes()[16:18], uint16(block.Len()-1))
+		output.Write(block.Bytes())
+		if len(chunk) == 0 {
+			return output.Bytes()
+		}
+	}
+}
+
+func TestBGZFReader(t *testing.T) {
+	contents := []byte(strings.Repeat("chr22\t100\tvar1\tA\tG\n", 5000))
+	bgzipped := bgzip(contents, 4096)
+
+	for _, threads := range []int{1, 4} {
+		reader := NewBGZFReader(bytes.NewReader(bgzipped), threads)
+		read, read_err := io.ReadAll(reader)
+		reader.Close()
+		if read_err != nil || !bytes.Equal(read, contents) {
+			t.Errorf("%d threads read %d of the %d bytes (%v)", threads, len(read), len(contents), read_err)
+		}
+	}
+
+	// Flipping a byte of the CRC in the footer of the first block has to fail the read
+	corrupt := bytes.Clone(bgzipped)
+	first_block := int(binary.LittleEndian.Uint16(corrupt[16:18])) + 1
+	corrupt[first_block-8] ^= 0xff
+	if _, read_err := io.ReadAll(NewBGZFReader(bytes.NewReader(corrupt), 2)); read_err == nil {
+		t.Errorf("expected an error for a block with the wrong CRC")
+	}
+
+	// A gzip member with a BC subfield but a size that can't hold a block is an error and not a panic
+	truncated := bytes.Clone(bgzipped)
+	binary.LittleEndian.PutUint16(truncated[16:18], 0)
+	if _, read_err := io.ReadAll(NewBGZFReader(bytes.NewReader(truncated), 2)); read_err == nil {
+		t.Errorf("expected an error for a block with a size of 1 byte")
+	}
+
+	// The stream ending in the middle of a block is unexpected
+	if _, read_err := io.ReadAll(NewBGZFReader(bytes.NewReader(bgzipped[:first_block+10]), 2)); read_err == nil {
+		t.Errorf("expected an error for a stream that was cut off in a block")
+	}
+}
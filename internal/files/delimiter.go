@@ -0,0 +1,75 @@
+package files
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strings"
+)
+
+// The delimiters of the input tables. Whitespace splits on any run of spaces and tabs
+const (
+	Tab        = "\t"
+	Comma      = ","
+	Whitespace = " "
+)
+
+// forcedDelimiter is the delimiter from --delimiter. An empty value means that the delimiter of each
+// table is detected from its first line
+var forcedDelimiter = ""
+
+// SetDelimiter sets the delimiter of the annotation, phenotype, and samples tables. The value can
+// be auto, tab, comma, or whitespace
+func SetDelimiter(value string) error {
+	switch strings.ToLower(value) {
+	case "", "auto":
+		forcedDelimiter = ""
+	case "tab", "tsv", `\t`:
+		forcedDelimiter = Tab
+	case "comma", "csv", ",":
+		forcedDelimiter = Comma
+	case "whitespace", "space":
+		forcedDelimiter = Whitespace
+	default:
+		return fmt.Errorf("unrecognized delimiter %s. The delimiter has to be auto, tab, comma, or whitespace", value)
+	}
+	return nil
+}
+
+// DetectDelimiter finds the delimiter of a table from its header (or first) line. Tabs win over
+// commas because VEP puts commas inside of the Consequence column. Tables exported from Excel as
+// CSV otherwise end up as a single column. A line without tabs or commas is split on whitespace
+func DetectDelimiter(line string) string {
+	if forcedDelimiter != "" {
+		return forcedDelimiter
+	}
+	switch {
+	case strings.Contains(line, Tab):
+		return Tab
+	case strings.Contains(line, Comma):
+		return Comma
+	case len(strings.Fields(line)) > 1:
+		return Whitespace
+	default:
+		return Tab
+	}
+}
+
+// SplitFields splits a line of a table on the delimiter. Comma separated lines with quotes are
+// parsed as CSV so that quoted values can have commas in them
+func SplitFields(line string, delimiter string) []string {
+	switch delimiter {
+	case Whitespace:
+		return strings.Fields(line)
+	case Comma:
+		if strings.Contains(line, `"`) {
+			reader := csv.NewReader(strings.NewReader(line))
+			reader.LazyQuotes = true
+			if fields, parse_err := reader.Read(); parse_err == nil {
+				return fields
+			}
+		}
+		return strings.Split(line, Comma)
+	default:
+		return strings.Split(line, delimiter)
+	}
+}
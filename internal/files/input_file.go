@@ -2,12 +2,18 @@ package files
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"runtime"
+	"slices"
 	"strings"
 
+	"go-phers-parser/internal/header"
+
 	gzip "github.com/klauspost/pgzip"
 )
 
@@ -28,7 +34,30 @@ type FileReader struct {
 	Header_col_indx map[string]int
 	Header_Found    bool
 	Col_count       int
+	HeaderLines     int // number of lines read while looking for the header line (including the header line)
 	Handles         []io.Closer
+	Lines           *LineLimit  // the longest line that the scanner can read
+	Delimiter       string      // the delimiter of the columns. Tab unless AutoDelimiter found a different one
+	AutoDelimiter   bool        // detect the delimiter from the header line for tables that users make themselves
+	MetaLines       []string    // the "##" lines that came before the header line
+	Format          InputFormat // the compression that Open found from the first bytes of the input
+	Index           string      // the .tbi index next to a bgzipped input. Empty if there isn't one
+}
+
+// Split splits a line of the file into its columns
+func (fr *FileReader) Split(line string) []string {
+	if fr.Delimiter == "" {
+		return strings.Split(line, Tab)
+	}
+	return SplitFields(line, fr.Delimiter)
+}
+
+// header_delimiter picks the delimiter of the header line
+func (fr *FileReader) header_delimiter(line string) string {
+	if fr.AutoDelimiter {
+		return DetectDelimiter(line)
+	}
+	return Tab
 }
 
 func (fr FileReader) CheckErrors() {
@@ -43,10 +72,28 @@ func (fr FileReader) CheckErrors() {
 	os.Exit(1)
 }
 
-func mapHeader(header_line string) (map[string]int, int) {
+// Close closes the handles of the file in the reverse order that they were opened so the
+// decompressor is closed before the file that it reads from. Handles that were never opened (the
+// file couldn't be opened or decompressed) are skipped and the reader from standard input has no
+// handles, so Close is always safe to defer. Calling Close again does nothing. The first error is returned
+func (fr *FileReader) Close() error {
+	var first_err error
+	for indx := len(fr.Handles) - 1; indx >= 0; indx-- {
+		if fr.Handles[indx] == nil {
+			continue
+		}
+		if close_err := fr.Handles[indx].Close(); close_err != nil && first_err == nil {
+			first_err = fmt.Errorf("unable to close the file %s: %w", fr.Filename, close_err)
+		}
+	}
+	fr.Handles = nil
+	return first_err
+}
+
+func mapHeader(header_line string, delimiter string) (map[string]int, int) {
 	column_mappings := make(map[string]int)
 
-	column_list := strings.Split(strings.TrimSpace(header_line), "\t")
+	column_list := SplitFields(strings.TrimSpace(header_line), delimiter)
 
 	for indx, value := range column_list {
 		column_mappings[value] = indx
@@ -57,9 +104,15 @@ func mapHeader(header_line string) (map[string]int, int) {
 
 func (fr *FileReader) ParseHeader(headerIdentified string) error {
 	for fr.FileScanner.Scan() {
+		fr.HeaderLines++
 		line := fr.FileScanner.Text()
-		if strings.Contains(line, headerIdentified) {
-			col_indx, col_count := mapHeader(line)
+		if strings.HasPrefix(line, "##") && !strings.HasPrefix(headerIdentified, "##") {
+			fr.MetaLines = append(fr.MetaLines, line)
+			continue
+		}
+		if strings.HasPrefix(line, headerIdentified) {
+			fr.Delimiter = fr.header_delimiter(line)
+			col_indx, col_count := mapHeader(line, fr.Delimiter)
 			// We will need to use the column indices and the col count later
 			fr.Header_col_indx = col_indx
 			fr.Col_count = col_count
@@ -74,88 +127,181 @@ func (fr *FileReader) ParseHeader(headerIdentified string) error {
 	return nil
 }
 
-// Handle the creation of the file reader and the creation of a bufio.Scanner
-func MakeCompressedFileReader(filename string, buffersize int) *FileReader {
-	handles := make([]io.Closer, 2)
-
-	fh, open_err := os.Open(filename)
-
-	if open_err != nil {
-		return &FileReader{Filename: filename, FileScanner: nil, Err: fmt.Errorf("encountered the following error while opening the file: %w", open_err), Handles: handles, Header_Found: false}
+// ParseHeaderWithColumns finds the header line of a table that doesn't start with a fixed
+// phrase. The header is the first line that has every one of the columns. A leading # on the
+// header line is ignored when the columns are compared
+func (fr *FileReader) ParseHeaderWithColumns(columns []string) error {
+	for fr.FileScanner.Scan() {
+		fr.HeaderLines++
+		line := fr.FileScanner.Text()
+		delimiter := fr.header_delimiter(line)
+		fields := SplitFields(strings.TrimPrefix(strings.TrimSpace(line), "#"), delimiter)
+		found_all := true
+		for _, column := range columns {
+			if !slices.Contains(fields, column) {
+				found_all = false
+				break
+			}
+		}
+		if found_all {
+			fr.Delimiter = delimiter
+			col_indx, col_count := mapHeader(strings.TrimPrefix(line, "#"), delimiter)
+			fr.Header_col_indx = col_indx
+			fr.Col_count = col_count
+			fr.Header_Found = true
+			break
+		}
 	}
-
-	handles[0] = fh
-
-	gh, gzip_err := gzip.NewReader(fh)
-
-	if gzip_err != nil {
-		return &FileReader{Filename: filename, FileScanner: nil, Err: fmt.Errorf("encountered the following error while trying to decompress the file: %w", gzip_err), Handles: handles, Header_Found: false}
+	if fr.FileScanner.Err() != nil {
+		return fr.FileScanner.Err()
 	}
+	return nil
+}
 
-	handles[1] = gh
-
-	buf := make([]byte, 0, buffersize)
+// InputFormat is the compression of an input. It is found from the first bytes of the input so
+// the extension of the file doesn't matter
+type InputFormat string
 
-	scanner := bufio.NewScanner(gh)
+const (
+	PlainText InputFormat = "plain"
+	Gzip      InputFormat = "gzip"
+	BGZF      InputFormat = "bgzip" // gzip made of independent blocks that can be seeked with a tabix index
+)
 
-	scanner.Buffer(buf, buffersize)
+// gzipMagic starts every gzip stream. BGZF files also set the FEXTRA flag and have a "BC" extra
+// subfield with the size of the block
+var gzipMagic = []byte{0x1f, 0x8b}
 
-	return &FileReader{Filename: filename, FileScanner: scanner, Err: nil, Handles: handles, Header_Found: false}
+// detect_format finds the compression of the input from the header of its first gzip member
+func detect_format(start []byte) InputFormat {
+	if !bytes.HasPrefix(start, gzipMagic) {
+		return PlainText
+	}
+	if len(start) >= 14 && start[3]&0x04 != 0 && start[12] == 'B' && start[13] == 'C' {
+		return BGZF
+	}
+	return Gzip
 }
 
-// Handle the creation of the file reader and the creation of a bufio.Scanner
-func MakeFileReader(filename string, buffersize int) *FileReader {
-	handles := make([]io.Closer, 1)
-	fh, open_err := os.Open(filename)
+// DecompressionOptions controls the readers of the gzipped and bgzipped inputs. Decompression is
+// usually the slowest part of reading the annotation file so it can be tuned to the machine
+type DecompressionOptions struct {
+	BlockSize int // bytes in each block that pgzip reads ahead for a gzipped input
+	Threads   int // blocks of a bgzipped input that are decompressed at the same time and blocks that pgzip reads ahead
+}
 
-	if open_err != nil {
-		return &FileReader{Filename: filename, FileScanner: nil, Err: fmt.Errorf("encountered the following error while opening the file: %w", open_err), Handles: handles, Header_Found: false}
+// Decompression is used for every compressed input. The block size is the default of pgzip
+var Decompression = DecompressionOptions{BlockSize: 1 << 20, Threads: runtime.GOMAXPROCS(0)}
+
+// SetDecompression changes the block size and the threads of the compressed inputs. A block size
+// of 0 keeps the default and 0 threads uses one thread for each CPU that the program can use
+// (GOMAXPROCS) like SetCompression
+func SetDecompression(block_size int, threads int) error {
+	if block_size != 0 {
+		// pgzip silently uses its default for blocks this small
+		if block_size <= 512 {
+			return fmt.Errorf("the decompression block size has to be larger than 512 bytes but it was %d", block_size)
+		}
+		Decompression.BlockSize = block_size
 	}
+	if threads < 0 {
+		return fmt.Errorf("the number of decompression threads has to be at least 1 but it was %d", threads)
+	}
+	Decompression.Threads = cmp.Or(threads, runtime.GOMAXPROCS(0))
+	return nil
+}
 
-	handles[0] = fh
-
-	buf := make([]byte, 0, buffersize)
-
-	scanner := bufio.NewScanner(fh)
-
-	scanner.Buffer(buf, buffersize)
-
-	return &FileReader{Filename: filename, FileScanner: scanner, Err: nil, Handles: handles, Header_Found: false}
+// new_decompressor creates the reader for a compressed input. The blocks of a bgzipped input are
+// decompressed in parallel. A plain gzip stream has to be decompressed in order so pgzip only
+// reads ahead in blocks of Decompression.BlockSize
+func new_decompressor(reader io.Reader, format InputFormat) (io.ReadCloser, error) {
+	if format == BGZF && Decompression.Threads > 1 {
+		return NewBGZFReader(reader, Decompression.Threads), nil
+	}
+	return gzip.NewReaderN(reader, Decompression.BlockSize, max(Decompression.Threads, 2))
 }
 
-func MakeStreamReader(buffersize int) *VCFReader {
-	buf := make([]byte, 0, buffersize)
+// Open creates the reader for an input. The spec can be "-" for standard input, a local path, or
+// an http(s), s3, or gs url. Gzipped and bgzipped inputs are decompressed (including standard
+// input) no matter what the extension is. If a bgzipped input has a .tbi index next to it then the
+// path of the index is in Index. Errors are reported in the Err field like the rest of the FileReader
+// and Close is safe to call even if the input couldn't be opened
+func Open(spec string, buffersize int) *FileReader {
+	fr := &FileReader{Filename: spec, Format: PlainText}
+
+	var source io.Reader
+	if spec == "-" {
+		// standard input is never closed by us
+		fr.Filename = "standard input"
+		source = Stdin()
+	} else {
+		fh, open_err := OpenSource(spec)
+		if open_err != nil {
+			fr.Err = fmt.Errorf("encountered the following error while opening the file: %w", open_err)
+			return fr
+		}
+		fr.Handles = append(fr.Handles, fh)
+		source = fh
+	}
 
-	stdin_streamer := bufio.NewScanner(os.Stdin)
+	buffered := bufio.NewReader(source)
+	// A short input (or one that fails to read) can't be compressed so the errors show up when it is scanned
+	start, _ := buffered.Peek(18)
+	fr.Format = detect_format(start)
+	if fr.Format == PlainText {
+		fr.FileScanner, fr.Lines = NewLineScanner(buffered, buffersize)
+		return fr
+	}
 
-	stdin_streamer.Buffer(buf, buffersize)
+	gh, gzip_err := new_decompressor(buffered, fr.Format)
+	if gzip_err != nil {
+		fr.Err = fmt.Errorf("encountered the following error while trying to decompress the file: %w", gzip_err)
+		return fr
+	}
+	fr.Handles = append(fr.Handles, gh)
+	fr.FileScanner, fr.Lines = NewLineScanner(gh, buffersize)
 
-	fileReader := FileReader{
-		Filename:    "standard input",
-		FileScanner: stdin_streamer,
-		Err:         nil,
-		Handles:     nil,
+	if fr.Format == BGZF && spec != "-" {
+		if index_fh, index_err := OpenSource(spec + ".tbi"); index_err == nil {
+			index_fh.Close()
+			fr.Index = spec + ".tbi"
+		}
 	}
+	return fr
+}
 
-	return &VCFReader{FileReader: fileReader}
+func MakeStreamReader(buffersize int) *VCFReader {
+	return &VCFReader{FileReader: *Open("-", buffersize)}
 }
 
 type VCFReader struct {
 	FileReader
+	Metadata         header.Metadata // information from the "##" lines of the header
 	SampleMapping    map[int]string
-	SampleExclusions []string // Sometimes in VCF files there are samples that we want to ignore (reference panel samples or invalid samples). This attribute will help us ignore them
+	SampleExclusions []string                    // Sometimes in VCF files there are samples that we want to ignore (reference panel samples or invalid samples). This attribute will help us ignore them
+	SampleFilter     func(sample_id string) bool // only the samples that pass the filter are mapped (such as the samples of --samples). nil keeps every sample
+	SampleColumns    []int                       // the columns of the SampleMapping in the order of the header so the records only read these columns
 }
 
 func (vcfReader *VCFReader) ParseHeader(header_identifier string) error {
 	for vcfReader.FileScanner.Scan() {
+		vcfReader.HeaderLines++
 		line := vcfReader.FileScanner.Text()
-		if strings.Contains(line, header_identifier) {
-			col_indx, col_count := mapHeader(line)
+		if strings.HasPrefix(line, "##") {
+			vcfReader.Metadata.AddLine(line)
+			continue
+		}
+		if strings.HasPrefix(line, header_identifier) {
+			col_indx, col_count := mapHeader(line, Tab)
 			// We will need to use the column indices and the col count later
 			vcfReader.Header_col_indx = col_indx
 			vcfReader.Col_count = col_count
 			// Now we also have to map the sample ids where the key is the indx and the value is the column label
-			vcfReader.SampleMapping = mapSamples(line, vcfReader.SampleExclusions)
+			vcfReader.SampleMapping, vcfReader.SampleColumns = mapSamples(line, vcfReader.SampleExclusions, vcfReader.SampleFilter)
+			// Now that we know how many samples there are we can size the buffer for the records
+			if vcfReader.Lines != nil {
+				vcfReader.Lines.SetSamples(max(col_count-9, 0))
+			}
 			// We also need to update that the header was found
 			vcfReader.Header_Found = true
 			break
@@ -167,10 +313,32 @@ func (vcfReader *VCFReader) ParseHeader(header_identifier string) error {
 	return nil
 }
 
+// ParseSampleExclusions splits the comma separated --sample-exclusion-string into the substrings
+// that VCFReader.SampleExclusions expects. The sample ids are lowercased before they are compared
+// so the substrings are lowercased too. Spaces around the substrings and empty substrings are dropped
+func ParseSampleExclusions(value string) []string {
+	var exclusions []string
+	for _, substring := range strings.Split(value, ",") {
+		if substring = strings.ToLower(strings.TrimSpace(substring)); substring != "" {
+			exclusions = append(exclusions, substring)
+		}
+	}
+	return exclusions
+}
+
+// ExcludedSamples returns the number of sample columns in the header that were skipped because of the SampleExclusions or the SampleFilter
+func (vcfReader *VCFReader) ExcludedSamples() int {
+	return max(vcfReader.Col_count-9, 0) - len(vcfReader.SampleMapping)
+}
+
 func checkSkipSamples(sampleID string, skipWordsList []string) bool {
 	var skipword bool
 
 	for _, val := range skipWordsList {
+		// An empty exclusion string (from splitting an empty flag value) is in every id so it would skip every sample
+		if val == "" {
+			continue
+		}
 		if strings.Contains(strings.ToLower(sampleID), val) {
 			skipword = true
 			break
@@ -181,19 +349,21 @@ func checkSkipSamples(sampleID string, skipWordsList []string) bool {
 
 // Because we stream in the vcf file, we need a way to keep track of
 // what columns have the sample ids. We can store the indices in a map
-// so that we can get the id later
-func mapSamples(header_line string, skipWords []string) map[int]string {
+// so that we can get the id later. The columns are also returned in order
+func mapSamples(header_line string, skipWords []string, keep func(string) bool) (map[int]string, []int) {
 	samplesMap := make(map[int]string)
+	var columns []int
 
 	split_line := strings.Split(strings.TrimSpace(header_line), "\t")
 
 	for indx, ind_id := range split_line[9:] {
-		if checkSkipSamples(ind_id, skipWords) {
+		if checkSkipSamples(ind_id, skipWords) || (keep != nil && !keep(ind_id)) {
 			continue
 		}
 		person_pos := indx + 9
 		samplesMap[person_pos] = ind_id
+		columns = append(columns, person_pos)
 	}
 
-	return samplesMap
+	return samplesMap, columns
 }
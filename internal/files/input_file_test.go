@@ -0,0 +1,161 @@
+package files
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// recordingCloser remembers the order that the handles were closed in
+type recordingCloser struct {
+	name   string
+	closed *[]string
+	err    error
+}
+
+func (closer recordingCloser) Close() error {
+	*closer.closed = append(*closer.closed, closer.name)
+	return closer.err
+}
+
+func TestFileReaderCloseOrder(t *testing.T) {
+	var closed []string
+	close_err := errors.New("already closed")
+	fr := &FileReader{Filename: "calls.vcf.gz", Handles: []io.Closer{
+		recordingCloser{"file", &closed, nil},
+		nil,
+		recordingCloser{"gzip", &closed, close_err},
+	}}
+
+	// The decompressor is closed before the file and the nil handle is skipped
+	if err := fr.Close(); !errors.Is(err, close_err) {
+		t.Errorf("expected the error from closing the gzip handle but got %v", err)
+	}
+	if !slices.Equal(closed, []string{"gzip", "file"}) {
+		t.Errorf("closed the handles in the order %q but expected gzip then file", closed)
+	}
+
+	// A second Close doesn't close the handles again
+	if err := fr.Close(); err != nil || len(closed) != 2 {
+		t.Errorf("the second Close returned %v and closed %q", err, closed)
+	}
+	// A reader without any handles (standard input) has nothing to close
+	if err := (&FileReader{Filename: "standard input"}).Close(); err != nil {
+		t.Errorf("unexpected error closing the standard input reader: %s", err)
+	}
+}
+
+// open_fds counts the file descriptors of the test process
+func open_fds(t *testing.T) int {
+	t.Helper()
+	entries, read_err := os.ReadDir("/proc/self/fd")
+	if read_err != nil {
+		t.Skip("unable to count the open file descriptors on this platform")
+	}
+	return len(entries)
+}
+
+func TestFileReaderCloseLeaks(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "calls.txt")
+	if err := os.WriteFile(plain, []byte("#CHROM\tPOS\nchr1\t100\n"), 0644); err != nil {
+		t.Fatalf("unable to write the fixture: %s", err)
+	}
+	compressed := filepath.Join(dir, "calls.txt.gz")
+	fh, create_err := os.Create(compressed)
+	if create_err != nil {
+		t.Fatalf("unable to write the fixture: %s", create_err)
+	}
+	gw := gzip.NewWriter(fh)
+	gw.Write([]byte("#CHROM\tPOS\nchr1\t100\n"))
+	gw.Close()
+	fh.Close()
+	// A file that starts like a gzip file but is cut off fails after the file was opened
+	not_gzipped := filepath.Join(dir, "broken.txt.gz")
+	if err := os.WriteFile(not_gzipped, []byte{0x1f, 0x8b, 0x08}, 0644); err != nil {
+		t.Fatalf("unable to write the fixture: %s", err)
+	}
+
+	cases := []struct {
+		filename string
+		fails    bool
+	}{
+		{plain, false},
+		{compressed, false},
+		{not_gzipped, true},
+		{filepath.Join(dir, "missing.txt"), true},
+	}
+	for _, test_case := range cases {
+		before := open_fds(t)
+		for range 20 {
+			fr := Open(test_case.filename, 1024)
+			if (fr.Err != nil) != test_case.fails {
+				t.Fatalf("opening %s returned the error %v", test_case.filename, fr.Err)
+			}
+			if fr.Err == nil {
+				if header_err := fr.ParseHeader("#CHROM"); header_err != nil || !fr.Header_Found {
+					t.Fatalf("unable to read the header of %s: %v", test_case.filename, header_err)
+				}
+			}
+			if close_err := fr.Close(); close_err != nil {
+				t.Errorf("unexpected error closing %s: %s", test_case.filename, close_err)
+			}
+		}
+		if after := open_fds(t); after != before {
+			t.Errorf("%d file descriptors were left open after reading %s", after-before, filepath.Base(test_case.filename))
+		}
+	}
+}
+
+func TestOpenDetectsFormat(t *testing.T) {
+	dir := t.TempDir()
+	contents := "#CHROM\tPOS\nchr1\t100\n"
+	write_gzip := func(filename string, extra []byte) {
+		fh, create_err := os.Create(filename)
+		if create_err != nil {
+			t.Fatalf("unable to write the fixture: %s", create_err)
+		}
+		gw := gzip.NewWriter(fh)
+		gw.Extra = extra
+		gw.Write([]byte(contents))
+		gw.Close()
+		fh.Close()
+	}
+
+	// The extension doesn't decide the format. A plain file named .gz is still read as plain text
+	plain := filepath.Join(dir, "calls.txt.gz")
+	os.WriteFile(plain, []byte(contents), 0644)
+	gzipped := filepath.Join(dir, "calls.txt")
+	write_gzip(gzipped, nil)
+	// BGZF blocks have a BC subfield with the size of the block in the gzip header
+	bgzipped := filepath.Join(dir, "calls.vcf.gz")
+	os.WriteFile(bgzipped, bgzip([]byte(contents), 1024), 0644)
+	os.WriteFile(bgzipped+".tbi", nil, 0644)
+
+	cases := []struct {
+		filename string
+		format   InputFormat
+		index    string
+	}{
+		{plain, PlainText, ""},
+		{gzipped, Gzip, ""},
+		{bgzipped, BGZF, bgzipped + ".tbi"},
+	}
+	for _, test_case := range cases {
+		fr := Open(test_case.filename, 1024)
+		if fr.Err != nil {
+			t.Fatalf("unable to open %s: %s", test_case.filename, fr.Err)
+		}
+		if fr.Format != test_case.format || fr.Index != test_case.index {
+			t.Errorf("%s was opened as %s with the index %q but expected %s with the index %q", filepath.Base(test_case.filename), fr.Format, fr.Index, test_case.format, test_case.index)
+		}
+		if header_err := fr.ParseHeader("#CHROM"); header_err != nil || !fr.Header_Found || fr.Col_count != 2 {
+			t.Errorf("unable to read the header of %s: %v", filepath.Base(test_case.filename), header_err)
+		}
+		fr.Close()
+	}
+}
@@ -0,0 +1,158 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// AutoBuffersize is the --buffersize value that sizes the line buffer from the number of samples
+// in the vcf header instead of using a fixed size
+const AutoBuffersize = 0
+
+const (
+	// bytesPerSample is what we budget for the call of each sample. A call with the usual FORMAT
+	// fields (GT:AD:DP:GQ:PL) is around 20-30 bytes for a biallelic site but the AD and PL
+	// values grow with the number of alleles
+	bytesPerSample = 48
+	// fixedColumnBytes is what we budget for the 9 fixed columns. INFO columns with VEP or
+	// snpEff annotations can be hundreds of kilobytes on their own
+	fixedColumnBytes = 1024 * 1024
+	// sampleMargin multiplies the budget for the calls so that records at multi-allelic sites
+	// still fit
+	sampleMargin = 2
+	// maxLineLength is the longest line that an automatically sized buffer can read before the
+	// number of samples is known (the header lines). The buffer only grows to this size if a
+	// line is actually that long
+	maxLineLength = 1024 * 1024 * 1024
+	// initialBufferSize is the size that the buffer starts at. The scanner doubles it as needed
+	initialBufferSize = 64 * 1024
+)
+
+// SampleBuffersize is the buffer that we use for a vcf with this many samples
+func SampleBuffersize(samples int) int {
+	return min(fixedColumnBytes+samples*bytesPerSample*sampleMargin, maxLineLength)
+}
+
+// LineLimit enforces the longest line that a scanner can read and warns once when a line gets
+// close to the limit so that users know to raise --buffersize before a wider callset fails
+type LineLimit struct {
+	Limit   int  // the longest line that can be read
+	Auto    bool // whether the limit comes from the number of samples
+	Longest int  // the longest line that has been read so far
+	Warn    func(message string)
+	warned  bool
+	started bool // whether the first line has been read. Only the first line can have a byte order mark
+}
+
+// utf8BOM is the byte order mark that Windows editors like Excel and Notepad put at the start of files
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// NewLineScanner creates a scanner that reads lines up to the buffersize. If the buffersize is
+// AutoBuffersize then header lines of any reasonable length can be read and the limit for the
+// records is set by calling SetSamples once the #CHROM line has been read. The buffer starts
+// small and only grows as long lines are read so a large limit doesn't allocate memory up front
+func NewLineScanner(reader io.Reader, buffersize int) (*bufio.Scanner, *LineLimit) {
+	limit := &LineLimit{Limit: buffersize}
+	if buffersize <= AutoBuffersize {
+		limit.Limit = maxLineLength
+		limit.Auto = true
+	}
+
+	scanner := bufio.NewScanner(reader)
+	// The scanner can hold one more byte than the limit so that split sees the long line and can
+	// return an error that tells the user what to do instead of bufio.ErrTooLong
+	scanner.Buffer(make([]byte, 0, min(initialBufferSize, limit.Limit)), limit.Limit+1)
+	scanner.Split(limit.split)
+	return scanner, limit
+}
+
+// SetSamples sizes an automatic limit for the number of samples in the header. A limit that the
+// user chose is left alone
+func (limit *LineLimit) SetSamples(samples int) {
+	if limit.Auto {
+		limit.Limit = SampleBuffersize(samples)
+	}
+}
+
+// split reads lines like bufio.ScanLines but it stops at the limit and it keeps track of how long
+// the lines are so that we can warn before the limit is reached
+func (limit *LineLimit) split(data []byte, at_eof bool) (int, []byte, error) {
+	advance, token, err := scan_lines(data, at_eof)
+	if token != nil && !limit.started {
+		limit.started = true
+		token = bytes.TrimPrefix(token, utf8BOM)
+	}
+	if token == nil {
+		if advance == 0 && len(data) > limit.Limit {
+			return 0, nil, limit.too_long()
+		}
+		return advance, token, err
+	}
+
+	if len(token) > limit.Limit {
+		return 0, nil, limit.too_long()
+	}
+	limit.Longest = max(limit.Longest, len(token))
+	// We warn at 80% of the limit because the next region or chromosome can easily have longer lines
+	if !limit.warned && len(token) >= limit.Limit/10*8 {
+		limit.warned = true
+		limit.warn(fmt.Sprintf("A line with %d bytes was read which is close to the limit of %d bytes. Longer lines will fail so consider setting --buffersize to at least %d", len(token), limit.Limit, 2*limit.Limit))
+	}
+	return advance, token, err
+}
+
+// scan_lines is bufio.ScanLines except that a carriage return on its own also ends a line. Files
+// that were edited on Windows end their lines with \r\n and files saved by older Mac versions of
+// Excel only use \r. Either way the \r is not part of the line
+func scan_lines(data []byte, at_eof bool) (int, []byte, error) {
+	if at_eof && len(data) == 0 {
+		return 0, nil, nil
+	}
+	newline := bytes.IndexByte(data, '\n')
+	search := data
+	if newline >= 0 {
+		search = data[:newline]
+	}
+	carriage := bytes.IndexByte(search, '\r')
+	switch {
+	case carriage >= 0 && carriage == newline-1:
+		return newline + 1, data[:carriage], nil
+	case carriage >= 0 && newline >= 0:
+		return carriage + 1, data[:carriage], nil
+	case carriage >= 0 && carriage+1 < len(data):
+		return carriage + 1, data[:carriage], nil
+	case carriage >= 0 && at_eof:
+		return len(data), data[:carriage], nil
+	case carriage >= 0:
+		// The next read could start with the \n of a \r\n so we need more data
+		return 0, nil, nil
+	case newline >= 0:
+		return newline + 1, data[:newline], nil
+	case at_eof:
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// NewTableScanner creates a scanner for the small tables that users make themselves (such as the
+// phenotype and samples files). These are the files that are most likely to come from Windows
+func NewTableScanner(reader io.Reader) *bufio.Scanner {
+	scanner, _ := NewLineScanner(reader, AutoBuffersize)
+	return scanner
+}
+
+func (limit *LineLimit) too_long() error {
+	return fmt.Errorf("%w: a line is longer than the limit of %d bytes. Set --buffersize to a larger value (such as %d) to read this file", bufio.ErrTooLong, limit.Limit, 2*limit.Limit)
+}
+
+func (limit *LineLimit) warn(message string) {
+	if limit.Warn != nil {
+		limit.Warn(message)
+		return
+	}
+	// Commands like query and lookup-variant write their results to stdout so the warning goes to stderr
+	fmt.Fprintln(os.Stderr, message)
+}
@@ -0,0 +1,440 @@
+package files
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	gzip "github.com/klauspost/pgzip"
+)
+
+// Outputs that go to object storage are uploaded in parts while the command is still writing so
+// that cluster jobs don't need local scratch space for the whole output. S3 requires every part
+// except the last one to be at least 5MB and GCS requires chunks to be a multiple of 256KB
+const uploadPartSize = 16 * 1024 * 1024
+
+// CompressionOptions controls the parallel gzip writer of the compressed outputs. The output is
+// cut into blocks and each block is compressed by its own goroutine so the writer doesn't have to
+// wait on a single core for wide outputs
+type CompressionOptions struct {
+	BlockSize int // bytes in each block that is compressed on its own
+	Workers   int // number of blocks that can be compressed at the same time
+}
+
+// minBlockSize is the smallest block that pgzip accepts. Every block needs more than the 16KB of
+// history that it passes on to the next block
+const minBlockSize = 16*1024 + 1
+
+// Compression is used for every compressed output. The defaults are the defaults of pgzip
+var Compression = CompressionOptions{BlockSize: 1 << 20, Workers: runtime.GOMAXPROCS(0)}
+
+// WriteBufferSize is how many bytes the record writers collect before they write to the output.
+// Writing whole blocks at a time means that the compression workers get full blocks instead of
+// one line at a time
+func WriteBufferSize() int {
+	return max(Compression.BlockSize, 64*1024)
+}
+
+// SetCompression changes the block size and the number of workers of the compressed outputs. A
+// block size of 0 keeps the default and 0 workers uses one worker for each thread that the
+// program can use (GOMAXPROCS) now that the CPU quota of the job has been applied to it
+func SetCompression(block_size int, workers int) error {
+	if block_size != 0 {
+		if block_size < minBlockSize {
+			return fmt.Errorf("the compression block size has to be at least %d bytes but it was %d", minBlockSize, block_size)
+		}
+		Compression.BlockSize = block_size
+	}
+	if workers < 0 {
+		return fmt.Errorf("the number of compression workers has to be at least 1 but it was %d", workers)
+	}
+	Compression.Workers = cmp.Or(workers, runtime.GOMAXPROCS(0))
+	return nil
+}
+
+// new_gzip_writer creates a parallel gzip writer with the block size and workers of Compression
+func new_gzip_writer(output io.WriteCloser) (io.WriteCloser, error) {
+	writer := gzip.NewWriter(output)
+	if concurrency_err := writer.SetConcurrency(Compression.BlockSize, Compression.Workers); concurrency_err != nil {
+		return nil, concurrency_err
+	}
+	return &gzipWriteCloser{Writer: writer, output: output}, nil
+}
+
+// IsRemoteOutput reports whether the output should be uploaded to object storage
+func IsRemoteOutput(filename string) bool {
+	return strings.HasPrefix(filename, "s3://") || strings.HasPrefix(filename, "gs://")
+}
+
+// Upload describes an object that finished uploading. The checksums are computed from the bytes
+// as they are uploaded so that the manifest doesn't have to download the object again
+type Upload struct {
+	Bytes  int64
+	MD5    string
+	SHA256 string
+}
+
+var (
+	uploads_mu sync.Mutex
+	uploads    = make(map[string]Upload)
+)
+
+// Uploaded returns the checksums of an output that was uploaded during this run. The second
+// value is false if the upload never completed
+func Uploaded(filename string) (Upload, bool) {
+	uploads_mu.Lock()
+	defer uploads_mu.Unlock()
+
+	upload, ok := uploads[filename]
+	return upload, ok
+}
+
+// gzipWriteCloser closes the compressed stream before the file (or upload) that it writes to
+type gzipWriteCloser struct {
+	*gzip.Writer
+	output io.WriteCloser
+}
+
+func (writer *gzipWriteCloser) Close() error {
+	gzip_err := writer.Writer.Close()
+	close_err := writer.output.Close()
+	return errors.Join(gzip_err, close_err)
+}
+
+// Create opens an output for writing. The output can be a local path or an s3:// or gs:// url.
+// Outputs that end in .gz are compressed as they are written
+func Create(filename string) (io.WriteCloser, error) {
+	var output io.WriteCloser
+
+	switch {
+	case IsRemoteOutput(filename):
+		upload, upload_err := newObjectUpload(filename)
+		if upload_err != nil {
+			return nil, upload_err
+		}
+		output = upload
+	case IsRemote(filename):
+		return nil, fmt.Errorf("unable to write to %s. Outputs can only be written to local files, s3:// urls, or gs:// urls", filename)
+	default:
+		fh, create_err := os.Create(filename)
+		if create_err != nil {
+			return nil, create_err
+		}
+		output = fh
+	}
+
+	if strings.HasSuffix(filename, ".gz") {
+		return new_gzip_writer(output)
+	}
+	return output, nil
+}
+
+// Append opens an existing local output so that more lines can be added to the end of it. A
+// compressed output is continued with a new gzip member because concatenated members are still
+// a valid gzip file
+func Append(filename string) (io.WriteCloser, error) {
+	if IsRemote(filename) {
+		return nil, fmt.Errorf("unable to append to %s. Objects in s3 or gcs can't be appended to", filename)
+	}
+
+	fh, open_err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if open_err != nil {
+		return nil, open_err
+	}
+
+	if strings.HasSuffix(filename, ".gz") {
+		return new_gzip_writer(fh)
+	}
+	return fh, nil
+}
+
+// WriteFile writes the data to a local file or to object storage like os.WriteFile. Small outputs
+// like the checksum sidecars and the run manifest are written this way
+func WriteFile(filename string, data []byte) error {
+	if !IsRemoteOutput(filename) {
+		return os.WriteFile(filename, data, 0644)
+	}
+
+	upload, upload_err := newObjectUpload(filename)
+	if upload_err != nil {
+		return upload_err
+	}
+	if _, write_err := upload.Write(data); write_err != nil {
+		upload.abort()
+		return write_err
+	}
+	return upload.Close()
+}
+
+// objectUpload buffers the output and sends it to object storage one part at a time. Each store
+// has its own protocol for multipart uploads so the steps are filled in by the constructor
+type objectUpload struct {
+	filename string
+	buffer   bytes.Buffer
+	sent     int64 // number of bytes that have been uploaded so far
+	md5      hash.Hash
+	sha256   hash.Hash
+	closed   bool
+
+	upload_part func(part []byte, last bool) error // sends the next part. last is true for the final part
+	complete    func() error                       // finishes the upload once every part has been sent
+	abort       func()                             // cleans up a failed upload
+}
+
+func newObjectUpload(filename string) (*objectUpload, error) {
+	upload := &objectUpload{filename: filename, md5: md5.New(), sha256: sha256.New()}
+
+	parsed, parse_err := url.Parse(filename)
+	if parse_err != nil {
+		return nil, fmt.Errorf("unable to parse the url %s: %w", filename, parse_err)
+	}
+
+	var start_err error
+	switch parsed.Scheme {
+	case "s3":
+		start_err = upload.start_s3(filename)
+	case "gs":
+		start_err = upload.start_gcs(parsed.Host, strings.TrimPrefix(parsed.Path, "/"))
+	default:
+		start_err = fmt.Errorf("the url scheme %s is not supported for outputs", parsed.Scheme)
+	}
+	if start_err != nil {
+		return nil, fmt.Errorf("unable to start the upload to %s: %w", filename, start_err)
+	}
+	return upload, nil
+}
+
+func (upload *objectUpload) Write(p []byte) (int, error) {
+	if upload.closed {
+		return 0, os.ErrClosed
+	}
+
+	upload.buffer.Write(p)
+	upload.md5.Write(p)
+	upload.sha256.Write(p)
+
+	for upload.buffer.Len() >= uploadPartSize {
+		if part_err := upload.upload_part(upload.buffer.Next(uploadPartSize), false); part_err != nil {
+			return 0, fmt.Errorf("unable to upload part of %s: %w", upload.filename, part_err)
+		}
+		upload.sent += uploadPartSize
+	}
+	return len(p), nil
+}
+
+// Close uploads whatever is left in the buffer and completes the upload. The object doesn't
+// exist in the bucket until Close returns without an error
+func (upload *objectUpload) Close() error {
+	if upload.closed {
+		return nil
+	}
+	upload.closed = true
+
+	remaining := int64(upload.buffer.Len())
+	if part_err := upload.upload_part(upload.buffer.Bytes(), true); part_err != nil {
+		upload.abort()
+		return fmt.Errorf("unable to upload the last part of %s: %w", upload.filename, part_err)
+	}
+	if complete_err := upload.complete(); complete_err != nil {
+		upload.abort()
+		return fmt.Errorf("unable to complete the upload of %s: %w", upload.filename, complete_err)
+	}
+
+	uploads_mu.Lock()
+	uploads[upload.filename] = Upload{
+		Bytes:  upload.sent + remaining,
+		MD5:    hex.EncodeToString(upload.md5.Sum(nil)),
+		SHA256: hex.EncodeToString(upload.sha256.Sum(nil)),
+	}
+	uploads_mu.Unlock()
+	return nil
+}
+
+// send_request sends a request with a body using the same retries as the ranged reads. The
+// accepted statuses are passed on to do_with_retries
+func send_request(method string, request_url string, body []byte, prepare func(*http.Request), accepted ...int) (*http.Response, error) {
+	return do_with_retries(func() (*http.Request, error) {
+		request, err := http.NewRequest(method, request_url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		prepare(request)
+		return request, nil
+	}, accepted...)
+}
+
+// start_s3 begins a multipart upload. Outputs that fit in a single part are sent with one PUT
+// instead because s3 won't accept a multipart upload with an empty part
+func (upload *objectUpload) start_s3(filename string) error {
+	object_url, _, resolve_err := resolve_remote_url(filename)
+	if resolve_err != nil {
+		return resolve_err
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	sign := func(body []byte) func(*http.Request) {
+		return func(request *http.Request) { sign_s3_request(request, region, body) }
+	}
+
+	var upload_id string
+	var etags []string
+
+	upload.upload_part = func(part []byte, last bool) error {
+		if last && upload_id == "" {
+			response, put_err := send_request(http.MethodPut, object_url, part, sign(part))
+			if put_err != nil {
+				return put_err
+			}
+			response.Body.Close()
+			return nil
+		}
+
+		if last && len(part) == 0 {
+			return nil
+		}
+
+		if upload_id == "" {
+			response, create_err := send_request(http.MethodPost, object_url+"?uploads", nil, sign(nil))
+			if create_err != nil {
+				return create_err
+			}
+			var created struct {
+				UploadId string
+			}
+			decode_err := xml.NewDecoder(response.Body).Decode(&created)
+			response.Body.Close()
+			if decode_err != nil || created.UploadId == "" {
+				return fmt.Errorf("s3 did not return an upload id: %v", decode_err)
+			}
+			upload_id = created.UploadId
+		}
+
+		part_url := fmt.Sprintf("%s?partNumber=%d&uploadId=%s", object_url, len(etags)+1, url.QueryEscape(upload_id))
+		response, part_err := send_request(http.MethodPut, part_url, part, sign(part))
+		if part_err != nil {
+			return part_err
+		}
+		response.Body.Close()
+		// The upload can't be completed without the ETag of every part
+		etag := response.Header.Get("ETag")
+		if etag == "" {
+			return fmt.Errorf("s3 did not return an ETag for the part %d", len(etags)+1)
+		}
+		etags = append(etags, etag)
+		return nil
+	}
+
+	upload.complete = func() error {
+		if upload_id == "" {
+			return nil
+		}
+		var body strings.Builder
+		body.WriteString("<CompleteMultipartUpload>")
+		for indx, etag := range etags {
+			body.WriteString(fmt.Sprintf("<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", indx+1, etag))
+		}
+		body.WriteString("</CompleteMultipartUpload>")
+
+		complete_body := []byte(body.String())
+		response, complete_err := send_request(http.MethodPost, fmt.Sprintf("%s?uploadId=%s", object_url, url.QueryEscape(upload_id)), complete_body, sign(complete_body))
+		if complete_err != nil {
+			return complete_err
+		}
+		defer response.Body.Close()
+
+		// s3 can return a 200 with an error in the body if the upload fails after it started
+		var result struct {
+			XMLName xml.Name
+			Message string
+		}
+		if decode_err := xml.NewDecoder(response.Body).Decode(&result); decode_err == nil && result.XMLName.Local == "Error" {
+			return errors.New(result.Message)
+		}
+		return nil
+	}
+
+	upload.abort = func() {
+		if upload_id == "" {
+			return
+		}
+		if response, _ := send_request(http.MethodDelete, fmt.Sprintf("%s?uploadId=%s", object_url, url.QueryEscape(upload_id)), nil, sign(nil)); response != nil {
+			response.Body.Close()
+		}
+	}
+	return nil
+}
+
+// start_gcs begins a resumable upload. Every chunk is sent to the session url with the range of
+// bytes that it covers and the total size is given with the last chunk
+func (upload *objectUpload) start_gcs(bucket string, object string) error {
+	authorize := func(request *http.Request) {
+		if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	start_url := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable&name=%s", gcs_endpoint(), bucket, url.QueryEscape(object))
+	response, start_err := send_request(http.MethodPost, start_url, nil, authorize)
+	if start_err != nil {
+		return start_err
+	}
+	response.Body.Close()
+
+	session_url := response.Header.Get("Location")
+	if session_url == "" {
+		return errors.New("gcs did not return a session url for the resumable upload")
+	}
+
+	upload.upload_part = func(part []byte, last bool) error {
+		first_byte := upload.sent
+		content_range := fmt.Sprintf("bytes %d-%d/*", first_byte, first_byte+int64(len(part))-1)
+		if last {
+			total := first_byte + int64(len(part))
+			if len(part) == 0 {
+				content_range = fmt.Sprintf("bytes */%d", total)
+			} else {
+				content_range = fmt.Sprintf("bytes %d-%d/%d", first_byte, total-1, total)
+			}
+		}
+
+		// gcs answers every chunk except the last one with a 308 (without a Location header so the
+		// client doesn't follow it). The last chunk gets a 200 or a 201 once the object exists
+		var accepted []int
+		if !last {
+			accepted = append(accepted, http.StatusPermanentRedirect)
+		}
+		response, part_err := send_request(http.MethodPut, session_url, part, func(request *http.Request) {
+			authorize(request)
+			request.Header.Set("Content-Range", content_range)
+		}, accepted...)
+		if part_err != nil {
+			return part_err
+		}
+		response.Body.Close()
+		return nil
+	}
+	upload.complete = func() error { return nil }
+	upload.abort = func() {
+		request, _ := http.NewRequest(http.MethodDelete, session_url, nil)
+		authorize(request)
+		if response, _ := remoteClient.Do(request); response != nil {
+			response.Body.Close()
+		}
+	}
+	return nil
+}
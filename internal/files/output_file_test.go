@@ -0,0 +1,173 @@
+package files
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeStore records the requests of an upload so that the tests can check what was sent
+type fakeStore struct {
+	mu       sync.Mutex
+	requests []string // the method and the path with the query of each request
+	bodies   map[string][]byte
+	handle   func(writer http.ResponseWriter, request *http.Request, body []byte)
+}
+
+func new_fake_store(t *testing.T, handle func(writer http.ResponseWriter, request *http.Request, body []byte)) *fakeStore {
+	store := &fakeStore{bodies: make(map[string][]byte), handle: handle}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		key := request.Method + " " + request.URL.RequestURI()
+		store.mu.Lock()
+		store.requests = append(store.requests, key)
+		store.bodies[key] = body
+		store.mu.Unlock()
+		store.handle(writer, request, body)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ENDPOINT_URL", server.URL)
+	t.Setenv("STORAGE_EMULATOR_HOST", server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "")
+	return store
+}
+
+func (store *fakeStore) methods() string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var methods []string
+	for _, request := range store.requests {
+		method, _, _ := strings.Cut(request, " ")
+		methods = append(methods, method)
+	}
+	return strings.Join(methods, ",")
+}
+
+func TestS3SinglePut(t *testing.T) {
+	store := new_fake_store(t, func(writer http.ResponseWriter, request *http.Request, body []byte) {
+		writer.Header().Set("ETag", `"single"`)
+	})
+
+	if write_err := WriteFile("s3://bucket/results/out.txt", []byte("#CHROM\tPOS\n")); write_err != nil {
+		t.Fatalf("unable to upload the output: %s", write_err)
+	}
+	if store.methods() != "PUT" || string(store.bodies["PUT /bucket/results/out.txt"]) != "#CHROM\tPOS\n" {
+		t.Errorf("expected a single PUT of the output but the store received %v", store.requests)
+	}
+	sum := md5.Sum([]byte("#CHROM\tPOS\n"))
+	if upload, found := Uploaded("s3://bucket/results/out.txt"); !found || upload.MD5 != hex.EncodeToString(sum[:]) || upload.Bytes != 11 {
+		t.Errorf("expected the upload to be recorded with its checksum but found %+v", upload)
+	}
+}
+
+// multipart_output is a part and a bit so that the upload has two parts
+func multipart_output() []byte {
+	return bytes.Repeat([]byte("0123456789abcdef"), uploadPartSize/16+64)
+}
+
+func s3_multipart_store(t *testing.T, complete_body string) *fakeStore {
+	return new_fake_store(t, func(writer http.ResponseWriter, request *http.Request, body []byte) {
+		query := request.URL.Query()
+		switch {
+		case request.Method == http.MethodPost && query.Has("uploads"):
+			fmt.Fprint(writer, "<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>")
+		case request.Method == http.MethodPut && query.Get("uploadId") == "upload-1":
+			writer.Header().Set("ETag", fmt.Sprintf(`"etag-%s"`, query.Get("partNumber")))
+		case request.Method == http.MethodPost && query.Get("uploadId") == "upload-1":
+			fmt.Fprint(writer, complete_body)
+		case request.Method == http.MethodDelete:
+			writer.WriteHeader(http.StatusNoContent)
+		default:
+			writer.WriteHeader(http.StatusBadRequest)
+		}
+	})
+}
+
+func TestS3Multipart(t *testing.T) {
+	store := s3_multipart_store(t, "<CompleteMultipartUploadResult><ETag>\"done\"</ETag></CompleteMultipartUploadResult>")
+	contents := multipart_output()
+
+	if write_err := WriteFile("s3://bucket/big.txt", contents); write_err != nil {
+		t.Fatalf("unable to upload the output: %s", write_err)
+	}
+	if methods := store.methods(); methods != "POST,PUT,PUT,POST" {
+		t.Fatalf("expected a multipart upload with two parts but the store received %v", store.requests)
+	}
+	first := store.bodies["PUT /bucket/big.txt?partNumber=1&uploadId=upload-1"]
+	second := store.bodies["PUT /bucket/big.txt?partNumber=2&uploadId=upload-1"]
+	if len(first) != uploadPartSize || !bytes.Equal(append(first, second...), contents) {
+		t.Errorf("expected the parts to be the output split at %d bytes but found parts of %d and %d bytes", uploadPartSize, len(first), len(second))
+	}
+	// The ETag of each part is sent back in order to complete the upload
+	expected := `<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>"etag-1"</ETag></Part><Part><PartNumber>2</PartNumber><ETag>"etag-2"</ETag></Part></CompleteMultipartUpload>`
+	if complete := string(store.bodies["POST /bucket/big.txt?uploadId=upload-1"]); complete != expected {
+		t.Errorf("expected the complete request\n%s\nbut found\n%s", expected, complete)
+	}
+}
+
+func TestS3MultipartCompleteError(t *testing.T) {
+	// s3 can answer the complete request with a 200 and an error in the body
+	store := s3_multipart_store(t, "<Error><Code>InternalError</Code><Message>We encountered an internal error</Message></Error>")
+
+	write_err := WriteFile("s3://bucket/failed.txt", multipart_output())
+	if write_err == nil || !strings.Contains(write_err.Error(), "internal error") {
+		t.Fatalf("expected the error in the body of the complete request but got %v", write_err)
+	}
+	// The failed upload is aborted so the parts aren't left in the bucket
+	if methods := store.methods(); methods != "POST,PUT,PUT,POST,DELETE" {
+		t.Errorf("expected the upload to be aborted but the store received %v", store.requests)
+	}
+	if _, found := Uploaded("s3://bucket/failed.txt"); found {
+		t.Errorf("expected the failed upload not to be recorded")
+	}
+}
+
+func TestGCSResumable(t *testing.T) {
+	var session string
+	store := new_fake_store(t, func(writer http.ResponseWriter, request *http.Request, body []byte) {
+		switch {
+		case request.Method == http.MethodPost:
+			writer.Header().Set("Location", session)
+		case strings.HasSuffix(request.Header.Get("Content-Range"), "/*"):
+			// Every chunk except the last one is answered with a 308
+			writer.WriteHeader(http.StatusPermanentRedirect)
+		default:
+			writer.WriteHeader(http.StatusOK)
+		}
+	})
+	session = strings.TrimSuffix(gcs_endpoint(), "/") + "/session/1"
+	contents := multipart_output()
+
+	if write_err := WriteFile("gs://bucket/big.txt", contents); write_err != nil {
+		t.Fatalf("unable to upload the output: %s", write_err)
+	}
+	if methods := store.methods(); methods != "POST,PUT,PUT" {
+		t.Fatalf("expected a resumable upload with two chunks but the store received %v", store.requests)
+	}
+	if upload, found := Uploaded("gs://bucket/big.txt"); !found || upload.Bytes != int64(len(contents)) {
+		t.Errorf("expected the upload of %d bytes to be recorded but found %+v", len(contents), upload)
+	}
+}
+
+func TestGCSLastChunkRedirect(t *testing.T) {
+	// A 308 for the last chunk means that gcs didn't receive the whole object so the upload failed
+	new_fake_store(t, func(writer http.ResponseWriter, request *http.Request, body []byte) {
+		if request.Method == http.MethodPost {
+			writer.Header().Set("Location", gcs_endpoint()+"/session/2")
+			return
+		}
+		writer.WriteHeader(http.StatusPermanentRedirect)
+	})
+
+	if write_err := WriteFile("gs://bucket/small.txt", []byte("#CHROM\n")); write_err == nil {
+		t.Errorf("expected a 308 for the last chunk to fail the upload")
+	}
+}
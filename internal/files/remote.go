@@ -0,0 +1,369 @@
+package files
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Remote inputs are read in chunks with http range requests. Each chunk is retried a few times
+// because the connections to the object stores of the biobanks drop now and then during long runs
+const (
+	remoteChunkSize  = 4 * 1024 * 1024
+	remoteMaxRetries = 4
+)
+
+// remoteRetryDelay is the wait before the first retry. It doubles for each retry after that. It is
+// a variable so that the tests don't have to wait
+var remoteRetryDelay = 500 * time.Millisecond
+
+// errRangeNotSatisfiable is returned when a range starts after the end of the object. Objects
+// without a known size are read until this error
+var errRangeNotSatisfiable = errors.New("the range starts after the end of the object")
+
+var remoteClient = &http.Client{Timeout: 5 * time.Minute}
+
+// IsRemote reports whether the filename is a url that we know how to read
+func IsRemote(filename string) bool {
+	for _, scheme := range []string{"http://", "https://", "s3://", "gs://"} {
+		if strings.HasPrefix(filename, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteFile reads an object from http(s), s3, or gcs with range requests. It implements
+// io.ReadSeekCloser so that indexed readers (like tabix) can seek to a block without
+// downloading the whole file
+type RemoteFile struct {
+	URL    string // the url as the user gave it (s3://bucket/key)
+	Size   int64  // -1 if the server didn't send the size and the end hasn't been reached yet
+	offset int64
+	buffer []byte // the chunk that we most recently downloaded
+	start  int64  // offset of the first byte of the buffer
+	signer func(*http.Request)
+}
+
+// resolve_remote_url converts the s3:// and gs:// schemes into the https endpoints. Requests to s3
+// are signed when AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are set and requests to gcs use the
+// token in GOOGLE_OAUTH_ACCESS_TOKEN. Public objects can be read without any credentials
+func resolve_remote_url(filename string) (string, func(*http.Request), error) {
+	parsed, parse_err := url.Parse(filename)
+	if parse_err != nil {
+		return "", nil, fmt.Errorf("unable to parse the url %s: %w", filename, parse_err)
+	}
+
+	switch parsed.Scheme {
+	case "http", "https":
+		return filename, func(*http.Request) {}, nil
+	case "gs":
+		https_url := fmt.Sprintf("%s/%s%s", gcs_endpoint(), parsed.Host, parsed.Path)
+		return https_url, func(request *http.Request) {
+			if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+				request.Header.Set("Authorization", "Bearer "+token)
+			}
+		}, nil
+	case "s3":
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := os.Getenv("AWS_ENDPOINT_URL")
+		var https_url string
+		if endpoint != "" {
+			https_url = fmt.Sprintf("%s/%s%s", strings.TrimSuffix(endpoint, "/"), parsed.Host, parsed.Path)
+		} else {
+			https_url = fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", parsed.Host, region, parsed.Path)
+		}
+		return https_url, func(request *http.Request) { sign_s3_request(request, region, nil) }, nil
+	default:
+		return "", nil, fmt.Errorf("the url scheme %s is not supported. Supported schemes are http, https, s3, and gs", parsed.Scheme)
+	}
+}
+
+// gcs_endpoint is the url of gcs. STORAGE_EMULATOR_HOST points the requests at an emulator (such as
+// fake-gcs-server) the same way that it does for the Google client libraries
+func gcs_endpoint() string {
+	emulator := os.Getenv("STORAGE_EMULATOR_HOST")
+	switch {
+	case emulator == "":
+		return "https://storage.googleapis.com"
+	case strings.Contains(emulator, "://"):
+		return strings.TrimSuffix(emulator, "/")
+	default:
+		return "http://" + strings.TrimSuffix(emulator, "/")
+	}
+}
+
+func sha256_hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmac_sha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign_s3_request adds an AWS signature version 4 to the request. Requests are left unsigned if
+// there are no credentials in the environment so that public buckets still work
+func sign_s3_request(request *http.Request, region string, payload []byte) {
+	sign_s3_request_at(request, region, payload, time.Now().UTC())
+}
+
+// sign_s3_request_at signs the request with the time of now (in UTC)
+func sign_s3_request_at(request *http.Request, region string, payload []byte, now time.Time) {
+	access_key := os.Getenv("AWS_ACCESS_KEY_ID")
+	secret_key := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if access_key == "" || secret_key == "" {
+		return
+	}
+
+	amz_date := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payload_hash := sha256_hex(payload)
+
+	request.Header.Set("x-amz-date", amz_date)
+	request.Header.Set("x-amz-content-sha256", payload_hash)
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		request.Header.Set("x-amz-security-token", token)
+	}
+
+	// Only the host and the x-amz headers are signed which is enough for s3
+	signed_names := []string{"host"}
+	canonical_headers := "host:" + request.URL.Host + "\n"
+	for _, name := range []string{"x-amz-content-sha256", "x-amz-date", "x-amz-security-token"} {
+		if value := request.Header.Get(name); value != "" {
+			signed_names = append(signed_names, name)
+			canonical_headers += name + ":" + value + "\n"
+		}
+	}
+	signed_headers := strings.Join(signed_names, ";")
+
+	canonical_request := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.Query().Encode(),
+		canonical_headers,
+		signed_headers,
+		payload_hash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	string_to_sign := strings.Join([]string{"AWS4-HMAC-SHA256", amz_date, scope, sha256_hex([]byte(canonical_request))}, "\n")
+
+	signing_key := hmac_sha256([]byte("AWS4"+secret_key), date)
+	signing_key = hmac_sha256(signing_key, region)
+	signing_key = hmac_sha256(signing_key, "s3")
+	signing_key = hmac_sha256(signing_key, "aws4_request")
+
+	signature := hex.EncodeToString(hmac_sha256(signing_key, string_to_sign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", access_key, scope, signed_headers, signature))
+}
+
+// retryable reports whether the request should be tried again. Server errors and throttling are
+// usually temporary but errors like a missing object are not
+func retryable(status_code int) bool {
+	return status_code == http.StatusTooManyRequests || status_code >= 500
+}
+
+// do_with_retries sends the request built by make_request until it succeeds or we run out of retries.
+// A 2xx status is a success. The accepted statuses are also a success for the requests that expect
+// them, like the 308 that gcs answers the chunks of a resumable upload with
+func do_with_retries(make_request func() (*http.Request, error), accepted ...int) (*http.Response, error) {
+	var last_err error
+	for attempt := 0; attempt < remoteMaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(remoteRetryDelay * time.Duration(1<<(attempt-1)))
+		}
+
+		request, request_err := make_request()
+		if request_err != nil {
+			return nil, request_err
+		}
+
+		response, response_err := remoteClient.Do(request)
+		if response_err != nil {
+			last_err = response_err
+			continue
+		}
+		if (response.StatusCode >= 200 && response.StatusCode < 300) || slices.Contains(accepted, response.StatusCode) {
+			return response, nil
+		}
+
+		response.Body.Close()
+		last_err = fmt.Errorf("the request for %s returned the status %s", request.URL, response.Status)
+		switch response.StatusCode {
+		case http.StatusNotFound:
+			// We wrap os.ErrNotExist so that a missing object is reported the same way as a missing local file
+			return nil, fmt.Errorf("%w: %w", os.ErrNotExist, last_err)
+		case http.StatusRequestedRangeNotSatisfiable:
+			return nil, fmt.Errorf("%w: %w", errRangeNotSatisfiable, last_err)
+		}
+		if !retryable(response.StatusCode) {
+			return nil, last_err
+		}
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", remoteMaxRetries, last_err)
+}
+
+// OpenRemote opens the object and looks up its size so that we know where the end of the file is
+func OpenRemote(filename string) (*RemoteFile, error) {
+	https_url, signer, resolve_err := resolve_remote_url(filename)
+	if resolve_err != nil {
+		return nil, resolve_err
+	}
+
+	remote := &RemoteFile{URL: https_url, signer: signer}
+
+	// A range request for the first byte gives us the size in the Content-Range header. Some
+	// signed urls only allow GET requests so we don't use a HEAD request
+	response, response_err := do_with_retries(func() (*http.Request, error) {
+		request, err := http.NewRequest(http.MethodGet, https_url, nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Range", "bytes=0-0")
+		signer(request)
+		return request, nil
+	})
+	if response_err != nil {
+		// An empty object has no first byte so the range can't be satisfied
+		if errors.Is(response_err, errRangeNotSatisfiable) {
+			return remote, nil
+		}
+		return nil, fmt.Errorf("unable to open the remote file %s: %w", filename, response_err)
+	}
+	defer response.Body.Close()
+
+	// A server that ignores the range would send the whole file with every chunk so we stop here
+	// instead of downloading the file again for each 4MB that is read
+	if response.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("unable to open the remote file %s because the server does not support range requests (it answered bytes=0-0 with the status %s). Please download the file and use the local copy", filename, response.Status)
+	}
+	io.Copy(io.Discard, response.Body)
+
+	// The Content-Range is bytes 0-0/<size>. The size is * if the server doesn't know it and then
+	// the file is read until a range can't be satisfied
+	remote.Size = -1
+	_, size_str, _ := strings.Cut(response.Header.Get("Content-Range"), "/")
+	if size, size_err := strconv.ParseInt(size_str, 10, 64); size_err == nil {
+		remote.Size = size
+	}
+	return remote, nil
+}
+
+// fetch downloads the chunk that starts at the offset. It returns io.EOF if the size of the file
+// wasn't known and the offset is past the end
+func (remote *RemoteFile) fetch(offset int64) error {
+	end := offset + remoteChunkSize - 1
+	if remote.Size >= 0 {
+		end = min(end, remote.Size-1)
+	}
+
+	response, response_err := do_with_retries(func() (*http.Request, error) {
+		request, err := http.NewRequest(http.MethodGet, remote.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end))
+		remote.signer(request)
+		return request, nil
+	})
+	if response_err != nil {
+		if errors.Is(response_err, errRangeNotSatisfiable) && remote.Size < 0 {
+			remote.Size = offset
+			return io.EOF
+		}
+		return response_err
+	}
+	defer response.Body.Close()
+
+	// The range was checked when the file was opened but a load balancer in front of another server
+	// could still ignore it. The body would then be the start of the file instead of the chunk
+	if response.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("the server answered the range request for bytes %d-%d of %s with the status %s instead of the partial content", offset, end, remote.URL, response.Status)
+	}
+
+	chunk, read_err := io.ReadAll(response.Body)
+	if read_err != nil {
+		return fmt.Errorf("the connection dropped while downloading bytes %d-%d of %s: %w", offset, end, remote.URL, read_err)
+	}
+	// Without a known size a short chunk is the end of the file
+	if remote.Size < 0 && int64(len(chunk)) < end-offset+1 {
+		remote.Size = offset + int64(len(chunk))
+	}
+
+	remote.buffer = chunk
+	remote.start = offset
+	return nil
+}
+
+func (remote *RemoteFile) Read(p []byte) (int, error) {
+	if remote.Size >= 0 && remote.offset >= remote.Size {
+		return 0, io.EOF
+	}
+
+	if remote.offset < remote.start || remote.offset >= remote.start+int64(len(remote.buffer)) {
+		if fetch_err := remote.fetch(remote.offset); fetch_err != nil {
+			return 0, fetch_err
+		}
+		if len(remote.buffer) == 0 {
+			if remote.Size >= 0 && remote.offset >= remote.Size {
+				return 0, io.EOF
+			}
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+
+	copied := copy(p, remote.buffer[remote.offset-remote.start:])
+	remote.offset += int64(copied)
+	return copied, nil
+}
+
+func (remote *RemoteFile) Seek(offset int64, whence int) (int64, error) {
+	var new_offset int64
+	switch whence {
+	case io.SeekStart:
+		new_offset = offset
+	case io.SeekCurrent:
+		new_offset = remote.offset + offset
+	case io.SeekEnd:
+		if remote.Size < 0 {
+			return 0, fmt.Errorf("unable to seek from the end of %s because the server did not send its size", remote.URL)
+		}
+		new_offset = remote.Size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if new_offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	remote.offset = new_offset
+	return new_offset, nil
+}
+
+func (remote *RemoteFile) Close() error {
+	remote.buffer = nil
+	return nil
+}
+
+// OpenSource opens a local file or a remote url. Both can be read sequentially or seeked for indexed access
+func OpenSource(filename string) (io.ReadSeekCloser, error) {
+	if IsRemote(filename) {
+		return OpenRemote(filename)
+	}
+	return os.Open(filename)
+}
@@ -0,0 +1,120 @@
+package files
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go-phers-parser/internal/resources"
+)
+
+// stallAbortFactor is how many stall timeouts a read from standard input can wait before the
+// program gives up. The first timeout only logs a warning because bcftools can take a while to
+// reach the first record of a region in a large (or remote) file
+const stallAbortFactor = 3
+
+var (
+	stallTimeout time.Duration
+	stallLogger  *slog.Logger
+)
+
+// SetStallTimeout sets how long a read from standard input can wait for bytes before a warning is
+// logged. The program is stopped after stallAbortFactor timeouts. A timeout of 0 turns off the watch
+func SetStallTimeout(timeout time.Duration, logger *slog.Logger) error {
+	if timeout < 0 {
+		return fmt.Errorf("the stall timeout can't be negative but it was %s", timeout)
+	}
+	stallTimeout = timeout
+	stallLogger = logger
+	return nil
+}
+
+// Stdin returns standard input for the commands that stream the vcf from bcftools. With a stall
+// timeout the reads are watched so that a dead or stuck upstream process is reported instead of
+// the program silently waiting forever
+func Stdin() io.Reader {
+	if stallTimeout <= 0 {
+		return os.Stdin
+	}
+	logger := stallLogger
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+	on_stall := func(waited time.Duration, bytes_read int64) {
+		logger.Warn(fmt.Sprintf("No bytes have arrived from standard input for %s (%s were read before that). The process that is writing the vcf (usually bcftools) may have died or be stuck. The program stops if nothing arrives within %s", waited.Round(time.Second), resources.FormatBytes(bytes_read), stallTimeout*stallAbortFactor))
+	}
+	on_abort := func(waited time.Duration, bytes_read int64) {
+		logger.Error(fmt.Sprintf("No bytes have arrived from standard input for %s so the upstream process most likely died without closing the pipe. Stopping the program after %s were read. The outputs are incomplete. Use --stall-timeout to wait longer or 0 to wait forever", waited.Round(time.Second), resources.FormatBytes(bytes_read)))
+		os.Exit(1)
+	}
+	return NewStallReader(os.Stdin, stallTimeout, on_stall, on_abort)
+}
+
+// StallReader watches the reads of a stream. If a Read waits longer than the timeout for bytes
+// then on_stall is called once and if it waits stallAbortFactor timeouts then on_abort is called.
+// Time that isn't spent inside of a Read (such as when the writer is behind) never counts as a stall
+type StallReader struct {
+	on_stall      func(waited time.Duration, bytes_read int64)
+	on_abort      func(waited time.Duration, bytes_read int64)
+	reader        io.Reader
+	timeout       time.Duration
+	waiting_since atomic.Int64 // unix nanoseconds of the start of the current Read. 0 outside of a Read
+	bytes_read    atomic.Int64
+	done          chan struct{}
+	stopped       atomic.Bool
+}
+
+// NewStallReader starts watching the reads of the reader. The callbacks get how long the Read has
+// waited and the number of bytes that were read before it. Close stops the watch
+func NewStallReader(reader io.Reader, timeout time.Duration, on_stall func(time.Duration, int64), on_abort func(time.Duration, int64)) *StallReader {
+	stall_reader := &StallReader{on_stall: on_stall, on_abort: on_abort, reader: reader, timeout: timeout, done: make(chan struct{})}
+	go stall_reader.watch()
+	return stall_reader
+}
+
+func (stall_reader *StallReader) Read(p []byte) (int, error) {
+	stall_reader.waiting_since.Store(time.Now().UnixNano())
+	read, read_err := stall_reader.reader.Read(p)
+	stall_reader.waiting_since.Store(0)
+	stall_reader.bytes_read.Add(int64(read))
+	return read, read_err
+}
+
+// Close stops the watch. The reader that is being watched is not closed
+func (stall_reader *StallReader) Close() error {
+	if stall_reader.stopped.CompareAndSwap(false, true) {
+		close(stall_reader.done)
+	}
+	return nil
+}
+
+// watch checks the current Read a few times per timeout
+func (stall_reader *StallReader) watch() {
+	ticker := time.NewTicker(max(stall_reader.timeout/4, time.Millisecond))
+	defer ticker.Stop()
+
+	warned_for := int64(0) // the Read that the warning was logged for
+	for {
+		select {
+		case <-stall_reader.done:
+			return
+		case now := <-ticker.C:
+			since := stall_reader.waiting_since.Load()
+			if since == 0 {
+				continue
+			}
+			waited := now.Sub(time.Unix(0, since))
+			switch {
+			case waited >= stall_reader.timeout*stallAbortFactor:
+				stall_reader.on_abort(waited, stall_reader.bytes_read.Load())
+				return
+			case waited >= stall_reader.timeout && warned_for != since:
+				warned_for = since
+				stall_reader.on_stall(waited, stall_reader.bytes_read.Load())
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package files
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStallReader(t *testing.T) {
+	pipe_reader, pipe_writer := io.Pipe()
+	var stalls, aborts atomic.Int32
+	aborted := make(chan int64, 1)
+	stall_reader := NewStallReader(pipe_reader, 20*time.Millisecond,
+		func(waited time.Duration, bytes_read int64) { stalls.Add(1) },
+		func(waited time.Duration, bytes_read int64) {
+			aborts.Add(1)
+			aborted <- bytes_read
+		})
+	defer stall_reader.Close()
+
+	go func() {
+		pipe_writer.Write([]byte("#CHROM\n"))
+		// Nothing else is written and the pipe is never closed like an upstream process that died
+	}()
+	buffer := make([]byte, 64)
+	if read, _ := stall_reader.Read(buffer); read != 7 {
+		t.Fatalf("read %d bytes but expected 7", read)
+	}
+
+	// Time outside of a Read isn't a stall (the writer can be behind)
+	time.Sleep(100 * time.Millisecond)
+	if stalls.Load() != 0 || aborts.Load() != 0 {
+		t.Fatalf("the time between reads was reported as a stall")
+	}
+
+	go stall_reader.Read(buffer)
+	select {
+	case bytes_read := <-aborted:
+		if bytes_read != 7 {
+			t.Errorf("the abort reported %d bytes but 7 were read", bytes_read)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the stalled read was never aborted")
+	}
+	if stalls.Load() != 1 {
+		t.Errorf("expected 1 warning before the abort but found %d", stalls.Load())
+	}
+	pipe_writer.Close()
+}
@@ -0,0 +1,36 @@
+package files
+
+import "io"
+
+// StreamTail follows the end of a streamed input. A pipe that was cut off (the upstream process
+// died or was killed) ends like any other stream so the only sign is usually a last line that
+// doesn't end with a newline
+type StreamTail struct {
+	reader io.Reader
+	bytes  int64
+	last   byte
+}
+
+// NewStreamTail starts following the reads of the reader
+func NewStreamTail(reader io.Reader) *StreamTail {
+	return &StreamTail{reader: reader}
+}
+
+func (tail *StreamTail) Read(p []byte) (int, error) {
+	read, read_err := tail.reader.Read(p)
+	if read > 0 {
+		tail.bytes += int64(read)
+		tail.last = p[read-1]
+	}
+	return read, read_err
+}
+
+// Bytes returns how many bytes have been read from the stream
+func (tail *StreamTail) Bytes() int64 {
+	return tail.bytes
+}
+
+// Truncated reports if the stream stopped in the middle of a line. An empty stream isn't truncated
+func (tail *StreamTail) Truncated() bool {
+	return tail.bytes > 0 && tail.last != '\n'
+}
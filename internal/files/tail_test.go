@@ -0,0 +1,28 @@
+package files
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStreamTail(t *testing.T) {
+	cases := []struct {
+		name      string
+		stream    string
+		truncated bool
+	}{
+		{"complete", "#CHROM\tPOS\nchr1\t100\n", false},
+		{"cut off", "#CHROM\tPOS\nchr1\t10", true},
+		{"empty", "", false},
+	}
+	for _, test_case := range cases {
+		tail := NewStreamTail(strings.NewReader(test_case.stream))
+		if _, read_err := io.Copy(io.Discard, tail); read_err != nil {
+			t.Fatalf("%s: unexpected error: %s", test_case.name, read_err)
+		}
+		if tail.Truncated() != test_case.truncated || tail.Bytes() != int64(len(test_case.stream)) {
+			t.Errorf("%s: read %d bytes and found truncated=%t but expected %d bytes and truncated=%t", test_case.name, tail.Bytes(), tail.Truncated(), len(test_case.stream), test_case.truncated)
+		}
+	}
+}
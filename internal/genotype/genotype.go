@@ -0,0 +1,139 @@
+// Package genotype has the helpers that read a single sample call. The helpers work on the call
+// string directly and don't allocate so they can be used in the loops that look at every call of a
+// record. The pull-variants, find-all-carriers, view-sample-variants, and serve commands and the
+// vcf library all use these helpers so that a call is read the same way everywhere
+package genotype
+
+import (
+	"strconv"
+	"strings"
+
+	"go-phers-parser/internal/model"
+)
+
+// GT returns the GT portion of a sample call. The GT has to be the first FORMAT field
+func GT(call string) string {
+	if colon_indx := strings.IndexByte(call, ':'); colon_indx != -1 {
+		return call[:colon_indx]
+	}
+	return call
+}
+
+// next_allele splits the first allele off of the rest of the GT. done is true for the last allele
+func next_allele(gt string) (allele string, rest string, done bool) {
+	end := strings.IndexAny(gt, "/|")
+	if end == -1 {
+		return gt, "", true
+	}
+	return gt[:end], gt[end+1:], false
+}
+
+// HasAlt reports whether a sample call has an alternate allele. It gives the same answer as
+// model.ParseGenotype(nil, call).HasAlt() without allocating
+func HasAlt(call string) bool {
+	rest := GT(call)
+	for rest != "" {
+		allele, remaining, done := next_allele(rest)
+		if model.ParseAllele(allele) > 0 {
+			return true
+		}
+		if done {
+			break
+		}
+		rest = remaining
+	}
+	return false
+}
+
+// HasRef reports whether a sample call has a reference allele. It is the counterpart of HasAlt
+// for the records where the reference is the minor allele
+func HasRef(call string) bool {
+	rest := GT(call)
+	for rest != "" {
+		allele, remaining, done := next_allele(rest)
+		if model.ParseAllele(allele) == 0 {
+			return true
+		}
+		if done {
+			break
+		}
+		rest = remaining
+	}
+	return false
+}
+
+// AlleleCounts returns the number of alternate and reference alleles in a sample call. Missing
+// alleles aren't counted
+func AlleleCounts(call string) (int, int) {
+	alt_count, ref_count := 0, 0
+	rest := GT(call)
+	for rest != "" {
+		allele, remaining, done := next_allele(rest)
+		switch parsed := model.ParseAllele(allele); {
+		case parsed == 0:
+			ref_count++
+		case parsed > 0:
+			alt_count++
+		}
+		if done {
+			break
+		}
+		rest = remaining
+	}
+	return alt_count, ref_count
+}
+
+// Alleles returns the allele indices of the call where 0 is the reference. Missing alleles are
+// model.MissingAllele. A call without a GT has no alleles
+func Alleles(call string) []int {
+	return model.ParseGenotype(nil, call).Alleles
+}
+
+// Ploidy returns the number of alleles in a sample call without parsing the alleles
+func Ploidy(call string) int {
+	gt := GT(call)
+	if gt == "" {
+		return 0
+	}
+	return strings.Count(gt, "/") + strings.Count(gt, "|") + 1
+}
+
+// IsPhased reports whether the alleles of the call are separated by | instead of /
+func IsPhased(call string) bool {
+	return strings.IndexByte(GT(call), '|') != -1
+}
+
+// Class returns the zygosity of the call. The classification works for any ploidy so 0/0/0 is
+// homozygous reference and 0/0/1 is heterozygous
+func Class(call string) model.GenotypeClass {
+	return model.ParseGenotype(nil, call).Class()
+}
+
+// ParsePloidyList parses a comma separated list of ploidies like "1,2" into a set
+func ParsePloidyList(value string) (map[int]bool, error) {
+	ploidies := make(map[int]bool)
+	for _, ploidy_str := range strings.Split(value, ",") {
+		ploidy, err := strconv.Atoi(strings.TrimSpace(ploidy_str))
+		if err != nil {
+			return nil, err
+		}
+		ploidies[ploidy] = true
+	}
+	return ploidies, nil
+}
+
+// FormatValue returns the value of a FORMAT field from a sample call. The second value is false
+// if the field isn't in the FORMAT column, if the call was truncated, or if the value is missing
+func FormatValue(format string, call string, key string) (string, bool) {
+	for {
+		format_key, format_rest, format_more := strings.Cut(format, ":")
+		value, call_rest, call_more := strings.Cut(call, ":")
+		if format_key == key {
+			return value, value != "" && value != "."
+		}
+		if !format_more || !call_more {
+			return "", false
+		}
+		format, call = format_rest, call_rest
+	}
+}
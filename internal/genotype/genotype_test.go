@@ -0,0 +1,127 @@
+package genotype
+
+import (
+	"slices"
+	"testing"
+
+	"go-phers-parser/internal/model"
+)
+
+func TestCallHelpers(t *testing.T) {
+	cases := []struct {
+		call    string
+		has_alt bool
+		has_ref bool
+		alt     int
+		ref     int
+		ploidy  int
+		phased  bool
+		class   model.GenotypeClass
+		alleles []int
+	}{
+		{"0/0", false, true, 0, 2, 2, false, model.HomRef, []int{0, 0}},
+		{"0/1:35:99", true, true, 1, 1, 2, false, model.Het, []int{0, 1}},
+		{"1|1", true, false, 2, 0, 2, true, model.HomAlt, []int{1, 1}},
+		{"1|0:.:5", true, true, 1, 1, 2, true, model.Het, []int{1, 0}},
+		{"./.", false, false, 0, 0, 2, false, model.Missing, []int{model.MissingAllele, model.MissingAllele}},
+		{"./1", true, false, 1, 0, 2, false, model.Other, []int{model.MissingAllele, 1}},
+		{"1/2", true, false, 2, 0, 2, false, model.Other, []int{1, 2}},
+		{"1", true, false, 1, 0, 1, false, model.HomAlt, []int{1}},
+		{"0/0/1", true, true, 1, 2, 3, false, model.Het, []int{0, 0, 1}},
+		{"0//1", true, true, 1, 1, 3, false, model.Other, []int{0, model.MissingAllele, 1}},
+		{"", false, false, 0, 0, 0, false, model.Missing, nil},
+		{":35", false, false, 0, 0, 0, false, model.Missing, nil},
+	}
+	for _, test_case := range cases {
+		if has_alt := HasAlt(test_case.call); has_alt != test_case.has_alt {
+			t.Errorf("HasAlt(%q) = %t but expected %t", test_case.call, has_alt, test_case.has_alt)
+		}
+		if has_ref := HasRef(test_case.call); has_ref != test_case.has_ref {
+			t.Errorf("HasRef(%q) = %t but expected %t", test_case.call, has_ref, test_case.has_ref)
+		}
+		if alt, ref := AlleleCounts(test_case.call); alt != test_case.alt || ref != test_case.ref {
+			t.Errorf("AlleleCounts(%q) = %d, %d but expected %d, %d", test_case.call, alt, ref, test_case.alt, test_case.ref)
+		}
+		if ploidy := Ploidy(test_case.call); ploidy != test_case.ploidy {
+			t.Errorf("Ploidy(%q) = %d but expected %d", test_case.call, ploidy, test_case.ploidy)
+		}
+		if phased := IsPhased(test_case.call); phased != test_case.phased {
+			t.Errorf("IsPhased(%q) = %t but expected %t", test_case.call, phased, test_case.phased)
+		}
+		if class := Class(test_case.call); class != test_case.class {
+			t.Errorf("Class(%q) = %s but expected %s", test_case.call, class, test_case.class)
+		}
+		if alleles := Alleles(test_case.call); !slices.Equal(alleles, test_case.alleles) {
+			t.Errorf("Alleles(%q) = %v but expected %v", test_case.call, alleles, test_case.alleles)
+		}
+		// The helpers that don't allocate have to agree with the parsed genotype
+		parsed := model.ParseGenotype(nil, test_case.call)
+		if parsed.HasAlt() != HasAlt(test_case.call) || parsed.Ploidy() != Ploidy(test_case.call) {
+			t.Errorf("the helpers disagree with model.ParseGenotype for the call %q", test_case.call)
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	cases := []struct {
+		format string
+		call   string
+		key    string
+		value  string
+		found  bool
+	}{
+		{"GT:DP:GQ", "0/1:35:99", "GQ", "99", true},
+		{"GT:DP:GQ", "0/1:35:99", "GT", "0/1", true},
+		{"GT:DP:GQ", "0/1:35", "GQ", "", false},
+		{"GT:DP:GQ", "0/1:.:99", "DP", ".", false},
+		{"GT:DP", "0/1:35", "PS", "", false},
+	}
+	for _, test_case := range cases {
+		value, found := FormatValue(test_case.format, test_case.call, test_case.key)
+		if value != test_case.value || found != test_case.found {
+			t.Errorf("FormatValue(%q, %q, %q) = %q, %t but expected %q, %t", test_case.format, test_case.call, test_case.key, value, found, test_case.value, test_case.found)
+		}
+	}
+}
+
+func TestCallPhase(t *testing.T) {
+	first := CallPhase("GT:PS", "0|1:100")
+	second := CallPhase("GT:PS", "0|1:100")
+	third := CallPhase("GT:PS", "1|0:100")
+	other_set := CallPhase("GT:PS", "1|0:200")
+	unphased := CallPhase("GT", "0/1")
+	hom_alt := CallPhase("GT", "1|1")
+
+	if first.Haplotype != 1 || third.Haplotype != 0 || first.PhaseSet != "100" {
+		t.Errorf("unexpected phases %+v and %+v", first, third)
+	}
+	if unphased.Phased || hom_alt.Phased {
+		t.Errorf("only phased heterozygous calls have a phase but found %+v and %+v", unphased, hom_alt)
+	}
+
+	relations := []struct {
+		first    Phase
+		second   Phase
+		relation string
+	}{
+		{first, second, "cis"},
+		{first, third, "trans"},
+		{first, other_set, "unknown"},
+		{first, unphased, "unknown"},
+	}
+	for _, test_case := range relations {
+		if relation := test_case.first.Relation(test_case.second); relation != test_case.relation {
+			t.Errorf("the relation of %+v and %+v is %s but expected %s", test_case.first, test_case.second, relation, test_case.relation)
+		}
+	}
+}
+
+func TestParsePloidyList(t *testing.T) {
+	ploidies, err := ParsePloidyList("1, 2")
+	if err != nil || !ploidies[1] || !ploidies[2] || len(ploidies) != 2 {
+		t.Errorf("ParsePloidyList(\"1, 2\") = %v, %v", ploidies, err)
+	}
+	if _, err := ParsePloidyList("1,two"); err == nil {
+		t.Errorf("expected an error for a ploidy that isn't a number")
+	}
+}
@@ -0,0 +1,45 @@
+package genotype
+
+import "go-phers-parser/internal/model"
+
+// Phase is the phasing of a heterozygous call. Haplotype is the index of the allele in the GT that
+// carries the alternate allele (0 for 1|0 and 1 for 0|1). PhaseSet is the PS value of the call. The
+// VCF spec says that phased calls without a PS are in the same phase set so the PS is empty for these
+type Phase struct {
+	Phased    bool
+	Haplotype int
+	PhaseSet  string
+}
+
+// CallPhase returns the phase of a heterozygous call. Calls that are unphased, missing the GT, or
+// not heterozygous are returned as unphased
+func CallPhase(format string, call string) Phase {
+	parsed := model.ParseGenotype(nil, call)
+	if !parsed.Phased || parsed.Class() != model.Het {
+		return Phase{}
+	}
+	phase := Phase{Phased: true, Haplotype: -1}
+	for indx, allele := range parsed.Alleles {
+		if allele > 0 {
+			phase.Haplotype = indx
+			break
+		}
+	}
+	if phase_set, found := FormatValue(format, call, "PS"); found {
+		phase.PhaseSet = phase_set
+	}
+	return phase
+}
+
+// Relation reports whether the alternate alleles of two heterozygous calls are in cis (on the same
+// haplotype) or in trans (on different haplotypes). The calls need to be phased in the same phase
+// set to be compared. Otherwise the relation is unknown
+func (phase Phase) Relation(other Phase) string {
+	if !phase.Phased || !other.Phased || phase.PhaseSet != other.PhaseSet || phase.Haplotype == -1 || other.Haplotype == -1 {
+		return "unknown"
+	}
+	if phase.Haplotype == other.Haplotype {
+		return "cis"
+	}
+	return "trans"
+}
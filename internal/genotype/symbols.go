@@ -0,0 +1,65 @@
+package genotype
+
+import (
+	"strings"
+
+	"go-phers-parser/internal/model"
+)
+
+// Symbol is the index of a distinct GT in a SymbolTable. A cohort only has a few dozen distinct GT
+// values (0/0, 0/1, 1|0, ./., ...) across millions of calls so a small integer is enough to name one
+type Symbol uint32
+
+// Summary is what the commands read from a GT. It is worked out once for each distinct GT instead
+// of once for every call
+type Summary struct {
+	GT       string // the interned GT. It doesn't keep the line that it was first seen in alive
+	Class    model.GenotypeClass
+	Ploidy   int
+	AltCount int
+	RefCount int
+}
+
+// SymbolTable interns the GT values of a stream. Looking up a GT that was already seen doesn't
+// allocate because the map is searched with the substring of the line, so only the first call of
+// each distinct GT is copied and classified. Every distinct GT is kept until the table is dropped
+// so a table should belong to a single stream. The table isn't safe for concurrent use
+type SymbolTable struct {
+	ids       map[string]Symbol
+	summaries []Summary
+}
+
+// NewSymbolTable creates an empty table
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{ids: make(map[string]Symbol)}
+}
+
+// Intern returns the symbol of the GT of the call. Anything after the GT (the other FORMAT values)
+// is ignored so calls with the same GT share a symbol
+func (table *SymbolTable) Intern(call string) Symbol {
+	gt := GT(call)
+	if symbol, found := table.ids[gt]; found {
+		return symbol
+	}
+	gt = strings.Clone(gt)
+	alt_count, ref_count := AlleleCounts(gt)
+	symbol := Symbol(len(table.summaries))
+	table.summaries = append(table.summaries, Summary{GT: gt, Class: Class(gt), Ploidy: Ploidy(gt), AltCount: alt_count, RefCount: ref_count})
+	table.ids[gt] = symbol
+	return symbol
+}
+
+// Summary returns the summary of a symbol that the table handed out
+func (table *SymbolTable) Summary(symbol Symbol) Summary {
+	return table.summaries[symbol]
+}
+
+// Lookup interns the GT of the call and returns its summary
+func (table *SymbolTable) Lookup(call string) Summary {
+	return table.summaries[table.Intern(call)]
+}
+
+// Len is the number of distinct GT values in the table
+func (table *SymbolTable) Len() int {
+	return len(table.summaries)
+}
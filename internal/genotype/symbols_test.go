@@ -0,0 +1,41 @@
+package genotype
+
+import (
+	"testing"
+
+	"go-phers-parser/internal/model"
+)
+
+func TestSymbolTable(t *testing.T) {
+	table := NewSymbolTable()
+	line := "0/1:35:99\t0/1\t1|1:.:5\t./."
+	calls := []string{line[0:9], line[10:13], line[14:21], line[22:]}
+
+	het := table.Intern(calls[0])
+	if again := table.Intern(calls[1]); again != het {
+		t.Errorf("expected the calls %q and %q to share the symbol of their GT but got %d and %d", calls[0], calls[1], het, again)
+	}
+	if table.Intern(calls[2]) == het || table.Len() != 2 {
+		t.Errorf("expected 2 distinct GT values after the calls %v but found %d", calls[:3], table.Len())
+	}
+
+	cases := []struct {
+		call    string
+		summary Summary
+	}{
+		{calls[0], Summary{GT: "0/1", Class: model.Het, Ploidy: 2, AltCount: 1, RefCount: 1}},
+		{calls[2], Summary{GT: "1|1", Class: model.HomAlt, Ploidy: 2, AltCount: 2}},
+		{calls[3], Summary{GT: "./.", Class: model.Missing, Ploidy: 2}},
+		{"0/0/1", Summary{GT: "0/0/1", Class: model.Het, Ploidy: 3, AltCount: 1, RefCount: 2}},
+	}
+	for _, test_case := range cases {
+		if summary := table.Lookup(test_case.call); summary != test_case.summary {
+			t.Errorf("expected the summary %+v for %q but got %+v", test_case.summary, test_case.call, summary)
+		}
+	}
+
+	// A GT that was already interned is looked up without allocating
+	if allocations := testing.AllocsPerRun(100, func() { table.Lookup(calls[1]) }); allocations != 0 {
+		t.Errorf("expected the lookup of a known GT to not allocate but it made %.0f allocations", allocations)
+	}
+}
@@ -0,0 +1,241 @@
+package header
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go-phers-parser/internal/contig"
+)
+
+// Contig stores the information from a ##contig=<ID=...,length=...> line in the vcf header
+type Contig struct {
+	ID       string
+	Length   int // this value is 0 if the header line didn't have a length
+	Assembly string
+}
+
+// FieldDefinition stores the information from the ##INFO and ##FORMAT lines. The Number
+// can be an integer or one of the special values A (one per alternate allele), R (one per
+// allele including the reference), G (one per genotype), or . (unknown)
+type FieldDefinition struct {
+	ID          string
+	Number      string
+	Type        string
+	Description string
+}
+
+// Metadata holds the information that we collect from the "##" lines of the vcf header
+type Metadata struct {
+	FileFormat string
+	Reference  string
+	Contigs    []Contig
+	Info       map[string]FieldDefinition
+	Format     map[string]FieldDefinition
+	Filter     map[string]FieldDefinition // only the ID and Description are set for FILTER lines
+	// Number of lines (including the #CHROM line) that make up the header. We
+	// use this value to convert record numbers into line numbers in the file
+	HeaderLines int
+	Lines       []string // every "##" line in the order they appeared so that the header can be written back out
+}
+
+// These are the lengths of chromosome 1 in the two builds that our callsets use. The length of
+// chromosome 1 is different between the builds so we can use it to guess the build when there
+// is no ##reference line
+var chrom1Lengths = map[int]string{
+	249250621: "GRCh37",
+	248956422: "GRCh38",
+}
+
+// ParseStructuredValue parses the value of header lines like
+// ##contig=<ID=chr1,length=248956422> into a map of the keys and the values. Values that are
+// wrapped in quotes can have commas in them so we can't just split the string on the commas
+func ParseStructuredValue(value string) map[string]string {
+	fields := make(map[string]string)
+
+	value = strings.TrimSpace(value)
+	value = strings.TrimPrefix(value, "<")
+	value = strings.TrimSuffix(value, ">")
+
+	var key strings.Builder
+	var current strings.Builder
+	in_quotes := false
+	in_key := true
+
+	flush := func() {
+		if key.Len() > 0 {
+			fields[strings.TrimSpace(key.String())] = current.String()
+		}
+		key.Reset()
+		current.Reset()
+		in_key = true
+	}
+
+	for _, r := range value {
+		switch {
+		case r == '"':
+			in_quotes = !in_quotes
+		case r == '=' && in_key && !in_quotes:
+			in_key = false
+		case r == ',' && !in_quotes:
+			flush()
+		case in_key:
+			key.WriteRune(r)
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+
+	return fields
+}
+
+// AddLine adds the information from a single "##" header line to the metadata. Lines
+// that we don't use are ignored
+func (meta *Metadata) AddLine(line string) {
+	meta.Lines = append(meta.Lines, strings.TrimSpace(line))
+
+	key, value, found := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "##"), "=")
+	if !found {
+		return
+	}
+
+	switch key {
+	case "fileformat":
+		meta.FileFormat = value
+	case "reference":
+		meta.Reference = value
+	case "INFO", "FORMAT":
+		fields := ParseStructuredValue(value)
+		definition := FieldDefinition{ID: fields["ID"], Number: fields["Number"], Type: fields["Type"], Description: fields["Description"]}
+		if key == "INFO" {
+			if meta.Info == nil {
+				meta.Info = make(map[string]FieldDefinition)
+			}
+			meta.Info[definition.ID] = definition
+		} else {
+			if meta.Format == nil {
+				meta.Format = make(map[string]FieldDefinition)
+			}
+			meta.Format[definition.ID] = definition
+		}
+	case "FILTER":
+		fields := ParseStructuredValue(value)
+		if meta.Filter == nil {
+			meta.Filter = make(map[string]FieldDefinition)
+		}
+		meta.Filter[fields["ID"]] = FieldDefinition{ID: fields["ID"], Description: fields["Description"]}
+	case "contig":
+		fields := ParseStructuredValue(value)
+		contig_length, _ := strconv.Atoi(fields["length"])
+		meta.Contigs = append(meta.Contigs, Contig{ID: fields["ID"], Length: contig_length, Assembly: fields["assembly"]})
+	}
+}
+
+// FindContig looks for the contig regardless of whether the header or the query uses the chr prefix
+func (meta *Metadata) FindContig(name string) (Contig, bool) {
+	for _, header_contig := range meta.Contigs {
+		if contig.Same(header_contig.ID, name) {
+			return header_contig, true
+		}
+	}
+	return Contig{}, false
+}
+
+// NormalizeBuild converts the different names for the builds into either GRCh37 or GRCh38. An
+// empty string is returned if the build isn't recognized
+func NormalizeBuild(value string) string {
+	lowered := strings.ToLower(value)
+	switch {
+	case strings.Contains(lowered, "grch38"), strings.Contains(lowered, "hg38"), strings.Contains(lowered, "b38"):
+		return "GRCh38"
+	case strings.Contains(lowered, "grch37"), strings.Contains(lowered, "hg19"), strings.Contains(lowered, "b37"), strings.Contains(lowered, "hs37"):
+		return "GRCh37"
+	default:
+		return ""
+	}
+}
+
+// BuildFromReference guesses the build from the ##reference line
+func (meta *Metadata) BuildFromReference() string {
+	return NormalizeBuild(meta.Reference)
+}
+
+// BuildFromContigs guesses the build from the assembly attribute or the length of chromosome 1
+func (meta *Metadata) BuildFromContigs() string {
+	for _, header_contig := range meta.Contigs {
+		if build := NormalizeBuild(header_contig.Assembly); build != "" {
+			return build
+		}
+	}
+	if chrom1, ok := meta.FindContig("1"); ok {
+		return chrom1Lengths[chrom1.Length]
+	}
+	return ""
+}
+
+// Version is the version of the VCF specification from the ##fileformat=VCFv4.x line
+type Version struct {
+	Major int
+	Minor int
+}
+
+func (version Version) String() string {
+	return fmt.Sprintf("VCFv%d.%d", version.Major, version.Minor)
+}
+
+// AtLeast reports whether the version is the same or newer than major.minor
+func (version Version) AtLeast(major int, minor int) bool {
+	return version.Major > major || (version.Major == major && version.Minor >= minor)
+}
+
+// ParseVersion parses the value of the ##fileformat line (such as VCFv4.2)
+func ParseVersion(fileformat string) (Version, error) {
+	version_str, found := strings.CutPrefix(strings.TrimSpace(fileformat), "VCFv")
+	if !found {
+		return Version{}, fmt.Errorf("expected the fileformat to have the form VCFv4.x but found the value %s", fileformat)
+	}
+
+	major_str, minor_str, _ := strings.Cut(version_str, ".")
+
+	major, major_err := strconv.Atoi(major_str)
+	if major_err != nil {
+		return Version{}, fmt.Errorf("failed to parse the major version from the fileformat %s: %w", fileformat, major_err)
+	}
+
+	minor, minor_err := strconv.Atoi(minor_str)
+	if minor_err != nil {
+		return Version{}, fmt.Errorf("failed to parse the minor version from the fileformat %s: %w", fileformat, minor_err)
+	}
+
+	return Version{Major: major, Minor: minor}, nil
+}
+
+// Version returns the version of the VCF specification that the file uses
+func (meta *Metadata) Version() (Version, error) {
+	if meta.FileFormat == "" {
+		return Version{}, fmt.Errorf("the vcf header did not have a ##fileformat line")
+	}
+	return ParseVersion(meta.FileFormat)
+}
+
+// PercentEncoded reports whether the INFO values can contain percent encoded characters. Starting with
+// VCFv4.3, characters like ';', '=', and ',' are written as %3B, %3D, and %2C inside of INFO values
+func (meta *Metadata) PercentEncoded() bool {
+	version, err := meta.Version()
+	return err == nil && version.AtLeast(4, 3)
+}
+
+// PercentDecode decodes a percent encoded INFO value. If the value has an invalid escape
+// sequence then we return the original value because older files may have a literal '%'
+func PercentDecode(value string) string {
+	if !strings.Contains(value, "%") {
+		return value
+	}
+	decoded, err := url.PathUnescape(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
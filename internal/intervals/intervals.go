@@ -0,0 +1,153 @@
+// Package intervals answers whether a position or a range overlaps a set of genomic intervals.
+// The intervals are sorted and merged once when the set is built so that every lookup is a binary
+// search. This gives the same O(log n) lookups as an interval tree for the membership questions
+// that we ask and the set can be shared by the annotation and the vcf filters
+package intervals
+
+import (
+	"fmt"
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/files"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Interval is a 1-based closed range on a chromosome like the chrX:start-end regions
+type Interval struct {
+	Chrom string
+	Start int
+	End   int
+}
+
+// Set is a precompiled set of intervals. The intervals of each chromosome are stored by the
+// canonical chromosome name so that chr22 and 22 find the same intervals
+type Set struct {
+	chroms    map[string][]Interval
+	order     []string // the chromosome names in the order that they were first seen
+	intervals int      // the number of intervals before they were merged
+}
+
+// New sorts and merges the intervals. Intervals that overlap or touch are merged into one
+func New(intervals []Interval) *Set {
+	set := &Set{chroms: make(map[string][]Interval), intervals: len(intervals)}
+	for _, interval := range intervals {
+		key := contig.Canonical(interval.Chrom)
+		if _, found := set.chroms[key]; !found {
+			set.order = append(set.order, interval.Chrom)
+		}
+		set.chroms[key] = append(set.chroms[key], interval)
+	}
+
+	for key, chrom_intervals := range set.chroms {
+		slices.SortFunc(chrom_intervals, func(first, second Interval) int { return first.Start - second.Start })
+
+		merged := chrom_intervals[:0]
+		for _, interval := range chrom_intervals {
+			if last := len(merged) - 1; last >= 0 && interval.Start <= merged[last].End+1 {
+				merged[last].End = max(merged[last].End, interval.End)
+				continue
+			}
+			merged = append(merged, interval)
+		}
+		set.chroms[key] = merged
+	}
+	return set
+}
+
+// overlaps_sorted reports whether start-end overlaps one of the sorted and merged intervals
+func overlaps_sorted(chrom_intervals []Interval, start int, end int) bool {
+	// This is the first interval that ends at or after the start. Since the intervals don't
+	// overlap each other it is the only interval that can contain the start
+	indx := sort.Search(len(chrom_intervals), func(i int) bool { return chrom_intervals[i].End >= start })
+	return indx < len(chrom_intervals) && chrom_intervals[indx].Start <= end
+}
+
+// Overlaps reports whether the range start-end on the chromosome overlaps one of the intervals.
+// An empty chromosome name matches the intervals of every chromosome which is used for positions
+// that don't include the chromosome
+func (set *Set) Overlaps(chrom string, start int, end int) bool {
+	if end < start {
+		end = start
+	}
+	if chrom == "" {
+		for _, chrom_intervals := range set.chroms {
+			if overlaps_sorted(chrom_intervals, start, end) {
+				return true
+			}
+		}
+		return false
+	}
+	return overlaps_sorted(set.chroms[contig.Canonical(chrom)], start, end)
+}
+
+// Contains reports whether the position is in one of the intervals
+func (set *Set) Contains(chrom string, pos int) bool {
+	return set.Overlaps(chrom, pos, pos)
+}
+
+// HasChrom reports whether the set has intervals on the chromosome
+func (set *Set) HasChrom(chrom string) bool {
+	_, found := set.chroms[contig.Canonical(chrom)]
+	return found
+}
+
+// Chroms returns the chromosome names of the set in the order that they were first seen
+func (set *Set) Chroms() []string {
+	return set.order
+}
+
+// Len is the number of intervals that the set was built from
+func (set *Set) Len() int {
+	return set.intervals
+}
+
+// String describes the set for the log. A single interval is written as chrX:start-end
+func (set *Set) String() string {
+	if len(set.order) == 1 {
+		if chrom_intervals := set.chroms[contig.Canonical(set.order[0])]; len(chrom_intervals) == 1 {
+			return fmt.Sprintf("%s:%d-%d", set.order[0], chrom_intervals[0].Start, chrom_intervals[0].End)
+		}
+	}
+	return fmt.Sprintf("%d intervals on %d chromosome(s)", set.intervals, len(set.order))
+}
+
+// ReadBED reads the intervals of a BED file. BED files use 0-based half open coordinates so the
+// start is shifted by one to get 1-based closed intervals. Header, track, and comment lines are
+// skipped and only the first three columns are used
+func ReadBED(filename string) ([]Interval, error) {
+	bed_fr := files.Open(filename, 1024*1024)
+	defer bed_fr.Close()
+	if bed_fr.Err != nil {
+		return nil, fmt.Errorf("unable to read the BED file %s: %w", filename, bed_fr.Err)
+	}
+
+	var intervals []Interval
+	line_number := 0
+	for bed_fr.FileScanner.Scan() {
+		line_number++
+		line := strings.TrimSpace(bed_fr.FileScanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+
+		columns := strings.Fields(line)
+		if len(columns) < 3 {
+			return nil, fmt.Errorf("line %d of the BED file %s has %d columns but a BED file needs the chrom, start, and end columns", line_number, filename, len(columns))
+		}
+		start, start_err := strconv.Atoi(columns[1])
+		end, end_err := strconv.Atoi(columns[2])
+		if start_err != nil || end_err != nil || start < 0 || end <= start {
+			return nil, fmt.Errorf("line %d of the BED file %s has the start %s and end %s which are not a valid interval", line_number, filename, columns[1], columns[2])
+		}
+		intervals = append(intervals, Interval{Chrom: columns[0], Start: start + 1, End: end})
+	}
+	if bed_fr.FileScanner.Err() != nil {
+		return nil, fmt.Errorf("encountered the following error while reading the BED file %s: %w", filename, bed_fr.FileScanner.Err())
+	}
+	if len(intervals) == 0 {
+		return nil, fmt.Errorf("the BED file %s did not have any intervals", filename)
+	}
+	return intervals, nil
+}
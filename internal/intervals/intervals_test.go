@@ -0,0 +1,141 @@
+package intervals
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func write_bed(t *testing.T, contents string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "regions.bed")
+	if write_err := os.WriteFile(filename, []byte(contents), 0o644); write_err != nil {
+		t.Fatalf("unable to write the BED file: %s", write_err)
+	}
+	return filename
+}
+
+func TestReadBED(t *testing.T) {
+	cases := []struct {
+		name     string
+		contents string
+		expected []Interval
+	}{
+		{"single base", "chr1\t0\t1\n", []Interval{{"chr1", 1, 1}}},
+		{"half open end", "chr1\t99\t200\n", []Interval{{"chr1", 100, 200}}},
+		{"extra columns", "22 10 20 name 0 +\n", []Interval{{"22", 11, 20}}},
+		{
+			"header lines",
+			"browser position chr1:1-100\ntrack name=regions\n# a comment\n\nchr1\t0\t10\nchrX\t5\t6\n",
+			[]Interval{{"chr1", 1, 10}, {"chrX", 6, 6}},
+		},
+	}
+	for _, test_case := range cases {
+		intervals, read_err := ReadBED(write_bed(t, test_case.contents))
+		if read_err != nil {
+			t.Errorf("%s: expected the BED file to be read but got the error %s", test_case.name, read_err)
+			continue
+		}
+		if !slices.Equal(intervals, test_case.expected) {
+			t.Errorf("%s: expected the intervals %v but got %v", test_case.name, test_case.expected, intervals)
+		}
+	}
+
+	for name, contents := range map[string]string{
+		"too few columns":  "chr1\t10\n",
+		"negative start":   "chr1\t-1\t10\n",
+		"empty interval":   "chr1\t10\t10\n",
+		"end before start": "chr1\t20\t10\n",
+		"not a number":     "chr1\tstart\t10\n",
+		"only headers":     "track name=regions\n# a comment\n",
+	} {
+		if _, read_err := ReadBED(write_bed(t, contents)); read_err == nil {
+			t.Errorf("%s: expected the BED file to be rejected", name)
+		}
+	}
+}
+
+func TestNewMerge(t *testing.T) {
+	cases := []struct {
+		name      string
+		intervals []Interval
+		expected  []Interval
+	}{
+		{"overlapping", []Interval{{"1", 1, 10}, {"1", 5, 20}}, []Interval{{"1", 1, 20}}},
+		{"contained", []Interval{{"1", 1, 100}, {"1", 20, 30}}, []Interval{{"1", 1, 100}}},
+		{"adjacent", []Interval{{"1", 1, 10}, {"1", 11, 20}}, []Interval{{"1", 1, 20}}},
+		{"gapped", []Interval{{"1", 1, 10}, {"1", 12, 20}}, []Interval{{"1", 1, 10}, {"1", 12, 20}}},
+		{"unsorted", []Interval{{"1", 30, 40}, {"1", 1, 10}, {"1", 8, 15}}, []Interval{{"1", 1, 15}, {"1", 30, 40}}},
+		{"mixed names", []Interval{{"chr1", 1, 10}, {"1", 5, 20}}, []Interval{{"chr1", 1, 20}}},
+	}
+	for _, test_case := range cases {
+		set := New(test_case.intervals)
+		if merged := set.chroms["1"]; !slices.Equal(merged, test_case.expected) {
+			t.Errorf("%s: expected the merged intervals %v but got %v", test_case.name, test_case.expected, merged)
+		}
+		if set.Len() != len(test_case.intervals) {
+			t.Errorf("%s: expected Len to count the %d intervals before merging but got %d", test_case.name, len(test_case.intervals), set.Len())
+		}
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	set := New([]Interval{{"chr22", 100, 200}, {"chr22", 300, 400}, {"X", 50, 60}, {"chrM", 1, 10}})
+	cases := []struct {
+		chrom    string
+		start    int
+		end      int
+		expected bool
+	}{
+		{"chr22", 100, 100, true},
+		{"chr22", 200, 200, true},
+		{"chr22", 99, 99, false},
+		{"chr22", 201, 201, false},
+		{"chr22", 201, 299, false},
+		{"chr22", 150, 350, true},
+		{"chr22", 50, 100, true},
+		{"chr22", 400, 500, true},
+		{"chr22", 250, 240, false}, // an end before the start is treated as the start
+		{"22", 150, 150, true},
+		{"CHR22", 150, 150, true},
+		{"chrX", 55, 55, true},
+		{"X", 61, 61, false},
+		{"MT", 5, 5, true},
+		{"chrMT", 5, 5, true},
+		{"M", 5, 5, true},
+		{"chr1", 150, 150, false},
+		{"", 55, 55, true}, // an empty chromosome matches any of the chromosomes
+		{"", 250, 250, false},
+	}
+	for _, test_case := range cases {
+		if found := set.Overlaps(test_case.chrom, test_case.start, test_case.end); found != test_case.expected {
+			t.Errorf("expected Overlaps(%q, %d, %d) to be %t but got %t", test_case.chrom, test_case.start, test_case.end, test_case.expected, found)
+		}
+	}
+
+	if !set.Contains("22", 300) || set.Contains("22", 299) {
+		t.Errorf("expected Contains to include the first base of an interval and exclude the base before it")
+	}
+	if !set.HasChrom("22") || !set.HasChrom("chrX") || set.HasChrom("chr1") {
+		t.Errorf("expected HasChrom to match chr22 and X regardless of the chr prefix")
+	}
+}
+
+func TestSetDescription(t *testing.T) {
+	single := New([]Interval{{"chr22", 100, 200}, {"22", 150, 250}})
+	if single.String() != "chr22:100-250" {
+		t.Errorf("expected the merged interval to be described as chr22:100-250 but got %s", single.String())
+	}
+	if !slices.Equal(single.Chroms(), []string{"chr22"}) {
+		t.Errorf("expected the chromosome to keep the first name that was seen but got %v", single.Chroms())
+	}
+
+	multiple := New([]Interval{{"2", 1, 10}, {"chr1", 1, 10}, {"1", 20, 30}})
+	if multiple.String() != "3 intervals on 2 chromosome(s)" {
+		t.Errorf("expected the set to be described as 3 intervals on 2 chromosome(s) but got %s", multiple.String())
+	}
+	if !slices.Equal(multiple.Chroms(), []string{"2", "chr1"}) {
+		t.Errorf("expected the chromosomes in the order that they were first seen but got %v", multiple.Chroms())
+	}
+}
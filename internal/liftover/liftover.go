@@ -0,0 +1,323 @@
+package liftover
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/files"
+)
+
+// block is one ungapped alignment between the source build and the target
+// build. All of the coordinates are 0-based and half open like they are in the chain file
+type block struct {
+	sourceChrom string
+	sourceSize  int
+	sourceStart int
+	sourceEnd   int
+	targetChrom string
+	targetStart int
+	targetSize  int
+	targetMinus bool
+}
+
+// Chain holds all of the alignment blocks from a UCSC chain file (such as
+// hg19ToHg38.over.chain.gz) so that we can convert positions between builds.
+// Blocks are stored by the canonical name of the source chromosome so that
+// chr22 and 22 will both find the same blocks
+type Chain struct {
+	Filename string
+	blocks   map[string][]block
+}
+
+// ReadChainFile reads in a chain file. The file can be gzipped or uncompressed
+func ReadChainFile(filename string, buffersize int) (*Chain, error) {
+	chain_fr := files.Open(filename, buffersize)
+	defer chain_fr.Close()
+
+	if chain_fr.Err != nil {
+		return nil, chain_fr.Err
+	}
+
+	chain := &Chain{Filename: filename, blocks: make(map[string][]block)}
+
+	// These values describe the chain that we are currently inside of. Each chain
+	// starts with a header line followed by lines of "size dt dq" and ends with a line that only has the size
+	var source_chrom string
+	var source_size int
+	var target_chrom string
+	var target_size int
+	var target_minus bool
+	var source_pos int
+	var target_pos int
+	in_chain := false
+
+	line_number := 0
+	for chain_fr.FileScanner.Scan() {
+		line_number++
+		line := strings.TrimSpace(chain_fr.FileScanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		if fields[0] == "chain" {
+			if len(fields) < 12 {
+				return nil, fmt.Errorf("the chain header on line %d of the file %s only had %d fields but 12 were expected", line_number, filename, len(fields))
+			}
+			var conv_errs [4]error
+			target_size, conv_errs[0] = strconv.Atoi(fields[8])
+			source_pos, conv_errs[1] = strconv.Atoi(fields[5])
+			target_pos, conv_errs[2] = strconv.Atoi(fields[10])
+			source_size, conv_errs[3] = strconv.Atoi(fields[3])
+			for _, err := range conv_errs {
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse the chain header on line %d of the file %s: %w", line_number, filename, err)
+				}
+			}
+			source_chrom = fields[2]
+			target_chrom = fields[7]
+			target_minus = fields[9] == "-"
+			in_chain = true
+			continue
+		}
+
+		if !in_chain {
+			return nil, fmt.Errorf("found the alignment line %d in the file %s before any chain header line", line_number, filename)
+		}
+
+		size, size_err := strconv.Atoi(fields[0])
+		if size_err != nil {
+			return nil, fmt.Errorf("failed to parse the block size on line %d of the file %s: %w", line_number, filename, size_err)
+		}
+
+		source_key := contig.Canonical(source_chrom)
+		chain.blocks[source_key] = append(chain.blocks[source_key], block{
+			sourceChrom: source_chrom,
+			sourceSize:  source_size,
+			sourceStart: source_pos,
+			sourceEnd:   source_pos + size,
+			targetChrom: target_chrom,
+			targetStart: target_pos,
+			targetSize:  target_size,
+			targetMinus: target_minus,
+		})
+
+		// The last line of a chain only has the size of the final block
+		if len(fields) == 1 {
+			in_chain = false
+			continue
+		} else if len(fields) < 3 {
+			return nil, fmt.Errorf("expected the line %d of the file %s to have the form 'size dt dq'", line_number, filename)
+		}
+
+		source_gap, source_gap_err := strconv.Atoi(fields[1])
+		target_gap, target_gap_err := strconv.Atoi(fields[2])
+		if source_gap_err != nil || target_gap_err != nil {
+			return nil, fmt.Errorf("failed to parse the gap sizes on line %d of the file %s", line_number, filename)
+		}
+		source_pos += size + source_gap
+		target_pos += size + target_gap
+	}
+	if chain_fr.FileScanner.Err() != nil {
+		return nil, fmt.Errorf("encountered the following error while reading the chain file %s: %w", filename, chain_fr.FileScanner.Err())
+	}
+
+	if len(chain.blocks) == 0 {
+		return nil, fmt.Errorf("no alignment blocks were read in from the chain file %s", filename)
+	}
+
+	chain.sort_blocks()
+	return chain, nil
+}
+
+// sort_blocks sorts the blocks of every chromosome by their start so that we can binary search them
+func (chain *Chain) sort_blocks() {
+	for chrom := range chain.blocks {
+		sort.Slice(chain.blocks[chrom], func(i, j int) bool {
+			return chain.blocks[chrom][i].sourceStart < chain.blocks[chrom][j].sourceStart
+		})
+	}
+}
+
+// Invert returns the chain that converts positions from the target build back to the source
+// build. A block on the minus strand is still on the minus strand after it is inverted but its
+// start is counted from the end of the other chromosome
+func (chain *Chain) Invert() *Chain {
+	inverted := &Chain{Filename: chain.Filename, blocks: make(map[string][]block)}
+	for _, chrom_blocks := range chain.blocks {
+		for _, current := range chrom_blocks {
+			size := current.sourceEnd - current.sourceStart
+			start, target_start := current.targetStart, current.sourceStart
+			if current.targetMinus {
+				start = current.targetSize - current.targetStart - size
+				target_start = current.sourceSize - current.sourceEnd
+			}
+			key := contig.Canonical(current.targetChrom)
+			inverted.blocks[key] = append(inverted.blocks[key], block{
+				sourceChrom: current.targetChrom,
+				sourceSize:  current.targetSize,
+				sourceStart: start,
+				sourceEnd:   start + size,
+				targetChrom: current.sourceChrom,
+				targetStart: target_start,
+				targetSize:  current.sourceSize,
+				targetMinus: current.targetMinus,
+			})
+		}
+	}
+	inverted.sort_blocks()
+	return inverted
+}
+
+// LiftPosition converts a 1-based position from the source build to the target build.
+// The returned bool is false if the position falls in a gap of the chain or on a
+// chromosome that is not present in the chain file
+func (chain *Chain) LiftPosition(chrom string, pos int) (string, int, bool) {
+	target_chrom, target_pos, _, ok := chain.lift(chrom, pos)
+	return target_chrom, target_pos, ok
+}
+
+// lift converts the position like LiftPosition and also reports whether the position landed on
+// the minus strand of the target build
+func (chain *Chain) lift(chrom string, pos int) (string, int, bool, bool) {
+	chrom_blocks := chain.blocks[contig.Canonical(chrom)]
+
+	zero_based := pos - 1
+
+	// find the first block that ends after our position
+	indx := sort.Search(len(chrom_blocks), func(i int) bool {
+		return chrom_blocks[i].sourceEnd > zero_based
+	})
+
+	if indx == len(chrom_blocks) || chrom_blocks[indx].sourceStart > zero_based {
+		return "", 0, false, false
+	}
+
+	matched := chrom_blocks[indx]
+
+	target_pos := matched.targetStart + (zero_based - matched.sourceStart)
+
+	// positions on the minus strand are counted from the end of the chromosome
+	if matched.targetMinus {
+		target_pos = matched.targetSize - target_pos - 1
+	}
+
+	// We want the lifted chromosome name to use the same style as the input name
+	target_chrom := matched.targetChrom
+	if contig.DetectStyle(chrom) != contig.DetectStyle(target_chrom) {
+		target_chrom = contig.Apply(target_chrom, contig.DetectStyle(chrom))
+	}
+
+	return target_chrom, target_pos + 1, matched.targetMinus, true
+}
+
+// LiftInterval converts both ends of an interval to the target build. Both ends
+// have to land on the same chromosome for the lift to be successful. If the
+// interval lands on the minus strand then the ends are swapped so that start <= end
+func (chain *Chain) LiftInterval(chrom string, start int, end int) (string, int, int, error) {
+	start_chrom, new_start, start_ok := chain.LiftPosition(chrom, start)
+	end_chrom, new_end, end_ok := chain.LiftPosition(chrom, end)
+
+	if !start_ok || !end_ok {
+		return "", 0, 0, fmt.Errorf("the interval %s:%d-%d could not be lifted over because one of the ends falls outside of the alignments in the chain file %s", chrom, start, end, chain.Filename)
+	}
+
+	if !contig.Same(start_chrom, end_chrom) {
+		return "", 0, 0, fmt.Errorf("the interval %s:%d-%d was split across the chromosomes %s and %s when it was lifted over", chrom, start, end, start_chrom, end_chrom)
+	}
+
+	if new_start > new_end {
+		new_start, new_end = new_end, new_start
+	}
+
+	return start_chrom, new_start, new_end, nil
+}
+
+// complements maps each base to the base that it pairs with
+var complements = map[byte]byte{'A': 'T', 'C': 'G', 'G': 'C', 'T': 'A', 'N': 'N', 'a': 't', 'c': 'g', 'g': 'c', 't': 'a', 'n': 'n'}
+
+// reverse_complement returns the sequence of the other strand. The bool is false if the allele has
+// something other than bases (such as the symbolic allele <DEL> or the missing allele *)
+func reverse_complement(allele string) (string, bool) {
+	complemented := make([]byte, len(allele))
+	for indx := 0; indx < len(allele); indx++ {
+		base, found := complements[allele[indx]]
+		if !found {
+			return "", false
+		}
+		complemented[len(allele)-indx-1] = base
+	}
+	return string(complemented), true
+}
+
+// LiftVariantID rewrites position-based variant IDs like chr22_23456789_A/G or
+// 22:23456789:A:G so that the position is in the target build. IDs that don't
+// contain a position (such as rsIDs) are returned unchanged along with true.
+// Variants that land on the minus strand of the target build have their REF and ALT
+// reverse complemented and the position moved to the other end of the REF. The
+// padding base of an indel would end up on the wrong side of the alleles so indels
+// (and symbolic alleles) on the minus strand can't be lifted and false is returned
+func (chain *Chain) LiftVariantID(id string) (string, bool) {
+	first_sep := strings.IndexAny(id, ":_")
+	if first_sep <= 0 {
+		return id, true
+	}
+
+	rest := id[first_sep+1:]
+	second_sep := strings.IndexAny(rest, ":_-")
+	if second_sep == -1 {
+		second_sep = len(rest)
+	}
+
+	pos, conv_err := strconv.Atoi(rest[:second_sep])
+	if conv_err != nil {
+		return id, true
+	}
+
+	// The alleles come after the position as REF/ALT or REF:ALT (or with the separator of the position)
+	suffix := rest[second_sep:]
+	var ref, alt string
+	allele_sep := -1
+	if len(suffix) > 1 {
+		allele_sep = strings.IndexAny(suffix[1:], "/:_-")
+		if allele_sep != -1 {
+			ref, alt = suffix[1:allele_sep+1], suffix[allele_sep+2:]
+		}
+	}
+
+	new_chrom, new_pos, minus, ok := chain.lift(id[:first_sep], pos)
+	if !ok {
+		return id, false
+	}
+	if !minus || suffix == "" {
+		return fmt.Sprintf("%s%c%d%s", new_chrom, id[first_sep], new_pos, suffix), true
+	}
+
+	// On the minus strand the last base of the REF is the first base in the target build
+	if allele_sep == -1 {
+		return id, false
+	}
+	new_ref, ref_ok := reverse_complement(ref)
+	if !ref_ok || ref == "" {
+		return id, false
+	}
+	alts := strings.Split(alt, ",")
+	for indx, allele := range alts {
+		new_alt, alt_ok := reverse_complement(allele)
+		if !alt_ok || len(allele) != len(ref) {
+			return id, false
+		}
+		alts[indx] = new_alt
+	}
+	end_chrom, new_end, end_minus, end_ok := chain.lift(id[:first_sep], pos+len(ref)-1)
+	if !end_ok || !end_minus || end_chrom != new_chrom || new_pos-new_end != len(ref)-1 {
+		return id, false
+	}
+
+	return fmt.Sprintf("%s%c%d%c%s%c%s", new_chrom, id[first_sep], new_end, suffix[0], new_ref, suffix[allele_sep+1], strings.Join(alts, ",")), true
+}
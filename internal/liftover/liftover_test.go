@@ -0,0 +1,157 @@
+package liftover
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The chr1 chain is on the plus strand with a gap in both builds. The chr2 chain lands on the
+// minus strand so the positions count down from the end of the target chromosome
+const testChain = `chain 1000 chr1 1000 + 100 190 chr1 1000 + 200 300 1
+50 10 20
+30
+
+chain 1000 chr2 1000 + 0 100 chr2 1000 - 100 200 2
+100
+`
+
+func read_test_chain(t *testing.T) *Chain {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "test.over.chain")
+	if write_err := os.WriteFile(filename, []byte(testChain), 0o644); write_err != nil {
+		t.Fatalf("unable to write the chain file: %s", write_err)
+	}
+	chain, read_err := ReadChainFile(filename, 1024)
+	if read_err != nil {
+		t.Fatalf("unable to read the chain file: %s", read_err)
+	}
+	return chain
+}
+
+func TestReadChainFile(t *testing.T) {
+	chain := read_test_chain(t)
+	if len(chain.blocks["1"]) != 2 || len(chain.blocks["2"]) != 1 {
+		t.Fatalf("expected 2 blocks for chr1 and 1 block for chr2 but found %d and %d", len(chain.blocks["1"]), len(chain.blocks["2"]))
+	}
+	second := chain.blocks["1"][1]
+	if second.sourceStart != 160 || second.sourceEnd != 190 || second.targetStart != 270 {
+		t.Errorf("expected the second block to skip the gaps but found %+v", second)
+	}
+
+	for name, contents := range map[string]string{
+		"no header":    "50 10 20\n",
+		"short header": "chain 1000 chr1 1000 +\n",
+		"empty":        "# no chains\n",
+	} {
+		filename := filepath.Join(t.TempDir(), "bad.chain")
+		os.WriteFile(filename, []byte(contents), 0o644)
+		if _, read_err := ReadChainFile(filename, 1024); read_err == nil {
+			t.Errorf("%s: expected the chain file to be rejected", name)
+		}
+	}
+}
+
+func TestLiftPosition(t *testing.T) {
+	chain := read_test_chain(t)
+	cases := []struct {
+		chrom    string
+		pos      int
+		expected string // chrom:pos or empty if the position doesn't lift
+	}{
+		{"chr1", 101, "chr1:201"},
+		{"chr1", 150, "chr1:250"},
+		{"chr1", 151, ""}, // in the gap of the source build
+		{"chr1", 161, "chr1:271"},
+		{"1", 161, "1:271"}, // the lifted name keeps the style of the input
+		{"chr1", 100, ""},   // before the chain
+		{"chr3", 10, ""},    // not in the chain file
+		// The minus strand counts down from the end of the target chromosome
+		{"chr2", 1, "chr2:900"},
+		{"chr2", 10, "chr2:891"},
+		{"chr2", 100, "chr2:801"},
+	}
+	for _, test_case := range cases {
+		chrom, pos, ok := chain.LiftPosition(test_case.chrom, test_case.pos)
+		lifted := ""
+		if ok {
+			lifted = fmt.Sprintf("%s:%d", chrom, pos)
+		}
+		if lifted != test_case.expected {
+			t.Errorf("expected %s:%d to lift to %q but got %q", test_case.chrom, test_case.pos, test_case.expected, lifted)
+		}
+	}
+}
+
+func TestLiftInterval(t *testing.T) {
+	chain := read_test_chain(t)
+
+	if chrom, start, end, lift_err := chain.LiftInterval("chr1", 101, 120); lift_err != nil || chrom != "chr1" || start != 201 || end != 220 {
+		t.Errorf("expected chr1:101-120 to lift to chr1:201-220 but got %s:%d-%d (%v)", chrom, start, end, lift_err)
+	}
+	// The ends are swapped on the minus strand so that the start comes first
+	if chrom, start, end, lift_err := chain.LiftInterval("chr2", 1, 10); lift_err != nil || chrom != "chr2" || start != 891 || end != 900 {
+		t.Errorf("expected chr2:1-10 to lift to chr2:891-900 but got %s:%d-%d (%v)", chrom, start, end, lift_err)
+	}
+	if _, _, _, lift_err := chain.LiftInterval("chr1", 140, 155); lift_err == nil {
+		t.Errorf("expected an interval that ends in a gap to fail")
+	}
+}
+
+func TestLiftVariantID(t *testing.T) {
+	chain := read_test_chain(t)
+	cases := []struct {
+		id       string
+		expected string
+		ok       bool
+	}{
+		{"chr1_101_A/G", "chr1_201_A/G", true},
+		{"1:101:A:G", "1:201:A:G", true},
+		{"rs12345", "rs12345", true},
+		{"chr1_151_A/G", "chr1_151_A/G", false},
+		// The alleles are reverse complemented and the position moves to the other end of the REF
+		{"chr2_10_A/G", "chr2_891_T/C", true},
+		{"chr2_10_AC/GT", "chr2_890_GT/AC", true},
+		{"2:10:A:G,T", "2:891:T:C,A", true},
+		// The padding base of an indel would be on the wrong side so these aren't lifted
+		{"chr2_10_A/AT", "chr2_10_A/AT", false},
+		{"chr2_10_A/<DEL>", "chr2_10_A/<DEL>", false},
+	}
+	for _, test_case := range cases {
+		lifted, ok := chain.LiftVariantID(test_case.id)
+		if lifted != test_case.expected || ok != test_case.ok {
+			t.Errorf("expected %s to lift to %s (%t) but got %s (%t)", test_case.id, test_case.expected, test_case.ok, lifted, ok)
+		}
+	}
+}
+
+func TestInvert(t *testing.T) {
+	chain := read_test_chain(t)
+	inverted := chain.Invert()
+
+	// Every position that lifts to the target build has to lift back to where it started
+	for _, chrom := range []string{"chr1", "chr2"} {
+		for pos := 1; pos <= 300; pos++ {
+			target_chrom, target_pos, ok := chain.LiftPosition(chrom, pos)
+			if !ok {
+				continue
+			}
+			source_chrom, source_pos, back_ok := inverted.LiftPosition(target_chrom, target_pos)
+			if !back_ok || source_chrom != chrom || source_pos != pos {
+				t.Errorf("expected %s:%d to lift back from %s:%d but got %s:%d (%t)", chrom, pos, target_chrom, target_pos, source_chrom, source_pos, back_ok)
+			}
+		}
+	}
+
+	// The gaps of the target build are gaps of the inverted chain
+	if _, _, ok := inverted.LiftPosition("chr1", 251); ok {
+		t.Errorf("expected the gap of the target build to fail to lift back")
+	}
+	if lifted, ok := inverted.LiftVariantID("chr2_891_T/C"); !ok || lifted != "chr2_10_A/G" {
+		t.Errorf("expected chr2_891_T/C to lift back to chr2_10_A/G but got %s (%t)", lifted, ok)
+	}
+	if lifted, ok := inverted.LiftVariantID("chr1_201_A/G"); !ok || lifted != "chr1_101_A/G" {
+		t.Errorf("expected chr1_201_A/G to lift back to chr1_101_A/G but got %s (%t)", lifted, ok)
+	}
+}
@@ -0,0 +1,280 @@
+package manifest
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/resources"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output is the checksum information for one output file
+type Output struct {
+	Path   string `json:"path"`
+	Bytes  int64  `json:"bytes"`
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest records what was run and the checksums of everything that was written. Our data
+// provenance policy requires this for any result that is derived from protected genotype data
+type Manifest struct {
+	Command  string    `json:"command"`
+	Args     []string  `json:"args"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Outputs  []Output  `json:"outputs"`
+	// Resources is the memory, I/O, and stage times of the run so that the next job can be sized
+	Resources resources.Usage `json:"resources"`
+	// Input is how the streamed vcf ended for the commands that read one
+	Input *Input `json:"input,omitempty"`
+	// Publish is how many variants were sent to the message queue of --publish
+	Publish *Publish `json:"publish,omitempty"`
+}
+
+// Input is how a streamed input ended. A pipe that stopped early (because the upstream process
+// failed or was killed) still looks like a small but valid vcf so the status is recorded next to
+// the outputs that were made from it
+type Input struct {
+	Source     string `json:"source"` // standard input or the bcftools command that the program started
+	Bytes      int64  `json:"bytes"`
+	Complete   bool   `json:"complete"`
+	ExitStatus string `json:"exit_status,omitempty"` // only known when the program started the upstream process itself
+	Error      string `json:"error,omitempty"`
+}
+
+// Publish is how the variants of --publish were delivered. The subscribers only see the published
+// variants so a run that lost messages is recorded next to the outputs that have every variant
+type Publish struct {
+	Target    string `json:"target"` // the queue without the password of the url
+	Published int    `json:"published"`
+	Failed    int    `json:"failed"`
+	Error     string `json:"error,omitempty"` // the error from closing the connection to the queue
+}
+
+// Err returns why some of the variants may not have reached the subscribers. It is nil if every
+// variant was delivered
+func (status Publish) Err() error {
+	switch {
+	case status.Failed > 0:
+		return fmt.Errorf("only %d of the %d variants were published to %s so the subscribers are missing variants that are in the output", status.Published, status.Published+status.Failed, status.Target)
+	case status.Error != "":
+		// The publishers batch the messages so the variants that were handed over can still be lost when the batches are flushed
+		return fmt.Errorf("some of the %d variants may not have been delivered to %s because the connection failed while it was closed. %s", status.Published, status.Target, status.Error)
+	default:
+		return nil
+	}
+}
+
+// The commands register their output files as they create them. The files are only
+// checksummed once the command has finished writing them
+var (
+	tracked_mu sync.Mutex
+	tracked    []string
+)
+
+// The status of the streamed input is set once the command has read all of it
+var (
+	input_mu sync.Mutex
+	input    *Input
+)
+
+// SetInput records how the streamed input of the run ended
+func SetInput(status Input) {
+	input_mu.Lock()
+	defer input_mu.Unlock()
+
+	input = &status
+}
+
+// InputStatus returns how the streamed input ended. The bool is false if the command didn't read a stream
+func InputStatus() (Input, bool) {
+	input_mu.Lock()
+	defer input_mu.Unlock()
+
+	if input == nil {
+		return Input{}, false
+	}
+	return *input, true
+}
+
+// The delivery of the published variants is set once the connection to the queue is closed
+var (
+	publish_mu sync.Mutex
+	publish    *Publish
+)
+
+// SetPublish records how the variants were delivered to the message queue
+func SetPublish(status Publish) {
+	publish_mu.Lock()
+	defer publish_mu.Unlock()
+
+	publish = &status
+}
+
+// PublishStatus returns how the variants were delivered. The bool is false if nothing was published
+func PublishStatus() (Publish, bool) {
+	publish_mu.Lock()
+	defer publish_mu.Unlock()
+
+	if publish == nil {
+		return Publish{}, false
+	}
+	return *publish, true
+}
+
+// Track records an output file that should be checksummed at the end of the run
+func Track(path string) {
+	tracked_mu.Lock()
+	defer tracked_mu.Unlock()
+
+	if !slices.Contains(tracked, path) {
+		tracked = append(tracked, path)
+	}
+}
+
+// Tracked returns the output files that have been registered so far
+func Tracked() []string {
+	tracked_mu.Lock()
+	defer tracked_mu.Unlock()
+
+	return slices.Clone(tracked)
+}
+
+// Checksum computes the MD5 and SHA256 of the file in a single pass
+func Checksum(path string) (Output, error) {
+	fh, open_err := os.Open(path)
+	if open_err != nil {
+		return Output{}, fmt.Errorf("unable to open the output file %s to compute its checksum: %w", path, open_err)
+	}
+	defer fh.Close()
+
+	md5_hash := md5.New()
+	sha_hash := sha256.New()
+
+	bytes_read, copy_err := io.Copy(io.MultiWriter(md5_hash, sha_hash), fh)
+	if copy_err != nil {
+		return Output{}, fmt.Errorf("encountered the following error while computing the checksum of %s: %w", path, copy_err)
+	}
+
+	return Output{Path: path, Bytes: bytes_read, MD5: hex.EncodeToString(md5_hash.Sum(nil)), SHA256: hex.EncodeToString(sha_hash.Sum(nil))}, nil
+}
+
+// WriteSidecar writes <path>.md5 in the same format as md5sum so that the file can be checked
+// with `md5sum -c` from the directory of the output
+func WriteSidecar(output Output) error {
+	sidecar := fmt.Sprintf("%s  %s\n", output.MD5, filepath.Base(output.Path))
+	return files.WriteFile(output.Path+".md5", []byte(sidecar))
+}
+
+// redactedValue replaces the values of the flags that RedactArgs hides
+const redactedValue = "REDACTED"
+
+// RedactArgs returns a copy of the command line with the values of the flags replaced by
+// REDACTED. The manifest is shared along with the outputs so secrets like the --hash-ids salt
+// can't be written into it. The flags are given without dashes and both --flag value and
+// --flag=value (with one or two dashes) are redacted. The user and password of every url on the
+// command line (like the --publish target) are redacted too
+func RedactArgs(args []string, flags ...string) []string {
+	redacted := slices.Clone(args)
+	for indx := 0; indx < len(redacted); indx++ {
+		name, value, has_value := strings.Cut(strings.TrimLeft(redacted[indx], "-"), "=")
+		if !strings.HasPrefix(redacted[indx], "-") {
+			redacted[indx] = RedactURL(redacted[indx])
+			continue
+		}
+		if !slices.Contains(flags, name) {
+			if has_value {
+				redacted[indx] = redacted[indx][:strings.Index(redacted[indx], "=")+1] + RedactURL(value)
+			}
+			continue
+		}
+		if has_value {
+			redacted[indx] = redacted[indx][:strings.Index(redacted[indx], "=")+1] + redactedValue
+		} else if indx+1 < len(redacted) {
+			indx++
+			redacted[indx] = redactedValue
+		}
+	}
+	return redacted
+}
+
+// RedactURL replaces the user and password of a url with REDACTED. Some servers (like nats) take
+// a token as the user so the whole userinfo is removed and not only the password. Values that
+// aren't urls or don't have a user are returned unchanged
+func RedactURL(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	parsed, parse_err := url.Parse(value)
+	if parse_err != nil {
+		// A url that can't be parsed could still have a password so everything before the host is removed
+		scheme, rest, _ := strings.Cut(value, "://")
+		if host_start := strings.LastIndex(strings.SplitN(rest, "/", 2)[0], "@"); host_start >= 0 {
+			return scheme + "://" + redactedValue + rest[host_start:]
+		}
+		return value
+	}
+	if parsed.User == nil {
+		return value
+	}
+	parsed.User = url.User(redactedValue)
+	return parsed.String()
+}
+
+// Write checksums every tracked output, writes the .md5 sidecars, and then writes the manifest as
+// json with the resource usage of the run. Outputs that were tracked but never created (such as
+// an empty rejects file) are skipped
+func Write(manifest_path string, command string, args []string, started time.Time, usage resources.Usage) (*Manifest, error) {
+	manifest := &Manifest{Command: command, Args: args, Started: started, Finished: time.Now(), Resources: usage}
+	if status, found := InputStatus(); found {
+		manifest.Input = &status
+	}
+	if status, found := PublishStatus(); found {
+		manifest.Publish = &status
+	}
+
+	for _, path := range Tracked() {
+		var output Output
+		if files.IsRemoteOutput(path) {
+			// Uploads are checksummed while they are sent. If there is no record then the upload
+			// failed and the object isn't in the bucket
+			upload, uploaded := files.Uploaded(path)
+			if !uploaded {
+				return nil, fmt.Errorf("the upload of the output %s did not complete", path)
+			}
+			output = Output{Path: path, Bytes: upload.Bytes, MD5: upload.MD5, SHA256: upload.SHA256}
+		} else {
+			if _, stat_err := os.Stat(path); stat_err != nil {
+				continue
+			}
+
+			checksum, checksum_err := Checksum(path)
+			if checksum_err != nil {
+				return nil, checksum_err
+			}
+			output = checksum
+		}
+		if sidecar_err := WriteSidecar(output); sidecar_err != nil {
+			return nil, fmt.Errorf("unable to write the checksum sidecar for %s: %w", path, sidecar_err)
+		}
+		manifest.Outputs = append(manifest.Outputs, output)
+	}
+
+	manifest_json, json_err := json.MarshalIndent(manifest, "", "  ")
+	if json_err != nil {
+		return nil, json_err
+	}
+
+	return manifest, files.WriteFile(manifest_path, append(manifest_json, '\n'))
+}
@@ -0,0 +1,164 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+)
+
+// MissingAllele is the value used in Genotype.Alleles for a '.' allele
+const MissingAllele = -1
+
+// GenotypeClass is the zygosity of a call
+type GenotypeClass int
+
+const (
+	HomRef GenotypeClass = iota
+	Het
+	HomAlt
+	Missing
+	Other // partially missing calls or calls with two different alternate alleles like 1/2
+)
+
+func (class GenotypeClass) String() string {
+	switch class {
+	case HomRef:
+		return "homo_ref"
+	case Het:
+		return "het"
+	case HomAlt:
+		return "homo_alt"
+	case Missing:
+		return "no_calls"
+	default:
+		return "other"
+	}
+}
+
+// Genotype is a single parsed sample call
+type Genotype struct {
+	Raw     string // the GT value as it was written in the file
+	Alleles []int  // allele indices where 0 is the reference. Missing alleles are MissingAllele
+	Phased  bool
+	Fields  map[string]string // the FORMAT values of the call (GT, DS, GQ, ...). This is nil if the FORMAT wasn't known
+}
+
+// ParseGenotype parses a sample call using the FORMAT keys of the record. Every FORMAT value
+// of the call is kept in Fields. If the format is nil then the GT is expected to be the first
+// value of the call and Fields is left nil. Alleles that can't be parsed are treated as missing
+func ParseGenotype(format []string, call string) Genotype {
+	var genotype Genotype
+
+	if format == nil {
+		genotype.Raw, _, _ = strings.Cut(call, ":")
+	} else {
+		values := strings.Split(call, ":")
+		genotype.Fields = make(map[string]string, len(format))
+		for indx, key := range format {
+			// Trailing FORMAT values can be dropped from a call so those keys are missing
+			if indx < len(values) {
+				genotype.Fields[key] = values[indx]
+			}
+		}
+		genotype.Raw = genotype.Fields["GT"]
+	}
+
+	genotype.Phased = strings.Contains(genotype.Raw, "|")
+
+	if genotype.Raw == "" {
+		return genotype
+	}
+	// Empty alleles (like in 0//1) are kept as missing alleles so that the ploidy always matches
+	// the number of separators in the GT
+	rest := genotype.Raw
+	for {
+		end := strings.IndexAny(rest, "/|")
+		if end == -1 {
+			genotype.Alleles = append(genotype.Alleles, ParseAllele(rest))
+			break
+		}
+		genotype.Alleles = append(genotype.Alleles, ParseAllele(rest[:end]))
+		rest = rest[end+1:]
+	}
+
+	return genotype
+}
+
+// ParseAllele parses a single allele of a GT. Only plain digits are an allele index so values
+// like ".", "+1", or "1a" are treated as missing
+func ParseAllele(allele string) int {
+	if allele == "" {
+		return MissingAllele
+	}
+	for indx := 0; indx < len(allele); indx++ {
+		if allele[indx] < '0' || allele[indx] > '9' {
+			return MissingAllele
+		}
+	}
+	allele_indx, err := strconv.Atoi(allele)
+	if err != nil {
+		return MissingAllele
+	}
+	return allele_indx
+}
+
+// Ploidy is the number of alleles in the call. Haploid calls (like male chrX) have a ploidy of 1,
+// diploid calls have a ploidy of 2, and polyploid or mosaic callers can produce larger values
+func (genotype Genotype) Ploidy() int {
+	return len(genotype.Alleles)
+}
+
+// HasAlt reports whether any of the alleles is an alternate allele
+func (genotype Genotype) HasAlt() bool {
+	for _, allele := range genotype.Alleles {
+		if allele > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// AltCount is the number of alternate alleles in the call
+func (genotype Genotype) AltCount() int {
+	count := 0
+	for _, allele := range genotype.Alleles {
+		if allele > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// Class determines the zygosity of the call. The classification works for any ploidy so
+// 0/0/0 is homozygous reference and 0/0/1 is heterozygous
+func (genotype Genotype) Class() GenotypeClass {
+	missing_count := 0
+	ref_count := 0
+	first_alt := 0
+	multiple_alts := false
+
+	for _, allele := range genotype.Alleles {
+		switch {
+		case allele == MissingAllele:
+			missing_count++
+		case allele == 0:
+			ref_count++
+		case first_alt == 0:
+			first_alt = allele
+		case allele != first_alt:
+			multiple_alts = true
+		}
+	}
+
+	switch {
+	case missing_count == len(genotype.Alleles):
+		return Missing
+	case missing_count > 0 || multiple_alts:
+		return Other
+	case first_alt == 0:
+		return HomRef
+	case ref_count == 0:
+		return HomAlt
+	default:
+		return Het
+	}
+}
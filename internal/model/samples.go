@@ -0,0 +1,43 @@
+package model
+
+// SampleIndex maps sample ids to their position in a list of samples (such as the sample columns
+// of a vcf header). The map is built once so that looking up a sample doesn't have to scan the
+// list, which matters for callsets with hundreds of thousands of samples
+type SampleIndex struct {
+	ids       []string
+	positions map[string]int
+}
+
+// NewSampleIndex builds the index for the ids. If an id is in the list more than once then the
+// first position is used
+func NewSampleIndex(ids []string) *SampleIndex {
+	index := &SampleIndex{ids: ids, positions: make(map[string]int, len(ids))}
+	for position, id := range ids {
+		if _, duplicate := index.positions[id]; !duplicate {
+			index.positions[id] = position
+		}
+	}
+	return index
+}
+
+// Position returns the 0-based position of the sample. The bool is false if the sample isn't in the index
+func (index *SampleIndex) Position(id string) (int, bool) {
+	position, found := index.positions[id]
+	return position, found
+}
+
+// Contains reports whether the sample is in the index
+func (index *SampleIndex) Contains(id string) bool {
+	_, found := index.positions[id]
+	return found
+}
+
+// IDs returns the sample ids in their original order
+func (index *SampleIndex) IDs() []string {
+	return index.ids
+}
+
+// Len returns the number of samples in the index
+func (index *SampleIndex) Len() int {
+	return len(index.ids)
+}
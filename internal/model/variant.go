@@ -0,0 +1,106 @@
+// Package model has the typed representation of vcf records and sample calls that is shared by
+// the subcommands and the library so that every command validates records the same way
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidRecord is wrapped by the errors from ParseVariant so that callers can tell a bad
+// record apart from an error reading the stream
+var ErrInvalidRecord = errors.New("invalid vcf record")
+
+// Variant is a single vcf record. The sample calls are kept as the raw strings because most
+// commands only look at a few of the calls. Use Genotype to parse a call
+type Variant struct {
+	Chrom  string
+	Pos    int
+	ID     string
+	Ref    string
+	Alt    []string // the alternate alleles. A record without an alternate allele has the value "."
+	Qual   string
+	Filter string
+	Info   map[string]string // the INFO keys and their raw values. Flags have an empty value
+	Format []string          // the FORMAT keys. This is nil for sites only vcfs
+	Calls  []string          // the sample columns in the same order as the header
+}
+
+// ParseVariant builds a Variant from the tab separated columns of a record. The first 8 columns
+// are required and the FORMAT column and the sample calls are optional. The columns are not
+// copied so the calls share memory with the slice
+func ParseVariant(columns []string) (*Variant, error) {
+	if len(columns) < 8 {
+		return nil, fmt.Errorf("%w: expected at least 8 columns but the record has %d", ErrInvalidRecord, len(columns))
+	}
+
+	if columns[0] == "" {
+		return nil, fmt.Errorf("%w: the CHROM column is empty", ErrInvalidRecord)
+	}
+
+	pos, pos_err := strconv.Atoi(columns[1])
+	if pos_err != nil || pos < 0 {
+		return nil, fmt.Errorf("%w: the position %s is not an integer", ErrInvalidRecord, columns[1])
+	}
+
+	if columns[3] == "" || columns[3] == "." {
+		return nil, fmt.Errorf("%w: the variant %s at %s:%d has no REF allele", ErrInvalidRecord, columns[2], columns[0], pos)
+	}
+
+	if columns[4] == "" {
+		return nil, fmt.Errorf("%w: the variant %s at %s:%d has an empty ALT column", ErrInvalidRecord, columns[2], columns[0], pos)
+	}
+
+	variant := &Variant{
+		Chrom:  columns[0],
+		Pos:    pos,
+		ID:     columns[2],
+		Ref:    columns[3],
+		Alt:    strings.Split(columns[4], ","),
+		Qual:   columns[5],
+		Filter: columns[6],
+		Info:   ParseInfo(columns[7]),
+	}
+
+	if len(columns) > 8 {
+		variant.Format = strings.Split(columns[8], ":")
+		variant.Calls = columns[9:]
+	}
+
+	return variant, nil
+}
+
+// ParseInfo splits the INFO column into its keys and raw values. The values are not split on
+// commas or percent decoded. vcf.InfoDecoder does that using the ##INFO definitions
+func ParseInfo(info string) map[string]string {
+	values := make(map[string]string)
+	if info == "" || info == "." {
+		return values
+	}
+	for _, entry := range strings.Split(info, ";") {
+		key, value, _ := strings.Cut(entry, "=")
+		values[key] = value
+	}
+	return values
+}
+
+// Key identifies the variant by its position and alleles in the form chrom_pos_ref/alt which is
+// the same form as the variant ids in the annotation files
+func (variant *Variant) Key() string {
+	return fmt.Sprintf("%s_%d_%s/%s", variant.Chrom, variant.Pos, variant.Ref, strings.Join(variant.Alt, ","))
+}
+
+// Genotype parses the call of the sample at the index using the FORMAT of the record
+func (variant *Variant) Genotype(indx int) (Genotype, error) {
+	if indx < 0 || indx >= len(variant.Calls) {
+		return Genotype{}, fmt.Errorf("the variant %s has %d calls so there is no call at the index %d", variant.ID, len(variant.Calls), indx)
+	}
+	return ParseGenotype(variant.Format, variant.Calls[indx]), nil
+}
+
+// FormatString is the FORMAT column as it was written in the record
+func (variant *Variant) FormatString() string {
+	return strings.Join(variant.Format, ":")
+}
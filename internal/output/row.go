@@ -0,0 +1,65 @@
+package output
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Row builds one tab separated line of an output. The fields are only joined when the row is
+// written so the commands don't have to keep track of where the tabs go. A row always ends in a
+// single newline and never has a trailing tab, even when a section of the row is empty
+type Row struct {
+	fields []string
+}
+
+// NewRow creates a row that starts with the values
+func NewRow(values ...string) *Row {
+	return &Row{fields: append(make([]string, 0, len(values)), values...)}
+}
+
+// Header creates the header row of an output from the column names
+func Header(columns ...string) *Row {
+	return NewRow(columns...)
+}
+
+// Add appends the values to the row
+func (row *Row) Add(values ...string) *Row {
+	row.fields = append(row.fields, values...)
+	return row
+}
+
+// Int appends the integers to the row
+func (row *Row) Int(values ...int) *Row {
+	for _, value := range values {
+		row.fields = append(row.fields, strconv.Itoa(value))
+	}
+	return row
+}
+
+// Float appends the value to the row with the given number of decimal places
+func (row *Row) Float(value float64, precision int) *Row {
+	row.fields = append(row.fields, strconv.FormatFloat(value, 'f', precision, 64))
+	return row
+}
+
+// Len is the number of fields in the row
+func (row *Row) Len() int {
+	return len(row.fields)
+}
+
+// Fields returns the fields of the row in order
+func (row *Row) Fields() []string {
+	return row.fields
+}
+
+// String joins the fields with tabs and ends the line with a newline
+func (row *Row) String() string {
+	return strings.Join(row.fields, "\t") + "\n"
+}
+
+// WriteTo writes the line to the writer
+func (row *Row) WriteTo(writer io.Writer) (int64, error) {
+	written, write_err := io.WriteString(writer, row.String())
+	return int64(written), write_err
+}
@@ -0,0 +1,52 @@
+package output
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestRow(t *testing.T) {
+	cases := []struct {
+		name     string
+		row      *Row
+		expected string
+	}{
+		{"header", Header("CHROM", "POS", "ID"), "CHROM\tPOS\tID\n"},
+		{"mixed values", NewRow("chr1").Int(100, 2).Float(0.25, 6).Add("-"), "chr1\t100\t2\t0.250000\t-\n"},
+		// An empty section at the end of the row doesn't leave a trailing tab behind
+		{"empty section", NewRow("chr1", "100").Add(), "chr1\t100\n"},
+		{"empty value", NewRow("chr1", ""), "chr1\t\n"},
+		{"no fields", NewRow(), "\n"},
+	}
+	for _, test_case := range cases {
+		if line := test_case.row.String(); line != test_case.expected {
+			t.Errorf("%s: built the line %q but expected %q", test_case.name, line, test_case.expected)
+		}
+	}
+}
+
+func TestRowWriteTo(t *testing.T) {
+	var buffer bytes.Buffer
+	header := Header("SAMPLE", "COUNT")
+	row := NewRow("S1").Int(3)
+	if header.Len() != row.Len() {
+		t.Errorf("the row has %d fields but the header has %d", row.Len(), header.Len())
+	}
+	for _, line := range []*Row{header, row} {
+		if _, write_err := line.WriteTo(&buffer); write_err != nil {
+			t.Fatalf("unexpected error: %s", write_err)
+		}
+	}
+	if buffer.String() != "SAMPLE\tCOUNT\nS1\t3\n" {
+		t.Errorf("wrote %q", buffer.String())
+	}
+
+	// The fields of a row don't share memory with the values it was created from
+	values := []string{"a", "b"}
+	copied := NewRow(values...)
+	values[0] = "changed"
+	if !slices.Equal(copied.Fields(), []string{"a", "b"}) {
+		t.Errorf("the row changed with the values it was created from: %q", copied.Fields())
+	}
+}
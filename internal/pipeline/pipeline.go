@@ -0,0 +1,140 @@
+// Package pipeline connects the stages of a command (parsing, filtering, annotating, writing)
+// with channels that carry batches of records. Sending one record at a time over an unbuffered
+// channel makes every stage wait on the slowest one for each record. Batches amortize the
+// channel operations and the queue lets a fast stage run ahead until the queue is full, at
+// which point it blocks (backpressure) instead of growing memory without a bound
+package pipeline
+
+import "sync"
+
+// Config controls the size of the batches that are passed between stages and how many batches
+// each channel can hold before the stage that is sending them has to wait
+type Config struct {
+	BatchSize  int
+	QueueDepth int
+}
+
+// DefaultConfig is used by the commands when the user doesn't set --batch-size or --queue-depth
+var DefaultConfig = Config{BatchSize: 64, QueueDepth: 8}
+
+// normalize replaces values that would stall the pipeline. A batch needs at least one record
+// and a negative queue depth isn't a valid channel size
+func (config Config) normalize() Config {
+	if config.BatchSize < 1 {
+		config.BatchSize = 1
+	}
+	if config.QueueDepth < 0 {
+		config.QueueDepth = 0
+	}
+	return config
+}
+
+// Emitter collects records into batches and sends each full batch to its stream. Emit can be
+// called from multiple goroutines. Close has to be called once every record has been emitted
+// so that the last partial batch is sent and the stream is closed
+type Emitter[T any] struct {
+	lock   sync.Mutex
+	config Config
+	out    chan []T
+	batch  []T
+}
+
+// NewEmitter creates the output stream of a stage
+func NewEmitter[T any](config Config) *Emitter[T] {
+	config = config.normalize()
+	return &Emitter[T]{config: config, out: make(chan []T, config.QueueDepth), batch: make([]T, 0, config.BatchSize)}
+}
+
+// Stream is the channel that the next stage reads the batches from
+func (emitter *Emitter[T]) Stream() <-chan []T {
+	return emitter.out
+}
+
+// Emit adds the record to the current batch. The call blocks if the batch is full and the queue
+// of the stream is full
+func (emitter *Emitter[T]) Emit(record T) {
+	emitter.lock.Lock()
+	defer emitter.lock.Unlock()
+
+	emitter.batch = append(emitter.batch, record)
+	if len(emitter.batch) >= emitter.config.BatchSize {
+		emitter.out <- emitter.batch
+		// The next stage owns the batch that was sent so we need a new slice
+		emitter.batch = make([]T, 0, emitter.config.BatchSize)
+	}
+}
+
+// Close sends the last partial batch and closes the stream
+func (emitter *Emitter[T]) Close() {
+	emitter.lock.Lock()
+	defer emitter.lock.Unlock()
+
+	if len(emitter.batch) > 0 {
+		emitter.out <- emitter.batch
+		emitter.batch = nil
+	}
+	close(emitter.out)
+}
+
+// Stage runs fn on every record of the input in a goroutine. The records that fn keeps are sent
+// to the returned stream so a stage can filter records (return false), change them (annotators),
+// or just look at them (publishers)
+func Stage[In any, Out any](input <-chan []In, config Config, fn func(In) (Out, bool)) <-chan []Out {
+	emitter := NewEmitter[Out](config)
+	go func() {
+		defer emitter.Close()
+		for batch := range input {
+			for _, record := range batch {
+				if output, keep := fn(record); keep {
+					emitter.Emit(output)
+				}
+			}
+		}
+	}()
+	return emitter.Stream()
+}
+
+// Tee copies every batch of the input into count streams. The batches are shared between the
+// streams so the stages that read them must not change the records. Every stream has to be read
+// until it is closed otherwise the other streams stall once its queue is full
+func Tee[T any](input <-chan []T, config Config, count int) []<-chan []T {
+	config = config.normalize()
+
+	outputs := make([]chan []T, count)
+	streams := make([]<-chan []T, count)
+	for indx := range outputs {
+		outputs[indx] = make(chan []T, config.QueueDepth)
+		streams[indx] = outputs[indx]
+	}
+
+	go func() {
+		for batch := range input {
+			for _, output := range outputs {
+				output <- batch
+			}
+		}
+		for _, output := range outputs {
+			close(output)
+		}
+	}()
+	return streams
+}
+
+// Each calls fn for every record of the stream. Once fn returns an error the rest of the stream
+// is drained without calling fn so that the stages before this one can finish. The first error
+// is returned
+func Each[T any](input <-chan []T, fn func(T) error) error {
+	var first_err error
+	for batch := range input {
+		if first_err != nil {
+			continue
+		}
+		for _, record := range batch {
+			if err := fn(record); err != nil {
+				first_err = err
+				break
+			}
+		}
+	}
+	return first_err
+}
@@ -0,0 +1,126 @@
+package pseudonym
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// The hashed ids are truncated to 16 hex characters (64 bits) which keeps the columns readable
+// while making collisions between the ids of a biobank sized cohort extremely unlikely. The ids only
+// use hex characters so they never have the '_' that we use to append phenotypes to the ids
+const hashLength = 16
+
+// Hasher replaces sample ids with salted hashes so that outputs can be shared outside of the
+// trusted environment without exposing the GRIDs. The same salt always produces the same ids so
+// outputs from different runs can still be joined
+type Hasher struct {
+	salt    []byte
+	mu      sync.Mutex
+	mapping map[string]string
+}
+
+var active *Hasher
+
+// Enable turns on the hashing of sample ids for every output of the run
+func Enable(salt string) error {
+	if salt == "" {
+		return fmt.Errorf("the salt for the hashed sample ids can not be empty")
+	}
+	active = &Hasher{salt: []byte(salt), mapping: make(map[string]string)}
+	return nil
+}
+
+// Enabled reports whether the sample ids are being hashed
+func Enabled() bool {
+	return active != nil
+}
+
+// ID returns the id that should be written to the outputs. The id is returned unchanged when
+// hashing is not enabled
+func ID(sample_id string) string {
+	if active == nil {
+		return sample_id
+	}
+	return active.Hash(sample_id)
+}
+
+// Hash computes the keyed hash of the sample id
+func (hasher *Hasher) Hash(sample_id string) string {
+	hasher.mu.Lock()
+	defer hasher.mu.Unlock()
+
+	if hashed, found := hasher.mapping[sample_id]; found {
+		return hashed
+	}
+
+	mac := hmac.New(sha256.New, hasher.salt)
+	mac.Write([]byte(sample_id))
+	hashed := hex.EncodeToString(mac.Sum(nil))[:hashLength]
+
+	hasher.mapping[sample_id] = hashed
+	return hashed
+}
+
+// WriteMapping writes the original id and the hashed id for every sample that was hashed during
+// the run. This file links the hashes back to the GRIDs so it has to stay in the trusted environment
+func WriteMapping(filename string) error {
+	if active == nil {
+		return nil
+	}
+
+	active.mu.Lock()
+	defer active.mu.Unlock()
+
+	fh, create_err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if create_err != nil {
+		return fmt.Errorf("unable to create the mapping file %s: %w", filename, create_err)
+	}
+	defer fh.Close()
+
+	writer := bufio.NewWriter(fh)
+	writer.WriteString("GRID\tHASHED_ID\n")
+	for _, sample_id := range slices.Sorted(maps.Keys(active.mapping)) {
+		writer.WriteString(fmt.Sprintf("%s\t%s\n", sample_id, active.mapping[sample_id]))
+	}
+	return writer.Flush()
+}
+
+// ReadMapping adds the ids of a mapping file that was written by WriteMapping to the mapping of the
+// run. This combines the mappings of the processes that hashed the ids of one run. The ids are hashed
+// again so that a mapping that was made with a different salt is rejected
+func ReadMapping(filename string) error {
+	if active == nil {
+		return fmt.Errorf("the mapping file %s can only be read when the sample ids are hashed", filename)
+	}
+
+	fh, open_err := os.Open(filename)
+	if open_err != nil {
+		return fmt.Errorf("unable to open the mapping file %s: %w", filename, open_err)
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	line_number := 0
+	for scanner.Scan() {
+		line_number++
+		if line_number == 1 {
+			continue
+		}
+		sample_id, hashed, found := strings.Cut(scanner.Text(), "\t")
+		if !found {
+			return fmt.Errorf("line %d of the mapping file %s doesn't have the GRID and HASHED_ID columns", line_number, filename)
+		}
+		if active.Hash(sample_id) != hashed {
+			return fmt.Errorf("the hashed id on line %d of the mapping file %s was made with a different salt", line_number, filename)
+		}
+	}
+	return scanner.Err()
+}
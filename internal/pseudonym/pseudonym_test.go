@@ -0,0 +1,56 @@
+package pseudonym
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadMapping(t *testing.T) {
+	defer func() { active = nil }()
+	dir := t.TempDir()
+
+	// Two processes hash different samples with the same salt like the shards of a whole genome run
+	shard_mappings := map[string][]string{
+		"chr1.tsv": {"GRID1", "GRID2"},
+		"chr2.tsv": {"GRID2", "GRID3"},
+	}
+	expected := make(map[string]string)
+	for filename, sample_ids := range shard_mappings {
+		Enable("salt")
+		for _, sample_id := range sample_ids {
+			expected[sample_id] = ID(sample_id)
+		}
+		if write_err := WriteMapping(filepath.Join(dir, filename)); write_err != nil {
+			t.Fatalf("unable to write the mapping %s: %s", filename, write_err)
+		}
+	}
+
+	// The run that merges the shards never hashes an id itself
+	Enable("salt")
+	for filename := range shard_mappings {
+		if read_err := ReadMapping(filepath.Join(dir, filename)); read_err != nil {
+			t.Fatalf("unable to read the mapping %s: %s", filename, read_err)
+		}
+	}
+	merged := filepath.Join(dir, "merged.tsv")
+	if write_err := WriteMapping(merged); write_err != nil {
+		t.Fatalf("unable to write the merged mapping: %s", write_err)
+	}
+	contents, _ := os.ReadFile(merged)
+	expected_contents := "GRID\tHASHED_ID\n" + "GRID1\t" + expected["GRID1"] + "\n" + "GRID2\t" + expected["GRID2"] + "\n" + "GRID3\t" + expected["GRID3"] + "\n"
+	if string(contents) != expected_contents {
+		t.Errorf("expected the merged mapping to have every sample of the shards but got\n%s", contents)
+	}
+
+	// A mapping from another salt would link the hashes in the output to the wrong samples
+	Enable("other salt")
+	if read_err := ReadMapping(filepath.Join(dir, "chr1.tsv")); read_err == nil {
+		t.Errorf("expected the mapping that was made with a different salt to be rejected")
+	}
+
+	active = nil
+	if read_err := ReadMapping(filepath.Join(dir, "chr1.tsv")); read_err == nil {
+		t.Errorf("expected an error when the ids are not hashed")
+	}
+}
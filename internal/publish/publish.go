@@ -0,0 +1,146 @@
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// Publisher sends one message per record to a message queue so that downstream services can
+// subscribe to the results instead of polling the output files. The key is used by brokers that
+// partition messages (kafka) so that every message for a variant lands on the same partition
+type Publisher interface {
+	Publish(key string, message []byte) error
+	Close() error
+}
+
+// BatchError is returned when a batch of messages could not be sent. The publishers that batch
+// the messages (kafka) only find out that the earlier messages of the batch were lost when the
+// batch is sent so Messages is every message of the batch including the current one
+type BatchError struct {
+	Messages int
+	Err      error
+}
+
+func (batch_err *BatchError) Error() string {
+	return fmt.Sprintf("unable to send a batch of %d messages. %s", batch_err.Messages, batch_err.Err)
+}
+
+func (batch_err *BatchError) Unwrap() error {
+	return batch_err.Err
+}
+
+// Open connects to the message queue given as a url:
+//
+//	nats://host:4222/subject
+//	kafka://broker1:9092,broker2:9092/topic
+func Open(target string) (Publisher, error) {
+	parsed, parse_err := url.Parse(target)
+	if parse_err != nil {
+		// The url.Error repeats the target which can have a password in it
+		var url_err *url.Error
+		if errors.As(parse_err, &url_err) {
+			parse_err = url_err.Err
+		}
+		return nil, fmt.Errorf("unable to parse the publish target: %w", parse_err)
+	}
+	// The errors are logged and written to the manifest so they use the target without the password
+	target = parsed.Redacted()
+
+	destination := strings.TrimPrefix(parsed.Path, "/")
+	if destination == "" {
+		return nil, fmt.Errorf("the publish target %s is missing the subject or topic. It should have the form nats://host:port/subject or kafka://broker:port/topic", target)
+	}
+
+	switch parsed.Scheme {
+	case "nats":
+		return open_nats(parsed, destination)
+	case "kafka":
+		return open_kafka(parsed, destination), nil
+	default:
+		return nil, fmt.Errorf("the publish target %s uses the unsupported scheme %s. Supported schemes are nats and kafka", target, parsed.Scheme)
+	}
+}
+
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func open_nats(parsed *url.URL, subject string) (*natsPublisher, error) {
+	// The subject is part of our url but not of the server url so we drop it before connecting
+	server := url.URL{Scheme: parsed.Scheme, User: parsed.User, Host: parsed.Host}
+
+	conn, connect_err := nats.Connect(server.String(), nats.Name("go-vcf-parser"), nats.MaxReconnects(10), nats.ReconnectWait(2*time.Second))
+	if connect_err != nil {
+		return nil, fmt.Errorf("unable to connect to the nats server %s: %w", parsed.Host, connect_err)
+	}
+	return &natsPublisher{conn: conn, subject: subject}, nil
+}
+
+func (publisher *natsPublisher) Publish(key string, message []byte) error {
+	return publisher.conn.Publish(publisher.subject, message)
+}
+
+// Close waits for the server to receive every message that is still buffered before closing the connection
+func (publisher *natsPublisher) Close() error {
+	flush_err := publisher.conn.FlushTimeout(time.Minute)
+	publisher.conn.Close()
+	return flush_err
+}
+
+// kafkaBatchSize is the number of messages that are sent to the brokers at once. Sending every
+// message separately would make the writer goroutine wait on the brokers for every variant
+const kafkaBatchSize = 500
+
+type kafkaPublisher struct {
+	writer  *kafka.Writer
+	pending []kafka.Message
+}
+
+func open_kafka(parsed *url.URL, topic string) *kafkaPublisher {
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(parsed.Host, ",")...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    kafkaBatchSize,
+		RequiredAcks: kafka.RequireAll,
+	}
+	return &kafkaPublisher{writer: writer}
+}
+
+func (publisher *kafkaPublisher) Publish(key string, message []byte) error {
+	publisher.pending = append(publisher.pending, kafka.Message{Key: []byte(key), Value: message})
+	if len(publisher.pending) >= kafkaBatchSize {
+		return publisher.flush()
+	}
+	return nil
+}
+
+func (publisher *kafkaPublisher) flush() error {
+	if len(publisher.pending) == 0 {
+		return nil
+	}
+	write_err := publisher.writer.WriteMessages(context.Background(), publisher.pending...)
+	lost := len(publisher.pending)
+	publisher.pending = publisher.pending[:0]
+	if write_err != nil {
+		return &BatchError{Messages: lost, Err: write_err}
+	}
+	return nil
+}
+
+func (publisher *kafkaPublisher) Close() error {
+	flush_err := publisher.flush()
+	close_err := publisher.writer.Close()
+	if flush_err != nil {
+		return flush_err
+	}
+	return close_err
+}
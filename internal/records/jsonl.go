@@ -0,0 +1,79 @@
+package records
+
+import (
+	"bufio"
+	"encoding/json"
+	"go-phers-parser/internal/files"
+	"io"
+)
+
+func init() {
+	Register("jsonl", func(filename string) (RecordWriter, error) {
+		output_fh, create_err := files.Create(filename)
+		if create_err != nil {
+			return nil, create_err
+		}
+		return NewJSONL(output_fh), nil
+	})
+}
+
+// JSONL writes one json object per record with the column names as the keys. The keys are
+// written in the same order as the columns so that the lines are easy to read. There is no
+// header line because every object has its own keys
+type JSONL struct {
+	output io.WriteCloser
+	writer *bufio.Writer
+	header Header
+	keys   [][]byte // the encoded column names so that we don't encode them for every record
+}
+
+// NewJSONL writes the records to the output as json lines
+func NewJSONL(output io.WriteCloser) *JSONL {
+	return &JSONL{output: output, writer: bufio.NewWriterSize(output, files.WriteBufferSize())}
+}
+
+func (jsonl *JSONL) WriteHeader(header Header) error {
+	jsonl.header = header
+	jsonl.keys = make([][]byte, len(header.Columns))
+	for indx, col := range unique_columns(header.Columns) {
+		key, err := json.Marshal(col)
+		if err != nil {
+			return err
+		}
+		jsonl.keys[indx] = key
+	}
+	return nil
+}
+
+func (jsonl *JSONL) WriteRecord(values []string) error {
+	if err := check_record(jsonl.header, values); err != nil {
+		return err
+	}
+
+	line := []byte{'{'}
+	for indx, value := range values {
+		if indx > 0 {
+			line = append(line, ',')
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		line = append(line, jsonl.keys[indx]...)
+		line = append(line, ':')
+		line = append(line, encoded...)
+	}
+	line = append(line, '}', '\n')
+
+	_, write_err := jsonl.writer.Write(line)
+	return write_err
+}
+
+func (jsonl *JSONL) Close() error {
+	flush_err := jsonl.writer.Flush()
+	close_err := jsonl.output.Close()
+	if flush_err != nil {
+		return flush_err
+	}
+	return close_err
+}
@@ -0,0 +1,114 @@
+package records
+
+import (
+	"go-phers-parser/internal/files"
+	"io"
+	"reflect"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func init() {
+	Register("parquet", func(filename string) (RecordWriter, error) {
+		output_fh, create_err := files.Create(filename)
+		if create_err != nil {
+			return nil, create_err
+		}
+		return NewParquet(output_fh), nil
+	})
+}
+
+// parquetBatchSize is the number of records that we buffer before handing them to the parquet
+// writer. The writer still decides where the row groups end
+const parquetBatchSize = 1024
+
+// Parquet writes every column as a string column. The values are kept as strings (and "-" is
+// kept as "-") so that reading the parquet gives the same values as reading the tsv
+type Parquet struct {
+	output io.WriteCloser
+	writer *parquet.Writer
+	header Header
+	batch  []parquet.Row
+}
+
+// recordGroup is a parquet group that keeps the columns in the order of the header. The
+// parquet.Group type sorts the columns by name which would put the samples before #CHROM
+type recordGroup struct {
+	parquet.Group
+	columns []string
+}
+
+func (group recordGroup) Fields() []parquet.Field {
+	fields := make([]parquet.Field, len(group.columns))
+	for indx, col := range group.columns {
+		fields[indx] = recordField{Node: group.Group[col], name: col}
+	}
+	return fields
+}
+
+type recordField struct {
+	parquet.Node
+	name string
+}
+
+func (field recordField) Name() string { return field.name }
+
+// Value is only used when writing go structs. We write the rows ourselves so there is no value
+func (field recordField) Value(base reflect.Value) reflect.Value { return reflect.Value{} }
+
+// NewParquet writes the records to the output as a zstd compressed parquet file
+func NewParquet(output io.WriteCloser) *Parquet {
+	return &Parquet{output: output}
+}
+
+func (pq *Parquet) WriteHeader(header Header) error {
+	pq.header = header
+
+	columns := unique_columns(header.Columns)
+	group := recordGroup{Group: parquet.Group{}, columns: columns}
+	for _, col := range columns {
+		group.Group[col] = parquet.String()
+	}
+	schema := parquet.NewSchema("record", group)
+
+	pq.writer = parquet.NewWriter(pq.output, schema, parquet.Compression(&parquet.Zstd))
+	return nil
+}
+
+func (pq *Parquet) WriteRecord(values []string) error {
+	if err := check_record(pq.header, values); err != nil {
+		return err
+	}
+
+	row := make(parquet.Row, len(values))
+	for indx, value := range values {
+		row[indx] = parquet.ByteArrayValue([]byte(value)).Level(0, 0, indx)
+	}
+	pq.batch = append(pq.batch, row)
+
+	if len(pq.batch) >= parquetBatchSize {
+		return pq.flush()
+	}
+	return nil
+}
+
+func (pq *Parquet) flush() error {
+	_, write_err := pq.writer.WriteRows(pq.batch)
+	pq.batch = pq.batch[:0]
+	return write_err
+}
+
+func (pq *Parquet) Close() error {
+	var write_err error
+	if pq.writer != nil {
+		write_err = pq.flush()
+		if close_err := pq.writer.Close(); write_err == nil {
+			write_err = close_err
+		}
+	}
+	close_err := pq.output.Close()
+	if write_err != nil {
+		return write_err
+	}
+	return close_err
+}
@@ -0,0 +1,93 @@
+package records
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Header describes the columns of an output. Outputs that are vcf records (like pull-variants)
+// start with the 9 fixed vcf columns followed by Samples sample columns. Any columns after the
+// samples are annotations. Outputs that aren't vcf records leave Samples at 0
+type Header struct {
+	Columns []string
+	Samples int
+	Meta    []string // "##" lines from the input vcf. Only the vcf writer uses these
+	// SampleMeta are "##SAMPLE" lines that describe the sample columns. Both the tsv and the vcf
+	// writers put them before the column line
+	SampleMeta []string
+}
+
+// RecordWriter writes the rows of an output in one format. The header has to be written before
+// any records and every record has to have one value per column. Close flushes the output
+type RecordWriter interface {
+	WriteHeader(header Header) error
+	WriteRecord(values []string) error
+	Close() error
+}
+
+// Factory creates a RecordWriter that writes to the file
+type Factory func(filename string) (RecordWriter, error)
+
+var (
+	registry_lock sync.RWMutex
+	registry      = make(map[string]Factory)
+)
+
+// Register makes a format available to Open. Registering the same name twice replaces the
+// earlier factory so that a build can swap in its own implementation of a format
+func Register(format string, factory Factory) {
+	registry_lock.Lock()
+	defer registry_lock.Unlock()
+	registry[strings.ToLower(format)] = factory
+}
+
+// Formats returns the names of the registered formats in sorted order
+func Formats() []string {
+	registry_lock.RLock()
+	defer registry_lock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open creates the output file and returns the writer for the format
+func Open(format string, filename string) (RecordWriter, error) {
+	registry_lock.RLock()
+	factory, found := registry[strings.ToLower(format)]
+	registry_lock.RUnlock()
+
+	if !found {
+		return nil, fmt.Errorf("the output format %s is not recognized. Allowed values are %s", format, strings.Join(Formats(), ", "))
+	}
+	return factory(filename)
+}
+
+// unique_columns makes the column names unique by adding a numbered suffix to repeated names.
+// The tsv output allows repeated names but the json keys and the table columns can't repeat
+func unique_columns(columns []string) []string {
+	seen := make(map[string]int, len(columns))
+	unique := make([]string, len(columns))
+	for indx, col := range columns {
+		seen[col]++
+		if count := seen[col]; count > 1 {
+			unique[indx] = fmt.Sprintf("%s_%d", col, count)
+		} else {
+			unique[indx] = col
+		}
+	}
+	return unique
+}
+
+// check_record makes sure that the record lines up with the header
+func check_record(header Header, values []string) error {
+	if len(values) != len(header.Columns) {
+		return fmt.Errorf("the record has %d values but the header has %d columns", len(values), len(header.Columns))
+	}
+	return nil
+}
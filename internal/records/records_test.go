@@ -0,0 +1,210 @@
+package records
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// bufferCloser lets the writers write into a buffer that we can check
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (buffer *bufferCloser) Close() error { return nil }
+
+var test_header = Header{
+	Columns: []string{"#CHROM", "POS", "ID", "REF", "ALT", "QUAL", "FILTER", "INFO", "FORMAT", "S1_1", "S2_0", "CLIN_SIG", "AF"},
+	Samples: 2,
+	Meta:    []string{"##fileformat=VCFv4.2", `##INFO=<ID=AF,Number=A,Type=Float,Description="Allele frequency">`},
+}
+
+var test_record = []string{"chr22", "100", "chr22_100_A/G", "A", "G", ".", "PASS", "AF=0.01", "GT", "0/1", "0/0", "likely pathogenic;risk", "0.01"}
+
+func write_test_records(t *testing.T, writer RecordWriter, values ...[]string) {
+	t.Helper()
+	if err := writer.WriteHeader(test_header); err != nil {
+		t.Fatalf("unable to write the header: %s", err)
+	}
+	for _, record := range values {
+		if err := writer.WriteRecord(record); err != nil {
+			t.Fatalf("unable to write the record %v: %s", record, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("unable to close the writer: %s", err)
+	}
+}
+
+func TestTSV(t *testing.T) {
+	output := &bufferCloser{}
+	write_test_records(t, NewTSV(output, true), test_record)
+
+	expected := "#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS1_1\tS2_0\tCLIN_SIG\tAF\n" +
+		"chr22\t100\tchr22_100_A/G\tA\tG\t.\tPASS\tAF=0.01\tGT\t0/1\t0/0\tlikely pathogenic;risk\t0.01\n"
+	if output.String() != expected {
+		t.Errorf("expected the tsv output:\n%s\nbut got:\n%s", expected, output.String())
+	}
+
+	appended := &bufferCloser{}
+	write_test_records(t, NewTSV(appended, false), test_record)
+	if appended.String() != expected[len("#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS1_1\tS2_0\tCLIN_SIG\tAF\n"):] {
+		t.Errorf("expected the header to be skipped but got:\n%s", appended.String())
+	}
+}
+
+func TestJSONL(t *testing.T) {
+	output := &bufferCloser{}
+	write_test_records(t, NewJSONL(output), test_record)
+
+	expected := `{"#CHROM":"chr22","POS":"100","ID":"chr22_100_A/G","REF":"A","ALT":"G","QUAL":".","FILTER":"PASS","INFO":"AF=0.01","FORMAT":"GT","S1_1":"0/1","S2_0":"0/0","CLIN_SIG":"likely pathogenic;risk","AF":"0.01"}` + "\n"
+	if output.String() != expected {
+		t.Errorf("expected the json line:\n%s\nbut got:\n%s", expected, output.String())
+	}
+}
+
+func TestVCF(t *testing.T) {
+	output := &bufferCloser{}
+	missing := slices.Clone(test_record)
+	missing[11] = "-"
+	missing[7] = "."
+	write_test_records(t, NewVCF(output), test_record, missing)
+
+	expected := "##fileformat=VCFv4.2\n" +
+		`##INFO=<ID=AF,Number=A,Type=Float,Description="Allele frequency">` + "\n" +
+		`##INFO=<ID=CLIN_SIG,Number=.,Type=String,Description="The CLIN_SIG column added by go-vcf-parser">` + "\n" +
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS1_1\tS2_0\n" +
+		"chr22\t100\tchr22_100_A/G\tA\tG\t.\tPASS\tAF=0.01;CLIN_SIG=likely%20pathogenic%3Brisk\tGT\t0/1\t0/0\n" +
+		"chr22\t100\tchr22_100_A/G\tA\tG\t.\tPASS\t.\tGT\t0/1\t0/0\n"
+	if output.String() != expected {
+		t.Errorf("expected the vcf:\n%s\nbut got:\n%s", expected, output.String())
+	}
+
+	if err := NewVCF(&bufferCloser{}).WriteHeader(Header{Columns: []string{"SAMPLE", "SCORE"}}); err == nil {
+		t.Errorf("expected an error when writing an output that isn't vcf records as a vcf")
+	}
+}
+
+func TestSQLite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "records.sqlite")
+	writer, open_err := NewSQLite(filename)
+	if open_err != nil {
+		t.Fatalf("unable to create the database: %s", open_err)
+	}
+	second_record := slices.Clone(test_record)
+	second_record[1], second_record[9], second_record[10] = "200", "0/0", "1/1"
+	write_test_records(t, writer, test_record, second_record)
+
+	db, _ := sql.Open("sqlite", filename)
+	defer db.Close()
+	var columns []string
+	rows, query_err := db.Query("SELECT name FROM pragma_table_info('records')")
+	if query_err != nil {
+		t.Fatalf("unable to read the columns of the records table: %s", query_err)
+	}
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		columns = append(columns, name)
+	}
+	rows.Close()
+	// The sample columns are in the genotypes table instead
+	expected := []string{"record_id", "#CHROM", "POS", "ID", "REF", "ALT", "QUAL", "FILTER", "INFO", "FORMAT", "CLIN_SIG", "AF"}
+	if !slices.Equal(columns, expected) {
+		t.Errorf("expected the records table to have the columns %v but found %v", expected, columns)
+	}
+
+	var calls []string
+	rows, query_err = db.Query("SELECT records.POS, genotypes.sample, genotypes.call FROM genotypes JOIN records USING (record_id) ORDER BY records.POS, genotypes.sample")
+	if query_err != nil {
+		t.Fatalf("unable to read the genotypes table: %s", query_err)
+	}
+	for rows.Next() {
+		var pos, sample, call string
+		rows.Scan(&pos, &sample, &call)
+		calls = append(calls, pos+":"+sample+":"+call)
+	}
+	rows.Close()
+	if expected := []string{"100:S1_1:0/1", "100:S2_0:0/0", "200:S1_1:0/0", "200:S2_0:1/1"}; !slices.Equal(calls, expected) {
+		t.Errorf("expected the calls %v but found %v", expected, calls)
+	}
+}
+
+func TestSQLiteManySamples(t *testing.T) {
+	// sqlite only allows 2000 columns in a table by default
+	header := Header{Columns: slices.Clone(test_header.Columns[:9]), Samples: 2500}
+	record := slices.Clone(test_record[:9])
+	for indx := range header.Samples {
+		header.Columns = append(header.Columns, fmt.Sprintf("S%d", indx))
+		record = append(record, "0/1")
+	}
+	filename := filepath.Join(t.TempDir(), "records.sqlite")
+	writer, open_err := NewSQLite(filename)
+	if open_err != nil {
+		t.Fatalf("unable to create the database: %s", open_err)
+	}
+	if header_err := writer.WriteHeader(header); header_err != nil {
+		t.Fatalf("unable to write the header of %d samples: %s", header.Samples, header_err)
+	}
+	if record_err := writer.WriteRecord(record); record_err != nil {
+		t.Fatalf("unable to write the record: %s", record_err)
+	}
+	if close_err := writer.Close(); close_err != nil {
+		t.Fatalf("unable to close the database: %s", close_err)
+	}
+
+	db, _ := sql.Open("sqlite", filename)
+	defer db.Close()
+	var count int
+	if query_err := db.QueryRow("SELECT COUNT(*) FROM genotypes WHERE call = '0/1'").Scan(&count); query_err != nil || count != header.Samples {
+		t.Errorf("expected %d calls in the genotypes table but found %d (%v)", header.Samples, count, query_err)
+	}
+
+	// Outputs that aren't vcf records keep every column in the records table
+	filename = filepath.Join(t.TempDir(), "table.sqlite")
+	writer, _ = NewSQLite(filename)
+	table := Header{Columns: []string{"SAMPLE", "SCORE"}}
+	writer.WriteHeader(table)
+	writer.WriteRecord([]string{"S1", "0.5"})
+	writer.Close()
+	db, _ = sql.Open("sqlite", filename)
+	defer db.Close()
+	var sample string
+	if query_err := db.QueryRow("SELECT SAMPLE FROM records").Scan(&sample); query_err != nil || sample != "S1" {
+		t.Errorf("expected the records table to have the SAMPLE column but got %q (%v)", sample, query_err)
+	}
+	if _, query_err := db.Query("SELECT * FROM genotypes"); query_err == nil || !strings.Contains(query_err.Error(), "no such table") {
+		t.Errorf("expected no genotypes table without sample columns but got %v", query_err)
+	}
+}
+
+func TestRecordLength(t *testing.T) {
+	writer := NewTSV(&bufferCloser{}, true)
+	writer.WriteHeader(test_header)
+	if err := writer.WriteRecord(test_record[:5]); err == nil {
+		t.Errorf("expected an error for a record with fewer values than the header has columns")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	for _, format := range []string{"tsv", "vcf", "jsonl", "parquet", "sqlite"} {
+		if !slices.Contains(Formats(), format) {
+			t.Errorf("expected the %s format to be registered. The registered formats are %v", format, Formats())
+		}
+	}
+
+	if _, err := Open("xlsx", "output.xlsx"); err == nil {
+		t.Errorf("expected an error for a format that isn't registered")
+	}
+}
+
+func TestUniqueColumns(t *testing.T) {
+	unique := unique_columns([]string{"AF", "CLIN_SIG", "AF"})
+	if !slices.Equal(unique, []string{"AF", "CLIN_SIG", "AF_2"}) {
+		t.Errorf("expected the repeated column to get a suffix but got %v", unique)
+	}
+}
@@ -0,0 +1,154 @@
+package records
+
+import (
+	"database/sql"
+	"fmt"
+	"go-phers-parser/internal/files"
+	"os"
+	"slices"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	Register("sqlite", func(filename string) (RecordWriter, error) {
+		return NewSQLite(filename)
+	})
+}
+
+// SQLite writes the records into a table called records in a sqlite database. Every column is
+// TEXT. The calls of vcf records are written to a long genotypes table (record_id, sample, call)
+// with one row per sample instead of one column per sample because sqlite only allows 2000 columns
+// in a table by default. The inserts happen in a single transaction that is committed when the writer is closed
+type SQLite struct {
+	db        *sql.DB
+	tx        *sql.Tx
+	statement *sql.Stmt
+	genotypes *sql.Stmt
+	header    Header
+	samples   []string
+	row       []any
+	record_id int64
+}
+
+// NewSQLite creates the database file. An existing file at the path is replaced so that the
+// output behaves the same way as the tsv output
+func NewSQLite(filename string) (*SQLite, error) {
+	if files.IsRemote(filename) {
+		return nil, fmt.Errorf("sqlite outputs have to be written to a local file. Upload %s after the run finishes", filename)
+	}
+	if remove_err := os.Remove(filename); remove_err != nil && !os.IsNotExist(remove_err) {
+		return nil, fmt.Errorf("unable to replace the existing database %s: %w", filename, remove_err)
+	}
+
+	db, open_err := sql.Open("sqlite", filename)
+	if open_err != nil {
+		return nil, fmt.Errorf("unable to create the sqlite database %s: %w", filename, open_err)
+	}
+	return &SQLite{db: db}, nil
+}
+
+// sqlite_identifier quotes a column name. The column names come from the user and the sample ids
+func sqlite_identifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqliteRecordID is the column of the records table that the genotypes table refers to
+const sqliteRecordID = "record_id"
+
+func (lite *SQLite) WriteHeader(header Header) error {
+	lite.header = header
+
+	// The sample columns are moved to the genotypes table so the records table has the fixed vcf
+	// columns and the annotations
+	columns := header.Columns
+	if header.Samples > 0 {
+		lite.samples = columns[9 : 9+header.Samples]
+		columns = append(slices.Clone(columns[:9]), columns[9+header.Samples:]...)
+	}
+	columns = unique_columns(append([]string{sqliteRecordID}, columns...))
+	definitions := []string{sqlite_identifier(columns[0]) + " INTEGER PRIMARY KEY"}
+	placeholders := []string{"?"}
+	for _, col := range columns[1:] {
+		definitions = append(definitions, sqlite_identifier(col)+" TEXT")
+		placeholders = append(placeholders, "?")
+	}
+
+	if _, exec_err := lite.db.Exec(fmt.Sprintf("CREATE TABLE records (%s)", strings.Join(definitions, ", "))); exec_err != nil {
+		return fmt.Errorf("unable to create the records table: %w", exec_err)
+	}
+	if lite.samples != nil {
+		if _, exec_err := lite.db.Exec(fmt.Sprintf("CREATE TABLE genotypes (%s INTEGER REFERENCES records, sample TEXT, call TEXT)", sqliteRecordID)); exec_err != nil {
+			return fmt.Errorf("unable to create the genotypes table: %w", exec_err)
+		}
+	}
+
+	tx, tx_err := lite.db.Begin()
+	if tx_err != nil {
+		return tx_err
+	}
+	statement, prepare_err := tx.Prepare(fmt.Sprintf("INSERT INTO records VALUES (%s)", strings.Join(placeholders, ", ")))
+	if prepare_err != nil {
+		tx.Rollback()
+		return prepare_err
+	}
+	if lite.samples != nil {
+		lite.genotypes, prepare_err = tx.Prepare("INSERT INTO genotypes VALUES (?, ?, ?)")
+		if prepare_err != nil {
+			statement.Close()
+			tx.Rollback()
+			return prepare_err
+		}
+	}
+	lite.tx = tx
+	lite.statement = statement
+	lite.row = make([]any, len(columns))
+	return nil
+}
+
+func (lite *SQLite) WriteRecord(values []string) error {
+	if err := check_record(lite.header, values); err != nil {
+		return err
+	}
+	lite.record_id++
+	lite.row[0] = lite.record_id
+	indx := 1
+	for col_indx, value := range values {
+		if col_indx >= 9 && col_indx < 9+len(lite.samples) {
+			continue
+		}
+		lite.row[indx] = value
+		indx++
+	}
+	if _, exec_err := lite.statement.Exec(lite.row...); exec_err != nil {
+		return exec_err
+	}
+	for sample_indx, sample_id := range lite.samples {
+		if _, exec_err := lite.genotypes.Exec(lite.record_id, sample_id, values[9+sample_indx]); exec_err != nil {
+			return exec_err
+		}
+	}
+	return nil
+}
+
+// Close commits the rows and then indexes the genotypes by sample. The index is built once at the
+// end because updating it for every insert is much slower
+func (lite *SQLite) Close() error {
+	var commit_err error
+	if lite.tx != nil {
+		lite.statement.Close()
+		if lite.genotypes != nil {
+			lite.genotypes.Close()
+		}
+		commit_err = lite.tx.Commit()
+		if commit_err == nil && lite.genotypes != nil {
+			_, commit_err = lite.db.Exec("CREATE INDEX genotypes_sample ON genotypes (sample)")
+		}
+	}
+	close_err := lite.db.Close()
+	if commit_err != nil {
+		return commit_err
+	}
+	return close_err
+}
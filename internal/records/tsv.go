@@ -0,0 +1,69 @@
+package records
+
+import (
+	"bufio"
+	"go-phers-parser/internal/files"
+	"io"
+	"strings"
+)
+
+func init() {
+	Register("tsv", func(filename string) (RecordWriter, error) {
+		output_fh, create_err := files.Create(filename)
+		if create_err != nil {
+			return nil, create_err
+		}
+		return NewTSV(output_fh, true), nil
+	})
+}
+
+// TSV writes tab separated rows. This is the format that every command used before there were
+// other formats so the other commands (merge-outputs, compare-outputs, ...) read this format
+type TSV struct {
+	output       io.WriteCloser
+	writer       *bufio.Writer
+	header       Header
+	write_header bool
+}
+
+// NewTSV writes the rows to the output. The header line is skipped if write_header is false
+// which is what we want when we are appending to an output that already has a header
+func NewTSV(output io.WriteCloser, write_header bool) *TSV {
+	return &TSV{output: output, writer: bufio.NewWriterSize(output, files.WriteBufferSize()), write_header: write_header}
+}
+
+func (tsv *TSV) WriteHeader(header Header) error {
+	tsv.header = header
+	if !tsv.write_header {
+		return nil
+	}
+	for _, line := range header.SampleMeta {
+		if _, write_err := tsv.writer.WriteString(line + "\n"); write_err != nil {
+			return write_err
+		}
+	}
+	return tsv.write_line(header.Columns)
+}
+
+func (tsv *TSV) WriteRecord(values []string) error {
+	if err := check_record(tsv.header, values); err != nil {
+		return err
+	}
+	return tsv.write_line(values)
+}
+
+func (tsv *TSV) write_line(values []string) error {
+	if _, err := tsv.writer.WriteString(strings.Join(values, "\t")); err != nil {
+		return err
+	}
+	return tsv.writer.WriteByte('\n')
+}
+
+func (tsv *TSV) Close() error {
+	flush_err := tsv.writer.Flush()
+	close_err := tsv.output.Close()
+	if flush_err != nil {
+		return flush_err
+	}
+	return close_err
+}
@@ -0,0 +1,150 @@
+package records
+
+import (
+	"bufio"
+	"fmt"
+	"go-phers-parser/internal/files"
+	"io"
+	"strings"
+)
+
+func init() {
+	Register("vcf", func(filename string) (RecordWriter, error) {
+		output_fh, create_err := files.Create(filename)
+		if create_err != nil {
+			return nil, create_err
+		}
+		return NewVCF(output_fh), nil
+	})
+}
+
+// vcf_fixed_columns is the number of columns before the samples in a vcf record
+const vcf_fixed_columns = 9
+
+// VCF writes the records back out as a vcf so that the output can go through bcftools or a
+// variant viewer. The columns after the samples (the annotations) are added to the INFO
+// column with a ##INFO line for each of them. Columns that are already INFO keys in the input
+// (like the --info-cols) are left out because the value is already in the INFO column
+type VCF struct {
+	output     io.WriteCloser
+	writer     *bufio.Writer
+	header     Header
+	extra_keys []string // INFO key for each column after the samples. Empty keys are skipped
+}
+
+// NewVCF writes the records to the output as a vcf
+func NewVCF(output io.WriteCloser) *VCF {
+	return &VCF{output: output, writer: bufio.NewWriterSize(output, files.WriteBufferSize())}
+}
+
+// vcf_info_id turns a column name into a valid INFO key. Keys can only have letters, digits,
+// underscores, and periods and they can't start with a digit or a period
+func vcf_info_id(col string) string {
+	id := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, strings.TrimPrefix(col, "#"))
+
+	if id == "" || (id[0] >= '0' && id[0] <= '9') || id[0] == '.' {
+		id = "_" + id
+	}
+	return id
+}
+
+// vcf_info_value percent encodes the characters that would break up the INFO column
+var vcf_info_value = strings.NewReplacer("%", "%25", ";", "%3B", "=", "%3D", ",", "%2C", ":", "%3A", "\t", "%09", "\n", "%0A", "\r", "%0D", " ", "%20")
+
+func (vcf *VCF) WriteHeader(header Header) error {
+	if len(header.Columns) < vcf_fixed_columns+header.Samples || header.Columns[0] != "#CHROM" {
+		return fmt.Errorf("the vcf format can only be used for outputs that are vcf records")
+	}
+	vcf.header = header
+
+	defined := make(map[string]bool)
+	has_fileformat := false
+	for _, line := range header.Meta {
+		if strings.HasPrefix(line, "##fileformat=") {
+			has_fileformat = true
+		}
+		if definition, found := strings.CutPrefix(line, "##INFO=<ID="); found {
+			id, _, _ := strings.Cut(definition, ",")
+			defined[id] = true
+		}
+	}
+
+	if !has_fileformat {
+		vcf.writer.WriteString("##fileformat=VCFv4.3\n")
+	}
+	for _, line := range header.Meta {
+		// The sample lines of the input would contradict the ones that describe the output columns
+		if len(header.SampleMeta) > 0 && strings.HasPrefix(line, "##SAMPLE=") {
+			continue
+		}
+		vcf.writer.WriteString(line + "\n")
+	}
+	for _, line := range header.SampleMeta {
+		vcf.writer.WriteString(line + "\n")
+	}
+
+	extra_cols := header.Columns[vcf_fixed_columns+header.Samples:]
+	vcf.extra_keys = make([]string, len(extra_cols))
+	for indx, col := range extra_cols {
+		id := vcf_info_id(col)
+		if defined[id] {
+			continue
+		}
+		defined[id] = true
+		vcf.extra_keys[indx] = id
+		vcf.writer.WriteString(fmt.Sprintf("##INFO=<ID=%s,Number=.,Type=String,Description=\"The %s column added by go-vcf-parser\">\n", id, strings.ReplaceAll(col, `"`, `'`)))
+	}
+
+	_, write_err := vcf.writer.WriteString(strings.Join(header.Columns[:vcf_fixed_columns+header.Samples], "\t") + "\n")
+	return write_err
+}
+
+func (vcf *VCF) WriteRecord(values []string) error {
+	if err := check_record(vcf.header, values); err != nil {
+		return err
+	}
+
+	info := values[7]
+	// Not every input has ##INFO lines so we also skip the keys that are already in the record
+	present := make(map[string]bool)
+	for _, entry := range strings.Split(info, ";") {
+		key, _, _ := strings.Cut(entry, "=")
+		present[key] = true
+	}
+
+	for indx, value := range values[vcf_fixed_columns+vcf.header.Samples:] {
+		// missing annotations are written as - in the other formats. In a vcf we just leave the key out
+		if vcf.extra_keys[indx] == "" || present[vcf.extra_keys[indx]] || value == "-" || value == "" {
+			continue
+		}
+		entry := vcf.extra_keys[indx] + "=" + vcf_info_value.Replace(value)
+		if info == "." || info == "" {
+			info = entry
+		} else {
+			info += ";" + entry
+		}
+	}
+
+	line := strings.Builder{}
+	line.WriteString(strings.Join(values[:7], "\t"))
+	line.WriteString("\t" + info + "\t")
+	line.WriteString(strings.Join(values[8:vcf_fixed_columns+vcf.header.Samples], "\t"))
+	line.WriteString("\n")
+
+	_, write_err := vcf.writer.WriteString(line.String())
+	return write_err
+}
+
+func (vcf *VCF) Close() error {
+	flush_err := vcf.writer.Flush()
+	close_err := vcf.output.Close()
+	if flush_err != nil {
+		return flush_err
+	}
+	return close_err
+}
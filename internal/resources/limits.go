@@ -0,0 +1,101 @@
+package resources
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Limits is the CPU and memory that the process is allowed to use. Kubernetes, Singularity, and the
+// schedulers of shared HPC nodes (SLURM and LSF) put the job in a cgroup with these limits but Go
+// still starts one thread for each CPU of the host. A job that asks for 4 CPUs on a 128 core node
+// then runs 128 threads that are throttled to 4 CPUs, and a garbage collector that doesn't know
+// about the memory limit lets the heap grow until the job is killed
+type Limits struct {
+	CPUs        float64 `json:"cpus,omitempty"`         // the CPU quota. 0 means there is no quota
+	MemoryBytes int64   `json:"memory_bytes,omitempty"` // the memory limit. 0 means there is no limit
+	HostCPUs    int     `json:"host_cpus"`              // the CPUs that the process can be scheduled on
+	Source      string  `json:"source,omitempty"`       // where the limits came from (such as cgroup v2)
+}
+
+const (
+	// memoryLimitFraction of the memory limit is given to the garbage collector (GOMEMLIMIT). The
+	// rest is left for the stacks, the page cache of the cgroup, and the subprocesses like bcftools
+	memoryLimitFraction = 0.9
+	// minBlockSize is the smallest that the compression blocks are shrunk to for a small memory limit
+	minBlockSize = 64 * 1024
+	// blockMemoryShare is the share of the memory limit that the compression blocks in flight can take
+	blockMemoryShare = 64
+)
+
+// limits is what ApplyLimits used so that it can be reported with the usage of the run
+var (
+	limits_mu sync.Mutex
+	limits    *Limits
+)
+
+// Threads is the number of threads that the limits allow. A quota of 1.5 CPUs can keep 2 threads busy
+// part of the time so the quota is rounded up, but never past the CPUs of the host
+func (limits Limits) Threads() int {
+	if limits.CPUs <= 0 {
+		return max(limits.HostCPUs, 1)
+	}
+	return max(min(int(math.Ceil(limits.CPUs)), limits.HostCPUs), 1)
+}
+
+// QueueDepth scales the default depth of the queues between the stages to the threads. The queues
+// let a fast stage run ahead of a slow one, which only helps when the stages have a thread each,
+// so with only 1 or 2 threads the batches would just sit in memory
+func (limits Limits) QueueDepth(default_depth int) int {
+	return max(min(default_depth, 2*limits.Threads()), 2)
+}
+
+// BlockSize shrinks the default size of the blocks that are compressed or read ahead by each
+// thread so that all of the blocks together stay a small share of the memory limit
+func (limits Limits) BlockSize(default_size int) int {
+	if limits.MemoryBytes <= 0 {
+		return default_size
+	}
+	share := limits.MemoryBytes / blockMemoryShare / int64(limits.Threads())
+	return int(max(min(int64(default_size), share), minBlockSize))
+}
+
+// SoftMemoryLimit is the memory that the garbage collector tries to stay under for the memory limit
+func (limits Limits) SoftMemoryLimit() int64 {
+	return int64(float64(limits.MemoryBytes) * memoryLimitFraction)
+}
+
+// ApplyLimits sets GOMAXPROCS to the threads of the limits and gives the garbage collector a soft
+// memory limit below the memory limit. The GOMAXPROCS and GOMEMLIMIT environment variables are
+// left alone if the user set them. It returns a line for the log for each setting that was changed
+func ApplyLimits(detected Limits) []string {
+	limits_mu.Lock()
+	limits = &detected
+	limits_mu.Unlock()
+
+	var changes []string
+	if detected.CPUs > 0 && os.Getenv("GOMAXPROCS") == "" {
+		runtime.GOMAXPROCS(detected.Threads())
+		changes = append(changes, fmt.Sprintf("Using %d threads for the CPU quota of %g CPUs from the %s (the host has %d CPUs). Set GOMAXPROCS to use a different number", detected.Threads(), detected.CPUs, detected.Source, detected.HostCPUs))
+	}
+	if detected.MemoryBytes > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		soft_limit := detected.SoftMemoryLimit()
+		debug.SetMemoryLimit(soft_limit)
+		changes = append(changes, fmt.Sprintf("The garbage collector will try to keep the memory below %s for the memory limit of %s from the %s. Set GOMEMLIMIT to use a different limit", FormatBytes(soft_limit), FormatBytes(detected.MemoryBytes), detected.Source))
+	}
+	return changes
+}
+
+// AppliedLimits returns the limits that ApplyLimits used. The bool is false if it wasn't called
+func AppliedLimits() (Limits, bool) {
+	limits_mu.Lock()
+	defer limits_mu.Unlock()
+
+	if limits == nil {
+		return Limits{}, false
+	}
+	return *limits, true
+}
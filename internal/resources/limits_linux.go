@@ -0,0 +1,148 @@
+package resources
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// cgroupUnlimited is the smallest memory limit of cgroup v1 that means there is no limit. The
+// kernel reports the largest int64 rounded down to a page instead of a word like v2 does
+const cgroupUnlimited = 1 << 62
+
+// DetectLimits reads the CPU quota and the memory limit of the cgroup that the process runs in.
+// runtime.NumCPU already follows the CPUs that the process is pinned to (the cpuset that SLURM
+// and taskset use) but not the quota that Kubernetes and Docker use
+func DetectLimits() Limits {
+	return cgroup_limits("/proc/self/cgroup", "/sys/fs/cgroup")
+}
+
+// cgroup_limits finds the cgroup of the process in the proc_cgroup file and reads its limits
+// from the cgroup filesystem at mount. Both cgroup v2 and the v1 cpu and memory controllers are
+// read because the nodes of older clusters still mount v1 or a mix of the two
+func cgroup_limits(proc_cgroup string, mount string) Limits {
+	limits := Limits{HostCPUs: runtime.NumCPU()}
+	content, read_err := os.ReadFile(proc_cgroup)
+	if read_err != nil {
+		return limits
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		// Each line is hierarchy-id:controllers:path. cgroup v2 has the id 0 and no controllers
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		cpus, memory, source := 0.0, 0.0, ""
+		if fields[0] == "0" && fields[1] == "" {
+			cpus = smallest_limit(mount, fields[2], read_cpu_max)
+			memory = smallest_limit(mount, fields[2], read_memory_max)
+			source = "cgroup v2"
+		} else {
+			controllers := strings.Split(fields[1], ",")
+			if slices.Contains(controllers, "cpu") {
+				cpus = smallest_limit(filepath.Join(mount, fields[1]), fields[2], read_cfs_quota)
+			}
+			if slices.Contains(controllers, "memory") {
+				memory = smallest_limit(filepath.Join(mount, fields[1]), fields[2], read_memory_limit)
+			}
+			source = "cgroup v1"
+		}
+		if cpus > 0 && limits.CPUs == 0 {
+			limits.CPUs, limits.Source = cpus, source
+		}
+		if memory > 0 && limits.MemoryBytes == 0 {
+			limits.MemoryBytes, limits.Source = int64(memory), source
+		}
+	}
+	return limits
+}
+
+// smallest_limit reads the limit of the cgroup and of every cgroup above it because SLURM sets
+// the limits on the job while the process runs in a step below it. The smallest limit is the one
+// that applies. A container without its own cgroup namespace has the path of the host but only
+// its own cgroup is mounted, so the root of the mount is used when the path isn't there
+func smallest_limit(root string, path string, read func(dir string) float64) float64 {
+	dir := filepath.Join(root, path)
+	if _, stat_err := os.Stat(dir); stat_err != nil {
+		dir = root
+	}
+	smallest := 0.0
+	for {
+		if value := read(dir); value > 0 && (smallest == 0 || value < smallest) {
+			smallest = value
+		}
+		if dir == root || len(dir) < len(root) {
+			return smallest
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// read_cgroup_file returns the fields of the first line of the file in the cgroup
+func read_cgroup_file(dir string, name string) []string {
+	content, read_err := os.ReadFile(filepath.Join(dir, name))
+	if read_err != nil {
+		return nil
+	}
+	return strings.Fields(string(content))
+}
+
+// read_cpu_max reads the quota and the period of cgroup v2 such as "150000 100000" for 1.5 CPUs
+// or "max 100000" for no quota
+func read_cpu_max(dir string) float64 {
+	fields := read_cgroup_file(dir, "cpu.max")
+	if len(fields) != 2 {
+		return 0
+	}
+	quota, quota_err := strconv.ParseFloat(fields[0], 64)
+	period, period_err := strconv.ParseFloat(fields[1], 64)
+	if quota_err != nil || period_err != nil || period <= 0 {
+		return 0
+	}
+	return quota / period
+}
+
+// read_memory_max reads the memory limit of cgroup v2 which is "max" when there is no limit
+func read_memory_max(dir string) float64 {
+	fields := read_cgroup_file(dir, "memory.max")
+	if len(fields) != 1 {
+		return 0
+	}
+	limit, parse_err := strconv.ParseFloat(fields[0], 64)
+	if parse_err != nil {
+		return 0
+	}
+	return limit
+}
+
+// read_cfs_quota reads the quota of cgroup v1 which is -1 when there is no quota
+func read_cfs_quota(dir string) float64 {
+	quota := read_cgroup_file(dir, "cpu.cfs_quota_us")
+	period := read_cgroup_file(dir, "cpu.cfs_period_us")
+	if len(quota) != 1 || len(period) != 1 {
+		return 0
+	}
+	quota_us, quota_err := strconv.ParseFloat(quota[0], 64)
+	period_us, period_err := strconv.ParseFloat(period[0], 64)
+	if quota_err != nil || period_err != nil || quota_us <= 0 || period_us <= 0 {
+		return 0
+	}
+	return quota_us / period_us
+}
+
+// read_memory_limit reads the memory limit of cgroup v1
+func read_memory_limit(dir string) float64 {
+	fields := read_cgroup_file(dir, "memory.limit_in_bytes")
+	if len(fields) != 1 {
+		return 0
+	}
+	limit, parse_err := strconv.ParseFloat(fields[0], 64)
+	if parse_err != nil || limit >= cgroupUnlimited {
+		return 0
+	}
+	return limit
+}
@@ -0,0 +1,45 @@
+package resources
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCgroupLimits(t *testing.T) {
+	write := func(path string, content string) {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if write_err := os.WriteFile(path, []byte(content), 0644); write_err != nil {
+			t.Fatalf("unable to write the fixture: %s", write_err)
+		}
+	}
+
+	// A SLURM step under a job that has the limits. The step has a looser memory limit than the job
+	v2 := t.TempDir()
+	write(filepath.Join(v2, "proc"), "0::/slurm/job_1/step_0\n")
+	write(filepath.Join(v2, "cgroup/slurm/job_1/cpu.max"), "250000 100000\n")
+	write(filepath.Join(v2, "cgroup/slurm/job_1/memory.max"), "4294967296\n")
+	write(filepath.Join(v2, "cgroup/slurm/job_1/step_0/cpu.max"), "max 100000\n")
+	write(filepath.Join(v2, "cgroup/slurm/job_1/step_0/memory.max"), "8589934592\n")
+	limits := cgroup_limits(filepath.Join(v2, "proc"), filepath.Join(v2, "cgroup"))
+	if limits.CPUs != 2.5 || limits.MemoryBytes != 4294967296 || limits.Source != "cgroup v2" {
+		t.Errorf("expected 2.5 CPUs and 4GiB from cgroup v2 but found %+v", limits)
+	}
+
+	// A docker container on cgroup v1 without its own namespace only mounts its own cgroup
+	v1 := t.TempDir()
+	write(filepath.Join(v1, "proc"), "4:memory:/docker/abc\n2:cpu,cpuacct:/docker/abc\n1:name=systemd:/\n")
+	write(filepath.Join(v1, "cgroup/cpu,cpuacct/cpu.cfs_quota_us"), "100000\n")
+	write(filepath.Join(v1, "cgroup/cpu,cpuacct/cpu.cfs_period_us"), "100000\n")
+	write(filepath.Join(v1, "cgroup/memory/memory.limit_in_bytes"), "9223372036854771712\n")
+	limits = cgroup_limits(filepath.Join(v1, "proc"), filepath.Join(v1, "cgroup"))
+	if limits.CPUs != 1 || limits.MemoryBytes != 0 || limits.Source != "cgroup v1" {
+		t.Errorf("expected 1 CPU without a memory limit from cgroup v1 but found %+v", limits)
+	}
+
+	// Without a cgroup every CPU can be used
+	limits = cgroup_limits(filepath.Join(t.TempDir(), "missing"), "/nonexistent")
+	if limits.CPUs != 0 || limits.MemoryBytes != 0 || limits.HostCPUs < 1 {
+		t.Errorf("expected no limits but found %+v", limits)
+	}
+}
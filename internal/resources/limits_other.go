@@ -0,0 +1,11 @@
+//go:build !linux
+
+package resources
+
+import "runtime"
+
+// DetectLimits only reads the cgroups of Linux which is what the clusters and containers run.
+// Other platforms don't have a quota so every CPU can be used
+func DetectLimits() Limits {
+	return Limits{HostCPUs: runtime.NumCPU()}
+}
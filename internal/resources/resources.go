@@ -0,0 +1,213 @@
+// Package resources keeps track of the time that each stage of a command takes and collects the
+// memory, garbage collector, and I/O usage of the process at the end of the run. The report
+// helps users pick the memory and time limits of their cluster jobs
+package resources
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"go-phers-parser/internal/output"
+)
+
+// StageTime is the total wall time of one stage. Stages run at the same time in the pipeline so
+// the times of the stages can add up to more than the length of the run
+type StageTime struct {
+	Name        string  `json:"name"`
+	WallSeconds float64 `json:"wall_seconds"`
+	Records     int     `json:"records,omitempty"` // number of records (lines, annotations, or variants) that the stage handled
+}
+
+// Usage is the resource usage of the whole run
+type Usage struct {
+	PeakRSSBytes      int64       `json:"peak_rss_bytes"`
+	TotalAllocBytes   uint64      `json:"total_alloc_bytes"`
+	NumGC             uint32      `json:"num_gc"`
+	GCPauseSeconds    float64     `json:"gc_pause_seconds"`
+	MaxGCPauseSeconds float64     `json:"max_gc_pause_seconds"`
+	BytesRead         int64       `json:"bytes_read"`
+	BytesWritten      int64       `json:"bytes_written"`
+	Stages            []StageTime `json:"stages"`
+	// Limits is the CPU quota and memory limit of the container or the cluster job
+	Limits *Limits `json:"limits,omitempty"`
+}
+
+var (
+	stages_mu sync.Mutex
+	stages    []StageTime
+	// timings turns on the Stopwatch laps. Reading the clock for every record has a small cost so
+	// the stages inside of the record loops are only timed with --timings
+	timings bool
+)
+
+// EnableTimings turns on the timing of the stages that are interleaved in the record loops
+func EnableTimings() {
+	timings = true
+}
+
+// TimingsEnabled reports whether --timings was given
+func TimingsEnabled() bool {
+	return timings
+}
+
+// add_stage adds the time and the records to the stage with the name
+func add_stage(name string, elapsed float64, records int) {
+	stages_mu.Lock()
+	defer stages_mu.Unlock()
+
+	if indx := slices.IndexFunc(stages, func(stage StageTime) bool { return stage.Name == name }); indx != -1 {
+		stages[indx].WallSeconds += elapsed
+		stages[indx].Records += records
+	} else {
+		stages = append(stages, StageTime{Name: name, WallSeconds: elapsed, Records: records})
+	}
+}
+
+// StartStage starts the clock for a stage and returns the function that stops it. It is meant to
+// be used as defer resources.StartStage("read annotations")(). A stage that runs more than once
+// (such as the annotations of each chromosome) adds up the time of every run
+func StartStage(name string) func() {
+	started := time.Now()
+	return func() {
+		add_stage(name, time.Since(started).Seconds(), 0)
+	}
+}
+
+// CountRecords adds the number of records that a stage handled. The records of a stage are
+// usually only known once it is done so they are added separately from its time
+func CountRecords(name string, records int) {
+	add_stage(name, 0, records)
+}
+
+// Stopwatch splits the time of a loop between the stages that take turns inside of it (reading
+// a record, filtering it, and looking up its annotations). Each Lap gives the time since the
+// previous lap to the stage. A Stopwatch belongs to one goroutine and the laps are only timed
+// with --timings
+type Stopwatch struct {
+	last    time.Time
+	elapsed map[string]time.Duration
+	records map[string]int
+	order   []string
+}
+
+// NewStopwatch starts a Stopwatch
+func NewStopwatch() *Stopwatch {
+	watch := &Stopwatch{elapsed: make(map[string]time.Duration), records: make(map[string]int)}
+	if timings {
+		watch.last = time.Now()
+	}
+	return watch
+}
+
+// Lap gives the time since the previous lap to the stage
+func (watch *Stopwatch) Lap(name string) {
+	if !timings {
+		return
+	}
+	now := time.Now()
+	if _, found := watch.elapsed[name]; !found {
+		watch.order = append(watch.order, name)
+	}
+	watch.elapsed[name] += now.Sub(watch.last)
+	watch.last = now
+}
+
+// Count adds the records that the stage handled
+func (watch *Stopwatch) Count(name string, records int) {
+	watch.records[name] += records
+}
+
+// Finish adds the laps of the stopwatch to the stages of the run
+func (watch *Stopwatch) Finish() {
+	if !timings {
+		return
+	}
+	for _, name := range watch.order {
+		add_stage(name, watch.elapsed[name].Seconds(), watch.records[name])
+	}
+}
+
+// Collect reads the usage of the process so far
+func Collect() Usage {
+	var mem_stats runtime.MemStats
+	runtime.ReadMemStats(&mem_stats)
+
+	usage := Usage{
+		TotalAllocBytes: mem_stats.TotalAlloc,
+		NumGC:           mem_stats.NumGC,
+		GCPauseSeconds:  time.Duration(mem_stats.PauseTotalNs).Seconds(),
+	}
+	// The runtime only keeps the most recent 256 pauses so the longest pause is from those
+	for _, pause := range mem_stats.PauseNs {
+		usage.MaxGCPauseSeconds = max(usage.MaxGCPauseSeconds, time.Duration(pause).Seconds())
+	}
+	usage.PeakRSSBytes, usage.BytesRead, usage.BytesWritten = process_usage()
+
+	stages_mu.Lock()
+	usage.Stages = slices.Clone(stages)
+	stages_mu.Unlock()
+
+	if applied, found := AppliedLimits(); found {
+		usage.Limits = &applied
+	}
+
+	return usage
+}
+
+// FormatBytes writes the number of bytes with the largest unit that keeps the value above 1
+func FormatBytes(bytes int64) string {
+	value := float64(bytes)
+	for _, unit := range []string{"B", "KiB", "MiB", "GiB"} {
+		if value < 1024 {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+		value /= 1024
+	}
+	return fmt.Sprintf("%.1f TiB", value)
+}
+
+// Report writes the usage as a few lines that can go in the log
+func (usage Usage) Report() []string {
+	var lines []string
+	if usage.PeakRSSBytes > 0 {
+		lines = append(lines, fmt.Sprintf("Peak memory (RSS): %s", FormatBytes(usage.PeakRSSBytes)))
+	}
+	// The peak is compared with the limit so that the next job can ask for less memory or more
+	if usage.Limits != nil && usage.Limits.MemoryBytes > 0 && usage.PeakRSSBytes > 0 {
+		lines = append(lines, fmt.Sprintf("The peak memory was %.0f%% of the memory limit of %s from the %s", 100*float64(usage.PeakRSSBytes)/float64(usage.Limits.MemoryBytes), FormatBytes(usage.Limits.MemoryBytes), usage.Limits.Source))
+	}
+	lines = append(lines, fmt.Sprintf("Allocated %s in total. The garbage collector ran %d times and paused the program for %s (the longest pause was %s)", FormatBytes(int64(usage.TotalAllocBytes)), usage.NumGC, seconds(usage.GCPauseSeconds), seconds(usage.MaxGCPauseSeconds)))
+	if usage.BytesRead > 0 || usage.BytesWritten > 0 {
+		lines = append(lines, fmt.Sprintf("Read %s and wrote %s", FormatBytes(usage.BytesRead), FormatBytes(usage.BytesWritten)))
+	}
+	for _, stage := range usage.Stages {
+		if stage.Records > 0 {
+			lines = append(lines, fmt.Sprintf("Stage %s: %s (%d records)", stage.Name, seconds(stage.WallSeconds), stage.Records))
+		} else {
+			lines = append(lines, fmt.Sprintf("Stage %s: %s", stage.Name, seconds(stage.WallSeconds)))
+		}
+	}
+	return lines
+}
+
+// TimingsTable builds the per-stage table that --timings prints at the end of the run. Stages
+// that ran at the same time overlap so the times don't add up to the length of the run
+func (usage Usage) TimingsTable() []*output.Row {
+	table := []*output.Row{output.Header("STAGE", "WALL_TIME", "RECORDS", "RECORDS_PER_SECOND")}
+	for _, stage := range usage.Stages {
+		rate := "-"
+		if stage.Records > 0 && stage.WallSeconds > 0 {
+			rate = strconv.FormatFloat(float64(stage.Records)/stage.WallSeconds, 'f', 0, 64)
+		}
+		table = append(table, output.NewRow(stage.Name, seconds(stage.WallSeconds)).Int(stage.Records).Add(rate))
+	}
+	return table
+}
+
+func seconds(value float64) string {
+	return time.Duration(value * float64(time.Second)).Round(time.Microsecond).String()
+}
@@ -0,0 +1,73 @@
+package resources
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStopwatch(t *testing.T) {
+	t.Cleanup(func() {
+		timings = false
+		stages = nil
+	})
+	stages = nil
+
+	// Without --timings the laps aren't timed or added to the stages
+	watch := NewStopwatch()
+	watch.Lap("scan vcf")
+	watch.Count("scan vcf", 1)
+	watch.Finish()
+	if len(stages) != 0 {
+		t.Fatalf("the stopwatch added the stages %+v without --timings", stages)
+	}
+
+	EnableTimings()
+	watch = NewStopwatch()
+	time.Sleep(2 * time.Millisecond)
+	watch.Lap("scan vcf")
+	watch.Lap("filter records")
+	watch.Count("scan vcf", 10)
+	watch.Finish()
+	CountRecords("scan vcf", 5)
+
+	if len(stages) != 2 || stages[0].Name != "scan vcf" || stages[1].Name != "filter records" {
+		t.Fatalf("unexpected stages %+v", stages)
+	}
+	if stages[0].Records != 15 || stages[0].WallSeconds < 0.002 {
+		t.Errorf("expected 15 records and at least 2ms for the scan but found %+v", stages[0])
+	}
+
+	table := Usage{Stages: stages}.TimingsTable()
+	if len(table) != 3 || table[0].Len() != table[1].Len() || table[2].Fields()[3] != "-" {
+		t.Errorf("unexpected table %q", table)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	cases := []struct {
+		limits                Limits
+		threads, depth, block int
+	}{
+		// No quota uses the CPUs of the host
+		{Limits{HostCPUs: 16}, 16, 8, 1 << 20},
+		// A quota of 1.5 CPUs rounds up to 2 threads and shortens the queues
+		{Limits{CPUs: 1.5, HostCPUs: 16}, 2, 4, 1 << 20},
+		// A quota above the pinned CPUs can't use more threads than the CPUs
+		{Limits{CPUs: 8, HostCPUs: 4}, 4, 8, 1 << 20},
+		// 256MiB shared by 4 threads leaves 1MiB of blocks for each thread
+		{Limits{CPUs: 4, MemoryBytes: 256 << 20, HostCPUs: 64}, 4, 8, 1 << 20},
+		// A tiny limit doesn't shrink the blocks past the minimum
+		{Limits{CPUs: 0.5, MemoryBytes: 1 << 20, HostCPUs: 64}, 1, 2, minBlockSize},
+	}
+	for _, test_case := range cases {
+		if threads := test_case.limits.Threads(); threads != test_case.threads {
+			t.Errorf("%+v gave %d threads but expected %d", test_case.limits, threads, test_case.threads)
+		}
+		if depth := test_case.limits.QueueDepth(8); depth != test_case.depth {
+			t.Errorf("%+v gave a queue depth of %d but expected %d", test_case.limits, depth, test_case.depth)
+		}
+		if block := test_case.limits.BlockSize(1 << 20); block != test_case.block {
+			t.Errorf("%+v gave a block size of %d but expected %d", test_case.limits, block, test_case.block)
+		}
+	}
+}
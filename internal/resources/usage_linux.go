@@ -0,0 +1,47 @@
+package resources
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// process_usage returns the peak resident memory and the bytes that the process read and wrote.
+// The bytes come from /proc/self/io and include everything that went through a read or write
+// call (stdin, files, and sockets) even if it was served from the page cache
+func process_usage() (int64, int64, int64) {
+	var peak_rss int64
+	var rusage syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &rusage) == nil {
+		// Linux reports the peak in kilobytes
+		peak_rss = rusage.Maxrss * 1024
+	}
+
+	io_fh, open_err := os.Open("/proc/self/io")
+	if open_err != nil {
+		return peak_rss, 0, 0
+	}
+	defer io_fh.Close()
+
+	var bytes_read, bytes_written int64
+	scanner := bufio.NewScanner(io_fh)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		parsed, parse_err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if parse_err != nil {
+			continue
+		}
+		switch key {
+		case "rchar":
+			bytes_read = parsed
+		case "wchar":
+			bytes_written = parsed
+		}
+	}
+	return peak_rss, bytes_read, bytes_written
+}
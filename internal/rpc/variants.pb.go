@@ -0,0 +1,404 @@
+// Schema for streaming the filtered variant records of a region to downstream services. The
+// generated go code lives next to this file. Regenerate it with:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	    --go-grpc_out=. --go-grpc_opt=paths=source_relative internal/rpc/variants.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        v5.29.3
+// source: internal/rpc/variants.proto
+
+package rpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// RegionRequest selects the records to stream
+type RegionRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// region of the form chrX:start-end
+	Region string `protobuf:"bytes,1,opt,name=region,proto3" json:"region,omitempty"`
+	// records where every alternate allele is more common than this value are skipped. A value of 0 disables the filter
+	MaxAlleleFrequency float64 `protobuf:"fixed64,2,opt,name=max_allele_frequency,json=maxAlleleFrequency,proto3" json:"max_allele_frequency,omitempty"`
+	// skip the records that no sample carries
+	CarriersOnly  bool `protobuf:"varint,3,opt,name=carriers_only,json=carriersOnly,proto3" json:"carriers_only,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegionRequest) Reset() {
+	*x = RegionRequest{}
+	mi := &file_internal_rpc_variants_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegionRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegionRequest) ProtoMessage() {}
+
+func (x *RegionRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_rpc_variants_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegionRequest.ProtoReflect.Descriptor instead.
+func (*RegionRequest) Descriptor() ([]byte, []int) {
+	return file_internal_rpc_variants_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *RegionRequest) GetRegion() string {
+	if x != nil {
+		return x.Region
+	}
+	return ""
+}
+
+func (x *RegionRequest) GetMaxAlleleFrequency() float64 {
+	if x != nil {
+		return x.MaxAlleleFrequency
+	}
+	return 0
+}
+
+func (x *RegionRequest) GetCarriersOnly() bool {
+	if x != nil {
+		return x.CarriersOnly
+	}
+	return false
+}
+
+// Carrier is a sample with a non reference call
+type Carrier struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Sample        string                 `protobuf:"bytes,1,opt,name=sample,proto3" json:"sample,omitempty"`
+	Genotype      string                 `protobuf:"bytes,2,opt,name=genotype,proto3" json:"genotype,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Carrier) Reset() {
+	*x = Carrier{}
+	mi := &file_internal_rpc_variants_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Carrier) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Carrier) ProtoMessage() {}
+
+func (x *Carrier) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_rpc_variants_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Carrier.ProtoReflect.Descriptor instead.
+func (*Carrier) Descriptor() ([]byte, []int) {
+	return file_internal_rpc_variants_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Carrier) GetSample() string {
+	if x != nil {
+		return x.Sample
+	}
+	return ""
+}
+
+func (x *Carrier) GetGenotype() string {
+	if x != nil {
+		return x.Genotype
+	}
+	return ""
+}
+
+// CarrierSet holds the carriers of a variant and the genotype class counts across all samples
+type CarrierSet struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Carriers []*Carrier             `protobuf:"bytes,1,rep,name=carriers,proto3" json:"carriers,omitempty"`
+	// keyed by homo_ref, het, homo_alt, no_calls, and other
+	GenotypeCounts map[string]int32 `protobuf:"bytes,2,rep,name=genotype_counts,json=genotypeCounts,proto3" json:"genotype_counts,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *CarrierSet) Reset() {
+	*x = CarrierSet{}
+	mi := &file_internal_rpc_variants_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CarrierSet) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CarrierSet) ProtoMessage() {}
+
+func (x *CarrierSet) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_rpc_variants_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CarrierSet.ProtoReflect.Descriptor instead.
+func (*CarrierSet) Descriptor() ([]byte, []int) {
+	return file_internal_rpc_variants_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *CarrierSet) GetCarriers() []*Carrier {
+	if x != nil {
+		return x.Carriers
+	}
+	return nil
+}
+
+func (x *CarrierSet) GetGenotypeCounts() map[string]int32 {
+	if x != nil {
+		return x.GenotypeCounts
+	}
+	return nil
+}
+
+// VariantRecord is one vcf record with its carriers and annotations
+type VariantRecord struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	Chrom             string                 `protobuf:"bytes,1,opt,name=chrom,proto3" json:"chrom,omitempty"`
+	Pos               int64                  `protobuf:"varint,2,opt,name=pos,proto3" json:"pos,omitempty"`
+	Id                string                 `protobuf:"bytes,3,opt,name=id,proto3" json:"id,omitempty"`
+	Ref               string                 `protobuf:"bytes,4,opt,name=ref,proto3" json:"ref,omitempty"`
+	Alt               string                 `protobuf:"bytes,5,opt,name=alt,proto3" json:"alt,omitempty"`
+	Filter            string                 `protobuf:"bytes,6,opt,name=filter,proto3" json:"filter,omitempty"`
+	AlleleFrequencies []float64              `protobuf:"fixed64,7,rep,packed,name=allele_frequencies,json=alleleFrequencies,proto3" json:"allele_frequencies,omitempty"`
+	Annotations       map[string]string      `protobuf:"bytes,8,rep,name=annotations,proto3" json:"annotations,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	CarrierSet        *CarrierSet            `protobuf:"bytes,9,opt,name=carrier_set,json=carrierSet,proto3" json:"carrier_set,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *VariantRecord) Reset() {
+	*x = VariantRecord{}
+	mi := &file_internal_rpc_variants_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VariantRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VariantRecord) ProtoMessage() {}
+
+func (x *VariantRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_rpc_variants_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VariantRecord.ProtoReflect.Descriptor instead.
+func (*VariantRecord) Descriptor() ([]byte, []int) {
+	return file_internal_rpc_variants_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *VariantRecord) GetChrom() string {
+	if x != nil {
+		return x.Chrom
+	}
+	return ""
+}
+
+func (x *VariantRecord) GetPos() int64 {
+	if x != nil {
+		return x.Pos
+	}
+	return 0
+}
+
+func (x *VariantRecord) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *VariantRecord) GetRef() string {
+	if x != nil {
+		return x.Ref
+	}
+	return ""
+}
+
+func (x *VariantRecord) GetAlt() string {
+	if x != nil {
+		return x.Alt
+	}
+	return ""
+}
+
+func (x *VariantRecord) GetFilter() string {
+	if x != nil {
+		return x.Filter
+	}
+	return ""
+}
+
+func (x *VariantRecord) GetAlleleFrequencies() []float64 {
+	if x != nil {
+		return x.AlleleFrequencies
+	}
+	return nil
+}
+
+func (x *VariantRecord) GetAnnotations() map[string]string {
+	if x != nil {
+		return x.Annotations
+	}
+	return nil
+}
+
+func (x *VariantRecord) GetCarrierSet() *CarrierSet {
+	if x != nil {
+		return x.CarrierSet
+	}
+	return nil
+}
+
+var File_internal_rpc_variants_proto protoreflect.FileDescriptor
+
+const file_internal_rpc_variants_proto_rawDesc = "" +
+	"\n" +
+	"\x1binternal/rpc/variants.proto\x12\x13gophers.variants.v1\"~\n" +
+	"\rRegionRequest\x12\x16\n" +
+	"\x06region\x18\x01 \x01(\tR\x06region\x120\n" +
+	"\x14max_allele_frequency\x18\x02 \x01(\x01R\x12maxAlleleFrequency\x12#\n" +
+	"\rcarriers_only\x18\x03 \x01(\bR\fcarriersOnly\"=\n" +
+	"\aCarrier\x12\x16\n" +
+	"\x06sample\x18\x01 \x01(\tR\x06sample\x12\x1a\n" +
+	"\bgenotype\x18\x02 \x01(\tR\bgenotype\"\xe7\x01\n" +
+	"\n" +
+	"CarrierSet\x128\n" +
+	"\bcarriers\x18\x01 \x03(\v2\x1c.gophers.variants.v1.CarrierR\bcarriers\x12\\\n" +
+	"\x0fgenotype_counts\x18\x02 \x03(\v23.gophers.variants.v1.CarrierSet.GenotypeCountsEntryR\x0egenotypeCounts\x1aA\n" +
+	"\x13GenotypeCountsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x05R\x05value:\x028\x01\"\x8b\x03\n" +
+	"\rVariantRecord\x12\x14\n" +
+	"\x05chrom\x18\x01 \x01(\tR\x05chrom\x12\x10\n" +
+	"\x03pos\x18\x02 \x01(\x03R\x03pos\x12\x0e\n" +
+	"\x02id\x18\x03 \x01(\tR\x02id\x12\x10\n" +
+	"\x03ref\x18\x04 \x01(\tR\x03ref\x12\x10\n" +
+	"\x03alt\x18\x05 \x01(\tR\x03alt\x12\x16\n" +
+	"\x06filter\x18\x06 \x01(\tR\x06filter\x12-\n" +
+	"\x12allele_frequencies\x18\a \x03(\x01R\x11alleleFrequencies\x12U\n" +
+	"\vannotations\x18\b \x03(\v23.gophers.variants.v1.VariantRecord.AnnotationsEntryR\vannotations\x12@\n" +
+	"\vcarrier_set\x18\t \x01(\v2\x1f.gophers.variants.v1.CarrierSetR\n" +
+	"carrierSet\x1a>\n" +
+	"\x10AnnotationsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x012j\n" +
+	"\x0eVariantService\x12X\n" +
+	"\fStreamRegion\x12\".gophers.variants.v1.RegionRequest\x1a\".gophers.variants.v1.VariantRecord0\x01B9\n" +
+	"\x17org.gophers.variants.v1P\x01Z\x1cgo-phers-parser/internal/rpcb\x06proto3"
+
+var (
+	file_internal_rpc_variants_proto_rawDescOnce sync.Once
+	file_internal_rpc_variants_proto_rawDescData []byte
+)
+
+func file_internal_rpc_variants_proto_rawDescGZIP() []byte {
+	file_internal_rpc_variants_proto_rawDescOnce.Do(func() {
+		file_internal_rpc_variants_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_internal_rpc_variants_proto_rawDesc), len(file_internal_rpc_variants_proto_rawDesc)))
+	})
+	return file_internal_rpc_variants_proto_rawDescData
+}
+
+var file_internal_rpc_variants_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_internal_rpc_variants_proto_goTypes = []any{
+	(*RegionRequest)(nil), // 0: gophers.variants.v1.RegionRequest
+	(*Carrier)(nil),       // 1: gophers.variants.v1.Carrier
+	(*CarrierSet)(nil),    // 2: gophers.variants.v1.CarrierSet
+	(*VariantRecord)(nil), // 3: gophers.variants.v1.VariantRecord
+	nil,                   // 4: gophers.variants.v1.CarrierSet.GenotypeCountsEntry
+	nil,                   // 5: gophers.variants.v1.VariantRecord.AnnotationsEntry
+}
+var file_internal_rpc_variants_proto_depIdxs = []int32{
+	1, // 0: gophers.variants.v1.CarrierSet.carriers:type_name -> gophers.variants.v1.Carrier
+	4, // 1: gophers.variants.v1.CarrierSet.genotype_counts:type_name -> gophers.variants.v1.CarrierSet.GenotypeCountsEntry
+	5, // 2: gophers.variants.v1.VariantRecord.annotations:type_name -> gophers.variants.v1.VariantRecord.AnnotationsEntry
+	2, // 3: gophers.variants.v1.VariantRecord.carrier_set:type_name -> gophers.variants.v1.CarrierSet
+	0, // 4: gophers.variants.v1.VariantService.StreamRegion:input_type -> gophers.variants.v1.RegionRequest
+	3, // 5: gophers.variants.v1.VariantService.StreamRegion:output_type -> gophers.variants.v1.VariantRecord
+	5, // [5:6] is the sub-list for method output_type
+	4, // [4:5] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_internal_rpc_variants_proto_init() }
+func file_internal_rpc_variants_proto_init() {
+	if File_internal_rpc_variants_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_internal_rpc_variants_proto_rawDesc), len(file_internal_rpc_variants_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_internal_rpc_variants_proto_goTypes,
+		DependencyIndexes: file_internal_rpc_variants_proto_depIdxs,
+		MessageInfos:      file_internal_rpc_variants_proto_msgTypes,
+	}.Build()
+	File_internal_rpc_variants_proto = out.File
+	file_internal_rpc_variants_proto_goTypes = nil
+	file_internal_rpc_variants_proto_depIdxs = nil
+}
@@ -0,0 +1,132 @@
+// Schema for streaming the filtered variant records of a region to downstream services. The
+// generated go code lives next to this file. Regenerate it with:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	    --go-grpc_out=. --go-grpc_opt=paths=source_relative internal/rpc/variants.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: internal/rpc/variants.proto
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	VariantService_StreamRegion_FullMethodName = "/gophers.variants.v1.VariantService/StreamRegion"
+)
+
+// VariantServiceClient is the client API for VariantService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type VariantServiceClient interface {
+	// StreamRegion streams the records of the region in the order of the vcf file
+	StreamRegion(ctx context.Context, in *RegionRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[VariantRecord], error)
+}
+
+type variantServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewVariantServiceClient(cc grpc.ClientConnInterface) VariantServiceClient {
+	return &variantServiceClient{cc}
+}
+
+func (c *variantServiceClient) StreamRegion(ctx context.Context, in *RegionRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[VariantRecord], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &VariantService_ServiceDesc.Streams[0], VariantService_StreamRegion_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[RegionRequest, VariantRecord]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type VariantService_StreamRegionClient = grpc.ServerStreamingClient[VariantRecord]
+
+// VariantServiceServer is the server API for VariantService service.
+// All implementations must embed UnimplementedVariantServiceServer
+// for forward compatibility.
+type VariantServiceServer interface {
+	// StreamRegion streams the records of the region in the order of the vcf file
+	StreamRegion(*RegionRequest, grpc.ServerStreamingServer[VariantRecord]) error
+	mustEmbedUnimplementedVariantServiceServer()
+}
+
+// UnimplementedVariantServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedVariantServiceServer struct{}
+
+func (UnimplementedVariantServiceServer) StreamRegion(*RegionRequest, grpc.ServerStreamingServer[VariantRecord]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamRegion not implemented")
+}
+func (UnimplementedVariantServiceServer) mustEmbedUnimplementedVariantServiceServer() {}
+func (UnimplementedVariantServiceServer) testEmbeddedByValue()                        {}
+
+// UnsafeVariantServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to VariantServiceServer will
+// result in compilation errors.
+type UnsafeVariantServiceServer interface {
+	mustEmbedUnimplementedVariantServiceServer()
+}
+
+func RegisterVariantServiceServer(s grpc.ServiceRegistrar, srv VariantServiceServer) {
+	// If the following call pancis, it indicates UnimplementedVariantServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&VariantService_ServiceDesc, srv)
+}
+
+func _VariantService_StreamRegion_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(RegionRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(VariantServiceServer).StreamRegion(m, &grpc.GenericServerStream[RegionRequest, VariantRecord]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type VariantService_StreamRegionServer = grpc.ServerStreamingServer[VariantRecord]
+
+// VariantService_ServiceDesc is the grpc.ServiceDesc for VariantService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var VariantService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gophers.variants.v1.VariantService",
+	HandlerType: (*VariantServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamRegion",
+			Handler:       _VariantService_StreamRegion_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "internal/rpc/variants.proto",
+}
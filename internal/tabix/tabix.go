@@ -0,0 +1,261 @@
+package tabix
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/files"
+
+	gzip "github.com/klauspost/pgzip"
+)
+
+// The pseudo bin holds statistics about the reference instead of chunks so we skip it
+const pseudoBin = 37450
+
+// The linear index uses 16kb windows
+const linearShift = 14
+
+// chunk fields are exported so that encoding/binary can fill them in
+type chunk struct {
+	Begin uint64
+	End   uint64
+}
+
+type reference struct {
+	bins   map[uint32][]chunk
+	linear []uint64
+}
+
+// Index is the content of a .tbi file. Only the parts that we need to find the
+// first record overlapping a region are kept
+type Index struct {
+	Filename   string
+	Names      []string
+	references map[string]*reference // keyed by the canonical contig name so chr22 and 22 both work
+}
+
+// ReadIndex reads a tabix index. The .tbi file is BGZF compressed like the vcf file
+func ReadIndex(filename string) (*Index, error) {
+	fh, open_err := files.OpenSource(filename)
+	if open_err != nil {
+		return nil, fmt.Errorf("encountered the following error while opening the tabix index: %w", open_err)
+	}
+	defer fh.Close()
+
+	gh, gzip_err := gzip.NewReader(fh)
+	if gzip_err != nil {
+		return nil, fmt.Errorf("encountered the following error while trying to decompress the tabix index %s: %w", filename, gzip_err)
+	}
+	defer gh.Close()
+
+	reader := bufio.NewReader(gh)
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(reader, magic); err != nil || !bytes.Equal(magic, []byte("TBI\x01")) {
+		return nil, fmt.Errorf("the file %s is not a tabix index", filename)
+	}
+
+	// n_ref, format, col_seq, col_beg, col_end, meta, skip, l_nm
+	fields := make([]int32, 8)
+	if err := binary.Read(reader, binary.LittleEndian, fields); err != nil {
+		return nil, fmt.Errorf("unable to read the header of the tabix index %s: %w", filename, err)
+	}
+	n_ref := int(fields[0])
+
+	names_block := make([]byte, fields[7])
+	if _, err := io.ReadFull(reader, names_block); err != nil {
+		return nil, fmt.Errorf("unable to read the contig names from the tabix index %s: %w", filename, err)
+	}
+	names := strings.Split(strings.TrimRight(string(names_block), "\x00"), "\x00")
+	if len(names) != n_ref {
+		return nil, fmt.Errorf("the tabix index %s lists %d contig names but has %d references", filename, len(names), n_ref)
+	}
+
+	index := &Index{Filename: filename, Names: names, references: make(map[string]*reference)}
+
+	for _, name := range names {
+		ref := &reference{bins: make(map[uint32][]chunk)}
+
+		var n_bin int32
+		if err := binary.Read(reader, binary.LittleEndian, &n_bin); err != nil {
+			return nil, fmt.Errorf("unable to read the bins for the contig %s: %w", name, err)
+		}
+		for i := 0; i < int(n_bin); i++ {
+			var bin uint32
+			var n_chunk int32
+			if err := binary.Read(reader, binary.LittleEndian, &bin); err != nil {
+				return nil, err
+			}
+			if err := binary.Read(reader, binary.LittleEndian, &n_chunk); err != nil {
+				return nil, err
+			}
+			chunks := make([]chunk, n_chunk)
+			if err := binary.Read(reader, binary.LittleEndian, chunks); err != nil {
+				return nil, err
+			}
+			if bin != pseudoBin {
+				ref.bins[bin] = chunks
+			}
+		}
+
+		var n_intv int32
+		if err := binary.Read(reader, binary.LittleEndian, &n_intv); err != nil {
+			return nil, fmt.Errorf("unable to read the linear index for the contig %s: %w", name, err)
+		}
+		ref.linear = make([]uint64, n_intv)
+		if err := binary.Read(reader, binary.LittleEndian, ref.linear); err != nil {
+			return nil, err
+		}
+
+		index.references[contig.Canonical(name)] = ref
+	}
+
+	return index, nil
+}
+
+// regionToBins returns the bins that can hold records overlapping the 0-based half open interval
+func regionToBins(begin int, end int) []uint32 {
+	end--
+	bins := []uint32{0}
+	for _, level := range []struct{ offset, shift int }{{1, 26}, {9, 23}, {73, 20}, {585, 17}, {4681, 14}} {
+		for k := level.offset + (begin >> level.shift); k <= level.offset+(end>>level.shift); k++ {
+			bins = append(bins, uint32(k))
+		}
+	}
+	return bins
+}
+
+// Offset returns the virtual file offset of the earliest block that could contain a record
+// overlapping the 1-based inclusive region. Reading the vcf forward from this offset until
+// the records pass the end of the region returns every overlapping record
+func (index *Index) Offset(chrom string, start int, end int) (uint64, bool) {
+	ref, found := index.references[contig.Canonical(chrom)]
+	if !found {
+		return 0, false
+	}
+
+	// Records that end before this offset can not overlap the region
+	var min_offset uint64
+	if window := (start - 1) >> linearShift; window < len(ref.linear) {
+		min_offset = ref.linear[window]
+	} else if len(ref.linear) > 0 {
+		min_offset = ref.linear[len(ref.linear)-1]
+	}
+
+	offset_found := false
+	var best uint64
+	for _, bin := range regionToBins(start-1, end) {
+		for _, chnk := range ref.bins[bin] {
+			if chnk.End <= min_offset {
+				continue
+			}
+			begin := max(chnk.Begin, min_offset)
+			if !offset_found || begin < best {
+				best = begin
+				offset_found = true
+			}
+		}
+	}
+	return best, offset_found
+}
+
+// Seeker lets us read a bgzipped file starting from a virtual offset
+type Seeker struct {
+	fh io.ReadSeekCloser
+	gh *gzip.Reader
+}
+
+// OpenAt opens the BGZF file and positions the reader at the virtual offset. The upper 48 bits
+// of the offset are the position of the compressed block and the lower 16 bits are the position inside of that block
+func OpenAt(filename string, virtual_offset uint64) (io.ReadCloser, error) {
+	fh, open_err := files.OpenSource(filename)
+	if open_err != nil {
+		return nil, fmt.Errorf("encountered the following error while opening the file: %w", open_err)
+	}
+
+	if _, seek_err := fh.Seek(int64(virtual_offset>>16), io.SeekStart); seek_err != nil {
+		fh.Close()
+		return nil, fmt.Errorf("unable to seek to the offset %d in %s: %w", virtual_offset>>16, filename, seek_err)
+	}
+
+	gh, gzip_err := gzip.NewReader(fh)
+	if gzip_err != nil {
+		fh.Close()
+		return nil, fmt.Errorf("encountered the following error while trying to decompress the file %s: %w", filename, gzip_err)
+	}
+
+	if _, skip_err := io.CopyN(io.Discard, gh, int64(virtual_offset&0xffff)); skip_err != nil {
+		gh.Close()
+		fh.Close()
+		return nil, fmt.Errorf("unable to move to the offset %d inside of the block: %w", virtual_offset&0xffff, skip_err)
+	}
+
+	return &Seeker{fh: fh, gh: gh}, nil
+}
+
+func (seeker *Seeker) Read(p []byte) (int, error) {
+	return seeker.gh.Read(p)
+}
+
+func (seeker *Seeker) Close() error {
+	seeker.gh.Close()
+	return seeker.fh.Close()
+}
+
+// ScanRegion calls fn with the split columns of every record in the bgzipped vcf that starts
+// inside of the 1-based inclusive region. The records are read from the first block that the
+// index says can contain the region until the records move past the end of the region
+func (index *Index) ScanRegion(filename string, chrom string, start int, end int, buffersize int, fn func(split_line []string) error) error {
+	offset, found := index.Offset(chrom, start, end)
+	if !found {
+		return nil
+	}
+
+	seeker, seek_err := OpenAt(filename, offset)
+	if seek_err != nil {
+		return seek_err
+	}
+	defer seeker.Close()
+
+	scanner, _ := files.NewLineScanner(seeker, buffersize)
+
+	contig_seen := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		split_line := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+		if len(split_line) < 2 {
+			continue
+		}
+		// The blocks before the region can have records from other contigs so we only stop once we have moved past the contig
+		if !contig.Same(split_line[0], chrom) {
+			if contig_seen {
+				break
+			}
+			continue
+		}
+		contig_seen = true
+		pos, pos_err := strconv.Atoi(split_line[1])
+		if pos_err != nil {
+			return fmt.Errorf("unable to parse the position %s of a record in %s: %w", split_line[1], filename, pos_err)
+		}
+		if pos > end {
+			break
+		}
+		if pos < start {
+			continue
+		}
+		if fn_err := fn(split_line); fn_err != nil {
+			return fn_err
+		}
+	}
+	return scanner.Err()
+}
@@ -1,18 +1,95 @@
 package internal
 
 type UserArgs struct {
-	CallsFile         string
-	SamplesList       string
-	PhenoFilePath     string
-	OutputFilepath    string
-	ClinvarColumnName string
-	ConsequenceCol    string
-	LogfilePath       string
-	AnnoFile          string
-	ColsToKeep        string
-	OutputFile        string
-	LogFilePath       string
-	MafCap            float64
-	Region            string
-	Buffersize        int
+	CallsFile               string
+	SamplesList             string
+	PhenoFilePath           string
+	OutputFilepath          string
+	ClinvarColumnName       string
+	ConsequenceCol          string
+	LogfilePath             string
+	AnnoFile                string
+	AnnoSources             []string
+	ColsToKeep              string
+	OutputFile              string
+	LogFilePath             string
+	MafCap                  float64
+	MafCompare              string
+	AdaptiveMaf             string
+	Region                  string
+	ContigStyle             string
+	ChainFile               string
+	LiftoverMode            string
+	GenomeBuild             string
+	Strict                  bool
+	Lenient                 bool
+	WriteRejects            bool
+	WriteUnannotated        bool
+	InfoCols                string
+	ExpectedPloidy          string
+	Classifier              string
+	GenotypeClass           string
+	MinVAF                  float64
+	KeepIntermediate        bool
+	SampleExclusion         string
+	CountsOnly              bool
+	MaxCarriersListed       int
+	PhenoCols               string
+	ScoreQuantile           float64
+	CovariateFile           string
+	CovariateCols           string
+	StrataCols              string
+	VariantTiers            bool
+	LofteeCol               string
+	LofHCOnly               bool
+	GeneCol                 string
+	TierFreqCol             string
+	SampleID                string
+	Variant                 string
+	VcfFile                 string
+	WindowSize              int
+	FirstFile               string
+	SecondFile              string
+	InputFiles              []string
+	Append                  bool
+	ListenAddress           string
+	GRPCAddress             string
+	PublishTarget           string
+	OutputFormat            string
+	BatchSize               int
+	QueueDepth              int
+	ValidateAgainstBcftools string
+	BcftoolsPath            string
+	Samples                 string
+	SamplesFile             string
+	MaxMemory               string
+	RegionsFile             string
+	AnnoPosCols             string
+	AfColumns               string
+	AfMode                  string
+	FoldAf                  bool
+	MaxAC                   int
+	OnlySingletons          bool
+	RestrictToPheno         bool
+	CarrierVAF              bool
+	FilterTrace             bool
+	KeepFiltered            bool
+	WholeGenome             bool
+	ShardWorkers            int
+	HashIdsMap              string
+	DiscoveryVcf            string
+	DiscoveryPheno          string
+	ReplicationVcf          string
+	ReplicationPheno        string
+	SubsetVariants          int
+	SubsetSamples           int
+	Seed                    int
+	GTOnly                  bool
+	BenchBuffersizes        string
+	BenchWorkers            string
+	BenchRepeat             int
+	BenchDecompressors      string
+	Database                string
+	Query                   string
+	Buffersize              int
 }
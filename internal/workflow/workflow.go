@@ -0,0 +1,133 @@
+package workflow
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Step is one subcommand in the workflow. The Params use the same names as the command line
+// flags (such as anno-file or maf-threshold). If the Output is empty then a filename is
+// generated from the output prefix and the name of the step
+type Step struct {
+	Name    string            `yaml:"name"`
+	Command string            `yaml:"command"`
+	Params  map[string]string `yaml:"params"`
+	Output  string            `yaml:"output"`
+}
+
+// Workflow is the ordered list of steps from the workflow file. The Shared parameters are
+// given to every step unless the step sets the parameter itself. An example workflow file is:
+//
+//	output_prefix: results/BRCA1
+//	shared:
+//	  pheno-file: cases.txt
+//	steps:
+//	  - name: pull
+//	    command: pull-variants
+//	    params:
+//	      anno-file: vep.txt.gz
+//	      region: chr17:43044295-43125483
+//	  - command: view-sample-variants
+//	    params:
+//	      calls-file: ${pull.output}
+type Workflow struct {
+	OutputPrefix string            `yaml:"output_prefix"`
+	Shared       map[string]string `yaml:"shared"`
+	Steps        []Step            `yaml:"steps"`
+}
+
+// references look like ${pull.output} or ${prefix}
+var referencePattern = regexp.MustCompile(`\$\{([A-Za-z0-9_-]+)(?:\.output)?\}`)
+
+// ReadWorkflow reads in the yaml file describing the workflow
+func ReadWorkflow(filename string) (*Workflow, error) {
+	contents, read_err := os.ReadFile(filename)
+	if read_err != nil {
+		return nil, fmt.Errorf("encountered the following error while trying to read the workflow file %s: %w", filename, read_err)
+	}
+
+	var wf Workflow
+
+	decoder := yaml.NewDecoder(strings.NewReader(string(contents)))
+	decoder.KnownFields(true)
+
+	if decode_err := decoder.Decode(&wf); decode_err != nil {
+		return nil, fmt.Errorf("unable to parse the workflow file %s: %w", filename, decode_err)
+	}
+
+	if len(wf.Steps) == 0 {
+		return nil, fmt.Errorf("the workflow file %s did not have any steps", filename)
+	}
+	return &wf, nil
+}
+
+// Resolve fills in the default step names and outputs, merges the shared parameters into each
+// step, and replaces references to the outputs of earlier steps. A step can only refer to steps
+// that come before it because the steps are run in order
+func (wf *Workflow) Resolve(default_prefix string) ([]Step, error) {
+	prefix := wf.OutputPrefix
+	if prefix == "" {
+		prefix = default_prefix
+	}
+
+	outputs := map[string]string{"prefix": prefix}
+
+	resolved := make([]Step, 0, len(wf.Steps))
+
+	for indx, step := range wf.Steps {
+		if step.Command == "" {
+			return nil, fmt.Errorf("step %d of the workflow does not have a command", indx+1)
+		}
+		if step.Name == "" {
+			step.Name = step.Command
+		}
+		if _, duplicate := outputs[step.Name]; duplicate {
+			return nil, fmt.Errorf("the name %s is used by more than one step in the workflow. Please give each step a unique name", step.Name)
+		}
+
+		params := make(map[string]string, len(wf.Shared)+len(step.Params))
+		for key, value := range wf.Shared {
+			params[key] = value
+		}
+		for key, value := range step.Params {
+			params[key] = value
+		}
+
+		var resolve_err error
+		substitute := func(value string) string {
+			return referencePattern.ReplaceAllStringFunc(value, func(match string) string {
+				name := referencePattern.FindStringSubmatch(match)[1]
+				output, found := outputs[name]
+				if !found {
+					resolve_err = fmt.Errorf("the step %s refers to %s but there is no earlier step with the name %s", step.Name, match, name)
+					return match
+				}
+				return output
+			})
+		}
+
+		for key, value := range params {
+			params[key] = substitute(value)
+		}
+
+		if step.Output == "" {
+			step.Output = fmt.Sprintf("%s_%s.txt", prefix, step.Name)
+		} else {
+			step.Output = substitute(step.Output)
+		}
+
+		if resolve_err != nil {
+			return nil, resolve_err
+		}
+
+		step.Params = params
+		outputs[step.Name] = step.Output
+		resolved = append(resolved, step)
+	}
+
+	return resolved, nil
+}
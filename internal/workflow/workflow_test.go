@@ -0,0 +1,62 @@
+package workflow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	wf := Workflow{
+		Shared: map[string]string{"pheno-file": "cases.txt", "maf-threshold": "0.01"},
+		Steps: []Step{
+			{Name: "pull", Command: "pull-variants", Params: map[string]string{"maf-threshold": "0.001", "region": "chr17:1-100"}},
+			{Command: "view-sample-variants", Params: map[string]string{"calls-file": "${pull.output}"}, Output: "${prefix}_view.tsv"},
+		},
+	}
+
+	steps, resolve_err := wf.Resolve("results/BRCA1")
+	if resolve_err != nil {
+		t.Fatalf("unable to resolve the workflow: %s", resolve_err)
+	}
+
+	// The params of a step win over the shared params and the shared params fill in the rest
+	pull := steps[0]
+	if pull.Params["maf-threshold"] != "0.001" {
+		t.Errorf("expected the step maf-threshold 0.001 to override the shared value but found %s", pull.Params["maf-threshold"])
+	}
+	if pull.Params["pheno-file"] != "cases.txt" || pull.Params["region"] != "chr17:1-100" {
+		t.Errorf("expected the pull step to have the shared pheno-file and its own region but found %v", pull.Params)
+	}
+	if pull.Output != "results/BRCA1_pull.txt" {
+		t.Errorf("expected the default output results/BRCA1_pull.txt but found %s", pull.Output)
+	}
+
+	view := steps[1]
+	if view.Name != "view-sample-variants" {
+		t.Errorf("expected the step without a name to be named after its command but found %s", view.Name)
+	}
+	if view.Params["calls-file"] != pull.Output || view.Output != "results/BRCA1_view.tsv" {
+		t.Errorf("expected the references to be replaced but found calls-file=%s and output=%s", view.Params["calls-file"], view.Output)
+	}
+	if view.Params["maf-threshold"] != "0.01" {
+		t.Errorf("expected the shared maf-threshold 0.01 for the second step but found %s", view.Params["maf-threshold"])
+	}
+	// The shared params aren't changed by the step that overrides them
+	if wf.Shared["maf-threshold"] != "0.01" {
+		t.Errorf("expected the shared params to be left alone but found %v", wf.Shared)
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	cases := map[string]Workflow{
+		"does not have a command": {Steps: []Step{{Name: "pull"}}},
+		"more than one step":      {Steps: []Step{{Command: "pull-variants"}, {Command: "pull-variants"}}},
+		"no earlier step":         {Steps: []Step{{Command: "view-sample-variants", Params: map[string]string{"calls-file": "${pull.output}"}}}},
+	}
+	for expected, wf := range cases {
+		_, resolve_err := wf.Resolve("out")
+		if resolve_err == nil || !strings.Contains(resolve_err.Error(), expected) {
+			t.Errorf("expected an error containing %q but found %v", expected, resolve_err)
+		}
+	}
+}
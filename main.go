@@ -2,14 +2,23 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	cmd_commands "go-phers-parser/cmd"
 	"go-phers-parser/internal"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/manifest"
+	"go-phers-parser/internal/pipeline"
+	"go-phers-parser/internal/pseudonym"
+	"go-phers-parser/internal/resources"
 	log "go-phers-parser/logger"
 
 	"github.com/urfave/cli/v3"
@@ -21,7 +30,15 @@ func GenerateLogFileName(output_path string, log_filename string) string {
 	return filepath.Join(parent_output_dir, log_filename)
 }
 
+// ManifestPath is where the run manifest for the output is written. The manifest sits next to the
+// output and uses the output name without its extension (which is also the prefix for run-pipeline)
+func ManifestPath(output_path string) string {
+	return strings.TrimSuffix(output_path, filepath.Ext(output_path)) + ".manifest.json"
+}
+
 func main() {
+	run_started := time.Now()
+
 	// we are going to define our flag arrays here
 	pull_var_flags := []cli.Flag{
 		&cli.StringFlag{
@@ -29,15 +46,19 @@ func main() {
 			Aliases: []string{"a"},
 			Usage:   "Filepath to an annotation file (currently on supports VEP so that there is a canocial colum that we can use to avoid duplicates and only look at the cannocial transcript).",
 		},
+		&cli.StringSliceFlag{
+			Name:  "anno-source",
+			Usage: "Additional annotation source given as type:path. The types are clinvar (the ClinVar vcf), csq (a vcf annotated by VEP, use csq=ANN for snpEff), and tabix (a table like CADD or dbNSFP). The files have to be bgzipped and tabix indexed on the same build as the callset. Can be given multiple times and the sources are checked in order after the --anno-file. The columns are selected with --keep-cols",
+		},
 		&cli.StringFlag{
 			Name:    "pheno-file",
 			Aliases: []string{"p"},
-			Usage:   "Filepath to a tab separated file where the first column are ids and the second column is the case/control status. This file can have a header with the columns 'GRID' and 'Status' or it can have no header",
+			Usage:   "Filepath to a tab separated file where the first column are ids and the second column is the case/control status. This file can have a header line (see --header-keywords) or it can have no header",
 		},
 		&cli.StringFlag{
 			Name:    "keep-cols",
 			Aliases: []string{"c"},
-			Usage:   "Columns in the annotation file to keep while it is being read in.",
+			Usage:   "Columns in the annotation file to keep while it is being read in. A column can be renamed in the output with NAME=ALIAS (for example CLIN_SIG=ClinVar,gnomADe_NFE_AF=gnomAD_AF)",
 		},
 		&cli.StringFlag{
 			Name:    "output",
@@ -51,21 +72,232 @@ func main() {
 			Usage:   "region of the chromosome that we are intereseted in search for. This regions should have the form chrX:start-end. We will use this region to filter which annotations we wish to save in memory",
 		},
 
+		&cli.StringFlag{
+			Name:  "contig-style",
+			Value: "auto",
+			Usage: "How chromosome names should be written in the output. 'auto' keeps the names from the vcf file but still matches chr22 and 22 between the region, vcf, and annotation file. 'chr' forces names like chr22 and 'no-chr' forces names like 22",
+		},
+		&cli.StringFlag{
+			Name:  "chain-file",
+			Usage: "Filepath to a UCSC chain file (such as hg19ToHg38.over.chain.gz) used when the annotation file and the vcf file are on different genome builds. See --liftover-mode for which direction the chain file should map",
+		},
+		&cli.StringFlag{
+			Name:  "liftover-mode",
+			Value: "annotations",
+			Usage: "How the chain file is used. 'annotations' lifts every annotation position and variant id from the annotation build into the callset build (chain should map annotation build -> callset build). 'region' lifts the --region value into the annotation build to find the annotations and lifts the annotations that it found back into the callset build with the inverted chain (chain should map callset build -> annotation build)",
+		},
+		&cli.StringFlag{
+			Name:  "genome-build",
+			Usage: "Genome build that the callset is expected to use (GRCh37 or GRCh38). If provided, the program will warn you when the ##reference or ##contig lines of the vcf header indicate a different build",
+		},
+		&cli.BoolFlag{
+			Name:  "strict",
+			Usage: "Terminate the program on the first malformed record in the vcf stream. By default malformed records are skipped, counted, and their line numbers are logged",
+		},
+		&cli.BoolFlag{
+			Name:  "write-rejects",
+			Usage: "Write the malformed records that were skipped to the file <output>.rejects so that they can be inspected",
+		},
+		&cli.BoolFlag{
+			Name:  "write-unannotated",
+			Usage: "Write the variants that passed the filters but didn't match an annotation to the file <output>.unannotated. The REASON column says if the annotation file has rows at the position under other ids (id_mismatch), if the variant is outside the region that the annotations were read for (region_mismatch), or if there is no annotation row at the position (absent)",
+		},
+		&cli.StringFlag{
+			Name:  "info-cols",
+			Usage: "Comma separated list of INFO keys (such as AC,AF) to write as their own columns after the annotation columns. Values are decoded using the ##INFO lines of the vcf header",
+		},
 		&cli.FloatFlag{
 			Name:  "maf-threshold",
 			Value: 0.1,
-			Usage: "Minor allele frequency cap to filter output so that only variants below this threshold are returned",
+			Usage: "Minor allele frequency cap to filter output so that only variants at or below this threshold (below it with --maf-compare strict) are returned. Scientific notation such as 1e-4 is allowed and 0 keeps only the novel variants (a frequency of 0)",
+		},
+		&cli.StringFlag{
+			Name:  "maf-compare",
+			Value: "inclusive",
+			Usage: "How the frequency is compared with the --maf-threshold. 'inclusive' keeps the variants at or below the threshold and 'strict' keeps the variants below it",
+		},
+		&cli.StringFlag{
+			Name:  "adaptive-maf",
+			Usage: "Pick the MAF threshold from the frequencies of the records in the region instead of using the --maf-threshold. 'rarest:X' keeps the rarest X of the records (such as rarest:5% or rarest:0.05) and 'ac:K' keeps the records that are at most as common as K copies of the allele in the cohort (K divided by the AN). The records are copied to a temporary file in TMPDIR to read them twice. The --maf-threshold is still the upper limit",
+		},
+		&cli.BoolFlag{
+			Name:  "append",
+			Usage: "Add the variants for this region to the end of an existing output file instead of overwriting it. Variants that are already in the file are skipped. The samples, phenotypes, --keep-cols, and --info-cols have to match the existing file. Use merge-outputs afterwards if the file needs to be sorted by position",
+		},
+		&cli.StringFlag{
+			Name:  "output-format",
+			Value: "tsv",
+			Usage: "Format of the pull-variants output. 'tsv' writes the usual tab separated file. 'vcf' writes a vcf with the annotation columns added to the INFO column. 'jsonl' writes one json object per variant. 'parquet' writes the same columns as the tsv into a parquet file. 'sqlite' writes a sqlite database with the variants and their annotations in the records table and the calls of every sample in the genotypes table (record_id, sample, call). 'duckdb' writes a duckdb database with the tables variants, genotypes (the calls of the carriers), annotations, and samples that can be searched with the query command (only in builds with the duckdb tag)",
+		},
+		&cli.StringFlag{
+			Name:  "publish",
+			Usage: "Also publish one json message per qualifying variant (with its carriers and annotations) to a message queue so that other services can subscribe to the results. Give the queue as nats://host:port/subject or kafka://broker1:port,broker2:port/topic",
+		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Value: 64,
+			Usage: "Number of variants that are passed between the parsing, publishing, and writing stages at once. Larger batches mean less waiting between the stages for callsets with many small records",
+		},
+		&cli.IntFlag{
+			Name:  "queue-depth",
+			Usage: "Number of batches that can wait between two stages before the faster stage has to wait for the slower one. The memory used by the queues is roughly batch-size x queue-depth variants per stage. By default (0) 8 batches can wait, or fewer when the CPU quota of the job only leaves 1 to 3 threads for the stages",
+		},
+		&cli.StringFlag{
+			Name:  "vcf-file",
+			Usage: "Filepath to an indexed (bgzipped with a .tbi or .csi index) vcf. pull-variants then runs 'bcftools view -r <region>' on the file itself instead of reading the vcf from standard input. The messages from bcftools go to the log",
+		},
+		&cli.StringFlag{
+			Name:  "bcftools-path",
+			Value: "bcftools",
+			Usage: "Path to the bcftools executable that is run for the --vcf-file. By default bcftools is looked up on the PATH",
+		},
+		&cli.StringFlag{
+			Name:  "samples",
+			Usage: "Comma separated sample ids to read from the vcf. The other sample columns are skipped so the full cohort vcf can be used without subsetting it with bcftools first. Start the list with ^ to read every sample except these ones. With --vcf-file the samples are also passed to bcftools (-s)",
+		},
+		&cli.StringFlag{
+			Name:  "samples-file",
+			Usage: "File with one sample id per line (the format of bcftools view -S) to read from the vcf. The other sample columns are skipped. Start the path with ^ to read every sample except these ones. With --vcf-file the file is also passed to bcftools (-S)",
+		},
+		&cli.StringFlag{
+			Name:  "validate-against-bcftools",
+			Usage: "Filepath to the vcf that is being streamed in. After the run, bcftools view and bcftools query are run on this file with the same region, --maf-threshold, and carrier (GT) filters and the variants and carrier counts are compared with the output. Differences are written to <output>.bcftools_validation.txt and the program exits with an error. bcftools has to be on the PATH",
+		},
+		&cli.StringFlag{
+			Name:  "af-columns",
+			Usage: "Comma separated annotation columns with population frequencies (such as gnomADe_NFE_AF,gnomADg_AFR_AF) that the --maf-threshold is applied to instead of the INFO AF. The columns don't have to be in --keep-cols. Variants without a value in any of the columns are treated as rare",
+		},
+		&cli.StringFlag{
+			Name:  "af-mode",
+			Value: "max",
+			Usage: "How the --af-columns are combined. 'max' uses the largest frequency so a variant has to be rare in every population, 'min' uses the smallest frequency so a variant only has to be rare in one population, and 'pop' uses the first column that has a value so a specific population can fall back to a broader one",
+		},
+		&cli.IntFlag{
+			Name:  "max-ac",
+			Value: 0,
+			Usage: "Only keep the variants where the samples in the output carry at most this many copies of the minor allele. The allele count is computed from the calls instead of the AC in the INFO column. 0 means that there is no limit",
+		},
+		&cli.BoolFlag{
+			Name:  "only-singletons",
+			Usage: "Only keep the variants where a single allele is carried by the samples in the output. This is the same as --max-ac 1",
+		},
+		&cli.BoolFlag{
+			Name:  "restrict-to-pheno",
+			Usage: "Only write the samples that are in the phenotype file. Samples in the vcf header without a phenotype are left out of the output (and don't count as carriers) instead of stopping the program. This is for cohort vcfs that can't be subset with bcftools -S first",
+		},
+		&cli.BoolFlag{
+			Name:  "carrier-vaf",
+			Usage: "Add a CARRIER_VAF column after the INFO columns with the variant allele fraction of each carrier (sample=vaf) from the AF or AD FORMAT fields. This is meant for tumor-only panel vcfs",
+		},
+		&cli.BoolFlag{
+			Name:  "filter-trace",
+			Usage: "Add a FILTER_TRACE column after the INFO columns with the value that each filter saw for the variant, such as REGIONS=overlap;AF=0.002<=0.01;CARRIERS=3;AC=3<=5. This shows how close the variants are to the thresholds so they can be tuned from a single run",
+		},
+		&cli.BoolFlag{
+			Name:  "fold-af",
+			Usage: "Fold the allele frequencies (use 1-AF when the AF is above 0.5) before applying the --maf-threshold so that variants where the alternate is the major allele can't pass the filter. For these variants the samples that carry the reference allele are treated as the carriers. A MINOR_ALLELE column (REF or ALT) is added after the INFO columns",
+		},
+		&cli.StringFlag{
+			Name:  "anno-pos-cols",
+			Usage: "Comma separated names of the coordinate columns for annotation tables that aren't in the VEP layout. Use CHROM,POS for tables with one position per row or CHROM,START,END for intervals. The header line is the first line with these columns. If the table has REF and ALT columns then the variant ids are built from the coordinates and alleles, otherwise the first column has to be an id like chr22_123_A/G. By default the position comes from the VEP Location column",
+		},
+		&cli.StringFlag{
+			Name:  "regions-file",
+			Usage: "BED file of the intervals to pull variants from (such as the exons of a gene panel). Only the vcf records and annotations that overlap one of the intervals are kept. The --region should still cover the intervals because it is used to check the vcf header and to validate the output",
+		},
+		&cli.BoolFlag{
+			Name:  "lenient",
+			Usage: "Warn about the --keep-cols columns that are not in the header of the annotation file and write them as - instead of terminating the program",
+		},
+		&cli.StringFlag{
+			Name:  "max-memory",
+			Usage: "Memory budget for the annotations such as 8G or 500M. If the annotations of the region would use more memory than this then they are moved to a temporary key/value store on the disk (in TMPDIR) so that whole chromosome loads don't run out of memory. Lookups from the disk are slower. By default everything is kept in memory",
+		},
+	}
+
+	// These flags are only for the pull-variants command. The pipeline runs a single region and its
+	// later stages treat every variant that they are handed as a variant that passed the filters
+	pull_only_flags := []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "whole-genome",
+			Usage: "Pull the variants of every contig in the index (or the ##contig lines of the header) of the --vcf-file instead of a single --region. Each contig is pulled by its own pull-variants process into <output>.shards/<contig>/ and the shards are merged into the --output in the order of the contigs. The variants, time, and memory of every contig are written to <output>.shards.tsv",
+		},
+		&cli.IntFlag{
+			Name:  "shard-workers",
+			Usage: "Number of contigs that --whole-genome pulls at the same time. The threads and the memory limit of the run are split between them. By default (0) one contig is pulled for every 2 threads",
+		},
+		&cli.BoolFlag{
+			Name:  "keep-filtered",
+			Usage: "Write the records that fail the --maf-threshold, have no carriers, or are above the --max-ac instead of skipping them. A FILTER_STATUS column is added after the INFO columns with PASS or FAIL: followed by the filters that the record failed (maf, no_carrier, max_ac) so that one run can be filtered with different thresholds later. Records outside of the region or the --regions-file are still skipped",
 		},
 	}
 
 	find_all_carriers_flags := []cli.Flag{
 		&cli.StringFlag{
 			Name:  "sample-exclusion-string",
-			Usage: "List of comma-separated substrings that may indicate if a sample should be excluded from the analysis. This situation can arise if the reference panel controls were kept in the vcf or if invalid samples are present. This code can filter out those individuals by seeing if the substring is present in the ID. This list should not have spaces between the strings",
+			Usage: "List of comma-separated substrings that may indicate if a sample should be excluded from the analysis. This situation can arise if the reference panel controls were kept in the vcf or if invalid samples are present. This code can filter out those individuals by seeing if the substring is present in the ID (ignoring case)",
+		},
+		&cli.BoolFlag{
+			Name:  "counts-only",
+			Usage: "Only write the genotype counts and the allele frequency of each variant. The carrier columns are left out so that the output doesn't have any sample ids, which is needed for results that leave the secure enclave",
+		},
+		&cli.StringFlag{
+			Name:  "samples",
+			Usage: "Comma separated sample ids to read from the vcf. The other sample columns are skipped. Start the list with ^ to read every sample except these ones",
+		},
+		&cli.StringFlag{
+			Name:  "samples-file",
+			Usage: "File with one sample id per line (the format of bcftools view -S) to read from the vcf. The other sample columns are skipped. Start the path with ^ to read every sample except these ones",
+		},
+		&cli.IntFlag{
+			Name:  "max-carriers-listed",
+			Value: 0,
+			Usage: "List at most this many carriers for each variant. The carriers of common variants are sampled (the same carriers are picked every run) and CARRIER_COUNT and CARRIERS_LISTED columns report the total and listed number of carriers. By default (0) every carrier is listed",
 		},
 	}
 
 	pull_sample_variants := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "covariate-file",
+			Usage: "Filepath to a tab separated covariate file (age, sex, ancestry PCs, etc...) with a header line where the first column is the sample id. The selected covariates are appended to each row of the per-sample output",
+		},
+		&cli.StringFlag{
+			Name:  "covariate-cols",
+			Usage: "Comma separated list of columns from the covariate file to add to the output. If this flag is not provided then every column is added",
+		},
+		&cli.BoolFlag{
+			Name:  "variant-tiers",
+			Usage: "Classify the variants into ACMG style tiers (P/LP, VUS-favor-path, VUS, and LB/B) from the ClinVar significance, the consequence, the LOFTEE confidence, and the population frequency. The tiers replace the pathogenic, nonsynonymous, and other columns of the outputs and the tier of each variant is written to <output>_variant_tiers.txt",
+		},
+		&cli.StringFlag{
+			Name:  "loftee-col",
+			Value: "LoF",
+			Usage: "Column with the LOFTEE confidence (HC or LC) of the loss of function variants. This column is used by --variant-tiers and --lof-hc-only",
+		},
+		&cli.StringFlag{
+			Name:  "gene-col",
+			Usage: "Annotation column with the gene of each variant (such as SYMBOL). When this flag is used, every pair of heterozygous variants that a sample has in the same gene is written to <output>_compound_het.txt. Pairs of calls that are phased in the same phase set (the PS FORMAT field) are reported as cis or trans",
+		},
+		&cli.BoolFlag{
+			Name:  "lof-hc-only",
+			Usage: "Only put the stop gained, frameshift, and splice donor/acceptor variants in the LOF category if LOFTEE called them high confidence (HC) in the --loftee-col column",
+		},
+		&cli.StringFlag{
+			Name:  "tier-freq-col",
+			Usage: "Annotation column with the population frequency (such as gnomADe_AF) that the --variant-tiers use for the BA1 (above 5%) and PM2 (at or below 0.1%) frequency evidence. By default the frequency is not used",
+		},
+		&cli.StringFlag{
+			Name:  "strata-cols",
+			Usage: "Comma separated columns (such as sex or ancestry) from the covariate file or the phenotype file to stratify the carrier counts by. The carrier counts, carrier frequency, and alternate allele frequency of each variant in each stratum are written to <output>_strata_summary.txt",
+		},
+		&cli.FloatFlag{
+			Name:  "score-quantile",
+			Usage: "Only report samples whose score is in the top quantile of the scores in the phenotype file (for example 0.99 keeps the top 1%). A SCORE_PERCENTILE column is added to the output. The score is the first --pheno-cols column or the second column of the phenotype file",
+		},
+		&cli.StringFlag{
+			Name:  "pheno-cols",
+			Usage: "Comma separated list of phenotype/score columns to use from the phenotype file. The phenotype file needs a header line when this flag is used. Each column is written to the output and a per-phenotype carrier summary is written to <output>_pheno_summary.txt",
+		},
 		&cli.StringFlag{
 			Name:  "clinvar-col",
 			Usage: "column label of the clinical annotations column. These annotations can come fro VEP or manual annotations.",
@@ -76,6 +308,99 @@ func main() {
 		},
 	}
 
+	// These flags are only used when view-sample-variants is run by itself. The pipeline
+	// command uses the output of the pull-variants step and the pheno-file flag from pull_var_flags
+	view_sample_only_flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "calls-file",
+			Usage: "Filepath to the output of the pull-variants command. The file can be gzipped (ending in .gz) or '-' can be used to read the file from standard input",
+		},
+		&cli.StringFlag{
+			Name:    "pheno-file",
+			Aliases: []string{"p"},
+			Usage:   "Filepath to a tab separated file where the first column are the ids of the samples that we want to pull variants for",
+		},
+	}
+
+	lookup_carrier_flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:     "sample",
+			Aliases:  []string{"s"},
+			Required: true,
+			Usage:    "ID of the sample (as written in the vcf header) to report the variants for",
+		},
+		&cli.StringFlag{
+			Name:    "anno-file",
+			Aliases: []string{"a"},
+			Usage:   "Filepath to a VEP annotation file. If this flag is not provided then the variants are written without annotations",
+		},
+		&cli.StringFlag{
+			Name:    "keep-cols",
+			Aliases: []string{"c"},
+			Usage:   "Columns in the annotation file to keep while it is being read in.",
+		},
+		&cli.StringFlag{
+			Name:    "region",
+			Aliases: []string{"r"},
+			Usage:   "region of the chromosome to report variants for. This regions should have the form chrX:start-end. It is required if an annotation file is provided",
+		},
+		&cli.StringFlag{
+			Name:  "info-cols",
+			Usage: "Comma separated list of INFO keys to write as their own columns in the output",
+		},
+		&cli.FloatFlag{
+			Name:  "maf-threshold",
+			Value: 0.1,
+			Usage: "Minor allele frequency cap to filter output so that only variants at or below this threshold (below it with --maf-compare strict) are returned. Scientific notation such as 1e-4 is allowed and 0 keeps only the novel variants (a frequency of 0)",
+		},
+		&cli.StringFlag{
+			Name:  "maf-compare",
+			Value: "inclusive",
+			Usage: "How the frequency is compared with the --maf-threshold. 'inclusive' keeps the variants at or below the threshold and 'strict' keeps the variants below it",
+		},
+	}
+
+	lookup_variant_flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "vcf-file",
+			Value: "-",
+			Usage: "Filepath to the vcf file. If the file is bgzipped and has a tabix index (<vcf-file>.tbi) then we seek directly to the site. '-' reads the vcf from standard input",
+		},
+		&cli.StringFlag{
+			Name:    "anno-file",
+			Aliases: []string{"a"},
+			Usage:   "Filepath to a VEP annotation file. If this flag is not provided then no annotations are reported",
+		},
+		&cli.StringFlag{
+			Name:    "keep-cols",
+			Aliases: []string{"c"},
+			Usage:   "Columns in the annotation file to report for the variant.",
+		},
+		&cli.StringFlag{
+			Name:    "pheno-file",
+			Aliases: []string{"p"},
+			Usage:   "Filepath to a tab separated file where the first column are the sample ids. The phenotypes of the carriers are reported from this file",
+		},
+		&cli.StringFlag{
+			Name:  "pheno-cols",
+			Usage: "Comma separated list of phenotype columns to report for the carriers. If this flag is not provided then the second column of the phenotype file is used",
+		},
+	}
+
+	summarize_windows_flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:     "region",
+			Aliases:  []string{"r"},
+			Required: true,
+			Usage:    "region of the chromosome to summarize. This regions should have the form chrX:start-end",
+		},
+		&cli.IntFlag{
+			Name:  "window-size",
+			Value: 100000,
+			Usage: "Size of each window in base pairs",
+		},
+	}
+
 	cmd := &cli.Command{
 		Name:  "go-vcf-parser",
 		Usage: "A small go utility to parse vcf files",
@@ -84,8 +409,41 @@ func main() {
 			&cli.IntFlag{
 				Name:    "buffersize",
 				Aliases: []string{"b"},
-				Value:   5012 * 5012,
-				Usage:   "buffersize to use while reading through the streamed input data. Default: 5012**2 bytes",
+				Value:   0,
+				Usage:   "Longest line (in bytes) that can be read from the input data. By default (0) the buffer is sized from the number of samples in the vcf header and a warning is logged if a line gets close to the limit. Set this value if the records have very long INFO or FORMAT fields",
+			},
+			&cli.IntFlag{
+				Name:  "compress-block-size",
+				Value: 1 << 20,
+				Usage: "Size in bytes of the blocks that outputs ending in .gz are compressed in. Each block is compressed by its own worker so larger blocks compress a little better and smaller blocks use less memory",
+			},
+			&cli.IntFlag{
+				Name:  "compress-workers",
+				Usage: "Number of blocks of a .gz output that are compressed at the same time. By default (0) one worker is used for each CPU that the program can use",
+			},
+			&cli.IntFlag{
+				Name:  "decomp-threads",
+				Usage: "Number of blocks of a bgzipped input that are decompressed at the same time. Plain gzip inputs can't be decompressed in parallel so this is the number of blocks that are read ahead. By default (0) one thread is used for each CPU that the program can use",
+			},
+			&cli.IntFlag{
+				Name:  "decomp-blocksize",
+				Value: 1 << 20,
+				Usage: "Size in bytes of the blocks that are read ahead from a plain gzip input. BGZF blocks are always 64KB or smaller",
+			},
+			&cli.StringFlag{
+				Name:  "delimiter",
+				Value: "auto",
+				Usage: "Delimiter of the annotation, phenotype, and samples files. 'auto' detects tab, comma (CSV files exported from Excel), or whitespace from the first line of each file. Use tab, comma, or whitespace to always use that delimiter",
+			},
+			&cli.StringFlag{
+				Name:  "header-keywords",
+				Value: "GRID,IID,FID,ID,SAMPLE,SAMPLE_ID,PERSON_ID",
+				Usage: "Comma separated names of the sample id column. The first line of the samples and phenotype files is treated as a header if its first column is one of these names (ignoring case) or if its second column is not a number",
+			},
+			&cli.StringFlag{
+				Name:  "sample-separator",
+				Value: "_",
+				Usage: "Separator between the sample id and the phenotype in the sample columns of pull-variants outputs from older versions. Newer outputs have ##SAMPLE header lines with the phenotype of each column so the columns are matched on the full sample id",
 			},
 			&cli.StringFlag{
 				Name:  "log-filepath",
@@ -96,39 +454,161 @@ func main() {
 				Name:    "output",
 				Aliases: []string{"o"},
 				Value:   "test_output.txt",
-				Usage:   "Filepath to write the output file to. If running subcommands individually then this should be a full file path with a suffix. If you are running the pipeline command then this value should only be the output prefix.",
+				Usage:   "Filepath to write the output file to. If running subcommands individually then this should be a full file path with a suffix. If you are running the pipeline command then this value should only be the output prefix. The output can also be an s3:// or gs:// url to upload the results directly to object storage and outputs ending in .gz are compressed.",
+			},
+			&cli.StringFlag{
+				Name:  "expected-ploidy",
+				Value: "1,2",
+				Usage: "Comma separated list of the ploidies that calls are expected to have. Calls with any other ploidy (such as those from polyploid or mosaic callers) are reported separately instead of being classified",
+			},
+			&cli.StringFlag{
+				Name:  "carrier-classifier",
+				Value: "hard",
+				Usage: "How a call is classified as a carrier. 'hard' uses the GT, 'dosage:<threshold>' uses the imputed dosage (DS) such as dosage:0.5, and 'quality:gq=<min>,dp=<min>' only accepts GT carriers that meet the genotype quality and read depth minimums",
+			},
+			&cli.StringFlag{
+				Name:  "genotype-class",
+				Value: "any",
+				Usage: "Only count the carriers with this zygosity. 'het' keeps the heterozygous carriers, 'hom-alt' keeps the homozygous alternate carriers (for recessive analyses), and 'any' keeps every carrier of the --carrier-classifier",
+			},
+			&cli.FloatFlag{
+				Name:  "min-vaf",
+				Usage: "Only count the carriers whose variant allele fraction is at least this value. The fraction comes from the AF FORMAT field or is computed from the allele depths (AD). Calls without either field are kept. By default (0) the fraction is not checked",
 			},
 			&cli.BoolFlag{
 				Name:    "verbose",
 				Aliases: []string{"v"},
 				Usage:   "increase the verbosity of the program (use -v or -vv). There are only 3 levels so anything above -vv will just be treated as -vv",
 			},
+			&cli.StringFlag{
+				Name:  "hash-ids",
+				Usage: "Salt used to replace the sample ids in all of the outputs with salted hashes so that results can be shared outside of the trusted environment. The same salt always produces the same hashes",
+			},
+			&cli.DurationFlag{
+				Name:  "stall-timeout",
+				Value: 10 * time.Minute,
+				Usage: "How long a read from standard input can wait for data before a warning says that the process writing the vcf (usually bcftools) may have died or be stuck. The program stops with an error after 3 times this long so that a dead pipe doesn't hang the job until it hits its time limit. Use 0 to wait forever",
+			},
+			&cli.BoolFlag{
+				Name:  "timings",
+				Usage: "Print a table with the wall time and the number of records of each stage (header parsing, annotation loading, vcf scanning, filtering, annotation lookups, and writing) at the end of the run. It shows whether reading the input, the filters, or the annotation join takes the most time",
+			},
+			&cli.StringFlag{
+				Name:  "hash-ids-map",
+				Usage: "Filepath to write the mapping between the sample ids and the hashed ids to. This file can be used to link the hashes back to the sample ids so it should stay in the trusted environment. Only used with --hash-ids",
+			},
+		},
+		// The sample ids are hashed in every output so we turn the hashing on before any of the commands
+		// run. The compression settings are also shared by every output and the delimiter by every input table
+		Before: func(ctx context.Context, cmd *cli.Command) (context.Context, error) {
+			// The messages go to stderr because the commands create their loggers later
+			stderr_logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+			// The CPU and memory limits of the container or the cluster job decide the default threads,
+			// queues, and compression blocks so they have to be applied before those are set
+			limits := resources.DetectLimits()
+			for _, change := range resources.ApplyLimits(limits) {
+				stderr_logger.Info(change)
+			}
+			pipeline.DefaultConfig.QueueDepth = limits.QueueDepth(pipeline.DefaultConfig.QueueDepth)
+			compress_block_size, decomp_block_size := cmd.Int("compress-block-size"), cmd.Int("decomp-blocksize")
+			if !cmd.IsSet("compress-block-size") {
+				compress_block_size = limits.BlockSize(compress_block_size)
+			}
+			if !cmd.IsSet("decomp-blocksize") {
+				decomp_block_size = limits.BlockSize(decomp_block_size)
+			}
+			if compression_err := files.SetCompression(compress_block_size, cmd.Int("compress-workers")); compression_err != nil {
+				return ctx, compression_err
+			}
+			if decompression_err := files.SetDecompression(decomp_block_size, cmd.Int("decomp-threads")); decompression_err != nil {
+				return ctx, decompression_err
+			}
+			if delimiter_err := files.SetDelimiter(cmd.String("delimiter")); delimiter_err != nil {
+				return ctx, delimiter_err
+			}
+			cmd_commands.SetHeaderKeywords(cmd.String("header-keywords"))
+			cmd_commands.SetSampleSeparator(cmd.String("sample-separator"))
+			// The warnings go to stderr because the watch starts before the command creates its logger
+			if stall_err := files.SetStallTimeout(cmd.Duration("stall-timeout"), stderr_logger); stall_err != nil {
+				return ctx, stall_err
+			}
+			if cmd.Bool("timings") {
+				resources.EnableTimings()
+			}
+			if salt := cmd.String("hash-ids"); salt != "" {
+				return ctx, pseudonym.Enable(salt)
+			}
+			return ctx, nil
 		},
 		Commands: []*cli.Command{
 			{
 				Name:  "pull-variants",
 				Usage: "pull variants for the specified region",
-				Flags: pull_var_flags,
+				Flags: append(append([]cli.Flag{}, pull_var_flags...), pull_only_flags...),
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 					// Count the number of times that the verbosity flag was passed
 					verbosity := cmd.Count("verbose")
 					pull_vars_args := internal.UserArgs{
-						AnnoFile:      cmd.String("anno-file"),
-						ColsToKeep:    cmd.String("keep-cols"),
-						PhenoFilePath: cmd.String("pheno-file"),
-						OutputFile:    cmd.String("output"),
-						MafCap:        cmd.Float("maf-threshold"),
-						Buffersize:    cmd.Int("buffersize"),
-						Region:        cmd.String("region"),
+						AnnoFile:                cmd.String("anno-file"),
+						AnnoSources:             cmd.StringSlice("anno-source"),
+						ColsToKeep:              cmd.String("keep-cols"),
+						PhenoFilePath:           cmd.String("pheno-file"),
+						OutputFile:              cmd.String("output"),
+						MafCap:                  cmd.Float("maf-threshold"),
+						MafCompare:              cmd.String("maf-compare"),
+						AdaptiveMaf:             cmd.String("adaptive-maf"),
+						Buffersize:              cmd.Int("buffersize"),
+						Region:                  cmd.String("region"),
+						ContigStyle:             cmd.String("contig-style"),
+						ChainFile:               cmd.String("chain-file"),
+						LiftoverMode:            cmd.String("liftover-mode"),
+						GenomeBuild:             cmd.String("genome-build"),
+						Strict:                  cmd.Bool("strict"),
+						WriteRejects:            cmd.Bool("write-rejects"),
+						WriteUnannotated:        cmd.Bool("write-unannotated"),
+						InfoCols:                cmd.String("info-cols"),
+						ExpectedPloidy:          cmd.String("expected-ploidy"),
+						Classifier:              cmd.String("carrier-classifier"),
+						GenotypeClass:           cmd.String("genotype-class"),
+						MinVAF:                  cmd.Float("min-vaf"),
+						Append:                  cmd.Bool("append"),
+						PublishTarget:           cmd.String("publish"),
+						OutputFormat:            cmd.String("output-format"),
+						BatchSize:               cmd.Int("batch-size"),
+						QueueDepth:              cmd.Int("queue-depth"),
+						ValidateAgainstBcftools: cmd.String("validate-against-bcftools"),
+						VcfFile:                 cmd.String("vcf-file"),
+						BcftoolsPath:            cmd.String("bcftools-path"),
+						Samples:                 cmd.String("samples"),
+						SamplesFile:             cmd.String("samples-file"),
+						MaxMemory:               cmd.String("max-memory"),
+						Lenient:                 cmd.Bool("lenient"),
+						RegionsFile:             cmd.String("regions-file"),
+						AnnoPosCols:             cmd.String("anno-pos-cols"),
+						AfColumns:               cmd.String("af-columns"),
+						AfMode:                  cmd.String("af-mode"),
+						FoldAf:                  cmd.Bool("fold-af"),
+						MaxAC:                   cmd.Int("max-ac"),
+						OnlySingletons:          cmd.Bool("only-singletons"),
+						RestrictToPheno:         cmd.Bool("restrict-to-pheno"),
+						CarrierVAF:              cmd.Bool("carrier-vaf"),
+						FilterTrace:             cmd.Bool("filter-trace"),
+						KeepFiltered:            cmd.Bool("keep-filtered"),
+						WholeGenome:             cmd.Bool("whole-genome"),
+						ShardWorkers:            cmd.Int("shard-workers"),
+						HashIdsMap:              cmd.String("hash-ids-map"),
 					}
 
 					log_output_path := GenerateLogFileName(pull_vars_args.OutputFile, cmd.String("log-filepath"))
 
 					logger := log.CreateLogger(verbosity, log_output_path)
 
-					cmd_commands.PullVariants(pull_vars_args, logger)
-
-					return nil
+					if pull_vars_args.WholeGenome {
+						// The shards are started with the same command line so they get every other flag of the run
+						cmd_commands.PullWholeGenome(pull_vars_args, os.Args[1:], logger)
+						return nil
+					}
+					return cmd_commands.PullVariants(pull_vars_args, logger)
 				},
 			},
 			{
@@ -145,7 +625,7 @@ func main() {
 
 					log.CreateLogger(verbosity, log_output_path)
 
-					cmd_commands.FindAllCarrierCalls(output_path, buffersize, sample_exclusion)
+					cmd_commands.FindAllCarrierCalls(output_path, buffersize, sample_exclusion, cmd.String("expected-ploidy"), cmd.String("carrier-classifier"), cmd.String("genotype-class"), cmd.Float("min-vaf"), cmd.Bool("counts-only"), cmd.Int("max-carriers-listed"), cmd.String("samples"), cmd.String("samples-file"))
 
 					//TODO: Need to update the FindAllCarrierCalls to return an error
 					return nil
@@ -154,7 +634,7 @@ func main() {
 			{
 				Name:  "view-sample-variants",
 				Usage: "grab the variants that samples of interest have. This command uses the output from the pull-variants command",
-				Flags: pull_sample_variants,
+				Flags: append(append([]cli.Flag{}, pull_sample_variants...), view_sample_only_flags...),
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 					verbosity := cmd.Count("verbose")
 
@@ -164,6 +644,19 @@ func main() {
 						OutputFilepath:    cmd.String("output"),
 						ClinvarColumnName: cmd.String("clinvar-col"),
 						ConsequenceCol:    cmd.String("consequence-col"),
+						PhenoCols:         cmd.String("pheno-cols"),
+						ScoreQuantile:     cmd.Float("score-quantile"),
+						CovariateFile:     cmd.String("covariate-file"),
+						CovariateCols:     cmd.String("covariate-cols"),
+						StrataCols:        cmd.String("strata-cols"),
+						VariantTiers:      cmd.Bool("variant-tiers"),
+						LofteeCol:         cmd.String("loftee-col"),
+						LofHCOnly:         cmd.Bool("lof-hc-only"),
+						GeneCol:           cmd.String("gene-col"),
+						TierFreqCol:       cmd.String("tier-freq-col"),
+						Classifier:        cmd.String("carrier-classifier"),
+						GenotypeClass:     cmd.String("genotype-class"),
+						MinVAF:            cmd.Float("min-vaf"),
 						LogfilePath:       cmd.String("log-filepath"),
 					}
 
@@ -177,11 +670,607 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:  "lookup-carrier",
+				Usage: "report every qualifying variant that a single sample carries. Only the column for that sample is parsed. Expects vcf input to be streamed in from bcftools",
+				Flags: lookup_carrier_flags,
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					userArgs := internal.UserArgs{
+						SampleID:   cmd.String("sample"),
+						AnnoFile:   cmd.String("anno-file"),
+						ColsToKeep: cmd.String("keep-cols"),
+						Region:     cmd.String("region"),
+						InfoCols:   cmd.String("info-cols"),
+						MafCap:     cmd.Float("maf-threshold"),
+						MafCompare: cmd.String("maf-compare"),
+						OutputFile: cmd.String("output"),
+						Buffersize: cmd.Int("buffersize"),
+					}
+
+					log_output_path := GenerateLogFileName(userArgs.OutputFile, cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.LookupCarrier(userArgs, logger)
+
+					return nil
+				},
+			},
+			{
+				Name:      "lookup-variant",
+				Usage:     "report the genotype counts, the carriers, and the annotations for a single site given as chrom:pos:ref:alt",
+				ArgsUsage: "chrom:pos:ref:alt",
+				Flags:     lookup_variant_flags,
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					if cmd.Args().Len() != 1 {
+						return fmt.Errorf("lookup-variant expects a single variant of the form chrom:pos:ref:alt but received %d arguments", cmd.Args().Len())
+					}
+
+					userArgs := internal.UserArgs{
+						Variant:       cmd.Args().First(),
+						VcfFile:       cmd.String("vcf-file"),
+						AnnoFile:      cmd.String("anno-file"),
+						ColsToKeep:    cmd.String("keep-cols"),
+						PhenoFilePath: cmd.String("pheno-file"),
+						PhenoCols:     cmd.String("pheno-cols"),
+						Buffersize:    cmd.Int("buffersize"),
+					}
+
+					log_output_path := GenerateLogFileName(cmd.String("output"), cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.LookupVariant(userArgs, logger)
+
+					return nil
+				},
+			},
+			{
+				Name:  "summarize-windows",
+				Usage: "report the variant counts, the mean MAF, and the carrier counts in fixed size windows across the region. Useful for checking the coverage of the callset before the main analysis. Expects vcf input to be streamed in from bcftools",
+				Flags: summarize_windows_flags,
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					userArgs := internal.UserArgs{
+						Region:     cmd.String("region"),
+						WindowSize: cmd.Int("window-size"),
+						OutputFile: cmd.String("output"),
+						Buffersize: cmd.Int("buffersize"),
+					}
+
+					log_output_path := GenerateLogFileName(userArgs.OutputFile, cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.SummarizeWindows(userArgs, logger)
+
+					return nil
+				},
+			},
+			{
+				Name:  "inspect-header",
+				Usage: "print the metadata from the vcf header (fileformat, contigs, FILTER/INFO/FORMAT definitions, and the samples). Only the header is read",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "vcf-file",
+						Value: "-",
+						Usage: "Filepath to the vcf file. The file can be gzipped or '-' can be used to read the vcf from standard input",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					userArgs := internal.UserArgs{
+						VcfFile:    cmd.String("vcf-file"),
+						Buffersize: cmd.Int("buffersize"),
+					}
+
+					log_output_path := GenerateLogFileName(cmd.String("output"), cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.InspectHeader(userArgs, logger)
+
+					return nil
+				},
+			},
+			{
+				Name:  "check-consistency",
+				Usage: "compare the sample ids of the phenotype file, the bcftools samples file, and the vcf header before a run and report how many samples are in each combination of the files. Exits with 1 if pull-variants would stop because a streamed sample has no phenotype or if bcftools view -S would fail. Only the header of the vcf is read",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "pheno-file",
+						Aliases: []string{"p"},
+						Usage:   "Filepath to the phenotype file that will be given to pull-variants",
+					},
+					&cli.StringFlag{
+						Name:  "samples-file",
+						Usage: "Filepath to the samples file that is given to bcftools view -S. Start the path with ^ if the file lists the samples to exclude",
+					},
+					&cli.StringFlag{
+						Name:  "vcf-file",
+						Value: "-",
+						Usage: "Filepath to the vcf file. The file can be gzipped or '-' can be used to read the header from standard input (such as from bcftools view -h)",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					userArgs := internal.UserArgs{
+						PhenoFilePath: cmd.String("pheno-file"),
+						SamplesFile:   cmd.String("samples-file"),
+						VcfFile:       cmd.String("vcf-file"),
+						Buffersize:    cmd.Int("buffersize"),
+					}
+
+					log_output_path := GenerateLogFileName(cmd.String("output"), cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.CheckConsistency(userArgs, logger)
+
+					return nil
+				},
+			},
+			{
+				Name:  "subset",
+				Usage: "write a small anonymized vcf with a random selection of the variants and samples of a vcf so that bug reports can include an input that reproduces the problem. The samples are shuffled and renamed to SAMPLE_1, SAMPLE_2, ... and the ##SAMPLE, ##PEDIGREE, and command line header lines are dropped. The INFO values (like AC and AF) are kept from the full callset so that the frequency filters behave the same way",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "vcf-file",
+						Value: "-",
+						Usage: "Filepath to the vcf file. The file can be gzipped or '-' can be used to read the vcf from standard input",
+					},
+					&cli.IntFlag{
+						Name:  "variants",
+						Value: 100,
+						Usage: "Number of variants to randomly select. The variants are written in the same order as the input",
+					},
+					&cli.IntFlag{
+						Name:  "samples",
+						Value: 10,
+						Usage: "Number of samples to randomly select",
+					},
+					&cli.IntFlag{
+						Name:  "seed",
+						Usage: "Seed for the random selection so that the same subset can be made again. If this flag is not provided then a seed is picked and written to the log",
+					},
+					&cli.BoolFlag{
+						Name:  "gt-only",
+						Usage: "Drop every FORMAT field except the GT (such as AD, DP, GQ, and PL) from the calls and the header",
+					},
+				}, find_all_carriers_flags...),
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					userArgs := internal.UserArgs{
+						VcfFile:         cmd.String("vcf-file"),
+						SampleExclusion: cmd.String("sample-exclusion-string"),
+						OutputFile:      cmd.String("output"),
+						Buffersize:      cmd.Int("buffersize"),
+						SubsetVariants:  cmd.Int("variants"),
+						SubsetSamples:   cmd.Int("samples"),
+						Seed:            cmd.Int("seed"),
+						GTOnly:          cmd.Bool("gt-only"),
+					}
+
+					log_output_path := GenerateLogFileName(userArgs.OutputFile, cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.SubsetVcf(userArgs, logger)
+
+					return nil
+				},
+			},
+			{
+				Name:  "bench",
+				Usage: "time the vcf parser, the annotation reader, and the gzip, pgzip, and bgzf decompression of your own files with different buffer sizes and worker counts. The timings are written to the output, the CPU and heap profiles are written to <output>.cpu.pprof and <output>.heap.pprof, and the fastest settings are recommended at the end",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "vcf-file",
+						Usage: "Filepath to the vcf file to time the parser with. The file can be gzipped",
+					},
+					&cli.StringFlag{
+						Name:    "anno-file",
+						Aliases: []string{"a"},
+						Usage:   "Filepath to a VEP annotation file to time the annotation reader with",
+					},
+					&cli.StringFlag{
+						Name:    "keep-cols",
+						Aliases: []string{"k"},
+						Value:   "Consequence,CLIN_SIG",
+						Usage:   "Columns in the annotation file to keep while it is being read in.",
+					},
+					&cli.StringFlag{
+						Name:    "region",
+						Aliases: []string{"r"},
+						Usage:   "region to read the annotations for. This regions should have the form chrX:start-end. It is required if an annotation file is provided",
+					},
+					&cli.StringFlag{
+						Name:  "buffer-sizes",
+						Value: "1048576,8388608,26214400,51380224",
+						Usage: "Comma separated list of the buffer sizes (in bytes) to time. A buffer that is shorter than the longest line of a file fails and is reported in the output",
+					},
+					&cli.StringFlag{
+						Name:  "workers",
+						Value: fmt.Sprintf("1,2,4,%d", runtime.NumCPU()),
+						Usage: "Comma separated list of the number of threads (GOMAXPROCS) to time. The threads are used by the decompression and the garbage collector",
+					},
+					&cli.IntFlag{
+						Name:  "repeat",
+						Value: 1,
+						Usage: "Number of times to time each combination. Repeats smooth out the noise from the file cache",
+					},
+					&cli.StringFlag{
+						Name:  "decompressors",
+						Value: "gzip,pgzip,bgzf",
+						Usage: "Comma separated list of the readers to time the decompression of the gzipped inputs with. gzip is the standard library reader, pgzip decompresses ahead of the scanner in parallel, and bgzf is the block reader used for the tabix lookups (the input has to be bgzipped). Use 'none' to skip the decompression timings",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					userArgs := internal.UserArgs{
+						VcfFile:            cmd.String("vcf-file"),
+						AnnoFile:           cmd.String("anno-file"),
+						ColsToKeep:         cmd.String("keep-cols"),
+						Region:             cmd.String("region"),
+						OutputFile:         cmd.String("output"),
+						BenchBuffersizes:   cmd.String("buffer-sizes"),
+						BenchWorkers:       cmd.String("workers"),
+						BenchRepeat:        cmd.Int("repeat"),
+						BenchDecompressors: cmd.String("decompressors"),
+					}
+
+					log_output_path := GenerateLogFileName(userArgs.OutputFile, cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.Bench(userArgs, logger)
+
+					return nil
+				},
+			},
+			{
+				Name:  "extract-samples",
+				Usage: "write the sample ids from the vcf header to a file in the format that the --pheno-file flag expects. Every sample is written with a status of NA",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "vcf-file",
+						Value: "-",
+						Usage: "Filepath to the vcf file. The file can be gzipped or '-' can be used to read the vcf from standard input",
+					},
+				}, find_all_carriers_flags...),
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					userArgs := internal.UserArgs{
+						VcfFile:         cmd.String("vcf-file"),
+						SampleExclusion: cmd.String("sample-exclusion-string"),
+						OutputFile:      cmd.String("output"),
+						Buffersize:      cmd.Int("buffersize"),
+					}
+
+					log_output_path := GenerateLogFileName(userArgs.OutputFile, cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.ExtractSamples(userArgs, logger)
+
+					return nil
+				},
+			},
+			{
+				Name:  "compare",
+				Usage: "compare two outputs of the pull-variants command (such as two versions of a callset or two cohorts) and report the shared, unique, and discordant variants for each sample",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "first",
+						Required: true,
+						Usage:    "Filepath to the first pull-variants output. The file can be gzipped",
+					},
+					&cli.StringFlag{
+						Name:     "second",
+						Required: true,
+						Usage:    "Filepath to the second pull-variants output. The file can be gzipped",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					userArgs := internal.UserArgs{
+						FirstFile:  cmd.String("first"),
+						SecondFile: cmd.String("second"),
+						OutputFile: cmd.String("output"),
+						Buffersize: cmd.Int("buffersize"),
+					}
+
+					log_output_path := GenerateLogFileName(userArgs.OutputFile, cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.CompareOutputs(userArgs, logger)
+
+					return nil
+				},
+			},
+			{
+				Name:  "extract-annotations",
+				Usage: "write the annotations of a region as a table with one row per variant without reading a vcf. The values of the transcripts of a variant are collapsed to the distinct values. The region, liftover, and frequency filters work the same way as in pull-variants so the table can be used to build gene reports",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "anno-file",
+						Aliases:  []string{"a"},
+						Required: true,
+						Usage:    "Filepath to the VEP annotation file (or a table with --anno-pos-cols) to read the annotations from",
+					},
+					&cli.StringFlag{
+						Name:     "keep-cols",
+						Aliases:  []string{"c"},
+						Required: true,
+						Usage:    "Columns in the annotation file to write. A column can be renamed in the output with NAME=ALIAS (for example CLIN_SIG=ClinVar)",
+					},
+					&cli.StringFlag{
+						Name:    "region",
+						Aliases: []string{"r"},
+						Usage:   "region to write the annotations of. This regions should have the form chrX:start-end. It is required unless a --regions-file is provided",
+					},
+					&cli.StringFlag{
+						Name:  "regions-file",
+						Usage: "BED file of the intervals (such as the exons of a gene panel) to write the annotations of instead of the --region",
+					},
+					&cli.StringFlag{
+						Name:  "anno-pos-cols",
+						Usage: "Comma separated names of the coordinate columns for annotation tables that aren't in the VEP layout (CHROM,POS or CHROM,START,END). By default the position comes from the VEP Location column",
+					},
+					&cli.StringFlag{
+						Name:  "contig-style",
+						Value: "auto",
+						Usage: "How chromosome names should be written in the output. 'auto' follows the naming of the --region (or the regions file), 'chr' forces names like chr22, and 'no-chr' forces names like 22",
+					},
+					&cli.StringFlag{
+						Name:  "chain-file",
+						Usage: "Filepath to a UCSC chain file used when the annotations are on a different genome build than the region. See --liftover-mode for which direction the chain file should map",
+					},
+					&cli.StringFlag{
+						Name:  "liftover-mode",
+						Value: "annotations",
+						Usage: "How the chain file is used. 'annotations' lifts every annotation into the build of the region and 'region' lifts the --region into the build of the annotations and the annotations that it found back into the build of the region",
+					},
+					&cli.StringFlag{
+						Name:  "af-columns",
+						Usage: "Comma separated annotation columns with population frequencies (such as gnomADe_NFE_AF) that the --maf-threshold is applied to. The columns don't have to be in --keep-cols. Without this flag every annotated variant is written",
+					},
+					&cli.StringFlag{
+						Name:  "af-mode",
+						Value: "max",
+						Usage: "How the --af-columns are combined. 'max' uses the largest frequency, 'min' uses the smallest frequency, and 'pop' uses the first column that has a value",
+					},
+					&cli.BoolFlag{
+						Name:  "fold-af",
+						Usage: "Fold the frequencies of the --af-columns (use 1-AF when the AF is above 0.5) before applying the --maf-threshold",
+					},
+					&cli.FloatFlag{
+						Name:  "maf-threshold",
+						Value: 0.1,
+						Usage: "Frequency cap for the --af-columns. Variants without a frequency in any of the columns are treated as rare. 0 keeps only the variants with a frequency of 0 and the variants without a frequency",
+					},
+					&cli.StringFlag{
+						Name:  "maf-compare",
+						Value: "inclusive",
+						Usage: "How the frequency is compared with the --maf-threshold. 'inclusive' keeps the variants at or below the threshold and 'strict' keeps the variants below it",
+					},
+					&cli.BoolFlag{
+						Name:  "lenient",
+						Usage: "Warn about the --keep-cols columns that are not in the header of the annotation file and write them as - instead of terminating the program",
+					},
+					&cli.StringFlag{
+						Name:  "max-memory",
+						Usage: "Memory budget for the annotations such as 8G or 500M. Annotations past the budget are moved to a temporary key/value store on the disk (in TMPDIR)",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					userArgs := internal.UserArgs{
+						AnnoFile:     cmd.String("anno-file"),
+						ColsToKeep:   cmd.String("keep-cols"),
+						Region:       cmd.String("region"),
+						RegionsFile:  cmd.String("regions-file"),
+						AnnoPosCols:  cmd.String("anno-pos-cols"),
+						ContigStyle:  cmd.String("contig-style"),
+						ChainFile:    cmd.String("chain-file"),
+						LiftoverMode: cmd.String("liftover-mode"),
+						AfColumns:    cmd.String("af-columns"),
+						AfMode:       cmd.String("af-mode"),
+						FoldAf:       cmd.Bool("fold-af"),
+						MafCap:       cmd.Float("maf-threshold"),
+						MafCompare:   cmd.String("maf-compare"),
+						Lenient:      cmd.Bool("lenient"),
+						MaxMemory:    cmd.String("max-memory"),
+						OutputFile:   cmd.String("output"),
+					}
+
+					log_output_path := GenerateLogFileName(userArgs.OutputFile, cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.ExtractAnnotations(userArgs, logger)
+
+					return nil
+				},
+			},
+			{
+				Name:  "compare-cohorts",
+				Usage: "join the variants of a discovery cohort and a replication cohort (each a vcf and a phenotype file) into one table with the carriers and the allele frequency in both cohorts. The REPLICATION column says if the carriers lean towards the cases (or a higher score) in both cohorts",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "discovery-vcf",
+						Required: true,
+						Usage:    "Filepath to the vcf of the discovery cohort. The file can be gzipped or bgzipped and \"-\" reads standard input",
+					},
+					&cli.StringFlag{
+						Name:     "discovery-pheno",
+						Required: true,
+						Usage:    "Phenotype file of the discovery cohort with the sample id in the first column and the case/control status or a score in the second column. Only the samples in this file are read from the vcf",
+					},
+					&cli.StringFlag{
+						Name:     "replication-vcf",
+						Required: true,
+						Usage:    "Filepath to the vcf of the replication cohort",
+					},
+					&cli.StringFlag{
+						Name:     "replication-pheno",
+						Required: true,
+						Usage:    "Phenotype file of the replication cohort. It needs the same kind of phenotype (case/control or score) as the discovery phenotype file",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					userArgs := internal.UserArgs{
+						DiscoveryVcf:     cmd.String("discovery-vcf"),
+						DiscoveryPheno:   cmd.String("discovery-pheno"),
+						ReplicationVcf:   cmd.String("replication-vcf"),
+						ReplicationPheno: cmd.String("replication-pheno"),
+						OutputFile:       cmd.String("output"),
+						Buffersize:       cmd.Int("buffersize"),
+						ExpectedPloidy:   cmd.String("expected-ploidy"),
+						Classifier:       cmd.String("carrier-classifier"),
+						GenotypeClass:    cmd.String("genotype-class"),
+						MinVAF:           cmd.Float("min-vaf"),
+					}
+
+					log_output_path := GenerateLogFileName(userArgs.OutputFile, cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.CompareCohorts(userArgs, logger)
+
+					return nil
+				},
+			},
+			{
+				Name:      "merge-outputs",
+				Usage:     "combine pull-variants outputs that were run on separate regions or chromosomes into one file sorted by position. Variants that are in more than one file are only written once",
+				ArgsUsage: "<output1> <output2> ...",
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					userArgs := internal.UserArgs{
+						InputFiles: cmd.Args().Slice(),
+						OutputFile: cmd.String("output"),
+						Buffersize: cmd.Int("buffersize"),
+					}
+
+					log_output_path := GenerateLogFileName(userArgs.OutputFile, cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.MergeOutputs(userArgs, logger)
+
+					return nil
+				},
+			},
+			{
+				Name:      "query",
+				Usage:     "run a sql query against a duckdb file written by pull-variants with --output-format duckdb and print the results as tab separated text. The tables are variants, genotypes, annotations, and samples. Only available in builds with the duckdb tag (make build-duckdb)",
+				ArgsUsage: "\"<sql>\"",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "db",
+						Required: true,
+						Usage:    "Filepath to the duckdb file",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					if cmd.Args().Len() != 1 {
+						return fmt.Errorf("query expects a single sql statement (in quotes) but received %d arguments", cmd.Args().Len())
+					}
+
+					userArgs := internal.UserArgs{
+						Database: cmd.String("db"),
+						Query:    cmd.Args().First(),
+					}
+
+					log_output_path := GenerateLogFileName(cmd.String("output"), cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.Query(userArgs, logger)
+
+					return nil
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "start an http server that answers carrier queries from a bgzipped and tabix indexed vcf. The routes are GET /region/{chr}:{start}-{end}/carriers and GET /sample/{id}/variants?region={chr}:{start}-{end}",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "vcf-file",
+						Required: true,
+						Usage:    "Filepath to the bgzipped vcf file. The tabix index has to be next to the file (<vcf-file>.tbi)",
+					},
+					&cli.StringFlag{
+						Name:    "anno-file",
+						Aliases: []string{"a"},
+						Usage:   "Filepath to a VEP annotation file. The annotations for a chromosome are read in the first time that the chromosome is queried and then cached",
+					},
+					&cli.StringFlag{
+						Name:    "keep-cols",
+						Aliases: []string{"c"},
+						Usage:   "Columns in the annotation file to return with each variant.",
+					},
+					&cli.StringFlag{
+						Name:  "listen",
+						Value: "127.0.0.1:8080",
+						Usage: "Address for the http server to listen on. Use an empty string to only start the grpc server",
+					},
+					&cli.StringFlag{
+						Name:  "grpc-listen",
+						Usage: "Address for the grpc server to listen on (for example 127.0.0.1:9090). The VariantService in internal/rpc/variants.proto streams the filtered records of a region. The grpc server is only started if this flag is provided",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					verbosity := cmd.Count("verbose")
+
+					userArgs := internal.UserArgs{
+						VcfFile:       cmd.String("vcf-file"),
+						AnnoFile:      cmd.String("anno-file"),
+						ColsToKeep:    cmd.String("keep-cols"),
+						ListenAddress: cmd.String("listen"),
+						GRPCAddress:   cmd.String("grpc-listen"),
+						Buffersize:    cmd.Int("buffersize"),
+					}
+
+					log_output_path := GenerateLogFileName(cmd.String("output"), cmd.String("log-filepath"))
+
+					logger := log.CreateLogger(verbosity, log_output_path)
+
+					cmd_commands.Serve(userArgs, logger)
+
+					return nil
+				},
+			},
 			{
 				Name:  "run-pipeline",
 				Usage: "This subcommand serves as a pipeline that connects the pull-variants subcommand with the view-sample-variants subcommand. So that users can run both together if they wish to. To run this we are assuming that the input sequencing file is being piped through bcftools",
 				// Now we can appened the subcommand flags to this pipeline
-				Flags: append(append([]cli.Flag{}, pull_var_flags...), pull_sample_variants...),
+				Flags: append(append(append([]cli.Flag{}, pull_var_flags...), pull_sample_variants...), &cli.BoolFlag{
+					Name:  "keep-intermediate",
+					Usage: "Also write the output of the pull-variants step to <output prefix>_all_network_id_variants.txt. By default the variants are passed between the steps in memory and this file is not written",
+				}, &cli.StringFlag{
+					Name:  "workflow",
+					Usage: "Filepath to a yaml file that describes the ordered steps of the pipeline and the parameters for each step. When this flag is provided, the steps in the file are run instead of the default pull-variants -> view-sample-variants pipeline",
+				}),
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 
 					start_time := time.Now()
@@ -198,38 +1287,97 @@ func main() {
 
 					logger.Info(fmt.Sprintf("began the analysis at: %s\n", start_time.Format("2006-01-02@15:04:05")))
 
-					final_output_prefix := strings.TrimSuffix(userProvidedOutput, filepath.Ext(userProvidedOutput))
-
-					output_file1 := fmt.Sprintf("%s_all_network_id_variants.txt", final_output_prefix)
-					logger.Info(fmt.Sprintf("Writing the output of step 1 to %s", output_file1))
+					// If the user provided a workflow file then the steps come from that file instead
+					if workflow_file := cmd.String("workflow"); workflow_file != "" {
+						// The steps start from the values of the command line so that the params of a
+						// step only change what the step sets
+						baseArgs := internal.UserArgs{
+							OutputFile:     userProvidedOutput,
+							Buffersize:     cmd.Int("buffersize"),
+							MafCap:         cmd.Float("maf-threshold"),
+							MafCompare:     cmd.String("maf-compare"),
+							AdaptiveMaf:    cmd.String("adaptive-maf"),
+							ExpectedPloidy: cmd.String("expected-ploidy"),
+							Classifier:     cmd.String("carrier-classifier"),
+							GenotypeClass:  cmd.String("genotype-class"),
+							MinVAF:         cmd.Float("min-vaf"),
+							ContigStyle:    cmd.String("contig-style"),
+							LiftoverMode:   cmd.String("liftover-mode"),
+							LogfilePath:    cmd.String("log-filepath"),
+						}
+						cmd_commands.RunWorkflow(workflow_file, baseArgs, logger)
 
-					output_file2 := fmt.Sprintf("%s_cases_in_network_variants.txt", final_output_prefix)
+						logger.Info(fmt.Sprintf("total analysis time: %s\n", time.Since(start_time).String()))
+						return nil
+					}
 
-					logger.Info(fmt.Sprintf("Writing the output of step 2 to %s", output_file2))
+					final_output_prefix := strings.TrimSuffix(userProvidedOutput, filepath.Ext(userProvidedOutput))
 
 					userArgs := internal.UserArgs{
-						AnnoFile:          cmd.String("anno-file"),
-						ColsToKeep:        cmd.String("keep-cols"),
-						OutputFile:        output_file1,
-						MafCap:            cmd.Float("maf-threshold"),
-						Buffersize:        cmd.Int("buffersize"),
-						CallsFile:         output_file1,
-						Region:            cmd.String("region"),
-						PhenoFilePath:     cmd.String("pheno-file"),
-						OutputFilepath:    output_file1,
-						ClinvarColumnName: cmd.String("clinvar-col"),
-						ConsequenceCol:    cmd.String("consequence-col"),
-						LogfilePath:       cmd.String("log-filepath"),
+						AnnoFile:                cmd.String("anno-file"),
+						AnnoSources:             cmd.StringSlice("anno-source"),
+						ColsToKeep:              cmd.String("keep-cols"),
+						OutputFile:              fmt.Sprintf("%s_all_network_id_variants.txt", final_output_prefix),
+						KeepIntermediate:        cmd.Bool("keep-intermediate"),
+						MafCap:                  cmd.Float("maf-threshold"),
+						MafCompare:              cmd.String("maf-compare"),
+						AdaptiveMaf:             cmd.String("adaptive-maf"),
+						Buffersize:              cmd.Int("buffersize"),
+						Region:                  cmd.String("region"),
+						ContigStyle:             cmd.String("contig-style"),
+						ChainFile:               cmd.String("chain-file"),
+						LiftoverMode:            cmd.String("liftover-mode"),
+						GenomeBuild:             cmd.String("genome-build"),
+						Strict:                  cmd.Bool("strict"),
+						WriteRejects:            cmd.Bool("write-rejects"),
+						WriteUnannotated:        cmd.Bool("write-unannotated"),
+						InfoCols:                cmd.String("info-cols"),
+						ExpectedPloidy:          cmd.String("expected-ploidy"),
+						Classifier:              cmd.String("carrier-classifier"),
+						GenotypeClass:           cmd.String("genotype-class"),
+						MinVAF:                  cmd.Float("min-vaf"),
+						Append:                  cmd.Bool("append"),
+						PublishTarget:           cmd.String("publish"),
+						OutputFormat:            cmd.String("output-format"),
+						BatchSize:               cmd.Int("batch-size"),
+						QueueDepth:              cmd.Int("queue-depth"),
+						ValidateAgainstBcftools: cmd.String("validate-against-bcftools"),
+						VcfFile:                 cmd.String("vcf-file"),
+						BcftoolsPath:            cmd.String("bcftools-path"),
+						Samples:                 cmd.String("samples"),
+						SamplesFile:             cmd.String("samples-file"),
+						MaxMemory:               cmd.String("max-memory"),
+						Lenient:                 cmd.Bool("lenient"),
+						RegionsFile:             cmd.String("regions-file"),
+						AnnoPosCols:             cmd.String("anno-pos-cols"),
+						AfColumns:               cmd.String("af-columns"),
+						AfMode:                  cmd.String("af-mode"),
+						FoldAf:                  cmd.Bool("fold-af"),
+						MaxAC:                   cmd.Int("max-ac"),
+						OnlySingletons:          cmd.Bool("only-singletons"),
+						RestrictToPheno:         cmd.Bool("restrict-to-pheno"),
+						CarrierVAF:              cmd.Bool("carrier-vaf"),
+						FilterTrace:             cmd.Bool("filter-trace"),
+						PhenoFilePath:           cmd.String("pheno-file"),
+						OutputFilepath:          fmt.Sprintf("%s_cases_in_network_variants.txt", final_output_prefix),
+						ClinvarColumnName:       cmd.String("clinvar-col"),
+						ConsequenceCol:          cmd.String("consequence-col"),
+						PhenoCols:               cmd.String("pheno-cols"),
+						ScoreQuantile:           cmd.Float("score-quantile"),
+						CovariateFile:           cmd.String("covariate-file"),
+						CovariateCols:           cmd.String("covariate-cols"),
+						StrataCols:              cmd.String("strata-cols"),
+						VariantTiers:            cmd.Bool("variant-tiers"),
+						LofteeCol:               cmd.String("loftee-col"),
+						LofHCOnly:               cmd.Bool("lof-hc-only"),
+						GeneCol:                 cmd.String("gene-col"),
+						TierFreqCol:             cmd.String("tier-freq-col"),
+						LogfilePath:             cmd.String("log-filepath"),
 					}
 
-					logger.Info(fmt.Sprintf("Reading in annotations for the region %s and pulling variants for the samples in the samples file, %s\n", userArgs.Region, userArgs.PhenoFilePath))
-
-					cmd_commands.PullVariants(userArgs, logger)
-
-					//lest make sure that the output file is right now
-					userArgs.OutputFilepath = output_file2
-
-					cmd_commands.FindSampleVariants(userArgs, logger)
+					if pipeline_err := cmd_commands.RunPipeline(userArgs, logger); pipeline_err != nil {
+						return pipeline_err
+					}
 
 					end_time := time.Now()
 
@@ -244,7 +1392,58 @@ func main() {
 			},
 		},
 	}
+	// The values of these flags are left out of the run manifest. With the salt anyone could
+	// recompute the hashed ids from a list of sample ids
+	secretFlags := []string{"hash-ids", "hash-ids-map"}
+	// Every command reports the resources that it used and checksums the files that it wrote and
+	// records them in the run manifest once it finishes. Commands that only print to the terminal
+	// don't track any outputs so no manifest is written
+	for _, subcommand := range cmd.Commands {
+		subcommand.After = func(ctx context.Context, cmd *cli.Command) error {
+			if map_file := cmd.String("hash-ids-map"); map_file != "" {
+				if map_err := pseudonym.WriteMapping(map_file); map_err != nil {
+					return map_err
+				}
+			}
+			// The usage is collected before the outputs are checksummed so that reading them back
+			// doesn't count towards the bytes that the command read
+			usage := resources.Collect()
+			// The report goes to stderr because commands like query and lookup-variant write their
+			// results to stdout
+			logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+			for _, line := range usage.Report() {
+				logger.Info(line)
+			}
+			if resources.TimingsEnabled() {
+				table := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+				for _, row := range usage.TimingsTable() {
+					row.WriteTo(table)
+				}
+				table.Flush()
+			}
+			// A vcf stream that stopped early makes outputs that look complete so the run has to
+			// fail after the manifest records what happened
+			var run_err error
+			if input, found := manifest.InputStatus(); found && !input.Complete {
+				run_err = fmt.Errorf("the vcf stream from %s was incomplete so the outputs are incomplete too. %s", input.Source, input.Error)
+			}
+			// The subscribers of --publish would be missing the variants that couldn't be delivered
+			if status, found := manifest.PublishStatus(); found {
+				run_err = errors.Join(run_err, status.Err())
+			}
+			if len(manifest.Tracked()) == 0 {
+				return run_err
+			}
+			manifest_path := ManifestPath(cmd.String("output"))
+			if _, manifest_err := manifest.Write(manifest_path, cmd.Name, manifest.RedactArgs(os.Args, secretFlags...), run_started, usage); manifest_err != nil {
+				return fmt.Errorf("unable to write the run manifest %s: %w", manifest_path, manifest_err)
+			}
+			return run_err
+		}
+	}
+
 	if err := cmd.Run(context.Background(), os.Args); err != nil {
 		fmt.Println(err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,277 @@
+package vcf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go-phers-parser/internal/genotype"
+)
+
+// GenotypeClassifier decides whether a sample call makes the sample a carrier of the alternate
+// allele. The format is the FORMAT column of the record so that the classifier can find fields
+// like DS or GQ in the call. Research groups can implement this interface to use their own logic
+type GenotypeClassifier interface {
+	IsCarrier(format string, call string) bool
+}
+
+// FormatValue returns the value of a FORMAT field from a sample call. The second value is false
+// if the field isn't in the FORMAT column, if the call was truncated, or if the value is missing
+func FormatValue(format string, call string, key string) (string, bool) {
+	return genotype.FormatValue(format, call, key)
+}
+
+// HardCall uses the GT of the call. Any alternate allele makes the sample a carrier
+type HardCall struct{}
+
+func (HardCall) IsCarrier(format string, call string) bool {
+	return CallHasAlt(call)
+}
+
+// Dosage uses the expected alternate allele dosage (DS) of imputed calls. Multi-allelic records
+// have a dosage for each alternate allele and these are added together. Calls without a dosage
+// fall back to the GT so that genotyped sites in a merged callset are still classified. With
+// Reference the dosage of the reference allele (the ploidy of the GT minus the alternate dosage)
+// is used instead for the records where the reference is the minor allele
+type Dosage struct {
+	Threshold float64
+	Reference bool
+}
+
+func (classifier Dosage) IsCarrier(format string, call string) bool {
+	value, found := FormatValue(format, call, "DS")
+	if !found {
+		if classifier.Reference {
+			return CallHasRef(call)
+		}
+		return CallHasAlt(call)
+	}
+	total := 0.0
+	for _, dosage := range strings.Split(value, ",") {
+		parsed, err := strconv.ParseFloat(dosage, 64)
+		if err != nil {
+			return false
+		}
+		total += parsed
+	}
+	if classifier.Reference {
+		// Imputed calls are diploid unless the GT says otherwise
+		ploidy := CallPloidy(call)
+		if ploidy == 0 {
+			ploidy = 2
+		}
+		total = float64(ploidy) - total
+	}
+	return total >= classifier.Threshold
+}
+
+// MinorReference is used for the records where the alternate allele is the major allele (an AF
+// above 0.5). The reference is then the minor allele so any reference allele in the GT makes the
+// sample a carrier of the minor allele. Use ForMinorReference to keep the rest of a classifier
+type MinorReference struct{}
+
+func (MinorReference) IsCarrier(format string, call string) bool {
+	return CallHasRef(call)
+}
+
+// ForMinorReference returns the classifier for the records where the reference is the minor allele.
+// The allele test at the bottom of the classifier looks for the reference allele instead of an
+// alternate allele and the decorators are kept. The zygosity of a GenotypeClassFilter is relative
+// to the minor allele so hom-alt keeps the homozygous reference calls, and MinVAF checks the fraction
+// of the reference allele. A classifier that isn't from this package can't be turned around so it is
+// replaced by MinorReference
+func ForMinorReference(classifier GenotypeClassifier) GenotypeClassifier {
+	switch base := classifier.(type) {
+	case HardCall, MinorReference:
+		return MinorReference{}
+	case Dosage:
+		base.Reference = !base.Reference
+		return base
+	case QualityAware:
+		base.Base = ForMinorReference(base.Base)
+		return base
+	case GenotypeClassFilter:
+		base.Base = ForMinorReference(base.Base)
+		switch base.Class {
+		case HomAlt:
+			base.Class = HomRef
+		case HomRef:
+			base.Class = HomAlt
+		}
+		return base
+	case MinVAF:
+		base.Base = ForMinorReference(base.Base)
+		base.Reference = !base.Reference
+		return base
+	default:
+		return MinorReference{}
+	}
+}
+
+// QualityAware only accepts a carrier call if the genotype quality (GQ) and the read depth (DP)
+// meet the minimums. Calls that are missing a field that has a minimum are not counted as carriers
+type QualityAware struct {
+	Base  GenotypeClassifier
+	MinGQ int
+	MinDP int
+}
+
+func (classifier QualityAware) IsCarrier(format string, call string) bool {
+	if !classifier.Base.IsCarrier(format, call) {
+		return false
+	}
+	for _, requirement := range []struct {
+		key     string
+		minimum int
+	}{{"GQ", classifier.MinGQ}, {"DP", classifier.MinDP}} {
+		if requirement.minimum <= 0 {
+			continue
+		}
+		value, found := FormatValue(format, call, requirement.key)
+		if !found {
+			return false
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < float64(requirement.minimum) {
+			return false
+		}
+	}
+	return true
+}
+
+// GenotypeClassFilter only accepts the carriers of the base classifier whose GT has the zygosity
+// of the class. Recessive analyses use this to keep only the homozygous alternate carriers
+type GenotypeClassFilter struct {
+	Base  GenotypeClassifier
+	Class GenotypeClass
+}
+
+func (classifier GenotypeClassFilter) IsCarrier(format string, call string) bool {
+	return classifier.Base.IsCarrier(format, call) && ParseGenotype(call).Class() == classifier.Class
+}
+
+// MinVAF only accepts the carriers of the base classifier whose variant allele fraction is at least
+// the minimum. Tumor-only panels call low fraction artifacts so these are dropped. Calls without
+// an AF or AD FORMAT field can't be checked so they are kept. With Reference the fraction of the
+// reference allele is checked for the records where the reference is the minor allele
+type MinVAF struct {
+	Base      GenotypeClassifier
+	Minimum   float64
+	Reference bool
+}
+
+func (classifier MinVAF) IsCarrier(format string, call string) bool {
+	if !classifier.Base.IsCarrier(format, call) {
+		return false
+	}
+	vaf, found := CallVAF(format, call)
+	if found && classifier.Reference {
+		vaf = 1 - vaf
+	}
+	return !found || vaf >= classifier.Minimum
+}
+
+// CallVAF returns the variant allele fraction of a call. The AF FORMAT field of somatic callers is
+// used if it is there. Otherwise the fraction is computed from the allele depths (AD). Multi-allelic
+// records add up the alternate alleles. The second value is false if neither field can be used
+func CallVAF(format string, call string) (float64, bool) {
+	if value, found := FormatValue(format, call, "AF"); found {
+		total := 0.0
+		for _, fraction := range strings.Split(value, ",") {
+			parsed, err := strconv.ParseFloat(fraction, 64)
+			if err != nil {
+				return 0, false
+			}
+			total += parsed
+		}
+		return total, true
+	}
+
+	value, found := FormatValue(format, call, "AD")
+	if !found {
+		return 0, false
+	}
+	depths := strings.Split(value, ",")
+	if len(depths) < 2 {
+		return 0, false
+	}
+	alt_depth, total_depth := 0, 0
+	for indx, depth := range depths {
+		parsed, err := strconv.Atoi(depth)
+		if err != nil {
+			return 0, false
+		}
+		total_depth += parsed
+		if indx > 0 {
+			alt_depth += parsed
+		}
+	}
+	if total_depth == 0 {
+		return 0, false
+	}
+	return float64(alt_depth) / float64(total_depth), true
+}
+
+// WithGenotypeClass restricts the classifier to a zygosity from the value of the --genotype-class flag:
+//
+//	any       every carrier of the classifier (the default)
+//	het       carriers with a heterozygous GT
+//	hom-alt   carriers with a homozygous alternate GT
+func WithGenotypeClass(classifier GenotypeClassifier, genotype_class string) (GenotypeClassifier, error) {
+	switch genotype_class {
+	case "", "any":
+		return classifier, nil
+	case "het":
+		return GenotypeClassFilter{Base: classifier, Class: Het}, nil
+	case "hom-alt":
+		return GenotypeClassFilter{Base: classifier, Class: HomAlt}, nil
+	default:
+		return nil, fmt.Errorf("the genotype class %s is not recognized. Allowed values are het, hom-alt, or any", genotype_class)
+	}
+}
+
+// ParseClassifier creates a classifier from the value of the --carrier-classifier flag:
+//
+//	hard                  any alternate allele in the GT (the default)
+//	dosage:0.5            DS >= 0.5
+//	quality:gq=20,dp=10   the GT has an alternate allele and GQ >= 20 and DP >= 10
+func ParseClassifier(spec string) (GenotypeClassifier, error) {
+	name, params, _ := strings.Cut(spec, ":")
+	switch name {
+	case "", "hard":
+		return HardCall{}, nil
+	case "dosage":
+		threshold := 0.5
+		if params != "" {
+			parsed, err := strconv.ParseFloat(params, 64)
+			if err != nil {
+				return nil, fmt.Errorf("the dosage threshold %s is not a number", params)
+			}
+			threshold = parsed
+		}
+		return Dosage{Threshold: threshold}, nil
+	case "quality":
+		classifier := QualityAware{Base: HardCall{}}
+		for _, param := range strings.Split(params, ",") {
+			if param == "" {
+				continue
+			}
+			key, value, _ := strings.Cut(param, "=")
+			minimum, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("the minimum %s for the quality classifier should be an integer", param)
+			}
+			switch strings.ToLower(key) {
+			case "gq":
+				classifier.MinGQ = minimum
+			case "dp":
+				classifier.MinDP = minimum
+			default:
+				return nil, fmt.Errorf("the quality classifier only accepts gq and dp but received %s", key)
+			}
+		}
+		return classifier, nil
+	default:
+		return nil, fmt.Errorf("the carrier classifier %s is not recognized. Allowed values are hard, dosage:<threshold>, or quality:gq=<min>,dp=<min>", spec)
+	}
+}
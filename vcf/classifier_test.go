@@ -0,0 +1,46 @@
+package vcf
+
+import "testing"
+
+func TestForMinorReference(t *testing.T) {
+	hom_alt, _ := WithGenotypeClass(HardCall{}, "hom-alt")
+	het, _ := WithGenotypeClass(QualityAware{Base: HardCall{}, MinGQ: 20}, "het")
+
+	cases := []struct {
+		name       string
+		classifier GenotypeClassifier
+		format     string
+		call       string
+		expected   bool
+	}{
+		{"hard ref carrier", HardCall{}, "GT", "0/1", true},
+		{"hard hom alt has no minor allele", HardCall{}, "GT", "1/1", false},
+		// hom-alt is homozygous for the minor allele so it keeps the homozygous reference calls
+		{"hom-alt keeps 0/0", hom_alt, "GT", "0/0", true},
+		{"hom-alt drops 0/1", hom_alt, "GT", "0/1", false},
+		{"hom-alt drops 1/1", hom_alt, "GT", "1/1", false},
+		// The quality minimums still apply to the folded records
+		{"het with quality", het, "GT:GQ", "0/1:30", true},
+		{"het with low quality", het, "GT:GQ", "0/1:10", false},
+		{"het drops 0/0", het, "GT:GQ", "0/0:30", false},
+		// The reference dosage is the ploidy minus the alternate dosage
+		{"dosage of the reference", Dosage{Threshold: 0.5}, "GT:DS", "1/1:1.6", false},
+		{"dosage of the reference carrier", Dosage{Threshold: 0.5}, "GT:DS", "0/1:1.2", true},
+		{"dosage without DS", Dosage{Threshold: 0.5}, "GT", "0/1", true},
+		// The fraction of the reference allele is checked
+		{"min vaf of the reference", MinVAF{Base: HardCall{}, Minimum: 0.3}, "GT:AD", "0/1:2,18", false},
+		{"min vaf of the reference carrier", MinVAF{Base: HardCall{}, Minimum: 0.3}, "GT:AD", "0/1:10,10", true},
+	}
+	for _, test_case := range cases {
+		folded := ForMinorReference(test_case.classifier)
+		if is_carrier := folded.IsCarrier(test_case.format, test_case.call); is_carrier != test_case.expected {
+			t.Errorf("%s: expected the folded classifier to return %t for %s but got %t", test_case.name, test_case.expected, test_case.call, is_carrier)
+		}
+	}
+
+	// Folding twice gives back the original allele test
+	twice := ForMinorReference(ForMinorReference(MinVAF{Base: Dosage{Threshold: 0.5}, Minimum: 0.2}))
+	if twice != (MinVAF{Base: Dosage{Threshold: 0.5}, Minimum: 0.2}) {
+		t.Errorf("expected folding twice to give back the classifier but got %+v", twice)
+	}
+}
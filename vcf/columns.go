@@ -0,0 +1,71 @@
+package vcf
+
+import (
+	"slices"
+	"strings"
+)
+
+// ColumnSelector pulls the 9 fixed columns and a few of the sample columns out of a record without
+// splitting the other columns. For a small panel of samples from a callset with hundreds of
+// thousands of samples most of the time would otherwise go to splitting calls that are never read
+type ColumnSelector struct {
+	columns  []int // the requested columns in the order they are returned
+	wanted   []int // the requested columns sorted without duplicates so the line is read once
+	position []int // where each of the requested columns is in wanted
+	values   []string
+}
+
+// NewColumnSelector selects the columns (0-based and including the 9 fixed columns) in the order
+// that they are given. A column can be given more than once
+func NewColumnSelector(columns []int) *ColumnSelector {
+	wanted := slices.Clone(columns)
+	slices.Sort(wanted)
+	wanted = slices.Compact(wanted)
+
+	position := make([]int, len(columns))
+	for indx, column := range columns {
+		position[indx], _ = slices.BinarySearch(wanted, column)
+	}
+	return &ColumnSelector{columns: columns, wanted: wanted, position: position, values: make([]string, len(wanted))}
+}
+
+// Select returns the fixed columns followed by the selected sample columns and the number of columns
+// in the line. The fields are only returned if the line has every one of the columns. The returned
+// slice is new for every line so it can be kept after the next line is selected
+func (selector *ColumnSelector) Select(line string) ([]string, int, bool) {
+	fields := make([]string, 9, 9+len(selector.columns))
+	column := 0
+	rest := line
+	next := 0 // the next column of wanted to look for
+	for {
+		tab_indx := strings.IndexByte(rest, '\t')
+		field := rest
+		if tab_indx != -1 {
+			field = rest[:tab_indx]
+		}
+		if column < 9 {
+			fields[column] = field
+		} else if next < len(selector.wanted) && selector.wanted[next] == column {
+			selector.values[next] = field
+			next++
+		}
+		if tab_indx == -1 {
+			break
+		}
+		rest = rest[tab_indx+1:]
+		column++
+		// Once the last wanted column was found the remaining tabs only have to be counted
+		if column >= 9 && next == len(selector.wanted) {
+			column += strings.Count(rest, "\t")
+			break
+		}
+	}
+	column_count := column + 1
+	if column_count < 9 || next < len(selector.wanted) {
+		return nil, column_count, false
+	}
+	for _, position := range selector.position {
+		fields = append(fields, selector.values[position])
+	}
+	return fields, column_count, true
+}
@@ -0,0 +1,58 @@
+package vcf
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestColumnSelector(t *testing.T) {
+	fixed := "chr1\t100\trs1\tA\tG\t.\tPASS\tAF=0.1\tGT"
+	line := fixed + "\t0/0\t0/1\t1/1\t./."
+
+	cases := []struct {
+		name     string
+		columns  []int
+		expected []string
+	}{
+		{"in order", []int{10, 12}, []string{"0/1", "./."}},
+		// The fields come back in the requested order even if the columns aren't sorted
+		{"out of order", []int{11, 9, 11}, []string{"1/1", "0/0", "1/1"}},
+		{"no samples", nil, nil},
+	}
+	for _, test_case := range cases {
+		fields, column_count, selected := NewColumnSelector(test_case.columns).Select(line)
+		if !selected || column_count != 13 {
+			t.Fatalf("%s: selected=%t with %d columns", test_case.name, selected, column_count)
+		}
+		if !slices.Equal(fields[:9], strings.Split(fixed, "\t")) || !slices.Equal(fields[9:], test_case.expected) {
+			t.Errorf("%s: selected %q", test_case.name, fields)
+		}
+	}
+
+	// A truncated record doesn't have the selected column
+	if _, column_count, selected := NewColumnSelector([]int{12}).Select(fixed + "\t0/0"); selected || column_count != 10 {
+		t.Errorf("expected the truncated record with 10 columns to fail but got selected=%t with %d columns", selected, column_count)
+	}
+}
+
+func BenchmarkColumnSelector(b *testing.B) {
+	calls := make([]string, 100000)
+	for indx := range calls {
+		calls[indx] = fmt.Sprintf("0/%d:35:99", indx%2)
+	}
+	line := "chr1\t100\trs1\tA\tG\t.\tPASS\tAF=0.1\tGT:DP:GQ\t" + strings.Join(calls, "\t")
+
+	b.Run("split", func(b *testing.B) {
+		for range b.N {
+			strings.Split(line, "\t")
+		}
+	})
+	b.Run("select", func(b *testing.B) {
+		selector := NewColumnSelector([]int{20, 5000, 70000})
+		for range b.N {
+			selector.Select(line)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package vcf
+
+import (
+	"go-phers-parser/internal/genotype"
+	"go-phers-parser/internal/model"
+)
+
+// The record and genotype types live in the shared model so that the commands and the library
+// use the same representation of a variant and its calls
+type (
+	Variant       = model.Variant
+	Genotype      = model.Genotype
+	GenotypeClass = model.GenotypeClass
+)
+
+const (
+	MissingAllele = model.MissingAllele
+	HomRef        = model.HomRef
+	Het           = model.Het
+	HomAlt        = model.HomAlt
+	Missing       = model.Missing
+	Other         = model.Other
+)
+
+// ParseVariant builds a Variant from the tab separated columns of a record
+func ParseVariant(columns []string) (*Variant, error) {
+	return model.ParseVariant(columns)
+}
+
+// ParseGenotype parses a sample call. The GT has to be the first FORMAT field so anything
+// after the first ':' is ignored. Use model.ParseGenotype to keep the other FORMAT values
+func ParseGenotype(call string) Genotype {
+	return model.ParseGenotype(nil, call)
+}
+
+// ParsePloidyList parses a comma separated list of ploidies like "1,2" into a set
+func ParsePloidyList(value string) (map[int]bool, error) {
+	return genotype.ParsePloidyList(value)
+}
+
+// CallHasAlt reports whether a sample call has an alternate allele. This function gives the
+// same answer as ParseGenotype(call).HasAlt() but it doesn't allocate so it can be used in the
+// hot loops that look at every call in a record
+func CallHasAlt(call string) bool {
+	return genotype.HasAlt(call)
+}
+
+// CallHasRef reports whether a sample call has a reference allele. It is the counterpart of
+// CallHasAlt for the records where the reference is the minor allele
+func CallHasRef(call string) bool {
+	return genotype.HasRef(call)
+}
+
+// CallAlleleCounts returns the number of alternate and reference alleles in a sample call.
+// Missing alleles aren't counted. Like CallHasAlt it doesn't allocate
+func CallAlleleCounts(call string) (int, int) {
+	return genotype.AlleleCounts(call)
+}
+
+// CallPloidy returns the number of alleles in a sample call without parsing the alleles
+func CallPloidy(call string) int {
+	return genotype.Ploidy(call)
+}
+
+// CallAlleles returns the allele indices of a sample call. Missing alleles are MissingAllele
+func CallAlleles(call string) []int {
+	return genotype.Alleles(call)
+}
+
+// CallIsPhased reports whether the alleles of a sample call are phased
+func CallIsPhased(call string) bool {
+	return genotype.IsPhased(call)
+}
+
+// CallClass returns the zygosity of a sample call
+func CallClass(call string) GenotypeClass {
+	return genotype.Class(call)
+}
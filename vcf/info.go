@@ -0,0 +1,240 @@
+// Package vcf is the library surface of the parser. It exposes the types and decoders
+// that the subcommands use so that other Go programs can reuse them
+package vcf
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go-phers-parser/internal/header"
+)
+
+// Metadata is the information collected from the "##" lines of a vcf header
+type Metadata = header.Metadata
+
+// FieldDefinition is the definition of an INFO or FORMAT field from the vcf header
+type FieldDefinition = header.FieldDefinition
+
+// InfoField is a single key from the INFO column. The Raw values have already been split on
+// commas (and percent decoded for VCFv4.3+ files). Flags have no values
+type InfoField struct {
+	ID     string
+	Number string
+	Type   string
+	Raw    []string
+}
+
+// Info is the decoded INFO column. The fields are kept in the same order as the record
+type Info struct {
+	Fields   []InfoField
+	altCount int // the number of alternate alleles in the ALT column of the record
+}
+
+// Get returns the field with the given ID
+func (info Info) Get(id string) (InfoField, bool) {
+	for _, field := range info.Fields {
+		if field.ID == id {
+			return field, true
+		}
+	}
+	return InfoField{}, false
+}
+
+// IsMissing reports whether a value is the VCF missing value
+func IsMissing(value string) bool {
+	return value == "" || value == "."
+}
+
+// Floats converts the values into floats. Missing values are returned as NaN
+func (field InfoField) Floats() ([]float64, error) {
+	values := make([]float64, len(field.Raw))
+	for indx, raw := range field.Raw {
+		if IsMissing(raw) {
+			values[indx] = math.NaN()
+			continue
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert the value %s of the INFO field %s into a float: %w", raw, field.ID, err)
+		}
+		values[indx] = value
+	}
+	return values, nil
+}
+
+// missingFrequencies are the spellings of a missing frequency that other tools write in place of the
+// VCF missing value
+var missingFrequencies = []string{"NA", "-"}
+
+// AlleleFrequencies converts the values into frequencies without failing on the values that other
+// tools write in place of a number. Missing values (such as . or NA) are returned as NaN. Values that
+// were percent encoded by a tool that ignored the version of the header (such as 0.01%2C0.02) are
+// decoded and split on the decoded commas. Values that still can't be parsed are returned as NaN and
+// counted in the second value so the caller can report them instead of dropping the record
+func (field InfoField) AlleleFrequencies() ([]float64, int) {
+	values := make([]float64, 0, len(field.Raw))
+	unparseable := 0
+	for _, raw := range field.Raw {
+		for _, item := range strings.Split(header.PercentDecode(raw), ",") {
+			item = strings.TrimSpace(item)
+			if IsMissing(item) || slices.ContainsFunc(missingFrequencies, func(missing string) bool { return strings.EqualFold(item, missing) }) {
+				values = append(values, math.NaN())
+				continue
+			}
+			value, err := strconv.ParseFloat(item, 64)
+			if err != nil {
+				value = math.NaN()
+				unparseable++
+			}
+			values = append(values, value)
+		}
+	}
+	return values, unparseable
+}
+
+// Ints converts the values into integers. Missing values are returned as math.MinInt
+func (field InfoField) Ints() ([]int, error) {
+	values := make([]int, len(field.Raw))
+	for indx, raw := range field.Raw {
+		if IsMissing(raw) {
+			values[indx] = math.MinInt
+			continue
+		}
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert the value %s of the INFO field %s into an integer: %w", raw, field.ID, err)
+		}
+		values[indx] = value
+	}
+	return values, nil
+}
+
+// ForAllele returns the value for the alternate allele with the 1-based index alt_indx. Number=A fields
+// don't have a value for the reference so the index is shifted. Number=R fields have the reference
+// value first. For any other Number the whole value is returned because it isn't allele specific
+func (field InfoField) ForAllele(alt_indx int) (string, bool) {
+	var indx int
+	switch field.Number {
+	case "A":
+		indx = alt_indx - 1
+	case "R":
+		indx = alt_indx
+	default:
+		return strings.Join(field.Raw, ","), true
+	}
+	if indx < 0 || indx >= len(field.Raw) {
+		return "", false
+	}
+	return field.Raw[indx], true
+}
+
+// String formats the field the same way as it would be written in the INFO column
+func (field InfoField) String() string {
+	if field.Type == "Flag" {
+		return field.ID
+	}
+	return strings.Join(field.Raw, ",")
+}
+
+// GenotypeCount is the number of possible genotypes for a number of alleles (including the
+// reference) and a ploidy. This value is the expected number of values for Number=G fields
+func GenotypeCount(allele_count int, ploidy int) int {
+	// The number of multisets of size ploidy from allele_count alleles is (n+p-1) choose p
+	count := 1
+	for i := 1; i <= ploidy; i++ {
+		count = count * (allele_count + i - 1) / i
+	}
+	return count
+}
+
+// InfoDecoder uses the ##INFO lines of the header to decode the INFO column of each record
+type InfoDecoder struct {
+	definitions    map[string]FieldDefinition
+	percentEncoded bool
+}
+
+// NewInfoDecoder creates a decoder from the vcf header metadata
+func NewInfoDecoder(meta *Metadata) *InfoDecoder {
+	return &InfoDecoder{definitions: meta.Info, percentEncoded: meta.PercentEncoded()}
+}
+
+// expectedCount returns the number of values that a field should have. The returned bool is false if
+// the number of values can't be known ahead of time (such as Number=.). Number=G fields depend on the
+// ploidy of the calls, which the INFO column doesn't have, so they aren't checked either
+func expectedCount(number string, alt_count int) (int, bool) {
+	switch number {
+	case "A":
+		return alt_count, true
+	case "R":
+		return alt_count + 1, true
+	case "G", ".", "":
+		return 0, false
+	default:
+		count, err := strconv.Atoi(number)
+		return count, err == nil
+	}
+}
+
+// Decode splits the INFO column into fields. The alt_count is the number of alternate alleles in
+// the ALT column. The number of values isn't checked here because a field that the caller never
+// reads shouldn't fail the record. Use Check for the fields that are used
+func (decoder *InfoDecoder) Decode(info_col string, alt_count int) (Info, error) {
+	info := Info{altCount: alt_count}
+
+	if IsMissing(info_col) {
+		return info, nil
+	}
+
+	for _, entry := range strings.Split(info_col, ";") {
+		if entry == "" {
+			continue
+		}
+
+		key, value, has_value := strings.Cut(entry, "=")
+
+		definition, defined := decoder.definitions[key]
+		field := InfoField{ID: key, Number: definition.Number, Type: definition.Type}
+
+		if !defined {
+			// Fields without a header definition are treated as strings or flags
+			field.Type = "String"
+			if !has_value {
+				field.Type = "Flag"
+			}
+		}
+
+		if has_value {
+			field.Raw = strings.Split(value, ",")
+			if decoder.percentEncoded {
+				for indx, raw := range field.Raw {
+					field.Raw[indx] = header.PercentDecode(raw)
+				}
+			}
+		}
+
+		info.Fields = append(info.Fields, field)
+	}
+
+	return info, nil
+}
+
+// Check makes sure that the fields with the given IDs have the number of values that their
+// Number=A/R or fixed Number needs for the alternate alleles of the record. Fields that aren't in
+// the record are skipped. A single missing value is allowed for any Number
+func (info Info) Check(ids ...string) error {
+	for _, id := range ids {
+		field, found := info.Get(id)
+		if !found || field.Type == "Flag" || len(field.Raw) == 0 {
+			continue
+		}
+		expected, known := expectedCount(field.Number, info.altCount)
+		if !known || len(field.Raw) == expected || (len(field.Raw) == 1 && IsMissing(field.Raw[0])) {
+			continue
+		}
+		return fmt.Errorf("the INFO field %s has Number=%s so %d value(s) were expected for %d alternate allele(s) but %d were found", field.ID, field.Number, expected, info.altCount, len(field.Raw))
+	}
+	return nil
+}
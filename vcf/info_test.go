@@ -0,0 +1,65 @@
+package vcf
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAlleleFrequencies(t *testing.T) {
+	cases := []struct {
+		raw         []string
+		expected    []float64
+		unparseable int
+	}{
+		{[]string{"0.0001", "2e-3"}, []float64{0.0001, 0.002}, 0},
+		{[]string{".", "NA", "na", "-"}, []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN()}, 0},
+		// A list that was percent encoded as a single value is split into its alleles
+		{[]string{"0.0001%2C0.002"}, []float64{0.0001, 0.002}, 0},
+		{[]string{"abc", " 0.5 "}, []float64{math.NaN(), 0.5}, 1},
+	}
+	for _, test_case := range cases {
+		freqs, unparseable := InfoField{ID: "AF", Raw: test_case.raw}.AlleleFrequencies()
+		if unparseable != test_case.unparseable || len(freqs) != len(test_case.expected) {
+			t.Fatalf("expected %d frequencies with %d unparseable values for %v but got %v with %d", len(test_case.expected), test_case.unparseable, test_case.raw, freqs, unparseable)
+		}
+		for indx, freq := range freqs {
+			expected := test_case.expected[indx]
+			if freq != expected && !(math.IsNaN(freq) && math.IsNaN(expected)) {
+				t.Errorf("expected the frequency %g for %v but got %g", expected, test_case.raw, freq)
+			}
+		}
+	}
+}
+
+func TestInfoCheck(t *testing.T) {
+	metadata := &Metadata{}
+	metadata.AddLine(`##INFO=<ID=AF,Number=A,Type=Float,Description="Allele Frequency">`)
+	metadata.AddLine(`##INFO=<ID=AD,Number=R,Type=Integer,Description="Allele Depths">`)
+	metadata.AddLine(`##INFO=<ID=PL,Number=G,Type=Integer,Description="Genotype Likelihoods">`)
+	metadata.AddLine(`##INFO=<ID=END,Number=1,Type=Integer,Description="End Position">`)
+	decoder := NewInfoDecoder(metadata)
+
+	// A bad count in a field that isn't checked doesn't fail the record
+	info, decode_err := decoder.Decode("AF=0.1,0.2;AD=5;END=10,11;PL=0,1", 2)
+	if decode_err != nil {
+		t.Fatalf("expected the counts to be left for Check but got %s", decode_err)
+	}
+	if check_err := info.Check("AF", "MISSING"); check_err != nil {
+		t.Errorf("expected the AF with a value for each allele to pass but got %s", check_err)
+	}
+	// Number=G depends on the ploidy so a haploid PL isn't rejected
+	if check_err := info.Check("PL"); check_err != nil {
+		t.Errorf("expected the Number=G field to be skipped but got %s", check_err)
+	}
+	for _, id := range []string{"AD", "END"} {
+		if check_err := info.Check(id); check_err == nil {
+			t.Errorf("expected the count of %s to be rejected when it is checked", id)
+		}
+	}
+
+	// A single missing value is allowed for any Number
+	info, _ = decoder.Decode("AF=.;AD=.", 2)
+	if check_err := info.Check("AF", "AD"); check_err != nil {
+		t.Errorf("expected a single missing value to pass but got %s", check_err)
+	}
+}
@@ -0,0 +1,214 @@
+package vcf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+
+	"go-phers-parser/internal/genotype"
+)
+
+// The 2 bit codes of the calls in a GenotypeMatrix. A code is the number of alternate alleles in
+// the call so haploid carriers are stored as MatrixOneAlt and calls with more than two alternate
+// alleles (from polyploid callers) are stored as MatrixTwoAlt
+const (
+	MatrixNoAlt   uint8 = iota // every allele is the reference
+	MatrixOneAlt               // one alternate allele
+	MatrixTwoAlt               // two (or more) alternate alleles
+	MatrixMissing              // at least one allele is missing (or the call has no GT)
+)
+
+const (
+	callsPerWord = 32 // each uint64 holds the 2 bit codes of 32 calls
+	lowBits      = 0x5555555555555555
+)
+
+// MatrixVariant is the fixed columns that a GenotypeMatrix keeps for each row
+type MatrixVariant struct {
+	Chrom string
+	Pos   int
+	ID    string
+	Ref   string
+	Alt   string // the alternate alleles separated by commas
+}
+
+// Key is the variant in the form chrom_pos_ref/alt (the same as Variant.Key)
+func (variant MatrixVariant) Key() string {
+	return fmt.Sprintf("%s_%d_%s/%s", variant.Chrom, variant.Pos, variant.Ref, variant.Alt)
+}
+
+// MatrixCounts counts the calls of a variant or of a sample by their code
+type MatrixCounts struct {
+	NoAlt   int
+	OneAlt  int
+	TwoAlt  int
+	Missing int
+}
+
+// Carriers is the number of calls with at least one alternate allele
+func (counts MatrixCounts) Carriers() int {
+	return counts.OneAlt + counts.TwoAlt
+}
+
+// GenotypeMatrix keeps the calls of many variants in memory with 2 bits per call so that the
+// calls can be counted again without reading the vcf again. A cohort of 100,000 samples takes
+// about 25KB for each variant. The rows are the variants in the order that they were added and
+// the columns are the samples in the order of the vcf header
+type GenotypeMatrix struct {
+	Samples  *SampleIndex
+	Skipped  int // malformed records that ReadMatrix skipped
+	variants []MatrixVariant
+	rows     map[string]int // the row of each variant by its key and by its id
+	words    int            // the uint64 words in each row
+	calls    []uint64
+}
+
+// NewGenotypeMatrix creates an empty matrix for the samples of a vcf header
+func NewGenotypeMatrix(samples []string) *GenotypeMatrix {
+	return &GenotypeMatrix{
+		Samples: NewSampleIndex(samples),
+		rows:    make(map[string]int),
+		words:   (len(samples) + callsPerWord - 1) / callsPerWord,
+	}
+}
+
+// matrix_code converts a sample call into its 2 bit code
+func matrix_code(call string) uint8 {
+	alt_count, ref_count := genotype.AlleleCounts(call)
+	ploidy := genotype.Ploidy(call)
+	if ploidy == 0 || alt_count+ref_count < ploidy {
+		return MatrixMissing
+	}
+	return uint8(min(alt_count, 2))
+}
+
+// Add appends the calls of the variant as a new row. The variant has to have a call for every
+// sample of the matrix
+func (matrix *GenotypeMatrix) Add(variant *Variant) error {
+	if len(variant.Calls) != matrix.Samples.Len() {
+		return fmt.Errorf("the variant %s has %d calls but the matrix has %d samples", variant.ID, len(variant.Calls), matrix.Samples.Len())
+	}
+	row := make([]uint64, matrix.words)
+	for indx, call := range variant.Calls {
+		row[indx/callsPerWord] |= uint64(matrix_code(call)) << (2 * (indx % callsPerWord))
+	}
+	matrix.calls = append(matrix.calls, row...)
+
+	row_indx := len(matrix.variants)
+	stored := MatrixVariant{Chrom: variant.Chrom, Pos: variant.Pos, ID: variant.ID, Ref: variant.Ref, Alt: strings.Join(variant.Alt, ",")}
+	matrix.variants = append(matrix.variants, stored)
+	// The first variant with a key or an id keeps it
+	for _, key := range []string{stored.Key(), stored.ID} {
+		if _, seen := matrix.rows[key]; !seen && !IsMissing(key) {
+			matrix.rows[key] = row_indx
+		}
+	}
+	return nil
+}
+
+// Len is the number of variants (rows) in the matrix
+func (matrix *GenotypeMatrix) Len() int {
+	return len(matrix.variants)
+}
+
+// Variant returns the fixed columns of the row
+func (matrix *GenotypeMatrix) Variant(row int) MatrixVariant {
+	return matrix.variants[row]
+}
+
+// Row finds the row of a variant by its id or by its key (chrom_pos_ref/alt). The bool is false
+// if the variant isn't in the matrix
+func (matrix *GenotypeMatrix) Row(id_or_key string) (int, bool) {
+	row, found := matrix.rows[id_or_key]
+	return row, found
+}
+
+// row_words returns the packed calls of the row
+func (matrix *GenotypeMatrix) row_words(row int) []uint64 {
+	return matrix.calls[row*matrix.words : (row+1)*matrix.words]
+}
+
+// Call returns the code of the call of the sample (its position in Samples) for the row
+func (matrix *GenotypeMatrix) Call(row int, sample int) uint8 {
+	word := matrix.row_words(row)[sample/callsPerWord]
+	return uint8(word>>(2*(sample%callsPerWord))) & 3
+}
+
+// VariantCounts counts the calls of the row. The codes are counted a whole word at a time
+func (matrix *GenotypeMatrix) VariantCounts(row int) MatrixCounts {
+	var counts MatrixCounts
+	for _, word := range matrix.row_words(row) {
+		low, high := word&lowBits, (word>>1)&lowBits
+		counts.Missing += bits.OnesCount64(low & high)
+		counts.OneAlt += bits.OnesCount64(low &^ high)
+		counts.TwoAlt += bits.OnesCount64(high &^ low)
+	}
+	// The padding at the end of the last word is zero so the reference calls are what is left
+	counts.NoAlt = matrix.Samples.Len() - counts.Missing - counts.OneAlt - counts.TwoAlt
+	return counts
+}
+
+// AlleleCount returns the alternate allele count of the row and the number of samples with a
+// complete call. Each call adds its code so haploid and polyploid calls are counted as described
+// for the codes
+func (matrix *GenotypeMatrix) AlleleCount(row int) (int, int) {
+	counts := matrix.VariantCounts(row)
+	return counts.OneAlt + 2*counts.TwoAlt, matrix.Samples.Len() - counts.Missing
+}
+
+// SampleCounts counts the calls of the sample (its position in Samples) across every row
+func (matrix *GenotypeMatrix) SampleCounts(sample int) MatrixCounts {
+	var counts MatrixCounts
+	for row := range matrix.variants {
+		switch matrix.Call(row, sample) {
+		case MatrixNoAlt:
+			counts.NoAlt++
+		case MatrixOneAlt:
+			counts.OneAlt++
+		case MatrixTwoAlt:
+			counts.TwoAlt++
+		default:
+			counts.Missing++
+		}
+	}
+	return counts
+}
+
+// Carriers returns the positions (in Samples) of the samples with at least one alternate allele in the row
+func (matrix *GenotypeMatrix) Carriers(row int) []int {
+	var carriers []int
+	for word_indx, word := range matrix.row_words(row) {
+		// A call has an alternate allele when exactly one of its 2 bits is set
+		carrying := (word ^ (word >> 1)) & lowBits
+		for carrying != 0 {
+			offset := bits.TrailingZeros64(carrying)
+			carriers = append(carriers, word_indx*callsPerWord+offset/2)
+			carrying &= carrying - 1
+		}
+	}
+	return carriers
+}
+
+// ReadMatrix reads the rest of the records (or of the region from the last Seek) into a new
+// GenotypeMatrix. Malformed records are skipped and counted in Skipped like the commands do
+func (reader *Reader) ReadMatrix() (*GenotypeMatrix, error) {
+	matrix := NewGenotypeMatrix(reader.Samples)
+	for {
+		variant, read_err := reader.Read()
+		if errors.Is(read_err, io.EOF) {
+			return matrix, nil
+		}
+		if errors.Is(read_err, ErrMalformedRecord) {
+			matrix.Skipped++
+			continue
+		}
+		if read_err != nil {
+			return matrix, read_err
+		}
+		if add_err := matrix.Add(variant); add_err != nil {
+			return matrix, add_err
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package vcf
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGenotypeMatrix(t *testing.T) {
+	// 40 samples so that the calls of a row span two words
+	samples := make([]string, 40)
+	for indx := range samples {
+		samples[indx] = fmt.Sprintf("S%d", indx+1)
+	}
+	calls := func(special map[int]string) string {
+		row := make([]string, len(samples))
+		for indx := range row {
+			row[indx] = "0/0"
+			if call, found := special[indx]; found {
+				row[indx] = call
+			}
+		}
+		return strings.Join(row, "\t")
+	}
+	stream := strings.Join([]string{
+		"##fileformat=VCFv4.2",
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\t" + strings.Join(samples, "\t"),
+		"chr1\t100\trs1\tA\tG\t.\tPASS\t.\tGT:DP\t" + calls(map[int]string{0: "0/1:12", 33: "1|1", 39: "./.", 5: "./1"}),
+		"chr1\tnot_a_position\trs2\tA\tG\t.\tPASS\t.\tGT\t" + calls(nil),
+		"chr1\t200\t.\tC\tT,G\t.\tPASS\t.\tGT\t" + calls(map[int]string{0: "1/2", 1: "1", 2: "0/0/1/1/1"}),
+	}, "\n") + "\n"
+
+	reader, open_err := NewReader(strings.NewReader(stream), 0)
+	if open_err != nil {
+		t.Fatalf("unable to read the header: %s", open_err)
+	}
+	matrix, read_err := reader.ReadMatrix()
+	if read_err != nil {
+		t.Fatalf("unable to read the matrix: %s", read_err)
+	}
+	if matrix.Len() != 2 || matrix.Skipped != 1 {
+		t.Fatalf("expected 2 rows and 1 skipped record but got %d rows and %d skipped", matrix.Len(), matrix.Skipped)
+	}
+
+	first, found := matrix.Row("rs1")
+	if !found || matrix.Call(first, 0) != MatrixOneAlt || matrix.Call(first, 33) != MatrixTwoAlt || matrix.Call(first, 5) != MatrixMissing {
+		t.Errorf("expected rs1 to be the first row with the calls 0/1, 1|1, and ./1 stored as %d, %d, and %d", MatrixOneAlt, MatrixTwoAlt, MatrixMissing)
+	}
+	if counts := matrix.VariantCounts(first); counts != (MatrixCounts{NoAlt: 36, OneAlt: 1, TwoAlt: 1, Missing: 2}) {
+		t.Errorf("expected the counts of rs1 to be 36/1/1/2 but got %+v", counts)
+	}
+	if ac, called := matrix.AlleleCount(first); ac != 3 || called != 38 {
+		t.Errorf("expected an allele count of 3 in 38 called samples for rs1 but got %d in %d", ac, called)
+	}
+	if carriers := matrix.Carriers(first); !slices.Equal(carriers, []int{0, 33}) {
+		t.Errorf("expected the carriers of rs1 to be the samples 0 and 33 but got %v", carriers)
+	}
+
+	// The second record doesn't have an id so it can only be found by its key
+	second, found := matrix.Row("chr1_200_C/T,G")
+	if !found || second != 1 || matrix.Variant(second).Alt != "T,G" {
+		t.Fatalf("expected to find the multi-allelic record by its key")
+	}
+	if ac, _ := matrix.AlleleCount(second); ac != 5 {
+		t.Errorf("expected 1/2, a haploid 1, and 0/0/1/1/1 to add up to an allele count of 5 but got %d", ac)
+	}
+	if counts := matrix.SampleCounts(0); counts != (MatrixCounts{OneAlt: 1, TwoAlt: 1}) {
+		t.Errorf("expected the first sample to have one het and one hom alt call but got %+v", counts)
+	}
+	if counts := matrix.SampleCounts(39); counts.Missing != 1 || counts.NoAlt != 1 || counts.Carriers() != 0 {
+		t.Errorf("expected the last sample to have one missing and one reference call but got %+v", counts)
+	}
+
+	if add_err := matrix.Add(&Variant{ID: "short", Calls: []string{"0/1"}}); add_err == nil {
+		t.Errorf("expected a variant without a call for every sample to be rejected")
+	}
+}
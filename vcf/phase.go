@@ -0,0 +1,14 @@
+package vcf
+
+import "go-phers-parser/internal/genotype"
+
+// Phase is the phasing of a heterozygous call. Haplotype is the index of the allele in the GT that
+// carries the alternate allele (0 for 1|0 and 1 for 0|1). PhaseSet is the PS value of the call.
+// Phase.Relation reports whether two calls are in cis or in trans
+type Phase = genotype.Phase
+
+// CallPhase returns the phase of a heterozygous call. Calls that are unphased, missing the GT, or
+// not heterozygous are returned as unphased
+func CallPhase(format string, call string) Phase {
+	return genotype.CallPhase(format, call)
+}
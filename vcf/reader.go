@@ -0,0 +1,286 @@
+package vcf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"go-phers-parser/internal/contig"
+	"go-phers-parser/internal/files"
+	"go-phers-parser/internal/model"
+	"go-phers-parser/internal/tabix"
+
+	gzip "github.com/klauspost/pgzip"
+)
+
+// ErrNotIndexed is returned by Reader.Seek when the vcf doesn't have a tabix index
+var ErrNotIndexed = errors.New("the vcf file does not have a tabix index")
+
+// Region is a 1-based inclusive interval on a contig
+type Region struct {
+	Chrom string
+	Start int
+	End   int
+}
+
+func (region Region) String() string {
+	return fmt.Sprintf("%s:%d-%d", region.Chrom, region.Start, region.End)
+}
+
+// Reader reads the records of a vcf one at a time. Files that are bgzipped and have a .tbi index
+// next to them can be read out of order by calling Seek with the region to read. Without a
+// Seek the records are read from the start of the file
+type Reader struct {
+	Metadata   *Metadata
+	Samples    []string
+	Index      *SampleIndex // position of each sample in Samples (and in Variant.Calls)
+	filename   string
+	buffersize int
+	index      *tabix.Index
+	source     io.Closer
+	scanner    *bufio.Scanner
+	lines      *files.LineLimit
+	region     *Region // the region from the last Seek. This is nil when reading the whole file
+	contig_hit bool    // whether we have reached the contig of the region yet
+	line       int     // line number of the current record when reading the whole file
+}
+
+// Open reads the header of the vcf (plain, gzipped, or bgzipped and local or remote) and loads
+// the tabix index if there is a .tbi file next to it. The buffersize is the longest line that
+// can be read which has to fit the calls of every sample. A buffersize of files.AutoBuffersize
+// sizes the buffer from the number of samples in the header
+func Open(filename string, buffersize int) (*Reader, error) {
+	reader := &Reader{filename: filename, buffersize: buffersize}
+
+	source, open_err := open_vcf_source(filename)
+	if open_err != nil {
+		return nil, open_err
+	}
+	reader.set_source(source)
+
+	if header_err := reader.read_header(); header_err != nil {
+		reader.Close()
+		return nil, header_err
+	}
+
+	if strings.HasSuffix(filename, ".gz") || strings.HasSuffix(filename, ".bgz") {
+		index, index_err := tabix.ReadIndex(filename + ".tbi")
+		if index_err != nil && !errors.Is(index_err, os.ErrNotExist) {
+			reader.Close()
+			return nil, index_err
+		}
+		reader.index = index
+	}
+	return reader, nil
+}
+
+// NewReader reads a vcf from a stream like standard input. A stream can't be indexed so Seek
+// always returns ErrNotIndexed
+func NewReader(stream io.Reader, buffersize int) (*Reader, error) {
+	reader := &Reader{buffersize: buffersize}
+	reader.set_source(io.NopCloser(stream))
+	if header_err := reader.read_header(); header_err != nil {
+		return nil, header_err
+	}
+	return reader, nil
+}
+
+// open_vcf_source opens the file and decompresses it if it starts with the gzip magic bytes
+func open_vcf_source(filename string) (io.ReadCloser, error) {
+	fh, open_err := files.OpenSource(filename)
+	if open_err != nil {
+		return nil, fmt.Errorf("unable to open the vcf file %s: %w", filename, open_err)
+	}
+
+	buffered := bufio.NewReader(fh)
+	if magic, _ := buffered.Peek(2); !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{buffered, fh}, nil
+	}
+
+	gh, gzip_err := gzip.NewReader(buffered)
+	if gzip_err != nil {
+		fh.Close()
+		return nil, fmt.Errorf("unable to decompress the vcf file %s: %w", filename, gzip_err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gh, closers{gh, fh}}, nil
+}
+
+// closers closes the decompressor before the file that it reads from
+type closers []io.Closer
+
+func (handles closers) Close() error {
+	var first_err error
+	for _, handle := range handles {
+		if err := handle.Close(); err != nil && first_err == nil {
+			first_err = err
+		}
+	}
+	return first_err
+}
+
+func (reader *Reader) set_source(source io.ReadCloser) {
+	if reader.source != nil {
+		reader.source.Close()
+	}
+	reader.source = source
+	var lines *files.LineLimit
+	reader.scanner, lines = files.NewLineScanner(source, reader.buffersize)
+	// A Seek starts a new scanner after the header has been read so the samples are already known
+	if reader.Samples != nil || reader.Metadata != nil {
+		lines.SetSamples(len(reader.Samples))
+	}
+	reader.lines = lines
+}
+
+// read_header collects the "##" lines and the sample ids from the #CHROM line
+func (reader *Reader) read_header() error {
+	reader.Metadata = &Metadata{}
+	for reader.scanner.Scan() {
+		reader.line++
+		line := reader.scanner.Text()
+		if strings.HasPrefix(line, "##") {
+			reader.Metadata.AddLine(line)
+			continue
+		}
+		if !strings.HasPrefix(line, "#CHROM") {
+			return fmt.Errorf("expected the vcf header to end with a #CHROM line but found a record on line %d", reader.line)
+		}
+		if columns := strings.Split(strings.TrimSpace(line), "\t"); len(columns) > 9 {
+			reader.Samples = columns[9:]
+		}
+		reader.Index = NewSampleIndex(reader.Samples)
+		reader.lines.SetSamples(len(reader.Samples))
+		reader.Metadata.HeaderLines = reader.line
+		return nil
+	}
+	if reader.scanner.Err() != nil {
+		return fmt.Errorf("encountered the following error while reading the vcf header: %w", reader.scanner.Err())
+	}
+	return fmt.Errorf("the vcf stream ended before the #CHROM header line was found")
+}
+
+// Indexed reports whether Seek can be used
+func (reader *Reader) Indexed() bool {
+	return reader.index != nil
+}
+
+// Seek moves the reader to the first record that starts inside of the region. Read then returns
+// the records of the region and io.EOF once the records move past the end of the region. The
+// contig of the region can use either naming style (chr22 or 22)
+func (reader *Reader) Seek(region Region) error {
+	if reader.index == nil {
+		return ErrNotIndexed
+	}
+	if region.Start < 1 || region.End < region.Start {
+		return fmt.Errorf("the region %s is not a valid 1-based region", region)
+	}
+
+	reader.region = &region
+	reader.contig_hit = false
+
+	offset, found := reader.index.Offset(region.Chrom, region.Start, region.End)
+	if !found {
+		// The index has no records for the region so every Read returns io.EOF
+		reader.set_source(io.NopCloser(strings.NewReader("")))
+		return nil
+	}
+
+	seeker, seek_err := tabix.OpenAt(reader.filename, offset)
+	if seek_err != nil {
+		return seek_err
+	}
+	reader.set_source(seeker)
+	return nil
+}
+
+// Read returns the next record. io.EOF is returned at the end of the file or the end of the
+// region from the last Seek. Records that can't be parsed return an error that wraps
+// ErrMalformedRecord so that callers can skip them and keep reading
+func (reader *Reader) Read() (*Variant, error) {
+	for reader.scanner.Scan() {
+		line := strings.TrimRight(reader.scanner.Text(), "\r\n")
+		if reader.region == nil {
+			reader.line++
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		columns := strings.Split(line, "\t")
+
+		if reader.region != nil {
+			in_region, done, region_err := reader.check_region(columns)
+			if region_err != nil {
+				return nil, region_err
+			} else if done {
+				reader.set_source(io.NopCloser(strings.NewReader("")))
+				return nil, io.EOF
+			} else if !in_region {
+				continue
+			}
+		}
+
+		variant, parse_err := model.ParseVariant(columns)
+		if parse_err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrMalformedRecord, reader.describe(parse_err))
+		}
+		if len(variant.Calls) != len(reader.Samples) {
+			return nil, fmt.Errorf("%w: %s", ErrMalformedRecord, reader.describe(fmt.Errorf("the record has %d calls but the header has %d samples", len(variant.Calls), len(reader.Samples))))
+		}
+		return variant, nil
+	}
+
+	if reader.scanner.Err() != nil {
+		return nil, reader.scanner.Err()
+	}
+	return nil, io.EOF
+}
+
+// check_region decides if the record starts inside of the region from the last Seek. The blocks
+// before the region can have records from other contigs so we are only done once we have
+// moved past the contig of the region or past the end of the region
+func (reader *Reader) check_region(columns []string) (bool, bool, error) {
+	if len(columns) < 2 {
+		return false, false, nil
+	}
+	if !contig.Same(columns[0], reader.region.Chrom) {
+		return false, reader.contig_hit, nil
+	}
+	reader.contig_hit = true
+
+	pos, pos_err := strconv.Atoi(columns[1])
+	if pos_err != nil {
+		return false, false, fmt.Errorf("%w: the position %s of a record in the region %s is not an integer", ErrMalformedRecord, columns[1], reader.region)
+	}
+	return pos >= reader.region.Start && pos <= reader.region.End, pos > reader.region.End, nil
+}
+
+// describe adds the location of the record to the error. The line number is only known when
+// we read the whole file because a Seek starts in the middle of the file
+func (reader *Reader) describe(err error) string {
+	if reader.region != nil {
+		return fmt.Sprintf("a record in the region %s: %s", reader.region, err)
+	}
+	return fmt.Sprintf("line %d: %s", reader.line, err)
+}
+
+// Close closes the vcf file
+func (reader *Reader) Close() error {
+	if reader.source == nil {
+		return nil
+	}
+	close_err := reader.source.Close()
+	reader.source = nil
+	return close_err
+}
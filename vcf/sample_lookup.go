@@ -0,0 +1,162 @@
+package vcf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"go-phers-parser/internal/files"
+)
+
+// ErrMalformedRecord is wrapped by the errors for records that could not be parsed. Callers can
+// use errors.Is to skip these records and keep reading the stream
+var ErrMalformedRecord = errors.New("malformed vcf record")
+
+// SampleRecord is a single vcf record reduced to the fixed columns and the call of one sample
+type SampleRecord struct {
+	Chrom    string
+	Pos      int
+	ID       string
+	Ref      string
+	Alt      string
+	Qual     string
+	Filter   string
+	Info     string
+	Format   string
+	Call     string
+	Genotype Genotype
+	Line     int // line number of the record in the stream
+}
+
+// SampleLookup reads a vcf stream and only pulls out the column for one sample. The other sample
+// columns are skipped without being split which matters for wide callsets with hundreds of
+// thousands of samples
+type SampleLookup struct {
+	Metadata    *Metadata
+	SampleID    string
+	SampleIndex int // column index of the sample (0-based and including the 9 fixed columns)
+	scanner     *bufio.Scanner
+	line        int
+}
+
+// NewSampleLookup reads the header of the vcf stream and finds the column of the sample
+func NewSampleLookup(reader io.Reader, sample_id string, buffersize int) (*SampleLookup, error) {
+	scanner, lines := files.NewLineScanner(reader, buffersize)
+
+	lookup := &SampleLookup{Metadata: &Metadata{}, SampleID: sample_id, SampleIndex: -1, scanner: scanner}
+
+	for scanner.Scan() {
+		lookup.line++
+		line := scanner.Text()
+		if strings.HasPrefix(line, "##") {
+			lookup.Metadata.AddLine(line)
+			continue
+		}
+		if !strings.HasPrefix(line, "#CHROM") {
+			return nil, fmt.Errorf("expected the vcf header to end with a #CHROM line but found a record on line %d", lookup.line)
+		}
+
+		columns := strings.Split(strings.TrimSpace(line), "\t")
+		lines.SetSamples(max(len(columns)-9, 0))
+		for indx, column := range columns {
+			if indx >= 9 && column == sample_id {
+				lookup.SampleIndex = indx
+				break
+			}
+		}
+		if lookup.SampleIndex == -1 {
+			return nil, fmt.Errorf("the sample %s was not found in the header of the vcf file", sample_id)
+		}
+		lookup.Metadata.HeaderLines = lookup.line
+		return lookup, nil
+	}
+
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("encountered the following error while reading the vcf header: %w", scanner.Err())
+	}
+	return nil, fmt.Errorf("the vcf stream ended before the #CHROM header line was found")
+}
+
+// nthField returns the field at the 0-based index without splitting the rest of the line
+func nthField(line string, indx int) (string, bool) {
+	for i := 0; i < indx; i++ {
+		tab_indx := strings.IndexByte(line, '\t')
+		if tab_indx == -1 {
+			return "", false
+		}
+		line = line[tab_indx+1:]
+	}
+	if tab_indx := strings.IndexByte(line, '\t'); tab_indx != -1 {
+		line = line[:tab_indx]
+	}
+	return strings.TrimRight(line, "\r\n"), true
+}
+
+// Next returns the next record. io.EOF is returned once the stream has been read completely
+func (lookup *SampleLookup) Next() (*SampleRecord, error) {
+	if !lookup.scanner.Scan() {
+		if lookup.scanner.Err() != nil {
+			return nil, lookup.scanner.Err()
+		}
+		return nil, io.EOF
+	}
+	lookup.line++
+	line := lookup.scanner.Text()
+
+	fixed := strings.SplitN(line, "\t", 10)
+	if len(fixed) < 10 {
+		return nil, fmt.Errorf("%w: the record on line %d only had %d columns", ErrMalformedRecord, lookup.line, len(fixed))
+	}
+
+	call, found := nthField(fixed[9], lookup.SampleIndex-9)
+	if !found {
+		return nil, fmt.Errorf("%w: the record on line %d does not have a column for the sample %s", ErrMalformedRecord, lookup.line, lookup.SampleID)
+	}
+
+	pos, pos_err := strconv.Atoi(fixed[1])
+	if pos_err != nil {
+		return nil, fmt.Errorf("%w: unable to parse the position %s on line %d: %s", ErrMalformedRecord, fixed[1], lookup.line, pos_err)
+	}
+
+	return &SampleRecord{
+		Chrom:    fixed[0],
+		Pos:      pos,
+		ID:       fixed[2],
+		Ref:      fixed[3],
+		Alt:      fixed[4],
+		Qual:     fixed[5],
+		Filter:   fixed[6],
+		Info:     fixed[7],
+		Format:   fixed[8],
+		Call:     call,
+		Genotype: ParseGenotype(call),
+		Line:     lookup.line,
+	}, nil
+}
+
+// LookupCarrier returns every record in the stream where the sample carries an alternate allele.
+// The keep function can be used to apply extra filters (such as a frequency cap). If keep is nil
+// then every carried variant is returned
+func LookupCarrier(reader io.Reader, sample_id string, buffersize int, keep func(*SampleRecord) bool) ([]*SampleRecord, error) {
+	lookup, err := NewSampleLookup(reader, sample_id, buffersize)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*SampleRecord
+	for {
+		record, next_err := lookup.Next()
+		if next_err == io.EOF {
+			return records, nil
+		} else if next_err != nil {
+			return records, next_err
+		}
+
+		if record.Genotype.HasAlt() && (keep == nil || keep(record)) {
+			records = append(records, record)
+		}
+	}
+}
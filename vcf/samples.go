@@ -0,0 +1,13 @@
+package vcf
+
+import "go-phers-parser/internal/model"
+
+// SampleIndex looks up the position of a sample without scanning the list of samples
+type SampleIndex = model.SampleIndex
+
+// NewSampleIndex builds a SampleIndex for the sample ids. The position of a sample in the index
+// is its position in ids so the index of a vcf header's samples gives the position of the call
+// in Variant.Calls (and the column of the call is the position plus 9)
+func NewSampleIndex(ids []string) *SampleIndex {
+	return model.NewSampleIndex(ids)
+}